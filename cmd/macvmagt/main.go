@@ -1,51 +1,442 @@
-package main
-
-import (
-	"log"
-	"os"
-
-	"github.com/changty97/macvmagt/internal/agent"
-	"github.com/changty97/macvmagt/internal/config"
-	"github.com/spf13/cobra"
-)
-
-var cfg *config.Config // Global config variable
-
-func init() {
-	// Load configuration early
-	cfg = config.LoadConfig()
-
-	// Use config values as defaults for Cobra flags
-	rootCmd.PersistentFlags().StringVar(&cfg.NodeID, "node-id", cfg.NodeID, "Unique identifier for this Mac Mini")
-	rootCmd.PersistentFlags().StringVar(&cfg.OrchestratorURL, "orchestrator-url", cfg.OrchestratorURL, "URL of the macvmorx orchestrator")
-	rootCmd.PersistentFlags().DurationVar(&cfg.HeartbeatInterval, "heartbeat-interval", cfg.HeartbeatInterval, "Interval for sending heartbeats to the orchestrator")
-	rootCmd.PersistentFlags().StringVar(&cfg.ImageCacheDir, "image-cache-dir", cfg.ImageCacheDir, "Directory to store cached VM images")
-	rootCmd.PersistentFlags().IntVar(&cfg.MaxCachedImages, "max-cached-images", cfg.MaxCachedImages, "Maximum number of images to keep in cache (LRU)")
-	rootCmd.PersistentFlags().StringVar(&cfg.GCSBucketName, "gcs-bucket-name", cfg.GCSBucketName, "GCP Cloud Storage bucket name for images")
-	rootCmd.PersistentFlags().StringVar(&cfg.GCPCredentialsPath, "gcp-credentials-path", cfg.GCPCredentialsPath, "Path to GCP service account key JSON file (optional)")
-}
-
-var rootCmd = &cobra.Command{
-	Use:   "macvmagt",
-	Short: "macvmagt runs on Mac Minis to manage VMs and report status.",
-	Long: `The MacVMOrx Agent is responsible for sending heartbeats to the orchestrator,
-provisioning and deleting virtual machines, and managing a local cache of VM images.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		startAgent()
-	},
-}
-
-func startAgent() {
-	agent, err := agent.NewAgent(cfg)
-	if err != nil {
-		log.Fatalf("Failed to initialize agent: %v", err)
-	}
-	agent.Start()
-}
-
-func main() {
-	if err := rootCmd.Execute(); err != nil {
-		log.Fatalf("Error executing command: %v", err)
-		os.Exit(1)
-	}
-}
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/agent"
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/doctor"
+	"github.com/changty97/macvmagt/internal/fakedriver"
+	"github.com/changty97/macvmagt/internal/logrotate"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/selfupdate"
+	"github.com/changty97/macvmagt/internal/sshclient"
+	"github.com/changty97/macvmagt/internal/supportbundle"
+	"github.com/changty97/macvmagt/internal/utils"
+	"github.com/changty97/macvmagt/internal/version"
+	"github.com/changty97/macvmagt/internal/vmgr"
+	"github.com/changty97/macvmagt/internal/vmprofiles"
+	"github.com/spf13/cobra"
+)
+
+var cfg *config.Config // Global config variable
+
+func init() {
+	// Load configuration early
+	cfg = config.LoadConfig()
+	cobra.OnInitialize(cfg.ResolvePaths, setupCommandRunner) // Once flags are parsed, so --data-root applies
+
+	// Use config values as defaults for Cobra flags
+	rootCmd.PersistentFlags().StringVar(&cfg.NodeID, "node-id", cfg.NodeID, "Unique identifier for this Mac Mini")
+	rootCmd.PersistentFlags().StringVar(&cfg.OrchestratorURL, "orchestrator-url", cfg.OrchestratorURL, "URL of the macvmorx orchestrator")
+	rootCmd.PersistentFlags().DurationVar(&cfg.HeartbeatInterval, "heartbeat-interval", cfg.HeartbeatInterval, "Interval for sending heartbeats to the orchestrator")
+	rootCmd.PersistentFlags().BoolVar(&cfg.HeartbeatDeltas, "heartbeat-deltas", cfg.HeartbeatDeltas, "Offer differential heartbeats that send only changes to VMs and cached images, if the orchestrator supports them")
+	rootCmd.PersistentFlags().DurationVar(&cfg.FullHeartbeatInterval, "full-heartbeat-interval", cfg.FullHeartbeatInterval, "With differential heartbeats, how often the full state is sent anyway")
+	rootCmd.PersistentFlags().BoolVar(&cfg.HeartbeatCommands, "heartbeat-commands", cfg.HeartbeatCommands, "Run commands the orchestrator sends in heartbeat responses: cordon, uncordon, prefetch-image, set-interval and delete-vm")
+	rootCmd.PersistentFlags().StringVar(&cfg.DataRoot, "data-root", cfg.DataRoot, "Directory the image cache, VMs, state, secrets and SSH key directories are created under unless set individually")
+	rootCmd.PersistentFlags().StringVar(&cfg.ImageCacheDir, "image-cache-dir", cfg.ImageCacheDir, "Directory to store cached VM images (default <data-root>/images_cache)")
+	rootCmd.PersistentFlags().StringVar(&cfg.VMsDir, "vms-dir", cfg.VMsDir, "Directory holding one working directory per VM (default <data-root>/vms)")
+	rootCmd.PersistentFlags().StringVar(&cfg.VMsDirMode, "vms-dir-mode", cfg.VMsDirMode, "Octal permissions the VMs directory is created with")
+	rootCmd.PersistentFlags().IntVar(&cfg.MaxCachedImages, "max-cached-images", cfg.MaxCachedImages, "Maximum number of images to keep in cache (LRU)")
+	rootCmd.PersistentFlags().IntVar(&cfg.MaxConcurrentDownloads, "max-concurrent-downloads", cfg.MaxConcurrentDownloads, "Number of image downloads run at once; more are queued")
+	rootCmd.PersistentFlags().Int64Var(&cfg.DownloadRateLimit, "download-rate-limit", cfg.DownloadRateLimit, "Combined rate of image downloads in bytes per second (0 means unlimited)")
+	rootCmd.PersistentFlags().Int64Var(&cfg.DownloadBusyRateLimit, "download-busy-rate-limit", cfg.DownloadBusyRateLimit, "Lower combined rate of image downloads in bytes per second while VMs are running jobs (0 disables it)")
+	rootCmd.PersistentFlags().BoolVar(&cfg.ImageSmokeTest, "image-smoke-test", cfg.ImageSmokeTest, "Boot each newly downloaded image in a throwaway VM and validate it before it is used for provisioning")
+	rootCmd.PersistentFlags().StringVar(&cfg.ImageSmokeTestScript, "image-smoke-test-script", cfg.ImageSmokeTestScript, "Path on the host of the validation script run inside the smoke test VM (empty = only check that it boots and answers SSH)")
+	rootCmd.PersistentFlags().DurationVar(&cfg.ImageSmokeTestTimeout, "image-smoke-test-timeout", cfg.ImageSmokeTestTimeout, "Maximum duration of an image smoke test")
+	rootCmd.PersistentFlags().StringVar(&cfg.ImageVerify, "image-verify", cfg.ImageVerify, "How cached images are verified before VMs are created from them: fast (rehash only if size or mtime changed), full (rehash every time) or off")
+	rootCmd.PersistentFlags().StringVar(&cfg.GCSBucketName, "gcs-bucket-name", cfg.GCSBucketName, "GCP Cloud Storage bucket name for images")
+	rootCmd.PersistentFlags().StringVar(&cfg.GCPCredentialsPath, "gcp-credentials-path", cfg.GCPCredentialsPath, "Path to GCP service account key JSON file (optional)")
+	rootCmd.PersistentFlags().StringVar(&cfg.VMSSHUser, "vm-ssh-user", cfg.VMSSHUser, "SSH user configured inside the VM images")
+	rootCmd.PersistentFlags().StringVar(&cfg.VMSSHKeyPath, "vm-ssh-key-path", cfg.VMSSHKeyPath, "Path to the private key used to SSH into VMs (default <data-root>/ssh/id_ed25519)")
+	rootCmd.PersistentFlags().BoolVar(&cfg.VMSSHInsecureHostKey, "vm-ssh-insecure-host-key", cfg.VMSSHInsecureHostKey, "Disable VM SSH host key verification (development only)")
+	rootCmd.PersistentFlags().StringVar(&cfg.RunnerScriptPath, "runner-script-path", cfg.RunnerScriptPath, "Path to the GitHub runner install script executed inside VMs")
+	rootCmd.PersistentFlags().IntVar(&cfg.RunnerInstallAttempts, "runner-install-attempts", cfg.RunnerInstallAttempts, "Number of attempts to install the GitHub runner before tearing the VM down")
+	rootCmd.PersistentFlags().DurationVar(&cfg.RunnerInstallRetryDelay, "runner-install-retry-delay", cfg.RunnerInstallRetryDelay, "Delay between GitHub runner install attempts")
+	rootCmd.PersistentFlags().DurationVar(&cfg.RunnerInstallTimeout, "runner-install-timeout", cfg.RunnerInstallTimeout, "Maximum duration of a single GitHub runner install attempt before it is aborted")
+	rootCmd.PersistentFlags().StringVar(&cfg.RunnerScriptInterpreter, "runner-script-interpreter", cfg.RunnerScriptInterpreter, "Interpreter inside the VM that runs the runner install script (e.g. bash, zsh)")
+	rootCmd.PersistentFlags().StringVar(&cfg.RunnerConfirmation, "runner-confirmation", cfg.RunnerConfirmation, "How GitHub runner registration is confirmed after the install script: off, file (the runner's .runner file) or github (online in the GitHub API)")
+	rootCmd.PersistentFlags().DurationVar(&cfg.RunnerConfirmTimeout, "runner-confirm-timeout", cfg.RunnerConfirmTimeout, "How long to wait for a new runner to show up in its .runner file or online in the GitHub API")
+	rootCmd.PersistentFlags().DurationVar(&cfg.ProvisionStepTimeout, "provision-step-timeout", cfg.ProvisionStepTimeout, "Default timeout of custom provisioning steps in a provision request")
+	rootCmd.PersistentFlags().DurationVar(&cfg.ImageDownloadTimeout, "image-download-timeout", cfg.ImageDownloadTimeout, "How long a provision waits for its image to download before it fails")
+	rootCmd.PersistentFlags().DurationVar(&cfg.VMCreateTimeout, "vm-create-timeout", cfg.VMCreateTimeout, "How long cloning the image and starting a VM may take before the provision fails")
+	rootCmd.PersistentFlags().DurationVar(&cfg.IPTimeout, "ip-timeout", cfg.IPTimeout, "How long a booted VM may take to get an IP address before the provision fails")
+	rootCmd.PersistentFlags().DurationVar(&cfg.SSHReadyTimeout, "ssh-ready-timeout", cfg.SSHReadyTimeout, "How long a VM with an IP address may take to answer SSH before the provision fails")
+	rootCmd.PersistentFlags().StringVar(&cfg.StateDir, "state-dir", cfg.StateDir, "Directory for persistent agent state such as utilization history (default <data-root>/state)")
+	rootCmd.PersistentFlags().StringVar(&cfg.SecretsProvider, "secrets-provider", cfg.SecretsProvider, "Secrets provider for the runner registration token: env, file or gcp")
+	rootCmd.PersistentFlags().StringVar(&cfg.SecretsDir, "secrets-dir", cfg.SecretsDir, "Directory with one file per secret (file provider, default <data-root>/secrets)")
+	rootCmd.PersistentFlags().StringVar(&cfg.GCPProject, "gcp-project", cfg.GCPProject, "GCP project for Secret Manager (gcp provider)")
+	rootCmd.PersistentFlags().StringVar(&cfg.RunnerTokenSecret, "runner-token-secret", cfg.RunnerTokenSecret, "Name of the secret holding the GitHub runner registration token")
+	rootCmd.PersistentFlags().BoolVar(&cfg.RunnerPackageCache, "runner-package-cache", cfg.RunnerPackageCache, "Cache the GitHub runner package on the host and upload it into VMs instead of downloading it in each VM")
+	rootCmd.PersistentFlags().StringVar(&cfg.RunnerPackageDir, "runner-package-dir", cfg.RunnerPackageDir, "Directory cached GitHub runner packages are kept in (default <data-root>/runner_packages)")
+	rootCmd.PersistentFlags().StringVar(&cfg.RunnerVersion, "runner-version", cfg.RunnerVersion, "GitHub runner version to cache, e.g. 2.319.1; empty for the latest")
+	rootCmd.PersistentFlags().StringVar(&cfg.BuildkiteScriptPath, "buildkite-script-path", cfg.BuildkiteScriptPath, "Path to the Buildkite agent install script executed inside VMs of workload buildkite")
+	rootCmd.PersistentFlags().StringVar(&cfg.BuildkiteTokenSecret, "buildkite-token-secret", cfg.BuildkiteTokenSecret, "Name of the secret holding the Buildkite agent token")
+	rootCmd.PersistentFlags().StringVar(&cfg.GitLabScriptPath, "gitlab-script-path", cfg.GitLabScriptPath, "Path to the GitLab runner install script executed inside VMs of workload gitlab")
+	rootCmd.PersistentFlags().StringVar(&cfg.GitLabTokenSecret, "gitlab-token-secret", cfg.GitLabTokenSecret, "Name of the secret holding the GitLab runner authentication token (glrt-...)")
+	rootCmd.PersistentFlags().StringVar(&cfg.GitLabURL, "gitlab-url", cfg.GitLabURL, "URL of the GitLab instance runners register with")
+	rootCmd.PersistentFlags().StringVar(&cfg.RunnerRegistration, "runner-registration", cfg.RunnerRegistration, "Runner registration mode: token (config.sh with a registration token) or jit (just-in-time config via GitHub App)")
+	rootCmd.PersistentFlags().StringVar(&cfg.GitHubAPIURL, "github-api-url", cfg.GitHubAPIURL, "Base URL of the GitHub REST API")
+	rootCmd.PersistentFlags().IntVar(&cfg.GitHubAppID, "github-app-id", cfg.GitHubAppID, "GitHub App ID used for JIT runner registration")
+	rootCmd.PersistentFlags().IntVar(&cfg.GitHubAppInstallationID, "github-app-installation-id", cfg.GitHubAppInstallationID, "GitHub App installation ID used for JIT runner registration")
+	rootCmd.PersistentFlags().StringVar(&cfg.GitHubAppPrivateKeyPath, "github-app-private-key-path", cfg.GitHubAppPrivateKeyPath, "Path to the GitHub App private key (PEM)")
+	rootCmd.PersistentFlags().BoolVar(&cfg.DeregisterRunners, "deregister-runners", cfg.DeregisterRunners, "Remove a deleted VM's runner registration from GitHub")
+	rootCmd.PersistentFlags().StringVar(&cfg.GitHubTokenSecret, "github-token-secret", cfg.GitHubTokenSecret, "Name of the secret holding a GitHub token used to deregister runners; empty uses the GitHub App credentials")
+	rootCmd.PersistentFlags().BoolVar(&cfg.ThermalProtection, "thermal-protection", cfg.ThermalProtection, "Suspend VMs while host thermal pressure is critical and resume them when it recovers")
+	rootCmd.PersistentFlags().DurationVar(&cfg.ThermalCheckInterval, "thermal-check-interval", cfg.ThermalCheckInterval, "Interval for sampling host thermal pressure")
+	rootCmd.PersistentFlags().StringVar(&cfg.ThermalCriticalLevel, "thermal-critical-level", cfg.ThermalCriticalLevel, "Thermal pressure level that triggers VM suspension (Moderate, Heavy, Trapping or Sleeping)")
+	rootCmd.PersistentFlags().BoolVar(&cfg.CoreSchedulingSampling, "core-scheduling-sampling", cfg.CoreSchedulingSampling, "Report per-VM performance/efficiency core scheduling in heartbeats (samples powermetrics, requires root)")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.ReachabilityEndpoints, "reachability-endpoints", cfg.ReachabilityEndpoints, "Endpoints (URLs or host:port) each VM must reach before it is reported ready; empty disables the check")
+	rootCmd.PersistentFlags().BoolVar(&cfg.ReachabilityRequired, "reachability-required", cfg.ReachabilityRequired, "Fail provisioning when a VM cannot reach a required endpoint")
+	rootCmd.PersistentFlags().StringVar(&cfg.DHCPLeasesPath, "dhcp-leases-path", cfg.DHCPLeasesPath, "DHCP lease database used to look up the IPs of NAT, softnet and host-only VMs by MAC address")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.IPDiscovery, "ip-discovery", cfg.IPDiscovery, "IP discovery strategies tried in order to find a VM's IP address: tart, dhcp, arp")
+	rootCmd.PersistentFlags().BoolVar(&cfg.MDNSRegister, "mdns-register", cfg.MDNSRegister, "Advertise each VM as <vmId>.local over Bonjour (mDNS) once it has an IP")
+	rootCmd.PersistentFlags().BoolVar(&cfg.GuestEvents, "guest-events", cfg.GuestEvents, "Install a guest helper with the runner that reports boot, runner registration and job phases to the agent")
+	rootCmd.PersistentFlags().StringVar(&cfg.GuestAgentURL, "guest-agent-url", cfg.GuestAgentURL, "Agent URL as reachable from inside VMs, used by the guest helper (the host's address on the VM network)")
+	rootCmd.PersistentFlags().DurationVar(&cfg.EphemeralCheckInterval, "ephemeral-check-interval", cfg.EphemeralCheckInterval, "How often VMs with ephemeral runners are checked for a finished job, to delete them (0 disables)")
+	rootCmd.PersistentFlags().BoolVar(&cfg.VMLogCollection, "vm-log-collection", cfg.VMLogCollection, "Bundle the host logs, guest runner logs and system.log tail of failed and deleted VMs before their directory is removed")
+	rootCmd.PersistentFlags().BoolVar(&cfg.VMLogUpload, "vm-log-upload", cfg.VMLogUpload, "Upload VM log bundles to the image bucket under failures/<node>/")
+	rootCmd.PersistentFlags().IntVar(&cfg.MaxVMLogBundles, "max-vm-log-bundles", cfg.MaxVMLogBundles, "Maximum number of VM log bundles kept in the state directory")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.WebhookURLs, "webhook-urls", cfg.WebhookURLs, "URLs signed VM lifecycle events are POSTed to; empty disables webhooks")
+	rootCmd.PersistentFlags().StringVar(&cfg.WebhookSecret, "webhook-secret", cfg.WebhookSecret, "Name of the secret holding the key webhook deliveries are signed with")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.WebhookEvents, "webhook-events", cfg.WebhookEvents, "Event types delivered to webhooks; empty delivers all events")
+	rootCmd.PersistentFlags().DurationVar(&cfg.ReachabilityTimeout, "reachability-timeout", cfg.ReachabilityTimeout, "Per-endpoint timeout for the VM reachability check")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.HealthChecks, "health-checks", cfg.HealthChecks, "Checks run by POST /vms/{vmId}/healthcheck: ssh, disk, runner, clock")
+	rootCmd.PersistentFlags().Int64Var(&cfg.HealthCheckMinFreeDisk, "health-check-min-free-disk", cfg.HealthCheckMinFreeDisk, "Minimum free bytes on the guest's root volume for the disk health check")
+	rootCmd.PersistentFlags().DurationVar(&cfg.HealthCheckMaxClockSkew, "health-check-max-clock-skew", cfg.HealthCheckMaxClockSkew, "Maximum guest clock skew for the clock health check")
+	rootCmd.PersistentFlags().Int64Var(&cfg.FileTransferMaxBytes, "file-transfer-max-bytes", cfg.FileTransferMaxBytes, "Largest file accepted by POST /vms/{vmId}/files")
+	rootCmd.PersistentFlags().DurationVar(&cfg.FileTransferTimeout, "file-transfer-timeout", cfg.FileTransferTimeout, "Maximum duration of a single VM file upload or download")
+	rootCmd.PersistentFlags().DurationVar(&cfg.ExecMaxTimeout, "exec-max-timeout", cfg.ExecMaxTimeout, "Upper bound on the timeout of commands run via POST /vms/{vmId}/exec")
+	rootCmd.PersistentFlags().DurationVar(&cfg.GuestShutdownTimeout, "guest-shutdown-timeout", cfg.GuestShutdownTimeout, "How long a guest may take to power off after POST /vms/{vmId}/shutdown before the VM is stopped forcibly")
+	rootCmd.PersistentFlags().StringVar(&cfg.HooksDir, "hooks-dir", cfg.HooksDir, "Directory of host-side hook executables (pre-provision, post-provision, pre-delete, post-delete) run with VM metadata in env vars; empty disables hooks")
+	rootCmd.PersistentFlags().DurationVar(&cfg.HookTimeout, "hook-timeout", cfg.HookTimeout, "How long a host-side hook may run before it is killed")
+	rootCmd.PersistentFlags().StringVar(&cfg.VMProfilesFile, "vm-profiles-file", cfg.VMProfilesFile, "JSON file of named VM profiles (CPUs, memory, display, network, disks, runner script) applied to provision requests by name, image or label; empty defines none")
+	rootCmd.PersistentFlags().IntVar(&cfg.MaxVMs, "max-vms", cfg.MaxVMs, "Number of VM slots advertised to the orchestrator in heartbeats (macOS allows 2 macOS guests per host)")
+	rootCmd.PersistentFlags().IntVar(&cfg.WarmPoolSize, "warm-pool-size", cfg.WarmPoolSize, "Number of standby VMs kept booted from --warm-pool-image so provisions only need to install the runner (0 disables the warm pool)")
+	rootCmd.PersistentFlags().StringVar(&cfg.WarmPoolImage, "warm-pool-image", cfg.WarmPoolImage, "Image the warm pool's standby VMs are created from")
+	rootCmd.PersistentFlags().IntVar(&cfg.MaxConcurrentProvisions, "max-concurrent-provisions", cfg.MaxConcurrentProvisions, "Maximum provisions run at once; more are queued and scheduled fairly across tenants (0 = unlimited)")
+	rootCmd.PersistentFlags().IntVar(&cfg.MaxPendingProvisions, "max-pending-provisions", cfg.MaxPendingProvisions, "Maximum provisions queued beyond --max-concurrent-provisions before further requests are rejected with 429 (0 = unlimited)")
+	rootCmd.PersistentFlags().IntVar(&cfg.MaxCommandWorkers, "max-command-workers", cfg.MaxCommandWorkers, "VM commands run at once, deletes first; provisions never take the last worker")
+	rootCmd.PersistentFlags().IntVar(&cfg.MaxQueuedCommands, "max-queued-commands", cfg.MaxQueuedCommands, "Maximum deletes, shutdowns, suspends and resumes queued before further requests are rejected with 429 (0 = unlimited)")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.TenantWeights, "tenant-weights", cfg.TenantWeights, "Relative shares of provisioning slots as tenant=weight pairs (e.g. team-a=2,team-b=1); unlisted tenants weigh 1")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.NodeLabels, "node-labels", cfg.NodeLabels, "Labels provision requests select the node by, as key or key=value (e.g. xcode15,m2pro,team=ios)")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.NodeTaints, "node-taints", cfg.NodeTaints, "Taints provision requests must tolerate to be accepted, as key or key=value (e.g. team=ios)")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.RateLimits, "rate-limits", cfg.RateLimits, "Per-route API rate limits as /path=<requests per second>[:<burst>] (e.g. /provision-vm=2:10); routes not listed are unlimited")
+	rootCmd.PersistentFlags().Int64Var(&cfg.DiskSpaceReserve, "disk-space-reserve", cfg.DiskSpaceReserve, "Bytes to keep free on the image cache and VM volumes beyond what a download or clone needs")
+	rootCmd.PersistentFlags().StringVar(&cfg.DiskCloneMode, "disk-clone-mode", cfg.DiskCloneMode, "How VM disks are created from cached images: auto (APFS clone, falling back to a full copy), clone (APFS clone only) or copy (full copy only)")
+	rootCmd.PersistentFlags().StringVar(&cfg.UpdateURL, "update-url", cfg.UpdateURL, "http(s):// or gs:// location of agent releases, holding latest.json (empty = self-update disabled)")
+	rootCmd.PersistentFlags().StringVar(&cfg.UpdatePublicKey, "update-public-key", cfg.UpdatePublicKey, "Base64 Ed25519 public key that release signatures are verified with")
+	rootCmd.PersistentFlags().DurationVar(&cfg.UpdateInterval, "update-interval", cfg.UpdateInterval, "How often to check --update-url for a new release and install it (0 = only via `macvmagt update`)")
+	rootCmd.PersistentFlags().StringVar(&cfg.UpdateLaunchdLabel, "update-launchd-label", cfg.UpdateLaunchdLabel, "launchd job to restart after an update (e.g. com.yourcompany.macvmagt); empty exits and relies on KeepAlive")
+	rootCmd.PersistentFlags().StringVar(&cfg.MaintenanceSchedule, "maintenance-schedule", cfg.MaintenanceSchedule, "Cron spec (minute hour day-of-month month day-of-week) of when maintenance windows open, e.g. \"0 3 * * 0\" (empty = no maintenance windows)")
+	rootCmd.PersistentFlags().DurationVar(&cfg.MaintenanceWindow, "maintenance-window", cfg.MaintenanceWindow, "How long a maintenance window stays open for the node to drain and the hook to run")
+	rootCmd.PersistentFlags().StringVar(&cfg.MaintenanceHook, "maintenance-hook", cfg.MaintenanceHook, "Executable run once the node drained in a maintenance window, e.g. a script running softwareupdate and rebooting (empty = only drain)")
+	rootCmd.PersistentFlags().IntVar(&cfg.MaxRetainedVMRecords, "max-retained-vm-records", cfg.MaxRetainedVMRecords, "Maximum number of unacknowledged VM records (tombstones, failed provisions) kept for heartbeats")
+	rootCmd.PersistentFlags().IntVar(&cfg.VMHistorySize, "vm-history-size", cfg.VMHistorySize, "Number of VMs kept in the local VM history served by GET /history (0 disables it)")
+	rootCmd.PersistentFlags().DurationVar(&cfg.JanitorInterval, "janitor-interval", cfg.JanitorInterval, "How often stale temp files, nohup output and zero-byte disks are removed from the VMs directory (0 disables)")
+	rootCmd.PersistentFlags().DurationVar(&cfg.JanitorMinAge, "janitor-min-age", cfg.JanitorMinAge, "Minimum age of a stale file in the VMs directory before it is removed")
+	rootCmd.PersistentFlags().DurationVar(&cfg.VMGCInterval, "vm-gc-interval", cfg.VMGCInterval, "How often directories of VMs that no longer exist are collected (0 disables, POST /gc still works)")
+	rootCmd.PersistentFlags().DurationVar(&cfg.VMGCGracePeriod, "vm-gc-grace-period", cfg.VMGCGracePeriod, "How long a stale VM directory must be untouched before it is collected")
+	rootCmd.PersistentFlags().DurationVar(&cfg.DiskUsageInterval, "disk-usage-interval", cfg.DiskUsageInterval, "How often the disk space of the image cache and each VM is measured (0 disables)")
+	rootCmd.PersistentFlags().StringVar(&cfg.LegacyVMRootDir, "legacy-vm-root-dir", cfg.LegacyVMRootDir, "VM directory root of an older agent (vm_<id> directories) to migrate at startup")
+	rootCmd.PersistentFlags().StringVar(&cfg.Backend, "backend", cfg.Backend, "VM backend to use: auto (detect at startup) or tart")
+	rootCmd.PersistentFlags().StringVar(&cfg.UserAgent, "user-agent", cfg.UserAgent, "User-Agent of requests to the orchestrator (default macvmagt/<version>)")
+	rootCmd.PersistentFlags().StringVar(&cfg.AccessLog, "access-log", cfg.AccessLog, "Access log format of the command server: common, json or off")
+	rootCmd.PersistentFlags().DurationVar(&cfg.ServerReadTimeout, "server-read-timeout", cfg.ServerReadTimeout, "Time the command server allows to read a request")
+	rootCmd.PersistentFlags().DurationVar(&cfg.ServerWriteTimeout, "server-write-timeout", cfg.ServerWriteTimeout, "Time the command server allows to write a response, except on routes with a route timeout")
+	rootCmd.PersistentFlags().DurationVar(&cfg.ServerIdleTimeout, "server-idle-timeout", cfg.ServerIdleTimeout, "How long idle keep-alive connections to the command server are kept open")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.RouteTimeouts, "route-timeouts", cfg.RouteTimeouts, "Per-route timeouts replacing the read and write timeouts of long-running routes, as /path=<duration> (e.g. /gc=10m); 0 lifts them for streaming")
+	rootCmd.PersistentFlags().Int64Var(&cfg.AuditLogMaxBytes, "audit-log-max-bytes", cfg.AuditLogMaxBytes, "Size in bytes at which the audit log of orchestrator commands is rotated (0 disables rotation)")
+	rootCmd.PersistentFlags().IntVar(&cfg.AuditLogMaxFiles, "audit-log-max-files", cfg.AuditLogMaxFiles, "Number of rotated audit log files kept")
+	rootCmd.PersistentFlags().StringVar(&cfg.LogFile, "log-file", cfg.LogFile, "File the agent logs to, rotated by --log-max-bytes and --log-max-age (empty = stderr)")
+	rootCmd.PersistentFlags().Int64Var(&cfg.LogMaxBytes, "log-max-bytes", cfg.LogMaxBytes, "Size in bytes at which the agent's log file and each VM's vm.log are rotated (0 disables size-based rotation)")
+	rootCmd.PersistentFlags().DurationVar(&cfg.LogMaxAge, "log-max-age", cfg.LogMaxAge, "Age at which the agent's log file and each VM's vm.log are rotated (0 disables age-based rotation)")
+	rootCmd.PersistentFlags().IntVar(&cfg.LogMaxFiles, "log-max-files", cfg.LogMaxFiles, "Number of rotated files kept of the agent's log file and of each VM's vm.log")
+	rootCmd.PersistentFlags().StringVar(&cfg.TLSCertPath, "tls-cert", cfg.TLSCertPath, "PEM certificate to serve the command API over HTTPS with (requires --tls-key)")
+	rootCmd.PersistentFlags().StringVar(&cfg.TLSKeyPath, "tls-key", cfg.TLSKeyPath, "PEM private key of --tls-cert")
+	rootCmd.PersistentFlags().BoolVar(&cfg.TLSSelfSigned, "tls-self-signed", cfg.TLSSelfSigned, "Serve the command API over HTTPS with a self-signed certificate generated in the state directory, for the orchestrator to pin, when --tls-cert is not set")
+	rootCmd.PersistentFlags().StringVar(&cfg.HTTPRedirectAddr, "http-redirect-addr", cfg.HTTPRedirectAddr, "Address of a plain HTTP listener that redirects to the HTTPS command server (e.g. :8080); empty disables it")
+	rootCmd.PersistentFlags().StringVar(&cfg.OperatorTokenSecret, "operator-token-secret", cfg.OperatorTokenSecret, "Name of the secret holding the bearer token required for every API endpoint (empty = API open)")
+	rootCmd.PersistentFlags().StringVar(&cfg.ReadOnlyTokenSecret, "read-only-token-secret", cfg.ReadOnlyTokenSecret, "Name of the secret holding a bearer token that only allows GET endpoints, e.g. for dashboards (requires --operator-token-secret)")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.CommandPublicKeys, "command-public-keys", cfg.CommandPublicKeys, "Base64 Ed25519 public keys of the orchestrator that commands must be signed with (empty = unsigned commands accepted)")
+	rootCmd.PersistentFlags().DurationVar(&cfg.CommandSignatureMaxAge, "command-signature-max-age", cfg.CommandSignatureMaxAge, "How far a signed command's timestamp may be from the node's clock before it is rejected as stale")
+	rootCmd.PersistentFlags().StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", cfg.OTLPEndpoint, "OTLP/HTTP endpoint to export trace spans to, e.g. http://collector:4318/v1/traces (empty = tracing disabled)")
+	rootCmd.PersistentFlags().StringVar(&cfg.CommandRecordPath, "command-record", cfg.CommandRecordPath, "Record the outputs of the external commands the agent runs (tart, sysctl, ...) to this fixture file, for replaying in CI")
+	rootCmd.PersistentFlags().StringVar(&cfg.CommandReplayPath, "command-replay", cfg.CommandReplayPath, "Answer external commands with the outputs recorded in this fixture file instead of running them")
+	rootCmd.PersistentFlags().StringVar(&cfg.Driver, "driver", cfg.Driver, "How VMs are run: tart, or fake to simulate them with stub processes, e.g. for end-to-end tests on Linux CI")
+	rootCmd.PersistentFlags().DurationVar(&cfg.FakeBootTime, "fake-boot-time", cfg.FakeBootTime, "How long VMs of the fake driver take to get an IP address after they start")
+	rootCmd.PersistentFlags().Float64Var(&cfg.TraceSampleRatio, "trace-sample-ratio", cfg.TraceSampleRatio, "Fraction of traces started by the agent to sample; requests carrying trace context follow the caller's decision")
+}
+
+var rootCmd = &cobra.Command{
+	Use:   "macvmagt",
+	Short: "macvmagt runs on Mac Minis to manage VMs and report status.",
+	Long: `The MacVMOrx Agent is responsible for sending heartbeats to the orchestrator,
+provisioning and deleting virtual machines, and managing a local cache of VM images.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		startAgent()
+	},
+}
+
+var dryRunRequestPath string
+
+var dryRunCmd = &cobra.Command{
+	Use:   "dry-run",
+	Short: "Render the provisioning artifacts for a provision request without booting a VM.",
+	Long: `Reads a provision request (the JSON body of POST /provision-vm) and prints the
+rendered runner script and VM spec, plus warnings for placeholder leaks. The request
+is completed from its VM profile in --vm-profiles-file first. Secrets are
+replaced with dummy values and the image cache is not consulted.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var input io.Reader = os.Stdin
+		if dryRunRequestPath != "-" {
+			file, err := os.Open(dryRunRequestPath)
+			if err != nil {
+				return fmt.Errorf("failed to open request file: %w", err)
+			}
+			defer file.Close()
+			input = file
+		}
+
+		var req models.VMProvisionCommand
+		if err := json.NewDecoder(input).Decode(&req); err != nil {
+			return fmt.Errorf("failed to decode provision request: %w", err)
+		}
+
+		profiles, err := vmprofiles.Load(cfg.VMProfilesFile)
+		if err != nil {
+			return err
+		}
+		result, err := vmgr.RenderDryRun(cfg, profiles, req)
+		if err != nil {
+			return err
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	},
+}
+
+func init() {
+	dryRunCmd.Flags().StringVarP(&dryRunRequestPath, "request", "f", "-", "Path to the provision request JSON, or - for stdin")
+	rootCmd.AddCommand(dryRunCmd)
+}
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the agent version.",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println(version.Version)
+	},
+}
+
+var (
+	updateCheckOnly bool
+	updateNoRestart bool
+)
+
+var updateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Install the latest signed agent release from --update-url.",
+	Long: `Fetches latest.json from --update-url, verifies the release's Ed25519 signature
+against --update-public-key and the binary's checksum, swaps the running binary
+atomically and restarts the agent's launchd job (--update-launchd-label).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		updater, err := selfupdate.New(cfg, nil)
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+
+		if updateCheckOnly {
+			release, err := updater.Check(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("running %s, published %s\n", version.Version, release.Version)
+			return nil
+		}
+
+		release, err := updater.Update(ctx)
+		if errors.Is(err, selfupdate.ErrUpToDate) {
+			fmt.Printf("%s is already the published version\n", version.Version)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("updated %s to %s\n", version.Version, release.Version)
+		if updateNoRestart {
+			return nil
+		}
+		return updater.Restart()
+	},
+}
+
+func init() {
+	updateCmd.Flags().BoolVar(&updateCheckOnly, "check", false, "Only print the running and published versions")
+	updateCmd.Flags().BoolVar(&updateNoRestart, "no-restart", false, "Install the update without restarting the agent")
+	rootCmd.AddCommand(versionCmd, updateCmd)
+}
+
+var doctorJSON bool
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check that this host has everything the agent needs.",
+	Long: `Checks for a usable VM backend (tart installed, signed with the Virtualization
+entitlement, hypervisor support), writable image cache, VMs and state directories,
+the VM SSH key, the runner script, valid GCS credentials for the image bucket and
+reachability of the orchestrator. Failures come with a suggested fix. Exits non-zero
+if any check fails. A running agent offers the same checks at GET /healthz?deep=1.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		report := doctor.Run(context.Background(), cfg)
+
+		if doctorJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(report); err != nil {
+				return err
+			}
+		} else {
+			for _, check := range report.Checks {
+				if check.OK {
+					fmt.Printf("[ OK ] %s: %s\n", check.Name, check.Detail)
+					continue
+				}
+				fmt.Printf("[FAIL] %s: %s\n", check.Name, check.Detail)
+				fmt.Printf("       fix: %s\n", check.Fix)
+			}
+		}
+		if !report.Healthy {
+			cmd.SilenceUsage = true
+			return fmt.Errorf("host prerequisites are not met")
+		}
+		return nil
+	},
+}
+
+func init() {
+	doctorCmd.Flags().BoolVar(&doctorJSON, "json", false, "Print the report as JSON")
+	rootCmd.AddCommand(doctorCmd)
+}
+
+var supportBundleOutput string
+
+var supportBundleCmd = &cobra.Command{
+	Use:   "support-bundle",
+	Short: "Write a tar.gz of this node's state to attach to bug reports.",
+	Long: `Gathers the configuration with credentials redacted, the tail of the agent's log
+files and of each VM's logs, the VMs tart lists with their states, the manifests of
+cached images, the agent's state files, the doctor report, disk usage, thermal
+pressure and the versions of the VM backends into a single tar.gz. Secrets are not
+resolved, so the bundle never holds them. Parts that can't be gathered are listed
+in bundle.json. A running agent serves the same bundle, with its in-memory state
+added, at POST /admin/support-bundle.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := supportBundleOutput
+		if path == "" {
+			path = fmt.Sprintf("support-bundle-%s-%s.tar.gz", cfg.NodeID, time.Now().UTC().Format("20060102T150405Z"))
+		}
+		var output io.Writer = os.Stdout
+		if path != "-" {
+			file, err := os.Create(path)
+			if err != nil {
+				return fmt.Errorf("failed to create support bundle: %w", err)
+			}
+			defer file.Close()
+			output = file
+		}
+		if err := supportbundle.Write(context.Background(), cfg, output, "cli", nil); err != nil {
+			if path != "-" {
+				os.Remove(path)
+			}
+			return err
+		}
+		if path != "-" {
+			fmt.Fprintf(os.Stderr, "wrote %s\n", path)
+		}
+		return nil
+	},
+}
+
+func init() {
+	supportBundleCmd.Flags().StringVarP(&supportBundleOutput, "output", "o", "", "Path to write the bundle to, or - for stdout (default support-bundle-<node-id>-<time>.tar.gz)")
+	rootCmd.AddCommand(supportBundleCmd)
+}
+
+// setupCommandRunner records the outputs of external commands to
+// --command-record, replays them from --command-replay, or simulates tart
+// and the VMs with the fake driver.
+func setupCommandRunner() {
+	switch {
+	case cfg.Driver != "tart" && cfg.Driver != fakedriver.Name:
+		log.Fatalf("Unknown driver '%s', expected tart or %s", cfg.Driver, fakedriver.Name)
+	case cfg.CommandRecordPath != "" && cfg.CommandReplayPath != "":
+		log.Fatalf("--command-record and --command-replay cannot be used together")
+	case cfg.Driver == fakedriver.Name && (cfg.CommandRecordPath != "" || cfg.CommandReplayPath != ""):
+		log.Fatalf("--driver %s cannot be used with --command-record or --command-replay", fakedriver.Name)
+	case cfg.Driver == fakedriver.Name:
+		driver, err := fakedriver.New(cfg)
+		if err != nil {
+			log.Fatalf("Failed to set up the fake driver: %v", err)
+		}
+		log.Printf("Simulating tart and VMs with the fake driver; no VM really runs")
+		utils.SetCommandRunner(driver)
+		sshclient.SetDialer(driver.Dial)
+	case cfg.CommandRecordPath != "":
+		recorder, err := utils.NewRecordingRunner(utils.ExecRunner{}, cfg.CommandRecordPath)
+		if err != nil {
+			log.Fatalf("Failed to record commands: %v", err)
+		}
+		log.Printf("Recording the outputs of external commands to %s", cfg.CommandRecordPath)
+		utils.SetCommandRunner(recorder)
+	case cfg.CommandReplayPath != "":
+		replayer, err := utils.NewReplayRunner(cfg.CommandReplayPath)
+		if err != nil {
+			log.Fatalf("Failed to replay commands: %v", err)
+		}
+		log.Printf("Replaying the outputs of external commands from %s instead of running them", cfg.CommandReplayPath)
+		utils.SetCommandRunner(replayer)
+	}
+}
+
+func startAgent() {
+	if cfg.LogFile != "" {
+		logFile, err := logrotate.Open(cfg.LogFile, logrotate.FromConfig(cfg))
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		log.SetOutput(logFile)
+	}
+	agent, err := agent.NewAgent(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize agent: %v", err)
+	}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %s, stopping", sig)
+		agent.Stop()
+		os.Exit(0)
+	}()
+	agent.Start()
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		log.Fatalf("Error executing command: %v", err)
+		os.Exit(1)
+	}
+}
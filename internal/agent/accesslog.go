@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/requestid"
+)
+
+// accessLogEntry is one line of the JSON access log.
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Source    string    `json:"source"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	LatencyMs int64     `json:"latencyMs"`
+}
+
+// validateAccessLogFormat checks the configured access log format.
+func validateAccessLogFormat(format string) error {
+	switch format {
+	case "common", "json", "off":
+		return nil
+	default:
+		return fmt.Errorf("unsupported access log format '%s', expected common, json or off", format)
+	}
+}
+
+// accessLogMiddleware logs every request handled by next in the given format.
+// Each line carries the request's ID, see requestIDMiddleware.
+func accessLogMiddleware(format string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if format == "off" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+
+			entry := accessLogEntry{
+				Time:      start,
+				RequestID: requestid.FromContext(r.Context()),
+				Source:    sourceAddr(r),
+				Method:    r.Method,
+				Path:      r.URL.RequestURI(),
+				Status:    sw.status(),
+				Bytes:     sw.bytes,
+				LatencyMs: time.Since(start).Milliseconds(),
+			}
+			writeAccessLog(format, entry, r.Proto)
+		})
+	}
+}
+
+func writeAccessLog(format string, entry accessLogEntry, proto string) {
+	if format == "json" {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			log.Printf("Error marshalling access log entry: %v", err)
+			return
+		}
+		log.Print(string(line))
+		return
+	}
+	// Common Log Format, with latency and request ID appended.
+	log.Printf("%s - - [%s] \"%s %s %s\" %d %d %dms %s",
+		entry.Source, entry.Time.Format("02/Jan/2006:15:04:05 -0700"), entry.Method, entry.Path, proto,
+		entry.Status, entry.Bytes, entry.LatencyMs, entry.RequestID)
+}
+
+// sourceAddr returns the client IP of a request without its port.
+func sourceAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusWriter records the status code and body size of a response. It
+// unwraps to the underlying writer so http.ResponseController keeps working.
+type statusWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush supports streaming handlers such as exec.
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
@@ -1,18 +1,50 @@
 package agent
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/changty97/macvmagt/internal/audit"
+	"github.com/changty97/macvmagt/internal/backend"
+	"github.com/changty97/macvmagt/internal/cachestats"
 	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/cordon"
+	"github.com/changty97/macvmagt/internal/diskusage"
+	"github.com/changty97/macvmagt/internal/events"
+	"github.com/changty97/macvmagt/internal/github"
 	"github.com/changty97/macvmagt/internal/heartbeat"
+	"github.com/changty97/macvmagt/internal/hostkeys"
+	"github.com/changty97/macvmagt/internal/hostpower"
 	"github.com/changty97/macvmagt/internal/imagemgr"
+	"github.com/changty97/macvmagt/internal/janitor"
+	"github.com/changty97/macvmagt/internal/maintenance"
 	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/nodelabels"
+	"github.com/changty97/macvmagt/internal/operations"
+	"github.com/changty97/macvmagt/internal/orchestrator"
+	"github.com/changty97/macvmagt/internal/paths"
+	"github.com/changty97/macvmagt/internal/requestid"
+	"github.com/changty97/macvmagt/internal/scheduler"
+	"github.com/changty97/macvmagt/internal/secrets"
+	"github.com/changty97/macvmagt/internal/selfupdate"
+	"github.com/changty97/macvmagt/internal/thermal"
+	"github.com/changty97/macvmagt/internal/tracing"
+	"github.com/changty97/macvmagt/internal/utilization"
+	"github.com/changty97/macvmagt/internal/utils"
+	"github.com/changty97/macvmagt/internal/validate"
+	"github.com/changty97/macvmagt/internal/version"
 	"github.com/changty97/macvmagt/internal/vmgr"
+	"github.com/changty97/macvmagt/internal/vmprofiles"
+	"github.com/changty97/macvmagt/internal/vmrecords"
 	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
 )
 
 // Agent represents the MacVMOrx agent running on a Mac Mini.
@@ -21,99 +53,1106 @@ type Agent struct {
 	heartbeatSender *heartbeat.Sender
 	imageManager    *imagemgr.Manager
 	vmManager       *vmgr.Manager
+	utilization     *utilization.Recorder
+	thermalMonitor  *thermal.Monitor
+	diskUsage       *diskusage.Sampler
+	janitor         *janitor.Janitor
+	events          *events.Emitter
+	nodeInfo        *models.NodeInfo
+	nodeLabels      *nodelabels.Node
+	operations      *operations.Tracker
+	vmRecords       *vmrecords.Store
+	history         *vmrecords.History
+	orchestrator    *orchestrator.Client
+	provisions      *scheduler.Scheduler
+	commands        *scheduler.CommandQueue // Runs VM commands by priority on a bounded number of workers
+	rateLimits      map[string]*rate.Limiter
+	routeTimeouts   map[string]time.Duration // Read and write timeouts of long-running routes
+	signatures      *commandVerifier         // nil when commands needn't be signed
+	apiTokens       *apiTokens               // nil when the API is open
+	cordon          *cordon.Store
+	updater         *selfupdate.Updater
+	maintenance     *maintenance.Scheduler
+	hostPower       *hostpower.Store
+	audit           *audit.Log
+	tlsCert         *tls.Certificate // Certificate of the HTTPS command server; nil serves plain HTTP
+	started         time.Time        // When the agent started, for uptime
+	readiness       readinessCache
+	deepHealth      readinessCache
+	autoDeletes     autoDeletes // VMs of finished ephemeral runners being deleted
 }
 
 // NewAgent creates and initializes a new agent instance.
 func NewAgent(cfg *config.Config) (*Agent, error) {
-	imageManager, err := imagemgr.NewManager(cfg)
+	if err := validateAccessLogFormat(cfg.AccessLog); err != nil {
+		return nil, err
+	}
+	if err := vmgr.ValidateHealthChecks(cfg.HealthChecks); err != nil {
+		return nil, err
+	}
+	if err := vmgr.ValidateIPDiscovery(cfg.IPDiscovery); err != nil {
+		return nil, err
+	}
+	if err := vmgr.ValidateWarmPool(cfg.WarmPoolSize, cfg.WarmPoolImage); err != nil {
+		return nil, err
+	}
+	if err := vmgr.ValidateDiskCloneMode(cfg.DiskCloneMode); err != nil {
+		return nil, err
+	}
+	if err := vmgr.ValidateRunnerConfirmation(cfg.RunnerConfirmation); err != nil {
+		return nil, err
+	}
+	if err := imagemgr.ValidateImageVerify(cfg.ImageVerify); err != nil {
+		return nil, err
+	}
+	routeTimeouts, err := parseRouteTimeouts(cfg.RouteTimeouts)
+	if err != nil {
+		return nil, err
+	}
+	rateLimits, err := parseRateLimits(cfg.RateLimits)
+	if err != nil {
+		return nil, err
+	}
+	signatures, err := newCommandVerifier(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if signatures != nil && cfg.HeartbeatCommands {
+		// Heartbeat responses carry no signatures, so they would bypass them.
+		return nil, fmt.Errorf("--heartbeat-commands cannot be used with --command-public-keys, commands in heartbeat responses aren't signed")
+	}
+	tlsCert, err := loadTLSCertificate(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := tracing.Setup(cfg); err != nil {
+		return nil, err
+	}
+
+	nodeLabels, err := nodelabels.Parse(cfg.NodeLabels, cfg.NodeTaints)
+	if err != nil {
+		return nil, err
+	}
+	nodeInfo := backend.Detect(cfg)
+	if err := checkPermissions(cfg, nodeInfo); err != nil {
+		return nil, err
+	}
+	nodeInfo.Labels = nodeLabels.Labels()
+	nodeInfo.Taints = nodeLabels.Taints()
+	orchestratorClient := orchestrator.NewClient(cfg, nodeInfo)
+
+	operationTracker := operations.NewTracker()
+
+	tenantWeights, err := scheduler.ParseWeights(cfg.TenantWeights)
+	if err != nil {
+		return nil, err
+	}
+	provisionScheduler := scheduler.New(cfg.MaxConcurrentProvisions, cfg.MaxPendingProvisions, tenantWeights, operationTracker)
+	commandQueue := scheduler.NewCommandQueue(cfg.MaxCommandWorkers, cfg.MaxQueuedCommands, operationTracker)
+
+	layout := paths.New(cfg.VMsDir)
+	if err := layout.Init(cfg.VMsDirMode); err != nil {
+		return nil, err
+	}
+	var legacyRoots []string
+	if cfg.LegacyVMRootDir != "" {
+		legacyRoots = append(legacyRoots, cfg.LegacyVMRootDir)
+	}
+	if err := layout.Migrate(legacyRoots...); err != nil {
+		return nil, fmt.Errorf("failed to migrate VM directories: %w", err)
+	}
+
+	imageManager, err := imagemgr.NewManager(cfg, operationTracker)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize image manager: %w", err)
 	}
+	cacheStats, err := cachestats.NewRecorder(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize image cache stats: %w", err)
+	}
+	imageManager.SetCacheMetrics(cacheStats)
+
+	recorder, err := utilization.NewRecorder(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize utilization recorder: %w", err)
+	}
 
-	vmManager := vmgr.NewManager(cfg, imageManager)
-	heartbeatSender := heartbeat.NewSender(cfg, imageManager, vmManager)
+	vmRecordStore, err := vmrecords.NewStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize VM record store: %w", err)
+	}
 
-	return &Agent{
+	auditLog, err := audit.NewLog(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize audit log: %w", err)
+	}
+
+	secretsProvider, err := secrets.NewProvider(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize secrets provider: %w", err)
+	}
+
+	githubClient, err := github.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize GitHub client: %w", err)
+	}
+	if cfg.DeregisterRunners && cfg.GitHubTokenSecret == "" && !githubClient.HasAppCredentials() {
+		return nil, fmt.Errorf("--deregister-runners needs --github-token-secret or GitHub App credentials")
+	}
+
+	eventEmitter := events.NewEmitter(cfg, orchestratorClient)
+	if len(cfg.WebhookURLs) > 0 {
+		key, err := secretsProvider.GetSecret(context.Background(), cfg.WebhookSecret)
+		if err != nil {
+			return nil, fmt.Errorf("webhooks need a signing key: %w", err)
+		}
+		eventEmitter.SetWebhookKey(key)
+	}
+	apiTokens, err := loadAPITokens(context.Background(), cfg, secretsProvider)
+	if err != nil {
+		return nil, err
+	}
+	thermalMonitor := thermal.NewMonitor(cfg, eventEmitter)
+	vmJanitor := janitor.NewJanitor(cfg, layout, operationTracker, eventEmitter)
+
+	hostKeyStore, err := hostkeys.NewStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize SSH host key store: %w", err)
+	}
+
+	vmManager := vmgr.NewManager(cfg, imageManager, secretsProvider, githubClient, hostKeyStore, operationTracker, layout)
+	vmProfiles, err := vmprofiles.Load(cfg.VMProfilesFile)
+	if err != nil {
+		return nil, err
+	}
+	vmManager.SetProfiles(vmProfiles)
+	if cfg.ImageSmokeTest {
+		imageManager.SetSmokeTest(vmManager.SmokeTestImage)
+	}
+	thermalMonitor.SetLaunch(vmManager.Launch)
+	imageManager.SetInUse(vmManager.VMsUsingImage)
+	imageManager.SetHostArch(nodeInfo.Arch)
+	imageManager.SetBusy(vmManager.RunningJobs)
+	imageManager.SetDownloaded(func(imageName string, size int64) {
+		eventEmitter.Emit("image.downloaded", fmt.Sprintf("Image %s was downloaded", imageName), map[string]string{
+			"imageName": imageName,
+			"sizeBytes": strconv.FormatInt(size, 10),
+		})
+	})
+	updater, err := selfupdate.New(cfg, operationTracker)
+	if err != nil {
+		return nil, err
+	}
+
+	cordonStore, err := cordon.NewStore(cfg, eventEmitter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize cordon state: %w", err)
+	}
+	heartbeatSender := heartbeat.NewSender(cfg, imageManager, vmManager, recorder, thermalMonitor, vmRecordStore, orchestratorClient, cordonStore, nodeInfo)
+	if tlsCert != nil {
+		pin := publicKeyPin(tlsCert)
+		log.Printf("Command server TLS public key pin: %s", pin)
+		heartbeatSender.SetTLSPublicKeyPin(pin)
+		vmManager.SetAgentPublicKeyPin(pin)
+	}
+	heartbeatSender.SetCommandQueue(commandQueue)
+	maintenanceScheduler, err := maintenance.New(cfg, cordonStore, operationTracker, eventEmitter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to schedule maintenance windows: %w", err)
+	}
+	heartbeatSender.SetMaintenance(maintenanceScheduler)
+	hostPowerStore, err := hostpower.NewStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize host power state: %w", err)
+	}
+	heartbeatSender.SetLastHostPower(hostPowerStore.Last())
+	diskUsage := diskusage.NewSampler(cfg)
+	if cfg.DiskUsageInterval > 0 {
+		heartbeatSender.SetDiskUsage(diskUsage)
+		vmManager.SetDiskBytes(diskUsage.VMBytes)
+	}
+
+	a := &Agent{
 		cfg:             cfg,
 		heartbeatSender: heartbeatSender,
 		imageManager:    imageManager,
 		vmManager:       vmManager,
-	}, nil
+		utilization:     recorder,
+		thermalMonitor:  thermalMonitor,
+		diskUsage:       diskUsage,
+		janitor:         vmJanitor,
+		events:          eventEmitter,
+		nodeInfo:        nodeInfo,
+		nodeLabels:      nodeLabels,
+		operations:      operationTracker,
+		vmRecords:       vmRecordStore,
+		history:         vmrecords.NewHistory(cfg),
+		orchestrator:    orchestratorClient,
+		provisions:      provisionScheduler,
+		commands:        commandQueue,
+		rateLimits:      rateLimits,
+		routeTimeouts:   routeTimeouts,
+		signatures:      signatures,
+		apiTokens:       apiTokens,
+		cordon:          cordonStore,
+		updater:         updater,
+		maintenance:     maintenanceScheduler,
+		hostPower:       hostPowerStore,
+		audit:           auditLog,
+		tlsCert:         tlsCert,
+		started:         time.Now(),
+	}
+	if cfg.HeartbeatCommands {
+		heartbeatSender.SetCommandHandler(a.handleHeartbeatCommand)
+	}
+	return a, nil
 }
 
 // Start runs the agent's main loop and API server.
 func (a *Agent) Start() {
-	log.Printf("Starting MacVMOrx Agent (NodeID: %s)", a.cfg.NodeID)
+	log.Printf("Starting MacVMOrx Agent %s (NodeID: %s)", version.Version, a.cfg.NodeID)
+
+	// Clean up after a crash before accepting commands for the same VMs
+	a.recoverInterrupted()
+	a.reportHostBoot()
 
 	// Start sending heartbeats in a goroutine
 	go a.heartbeatSender.StartSendingHeartbeats()
+	go a.imageManager.StartImageSync()
+
+	if a.cfg.ThermalProtection {
+		go a.thermalMonitor.Start()
+	}
+
+	if a.cfg.DiskUsageInterval > 0 {
+		go a.diskUsage.Start()
+	}
+
+	if a.cfg.JanitorInterval > 0 {
+		go a.janitor.Start()
+	}
+	if a.cfg.VMGCInterval > 0 {
+		go a.janitor.StartGC()
+	}
+	if a.cfg.UpdateURL != "" && a.cfg.UpdateInterval > 0 {
+		go a.updater.Start()
+	}
+	if a.maintenance.Enabled() {
+		go a.maintenance.Start()
+	}
+	// Always started, to remove standby VMs left over from when the pool was enabled
+	go a.vmManager.StartWarmPool()
+	if a.cfg.RunnerPackageCache {
+		go a.vmManager.PrefetchRunnerPackage()
+	}
+	if a.cfg.EphemeralCheckInterval > 0 {
+		go a.watchEphemeral()
+	}
 
 	// Start HTTP server for orchestrator commands (e.g., provision/delete VM)
-	router := mux.NewRouter()
-	router.HandleFunc("/provision-vm", a.handleProvisionVM).Methods("POST")
-	router.HandleFunc("/delete-vm", a.handleDeleteVM).Methods("POST")
-	// Add other agent-specific API endpoints if needed
+	router := a.router()
 
 	addr := ":8081" // Agent listens on a different port than orchestrator
-	log.Printf("Agent command server starting on %s", addr)
 
-	srv := &http.Server{
-		Addr:         addr,
-		Handler:      router,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 5 * time.Second,
-		IdleTimeout:  60 * time.Second,
+	srv := newServer(a.cfg, addr, requestIDMiddleware(accessLogMiddleware(a.cfg.AccessLog)(router))) // Wraps the router so unmatched routes are logged too
+
+	if a.tlsCert == nil {
+		if a.cfg.HTTPRedirectAddr != "" {
+			log.Printf("Warning: Ignoring HTTP redirect address %s, as the command server doesn't serve HTTPS", a.cfg.HTTPRedirectAddr)
+		}
+		log.Printf("Agent command server starting on %s", addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Could not start agent command server: %v", err)
+		}
+		return
 	}
 
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if a.cfg.HTTPRedirectAddr != "" {
+		go a.serveHTTPRedirect(addr)
+	}
+	srv.TLSConfig = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*a.tlsCert},
+	}
+	log.Printf("Agent command server starting on %s (HTTPS)", addr)
+	if err := srv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Could not start agent command server: %v", err)
 	}
 }
 
+// Stop cleans up before the agent exits on a signal, so the next start
+// knows it stopped cleanly.
+func (a *Agent) Stop() {
+	a.imageManager.Close()
+}
+
+// recoverInterrupted tears down VMs whose provision the last run of the agent
+// didn't finish and removes leftovers of its interrupted operations. Each
+// interrupted provision is reported as an event and a failed VM record, so
+// the orchestrator reschedules the VM.
+func (a *Agent) recoverInterrupted() {
+	for _, provision := range a.vmManager.RecoverInterrupted() {
+		details := map[string]string{"vmId": provision.VMID}
+		if provision.ImageName != "" {
+			details["imageName"] = provision.ImageName
+		}
+		if !provision.StartedAt.IsZero() {
+			details["startedAt"] = provision.StartedAt.Format(time.RFC3339)
+		}
+		ctx := requestid.NewContext(context.Background(), provision.RequestID)
+		a.events.EmitContext(ctx, "vm.provision-interrupted", fmt.Sprintf("Provision of VM %s was interrupted by an agent restart, the VM was removed", provision.VMID), details)
+		a.vmRecords.AddContext(ctx, provision.VMID, "failed", "provision interrupted by an agent restart")
+		a.history.Ended(provision.VMID, "interrupted", "provision interrupted by an agent restart")
+	}
+	a.janitor.SweepInterrupted()
+}
+
+// newServer returns an HTTP server for handler on addr. Every listener of the
+// agent is built here, so they share the same timeouts. Long-running routes
+// replace the read and write timeouts per request, see timeoutMiddleware;
+// the header timeout still guards them against slow clients.
+func newServer(cfg *config.Config, addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ServerReadTimeout,
+		ReadTimeout:       cfg.ServerReadTimeout,
+		WriteTimeout:      cfg.ServerWriteTimeout,
+		IdleTimeout:       cfg.ServerIdleTimeout,
+	}
+}
+
+// serveHTTPRedirect serves plain HTTP on HTTPRedirectAddr, redirecting every
+// request to the HTTPS command server on httpsAddr.
+func (a *Agent) serveHTTPRedirect(httpsAddr string) {
+	log.Printf("HTTP redirect server starting on %s", a.cfg.HTTPRedirectAddr)
+	srv := newServer(a.cfg, a.cfg.HTTPRedirectAddr, redirectToHTTPS(httpsAddr))
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Error serving HTTP redirects on %s: %v", a.cfg.HTTPRedirectAddr, err)
+	}
+}
+
+// router returns the command server's routes. Operational endpoints are
+// unversioned. The API is served under /v<version> for each API version and,
+// for orchestrators that predate versioning, at the unversioned paths too.
+func (a *Agent) router() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/version", a.handleVersion).Methods("GET")
+	router.HandleFunc("/healthz", a.handleHealthz).Methods("GET")
+	router.HandleFunc("/readyz", a.handleReadyz).Methods("GET")
+	router.HandleFunc("/metrics", a.handleMetrics).Methods("GET")
+	for _, apiVersion := range version.APIVersions {
+		a.registerAPIRoutes(router, apiVersion)
+	}
+	a.registerAPIRoutes(router, "") // Legacy unversioned paths
+	router.NotFoundHandler = http.HandlerFunc(handleNotFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(handleMethodNotAllowed)
+	router.Use(recoveryMiddleware, timeoutMiddleware(a.routeTimeouts), tracingMiddleware(), authMiddleware(a.apiTokens), signatureMiddleware(a.signatures), rateLimitMiddleware(a.rateLimits))
+	return router
+}
+
+// registerAPIRoutes registers the command API of apiVersion on router, under
+// /v<apiVersion>, or at the unversioned paths if apiVersion is "". Routes are
+// registered on the root router rather than on subrouters, which would turn
+// method mismatches into 404s.
+func (a *Agent) registerAPIRoutes(router *mux.Router, apiVersion string) {
+	prefix := ""
+	if apiVersion != "" {
+		prefix = "/v" + apiVersion
+	}
+	negotiate := apiVersionMiddleware(apiVersion)
+	handle := func(method, path string, handler http.HandlerFunc) {
+		router.Handle(prefix+path, negotiate(handler)).Methods(method)
+	}
+	// Commands are audited even if they ask for an unsupported API version.
+	audited := func(method, path, command string, handler http.HandlerFunc) {
+		router.Handle(prefix+path, a.audited(command, negotiate(handler).ServeHTTP)).Methods(method)
+	}
+	audited("POST", "/provision-vm", "provision", a.handleProvisionVM)
+	handle("POST", "/provision-vm/dry-run", a.handleDryRun)
+	audited("POST", "/delete-vm", "delete", a.handleDeleteVM)
+	handle("GET", "/utilization", a.handleUtilization)
+	handle("GET", "/node", a.handleNode)
+	handle("GET", "/operations", a.handleOperations)
+	handle("GET", "/audit", a.handleAudit)
+	handle("GET", "/images", a.handleImages)
+	audited("DELETE", "/images", "image-purge", a.handlePurgeImages)
+	audited("DELETE", "/images/{name}", "image-delete", a.handleDeleteImage)
+	handle("POST", "/images/{name}/verify", a.handleVerifyImage)
+	handle("GET", "/downloads", a.handleDownloads)
+	handle("GET", "/sync-images", a.handleImageSyncStatus)
+	audited("POST", "/sync-images", "image-sync", a.handleSyncImages)
+	handle("GET", "/image-cache", a.handleImageCache)
+	handle("GET", "/disk-usage", a.handleDiskUsage)
+	handle("GET", "/provision-reports", a.handleProvisionReports)
+	handle("GET", "/history", a.handleHistory)
+	handle("POST", "/gc", a.handleGC)
+	handle("POST", "/cordon", a.handleCordon)
+	handle("POST", "/uncordon", a.handleUncordon)
+	handle("POST", "/vms/{vmId}/files", a.handleUploadFile)
+	handle("GET", "/vms/{vmId}/files", a.handleDownloadFile)
+	audited("POST", "/vms/{vmId}/exec", "exec", a.handleExec)
+	handle("POST", "/vms/{vmId}/shutdown", a.handleShutdownVM)
+	handle("POST", "/vms/{vmId}/suspend", a.handleSuspendVM)
+	handle("POST", "/vms/{vmId}/resume", a.handleResumeVM)
+	audited("POST", "/vms/{vmId}/template", "template-capture", a.handleCaptureTemplate)
+	audited("POST", "/admin/reboot", "host-reboot", a.handleHostPower(models.HostReboot))
+	audited("POST", "/admin/shutdown", "host-shutdown", a.handleHostPower(models.HostShutdown))
+	audited("POST", "/admin/support-bundle", "support-bundle", a.handleSupportBundle)
+	handle("POST", "/vms/{vmId}/healthcheck", a.handleHealthCheck)
+	handle("POST", "/vms/{vmId}/guest-events", a.handleGuestEvent)
+	// Add other agent-specific API endpoints if needed
+}
+
 // handleProvisionVM handles requests from the orchestrator to provision a VM.
 func (a *Agent) handleProvisionVM(w http.ResponseWriter, r *http.Request) {
+	if a.nodeInfo.SelectedBackend == "" {
+		writeError(w, http.StatusServiceUnavailable, "no_backend", "No usable VM backend on this node, see GET /node")
+		return
+	}
+	if state := a.cordon.State(); state.Cordoned {
+		writeError(w, http.StatusServiceUnavailable, "node_cordoned", fmt.Sprintf("Node is cordoned since %s: %s", state.Since.Format(time.RFC3339), state.Reason))
+		return
+	}
+
 	var cmd models.VMProvisionCommand
 	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
 		log.Printf("Error decoding provision VM command: %v", err)
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "invalid_payload", "Invalid request payload")
+		return
+	}
+	if err := a.vmManager.ApplyProfile(&cmd); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "unknown_profile", err.Error())
+		return
+	}
+	if err := validate.ProvisionCommand(cmd); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	if err := a.nodeLabels.Admit(cmd.NodeSelector, cmd.Tolerations); err != nil {
+		log.Printf("Rejecting provision of VM %s%s: %v", cmd.VMID, requestid.LogSuffix(r.Context()), err)
+		code := "node_selector_mismatch"
+		if errors.Is(err, nodelabels.ErrTaintNotTolerated) {
+			code = "taint_not_tolerated"
+		}
+		writeError(w, http.StatusUnprocessableEntity, code, err.Error())
 		return
 	}
 
-	// Run provisioning in a goroutine to not block the API handler
-	go func() {
-		if err := a.vmManager.ProvisionVM(cmd); err != nil {
-			log.Printf("Failed to provision VM %s: %v", cmd.VMID, err)
-			// TODO: Report provisioning failure back to orchestrator
+	if err := a.vmManager.Preflight(r.Context(), cmd); err != nil {
+		log.Printf("Rejecting provision of VM %s%s: %v", cmd.VMID, requestid.LogSuffix(r.Context()), err)
+		if errors.Is(err, imagemgr.ErrInsufficientStorage) {
+			writeError(w, http.StatusInsufficientStorage, "insufficient_storage", err.Error())
+			return
+		}
+		if errors.Is(err, imagemgr.ErrSmokeTestFailed) {
+			writeError(w, http.StatusUnprocessableEntity, "image_failed_smoke_test", err.Error())
+			return
+		}
+		if errors.Is(err, imagemgr.ErrRequirementsNotMet) {
+			writeError(w, http.StatusUnprocessableEntity, "image_requirements_not_met", err.Error())
+			return
+		}
+		if errors.Is(err, imagemgr.ErrArchMismatch) {
+			writeError(w, http.StatusUnprocessableEntity, "image_arch_mismatch", err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "preflight_failed", fmt.Sprintf("Disk preflight failed: %v", err))
+		return
+	}
+
+	// Run provisioning in the background to not block the API handler; the
+	// scheduler queues it if the node is already at its provisioning limit,
+	// and it then waits for a command worker behind any deletes.
+	// It stays in the request's trace but outlives the request.
+	ctx := context.WithoutCancel(r.Context())
+	err := a.provisions.Submit(ctx, scheduler.Tenant(cmd), cmd.VMID, func() {
+		var err error
+		a.commands.Run(ctx, scheduler.PriorityProvision, "provision", cmd.VMID, func() {
+			a.events.EmitContext(ctx, "vm.provision.started", fmt.Sprintf("Provisioning VM %s from image %s", cmd.VMID, cmd.ImageName), provisionDetails(cmd))
+			a.history.Started(cmd, scheduler.Tenant(cmd))
+			err = utils.CatchPanic("provision of VM "+cmd.VMID, func() error {
+				return a.vmManager.ProvisionVM(ctx, cmd)
+			})
+		})
+		a.auditResult(ctx, err)
+		a.utilization.RecordProvision(err == nil)
+		if err != nil {
+			log.Printf("Failed to provision VM %s%s: %v", cmd.VMID, requestid.LogSuffix(ctx), err)
+			a.reportProvisionStatus(ctx, cmd.VMID, "failed", err.Error())
+			a.vmRecords.AddContext(ctx, cmd.VMID, "failed", err.Error())
+			a.history.Ended(cmd.VMID, "failed", err.Error())
+			details := provisionDetails(cmd)
+			details["error"] = err.Error()
+			if stage := vmgr.TimedOutStage(err); stage != "" {
+				details["timedOutStage"] = stage
+			}
+			a.events.EmitContext(ctx, "vm.failed", fmt.Sprintf("Provisioning VM %s failed", cmd.VMID), details)
 		} else {
-			log.Printf("VM %s provisioning initiated successfully.", cmd.VMID)
-			// TODO: Report provisioning success back to orchestrator
+			log.Printf("VM %s provisioning initiated successfully%s.", cmd.VMID, requestid.LogSuffix(ctx))
+			a.reportProvisionStatus(ctx, cmd.VMID, "ready", "")
+			a.history.Ready(cmd.VMID)
+			a.events.EmitContext(ctx, "vm.ready", fmt.Sprintf("VM %s is ready", cmd.VMID), provisionDetails(cmd))
 		}
-	}()
+	})
+	switch {
+	case errors.Is(err, scheduler.ErrDuplicate):
+		writeError(w, http.StatusConflict, "vm_busy", fmt.Sprintf("VM %s is already being provisioned", cmd.VMID))
+		return
+	case errors.Is(err, scheduler.ErrQueueFull):
+		log.Printf("Rejecting provision of VM %s%s: %v", cmd.VMID, requestid.LogSuffix(r.Context()), err)
+		w.Header().Set("Retry-After", "30")
+		writeError(w, http.StatusTooManyRequests, "provision_queue_full", "Too many provisions pending on this node, retry later")
+		return
+	}
 
 	w.WriteHeader(http.StatusAccepted) // Acknowledge receipt, provisioning happens in background
 	json.NewEncoder(w).Encode(map[string]string{"message": "VM provisioning initiated"})
 }
 
+// handleDryRun renders the provisioning artifacts for a request without booting a VM.
+func (a *Agent) handleDryRun(w http.ResponseWriter, r *http.Request) {
+	var cmd models.VMProvisionCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		log.Printf("Error decoding dry-run command: %v", err)
+		writeError(w, http.StatusBadRequest, "invalid_payload", "Invalid request payload")
+		return
+	}
+	if err := validate.ProvisionCommand(cmd); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	result, err := a.vmManager.DryRun(cmd)
+	if errors.Is(err, vmprofiles.ErrUnknownProfile) {
+		writeError(w, http.StatusUnprocessableEntity, "unknown_profile", err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "dry_run_failed", fmt.Sprintf("Dry run failed: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
 // handleDeleteVM handles requests from the orchestrator to delete a VM.
 func (a *Agent) handleDeleteVM(w http.ResponseWriter, r *http.Request) {
 	var cmd models.VMDeleteCommand
 	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
 		log.Printf("Error decoding delete VM command: %v", err)
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "invalid_payload", "Invalid request payload")
+		return
+	}
+	if err := validate.VMID(cmd.VMID); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	// Queue the deletion ahead of other commands, in the request's trace
+	if err := a.submitDelete(context.WithoutCancel(r.Context()), cmd); err != nil {
+		writeCommandQueueFull(w)
 		return
 	}
 
-	// Run deletion in a goroutine
-	go func() {
-		if err := a.vmManager.DeleteVM(cmd); err != nil {
-			log.Printf("Failed to delete VM %s: %v", cmd.VMID, err)
+	w.WriteHeader(http.StatusAccepted) // Acknowledge receipt, deletion happens in background
+	json.NewEncoder(w).Encode(map[string]string{"message": "VM deletion initiated"})
+}
+
+// submitDelete queues the deletion of a VM ahead of other commands. The
+// deletion runs in ctx, whose audit record gets its result.
+func (a *Agent) submitDelete(ctx context.Context, cmd models.VMDeleteCommand) error {
+	return a.commands.Submit(ctx, scheduler.PriorityDelete, "delete", cmd.VMID, func() {
+		err := utils.CatchPanic("deletion of VM "+cmd.VMID, func() error {
+			return a.vmManager.DeleteVM(ctx, cmd)
+		})
+		a.auditResult(ctx, err)
+		if err != nil {
+			log.Printf("Failed to delete VM %s%s: %v", cmd.VMID, requestid.LogSuffix(ctx), err)
 			// TODO: Report deletion failure back to orchestrator
 		} else {
-			log.Printf("VM %s deletion initiated successfully.", cmd.VMID)
+			log.Printf("VM %s deletion initiated successfully%s.", cmd.VMID, requestid.LogSuffix(ctx))
+			a.utilization.RecordDeletion()
+			a.vmRecords.AddContext(ctx, cmd.VMID, "deleted", "")
+			a.history.Ended(cmd.VMID, "deleted", "")
+			a.events.EmitContext(ctx, "vm.deleted", fmt.Sprintf("VM %s was deleted", cmd.VMID), map[string]string{"vmId": cmd.VMID})
 			// TODO: Report deletion success back to orchestrator
 		}
-	}()
+	})
+}
 
-	w.WriteHeader(http.StatusAccepted) // Acknowledge receipt, deletion happens in background
-	json.NewEncoder(w).Encode(map[string]string{"message": "VM deletion initiated"})
+// handleShutdownVM powers a VM off without deleting it, e.g. to stop usage
+// while preserving its disk. The outcome is reported like other VM commands.
+func (a *Agent) handleShutdownVM(w http.ResponseWriter, r *http.Request) {
+	vmID, ok := vmIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	state, err := utils.GetVMState(vmID)
+	if err != nil {
+		writeVMStateError(w, err)
+		return
+	}
+	if state != "running" {
+		writeError(w, http.StatusConflict, "vm_not_running", fmt.Sprintf("VM %s is not running (state: %s)", vmID, state))
+		return
+	}
+
+	// Queue the shutdown, the guest may take a while to power off
+	err = a.commands.Submit(r.Context(), scheduler.PriorityControl, "shutdown", vmID, func() {
+		err := utils.CatchPanic("shutdown of VM "+vmID, func() error {
+			return a.vmManager.ShutdownVM(vmID)
+		})
+		if err != nil {
+			log.Printf("Failed to shut down VM %s: %v", vmID, err)
+			a.reportVMStatus(r.Context(), vmID, "shutdown-failed", err.Error())
+		} else {
+			a.reportVMStatus(r.Context(), vmID, "stopped", "")
+		}
+	})
+	if err != nil {
+		writeCommandQueueFull(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "VM shutdown initiated"})
+}
+
+// handleSuspendVM suspends a running VM to disk, freeing its memory and slot.
+func (a *Agent) handleSuspendVM(w http.ResponseWriter, r *http.Request) {
+	vmID, ok := vmIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	state, err := utils.GetVMState(vmID)
+	if err != nil {
+		writeVMStateError(w, err)
+		return
+	}
+	if state != "running" {
+		writeError(w, http.StatusConflict, "vm_not_running", fmt.Sprintf("VM %s is not running (state: %s)", vmID, state))
+		return
+	}
+	if a.operations.Busy(vmID) {
+		writeError(w, http.StatusConflict, "vm_busy", fmt.Sprintf("VM %s has an operation in progress, see GET /operations", vmID))
+		return
+	}
+
+	// Queue the suspension, saving the VM's memory can take a while
+	err = a.commands.Submit(r.Context(), scheduler.PriorityControl, "suspend", vmID, func() {
+		err := utils.CatchPanic("suspension of VM "+vmID, func() error {
+			return a.vmManager.SuspendVM(vmID)
+		})
+		if err != nil {
+			log.Printf("Failed to suspend VM %s: %v", vmID, err)
+			a.reportVMStatus(r.Context(), vmID, "suspend-failed", err.Error())
+		} else {
+			a.reportVMStatus(r.Context(), vmID, "suspended", "")
+		}
+	})
+	if err != nil {
+		writeCommandQueueFull(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "VM suspension initiated"})
+}
+
+// handleCaptureTemplate caches a VM's current disk as an image that new VMs
+// can be provisioned from, suspending the VM first if it is running.
+func (a *Agent) handleCaptureTemplate(w http.ResponseWriter, r *http.Request) {
+	vmID, ok := vmIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req models.VMTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_payload", "Invalid request payload")
+		return
+	}
+	if err := validate.ImageName(req.Name); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	if _, err := utils.GetVMState(vmID); err != nil {
+		writeVMStateError(w, err)
+		return
+	}
+	if a.operations.Busy(vmID) {
+		writeError(w, http.StatusConflict, "vm_busy", fmt.Sprintf("VM %s has an operation in progress, see GET /operations", vmID))
+		return
+	}
+
+	manifest, err := a.vmManager.CaptureTemplate(r.Context(), vmID, req.Name)
+	switch {
+	case errors.Is(err, imagemgr.ErrNotTemplate):
+		writeError(w, http.StatusConflict, "image_not_template", err.Error())
+		return
+	case errors.Is(err, imagemgr.ErrImageInUse):
+		writeError(w, http.StatusConflict, "image_in_use", err.Error())
+		return
+	case errors.Is(err, imagemgr.ErrImageDownloading):
+		writeError(w, http.StatusConflict, "image_downloading", err.Error())
+		return
+	case err != nil:
+		log.Printf("Failed to capture VM %s as template %s: %v", vmID, req.Name, err)
+		writeError(w, http.StatusInternalServerError, "template_capture_failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+// handleResumeVM resumes a suspended VM, if a slot is free for it.
+func (a *Agent) handleResumeVM(w http.ResponseWriter, r *http.Request) {
+	vmID, ok := vmIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	states, err := utils.ListVMs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "vm_list_failed", err.Error())
+		return
+	}
+	state, found := states[vmID]
+	if !found {
+		writeError(w, http.StatusNotFound, "vm_not_found", fmt.Sprintf("VM %s not found", vmID))
+		return
+	}
+	if state != "suspended" {
+		writeError(w, http.StatusConflict, "vm_not_suspended", fmt.Sprintf("VM %s is not suspended (state: %s)", vmID, state))
+		return
+	}
+	if a.thermalMonitor.Active() {
+		writeError(w, http.StatusConflict, "thermal_protection", "VMs stay suspended while host thermal pressure is critical")
+		return
+	}
+	running := 0
+	for vmID, state := range states {
+		if state == "running" && !vmgr.IsStandby(vmID) { // Standbys give up their slot
+			running++
+		}
+	}
+	if running >= a.cfg.MaxVMs {
+		writeError(w, http.StatusConflict, "no_free_slot", fmt.Sprintf("All %d VM slots are in use, suspend or delete a VM first", a.cfg.MaxVMs))
+		return
+	}
+	if a.operations.Busy(vmID) {
+		writeError(w, http.StatusConflict, "vm_busy", fmt.Sprintf("VM %s has an operation in progress, see GET /operations", vmID))
+		return
+	}
+
+	err = a.commands.Submit(r.Context(), scheduler.PriorityControl, "resume", vmID, func() {
+		err := utils.CatchPanic("resume of VM "+vmID, func() error {
+			return a.vmManager.ResumeVM(vmID)
+		})
+		if err != nil {
+			log.Printf("Failed to resume VM %s: %v", vmID, err)
+			a.reportVMStatus(r.Context(), vmID, "resume-failed", err.Error())
+		} else {
+			a.reportVMStatus(r.Context(), vmID, "resumed", "")
+		}
+	})
+	if err != nil {
+		writeCommandQueueFull(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "VM resume initiated"})
+}
+
+// handleHealthCheck runs the configured health checks against a running VM
+// and returns the report.
+func (a *Agent) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	vmID, ok := vmIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	report := a.vmManager.HealthCheck(r.Context(), vmID)
+	if !report.Healthy {
+		log.Printf("Health check of VM %s failed", vmID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleNode returns the host details and VM backend detection result.
+func (a *Agent) handleNode(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.nodeInfo)
+}
+
+// handleOperations lists the background operations currently in flight.
+func (a *Agent) handleOperations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.operations.List())
+}
+
+// handleGC collects stale VM directories now instead of waiting for the schedule.
+func (a *Agent) handleGC(w http.ResponseWriter, r *http.Request) {
+	result, err := a.janitor.CollectVMDirs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "gc_failed", fmt.Sprintf("VM directory collection failed: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleCordon marks the node unschedulable, e.g. POST /cordon {"reason": "macOS update"}.
+// Running VMs are left alone.
+func (a *Agent) handleCordon(w http.ResponseWriter, r *http.Request) {
+	var req models.CordonRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_payload", "Invalid request payload")
+			return
+		}
+	}
+
+	state, err := a.cordon.Cordon(req.Reason)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "cordon_failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// handleUncordon makes the node schedulable again.
+func (a *Agent) handleUncordon(w http.ResponseWriter, r *http.Request) {
+	state, err := a.cordon.Uncordon()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "uncordon_failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// handleImages lists the manifests of the cached images.
+func (a *Agent) handleImages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.imageManager.Manifests())
+}
+
+// handleDownloads lists the image downloads queued or in progress, with their
+// progress, rate and ETA.
+func (a *Agent) handleDownloads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.imageManager.Downloads())
+}
+
+// handleImageCache serves how well the image cache serves provisions: its
+// size and average image age, and hits, misses, bytes and evictions over the
+// last hour, day and week.
+func (a *Agent) handleImageCache(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.imageManager.CacheStats())
+}
+
+// handleDiskUsage serves where the node's disk space went: the image cache
+// and each VM, as last sampled in the background.
+func (a *Agent) handleDiskUsage(w http.ResponseWriter, r *http.Request) {
+	if a.cfg.DiskUsageInterval <= 0 {
+		writeError(w, http.StatusNotFound, "disk_usage_disabled", "Disk usage sampling is disabled, see --disk-usage-interval")
+		return
+	}
+	usage := a.diskUsage.Usage()
+	if usage == nil {
+		writeError(w, http.StatusServiceUnavailable, "disk_usage_not_sampled", "Disk usage hasn't been sampled yet")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// handleProvisionReports lists the timing reports of recent provisions,
+// newest first, e.g. GET /provision-reports?vmId=runner-1 for one VM's.
+func (a *Agent) handleProvisionReports(w http.ResponseWriter, r *http.Request) {
+	vmID := r.URL.Query().Get("vmId")
+	if vmID != "" {
+		if err := validate.VMID(vmID); err != nil {
+			writeValidationError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.vmManager.ProvisionReports(vmID))
+}
+
+// handleDeleteImage removes a cached image from the node, e.g. after a bad
+// build. Images that are downloading or used by a VM are refused.
+func (a *Agent) handleDeleteImage(w http.ResponseWriter, r *http.Request) {
+	imageName := mux.Vars(r)["name"]
+	if err := validate.ImageName(imageName); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	eviction, err := a.imageManager.DeleteImage(imageName)
+	switch {
+	case errors.Is(err, imagemgr.ErrImageNotCached):
+		writeError(w, http.StatusNotFound, "image_not_cached", err.Error())
+		return
+	case errors.Is(err, imagemgr.ErrImageInUse):
+		writeError(w, http.StatusConflict, "image_in_use", err.Error())
+		return
+	case errors.Is(err, imagemgr.ErrImageDownloading):
+		writeError(w, http.StatusConflict, "image_downloading", err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, "image_delete_failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(eviction)
+}
+
+// handleVerifyImage hashes a cached image and checks it against its manifest,
+// evicting it if it's corrupt so the next provision downloads it again.
+func (a *Agent) handleVerifyImage(w http.ResponseWriter, r *http.Request) {
+	imageName := mux.Vars(r)["name"]
+	if err := validate.ImageName(imageName); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	result, err := a.imageManager.VerifyImage(r.Context(), imageName, true)
+	switch {
+	case errors.Is(err, imagemgr.ErrImageNotCached):
+		writeError(w, http.StatusNotFound, "image_not_cached", err.Error())
+		return
+	case errors.Is(err, imagemgr.ErrImageDownloading):
+		writeError(w, http.StatusConflict, "image_downloading", err.Error())
+		return
+	case errors.Is(err, imagemgr.ErrImageNoManifest):
+		writeError(w, http.StatusConflict, "image_no_manifest", err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, "image_verify_failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handlePurgeImages removes every cached image that isn't downloading or used
+// by a VM, and lists the ones it kept.
+func (a *Agent) handlePurgeImages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.imageManager.PurgeImages())
+}
+
+// handleSyncImages sets the images the node keeps cached, e.g. POST
+// /sync-images {"images": ["macos-sequoia-xcode:16"], "evict": true}, and
+// returns how far the cache is from them. Downloads and removals run in the
+// background.
+func (a *Agent) handleSyncImages(w http.ResponseWriter, r *http.Request) {
+	var req models.ImageSyncRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_payload", "Invalid request payload")
+		return
+	}
+	status, err := a.imageManager.SetDesiredImages(req)
+	if err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleImageSyncStatus returns how far the cache is from the desired images.
+func (a *Agent) handleImageSyncStatus(w http.ResponseWriter, r *http.Request) {
+	status := a.imageManager.ImageSyncStatus()
+	if status == nil {
+		writeError(w, http.StatusNotFound, "no_desired_images", "No desired images were set, see POST /sync-images")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleUtilization returns hourly utilization rollups, e.g. GET /utilization?range=72h.
+func (a *Agent) handleUtilization(w http.ResponseWriter, r *http.Request) {
+	rangeDur := 24 * time.Hour
+	if value := r.URL.Query().Get("range"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid_range", "Invalid range, expected a positive duration such as 24h")
+			return
+		}
+		rangeDur = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.utilization.Rollups(rangeDur))
+}
+
+// reportVMStatus notifies the orchestrator about the outcome of a VM command,
+// whose request context is ctx.
+func (a *Agent) reportVMStatus(ctx context.Context, vmID, status, message string) {
+	a.postVMStatus(ctx, a.vmStatusUpdate(ctx, vmID, status, message))
+}
+
+// reportProvisionStatus reports the outcome of a provision to the
+// orchestrator, with the provision's timing report and, if it was confirmed,
+// the runner's registration.
+func (a *Agent) reportProvisionStatus(ctx context.Context, vmID, status, message string) {
+	update := a.vmStatusUpdate(ctx, vmID, status, message)
+	if report, ok := a.vmManager.ProvisionReport(vmID); ok {
+		update.ProvisionReport = &report
+	}
+	if status == "ready" {
+		update.Runner = a.vmManager.RunnerRegistration(vmID)
+	}
+	a.postVMStatus(ctx, update)
+}
+
+// provisionDetails returns the details of the lifecycle events of a provision.
+func provisionDetails(cmd models.VMProvisionCommand) map[string]string {
+	details := map[string]string{"vmId": cmd.VMID, "imageName": cmd.ImageName, "tenant": scheduler.Tenant(cmd)}
+	if cmd.Workload != "" {
+		details["workload"] = cmd.Workload
+	}
+	if cmd.Profile != "" {
+		details["profile"] = cmd.Profile
+	}
+	return details
+}
+
+func (a *Agent) vmStatusUpdate(ctx context.Context, vmID, status, message string) models.VMStatusUpdate {
+	return models.VMStatusUpdate{
+		NodeID:    a.cfg.NodeID,
+		VMID:      vmID,
+		Status:    status,
+		Message:   message,
+		RequestID: requestid.FromContext(ctx),
+		// Attach the guest network self-test so failures are visible on the VM record.
+		Reachability: a.vmManager.Reachability(vmID),
+	}
+}
+
+func (a *Agent) postVMStatus(ctx context.Context, update models.VMStatusUpdate) {
+	resp, err := a.orchestrator.PostContext(ctx, "/api/vm-status", update)
+	if err != nil {
+		log.Printf("Error reporting status '%s' for VM %s to orchestrator: %v", update.Status, update.VMID, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Received non-OK response for VM %s status update: %s", update.VMID, resp.Status)
+	}
 }
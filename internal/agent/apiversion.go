@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/version"
+	"github.com/gorilla/mux"
+)
+
+// apiVersionHeader negotiates the command API version. A client may send the
+// version it speaks; every versioned response carries the version that served it.
+const apiVersionHeader = "X-Macvmagt-Api-Version"
+
+// versionPrefix matches the version prefix of a path template, e.g. "/v1".
+var versionPrefix = regexp.MustCompile(`^/v[0-9]+/`)
+
+// unversionedPath strips the version prefix from a path template, so
+// per-route settings such as rate limits apply to every version of a route.
+func unversionedPath(template string) string {
+	if prefix := versionPrefix.FindString(template); prefix != "" {
+		return template[len(prefix)-1:]
+	}
+	return template
+}
+
+// apiVersionMiddleware serves routes of API version pathVersion, or, for the
+// unversioned legacy paths (pathVersion ""), the version the client asks for
+// in apiVersionHeader, defaulting to the oldest. Requests for a version the
+// agent doesn't serve, or that contradict their path, are rejected.
+func apiVersionMiddleware(pathVersion string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested := strings.TrimPrefix(r.Header.Get(apiVersionHeader), "v")
+			served := pathVersion
+			switch {
+			case requested == "":
+				if served == "" {
+					served = version.APIVersions[0]
+				}
+			case !slices.Contains(version.APIVersions, requested):
+				w.Header().Set(apiVersionHeader, strings.Join(version.APIVersions, ", "))
+				writeError(w, http.StatusBadRequest, "unsupported_api_version", fmt.Sprintf("API version %s is not supported, this agent serves %s", requested, strings.Join(version.APIVersions, ", ")))
+				return
+			case served != "" && requested != served:
+				writeError(w, http.StatusBadRequest, "api_version_mismatch", fmt.Sprintf("%s asks for API version %s but the path is version %s", apiVersionHeader, requested, served))
+				return
+			default:
+				served = requested
+			}
+			w.Header().Set(apiVersionHeader, served)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// handleVersion returns the agent's build info and the API versions it serves.
+func (a *Agent) handleVersion(w http.ResponseWriter, r *http.Request) {
+	revision, revisionTime, modified := version.VCS()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.VersionInfo{
+		AgentVersion: version.Version,
+		GoVersion:    runtime.Version(),
+		Revision:     revision,
+		RevisionTime: revisionTime,
+		Modified:     modified,
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		APIVersions:  version.APIVersions,
+	})
+}
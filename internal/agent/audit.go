@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/requestid"
+	"github.com/gorilla/mux"
+)
+
+// anonymousPrincipal is recorded as the caller of audited commands when no
+// API tokens are configured, so the command API doesn't authenticate callers.
+const anonymousPrincipal = "anonymous"
+
+// Page sizes of GET /audit.
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+// auditContextKey carries the *auditRecord of an audited request in its context.
+type auditContextKey struct{}
+
+// auditRecord is the audit entry of a command being handled. A synchronous
+// command's handler adds its result before returning; an asynchronous one's
+// result is written as its own entry once the acceptance entry is written.
+type auditRecord struct {
+	entry   models.AuditEntry
+	written chan struct{} // Closed once the entry for the response is written
+}
+
+// audited records every request handled by next in the audit log: who sent
+// which command for which VM, a hash of the payload, and the outcome.
+func (a *Agent) audited(command string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(payload))
+		sum := sha256.Sum256(payload)
+
+		vmID := mux.Vars(r)["vmId"]
+		if vmID == "" {
+			var target struct {
+				VMID string `json:"vmId"`
+			}
+			json.Unmarshal(payload, &target)
+			vmID = target.VMID
+		}
+
+		record := &auditRecord{
+			entry: models.AuditEntry{
+				RequestID:     requestid.FromContext(r.Context()),
+				Source:        sourceAddr(r),
+				Principal:     principal(r),
+				Command:       command,
+				VMID:          vmID,
+				PayloadSHA256: hex.EncodeToString(sum[:]),
+			},
+			written: make(chan struct{}),
+		}
+		defer close(record.written)
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, record)))
+
+		entry := record.entry
+		entry.Status = sw.status()
+		switch {
+		case entry.Error != "":
+			entry.Outcome = models.AuditFailed
+		case entry.Status >= http.StatusBadRequest:
+			entry.Outcome = models.AuditRejected
+		case entry.ExitCode != nil:
+			entry.Outcome = models.AuditCompleted
+		default:
+			entry.Outcome = models.AuditAccepted
+		}
+		a.appendAudit(entry)
+	}
+}
+
+// setAuditResult records the result of a synchronous command on its audit entry.
+func setAuditResult(ctx context.Context, exitCode *int, err error) {
+	record, ok := ctx.Value(auditContextKey{}).(*auditRecord)
+	if !ok {
+		return
+	}
+	record.entry.ExitCode = exitCode
+	if err != nil {
+		record.entry.Error = err.Error()
+	}
+}
+
+// auditResult writes the result of an asynchronous command, whose request
+// context is ctx, as a new entry following its acceptance.
+func (a *Agent) auditResult(ctx context.Context, err error) {
+	record, ok := ctx.Value(auditContextKey{}).(*auditRecord)
+	if !ok {
+		return
+	}
+	<-record.written
+	entry := record.entry
+	entry.Outcome = models.AuditSucceeded
+	if err != nil {
+		entry.Outcome, entry.Error = models.AuditFailed, err.Error()
+	}
+	a.appendAudit(entry)
+}
+
+func (a *Agent) appendAudit(entry models.AuditEntry) {
+	if err := a.audit.Append(entry); err != nil {
+		log.Printf("Error writing audit entry for %s of VM %s: %v", entry.Command, entry.VMID, err)
+	}
+}
+
+// handleAudit serves the audit log a page at a time, oldest first, e.g.
+// GET /audit?after=200&limit=100 for the entries following entry 200.
+func (a *Agent) handleAudit(w http.ResponseWriter, r *http.Request) {
+	var after int64
+	if value := r.URL.Query().Get("after"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_after", "Invalid after, expected an entry number such as 200")
+			return
+		}
+		after = parsed
+	}
+	limit := defaultAuditPageSize
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxAuditPageSize {
+			writeError(w, http.StatusBadRequest, "invalid_limit", "Invalid limit, expected 1 to "+strconv.Itoa(maxAuditPageSize))
+			return
+		}
+		limit = parsed
+	}
+
+	entries, more, err := a.audit.List(after, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "audit_read_failed", err.Error())
+		return
+	}
+	page := models.AuditPage{Entries: entries}
+	if more {
+		page.NextAfter = entries[len(entries)-1].Seq
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
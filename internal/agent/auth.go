@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/secrets"
+	"github.com/gorilla/mux"
+)
+
+// Roles of API tokens, recorded as the principal of audited commands.
+const (
+	readOnlyRole = "read-only" // May call GET endpoints
+	operatorRole = "operator"  // May call every endpoint
+)
+
+// publicRoutes are served without a token: version and health probes, and
+// guest events, which guest helpers authenticate with their VM's token. Deep
+// health checks aren't public, see isPublic.
+var publicRoutes = map[string]bool{
+	"/version":                 true,
+	"/healthz":                 true,
+	"/readyz":                  true,
+	"/vms/{vmId}/guest-events": true,
+}
+
+// operatorReads are the GET endpoints that need the operator token anyway,
+// since they return what's inside a VM.
+var operatorReads = map[string]bool{
+	"/vms/{vmId}/files": true,
+}
+
+// isPublic reports whether r, served by the route with the unversioned path
+// template, needs no token. GET /healthz?deep=1 runs every doctor check and
+// reports details of the host, so only the shallow liveness probe is public.
+func isPublic(template string, r *http.Request) bool {
+	if template == "/healthz" && deepHealthCheck(r) {
+		return false
+	}
+	return publicRoutes[template]
+}
+
+// roleContextKey carries the role of the token a request was authenticated
+// with in its context.
+type roleContextKey struct{}
+
+// apiTokens holds the SHA256 of the tokens of each role.
+type apiTokens struct {
+	readOnly [sha256.Size]byte
+	operator [sha256.Size]byte
+	hasRead  bool // A read-only token is configured
+}
+
+// loadAPITokens resolves OperatorTokenSecret and ReadOnlyTokenSecret through
+// the secrets provider. It returns nil if no operator token is configured,
+// so the API is open.
+func loadAPITokens(ctx context.Context, cfg *config.Config, provider secrets.Provider) (*apiTokens, error) {
+	if cfg.OperatorTokenSecret == "" {
+		if cfg.ReadOnlyTokenSecret != "" {
+			return nil, fmt.Errorf("--read-only-token-secret needs --operator-token-secret")
+		}
+		return nil, nil
+	}
+	operator, err := resolveToken(ctx, provider, cfg.OperatorTokenSecret)
+	if err != nil {
+		return nil, err
+	}
+	tokens := &apiTokens{operator: sha256.Sum256([]byte(operator))}
+	if cfg.ReadOnlyTokenSecret != "" {
+		readOnly, err := resolveToken(ctx, provider, cfg.ReadOnlyTokenSecret)
+		if err != nil {
+			return nil, err
+		}
+		if readOnly == operator {
+			return nil, fmt.Errorf("the read-only and operator tokens must differ")
+		}
+		tokens.readOnly, tokens.hasRead = sha256.Sum256([]byte(readOnly)), true
+	}
+	return tokens, nil
+}
+
+// resolveToken returns the API token held by the secret name.
+func resolveToken(ctx context.Context, provider secrets.Provider, name string) (string, error) {
+	token, err := provider.GetSecret(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve API token: %w", err)
+	}
+	if token == "" {
+		return "", fmt.Errorf("API token secret %s is empty", name)
+	}
+	return token, nil
+}
+
+// role returns the role of token, or "" if it is no API token. Tokens are
+// compared by hash in constant time.
+func (t *apiTokens) role(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	switch {
+	case subtle.ConstantTimeCompare(sum[:], t.operator[:]) == 1:
+		return operatorRole
+	case t.hasRead && subtle.ConstantTimeCompare(sum[:], t.readOnly[:]) == 1:
+		return readOnlyRole
+	}
+	return ""
+}
+
+// authMiddleware requires a bearer token on every route but publicRoutes, if
+// API tokens are configured: the read-only token for GET endpoints, else the
+// operator token. Requests without a valid token are rejected with 401, and
+// read-only tokens used for anything else with 403.
+func authMiddleware(tokens *apiTokens) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if tokens == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var template string
+			if route := mux.CurrentRoute(r); route != nil {
+				template, _ = route.GetPathTemplate()
+				template = unversionedPath(template)
+			}
+			if isPublic(template, r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			role := ""
+			if ok {
+				role = tokens.role(token)
+			}
+			if role == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="macvmagt"`)
+				writeError(w, http.StatusUnauthorized, "unauthorized", "Missing or invalid API token")
+				return
+			}
+			read := (r.Method == http.MethodGet || r.Method == http.MethodHead) && !operatorReads[template]
+			if role != operatorRole && !read {
+				writeError(w, http.StatusForbidden, "insufficient_scope", fmt.Sprintf("%s %s needs the operator token", r.Method, r.URL.Path))
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), roleContextKey{}, role)))
+		})
+	}
+}
+
+// principal returns the role of the token r was authenticated with, or
+// anonymousPrincipal if the API is open.
+func principal(r *http.Request) string {
+	if role, ok := r.Context().Value(roleContextKey{}).(string); ok {
+		return role
+	}
+	return anonymousPrincipal
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+const (
+	testOperatorToken = "operator-token-0123456789"
+	testReadOnlyToken = "read-only-token-0123456789"
+)
+
+// staticSecrets is a secrets.Provider holding fixed secrets.
+type staticSecrets map[string]string
+
+func (s staticSecrets) GetSecret(ctx context.Context, name string) (string, error) {
+	secret, ok := s[name]
+	if !ok {
+		return "", fmt.Errorf("no secret %s", name)
+	}
+	return secret, nil
+}
+
+// newAuthTestAgent returns an Agent with just enough set up to serve the
+// routes the auth tests call, with the test tokens if withTokens is set. Its
+// deep health report is cached, so deep checks don't run the doctor.
+func newAuthTestAgent(t *testing.T, withTokens bool) *Agent {
+	t.Helper()
+	cfg := &config.Config{NodeID: "node-1"}
+	if withTokens {
+		cfg.OperatorTokenSecret, cfg.ReadOnlyTokenSecret = "OPERATOR_TOKEN", "READ_ONLY_TOKEN"
+	}
+	tokens, err := loadAPITokens(context.Background(), cfg, staticSecrets{
+		"OPERATOR_TOKEN":  testOperatorToken,
+		"READ_ONLY_TOKEN": testReadOnlyToken,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Agent{
+		cfg:       cfg,
+		apiTokens: tokens,
+		nodeInfo:  &models.NodeInfo{NodeID: cfg.NodeID},
+		started:   time.Now(),
+	}
+	a.deepHealth.report = &models.DoctorReport{Healthy: true, CheckedAt: time.Now()}
+	return a
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		noTokens      bool // Serve without API tokens configured
+		method, path  string
+		authorization string
+		wantStatus    int
+		wantCode      string // Error code of rejected requests
+	}{
+		{name: "read-only token on GET", method: "GET", path: "/node", authorization: "Bearer " + testReadOnlyToken, wantStatus: http.StatusOK},
+		{name: "read-only token on versioned GET", method: "GET", path: "/v1/node", authorization: "Bearer " + testReadOnlyToken, wantStatus: http.StatusOK},
+		{name: "read-only token on POST", method: "POST", path: "/provision-vm/dry-run", authorization: "Bearer " + testReadOnlyToken, wantStatus: http.StatusForbidden, wantCode: "insufficient_scope"},
+		{name: "read-only token on delete", method: "POST", path: "/v1/delete-vm", authorization: "Bearer " + testReadOnlyToken, wantStatus: http.StatusForbidden, wantCode: "insufficient_scope"},
+		{name: "read-only token on DELETE", method: "DELETE", path: "/images/macos-15", authorization: "Bearer " + testReadOnlyToken, wantStatus: http.StatusForbidden, wantCode: "insufficient_scope"},
+		{name: "read-only token on operator read", method: "GET", path: "/vms/vm-1/files?path=relative", authorization: "Bearer " + testReadOnlyToken, wantStatus: http.StatusForbidden, wantCode: "insufficient_scope"},
+		{name: "operator token on GET", method: "GET", path: "/node", authorization: "Bearer " + testOperatorToken, wantStatus: http.StatusOK},
+		{name: "operator token on POST", method: "POST", path: "/provision-vm/dry-run", authorization: "Bearer " + testOperatorToken, wantStatus: http.StatusBadRequest, wantCode: "invalid_payload"},
+		{name: "operator token on operator read", method: "GET", path: "/vms/vm-1/files?path=relative", authorization: "Bearer " + testOperatorToken, wantStatus: http.StatusBadRequest, wantCode: "invalid_path"},
+		{name: "missing token", method: "GET", path: "/node", wantStatus: http.StatusUnauthorized, wantCode: "unauthorized"},
+		{name: "missing token on POST", method: "POST", path: "/provision-vm/dry-run", wantStatus: http.StatusUnauthorized, wantCode: "unauthorized"},
+		{name: "unknown token", method: "GET", path: "/node", authorization: "Bearer not-a-token", wantStatus: http.StatusUnauthorized, wantCode: "unauthorized"},
+		{name: "token without Bearer", method: "GET", path: "/node", authorization: testOperatorToken, wantStatus: http.StatusUnauthorized, wantCode: "unauthorized"},
+		{name: "basic auth", method: "GET", path: "/node", authorization: "Basic " + testOperatorToken, wantStatus: http.StatusUnauthorized, wantCode: "unauthorized"},
+		{name: "empty bearer", method: "GET", path: "/node", authorization: "Bearer ", wantStatus: http.StatusUnauthorized, wantCode: "unauthorized"},
+		{name: "public version", method: "GET", path: "/version", wantStatus: http.StatusOK},
+		{name: "public liveness", method: "GET", path: "/healthz", wantStatus: http.StatusOK},
+		{name: "deep health check without token", method: "GET", path: "/healthz?deep=1", wantStatus: http.StatusUnauthorized, wantCode: "unauthorized"},
+		{name: "deep health check with read-only token", method: "GET", path: "/healthz?deep=true", authorization: "Bearer " + testReadOnlyToken, wantStatus: http.StatusOK},
+		{name: "no tokens configured, GET", noTokens: true, method: "GET", path: "/node", wantStatus: http.StatusOK},
+		{name: "no tokens configured, POST", noTokens: true, method: "POST", path: "/provision-vm/dry-run", wantStatus: http.StatusBadRequest, wantCode: "invalid_payload"},
+		{name: "no tokens configured, deep health check", noTokens: true, method: "GET", path: "/healthz?deep=1", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newAuthTestAgent(t, !tt.noTokens).router()
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader("not json"))
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantCode != "" {
+				var response models.ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.Error.Code != tt.wantCode {
+					t.Errorf("got body %s, want code %q", w.Body, tt.wantCode)
+				}
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("401 without a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestLoadAPITokens(t *testing.T) {
+	secrets := staticSecrets{"A": "same-token", "B": "same-token", "EMPTY": ""}
+	for _, cfg := range []*config.Config{
+		{ReadOnlyTokenSecret: "A"},                           // Read-only token without an operator token
+		{OperatorTokenSecret: "A", ReadOnlyTokenSecret: "B"}, // Same token for both roles
+		{OperatorTokenSecret: "EMPTY"},
+		{OperatorTokenSecret: "MISSING"},
+	} {
+		if _, err := loadAPITokens(context.Background(), cfg, secrets); err == nil {
+			t.Errorf("loadAPITokens(operator %q, read-only %q) succeeded, want an error", cfg.OperatorTokenSecret, cfg.ReadOnlyTokenSecret)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/scheduler"
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// autoDeletes tracks the VMs of ephemeral runners being deleted, so a VM
+// whose job finished is deleted only once.
+type autoDeletes struct {
+	mu    sync.Mutex
+	vmIDs map[string]bool
+}
+
+// start reports whether the deletion of a VM may start, marking it as started.
+func (d *autoDeletes) start(vmID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.vmIDs[vmID] {
+		return false
+	}
+	if d.vmIDs == nil {
+		d.vmIDs = make(map[string]bool)
+	}
+	d.vmIDs[vmID] = true
+	return true
+}
+
+// done forgets a VM once its deletion finished.
+func (d *autoDeletes) done(vmID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.vmIDs, vmID)
+}
+
+// watchEphemeral deletes VMs whose ephemeral runner finished its job every
+// EphemeralCheckInterval, returning their slots without the orchestrator
+// having to poll for it. It runs until the agent exits.
+func (a *Agent) watchEphemeral() {
+	ticker := time.NewTicker(a.cfg.EphemeralCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, vmID := range a.vmManager.EphemeralVMs() {
+			if a.vmManager.JobFinished(context.Background(), vmID) {
+				a.deleteEphemeral(vmID)
+			}
+		}
+	}
+}
+
+// deleteEphemeral queues the deletion of a VM whose ephemeral runner finished
+// its job, unless it is already being deleted.
+func (a *Agent) deleteEphemeral(vmID string) {
+	if !a.autoDeletes.start(vmID) {
+		return
+	}
+	log.Printf("Ephemeral runner of VM %s finished its job, deleting the VM", vmID)
+	// Not bounded like the orchestrator's deletes: the job is done and the slot must be freed
+	go a.commands.Run(context.Background(), scheduler.PriorityDelete, "delete", vmID, func() {
+		defer a.autoDeletes.done(vmID)
+		err := utils.CatchPanic("deletion of VM "+vmID, func() error {
+			return a.vmManager.DeleteVM(context.Background(), models.VMDeleteCommand{VMID: vmID})
+		})
+		if err != nil {
+			log.Printf("Failed to delete VM %s of a finished ephemeral runner: %v", vmID, err)
+			return
+		}
+		a.utilization.RecordDeletion()
+		a.vmRecords.Add(vmID, "deleted", "ephemeral runner finished its job")
+		a.history.Ended(vmID, "job-finished", "")
+		a.events.Emit("vm.ephemeral-deleted", fmt.Sprintf("Ephemeral runner of VM %s finished its job, the VM was deleted", vmID), map[string]string{"vmId": vmID})
+	})
+}
@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/utils"
+	"github.com/changty97/macvmagt/internal/validate"
+	"github.com/gorilla/mux"
+)
+
+// writeError sends a JSON error response with a machine-readable code.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(models.ErrorResponse{Error: models.APIError{Code: code, Message: message}})
+}
+
+// writeValidationError sends a 400 for a validation failure, using its code.
+func writeValidationError(w http.ResponseWriter, err error) {
+	var validationErr *validate.Error
+	if errors.As(err, &validationErr) {
+		writeError(w, http.StatusBadRequest, validationErr.Code, validationErr.Message)
+		return
+	}
+	writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+}
+
+// writeVMStateError sends a 404 if a VM's state couldn't be read because
+// the VM doesn't exist, and a 500 if tart couldn't be asked.
+func writeVMStateError(w http.ResponseWriter, err error) {
+	if errors.Is(err, utils.ErrVMNotFound) {
+		writeError(w, http.StatusNotFound, "vm_not_found", err.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "vm_state_failed", err.Error())
+}
+
+// writeCommandQueueFull sends a 429 for a VM command rejected because the
+// command queue is full, asking the orchestrator to back off.
+func writeCommandQueueFull(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "30")
+	writeError(w, http.StatusTooManyRequests, "command_queue_full", "Too many VM commands queued on this node, retry later")
+}
+
+// vmIDFromPath returns the validated {vmId} of a request, or writes a 400 and
+// returns false.
+func vmIDFromPath(w http.ResponseWriter, r *http.Request) (string, bool) {
+	vmID := mux.Vars(r)["vmId"]
+	if err := validate.VMID(vmID); err != nil {
+		writeValidationError(w, err)
+		return "", false
+	}
+	return vmID, true
+}
+
+// handleNotFound answers requests for unknown routes.
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, "not_found", "No such endpoint: "+r.URL.Path)
+}
+
+// handleMethodNotAllowed answers requests with a method the route doesn't support.
+func handleMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" is not supported on "+r.URL.Path)
+}
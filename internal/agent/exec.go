@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// defaultExecTimeout applies when an exec request doesn't specify a timeout.
+const defaultExecTimeout = 60 * time.Second
+
+// handleExec runs a command inside a VM, e.g. POST /vms/{vmId}/exec with
+// {"command": "df -h /", "timeoutSeconds": 30}. Output is streamed back as
+// newline-delimited JSON chunks, followed by a final chunk with the exit code.
+func (a *Agent) handleExec(w http.ResponseWriter, r *http.Request) {
+	vmID, ok := vmIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.VMExecRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Command == "" {
+		writeError(w, http.StatusBadRequest, "invalid_payload", "Invalid request payload, 'command' is required")
+		return
+	}
+
+	timeout := defaultExecTimeout
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+	}
+	if timeout > a.cfg.ExecMaxTimeout {
+		timeout = a.cfg.ExecMaxTimeout
+	}
+
+	// Like file transfers, exec outlives the server's default write deadline.
+	deadline := time.Now().Add(timeout + 5*time.Second)
+	if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+		log.Printf("Warning: Could not extend write deadline for exec: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	log.Printf("Executing command in VM %s: %s", vmID, req.Command)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	stream := &execStream{w: w, encoder: json.NewEncoder(w)}
+
+	exitCode, err := a.vmManager.Exec(ctx, vmID, req.Command, stream.writer("stdout"), stream.writer("stderr"))
+	final := models.VMExecOutput{ExitCode: &exitCode}
+	if err != nil {
+		log.Printf("Exec in VM %s failed: %v", vmID, err)
+		final.Error = err.Error()
+	}
+	setAuditResult(r.Context(), &exitCode, err)
+	stream.send(final)
+}
+
+// execStream serializes output chunks from the concurrently copied stdout and
+// stderr of an SSH session onto one response.
+type execStream struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	encoder *json.Encoder
+}
+
+func (s *execStream) send(chunk models.VMExecOutput) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.encoder.Encode(chunk); err != nil {
+		return err
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+func (s *execStream) writer(name string) *execStreamWriter {
+	return &execStreamWriter{stream: s, name: name}
+}
+
+// execStreamWriter turns writes into output chunks for one stream.
+type execStreamWriter struct {
+	stream *execStream
+	name   string
+}
+
+func (w *execStreamWriter) Write(p []byte) (int, error) {
+	if err := w.stream.send(models.VMExecOutput{Stream: w.name, Data: string(p)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
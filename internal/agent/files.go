@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// defaultUploadMode is used for uploaded files when no mode is given.
+const defaultUploadMode = 0644
+
+// handleUploadFile writes the request body to a file inside a VM, e.g.
+// POST /vms/{vmId}/files?path=/Users/admin/cert.p12&mode=0600.
+func (a *Agent) handleUploadFile(w http.ResponseWriter, r *http.Request) {
+	vmID, ok := vmIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	remotePath := r.URL.Query().Get("path")
+	if !path.IsAbs(remotePath) {
+		writeError(w, http.StatusBadRequest, "invalid_path", "Query parameter 'path' must be an absolute guest path")
+		return
+	}
+
+	mode := os.FileMode(defaultUploadMode)
+	if value := r.URL.Query().Get("mode"); value != "" {
+		parsed, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || parsed > 0777 {
+			writeError(w, http.StatusBadRequest, "invalid_mode", "Invalid mode, expected octal permissions such as 0644")
+			return
+		}
+		mode = os.FileMode(parsed)
+	}
+
+	ctx, cancel := a.fileTransferContext(w, r)
+	defer cancel()
+
+	body := http.MaxBytesReader(w, r.Body, a.cfg.FileTransferMaxBytes)
+	if err := a.vmManager.UploadFile(ctx, vmID, remotePath, body, mode); err != nil {
+		log.Printf("Error uploading %s to VM %s: %v", remotePath, vmID, err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("File exceeds the %d byte limit", a.cfg.FileTransferMaxBytes))
+			return
+		}
+		writeError(w, http.StatusBadGateway, "upload_failed", fmt.Sprintf("Upload failed: %v", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleDownloadFile streams a file from inside a VM, e.g.
+// GET /vms/{vmId}/files?path=/Users/admin/Library/Logs/DiagnosticReports/app.crash.
+func (a *Agent) handleDownloadFile(w http.ResponseWriter, r *http.Request) {
+	vmID, ok := vmIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	remotePath := r.URL.Query().Get("path")
+	if !path.IsAbs(remotePath) {
+		writeError(w, http.StatusBadRequest, "invalid_path", "Query parameter 'path' must be an absolute guest path")
+		return
+	}
+
+	ctx, cancel := a.fileTransferContext(w, r)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(remotePath)))
+
+	dst := &trackingWriter{ResponseWriter: w}
+	if err := a.vmManager.DownloadFile(ctx, vmID, remotePath, dst); err != nil {
+		log.Printf("Error downloading %s from VM %s: %v", remotePath, vmID, err)
+		if dst.written {
+			return // Headers are already sent; the client sees a truncated body
+		}
+		w.Header().Del("Content-Disposition")
+		if errors.Is(err, os.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "file_not_found", fmt.Sprintf("File %s not found in VM %s", remotePath, vmID))
+			return
+		}
+		writeError(w, http.StatusBadGateway, "download_failed", fmt.Sprintf("Download failed: %v", err))
+	}
+}
+
+// fileTransferContext lifts the server's short read/write deadlines for this
+// request and bounds the transfer by FileTransferTimeout instead.
+func (a *Agent) fileTransferContext(w http.ResponseWriter, r *http.Request) (context.Context, context.CancelFunc) {
+	deadline := time.Now().Add(a.cfg.FileTransferTimeout)
+	extendDeadlines(w, deadline)
+	return context.WithDeadline(r.Context(), deadline)
+}
+
+// trackingWriter records whether any of the response body has been written.
+type trackingWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	t.written = true
+	return t.ResponseWriter.Write(p)
+}
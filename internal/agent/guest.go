@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/validate"
+)
+
+// handleGuestEvent records a phase reported by the guest helper inside a VM,
+// e.g. POST /vms/{vmId}/guest-events with {"event": "job-started", "job": "123/build"}.
+// The helper authenticates with the VM's guest token as a bearer token, so a
+// guest can only report events for its own VM.
+func (a *Agent) handleGuestEvent(w http.ResponseWriter, r *http.Request) {
+	vmID, ok := vmIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !a.vmManager.CheckGuestToken(vmID, token) {
+		writeError(w, http.StatusUnauthorized, "invalid_guest_token", "Missing or invalid guest token")
+		return
+	}
+
+	var event models.GuestEvent
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&event); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_payload", "Invalid request payload")
+		return
+	}
+	if err := validate.GuestEvent(event); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	a.vmManager.RecordGuestEvent(vmID, event)
+	if event.Event == models.GuestJobFinished && a.vmManager.IsEphemeral(vmID) {
+		a.deleteEphemeral(vmID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/requestid"
+	"github.com/changty97/macvmagt/internal/validate"
+)
+
+// Source and principal audited for commands from heartbeat responses, which
+// come from the orchestrator the agent sends heartbeats to.
+const (
+	heartbeatSource    = "heartbeat"
+	heartbeatPrincipal = "orchestrator"
+)
+
+// handleHeartbeatCommand runs a command from a heartbeat response like the
+// endpoint of the same command would. Deletes and prefetches are started in
+// the background.
+func (a *Agent) handleHeartbeatCommand(cmd models.HeartbeatCommand) error {
+	ctx := requestid.NewContext(context.Background(), requestid.New())
+	switch cmd.Type {
+	case models.HeartbeatCordon:
+		_, err := a.cordon.Cordon(cmd.Reason)
+		return err
+	case models.HeartbeatUncordon:
+		_, err := a.cordon.Uncordon()
+		return err
+	case models.HeartbeatPrefetchImage:
+		if err := validate.ImageName(cmd.ImageName); err != nil {
+			return err
+		}
+		if err := a.imageManager.CheckArch(ctx, cmd.ImageName); err != nil {
+			return err
+		}
+		// Nothing waits for the image, so the download isn't canceled.
+		a.imageManager.RequestImageDownload(ctx, cmd.ImageName)
+		return nil
+	case models.HeartbeatDeleteVM:
+		if err := validate.VMID(cmd.VMID); err != nil {
+			return err
+		}
+		return a.deleteFromHeartbeat(ctx, cmd)
+	default:
+		return fmt.Errorf("unsupported command type %q", cmd.Type)
+	}
+}
+
+// deleteFromHeartbeat queues the deletion of cmd.VMID and audits it like a
+// delete request: an entry for its acceptance, then one for its result.
+func (a *Agent) deleteFromHeartbeat(ctx context.Context, cmd models.HeartbeatCommand) error {
+	payload, _ := json.Marshal(cmd)
+	sum := sha256.Sum256(payload)
+	record := &auditRecord{
+		entry: models.AuditEntry{
+			RequestID:     requestid.FromContext(ctx),
+			Source:        heartbeatSource,
+			Principal:     heartbeatPrincipal,
+			Command:       "delete",
+			VMID:          cmd.VMID,
+			PayloadSHA256: hex.EncodeToString(sum[:]),
+		},
+		written: make(chan struct{}),
+	}
+	defer close(record.written)
+
+	log.Printf("Deleting VM %s for heartbeat command %s%s", cmd.VMID, cmd.ID, requestid.LogSuffix(ctx))
+	err := a.submitDelete(context.WithValue(ctx, auditContextKey{}, record), models.VMDeleteCommand{VMID: cmd.VMID})
+	entry := record.entry
+	entry.Outcome = models.AuditAccepted
+	if err != nil {
+		entry.Outcome, entry.Error = models.AuditRejected, err.Error()
+	}
+	a.appendAudit(entry)
+	return err
+}
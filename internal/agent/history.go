@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/validate"
+	"github.com/changty97/macvmagt/internal/vmrecords"
+)
+
+// exitReasons are the exit reasons GET /history filters by, "running" for
+// VMs that haven't ended.
+var exitReasons = map[string]bool{"running": true, "deleted": true, "job-finished": true, "failed": true, "interrupted": true}
+
+// handleHistory lists the VMs provisioned on the node, newest first, for
+// usage accounting that doesn't depend on the orchestrator. It filters by
+// vmId, image, tenant and exitReason, by since and until (RFC 3339) and caps
+// the entries at limit.
+func (a *Agent) handleHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := vmrecords.HistoryFilter{
+		VMID:       query.Get("vmId"),
+		ImageName:  query.Get("image"),
+		Tenant:     query.Get("tenant"),
+		ExitReason: query.Get("exitReason"),
+	}
+	if filter.VMID != "" {
+		if err := validate.VMID(filter.VMID); err != nil {
+			writeValidationError(w, err)
+			return
+		}
+	}
+	if filter.ExitReason != "" && !exitReasons[filter.ExitReason] {
+		writeError(w, http.StatusBadRequest, "invalid_exit_reason", "Invalid exitReason, expected running, deleted, job-finished, failed or interrupted")
+		return
+	}
+	for _, bound := range []struct {
+		name string
+		time *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		value := query.Get(bound.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_"+bound.name, "Invalid "+bound.name+", expected an RFC 3339 time such as 2024-05-01T00:00:00Z")
+			return
+		}
+		*bound.time = parsed
+	}
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			writeError(w, http.StatusBadRequest, "invalid_limit", "Invalid limit, expected a positive number")
+			return
+		}
+		filter.Limit = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.history.List(filter))
+}
@@ -0,0 +1,180 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/fakedriver"
+	"github.com/changty97/macvmagt/internal/hostpower"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/requestid"
+	"github.com/changty97/macvmagt/internal/utils"
+	"github.com/changty97/macvmagt/internal/vmgr"
+)
+
+// hostPowerDelay is how long a reboot or shutdown waits after it was
+// accepted, so the response and the event announcing it get out first.
+const hostPowerDelay = 2 * time.Second
+
+// hostPowerEvents are the events announcing each host power action.
+var hostPowerEvents = map[string]string{
+	models.HostReboot:   "host.rebooting",
+	models.HostShutdown: "host.shutting-down",
+}
+
+// handleHostPower reboots or shuts down the host, e.g. POST /admin/reboot
+// {"reason": "kernel panic recovery"}. It refuses while VMs are running or
+// operations are in flight, and while launchd wouldn't start the agent again
+// after boot, unless force is set in the body or as ?force=true. The node is
+// cordoned until the host went down, and uncordoned once the agent is back.
+func (a *Agent) handleHostPower(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.HostPowerRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_payload", "Invalid request payload")
+				return
+			}
+		}
+		if force := r.URL.Query().Get("force"); force != "" {
+			forced, err := strconv.ParseBool(force)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_force", fmt.Sprintf("invalid force %q", force))
+				return
+			}
+			req.Force = req.Force || forced
+		}
+
+		if a.hostPower.Pending() {
+			writeError(w, http.StatusConflict, "host_power_pending", "A host reboot or shutdown is already under way")
+			return
+		}
+		// shutdown(8) needs root; the fake driver only simulates it.
+		if os.Geteuid() != 0 && a.cfg.Driver != fakedriver.Name {
+			writeError(w, http.StatusForbidden, "requires_root", fmt.Sprintf("The agent must run as root to %s the host", action))
+			return
+		}
+		busy, err := a.busyVMs()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "vm_list_failed", err.Error())
+			return
+		}
+		if len(busy) > 0 && !req.Force {
+			writeError(w, http.StatusConflict, "vms_running", fmt.Sprintf("VMs are running: %s; drain the node first or pass force=true", strings.Join(busy, ", ")))
+			return
+		}
+		if ops := a.busyOperations(); len(ops) > 0 && !req.Force {
+			writeError(w, http.StatusConflict, "operations_in_flight", fmt.Sprintf("Operations are in flight: %s; wait for them or pass force=true", strings.Join(ops, ", ")))
+			return
+		}
+		if err := hostpower.CheckLaunchd(a.cfg.UpdateLaunchdLabel); err != nil && !req.Force {
+			writeError(w, http.StatusConflict, "launchd_not_ready", fmt.Sprintf("%v; the agent might not come back after boot, pass force=true to %s anyway", err, action))
+			return
+		}
+
+		hostAction := models.HostPowerAction{
+			Action:      action,
+			Reason:      req.Reason,
+			RequestID:   requestid.FromContext(r.Context()),
+			RequestedAt: time.Now().UTC(),
+			Forced:      req.Force,
+			RunningVMs:  busy,
+			Cordoned:    !a.cordon.Cordoned(),
+		}
+		if hostAction.Cordoned {
+			if _, err := a.cordon.Cordon("host " + action); err != nil {
+				writeError(w, http.StatusInternalServerError, "cordon_failed", err.Error())
+				return
+			}
+		}
+		if err := a.hostPower.Begin(hostAction); err != nil {
+			a.uncordonAfter(hostAction)
+			writeError(w, http.StatusConflict, "host_power_pending", err.Error())
+			return
+		}
+
+		log.Printf("Host %s requested (%s)%s", action, req.Reason, requestid.LogSuffix(r.Context()))
+		ctx := context.WithoutCancel(r.Context())
+		go func() {
+			details := map[string]string{"reason": req.Reason, "forced": strconv.FormatBool(req.Force)}
+			if len(busy) > 0 {
+				details["runningVms"] = strings.Join(busy, ",")
+			}
+			a.events.EmitContext(ctx, hostPowerEvents[action], fmt.Sprintf("Host %s requested, heartbeats stop until the agent is back", action), details)
+			time.Sleep(hostPowerDelay)
+			if err := a.hostPower.Execute(hostAction); err != nil {
+				log.Printf("Error: %v", err)
+				a.uncordonAfter(hostAction)
+				a.events.EmitContext(ctx, "host.power-failed", err.Error(), map[string]string{"action": action})
+			}
+		}()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(hostAction)
+	}
+}
+
+// busyVMs returns the running VMs but warm pool standbys, which hold no work.
+func (a *Agent) busyVMs() ([]string, error) {
+	vms, err := utils.GetRunningVMs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list running VMs: %w", err)
+	}
+	var busy []string
+	for _, vm := range vms {
+		if !vmgr.IsStandby(vm.VMID) {
+			busy = append(busy, vm.VMID)
+		}
+	}
+	return busy, nil
+}
+
+// busyOperations returns the operations in flight but those on warm pool
+// standbys, as "<kind> <target>".
+func (a *Agent) busyOperations() []string {
+	var busy []string
+	for _, op := range a.operations.List() {
+		if !vmgr.IsStandby(op.Target) {
+			busy = append(busy, op.Kind+" "+op.Target)
+		}
+	}
+	return busy
+}
+
+// uncordonAfter uncordons the node if a host power action cordoned it.
+func (a *Agent) uncordonAfter(action models.HostPowerAction) {
+	if !action.Cordoned {
+		return
+	}
+	if _, err := a.cordon.Uncordon(); err != nil {
+		log.Printf("Error uncordoning node after host %s: %v", action.Action, err)
+	}
+}
+
+// reportHostBoot tells the orchestrator the host is back from the reboot or
+// shutdown the last run of the agent was asked for, and uncordons the node.
+func (a *Agent) reportHostBoot() {
+	last := a.hostPower.Last()
+	if last == nil {
+		return
+	}
+	a.uncordonAfter(*last)
+	details := map[string]string{
+		"action":      last.Action,
+		"reason":      last.Reason,
+		"requestedAt": last.RequestedAt.Format(time.RFC3339),
+	}
+	if !last.BootedAt.IsZero() {
+		details["bootedAt"] = last.BootedAt.Format(time.RFC3339)
+	}
+	ctx := requestid.NewContext(context.Background(), last.RequestID)
+	go a.events.EmitContext(ctx, "host.booted", fmt.Sprintf("Host is back from the %s requested at %s", last.Action, last.RequestedAt.Format(time.RFC3339)), details)
+}
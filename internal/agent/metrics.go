@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// vmMetrics are the per-VM metrics served by /metrics, in Prometheus text format.
+var vmMetrics = []struct {
+	name, kind, help string
+	value            func(models.VMResourceUsage) float64
+}{
+	{"macvmagt_vm_cpu_percent", "gauge", "CPU used by the VM's processes since the previous sample, 100 per core.",
+		func(u models.VMResourceUsage) float64 { return u.CPUPercent }},
+	{"macvmagt_vm_memory_rss_bytes", "gauge", "Resident memory of the VM's processes.",
+		func(u models.VMResourceUsage) float64 { return float64(u.MemoryRSSBytes) }},
+	{"macvmagt_vm_disk_bytes", "gauge", "Disk space allocated to the VM's directory.",
+		func(u models.VMResourceUsage) float64 { return float64(u.DiskBytes) }},
+	{"macvmagt_vm_network_receive_bytes_total", "counter", "Bytes received by the guest on its vmnet interface.",
+		func(u models.VMResourceUsage) float64 { return float64(u.NetRxBytes) }},
+	{"macvmagt_vm_network_transmit_bytes_total", "counter", "Bytes sent by the guest on its vmnet interface.",
+		func(u models.VMResourceUsage) float64 { return float64(u.NetTxBytes) }},
+}
+
+// imageCacheMetrics are the image cache metrics served by /metrics per rolling window.
+var imageCacheMetrics = []struct {
+	name, help string
+	value      func(models.ImageCacheWindow) float64
+}{
+	{"macvmagt_image_cache_hit_ratio", "Provisions that found their image cached, out of all provisions.",
+		func(w models.ImageCacheWindow) float64 { return w.HitRatio }},
+	{"macvmagt_image_cache_hits", "Provisions that found their image cached.",
+		func(w models.ImageCacheWindow) float64 { return float64(w.Hits) }},
+	{"macvmagt_image_cache_misses", "Provisions that had to wait for their image to download.",
+		func(w models.ImageCacheWindow) float64 { return float64(w.Misses) }},
+	{"macvmagt_image_cache_served_bytes", "Size of the cached images provisions were served.",
+		func(w models.ImageCacheWindow) float64 { return float64(w.BytesFromCache) }},
+	{"macvmagt_image_cache_downloaded_bytes", "Size of the images downloaded.",
+		func(w models.ImageCacheWindow) float64 { return float64(w.BytesDownloaded) }},
+	{"macvmagt_image_cache_evictions", "Images removed from the cache.",
+		func(w models.ImageCacheWindow) float64 { return float64(w.Evictions) }},
+}
+
+// handleMetrics serves the resource usage of each running VM, as sampled with
+// the last heartbeat, how booting VMs' IP addresses were found, and how well
+// the image cache serves provisions, for scraping by Prometheus.
+func (a *Agent) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	usages := a.vmManager.ResourceUsages()
+	vmIDs := make([]string, 0, len(usages))
+	for vmID := range usages {
+		vmIDs = append(vmIDs, vmID)
+	}
+	sort.Strings(vmIDs)
+
+	var b strings.Builder
+	for _, metric := range vmMetrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, vmID := range vmIDs {
+			usage := usages[vmID]
+			if strings.HasPrefix(metric.name, "macvmagt_vm_network_") && usage.NetworkInterface == "" {
+				continue // Not attached to a vmnet bridge
+			}
+			value := metric.value(usage)
+			fmt.Fprintf(&b, "%s{node_id=%q,vm_id=%q} %s\n", metric.name, a.cfg.NodeID, vmID, strconv.FormatFloat(value, 'g', -1, 64))
+		}
+	}
+
+	discoveries := a.vmManager.IPDiscoveries()
+	methods := make([]string, 0, len(discoveries))
+	for method := range discoveries {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	b.WriteString("# HELP macvmagt_ip_discoveries_total Booting VMs whose IP address each discovery strategy found.\n# TYPE macvmagt_ip_discoveries_total counter\n")
+	for _, method := range methods {
+		fmt.Fprintf(&b, "macvmagt_ip_discoveries_total{node_id=%q,method=%q} %d\n", a.cfg.NodeID, method, discoveries[method])
+	}
+
+	cache := a.imageManager.CacheStats()
+	b.WriteString("# HELP macvmagt_image_cache_images Images in the image cache.\n# TYPE macvmagt_image_cache_images gauge\n")
+	fmt.Fprintf(&b, "macvmagt_image_cache_images{node_id=%q} %d\n", a.cfg.NodeID, cache.CachedImages)
+	b.WriteString("# HELP macvmagt_image_cache_average_age_seconds Mean time since the cached images were downloaded.\n# TYPE macvmagt_image_cache_average_age_seconds gauge\n")
+	fmt.Fprintf(&b, "macvmagt_image_cache_average_age_seconds{node_id=%q} %d\n", a.cfg.NodeID, cache.AverageImageAgeSeconds)
+	for _, metric := range imageCacheMetrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", metric.name, metric.help, metric.name)
+		for _, window := range cache.Windows {
+			value := strconv.FormatFloat(metric.value(window), 'g', -1, 64)
+			fmt.Fprintf(&b, "%s{node_id=%q,window=%q} %s\n", metric.name, a.cfg.NodeID, window.Window, value)
+		}
+	}
+
+	if usage := a.diskUsage.Usage(); usage != nil {
+		b.WriteString("# HELP macvmagt_image_cache_disk_bytes Disk space allocated to the image cache, as last sampled.\n# TYPE macvmagt_image_cache_disk_bytes gauge\n")
+		fmt.Fprintf(&b, "macvmagt_image_cache_disk_bytes{node_id=%q} %d\n", a.cfg.NodeID, usage.ImageCacheBytes)
+		b.WriteString("# HELP macvmagt_vms_disk_bytes Disk space allocated to all VMs, standbys included, as last sampled.\n# TYPE macvmagt_vms_disk_bytes gauge\n")
+		fmt.Fprintf(&b, "macvmagt_vms_disk_bytes{node_id=%q} %d\n", a.cfg.NodeID, usage.VMBytes)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/changty97/macvmagt/internal/backend"
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/doctor"
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// checkPermissions verifies the user the agent runs as can do what it is
+// configured to, so the agent fails at startup with what to fix rather than
+// on the first provision. It needs no root unless a feature that does is
+// enabled: the directories it writes to must belong to its user, and on
+// macOS the user must be able to run VMs with the VM backend.
+func checkPermissions(cfg *config.Config, nodeInfo *models.NodeInfo) error {
+	if err := backend.Require(nodeInfo); err != nil {
+		if runtime.GOOS == "darwin" {
+			return err
+		}
+		// Elsewhere there is no Virtualization framework; the agent still runs for development.
+		log.Printf("Warning: %v", err)
+	}
+
+	var unwritable []string
+	for _, dir := range []string{cfg.ImageCacheDir, cfg.VMsDir, cfg.StateDir} {
+		if err := doctor.Writable(dir); err != nil {
+			unwritable = append(unwritable, err.Error())
+		}
+	}
+	if len(unwritable) > 0 {
+		return fmt.Errorf("%s: give the directories to the agent's user, e.g. sudo chown -R $(whoami) <dir>, or point --data-root at a directory it owns", strings.Join(unwritable, "; "))
+	}
+
+	if os.Geteuid() != 0 && cfg.CoreSchedulingSampling {
+		return fmt.Errorf("--core-scheduling-sampling samples powermetrics, which requires root: run the agent as root or turn it off")
+	}
+	return nil
+}
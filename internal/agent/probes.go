@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/doctor"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/version"
+)
+
+// readinessCacheTTL is how long a readiness report is reused, so frequent
+// probes don't list the image bucket and call the orchestrator every time.
+const readinessCacheTTL = 15 * time.Second
+
+// readinessCache holds the last readiness or deep health report.
+type readinessCache struct {
+	mu     sync.Mutex // Held while checks run, so concurrent probes share one run
+	report *models.DoctorReport
+}
+
+// deepHealthCheck reports whether a /healthz request asks for every doctor
+// check rather than liveness.
+func deepHealthCheck(r *http.Request) bool {
+	deep, _ := strconv.ParseBool(r.URL.Query().Get("deep"))
+	return deep
+}
+
+// handleHealthz is the liveness probe: it answers as long as the agent
+// process runs and serves requests. GET /healthz?deep=1 runs every doctor
+// check instead, with 503 if any failed. Like readiness reports, deep
+// reports are reused for readinessCacheTTL.
+func (a *Agent) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !deepHealthCheck(r) {
+		json.NewEncoder(w).Encode(models.Liveness{
+			Status:        "ok",
+			NodeID:        a.cfg.NodeID,
+			AgentVersion:  version.Version,
+			UptimeSeconds: int64(time.Since(a.started).Seconds()),
+		})
+		return
+	}
+	a.deepHealth.mu.Lock()
+	report := a.deepHealth.report
+	if report == nil || time.Since(report.CheckedAt) >= readinessCacheTTL {
+		report = doctor.Run(r.Context(), a.cfg)
+		a.deepHealth.report = report
+	}
+	a.deepHealth.mu.Unlock()
+
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleReadyz is the readiness probe: whether the agent can take VMs, i.e.
+// the VM backend is usable, its directories are writable, and the image
+// bucket and the orchestrator are reachable. It answers 503 if not.
+func (a *Agent) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	a.readiness.mu.Lock()
+	report := a.readiness.report
+	if report == nil || time.Since(report.CheckedAt) >= readinessCacheTTL {
+		report = doctor.Ready(r.Context(), a.cfg)
+		a.readiness.report = report
+	}
+	a.readiness.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
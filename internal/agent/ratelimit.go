@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// parseRateLimits parses route limits of the form "<path template>=<requests
+// per second>[:<burst>]", e.g. "/provision-vm=2:10". The burst defaults to
+// the rate rounded up.
+func parseRateLimits(specs []string) (map[string]*rate.Limiter, error) {
+	limiters := make(map[string]*rate.Limiter, len(specs))
+	for _, spec := range specs {
+		route, value, ok := strings.Cut(spec, "=")
+		if !ok || !strings.HasPrefix(route, "/") {
+			return nil, fmt.Errorf("invalid rate limit '%s', expected /path=<requests per second>[:<burst>]", spec)
+		}
+		rateValue, burstValue, hasBurst := strings.Cut(value, ":")
+		perSecond, err := strconv.ParseFloat(rateValue, 64)
+		if err != nil || perSecond <= 0 {
+			return nil, fmt.Errorf("invalid rate in rate limit '%s'", spec)
+		}
+		burst := int(math.Ceil(perSecond))
+		if hasBurst {
+			burst, err = strconv.Atoi(burstValue)
+			if err != nil || burst < 1 {
+				return nil, fmt.Errorf("invalid burst in rate limit '%s'", spec)
+			}
+		}
+		limiters[route] = rate.NewLimiter(rate.Limit(perSecond), burst)
+	}
+	return limiters, nil
+}
+
+// rateLimitMiddleware rejects requests to a rate-limited route with 429 once
+// its limit is exhausted. Limits are per route rather than per client, since
+// the orchestrator is the only regular caller, and are shared by all API
+// versions of the route.
+func rateLimitMiddleware(limiters map[string]*rate.Limiter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := mux.CurrentRoute(r)
+			if route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					template = unversionedPath(template)
+					if limiter, ok := limiters[template]; ok && !limiter.Allow() {
+						retryAfter := int(math.Ceil(1 / float64(limiter.Limit())))
+						w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+						writeError(w, http.StatusTooManyRequests, "rate_limited", fmt.Sprintf("Rate limit of %s exceeded, retry later", template))
+						return
+					}
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package agent
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoveryMiddleware turns a panic in a handler into a logged stack trace
+// and a structured 500, instead of a connection dropped without a response.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered) // Deliberate abort, which the server handles quietly
+			}
+			log.Printf("Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, recovered, debug.Stack())
+			if sw.code == 0 {
+				writeError(w, http.StatusInternalServerError, "internal_error", "The agent hit an internal error handling this request; see its log")
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
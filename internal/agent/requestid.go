@@ -0,0 +1,19 @@
+package agent
+
+import (
+	"net/http"
+
+	"github.com/changty97/macvmagt/internal/requestid"
+)
+
+// requestIDMiddleware gives every request an ID, see requestid.FromRequest,
+// echoes it in the response headers and passes it on in the request's
+// context. Logs, operations, callbacks and events of the command then carry
+// the same ID as the orchestrator's request.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestid.FromRequest(r)
+		w.Header().Set(requestid.Header, id)
+		next.ServeHTTP(w, r.WithContext(requestid.NewContext(r.Context(), id)))
+	})
+}
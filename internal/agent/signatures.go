@@ -0,0 +1,245 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/gorilla/mux"
+)
+
+// Headers of signed commands.
+const (
+	signatureHeader          = "X-Macvmagt-Signature"      // Base64 Ed25519 signature of the signed message
+	signatureTimestampHeader = "X-Macvmagt-Timestamp"      // Unix seconds when the command was signed
+	signatureNonceHeader     = "X-Macvmagt-Nonce"          // Unique value, so a signed command runs once
+	contentSHA256Header      = "X-Macvmagt-Content-Sha256" // Hex SHA256 of the body
+)
+
+// Bounds of the nonces accepted on signed commands, which are kept in memory.
+const (
+	minNonceLength = 16
+	maxNonceLength = 128
+)
+
+// maxBufferedSignedBody bounds the signed bodies kept in memory while they
+// are checked against their hash. Larger bodies, i.e. file uploads, are
+// spooled to a temporary file instead, so they are checked before the
+// handler runs too.
+const maxBufferedSignedBody = 1 << 20
+
+// errBodySignature is why a signed body that doesn't hash to the signed
+// SHA256 is rejected.
+var errBodySignature = errors.New("request body doesn't match its signed SHA256")
+
+// unsignedRoutes are the routes that don't take signed commands: guest events
+// come from the guest helpers, which authenticate with their VM's token.
+var unsignedRoutes = map[string]bool{
+	"/vms/{vmId}/guest-events": true,
+}
+
+// commandVerifier checks the Ed25519 signatures of commands and rejects
+// commands it has seen before.
+type commandVerifier struct {
+	keys   []ed25519.PublicKey
+	maxAge time.Duration
+	mu     sync.Mutex           // Protects nonces
+	nonces map[string]time.Time // Nonces seen, until their command goes stale
+}
+
+// newCommandVerifier parses CommandPublicKeys. It returns nil if none are
+// configured, so commands aren't checked.
+func newCommandVerifier(cfg *config.Config) (*commandVerifier, error) {
+	if len(cfg.CommandPublicKeys) == 0 {
+		return nil, nil
+	}
+	if cfg.CommandSignatureMaxAge <= 0 {
+		return nil, fmt.Errorf("command signature max age must be positive, got %s", cfg.CommandSignatureMaxAge)
+	}
+	v := &commandVerifier{
+		maxAge: cfg.CommandSignatureMaxAge,
+		nonces: make(map[string]time.Time),
+	}
+	for _, encoded := range cfg.CommandPublicKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid command public key '%s', expected a base64 Ed25519 public key", encoded)
+		}
+		v.keys = append(v.keys, ed25519.PublicKey(key))
+	}
+	return v, nil
+}
+
+// signedMessage returns what a command's signature covers: its method, path
+// and query, timestamp, nonce and body hash, one per line.
+func signedMessage(r *http.Request, timestamp, nonce, bodySHA256 string) []byte {
+	return []byte(strings.Join([]string{r.Method, r.URL.RequestURI(), timestamp, nonce, bodySHA256}, "\n"))
+}
+
+// verify checks the signature headers of r against the keys. It returns when
+// r was signed, and the error code and message to reject r with, if any. The
+// nonce isn't used up until claimNonce.
+func (v *commandVerifier) verify(r *http.Request) (time.Time, string, string) {
+	signature, timestamp, nonce := r.Header.Get(signatureHeader), r.Header.Get(signatureTimestampHeader), r.Header.Get(signatureNonceHeader)
+	bodySHA256 := strings.ToLower(r.Header.Get(contentSHA256Header))
+	if signature == "" || timestamp == "" || nonce == "" || bodySHA256 == "" {
+		return time.Time{}, "signature_required", fmt.Sprintf("Commands must be signed, with the %s, %s, %s and %s headers", signatureHeader, signatureTimestampHeader, signatureNonceHeader, contentSHA256Header)
+	}
+	if len(nonce) < minNonceLength || len(nonce) > maxNonceLength {
+		return time.Time{}, "invalid_nonce", fmt.Sprintf("Nonce must be %d to %d characters", minNonceLength, maxNonceLength)
+	}
+	if digest, err := hex.DecodeString(bodySHA256); err != nil || len(digest) != sha256.Size {
+		return time.Time{}, "invalid_content_sha256", fmt.Sprintf("%s must be a hex SHA256", contentSHA256Header)
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, "invalid_timestamp", fmt.Sprintf("%s must be Unix seconds", signatureTimestampHeader)
+	}
+	signedAt := time.Unix(seconds, 0)
+	if age := time.Since(signedAt); age > v.maxAge || age < -v.maxAge {
+		return time.Time{}, "stale_signature", fmt.Sprintf("Command was signed at %s, more than %s from the node's clock", signedAt.UTC().Format(time.RFC3339), v.maxAge)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return time.Time{}, "invalid_signature", "Signature must be base64"
+	}
+	message := signedMessage(r, timestamp, nonce, bodySHA256)
+	valid := false
+	for _, key := range v.keys {
+		if ed25519.Verify(key, message, sig) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return time.Time{}, "invalid_signature", "Signature doesn't match the command or any configured key"
+	}
+	return signedAt, "", ""
+}
+
+// claimNonce records the nonce of a command signed at signedAt, and returns
+// false if it was seen before. Only commands whose signature and body
+// checked out claim theirs, so forged requests can't fill the map or use up
+// the nonce of the command they tamper with.
+func (v *commandVerifier) claimNonce(nonce string, signedAt time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	for seen, expires := range v.nonces {
+		if now.After(expires) {
+			delete(v.nonces, seen)
+		}
+	}
+	if _, seen := v.nonces[nonce]; seen {
+		return false
+	}
+	v.nonces[nonce] = signedAt.Add(v.maxAge)
+	return true
+}
+
+// checkBody reads r's body and returns whether it hashes to bodySHA256,
+// replacing it with what was read. Bodies over maxBufferedSignedBody are
+// spooled to a temporary file, removed when the body is closed.
+func checkBody(r *http.Request, bodySHA256 string) (bool, error) {
+	digest := sha256.New()
+	head, err := io.ReadAll(io.LimitReader(io.TeeReader(r.Body, digest), maxBufferedSignedBody+1))
+	if err != nil {
+		return false, err
+	}
+	if len(head) <= maxBufferedSignedBody {
+		r.Body = io.NopCloser(bytes.NewReader(head))
+		return hex.EncodeToString(digest.Sum(nil)) == bodySHA256, nil
+	}
+
+	spool, err := os.CreateTemp("", "macvmagt-signed-body-*")
+	if err != nil {
+		return false, fmt.Errorf("failed to spool signed body: %w", err)
+	}
+	body := &spooledBody{File: spool}
+	_, err = spool.Write(head) // Already hashed
+	if err == nil {
+		_, err = io.Copy(io.MultiWriter(spool, digest), r.Body)
+	}
+	if err != nil {
+		body.Close()
+		return false, err
+	}
+	if hex.EncodeToString(digest.Sum(nil)) != bodySHA256 {
+		body.Close()
+		return false, nil
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		body.Close()
+		return false, fmt.Errorf("failed to spool signed body: %w", err)
+	}
+	r.Body = body
+	return true, nil
+}
+
+// spooledBody is a large signed body, read back from the temporary file it
+// was checked in.
+type spooledBody struct {
+	*os.File
+}
+
+// Close closes and removes the temporary file.
+func (b *spooledBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.Name())
+	return err
+}
+
+// signatureMiddleware rejects commands without a valid signature with 401,
+// if command public keys are configured. Reads (GET and HEAD) and the routes
+// in unsignedRoutes don't need a signature.
+func signatureMiddleware(v *commandVerifier) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if v == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil && unsignedRoutes[unversionedPath(template)] {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			signedAt, code, message := v.verify(r)
+			if code != "" {
+				writeError(w, http.StatusUnauthorized, code, message)
+				return
+			}
+			ok, err := checkBody(r, strings.ToLower(r.Header.Get(contentSHA256Header)))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_body", fmt.Sprintf("Failed to read request body: %v", err))
+				return
+			}
+			defer r.Body.Close()
+			if !ok {
+				writeError(w, http.StatusUnauthorized, "invalid_signature", errBodySignature.Error())
+				return
+			}
+			if !v.claimNonce(r.Header.Get(signatureNonceHeader), signedAt) {
+				writeError(w, http.StatusUnauthorized, "replayed_command", "Command with this nonce was already received")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
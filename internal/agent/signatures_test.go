@@ -0,0 +1,207 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// testSigningKey returns a deterministic Ed25519 key for tests.
+func testSigningKey(seed byte) ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+}
+
+// signedRequest returns a request for method and path carrying body, signed
+// with key at signedAt under nonce.
+func signedRequest(key ed25519.PrivateKey, method, path string, body []byte, signedAt time.Time, nonce string) *http.Request {
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	bodySHA256 := hex.EncodeToString(sum[:])
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	signature := ed25519.Sign(key, signedMessage(r, timestamp, nonce, bodySHA256))
+	r.Header.Set(signatureHeader, base64.StdEncoding.EncodeToString(signature))
+	r.Header.Set(signatureTimestampHeader, timestamp)
+	r.Header.Set(signatureNonceHeader, nonce)
+	r.Header.Set(contentSHA256Header, bodySHA256)
+	return r
+}
+
+// newTestVerifier returns a commandVerifier trusting key.
+func newTestVerifier(t *testing.T, key ed25519.PrivateKey) *commandVerifier {
+	t.Helper()
+	v, err := newCommandVerifier(&config.Config{
+		CommandPublicKeys:      []string{base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))},
+		CommandSignatureMaxAge: 5 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// serveSigned runs r through the signature middleware, in front of a handler
+// that echoes the body it got. It returns the response and the error code,
+// if any.
+func serveSigned(v *commandVerifier, r *http.Request) (*httptest.ResponseRecorder, string) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+	w := httptest.NewRecorder()
+	signatureMiddleware(v)(echo).ServeHTTP(w, r)
+	var response models.ErrorResponse
+	if w.Code != http.StatusOK {
+		json.Unmarshal(w.Body.Bytes(), &response)
+	}
+	return w, response.Error.Code
+}
+
+func TestSignatureMiddleware(t *testing.T) {
+	key := testSigningKey(7)
+	body := []byte(`{"vmId":"vm-1","imageName":"macos-15"}`)
+	large := bytes.Repeat([]byte("a"), 3*maxBufferedSignedBody)
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		request  func() *http.Request
+		wantCode string // Error code; "" if the command is let through
+		wantBody []byte // Body the handler gets if it is let through
+	}{
+		{
+			name: "valid signature",
+			request: func() *http.Request {
+				return signedRequest(key, http.MethodPost, "/provision-vm", body, now, "nonce-valid-000001")
+			},
+			wantBody: body,
+		},
+		{
+			name: "valid signature on a spooled body",
+			request: func() *http.Request {
+				return signedRequest(key, http.MethodPost, "/vms/vm-1/files", large, now, "nonce-large-000001")
+			},
+			wantBody: large,
+		},
+		{
+			name: "tampered body",
+			request: func() *http.Request {
+				r := signedRequest(key, http.MethodPost, "/provision-vm", body, now, "nonce-tamper-00001")
+				r.Body = io.NopCloser(bytes.NewReader([]byte(`{"vmId":"vm-2","imageName":"macos-15"}`)))
+				return r
+			},
+			wantCode: "invalid_signature",
+		},
+		{
+			name: "tampered spooled body",
+			request: func() *http.Request {
+				r := signedRequest(key, http.MethodPost, "/vms/vm-1/files", large, now, "nonce-tamper-00002")
+				r.Body = io.NopCloser(bytes.NewReader(append(bytes.Clone(large), 'b')))
+				return r
+			},
+			wantCode: "invalid_signature",
+		},
+		{
+			name: "tampered path",
+			request: func() *http.Request {
+				r := signedRequest(key, http.MethodPost, "/provision-vm", body, now, "nonce-path-000001")
+				r.URL.Path = "/delete-vm"
+				return r
+			},
+			wantCode: "invalid_signature",
+		},
+		{
+			name: "wrong key",
+			request: func() *http.Request {
+				return signedRequest(testSigningKey(8), http.MethodPost, "/provision-vm", body, now, "nonce-wrongkey-01")
+			},
+			wantCode: "invalid_signature",
+		},
+		{
+			name: "expired timestamp",
+			request: func() *http.Request {
+				return signedRequest(key, http.MethodPost, "/provision-vm", body, now.Add(-10*time.Minute), "nonce-expired-001")
+			},
+			wantCode: "stale_signature",
+		},
+		{
+			name: "timestamp in the future",
+			request: func() *http.Request {
+				return signedRequest(key, http.MethodPost, "/provision-vm", body, now.Add(10*time.Minute), "nonce-future-0001")
+			},
+			wantCode: "stale_signature",
+		},
+		{
+			name: "unsigned",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/provision-vm", bytes.NewReader(body))
+			},
+			wantCode: "signature_required",
+		},
+		{
+			name: "short nonce",
+			request: func() *http.Request {
+				return signedRequest(key, http.MethodPost, "/provision-vm", body, now, "short")
+			},
+			wantCode: "invalid_nonce",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestVerifier(t, key)
+			r := tt.request()
+			w, code := serveSigned(v, r)
+			if code != tt.wantCode {
+				t.Fatalf("got status %d, code %q, want code %q", w.Code, code, tt.wantCode)
+			}
+			if tt.wantCode == "" && !bytes.Equal(w.Body.Bytes(), tt.wantBody) {
+				t.Errorf("handler got a %d byte body, want the %d signed bytes", w.Body.Len(), len(tt.wantBody))
+			}
+		})
+	}
+}
+
+func TestSignatureMiddlewareReplay(t *testing.T) {
+	key := testSigningKey(7)
+	v := newTestVerifier(t, key)
+	body := []byte(`{"vmId":"vm-1"}`)
+	now := time.Now()
+
+	// A forged copy doesn't use up the nonce of the command it tampers with.
+	forged := signedRequest(key, http.MethodPost, "/delete-vm", body, now, "nonce-replay-00001")
+	forged.Body = io.NopCloser(bytes.NewReader([]byte(`{"vmId":"vm-2"}`)))
+	if _, code := serveSigned(v, forged); code != "invalid_signature" {
+		t.Fatalf("forged command: got code %q, want invalid_signature", code)
+	}
+
+	for i, wantCode := range []string{"", "replayed_command", "replayed_command"} {
+		r := signedRequest(key, http.MethodPost, "/delete-vm", body, now, "nonce-replay-00001")
+		if _, code := serveSigned(v, r); code != wantCode {
+			t.Fatalf("attempt %d: got code %q, want %q", i+1, code, wantCode)
+		}
+	}
+
+	r := signedRequest(key, http.MethodPost, "/delete-vm", body, now, fmt.Sprintf("nonce-replay-%05d", 2))
+	if _, code := serveSigned(v, r); code != "" {
+		t.Fatalf("new nonce: got code %q, want none", code)
+	}
+}
+
+func TestSignatureMiddlewareSkipsReads(t *testing.T) {
+	v := newTestVerifier(t, testSigningKey(7))
+	r := httptest.NewRequest(http.MethodGet, "/node", nil)
+	if w, code := serveSigned(v, r); code != "" {
+		t.Fatalf("GET without a signature: got status %d, code %q", w.Code, code)
+	}
+}
@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/requestid"
+	"github.com/changty97/macvmagt/internal/supportbundle"
+)
+
+// handleSupportBundle streams a support bundle of the node as a tar.gz, like
+// `macvmagt support-bundle` writes, with the agent's in-memory state added:
+// backends found at startup, operations in flight, downloads, image sync,
+// disk usage and thermal protection.
+func (a *Agent) handleSupportBundle(w http.ResponseWriter, r *http.Request) {
+	extra := map[string]any{
+		"agent/node.json":       a.nodeInfo,
+		"agent/operations.json": a.operations.List(),
+		"agent/downloads.json":  a.imageManager.Downloads(),
+		"agent/cordon.json":     a.cordon.State(),
+		"agent/thermal.json":    map[string]bool{"protectionActive": a.thermalMonitor.Active()},
+	}
+	if usage := a.diskUsage.Usage(); usage != nil {
+		extra["agent/disk-usage.json"] = usage
+	}
+	if status := a.imageManager.ImageSyncStatus(); status != nil {
+		extra["agent/image-sync.json"] = status
+	}
+
+	name := fmt.Sprintf("support-bundle-%s-%s.tar.gz", a.cfg.NodeID, time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	// The status is sent with the first bytes, so failing past them can only
+	// cut the bundle short; the audit entry records it.
+	err := supportbundle.Write(r.Context(), a.cfg, w, "api", extra)
+	if err != nil {
+		log.Printf("Error writing support bundle: %v%s", err, requestid.LogSuffix(r.Context()))
+	}
+	setAuditResult(r.Context(), nil, err)
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// longRoutes are the routes that take longer than the server's read and write
+// timeouts, with how long they may take. A route's timeout can be changed
+// with --route-timeouts. Exec and file transfers are bounded per request by
+// their own settings instead.
+var longRoutes = map[string]time.Duration{
+	"/healthz":                2 * time.Minute,  // ?deep=1 runs every doctor check
+	"/readyz":                 2 * time.Minute,  // Lists the image bucket and calls the orchestrator
+	"/vms/{vmId}/healthcheck": 3 * time.Minute,  // A full battery of health checks
+	"/gc":                     5 * time.Minute,  // Archiving logs of stale VMs
+	"/admin/support-bundle":   2 * time.Minute,  // Runs every doctor check and reads logs
+	"/images/{name}/verify":   30 * time.Minute, // Hashing a large image
+	"/vms/{vmId}/template":    30 * time.Minute, // Copying and hashing a VM's disk
+}
+
+// parseRouteTimeouts returns longRoutes with the overrides of the form
+// "<path template>=<duration>" applied, e.g. "/gc=10m". A duration of 0
+// lifts the deadlines entirely, for streaming responses.
+func parseRouteTimeouts(specs []string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration, len(longRoutes)+len(specs))
+	for route, timeout := range longRoutes {
+		timeouts[route] = timeout
+	}
+	for _, spec := range specs {
+		route, value, ok := strings.Cut(spec, "=")
+		if !ok || !strings.HasPrefix(route, "/") {
+			return nil, fmt.Errorf("invalid route timeout '%s', expected /path=<duration>", spec)
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid duration in route timeout '%s'", spec)
+		}
+		timeouts[route] = timeout
+	}
+	return timeouts, nil
+}
+
+// timeoutMiddleware replaces the server's read and write deadlines of a
+// request to a route with a timeout, and ends its context at the same time.
+// Other routes keep the server's deadlines.
+func timeoutMiddleware(timeouts map[string]time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := mux.CurrentRoute(r)
+			if route == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			template, err := route.GetPathTemplate()
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			timeout, ok := timeouts[unversionedPath(template)]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var deadline time.Time // Zero lifts the deadlines
+			if timeout > 0 {
+				deadline = time.Now().Add(timeout)
+				ctx, cancel := context.WithDeadline(r.Context(), deadline)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+			extendDeadlines(w, deadline)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// extendDeadlines sets the read and write deadlines of a request's
+// connection, e.g. for a request that outlives the server's timeouts.
+func extendDeadlines(w http.ResponseWriter, deadline time.Time) {
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(deadline); err != nil {
+		log.Printf("Warning: Could not extend read deadline: %v", err)
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		log.Printf("Warning: Could not extend write deadline: %v", err)
+	}
+}
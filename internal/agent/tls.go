@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+)
+
+// selfSignedValidity is how long a generated self-signed certificate is valid.
+// Orchestrators pin its key rather than trusting a CA, so it rarely needs renewing.
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// loadTLSCertificate returns the certificate the command server serves HTTPS
+// with: the configured one, or with TLSSelfSigned a self-signed one kept in
+// StateDir/tls, generated on first use. It returns nil to serve plain HTTP.
+func loadTLSCertificate(cfg *config.Config) (*tls.Certificate, error) {
+	certPath, keyPath := cfg.TLSCertPath, cfg.TLSKeyPath
+	switch {
+	case certPath != "" || keyPath != "":
+		if certPath == "" || keyPath == "" {
+			return nil, fmt.Errorf("TLS needs both a certificate and a key, got certificate %q and key %q", certPath, keyPath)
+		}
+	case cfg.TLSSelfSigned:
+		dir := filepath.Join(cfg.StateDir, "tls")
+		certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		if _, err := os.Stat(certPath); os.IsNotExist(err) {
+			if err := generateSelfSigned(cfg, certPath, keyPath); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate %s: %w", certPath, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("failed to parse TLS certificate %s: %w", certPath, err)
+		}
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		log.Printf("Warning: TLS certificate %s expired on %s", certPath, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return &cert, nil
+}
+
+// generateSelfSigned writes a self-signed ECDSA certificate and its key for
+// the host's names and addresses, including the address VMs reach it at.
+func generateSelfSigned(cfg *config.Config, certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate TLS key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("failed to generate TLS certificate serial: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "macvmagt " + cfg.NodeID},
+		NotBefore:             time.Now().Add(-time.Hour), // Tolerate clock skew on the orchestrator
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+	// The VM network's bridge may not exist yet, so its address is added explicitly.
+	if agentURL, err := url.Parse(cfg.GuestAgentURL); err == nil {
+		if ip := net.ParseIP(agentURL.Hostname()); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create TLS certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal TLS key: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certPath), 0700); err != nil {
+		return fmt.Errorf("failed to create TLS directory: %w", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return fmt.Errorf("failed to write TLS key %s: %w", keyPath, err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return fmt.Errorf("failed to write TLS certificate %s: %w", certPath, err)
+	}
+	log.Printf("Generated self-signed TLS certificate %s", certPath)
+	return nil
+}
+
+// publicKeyPin returns the pin of a certificate's public key in curl's
+// --pinnedpubkey format, sha256//<base64 SHA256 of the SubjectPublicKeyInfo>.
+// The pin survives renewing the certificate with the same key.
+func publicKeyPin(cert *tls.Certificate) string {
+	sum := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	return "sha256//" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// redirectToHTTPS redirects plain HTTP requests to the same URL on the HTTPS
+// command server at httpsAddr.
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, httpsPort, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]") // No port
+		}
+		target := url.URL{Scheme: "https", Host: net.JoinHostPort(host, httpsPort), Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		// 308 keeps the method and body, so redirected commands aren't turned into GETs.
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,24 @@
+package agent
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// tracingMiddleware traces each request as a server span named after its
+// route, continuing the trace of the orchestrator's request if it carries a
+// traceparent header. Background work the handler starts joins the same trace.
+func tracingMiddleware() mux.MiddlewareFunc {
+	return otelhttp.NewMiddleware("macvmagt",
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					return r.Method + " " + template
+				}
+			}
+			return r.Method
+		}),
+	)
+}
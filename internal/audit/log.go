@@ -0,0 +1,196 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// Log is the append-only audit log of orchestrator commands, kept as JSON
+// lines in audit.jsonl in the state directory. When the file would grow past
+// AuditLogMaxBytes it is rotated to audit.jsonl.1, shifting older files up to
+// audit.jsonl.<AuditLogMaxFiles>; the oldest file is then dropped. Entries are
+// numbered, and numbering continues across restarts and rotations.
+type Log struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+	mu       sync.Mutex // Protects file, size and seq
+	file     *os.File
+	size     int64
+	seq      int64 // Number of the last entry written
+}
+
+// NewLog opens the audit log in the state directory, creating it if needed.
+func NewLog(cfg *config.Config) (*Log, error) {
+	if err := os.MkdirAll(cfg.StateDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory %s: %w", cfg.StateDir, err)
+	}
+	l := &Log{
+		path:     filepath.Join(cfg.StateDir, "audit.jsonl"),
+		maxBytes: cfg.AuditLogMaxBytes,
+		maxFiles: cfg.AuditLogMaxFiles,
+	}
+	l.seq = l.lastSeq()
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the current file for appending.
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s: %w", l.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log %s: %w", l.path, err)
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// files returns the log's files from oldest to newest.
+func (l *Log) files() []string {
+	files := make([]string, 0, l.maxFiles+1)
+	for i := l.maxFiles; i >= 1; i-- {
+		files = append(files, fmt.Sprintf("%s.%d", l.path, i))
+	}
+	return append(files, l.path)
+}
+
+// lastSeq returns the number of the newest entry on disk, or 0 if there is none.
+func (l *Log) lastSeq() int64 {
+	files := l.files()
+	for i := len(files) - 1; i >= 0; i-- {
+		var last int64
+		if err := readEntries(files[i], func(entry models.AuditEntry) bool {
+			last = entry.Seq
+			return true
+		}); err != nil {
+			log.Printf("Warning: Could not read audit log %s: %v", files[i], err)
+		}
+		if last > 0 {
+			return last
+		}
+	}
+	return 0
+}
+
+// Append numbers entry, stamps it with the current time and writes it to the log.
+func (l *Log) Append(entry models.AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.Seq = l.seq + 1
+	entry.Time = time.Now().UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log %s: %w", l.path, err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync audit log %s: %w", l.path, err)
+	}
+	l.seq = entry.Seq
+	return nil
+}
+
+// rotate shifts the rotated files up by one, dropping the oldest, and starts
+// a new current file.
+func (l *Log) rotate() error {
+	l.file.Close()
+	if l.maxFiles < 1 {
+		os.Remove(l.path) // No rotated files are kept
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles))
+		for i := l.maxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			log.Printf("Warning: Failed to rotate audit log %s: %v", l.path, err)
+		}
+	}
+	return l.open()
+}
+
+// List returns up to limit entries numbered after after, oldest first, and
+// whether more follow.
+func (l *Log) List(after int64, limit int) ([]models.AuditEntry, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := []models.AuditEntry{}
+	more := false
+	for _, path := range l.files() {
+		err := readEntries(path, func(entry models.AuditEntry) bool {
+			if entry.Seq <= after {
+				return true
+			}
+			if len(entries) == limit {
+				more = true
+				return false
+			}
+			entries = append(entries, entry)
+			return true
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		if more {
+			break
+		}
+	}
+	return entries, more, nil
+}
+
+// readEntries calls fn for each entry of an audit log file until fn returns
+// false. A missing file has no entries; corrupt lines are skipped.
+func readEntries(path string, fn func(models.AuditEntry) bool) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s: %w", path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry models.AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if !fn(entry) {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read audit log %s: %w", path, err)
+	}
+	return nil
+}
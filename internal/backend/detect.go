@@ -0,0 +1,167 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/fakedriver"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// virtualizationEntitlement must be present on a backend binary for it to use
+// Apple's Virtualization framework.
+const virtualizationEntitlement = "com.apple.security.virtualization"
+
+// candidate describes a VM backend the agent knows how to look for.
+type candidate struct {
+	name      string
+	binary    string
+	supported bool // Whether this agent build can provision VMs with it
+}
+
+// candidates are probed in order of preference when Backend is "auto".
+var candidates = []candidate{
+	{name: "tart", binary: "tart", supported: true},
+	{name: "macosvm", binary: "macosvm", supported: false},
+}
+
+// Detect probes the host for usable VM backends and selects one, so the same
+// binary can run on nodes with different tooling installed. A configured
+// backend other than "auto" is selected only if it is usable.
+func Detect(cfg *config.Config) *models.NodeInfo {
+	info := &models.NodeInfo{
+		NodeID:              cfg.NodeID,
+		OS:                  runtime.GOOS,
+		Arch:                utils.GetHostArch(),
+		HypervisorSupported: cfg.Driver == fakedriver.Name || hypervisorSupported(), // Simulated VMs need no hypervisor
+	}
+
+	for _, c := range candidates {
+		status := probe(c)
+		if !info.HypervisorSupported && status.Usable {
+			status.Usable = false
+			status.Reason = "host does not support virtualization"
+		}
+		info.Backends = append(info.Backends, status)
+
+		if info.SelectedBackend == "" && status.Usable && (cfg.Backend == "auto" || cfg.Backend == c.name) {
+			info.SelectedBackend = c.name
+		}
+	}
+
+	if version, err := utils.GetOSVersion(); err == nil {
+		info.OSVersion = version
+	} else if runtime.GOOS == "darwin" {
+		log.Printf("Warning: %v", err)
+	}
+
+	if info.SelectedBackend == "" {
+		log.Printf("Warning: No usable VM backend found (requested %q); VM provisioning is disabled.", cfg.Backend)
+	} else {
+		log.Printf("Using VM backend %s.", info.SelectedBackend)
+	}
+	return info
+}
+
+func probe(c candidate) models.BackendStatus {
+	status := models.BackendStatus{Name: c.name}
+
+	path, err := utils.LookPath(c.binary)
+	if err != nil {
+		status.Reason = fmt.Sprintf("%s not found in PATH", c.binary)
+		status.Fix = fmt.Sprintf("Install %s where the agent's PATH finds it, or fix --backend", c.binary)
+		return status
+	}
+	status.Path = path
+
+	if output, err := utils.ExecuteCommand(path, "--version"); err == nil {
+		status.Version = strings.TrimSpace(output)
+	}
+
+	status.Entitled = hasVirtualizationEntitlement(path)
+	switch {
+	case !status.Entitled:
+		status.Reason = fmt.Sprintf("%s is not signed with the %s entitlement", path, virtualizationEntitlement)
+		status.Fix = fmt.Sprintf("Install a release of %s signed with the entitlement (e.g. from Homebrew), or re-sign %s with it", c.binary, path)
+	case !c.supported:
+		status.Reason = "detected, but not supported by this agent build"
+		status.Fix = "Install tart, or choose another --backend"
+	default:
+		if err := checkAccess(path); err != nil {
+			status.Reason = err.Error()
+			status.Fix = fmt.Sprintf("Run the agent as the user that owns the VMs of %s (TART_HOME, by default ~/.tart), logged into a session that may use the Virtualization framework, or give that user access to TART_HOME", c.binary)
+			return status
+		}
+		status.Usable = true
+	}
+	return status
+}
+
+// checkAccess verifies the current user can use the backend, by listing its
+// VMs: that fails if the user can't read the backend's VM storage.
+func checkAccess(path string) error {
+	output, err := utils.RunCommand(context.Background(), path, "list")
+	if err != nil {
+		return fmt.Errorf("%s list fails for user %s: %s", path, currentUser(), strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// currentUser names the user the agent runs as.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(os.Geteuid())
+}
+
+// Require returns an error saying what to fix if no backend can provision
+// VMs on this host, e.g. because the current user can't use the
+// Virtualization framework.
+func Require(info *models.NodeInfo) error {
+	if !info.HypervisorSupported {
+		return fmt.Errorf("host does not support virtualization: run the agent on a Mac with hardware virtualization support (kern.hv_support = 1)")
+	}
+	if info.SelectedBackend != "" {
+		return nil
+	}
+	problems := make([]string, 0, len(info.Backends))
+	for _, status := range info.Backends {
+		problem := fmt.Sprintf("%s: %s", status.Name, status.Reason)
+		if status.Fix != "" {
+			problem += " (fix: " + status.Fix + ")"
+		}
+		problems = append(problems, problem)
+	}
+	return fmt.Errorf("no usable VM backend: %s", strings.Join(problems, "; "))
+}
+
+// hasVirtualizationEntitlement reports whether the binary at path is signed
+// with the Virtualization framework entitlement.
+func hasVirtualizationEntitlement(path string) bool {
+	output, err := utils.RunCommand(context.Background(), "codesign", "-d", "--entitlements", "-", "--xml", path)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(output, virtualizationEntitlement)
+}
+
+// hypervisorSupported reports whether the host CPU and OS support hardware virtualization.
+func hypervisorSupported() bool {
+	if runtime.GOOS != "darwin" {
+		return false
+	}
+	output, err := utils.ExecuteCommand("sysctl", "-n", "kern.hv_support")
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(output) == "1"
+}
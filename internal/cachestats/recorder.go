@@ -0,0 +1,197 @@
+// Package cachestats keeps metrics on how well the image cache serves
+// provisions over rolling windows. It is plugged into the image manager,
+// see imagemgr.CacheMetrics.
+package cachestats
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// bucketSize is the granularity of the rolling windows.
+const bucketSize = time.Minute
+
+// windows are the rolling windows stats are reported over, shortest first.
+// The longest one is how long buckets are kept.
+var windows = []struct {
+	name   string
+	length time.Duration
+}{
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+}
+
+// bucket accumulates the cache activity of one minute. Minutes without any
+// aren't stored.
+type bucket struct {
+	Start           time.Time      `json:"start"`
+	Hits            int            `json:"hits,omitempty"`
+	Misses          int            `json:"misses,omitempty"`
+	BytesFromCache  int64          `json:"bytesFromCache,omitempty"`
+	BytesDownloaded int64          `json:"bytesDownloaded,omitempty"`
+	Evictions       map[string]int `json:"evictions,omitempty"` // By reason
+}
+
+// Recorder counts image cache hits, misses, downloads and evictions per
+// minute, persisted in cache_stats.json in the state directory so the
+// windows survive agent restarts.
+type Recorder struct {
+	path    string
+	mu      sync.Mutex        // Protects buckets
+	buckets map[int64]*bucket // Keyed by the minute's Unix timestamp
+}
+
+// NewRecorder creates a Recorder backed by cache_stats.json in the state directory.
+func NewRecorder(cfg *config.Config) (*Recorder, error) {
+	if err := os.MkdirAll(cfg.StateDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory %s: %w", cfg.StateDir, err)
+	}
+	r := &Recorder{
+		path:    filepath.Join(cfg.StateDir, "cache_stats.json"),
+		buckets: make(map[int64]*bucket),
+	}
+	r.load()
+	return r, nil
+}
+
+// load reads previously persisted buckets, ignoring a missing or corrupt file.
+func (r *Recorder) load() {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: Could not read image cache stats %s: %v", r.path, err)
+		}
+		return
+	}
+	var buckets []*bucket
+	if err := json.Unmarshal(data, &buckets); err != nil {
+		log.Printf("Warning: Could not parse image cache stats %s: %v", r.path, err)
+		return
+	}
+	for _, b := range buckets {
+		r.buckets[b.Start.Unix()] = b
+	}
+}
+
+// Hit counts a provision that found its image, of the given size, cached.
+func (r *Recorder) Hit(imageName string, bytes int64) {
+	r.update(func(b *bucket) {
+		b.Hits++
+		b.BytesFromCache += bytes
+	})
+}
+
+// Miss counts a provision that had to wait for its image to download.
+func (r *Recorder) Miss(imageName string) {
+	r.update(func(b *bucket) {
+		b.Misses++
+	})
+}
+
+// Downloaded counts an image download that finished.
+func (r *Recorder) Downloaded(imageName string, bytes int64) {
+	r.update(func(b *bucket) {
+		b.BytesDownloaded += bytes
+	})
+}
+
+// Evicted counts an image removed from the cache for reason.
+func (r *Recorder) Evicted(imageName, reason string) {
+	r.update(func(b *bucket) {
+		if b.Evictions == nil {
+			b.Evictions = make(map[string]int)
+		}
+		b.Evictions[reason]++
+	})
+}
+
+// update applies fn to the current minute's bucket, prunes buckets older
+// than the longest window and persists.
+func (r *Recorder) update(fn func(b *bucket)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start := time.Now().UTC().Truncate(bucketSize)
+	b, ok := r.buckets[start.Unix()]
+	if !ok {
+		b = &bucket{Start: start}
+		r.buckets[start.Unix()] = b
+	}
+	fn(b)
+
+	cutoff := start.Add(-windows[len(windows)-1].length).Unix()
+	for key := range r.buckets {
+		if key < cutoff {
+			delete(r.buckets, key)
+		}
+	}
+	if err := r.save(); err != nil {
+		log.Printf("Warning: Could not persist image cache stats: %v", err)
+	}
+}
+
+// save writes all buckets to disk atomically. Callers must hold r.mu.
+func (r *Recorder) save() error {
+	buckets := make([]*bucket, 0, len(r.buckets))
+	for _, b := range r.buckets {
+		buckets = append(buckets, b)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Start.Before(buckets[j].Start) })
+	data, err := json.Marshal(buckets)
+	if err != nil {
+		return fmt.Errorf("failed to marshal image cache stats: %w", err)
+	}
+	tmpPath := r.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+	return os.Rename(tmpPath, r.path)
+}
+
+// Windows returns the cache activity over the last hour, day and week. The
+// windows cover whole minutes, including the current one.
+func (r *Recorder) Windows() []models.ImageCacheWindow {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC().Truncate(bucketSize)
+	totals := make([]models.ImageCacheWindow, len(windows))
+	for i, window := range windows {
+		totals[i].Window = window.name
+	}
+	for _, b := range r.buckets {
+		for i, window := range windows {
+			if !b.Start.After(now.Add(-window.length)) {
+				continue
+			}
+			total := &totals[i]
+			total.Hits += b.Hits
+			total.Misses += b.Misses
+			total.BytesFromCache += b.BytesFromCache
+			total.BytesDownloaded += b.BytesDownloaded
+			for reason, n := range b.Evictions {
+				if total.EvictionReasons == nil {
+					total.EvictionReasons = make(map[string]int)
+				}
+				total.EvictionReasons[reason] += n
+				total.Evictions += n
+			}
+		}
+	}
+	for i := range totals {
+		if lookups := totals[i].Hits + totals[i].Misses; lookups > 0 {
+			totals[i].HitRatio = float64(totals[i].Hits) / float64(lookups)
+		}
+	}
+	return totals
+}
@@ -3,37 +3,340 @@ package config
 import (
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Config holds all agent-wide configuration settings.
 type Config struct {
-	NodeID             string        // Unique identifier for this Mac Mini
-	OrchestratorURL    string        // URL of the macvmorx orchestrator
-	HeartbeatInterval  time.Duration // How often to send heartbeats
-	ImageCacheDir      string        // Directory to store cached VM images
-	MaxCachedImages    int           // Maximum number of images to keep in cache (LRU)
-	GCSBucketName      string        // GCP Cloud Storage bucket name for images
-	GCPCredentialsPath string        // Path to GCP service account key JSON file
-	// Add other configurations like VM base path, runner post-script path etc.
+	NodeID                  string        // Unique identifier for this Mac Mini
+	OrchestratorURL         string        // URL of the macvmorx orchestrator
+	HeartbeatInterval       time.Duration // How often to send heartbeats
+	HeartbeatDeltas         bool          // Offer differential heartbeats that send only VM and image changes
+	FullHeartbeatInterval   time.Duration // With differential heartbeats, how often the full state is sent anyway
+	HeartbeatCommands       bool          // Run commands the orchestrator sends in heartbeat responses
+	DataRoot                string        // Directory the image cache, VMs, state, secrets and SSH key default to being under
+	ImageCacheDir           string        // Directory to store cached VM images
+	VMsDir                  string        // Directory holding one working directory per VM
+	VMsDirMode              string        // Octal permissions VMsDir is created with (e.g., "0755")
+	MaxCachedImages         int           // Maximum number of images to keep in cache (LRU)
+	MaxConcurrentDownloads  int           // Image downloads run at once; more are queued
+	DownloadRateLimit       int64         // Combined image download rate in bytes/s; 0 means unlimited
+	DownloadBusyRateLimit   int64         // Lower download rate in bytes/s while VMs are running jobs; 0 disables it
+	ImageSmokeTest          bool          // Boot each newly downloaded image in a throwaway VM before it is usable
+	ImageSmokeTestScript    string        // Host path of the validation script run in the smoke test VM; empty only checks SSH
+	ImageSmokeTestTimeout   time.Duration // Maximum duration of an image smoke test
+	ImageVerify             string        // How cached images are verified before use: "fast" (hash if size or mtime changed), "full" or "off"
+	GCSBucketName           string        // GCP Cloud Storage bucket name for images
+	GCPCredentialsPath      string        // Path to GCP service account key JSON file
+	VMSSHUser               string        // SSH user inside the VM images
+	VMSSHKeyPath            string        // Private key used to SSH into VMs
+	VMSSHInsecureHostKey    bool          // Skip VM SSH host key verification (development only)
+	RunnerScriptPath        string        // Path to the GitHub runner install script run inside VMs
+	RunnerInstallAttempts   int           // How many times to try installing the runner before giving up
+	RunnerInstallRetryDelay time.Duration // Delay between runner install attempts
+	RunnerInstallTimeout    time.Duration // Maximum duration of a single runner install attempt
+	RunnerScriptInterpreter string        // Interpreter the runner install script is fed to (e.g., "bash")
+	RunnerConfirmation      string        // How GitHub runner registration is confirmed after the install script: "off", "file" or "github"
+	RunnerConfirmTimeout    time.Duration // How long to wait for the runner to show up in its .runner file or on GitHub
+	ProvisionStepTimeout    time.Duration // Default timeout of custom provisioning steps
+	ImageDownloadTimeout    time.Duration // How long a provision waits for its image to download
+	VMCreateTimeout         time.Duration // How long cloning the image and starting a VM may take
+	IPTimeout               time.Duration // How long a booted VM may take to get an IP address
+	SSHReadyTimeout         time.Duration // How long a VM with an IP address may take to answer SSH
+	StateDir                string        // Directory for agent state (e.g., utilization history)
+	SecretsProvider         string        // Where secrets come from: "env", "file" or "gcp"
+	SecretsDir              string        // Directory holding one file per secret for the "file" provider
+	GCPProject              string        // GCP project used by the "gcp" secrets provider
+	RunnerTokenSecret       string        // Name of the secret holding the GitHub runner registration token
+	RunnerPackageCache      bool          // Cache the GitHub runner package on the host and upload it into VMs
+	RunnerPackageDir        string        // Directory cached GitHub runner packages are kept in
+	RunnerVersion           string        // GitHub runner version to cache; empty for the latest
+	BuildkiteScriptPath     string        // Path to the Buildkite agent install script run inside VMs
+	BuildkiteTokenSecret    string        // Name of the secret holding the Buildkite agent token
+	GitLabScriptPath        string        // Path to the GitLab runner install script run inside VMs
+	GitLabTokenSecret       string        // Name of the secret holding the GitLab runner authentication token
+	GitLabURL               string        // URL of the GitLab instance runners register with
+	RunnerRegistration      string        // How runners register: "token" (config.sh) or "jit" (GitHub App JIT config)
+	GitHubAPIURL            string        // Base URL of the GitHub REST API
+	GitHubAppID             int           // GitHub App ID used to mint installation tokens
+	GitHubAppInstallationID int           // Installation ID of the GitHub App
+	GitHubAppPrivateKeyPath string        // Path to the GitHub App private key (PEM)
+	DeregisterRunners       bool          // Remove a deleted VM's runner from GitHub
+	GitHubTokenSecret       string        // Name of the secret holding a GitHub token for runner deregistration; empty uses the GitHub App
+	ThermalProtection       bool          // Suspend VMs while host thermal pressure is critical
+	ThermalCheckInterval    time.Duration // How often to sample thermal pressure
+	ThermalCriticalLevel    string        // Pressure level that triggers protection (e.g., "Heavy")
+	CoreSchedulingSampling  bool          // Sample per-VM P/E core scheduling with powermetrics in the background for heartbeats (requires root)
+	ReachabilityEndpoints   []string      // Endpoints each VM must reach before it is ready; empty disables the check
+	ReachabilityRequired    bool          // Fail provisioning when an endpoint is unreachable instead of only reporting it
+	DHCPLeasesPath          string        // Lease database of the host's DHCP server, used to find the IPs of NAT VMs
+	IPDiscovery             []string      // IP discovery strategies tried in order: tart, dhcp and arp
+	MDNSRegister            bool          // Advertise each VM as <vmId>.local over Bonjour once it has an IP
+	GuestEvents             bool          // Install the guest helper that reports boot, runner and job phases from inside VMs
+	GuestAgentURL           string        // Agent URL as reachable from inside VMs, for the guest helper
+	EphemeralCheckInterval  time.Duration // How often VMs with ephemeral runners are checked for a finished job
+	VMLogCollection         bool          // Bundle the host and guest logs of failed and deleted VMs before their directory is removed
+	VMLogUpload             bool          // Upload VM log bundles to the image bucket under failures/
+	MaxVMLogBundles         int           // VM log bundles kept in the state directory; the oldest are removed beyond this
+	WebhookURLs             []string      // URLs signed lifecycle events are POSTed to; empty disables webhooks
+	WebhookSecret           string        // Name of the secret holding the key webhook deliveries are signed with
+	WebhookEvents           []string      // Event types delivered to webhooks; empty delivers all events
+	ReachabilityTimeout     time.Duration // Per-endpoint timeout for the reachability check
+	HealthChecks            []string      // Checks run by POST /vms/{vmId}/healthcheck: ssh, disk, runner, clock
+	HealthCheckMinFreeDisk  int64         // Minimum free space on the guest's root volume for the disk check
+	HealthCheckMaxClockSkew time.Duration // Maximum guest clock skew for the clock check
+	FileTransferMaxBytes    int64         // Largest file accepted by the VM file upload endpoint
+	FileTransferTimeout     time.Duration // Maximum duration of a single VM file upload or download
+	ExecMaxTimeout          time.Duration // Upper bound on the timeout of POST /vms/{vmId}/exec commands
+	GuestShutdownTimeout    time.Duration // How long a guest may take to power off before the VM is stopped forcibly
+	HooksDir                string        // Directory of host-side hook executables run around provisions and deletes; empty disables hooks
+	HookTimeout             time.Duration // How long a hook may run before it is killed
+	VMProfilesFile          string        // JSON file of named VM profiles provision requests can reference; empty defines none
+	MaxVMs                  int           // VM slots advertised to the orchestrator; macOS allows 2 macOS guests per host
+	WarmPoolSize            int           // Standby VMs kept booted from WarmPoolImage for fast provisioning; 0 disables the warm pool
+	WarmPoolImage           string        // Image the warm pool's standby VMs are created from
+	MaxConcurrentProvisions int           // Provisions run at once; more are queued and scheduled fairly across tenants. 0 means unlimited
+	MaxPendingProvisions    int           // Provisions queued beyond MaxConcurrentProvisions before requests are rejected with 429. 0 means unlimited
+	MaxCommandWorkers       int           // VM commands (deletes, provisions, shutdowns, suspends, resumes) run at once; deletes go first
+	MaxQueuedCommands       int           // Deletes, shutdowns, suspends and resumes queued before requests are rejected with 429. 0 means unlimited
+	TenantWeights           []string      // Relative shares of provisioning slots as tenant=weight; unlisted tenants weigh 1
+	NodeLabels              []string      // Labels provision requests select the node by, as key or key=value (e.g. xcode15, team=ios)
+	NodeTaints              []string      // Taints provision requests must tolerate to be accepted, as key or key=value
+	RateLimits              []string      // Per-route API rate limits as /path=<requests per second>[:<burst>]
+	DiskSpaceReserve        int64         // Bytes to keep free on image cache and VM volumes beyond what a download or clone needs
+	DiskCloneMode           string        // How VM disks are created from cached images: "auto" (APFS clone, else copy), "clone" or "copy"
+	MaxRetainedVMRecords    int           // Upper bound on VM records kept until the orchestrator acknowledges them
+	VMHistorySize           int           // VMs kept in the local VM history served by GET /history; 0 disables the history
+	UpdateURL               string        // http(s):// or gs:// location of agent releases (latest.json); empty disables self-update
+	UpdatePublicKey         string        // Base64 Ed25519 public key release signatures are verified with
+	UpdateInterval          time.Duration // How often the agent checks for a new release; 0 disables the auto-update loop
+	UpdateLaunchdLabel      string        // launchd job restarted after an update; empty exits and relies on KeepAlive
+	MaintenanceSchedule     string        // Cron spec of when maintenance windows open, in the host's time zone; empty disables them
+	MaintenanceWindow       time.Duration // How long a maintenance window stays open for the node to drain and the hook to run
+	MaintenanceHook         string        // Executable run once the node drained in a maintenance window (e.g. softwareupdate, reboot); empty only drains
+	JanitorInterval         time.Duration // How often stale files are swept from VMsDir; 0 disables the janitor
+	JanitorMinAge           time.Duration // Minimum age of a stale file before the janitor removes it
+	VMGCInterval            time.Duration // How often stale VM directories are collected; 0 disables scheduled collection
+	VMGCGracePeriod         time.Duration // How long a VM directory must be untouched before it can be collected
+	DiskUsageInterval       time.Duration // How often the disk space of the image cache and each VM is measured; 0 disables sampling
+	LegacyVMRootDir         string        // VM directory root of older agents to migrate into the current layout at startup
+	Backend                 string        // VM backend to use: "auto" (first usable) or a backend name such as "tart"
+	UserAgent               string        // User-Agent of requests to the orchestrator; empty for macvmagt/<version>
+	AccessLog               string        // Access log format of the command server: "common", "json" or "off"
+	ServerReadTimeout       time.Duration // Time to read a request to the command server, headers and body
+	ServerWriteTimeout      time.Duration // Time to write a response of the command server, except on RouteTimeouts
+	ServerIdleTimeout       time.Duration // How long idle keep-alive connections to the command server are kept
+	RouteTimeouts           []string      // Per-route timeouts replacing the read and write timeouts, as /path=<duration>; 0 lifts them
+	AuditLogMaxBytes        int64         // Size at which the audit log of orchestrator commands is rotated; 0 disables rotation
+	AuditLogMaxFiles        int           // Rotated audit log files kept
+	LogFile                 string        // File the agent logs to, rotated like VM logs; empty logs to stderr
+	LogMaxBytes             int64         // Size at which the agent's log file and each VM's log are rotated; 0 disables size-based rotation
+	LogMaxAge               time.Duration // Age at which the agent's log file and each VM's log are rotated; 0 disables age-based rotation
+	LogMaxFiles             int           // Rotated files kept of the agent's log file and of each VM's log
+	TLSCertPath             string        // PEM certificate the command server serves HTTPS with; empty serves plain HTTP
+	TLSKeyPath              string        // PEM private key of TLSCertPath
+	TLSSelfSigned           bool          // Serve HTTPS with a self-signed certificate generated into StateDir when no certificate is configured
+	HTTPRedirectAddr        string        // Address of a plain HTTP listener redirecting to the HTTPS command server; empty disables it
+	OperatorTokenSecret     string        // Name of the secret holding the API token for every endpoint; empty leaves the API open
+	ReadOnlyTokenSecret     string        // Name of the secret holding the API token for GET endpoints only
+	CommandPublicKeys       []string      // Base64 Ed25519 public keys commands must be signed with; empty accepts unsigned commands
+	CommandSignatureMaxAge  time.Duration // How far a signed command's timestamp may be from the node's clock
+	OTLPEndpoint            string        // OTLP/HTTP endpoint URL spans are exported to; empty disables tracing
+	TraceSampleRatio        float64       // Fraction of traces started by the agent that are sampled; requests keep the orchestrator's decision
+	CommandRecordPath       string        // Fixture file the outputs of external commands (tart, sysctl, ...) are recorded to; empty disables recording
+	CommandReplayPath       string        // Fixture file external commands are answered from instead of being run; empty runs them
+	Driver                  string        // How VMs are run: "tart", or "fake" to simulate them without Apple hardware
+	FakeBootTime            time.Duration // How long VMs of the fake driver take to get an IP address after they start
+	// Add other configurations like VM base path etc.
 }
 
 // LoadConfig loads configuration from environment variables or uses default values.
 func LoadConfig() *Config {
 	cfg := &Config{
-		NodeID:             getEnv("MACVMORX_AGENT_NODE_ID", "mac-mini-default"),
-		OrchestratorURL:    getEnv("MACVMORX_ORCHESTRATOR_URL", "http://localhost:8080"),
-		HeartbeatInterval:  getEnvDuration("MACVMORX_HEARTBEAT_INTERVAL", 15*time.Second), // 15-30s heartbeat
-		ImageCacheDir:      getEnv("MACVMORX_IMAGE_CACHE_DIR", "/var/macvmorx/images_cache"),
-		MaxCachedImages:    getEnvInt("MACVMORX_MAX_CACHED_IMAGES", 5),
-		GCSBucketName:      getEnv("MACVMORX_GCS_BUCKET_NAME", "macvmorx-vm-images"),
-		GCPCredentialsPath: getEnv("MACVMORX_GCP_CREDENTIALS_PATH", ""), // Leave empty for default auth
+		NodeID:                  getEnv("MACVMORX_AGENT_NODE_ID", "mac-mini-default"),
+		OrchestratorURL:         getEnv("MACVMORX_ORCHESTRATOR_URL", "http://localhost:8080"),
+		HeartbeatInterval:       getEnvDuration("MACVMORX_HEARTBEAT_INTERVAL", 15*time.Second), // 15-30s heartbeat
+		HeartbeatDeltas:         getEnvBool("MACVMORX_HEARTBEAT_DELTAS", false),
+		FullHeartbeatInterval:   getEnvDuration("MACVMORX_FULL_HEARTBEAT_INTERVAL", 10*time.Minute),
+		HeartbeatCommands:       getEnvBool("MACVMORX_HEARTBEAT_COMMANDS", false),
+		DataRoot:                getEnv("MACVMORX_DATA_ROOT", defaultDataRoot()),
+		ImageCacheDir:           getEnv("MACVMORX_IMAGE_CACHE_DIR", ""), // Empty paths are resolved under DataRoot by ResolvePaths
+		VMsDir:                  getEnv("MACVMORX_VMS_DIR", ""),
+		VMsDirMode:              getEnv("MACVMORX_VMS_DIR_MODE", "0755"),
+		MaxCachedImages:         getEnvInt("MACVMORX_MAX_CACHED_IMAGES", 5),
+		MaxConcurrentDownloads:  getEnvInt("MACVMORX_MAX_CONCURRENT_DOWNLOADS", 1),
+		DownloadRateLimit:       getEnvInt64("MACVMORX_DOWNLOAD_RATE_LIMIT", 0),
+		DownloadBusyRateLimit:   getEnvInt64("MACVMORX_DOWNLOAD_BUSY_RATE_LIMIT", 0),
+		ImageSmokeTest:          getEnvBool("MACVMORX_IMAGE_SMOKE_TEST", false),
+		ImageSmokeTestScript:    getEnv("MACVMORX_IMAGE_SMOKE_TEST_SCRIPT", ""),
+		ImageSmokeTestTimeout:   getEnvDuration("MACVMORX_IMAGE_SMOKE_TEST_TIMEOUT", 15*time.Minute),
+		ImageVerify:             getEnv("MACVMORX_IMAGE_VERIFY", "fast"),
+		GCSBucketName:           getEnv("MACVMORX_GCS_BUCKET_NAME", "macvmorx-vm-images"),
+		GCPCredentialsPath:      getEnv("MACVMORX_GCP_CREDENTIALS_PATH", ""), // Leave empty for default auth
+		VMSSHUser:               getEnv("MACVMORX_VM_SSH_USER", "admin"),
+		VMSSHKeyPath:            getEnv("MACVMORX_VM_SSH_KEY_PATH", ""),
+		VMSSHInsecureHostKey:    getEnvBool("MACVMORX_VM_SSH_INSECURE_HOST_KEY", false),
+		RunnerScriptPath:        getEnv("MACVMORX_RUNNER_SCRIPT_PATH", "/opt/macvmagt/scripts/install_github_runner.sh"),
+		RunnerInstallAttempts:   getEnvInt("MACVMORX_RUNNER_INSTALL_ATTEMPTS", 3),
+		RunnerInstallRetryDelay: getEnvDuration("MACVMORX_RUNNER_INSTALL_RETRY_DELAY", 30*time.Second),
+		RunnerInstallTimeout:    getEnvDuration("MACVMORX_RUNNER_INSTALL_TIMEOUT", 15*time.Minute),
+		RunnerScriptInterpreter: getEnv("MACVMORX_RUNNER_SCRIPT_INTERPRETER", "bash"),
+		RunnerConfirmation:      getEnv("MACVMORX_RUNNER_CONFIRMATION", "file"),
+		RunnerConfirmTimeout:    getEnvDuration("MACVMORX_RUNNER_CONFIRM_TIMEOUT", 2*time.Minute),
+		ProvisionStepTimeout:    getEnvDuration("MACVMORX_PROVISION_STEP_TIMEOUT", 10*time.Minute),
+		ImageDownloadTimeout:    getEnvDuration("MACVMORX_IMAGE_DOWNLOAD_TIMEOUT", 30*time.Minute),
+		VMCreateTimeout:         getEnvDuration("MACVMORX_VM_CREATE_TIMEOUT", 15*time.Minute),
+		IPTimeout:               getEnvDuration("MACVMORX_IP_TIMEOUT", 5*time.Minute),
+		SSHReadyTimeout:         getEnvDuration("MACVMORX_SSH_READY_TIMEOUT", 5*time.Minute),
+		StateDir:                getEnv("MACVMORX_STATE_DIR", ""),
+		SecretsProvider:         getEnv("MACVMORX_SECRETS_PROVIDER", "env"),
+		SecretsDir:              getEnv("MACVMORX_SECRETS_DIR", ""),
+		GCPProject:              getEnv("MACVMORX_GCP_PROJECT", ""),
+		RunnerTokenSecret:       getEnv("MACVMORX_RUNNER_TOKEN_SECRET", "GITHUB_RUNNER_TOKEN"),
+		RunnerPackageCache:      getEnvBool("MACVMORX_RUNNER_PACKAGE_CACHE", false),
+		RunnerPackageDir:        getEnv("MACVMORX_RUNNER_PACKAGE_DIR", ""),
+		RunnerVersion:           getEnv("MACVMORX_RUNNER_VERSION", ""),
+		BuildkiteScriptPath:     getEnv("MACVMORX_BUILDKITE_SCRIPT_PATH", "/opt/macvmagt/scripts/install_buildkite_agent.sh"),
+		BuildkiteTokenSecret:    getEnv("MACVMORX_BUILDKITE_TOKEN_SECRET", "BUILDKITE_AGENT_TOKEN"),
+		GitLabScriptPath:        getEnv("MACVMORX_GITLAB_SCRIPT_PATH", "/opt/macvmagt/scripts/install_gitlab_runner.sh"),
+		GitLabTokenSecret:       getEnv("MACVMORX_GITLAB_TOKEN_SECRET", "GITLAB_RUNNER_TOKEN"),
+		GitLabURL:               getEnv("MACVMORX_GITLAB_URL", "https://gitlab.com"),
+		RunnerRegistration:      getEnv("MACVMORX_RUNNER_REGISTRATION", "token"),
+		GitHubAPIURL:            getEnv("MACVMORX_GITHUB_API_URL", "https://api.github.com"),
+		GitHubAppID:             getEnvInt("MACVMORX_GITHUB_APP_ID", 0),
+		GitHubAppInstallationID: getEnvInt("MACVMORX_GITHUB_APP_INSTALLATION_ID", 0),
+		GitHubAppPrivateKeyPath: getEnv("MACVMORX_GITHUB_APP_PRIVATE_KEY_PATH", ""),
+		DeregisterRunners:       getEnvBool("MACVMORX_DEREGISTER_RUNNERS", false),
+		GitHubTokenSecret:       getEnv("MACVMORX_GITHUB_TOKEN_SECRET", ""),
+		ThermalProtection:       getEnvBool("MACVMORX_THERMAL_PROTECTION", false),
+		ThermalCheckInterval:    getEnvDuration("MACVMORX_THERMAL_CHECK_INTERVAL", 30*time.Second),
+		ThermalCriticalLevel:    getEnv("MACVMORX_THERMAL_CRITICAL_LEVEL", "Heavy"),
+		CoreSchedulingSampling:  getEnvBool("MACVMORX_CORE_SCHEDULING_SAMPLING", false),
+		ReachabilityEndpoints:   getEnvList("MACVMORX_REACHABILITY_ENDPOINTS", nil),
+		ReachabilityRequired:    getEnvBool("MACVMORX_REACHABILITY_REQUIRED", false),
+		DHCPLeasesPath:          getEnv("MACVMORX_DHCP_LEASES_PATH", "/var/db/dhcpd_leases"),
+		IPDiscovery:             getEnvList("MACVMORX_IP_DISCOVERY", []string{"tart", "dhcp", "arp"}),
+		MDNSRegister:            getEnvBool("MACVMORX_MDNS_REGISTER", false),
+		GuestEvents:             getEnvBool("MACVMORX_GUEST_EVENTS", false),
+		GuestAgentURL:           getEnv("MACVMORX_GUEST_AGENT_URL", "http://192.168.64.1:8081"), // Host side of tart's shared NAT network
+		EphemeralCheckInterval:  getEnvDuration("MACVMORX_EPHEMERAL_CHECK_INTERVAL", 30*time.Second),
+		VMLogCollection:         getEnvBool("MACVMORX_VM_LOG_COLLECTION", false),
+		VMLogUpload:             getEnvBool("MACVMORX_VM_LOG_UPLOAD", false),
+		MaxVMLogBundles:         getEnvInt("MACVMORX_MAX_VM_LOG_BUNDLES", 100),
+		WebhookURLs:             getEnvList("MACVMORX_WEBHOOK_URLS", nil),
+		WebhookSecret:           getEnv("MACVMORX_WEBHOOK_SECRET", "WEBHOOK_SECRET"),
+		WebhookEvents:           getEnvList("MACVMORX_WEBHOOK_EVENTS", []string{"vm.provision.started", "vm.ready", "vm.failed", "vm.deleted", "image.downloaded", "node.cordoned"}),
+		ReachabilityTimeout:     getEnvDuration("MACVMORX_REACHABILITY_TIMEOUT", 10*time.Second),
+		HealthChecks:            getEnvList("MACVMORX_HEALTH_CHECKS", []string{"ssh", "disk", "runner", "clock"}),
+		HealthCheckMinFreeDisk:  getEnvInt64("MACVMORX_HEALTH_CHECK_MIN_FREE_DISK", 5<<30),
+		HealthCheckMaxClockSkew: getEnvDuration("MACVMORX_HEALTH_CHECK_MAX_CLOCK_SKEW", 30*time.Second),
+		FileTransferMaxBytes:    getEnvInt64("MACVMORX_FILE_TRANSFER_MAX_BYTES", 1<<30),
+		FileTransferTimeout:     getEnvDuration("MACVMORX_FILE_TRANSFER_TIMEOUT", 10*time.Minute),
+		ExecMaxTimeout:          getEnvDuration("MACVMORX_EXEC_MAX_TIMEOUT", 10*time.Minute),
+		GuestShutdownTimeout:    getEnvDuration("MACVMORX_GUEST_SHUTDOWN_TIMEOUT", 2*time.Minute),
+		HooksDir:                getEnv("MACVMORX_HOOKS_DIR", ""),
+		HookTimeout:             getEnvDuration("MACVMORX_HOOK_TIMEOUT", time.Minute),
+		VMProfilesFile:          getEnv("MACVMORX_VM_PROFILES_FILE", ""),
+		MaxVMs:                  getEnvInt("MACVMORX_MAX_VMS", 2),
+		WarmPoolSize:            getEnvInt("MACVMORX_WARM_POOL_SIZE", 0),
+		WarmPoolImage:           getEnv("MACVMORX_WARM_POOL_IMAGE", ""),
+		MaxConcurrentProvisions: getEnvInt("MACVMORX_MAX_CONCURRENT_PROVISIONS", 4),
+		MaxPendingProvisions:    getEnvInt("MACVMORX_MAX_PENDING_PROVISIONS", 32),
+		MaxCommandWorkers:       getEnvInt("MACVMORX_MAX_COMMAND_WORKERS", 5),
+		MaxQueuedCommands:       getEnvInt("MACVMORX_MAX_QUEUED_COMMANDS", 100),
+		TenantWeights:           getEnvList("MACVMORX_TENANT_WEIGHTS", nil),
+		NodeLabels:              getEnvList("MACVMORX_NODE_LABELS", nil),
+		NodeTaints:              getEnvList("MACVMORX_NODE_TAINTS", nil),
+		RateLimits:              getEnvList("MACVMORX_RATE_LIMITS", []string{"/provision-vm=2:10", "/delete-vm=5:20", "/gc=0.1:1"}),
+		DiskSpaceReserve:        getEnvInt64("MACVMORX_DISK_SPACE_RESERVE", 10<<30),
+		DiskCloneMode:           getEnv("MACVMORX_DISK_CLONE_MODE", "auto"),
+		MaxRetainedVMRecords:    getEnvInt("MACVMORX_MAX_RETAINED_VM_RECORDS", 1000),
+		VMHistorySize:           getEnvInt("MACVMORX_VM_HISTORY_SIZE", 1000),
+		UpdateURL:               getEnv("MACVMORX_UPDATE_URL", ""),
+		UpdatePublicKey:         getEnv("MACVMORX_UPDATE_PUBLIC_KEY", ""),
+		UpdateInterval:          getEnvDuration("MACVMORX_UPDATE_INTERVAL", 0),
+		UpdateLaunchdLabel:      getEnv("MACVMORX_UPDATE_LAUNCHD_LABEL", ""),
+		MaintenanceSchedule:     getEnv("MACVMORX_MAINTENANCE_SCHEDULE", ""),
+		MaintenanceWindow:       getEnvDuration("MACVMORX_MAINTENANCE_WINDOW", 4*time.Hour),
+		MaintenanceHook:         getEnv("MACVMORX_MAINTENANCE_HOOK", ""),
+		JanitorInterval:         getEnvDuration("MACVMORX_JANITOR_INTERVAL", time.Hour),
+		JanitorMinAge:           getEnvDuration("MACVMORX_JANITOR_MIN_AGE", time.Hour),
+		VMGCInterval:            getEnvDuration("MACVMORX_VM_GC_INTERVAL", time.Hour),
+		VMGCGracePeriod:         getEnvDuration("MACVMORX_VM_GC_GRACE_PERIOD", 24*time.Hour),
+		DiskUsageInterval:       getEnvDuration("MACVMORX_DISK_USAGE_INTERVAL", 5*time.Minute),
+		LegacyVMRootDir:         getEnv("MACVMORX_LEGACY_VM_ROOT_DIR", ""),
+		Backend:                 getEnv("MACVMORX_BACKEND", "auto"),
+		UserAgent:               getEnv("MACVMORX_USER_AGENT", ""),
+		AccessLog:               getEnv("MACVMORX_ACCESS_LOG", "common"),
+		ServerReadTimeout:       getEnvDuration("MACVMORX_SERVER_READ_TIMEOUT", 5*time.Second),
+		ServerWriteTimeout:      getEnvDuration("MACVMORX_SERVER_WRITE_TIMEOUT", 5*time.Second),
+		ServerIdleTimeout:       getEnvDuration("MACVMORX_SERVER_IDLE_TIMEOUT", 60*time.Second),
+		RouteTimeouts:           getEnvList("MACVMORX_ROUTE_TIMEOUTS", nil),
+		AuditLogMaxBytes:        getEnvInt64("MACVMORX_AUDIT_LOG_MAX_BYTES", 10*1024*1024), // 10 MiB
+		AuditLogMaxFiles:        getEnvInt("MACVMORX_AUDIT_LOG_MAX_FILES", 5),
+		LogFile:                 getEnv("MACVMORX_LOG_FILE", ""),
+		LogMaxBytes:             getEnvInt64("MACVMORX_LOG_MAX_BYTES", 10*1024*1024), // 10 MiB
+		LogMaxAge:               getEnvDuration("MACVMORX_LOG_MAX_AGE", 24*time.Hour),
+		LogMaxFiles:             getEnvInt("MACVMORX_LOG_MAX_FILES", 3),
+		TLSCertPath:             getEnv("MACVMORX_TLS_CERT", ""),
+		TLSKeyPath:              getEnv("MACVMORX_TLS_KEY", ""),
+		TLSSelfSigned:           getEnvBool("MACVMORX_TLS_SELF_SIGNED", false),
+		HTTPRedirectAddr:        getEnv("MACVMORX_HTTP_REDIRECT_ADDR", ""),
+		OperatorTokenSecret:     getEnv("MACVMORX_OPERATOR_TOKEN_SECRET", ""),
+		ReadOnlyTokenSecret:     getEnv("MACVMORX_READ_ONLY_TOKEN_SECRET", ""),
+		CommandPublicKeys:       getEnvList("MACVMORX_COMMAND_PUBLIC_KEYS", nil),
+		CommandSignatureMaxAge:  getEnvDuration("MACVMORX_COMMAND_SIGNATURE_MAX_AGE", 5*time.Minute),
+		OTLPEndpoint:            getEnv("MACVMORX_OTLP_ENDPOINT", ""),
+		TraceSampleRatio:        getEnvFloat("MACVMORX_TRACE_SAMPLE_RATIO", 1),
+		CommandRecordPath:       getEnv("MACVMORX_COMMAND_RECORD", ""),
+		CommandReplayPath:       getEnv("MACVMORX_COMMAND_REPLAY", ""),
+		Driver:                  getEnv("MACVMORX_DRIVER", "tart"),
+		FakeBootTime:            getEnvDuration("MACVMORX_FAKE_BOOT_TIME", 10*time.Second),
 	}
 	log.Printf("Loaded agent configuration: %+v", cfg)
 	return cfg
 }
 
+// defaultDataRoot is /var/macvmorx for root, where earlier agents kept their
+// data, and ~/Library/Application Support/macvmagt for other users, so an
+// unprivileged agent works without directories prepared by an administrator.
+func defaultDataRoot() string {
+	if os.Geteuid() == 0 {
+		return "/var/macvmorx"
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Printf("Warning: Could not find the home directory, keeping data in the working directory: %v", err)
+		return "macvmagt"
+	}
+	return filepath.Join(home, "Library", "Application Support", "macvmagt")
+}
+
+// ResolvePaths sets the directories and files that weren't configured to
+// their default under DataRoot. It runs once flags are parsed, so --data-root
+// moves every one of them.
+func (c *Config) ResolvePaths() {
+	defaults := []struct {
+		path *string
+		rel  string
+	}{
+		{&c.ImageCacheDir, "images_cache"},
+		{&c.VMsDir, "vms"},
+		{&c.StateDir, "state"},
+		{&c.RunnerPackageDir, "runner_packages"},
+		{&c.SecretsDir, "secrets"},
+		{&c.VMSSHKeyPath, filepath.Join("ssh", "id_ed25519")},
+	}
+	for _, d := range defaults {
+		if *d.path == "" {
+			*d.path = filepath.Join(c.DataRoot, d.rel)
+		}
+	}
+}
+
 // getEnv retrieves an environment variable or returns a default value.
 func getEnv(key, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
@@ -67,3 +370,56 @@ func getEnvInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+// getEnvInt64 retrieves a 64-bit integer environment variable or returns a default value.
+func getEnvInt64(key string, defaultValue int64) int64 {
+	if value, exists := os.LookupEnv(key); exists {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Printf("Warning: Could not parse int for %s='%s', using default %d. Error: %v", key, value, defaultValue, err)
+			return defaultValue
+		}
+		return parsed
+	}
+	return defaultValue
+}
+
+// getEnvFloat retrieves a floating-point environment variable or returns a default value.
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value, exists := os.LookupEnv(key); exists {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			log.Printf("Warning: Could not parse float for %s='%s', using default %g. Error: %v", key, value, defaultValue, err)
+			return defaultValue
+		}
+		return parsed
+	}
+	return defaultValue
+}
+
+// getEnvBool retrieves a boolean environment variable or returns a default value.
+func getEnvBool(key string, defaultValue bool) bool {
+	if value, exists := os.LookupEnv(key); exists {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("Warning: Could not parse bool for %s='%s', using default %t. Error: %v", key, value, defaultValue, err)
+			return defaultValue
+		}
+		return parsed
+	}
+	return defaultValue
+}
+
+// getEnvList retrieves a comma-separated list environment variable or returns a default value.
+func getEnvList(key string, defaultValue []string) []string {
+	if value, exists := os.LookupEnv(key); exists {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list
+	}
+	return defaultValue
+}
@@ -0,0 +1,125 @@
+package cordon
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/events"
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// Store tracks whether the node is cordoned: it rejects new provisions while
+// leaving running VMs alone, so it can be drained for maintenance. The state
+// is persisted in cordon.json in the state directory, so a node stays cordoned
+// across the agent restarts a macOS update involves.
+type Store struct {
+	path   string
+	events *events.Emitter
+	mu     sync.Mutex // Protects state
+	state  models.CordonState
+}
+
+// NewStore creates a Store backed by cordon.json in the state directory.
+func NewStore(cfg *config.Config, em *events.Emitter) (*Store, error) {
+	if err := os.MkdirAll(cfg.StateDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory %s: %w", cfg.StateDir, err)
+	}
+
+	s := &Store{
+		path:   filepath.Join(cfg.StateDir, "cordon.json"),
+		events: em,
+	}
+	s.load()
+	return s, nil
+}
+
+// load reads the persisted state, treating a missing or corrupt file as uncordoned.
+func (s *Store) load() {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: Could not read cordon state %s: %v", s.path, err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		log.Printf("Warning: Could not parse cordon state %s: %v", s.path, err)
+		return
+	}
+	if s.state.Cordoned {
+		log.Printf("Node is cordoned since %s (%s); new provisions are rejected until POST /uncordon", s.state.Since.Format(time.RFC3339), s.state.Reason)
+	}
+}
+
+// State returns the current cordon state.
+func (s *Store) State() models.CordonState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Cordoned reports whether the node is cordoned.
+func (s *Store) Cordoned() bool {
+	return s.State().Cordoned
+}
+
+// Cordon marks the node unschedulable. Cordoning a cordoned node only updates the reason.
+func (s *Store) Cordon(reason string) (models.CordonState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wasCordoned := s.state.Cordoned
+	next := models.CordonState{Cordoned: true, Reason: reason, Since: s.state.Since}
+	if !wasCordoned {
+		next.Since = time.Now().UTC()
+	}
+	if err := s.persist(next); err != nil {
+		return s.state, err
+	}
+	s.state = next
+
+	if !wasCordoned {
+		// Sent in the background so the API response isn't held up by the orchestrator.
+		go s.events.Emit("node.cordoned", "Node cordoned, new provisions are rejected", map[string]string{"reason": reason})
+	}
+	return s.state, nil
+}
+
+// Uncordon makes the node schedulable again.
+func (s *Store) Uncordon() (models.CordonState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.state.Cordoned {
+		return s.state, nil
+	}
+	if err := s.persist(models.CordonState{}); err != nil {
+		return s.state, err
+	}
+	s.state = models.CordonState{}
+
+	go s.events.Emit("node.uncordoned", "Node uncordoned, provisions are accepted again", nil)
+	return s.state, nil
+}
+
+// persist writes state to disk atomically. Callers must hold s.mu.
+func (s *Store) persist(state models.CordonState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cordon state: %w", err)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to persist cordon state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Package diskusage measures where a node's disk space went: the image cache
+// and each VM's directory and tart bundle. Walking multi-gigabyte sparse VM
+// disks takes a while, so it is sampled in the background and served from
+// the last sample.
+package diskusage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/paths"
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// Sampler measures the node's disk usage every DiskUsageInterval and keeps
+// the last sample.
+type Sampler struct {
+	cfg    *config.Config
+	layout *paths.Layout
+	mu     sync.RWMutex      // Protects last
+	last   *models.DiskUsage // nil before the first sample
+}
+
+// NewSampler creates a new disk usage Sampler.
+func NewSampler(cfg *config.Config) *Sampler {
+	return &Sampler{
+		cfg:    cfg,
+		layout: paths.New(cfg.VMsDir),
+	}
+}
+
+// Start samples disk usage right away and then every DiskUsageInterval
+// until the process exits.
+func (s *Sampler) Start() {
+	s.Sample()
+	ticker := time.NewTicker(s.cfg.DiskUsageInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.Sample()
+	}
+}
+
+// Sample measures disk usage now and keeps the result. Parts that can't be
+// measured are listed in its Errors and counted as 0.
+func (s *Sampler) Sample() models.DiskUsage {
+	started := time.Now()
+	usage := models.DiskUsage{VMs: make(map[string]uint64)}
+	failed := func(err error) {
+		usage.Errors = append(usage.Errors, err.Error())
+	}
+
+	if bytes, err := utils.DirAllocatedBytes(s.cfg.ImageCacheDir); err == nil {
+		usage.ImageCacheBytes = bytes
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		failed(err)
+	}
+
+	vmIDs, err := s.layout.List()
+	if err != nil {
+		failed(fmt.Errorf("failed to list VM directories: %w", err))
+	}
+	for _, vmID := range vmIDs {
+		bytes, err := s.vmBytes(vmID)
+		if err != nil {
+			failed(err)
+		}
+		usage.VMs[vmID] = bytes
+		usage.VMBytes += bytes
+	}
+
+	usage.SampledAt = started.UTC()
+	usage.DurationMs = time.Since(started).Milliseconds()
+	if len(usage.Errors) > 0 {
+		log.Printf("Disk usage sample incomplete: %v", usage.Errors)
+	}
+
+	s.mu.Lock()
+	s.last = &usage
+	s.mu.Unlock()
+	return usage
+}
+
+// vmBytes returns the disk space allocated to a VM: its directory, and the
+// bundle tart keeps it in, if any. VMs removed while being measured count as 0.
+func (s *Sampler) vmBytes(vmID string) (uint64, error) {
+	total, err := utils.DirAllocatedBytes(s.layout.VMDir(vmID))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	if dir, err := utils.TartVMDir(vmID); err == nil {
+		if bytes, err := utils.DirAllocatedBytes(dir); err == nil {
+			total += bytes
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Usage returns the last sample, or nil before the first one.
+func (s *Sampler) Usage() *models.DiskUsage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.last
+}
+
+// VMBytes returns the disk space allocated to a VM as of the last sample,
+// and whether the VM was measured in it.
+func (s *Sampler) VMBytes(vmID string) (uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.last == nil {
+		return 0, false
+	}
+	bytes, ok := s.last.VMs[vmID]
+	return bytes, ok
+}
@@ -0,0 +1,214 @@
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/changty97/macvmagt/internal/backend"
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/models"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// checkTimeout bounds each check.
+const checkTimeout = 15 * time.Second
+
+// check verifies one prerequisite, returning what it found, or an error and a fix.
+type check struct {
+	name string
+	run  func(ctx context.Context, cfg *config.Config) (detail string, fix string, err error)
+}
+
+// checks run in order; later ones don't depend on earlier ones passing.
+var checks = []check{
+	{"backend", checkBackend},
+	{"directories", checkDirectories},
+	{"ssh-key", checkSSHKey},
+	{"runner-script", checkRunnerScript},
+	{"gcs", checkGCS},
+	{"orchestrator", checkOrchestrator},
+}
+
+// readinessChecks are the checks a running agent must pass to take VMs: the
+// ones whose outcome can change while it runs.
+var readinessChecks = []string{"backend", "directories", "gcs", "orchestrator"}
+
+// Run checks the host prerequisites of the agent: a usable VM backend, the
+// directories it writes to, the VM SSH key, the runner script, access to the
+// image bucket and reachability of the orchestrator. Every check runs even
+// after a failure, so one run lists everything there is to fix.
+func Run(ctx context.Context, cfg *config.Config) *models.DoctorReport {
+	return run(ctx, cfg, checks)
+}
+
+// Ready runs the readiness checks: the VM backend, the directories, the image
+// bucket and the orchestrator.
+func Ready(ctx context.Context, cfg *config.Config) *models.DoctorReport {
+	var selected []check
+	for _, c := range checks {
+		if slices.Contains(readinessChecks, c.name) {
+			selected = append(selected, c)
+		}
+	}
+	return run(ctx, cfg, selected)
+}
+
+// run runs checks in order.
+func run(ctx context.Context, cfg *config.Config, checks []check) *models.DoctorReport {
+	report := &models.DoctorReport{
+		NodeID:    cfg.NodeID,
+		Healthy:   true,
+		CheckedAt: time.Now().UTC(),
+		Checks:    make([]models.DoctorCheck, 0, len(checks)),
+	}
+	for _, c := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+		detail, fix, err := c.run(checkCtx, cfg)
+		cancel()
+
+		result := models.DoctorCheck{Name: c.name, OK: err == nil, Detail: detail}
+		if err != nil {
+			result.Detail = err.Error()
+			result.Fix = fix
+			report.Healthy = false
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	return report
+}
+
+// checkBackend verifies a VM backend is installed, entitled and usable on this host.
+func checkBackend(ctx context.Context, cfg *config.Config) (string, string, error) {
+	info := backend.Detect(cfg)
+	if !info.HypervisorSupported {
+		return "", "Run the agent on a Mac with hardware virtualization support (kern.hv_support = 1)", fmt.Errorf("host does not support virtualization")
+	}
+	if info.SelectedBackend == "" {
+		reasons := make([]string, 0, len(info.Backends))
+		fix := "" // That of the most preferred backend
+		for _, status := range info.Backends {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", status.Name, status.Reason))
+			if fix == "" {
+				fix = status.Fix
+			}
+		}
+		if fix == "" {
+			fix = "Install tart (brew install cirruslabs/cli/tart) where the agent's PATH finds it, or fix --backend"
+		}
+		return "", fix, fmt.Errorf("no usable VM backend (%s)", strings.Join(reasons, "; "))
+	}
+	for _, status := range info.Backends {
+		if status.Name == info.SelectedBackend {
+			return fmt.Sprintf("%s %s at %s", status.Name, status.Version, status.Path), "", nil
+		}
+	}
+	return info.SelectedBackend, "", nil
+}
+
+// checkDirectories verifies the agent can write to the directories it keeps data in.
+func checkDirectories(ctx context.Context, cfg *config.Config) (string, string, error) {
+	var failed []string
+	dirs := []string{cfg.ImageCacheDir, cfg.VMsDir, cfg.StateDir}
+	for _, dir := range dirs {
+		if err := Writable(dir); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return "", "Create the directories and give them to the agent's user, e.g. sudo mkdir -p <dir> && sudo chown $(whoami) <dir>", fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return strings.Join(dirs, ", ") + " are writable", "", nil
+}
+
+// Writable reports why dir can't be written to, creating it if it doesn't exist.
+func Writable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create %s: %w", dir, err)
+	}
+	file, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return fmt.Errorf("cannot write to %s: %w", dir, err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	return nil
+}
+
+// checkSSHKey verifies the key used to log into VMs exists, parses and is private.
+func checkSSHKey(ctx context.Context, cfg *config.Config) (string, string, error) {
+	fix := fmt.Sprintf("Install the private key matching the VM images' authorized_keys at %s with mode 0600, or set --vm-ssh-key-path", cfg.VMSSHKeyPath)
+	info, err := os.Stat(cfg.VMSSHKeyPath)
+	if err != nil {
+		return "", fix, fmt.Errorf("VM SSH key: %w", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Sprintf("chmod 600 %s", cfg.VMSSHKeyPath), fmt.Errorf("VM SSH key %s is accessible by other users (mode %04o)", cfg.VMSSHKeyPath, info.Mode().Perm())
+	}
+	key, err := os.ReadFile(cfg.VMSSHKeyPath)
+	if err != nil {
+		return "", fix, fmt.Errorf("VM SSH key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return "", fix, fmt.Errorf("failed to parse VM SSH key %s: %w", cfg.VMSSHKeyPath, err)
+	}
+	return fmt.Sprintf("%s key at %s", signer.PublicKey().Type(), cfg.VMSSHKeyPath), "", nil
+}
+
+// checkRunnerScript verifies the runner install script template is in place.
+func checkRunnerScript(ctx context.Context, cfg *config.Config) (string, string, error) {
+	if _, err := os.Stat(cfg.RunnerScriptPath); err != nil {
+		return "", fmt.Sprintf("Copy scripts/install_github_runner.sh to %s, or set --runner-script-path", cfg.RunnerScriptPath), fmt.Errorf("runner script: %w", err)
+	}
+	return cfg.RunnerScriptPath, "", nil
+}
+
+// checkGCS verifies the GCS credentials are valid and can read the image bucket.
+func checkGCS(ctx context.Context, cfg *config.Config) (string, string, error) {
+	var opts []option.ClientOption
+	credentials := "application default credentials"
+	if cfg.GCPCredentialsPath != "" {
+		opts = append(opts, option.WithCredentialsFile(cfg.GCPCredentialsPath))
+		credentials = cfg.GCPCredentialsPath
+	}
+	fix := "Point MACVMORX_GCP_CREDENTIALS_PATH at a service account key with storage.objects.get and storage.objects.list on the image bucket"
+
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return "", fix, fmt.Errorf("failed to create GCS client with %s: %w", credentials, err)
+	}
+	defer client.Close()
+
+	// Listing a single object proves both the credentials and read access.
+	it := client.Bucket(cfg.GCSBucketName).Objects(ctx, nil)
+	it.PageInfo().MaxSize = 1
+	if _, err := it.Next(); err != nil && err != iterator.Done {
+		return "", fix, fmt.Errorf("cannot list gs://%s with %s: %w", cfg.GCSBucketName, credentials, err)
+	}
+	return fmt.Sprintf("gs://%s readable with %s", cfg.GCSBucketName, credentials), "", nil
+}
+
+// checkOrchestrator verifies the orchestrator answers HTTP requests. Any
+// response counts, since only reachability is in question.
+func checkOrchestrator(ctx context.Context, cfg *config.Config) (string, string, error) {
+	fix := "Check --orchestrator-url and that the node's network and firewall allow connections to it"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.OrchestratorURL, nil)
+	if err != nil {
+		return "", fix, fmt.Errorf("invalid orchestrator URL %s: %w", cfg.OrchestratorURL, err)
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fix, fmt.Errorf("orchestrator %s is unreachable: %w", cfg.OrchestratorURL, err)
+	}
+	resp.Body.Close()
+	return fmt.Sprintf("%s answered %s in %s", cfg.OrchestratorURL, resp.Status, time.Since(start).Round(time.Millisecond)), "", nil
+}
@@ -0,0 +1,59 @@
+package events
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/orchestrator"
+	"github.com/changty97/macvmagt/internal/requestid"
+)
+
+// Emitter delivers node events (alerts, state changes) to the orchestrator,
+// and lifecycle events to the configured webhooks.
+type Emitter struct {
+	cfg          *config.Config
+	orchestrator *orchestrator.Client
+	webhooks     *http.Client
+	webhookKey   []byte // Key webhook deliveries are signed with; nil disables webhooks
+}
+
+// NewEmitter creates a new event Emitter.
+func NewEmitter(cfg *config.Config, oc *orchestrator.Client) *Emitter {
+	return &Emitter{cfg: cfg, orchestrator: oc, webhooks: &http.Client{Timeout: webhookTimeout}}
+}
+
+// Emit sends an event to the orchestrator and the webhooks subscribed to its
+// type. Delivery is best effort: failures are logged.
+func (e *Emitter) Emit(eventType, message string, details map[string]string) {
+	e.EmitContext(context.Background(), eventType, message, details)
+}
+
+// EmitContext is like Emit, for an event belonging to the command whose
+// request ID ctx carries.
+func (e *Emitter) EmitContext(ctx context.Context, eventType, message string, details map[string]string) {
+	event := models.NodeEvent{
+		NodeID:    e.cfg.NodeID,
+		Type:      eventType,
+		Message:   message,
+		Details:   details,
+		RequestID: requestid.FromContext(ctx),
+		Timestamp: time.Now().UTC(),
+	}
+	log.Printf("Event %s: %s%s", eventType, message, requestid.LogSuffix(ctx))
+	e.notifyWebhooks(event)
+
+	resp, err := e.orchestrator.PostContext(ctx, "/api/events", event)
+	if err != nil {
+		log.Printf("Error sending event %s to orchestrator: %v", eventType, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Received non-OK response for event %s: %s", eventType, resp.Status)
+	}
+}
@@ -0,0 +1,92 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/utils"
+	"github.com/changty97/macvmagt/internal/version"
+)
+
+// Headers of webhook deliveries. The signature is the hex HMAC-SHA256 of the
+// request body keyed with the webhook secret, as sha256=<hex>.
+const (
+	HeaderWebhookEvent     = "X-Macvmagt-Event"
+	HeaderWebhookSignature = "X-Macvmagt-Signature"
+)
+
+// webhookTimeout bounds a single webhook delivery.
+const webhookTimeout = 10 * time.Second
+
+// SetWebhookKey sets the key webhook deliveries are signed with. Events are
+// only delivered to the configured webhooks once it is set.
+func (e *Emitter) SetWebhookKey(key string) {
+	e.webhookKey = []byte(key)
+}
+
+// Sign returns the signature of a webhook body with key, as sent in
+// HeaderWebhookSignature.
+func Sign(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhooks delivers an event to every configured webhook in the
+// background, if its type is one of WebhookEvents.
+func (e *Emitter) notifyWebhooks(event models.NodeEvent) {
+	if len(e.cfg.WebhookURLs) == 0 || len(e.webhookKey) == 0 {
+		return
+	}
+	if len(e.cfg.WebhookEvents) > 0 && !slices.Contains(e.cfg.WebhookEvents, event.Type) {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding event %s for webhooks: %v", event.Type, err)
+		return
+	}
+	signature := Sign(e.webhookKey, body)
+	for _, url := range e.cfg.WebhookURLs {
+		go func() {
+			defer utils.Recover("webhook delivery of event " + event.Type)
+			e.deliverWebhook(url, event.Type, body, signature)
+		}()
+	}
+}
+
+// deliverWebhook posts a signed event to a webhook. Delivery is best effort:
+// failures are logged and not retried.
+func (e *Emitter) deliverWebhook(url, eventType string, body []byte, signature string) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error creating webhook request for event %s to %s: %v", eventType, url, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	userAgent := e.cfg.UserAgent
+	if userAgent == "" {
+		userAgent = "macvmagt/" + version.Version
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(HeaderWebhookEvent, eventType)
+	req.Header.Set(HeaderWebhookSignature, signature)
+
+	resp, err := e.webhooks.Do(req)
+	if err != nil {
+		log.Printf("Error delivering event %s to webhook %s: %v", eventType, url, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("Webhook %s rejected event %s: %s", url, eventType, resp.Status)
+	}
+}
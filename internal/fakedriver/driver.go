@@ -0,0 +1,260 @@
+// Package fakedriver simulates tart and the VMs it runs, so the agent can be
+// driven end to end on hosts without Apple hardware, e.g. an orchestrator's
+// Linux CI. Each booted VM is a stub sleep process with a made-up IP address
+// and an in-process SSH server that answers the agent's commands.
+package fakedriver
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/paths"
+	"github.com/changty97/macvmagt/internal/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// Name is the --driver value that selects the fake driver.
+const Name = "fake"
+
+// fakeTartHome is the TART_HOME of the simulated VMs' bundles, under the
+// data root.
+const fakeTartHome = "fake-tart"
+
+// fakeTartConfig is the config.json of a new simulated VM's bundle, as tart
+// writes it for a macOS VM.
+const fakeTartConfig = `{"version":1,"os":"darwin","arch":"arm64","cpuCountMin":2,"cpuCount":4,"memorySizeMin":4294967296,"memorySize":8589934592,"display":{"width":1024,"height":768}}`
+
+// Canned host details, so capacity reports look like a Mac's.
+const (
+	fakeMemoryBytes = 64 << 30
+	fakeOSVersion   = "15.1"
+	fakeTopOutput   = "CPU usage: 12.50% user, 6.25% sys, 81.25% idle\n"
+	fakeVMStat      = "Mach Virtual Memory Statistics: (page size of 4096 bytes)\nPages active:                          1048576.\nPages wired down:                       524288.\n"
+	fakeThermal     = "Current pressure level: Nominal\n"
+	fakeEntitlement = `<?xml version="1.0" encoding="UTF-8"?><plist version="1.0"><dict><key>com.apple.security.virtualization</key><true/></dict></plist>`
+)
+
+// Driver is a utils.CommandRunner that answers tart commands, and the host
+// tools the agent reads the Mac's details with, from simulated VMs. Other
+// commands, such as df, run on the host. VMs are the directories in VMsDir,
+// each with a tart bundle holding the config.json the agent sets their
+// hardware in, created as the agent copies the VM's disk. One that never
+// booted boots when its IP address or guest agent is first asked for. The
+// driver keeps its VMs in memory, so after an agent restart they boot again
+// that way.
+type Driver struct {
+	cfg       *config.Config
+	layout    *paths.Layout
+	next      utils.CommandRunner // Runs the commands the driver doesn't simulate
+	sshConfig *ssh.ServerConfig   // Of every VM's SSH server
+	hostKey   ssh.PublicKey       // Shared by every VM, as captured with `tart exec`
+	mu        sync.Mutex          // Protects vms and leases
+	vms       map[string]*vm      // Keyed by VM name
+	leases    int                 // IP addresses handed out so far
+	booted    time.Time           // When the simulated host booted: when the driver was created
+}
+
+// New creates a Driver for the VMs in cfg's VMsDir. It creates the SSH key
+// the agent logs into VMs with if there is none, since the simulated VMs
+// accept any key.
+func New(cfg *config.Config) (*Driver, error) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate SSH host key: %w", err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate SSH host key: %w", err)
+	}
+	if err := ensureSSHKey(cfg.VMSSHKeyPath); err != nil {
+		return nil, err
+	}
+	// The agent finds tart's bundles through TART_HOME; the simulated ones
+	// are kept apart from any real tart's.
+	if err := os.Setenv("TART_HOME", filepath.Join(cfg.DataRoot, fakeTartHome)); err != nil {
+		return nil, err
+	}
+
+	sshConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	sshConfig.AddHostKey(signer)
+	return &Driver{
+		cfg:       cfg,
+		layout:    paths.New(cfg.VMsDir),
+		next:      utils.ExecRunner{},
+		sshConfig: sshConfig,
+		hostKey:   signer.PublicKey(),
+		vms:       make(map[string]*vm),
+		booted:    time.Now(),
+	}, nil
+}
+
+// ensureSSHKey writes a new ed25519 private key to path if nothing is there.
+func ensureSSHKey(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate SSH key: %w", err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "macvmagt fake driver")
+	if err != nil {
+		return fmt.Errorf("failed to encode SSH key: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create SSH key directory: %w", err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return fmt.Errorf("failed to write SSH key %s: %w", path, err)
+	}
+	log.Printf("Created SSH key %s for the VMs of the fake driver", path)
+	return nil
+}
+
+// Run answers tart and the host tools it simulates, and runs other commands.
+func (d *Driver) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var output string
+	var err error
+	switch filepath.Base(name) {
+	case "tart":
+		output, err = d.tart(ctx, args)
+	case "cp":
+		return d.cp(ctx, args)
+	case "codesign":
+		if len(args) == 0 || filepath.Base(args[len(args)-1]) != "tart" {
+			return d.next.Run(ctx, name, args...)
+		}
+		output = fakeEntitlement
+	case "pgrep":
+		// The process hosting a VM, looked up as "tart run .*<vm>$".
+		if len(args) != 2 || args[0] != "-f" || !strings.HasPrefix(args[1], "tart run ") {
+			return d.next.Run(ctx, name, args...)
+		}
+		output, err = d.pgrep(strings.TrimSuffix(strings.TrimPrefix(args[1], "tart run .*"), "$"))
+	case "sysctl":
+		switch strings.Join(args, " ") {
+		case "-n kern.hv_support", "-n hw.optional.arm64":
+			output = "1\n"
+		case "-n hw.memsize":
+			output = fmt.Sprintf("%d\n", fakeMemoryBytes)
+		case "-n kern.boottime":
+			output = fmt.Sprintf("{ sec = %d, usec = 0 } %s\n", d.booted.Unix(), d.booted.Format(time.ANSIC))
+		default:
+			return d.next.Run(ctx, name, args...)
+		}
+	case "shutdown":
+		// Restarting the agent simulates the host coming back.
+		log.Printf("Fake driver: host shutdown %s simulated", strings.Join(args, " "))
+	case "sw_vers":
+		output = fakeOSVersion + "\n"
+	case "top":
+		output = fakeTopOutput
+	case "vm_stat":
+		output = fakeVMStat
+	case "powermetrics":
+		if !strings.Contains(strings.Join(args, " "), "--samplers thermal") {
+			return nil, fmt.Errorf("powermetrics is not simulated by the fake driver")
+		}
+		output = fakeThermal
+	default:
+		return d.next.Run(ctx, name, args...)
+	}
+	return []byte(output), err
+}
+
+// Start boots a VM for `tart run`, and starts other commands on the host.
+// nice and taskpolicy wrapping `tart run` to apply a CPU policy are dropped,
+// since the stub processes don't use the CPU. The VM's stub process stands in
+// for `tart run`: its PID is returned, and the VM stopping is its exit.
+func (d *Driver) Start(opts utils.StartOptions, name string, args ...string) (int, error) {
+	command := unwrapCPUPolicy(append([]string{name}, args...))
+	if filepath.Base(command[0]) != "tart" || len(command) < 2 || command[1] != "run" {
+		return d.next.Start(opts, name, args...)
+	}
+	vmName := command[len(command)-1]
+	if err := d.boot(vmName); err != nil {
+		opts.CloseOutput()
+		return 0, err
+	}
+	pid, down := d.process(vmName)
+	if opts.Output != nil {
+		fmt.Fprintf(opts.Output, "Fake driver: VM %s booted as process %d\n", vmName, pid)
+	}
+	go func() {
+		<-down
+		opts.Finish(nil)
+	}()
+	return pid, nil
+}
+
+// unwrapCPUPolicy returns the command wrapped by the nice and taskpolicy
+// prefixes of utils.VMLaunch.Command.
+func unwrapCPUPolicy(command []string) []string {
+	for len(command) > 0 {
+		switch filepath.Base(command[0]) {
+		case "nice":
+			command = command[min(3, len(command)):] // nice -n N
+		case "taskpolicy":
+			command = command[1:]
+			for len(command) >= 2 && strings.HasPrefix(command[0], "-") {
+				command = command[2:]
+			}
+		default:
+			return command
+		}
+	}
+	return []string{""}
+}
+
+// LookPath finds tart and codesign, and looks other executables up in PATH.
+func (d *Driver) LookPath(file string) (string, error) {
+	if file == "tart" || file == "codesign" {
+		return file, nil
+	}
+	return d.next.LookPath(file)
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// cp copies files on the host, simulating APFS clones (cp -c) with copies,
+// since Linux cp has no -c. A copy into a VM directory, i.e. of its disk,
+// adds the VM and its tart bundle, as `tart clone` would.
+func (d *Driver) cp(ctx context.Context, args []string) ([]byte, error) {
+	if len(args) > 0 && args[0] == "-c" {
+		args = args[1:]
+	}
+	output, err := d.next.Run(ctx, "cp", args...)
+	if err != nil || len(args) != 2 {
+		return output, err
+	}
+	if rel, err := filepath.Rel(d.cfg.VMsDir, args[1]); err == nil && !strings.HasPrefix(rel, "..") {
+		if name, _, nested := strings.Cut(rel, string(filepath.Separator)); nested {
+			d.mu.Lock()
+			d.lookup(name)
+			d.mu.Unlock()
+		}
+	}
+	return output, nil
+}
@@ -0,0 +1,39 @@
+package fakedriver
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Stub images stand in for the images in the bucket.
+const (
+	imageSize         = 16 << 20        // Bytes of zeros
+	imageDownloadTime = 5 * time.Second // How long downloading one takes
+	imageChunk        = 1 << 20         // Bytes written at a time
+)
+
+// ImageAttrs describes the stub image the fake driver serves for imageName,
+// as if it were stored in the bucket.
+func ImageAttrs(imageName string) *storage.ObjectAttrs {
+	return &storage.ObjectAttrs{Name: imageName, Size: imageSize, Created: time.Now().UTC(), Metadata: map[string]string{}}
+}
+
+// WriteImage "downloads" a stub image into w over imageDownloadTime.
+func WriteImage(ctx context.Context, w io.Writer) (int64, error) {
+	chunk := make([]byte, imageChunk)
+	var written int64
+	for written < imageSize {
+		if err := sleepContext(ctx, imageDownloadTime*imageChunk/imageSize); err != nil {
+			return written, err
+		}
+		n, err := w.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
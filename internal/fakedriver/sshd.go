@@ -0,0 +1,143 @@
+package fakedriver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// scriptTime is how long scripts streamed into a VM, such as the runner
+// install script, take to run.
+const scriptTime = 2 * time.Second
+
+// fakeGuestDF is the guest's `df -Pk /`, with 60 GB free.
+const fakeGuestDF = "Filesystem 1024-blocks Used Available Capacity Mounted on\n/dev/disk3s1s1 102400000 40960000 61440000 40% /\n"
+
+// Dial connects to the SSH server of the running VM with the IP address in
+// addr, for sshclient.SetDialer. Connections are refused until the VM's SSH
+// server answers.
+func (d *Driver) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	var sshd net.Listener
+	for _, v := range d.vms {
+		if v.ip == host && v.sshd != nil && time.Since(v.started) >= d.cfg.FakeBootTime+sshStartTime {
+			sshd = v.sshd
+		}
+	}
+	d.mu.Unlock()
+	if sshd == nil {
+		return nil, fmt.Errorf("dial %s %s: connection refused", network, addr)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, sshd.Addr().String())
+}
+
+// serveSSH serves the SSH connections of VM name until sshd is closed.
+// Connections are dropped when down is closed, as the VM stops.
+func (d *Driver) serveSSH(name string, sshd net.Listener, files sftp.Handlers, down <-chan struct{}) {
+	for {
+		conn, err := sshd.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			<-down
+			conn.Close()
+		}()
+		go d.serveConn(name, conn, files)
+	}
+}
+
+// serveConn serves the sessions of an SSH connection, accepting any key.
+func (d *Driver) serveConn(name string, conn net.Conn, files sftp.Handlers) {
+	defer conn.Close()
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, d.sshConfig)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are simulated")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go d.serveSession(name, channel, requests, files)
+	}
+}
+
+// serveSession answers a command run in VM name, or serves SFTP from the
+// VM's files.
+func (d *Driver) serveSession(name string, channel ssh.Channel, requests <-chan *ssh.Request, files sftp.Handlers) {
+	defer channel.Close()
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				return
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(requests) // Signals sent when the agent gives up
+			// Read all of stdin, as the command would, before answering.
+			if n, _ := io.Copy(io.Discard, channel); n > 0 {
+				time.Sleep(scriptTime)
+			}
+			output, status := d.guestCommand(name, payload.Command)
+			io.WriteString(channel, output)
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+			server := sftp.NewRequestServer(channel, files)
+			server.Serve()
+			server.Close()
+			return
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// guestCommand answers a command run in VM name. The commands whose output
+// the agent parses get a plausible one; every other command succeeds without
+// output, as if the guest ran it, so runners always look up, busy and
+// registered.
+func (d *Driver) guestCommand(name, command string) (string, uint32) {
+	switch {
+	case command == "echo ok":
+		return "ok\n", 0
+	case command == "date +%s":
+		return fmt.Sprintf("%d\n", time.Now().Unix()), 0
+	case command == "df -Pk /":
+		return fakeGuestDF, 0
+	case strings.HasSuffix(command, "./svc.sh status"):
+		return "Started:\n", 0
+	case strings.HasSuffix(command, "/.runner'"):
+		return fmt.Sprintf("\ufeff{\"agentId\":1,\"agentName\":\"macvmorx-runner-%s-%s\"}", d.cfg.NodeID, name), 0
+	}
+	return "", 0
+}
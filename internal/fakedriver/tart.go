@@ -0,0 +1,341 @@
+package fakedriver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/utils"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshStartTime is how long the SSH server of a VM takes to answer once the
+// VM has an IP address.
+const sshStartTime = 3 * time.Second
+
+// stubSeconds is how long a VM's stub process sleeps, i.e. forever.
+const stubSeconds = "2147483647"
+
+// States of a simulated VM, as `tart list` reports them.
+const (
+	stateRunning   = "running"
+	stateStopped   = "stopped"
+	stateSuspended = "suspended"
+)
+
+// vm is a simulated VM.
+type vm struct {
+	state   string
+	ip      string        // Made up when the VM first boots and kept, like a DHCP lease
+	started time.Time     // When the VM last booted
+	stub    *exec.Cmd     // Sleeps in place of `tart run` while the VM runs
+	sshd    net.Listener  // SSH server of a running VM, on the loopback interface
+	down    chan struct{} // Closed when a running VM stops, dropping its SSH connections
+	files   sftp.Handlers // The VM's files, which survive reboots
+}
+
+// tart answers a tart command.
+func (d *Driver) tart(ctx context.Context, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("tart: missing subcommand")
+	}
+	switch {
+	case args[0] == "--version":
+		return "fake\n", nil
+	case args[0] == "list":
+		return d.list()
+	case args[0] == "ip" && len(args) >= 2:
+		var wait time.Duration
+		if len(args) == 4 && args[2] == "--wait" {
+			seconds, err := strconv.Atoi(args[3])
+			if err != nil {
+				return "", fmt.Errorf("tart ip: invalid --wait %q", args[3])
+			}
+			wait = time.Duration(seconds) * time.Second
+		}
+		return d.ip(ctx, args[1], wait)
+	case args[0] == "exec" && len(args) >= 3:
+		return d.exec(ctx, args[1], args[2:])
+	case args[0] == "run" && len(args) >= 2:
+		return "", d.boot(args[len(args)-1])
+	case args[0] == "stop" && len(args) == 2:
+		return "", d.stop(args[1], stateStopped)
+	case args[0] == "suspend" && len(args) == 2:
+		return "", d.stop(args[1], stateSuspended)
+	case args[0] == "delete" && len(args) == 2:
+		return "", d.delete(args[1])
+	case args[0] == "rename" && len(args) == 3:
+		return "", d.rename(args[1], args[2])
+	}
+	return "", fmt.Errorf("tart %s is not simulated by the fake driver", strings.Join(args, " "))
+}
+
+// lookup returns a VM, adding the VM directories in VMsDir the driver hasn't
+// seen yet as stopped VMs. Callers must hold d.mu.
+func (d *Driver) lookup(name string) (*vm, bool) {
+	if v, ok := d.vms[name]; ok {
+		return v, true
+	}
+	if _, err := os.Stat(d.layout.VMDir(name)); err != nil {
+		return nil, false
+	}
+	v := &vm{state: stateStopped, files: sftp.InMemHandler()}
+	for _, dir := range []string{"/tmp", "/Users", "/Users/" + d.cfg.VMSSHUser} {
+		v.files.FileCmd.Filecmd(sftp.NewRequest("Mkdir", dir))
+	}
+	if err := writeBundle(name); err != nil {
+		log.Printf("Fake driver: %v", err)
+	}
+	d.vms[name] = v
+	return v, true
+}
+
+// writeBundle creates the tart bundle of VM name, unless it has one.
+func writeBundle(name string) error {
+	dir, err := utils.TartVMDir(name)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "config.json")
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create tart bundle of VM %s: %w", name, err)
+	}
+	if err := os.WriteFile(path, []byte(fakeTartConfig), 0644); err != nil {
+		return fmt.Errorf("failed to create tart bundle of VM %s: %w", name, err)
+	}
+	return nil
+}
+
+// list answers `tart list`, in the JSON format of --format json.
+func (d *Driver) list() (string, error) {
+	names, err := d.layout.List()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) { // Created once the agent set up its layout
+		return "", err
+	}
+	d.mu.Lock()
+	for _, name := range names {
+		d.lookup(name)
+	}
+	type entry struct {
+		Name  string `json:"name"`
+		State string `json:"state"`
+	}
+	entries := make([]entry, 0, len(d.vms))
+	for name, v := range d.vms {
+		entries = append(entries, entry{Name: name, State: v.state})
+	}
+	d.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	data, err := json.Marshal(entries)
+	return string(data), err
+}
+
+// ip answers `tart ip`: it waits up to wait for the VM to have booted for
+// FakeBootTime. A VM that never booted boots now.
+func (d *Driver) ip(ctx context.Context, name string, wait time.Duration) (string, error) {
+	ip, ready, err := d.bootedAt(name)
+	if err != nil {
+		return "", err
+	}
+	if remaining := time.Until(ready); remaining > 0 {
+		if remaining > wait {
+			sleepContext(ctx, wait)
+			return "", fmt.Errorf("no IP address found for VM %s, is it running?", name)
+		}
+		if err := sleepContext(ctx, remaining); err != nil {
+			return "", err
+		}
+	}
+	return ip + "\n", nil
+}
+
+// exec answers `tart exec`. The guest agent answers once the VM has booted;
+// only reading the SSH host key with cat is simulated.
+func (d *Driver) exec(ctx context.Context, name string, command []string) (string, error) {
+	_, ready, err := d.bootedAt(name)
+	if err != nil {
+		return "", err
+	}
+	if err := sleepContext(ctx, time.Until(ready)); err != nil {
+		return "", err
+	}
+	if command[0] != "cat" {
+		return "", nil
+	}
+	return string(ssh.MarshalAuthorizedKey(d.hostKey)), nil
+}
+
+// bootedAt returns the IP address of a running VM and when it gets it,
+// booting a VM that never booted.
+func (d *Driver) bootedAt(name string) (string, time.Time, error) {
+	d.mu.Lock()
+	v, ok := d.lookup(name)
+	fresh := ok && v.started.IsZero()
+	d.mu.Unlock()
+	if fresh {
+		if err := d.boot(name); err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok = d.vms[name]
+	if !ok || v.state != stateRunning {
+		return "", time.Time{}, fmt.Errorf("VM %s is not running", name)
+	}
+	return v.ip, v.started.Add(d.cfg.FakeBootTime), nil
+}
+
+// boot starts a VM: its stub process and its SSH server, which answers from
+// FakeBootTime plus sshStartTime on. Booting a running VM does nothing.
+func (d *Driver) boot(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.lookup(name)
+	if !ok {
+		return fmt.Errorf("the specified VM %q does not exist", name)
+	}
+	if v.state == stateRunning {
+		return nil
+	}
+
+	sshd, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to start SSH server of VM %s: %w", name, err)
+	}
+	stub := exec.Command("sleep", stubSeconds)
+	if err := stub.Start(); err != nil {
+		sshd.Close()
+		return fmt.Errorf("failed to start stub process of VM %s: %w", name, err)
+	}
+	if v.ip == "" {
+		v.ip = fmt.Sprintf("192.168.64.%d", 2+d.leases%253)
+		d.leases++
+	}
+	v.state, v.started, v.stub, v.sshd, v.down = stateRunning, time.Now(), stub, sshd, make(chan struct{})
+	go d.serveSSH(name, sshd, v.files, v.down)
+	go d.watch(name, v, stub)
+	log.Printf("Fake driver: VM %s booting as process %d with IP address %s", name, stub.Process.Pid, v.ip)
+	return nil
+}
+
+// watch stops a VM once its stub process exits, so killing the stub
+// simulates a VM crashing.
+func (d *Driver) watch(name string, v *vm, stub *exec.Cmd) {
+	stub.Wait()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if v.stub == stub {
+		log.Printf("Fake driver: stub process of VM %s exited, VM stopped", name)
+		d.halt(v, stateStopped)
+	}
+}
+
+// stop stops or suspends a VM. Stopping a VM that isn't running does nothing.
+func (d *Driver) stop(name, state string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.lookup(name)
+	if !ok {
+		return fmt.Errorf("the specified VM %q does not exist", name)
+	}
+	if state == stateSuspended && v.state != stateRunning {
+		return fmt.Errorf("VM %s is not running", name)
+	}
+	if v.state == stateRunning {
+		d.halt(v, state)
+	}
+	return nil
+}
+
+// halt kills a running VM's stub process and SSH server and leaves it in
+// state. Callers must hold d.mu.
+func (d *Driver) halt(v *vm, state string) {
+	if v.stub != nil {
+		v.stub.Process.Kill()
+		v.stub = nil
+	}
+	if v.sshd != nil {
+		v.sshd.Close()
+		close(v.down)
+		v.sshd = nil
+	}
+	v.state = state
+}
+
+// delete stops a VM and forgets it. Its directory is the agent's to remove.
+func (d *Driver) delete(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.lookup(name)
+	if !ok {
+		return fmt.Errorf("the specified VM %q does not exist", name)
+	}
+	d.halt(v, stateStopped)
+	delete(d.vms, name)
+	if dir, err := utils.TartVMDir(name); err == nil {
+		os.RemoveAll(dir)
+	}
+	return nil
+}
+
+// rename gives a VM a new name.
+func (d *Driver) rename(name, newName string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.lookup(name)
+	if !ok {
+		return fmt.Errorf("the specified VM %q does not exist", name)
+	}
+	if _, taken := d.vms[newName]; taken {
+		return fmt.Errorf("VM %q already exists", newName)
+	}
+	delete(d.vms, name)
+	d.vms[newName] = v
+	dir, _ := utils.TartVMDir(name)
+	newDir, err := utils.TartVMDir(newName)
+	if err == nil {
+		os.Rename(dir, newDir) // TART_HOME is set, so neither lookup fails
+	}
+	return nil
+}
+
+// process returns the PID of a running VM's stub process and a channel that
+// is closed once the VM stops.
+func (d *Driver) process(name string) (int, <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.lookup(name)
+	if !ok || v.stub == nil {
+		down := make(chan struct{})
+		close(down)
+		return 0, down
+	}
+	return v.stub.Process.Pid, v.down
+}
+
+// pgrep answers the lookup of the process hosting a running VM.
+func (d *Driver) pgrep(name string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.vms[name]
+	if !ok || v.stub == nil {
+		return "", fmt.Errorf("exit status 1")
+	}
+	return fmt.Sprintf("%d\n", v.stub.Process.Pid), nil
+}
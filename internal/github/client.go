@@ -0,0 +1,343 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+)
+
+// Client talks to the GitHub REST API on behalf of a GitHub App installation.
+type Client struct {
+	cfg        *config.Config
+	httpClient *http.Client
+	appKey     *rsa.PrivateKey // nil when no App credentials are configured
+
+	mu          sync.Mutex // Protects the cached installation token
+	token       string
+	tokenExpiry time.Time
+}
+
+// NewClient creates a GitHub client. App credentials are optional; without them
+// callers must supply an installation token with every request.
+func NewClient(cfg *config.Config) (*Client, error) {
+	c := &Client{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+
+	if cfg.GitHubAppPrivateKeyPath != "" {
+		key, err := loadPrivateKey(cfg.GitHubAppPrivateKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		c.appKey = key
+	}
+	return c, nil
+}
+
+// loadPrivateKey reads a GitHub App private key in PKCS#1 or PKCS#8 PEM format.
+func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GitHub App private key %s: %w", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in GitHub App private key %s", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse GitHub App private key %s: %w", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("GitHub App private key %s is not an RSA key", path)
+	}
+	return key, nil
+}
+
+// HasAppCredentials reports whether the agent can mint its own installation tokens.
+func (c *Client) HasAppCredentials() bool {
+	return c.appKey != nil && c.cfg.GitHubAppID != 0 && c.cfg.GitHubAppInstallationID != 0
+}
+
+// appJWT builds the short-lived RS256 JWT used to authenticate as the GitHub App.
+func (c *Client) appJWT() (string, error) {
+	now := time.Now()
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	claims := map[string]interface{}{
+		"iat": now.Add(-60 * time.Second).Unix(), // Allow for clock drift
+		"exp": now.Add(9 * time.Minute).Unix(),   // GitHub caps App JWTs at 10 minutes
+		"iss": strconv.Itoa(c.cfg.GitHubAppID),
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.appKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign GitHub App JWT: %w", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// InstallationToken returns a cached installation token, minting a new one when it is close to expiry.
+func (c *Client) InstallationToken(ctx context.Context) (string, error) {
+	if !c.HasAppCredentials() {
+		return "", fmt.Errorf("GitHub App credentials are not configured")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Until(c.tokenExpiry) > 5*time.Minute {
+		return c.token, nil
+	}
+
+	jwt, err := c.appJWT()
+	if err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	path := fmt.Sprintf("/app/installations/%d/access_tokens", c.cfg.GitHubAppInstallationID)
+	if err := c.do(ctx, http.MethodPost, path, "Bearer "+jwt, nil, http.StatusCreated, &resp); err != nil {
+		return "", fmt.Errorf("failed to create installation token: %w", err)
+	}
+
+	c.token = resp.Token
+	c.tokenExpiry = resp.ExpiresAt
+	return c.token, nil
+}
+
+// JITConfigRequest describes the runner to register just in time.
+type JITConfigRequest struct {
+	Org         string
+	Repo        string // Empty for an organization-level runner
+	RunnerName  string
+	RunnerGroup string // Runner group name (organization-level only); empty for the default group
+	Labels      []string
+}
+
+// GenerateJITConfig registers a just-in-time runner and returns its encoded config,
+// which the runner consumes with `run.sh --jitconfig`. If token is empty an
+// installation token is minted from the App credentials.
+func (c *Client) GenerateJITConfig(ctx context.Context, token string, req JITConfigRequest) (string, error) {
+	auth, err := c.auth(ctx, token)
+	if err != nil {
+		return "", err
+	}
+
+	groupID := int64(1) // The "Default" runner group
+	if req.RunnerGroup != "" && req.Repo == "" {
+		id, err := c.runnerGroupID(ctx, auth, req.Org, req.RunnerGroup)
+		if err != nil {
+			return "", err
+		}
+		groupID = id
+	}
+
+	body := map[string]interface{}{
+		"name":            req.RunnerName,
+		"runner_group_id": groupID,
+		"labels":          req.Labels,
+		"work_folder":     "_work",
+	}
+
+	path := runnersPath(req.Org, req.Repo) + "/generate-jitconfig"
+
+	var resp struct {
+		EncodedJITConfig string `json:"encoded_jit_config"`
+	}
+	if err := c.do(ctx, http.MethodPost, path, auth, body, http.StatusCreated, &resp); err != nil {
+		return "", fmt.Errorf("failed to generate JIT config for runner %s: %w", req.RunnerName, err)
+	}
+	if resp.EncodedJITConfig == "" {
+		return "", fmt.Errorf("GitHub returned an empty JIT config for runner %s", req.RunnerName)
+	}
+	return resp.EncodedJITConfig, nil
+}
+
+// DeleteRunner removes the registration of the runner named name from an
+// organization, or a repository if repo isn't empty. A runner that isn't
+// registered, e.g. an ephemeral one that already finished its job, is not an
+// error. If token is empty an installation token is minted from the App
+// credentials.
+func (c *Client) DeleteRunner(ctx context.Context, token, org, repo, name string) error {
+	auth, err := c.auth(ctx, token)
+	if err != nil {
+		return err
+	}
+	base := runnersPath(org, repo)
+	runner, err := c.findRunner(ctx, auth, base, name)
+	if err != nil || runner == nil {
+		return err
+	}
+	if err := c.do(ctx, http.MethodDelete, fmt.Sprintf("%s/%d", base, runner.ID), auth, nil, http.StatusNoContent, nil); err != nil {
+		return fmt.Errorf("failed to delete runner %s: %w", name, err)
+	}
+	return nil
+}
+
+// Runner is a self-hosted runner as GitHub lists it.
+type Runner struct {
+	ID     int64
+	Name   string
+	Status string // "online" or "offline"
+	Busy   bool
+	Labels []string // Including the default ones, such as self-hosted and macOS
+}
+
+// FindRunner returns the runner named name of an organization, or a
+// repository if repo isn't empty, or nil if no such runner is registered. If
+// token is empty an installation token is minted from the App credentials.
+func (c *Client) FindRunner(ctx context.Context, token, org, repo, name string) (*Runner, error) {
+	auth, err := c.auth(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return c.findRunner(ctx, auth, runnersPath(org, repo), name)
+}
+
+// findRunner looks up the runner named name under base, the runners path of
+// an organization or repository.
+func (c *Client) findRunner(ctx context.Context, auth, base, name string) (*Runner, error) {
+	var resp struct {
+		Runners []struct {
+			ID     int64  `json:"id"`
+			Name   string `json:"name"`
+			Status string `json:"status"`
+			Busy   bool   `json:"busy"`
+			Labels []struct {
+				Name string `json:"name"`
+			} `json:"labels"`
+		} `json:"runners"`
+	}
+	if err := c.do(ctx, http.MethodGet, base+"?name="+url.QueryEscape(name), auth, nil, http.StatusOK, &resp); err != nil {
+		return nil, fmt.Errorf("failed to look up runner %s: %w", name, err)
+	}
+	for _, runner := range resp.Runners {
+		if runner.Name != name {
+			continue
+		}
+		found := &Runner{ID: runner.ID, Name: runner.Name, Status: runner.Status, Busy: runner.Busy}
+		for _, label := range runner.Labels {
+			found.Labels = append(found.Labels, label.Name)
+		}
+		return found, nil
+	}
+	return nil, nil
+}
+
+// runnersPath returns the API path of the runners of an organization, or a
+// repository if repo isn't empty.
+func runnersPath(org, repo string) string {
+	if repo != "" {
+		return fmt.Sprintf("/repos/%s/%s/actions/runners", url.PathEscape(org), url.PathEscape(repo))
+	}
+	return fmt.Sprintf("/orgs/%s/actions/runners", url.PathEscape(org))
+}
+
+// auth returns the Authorization header for token, or for an installation
+// token minted from the App credentials if token is empty.
+func (c *Client) auth(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		var err error
+		token, err = c.InstallationToken(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+	return "Bearer " + token, nil
+}
+
+// runnerGroupID resolves an organization runner group name to its ID.
+func (c *Client) runnerGroupID(ctx context.Context, auth, org, name string) (int64, error) {
+	var resp struct {
+		RunnerGroups []struct {
+			ID   int64  `json:"id"`
+			Name string `json:"name"`
+		} `json:"runner_groups"`
+	}
+	path := fmt.Sprintf("/orgs/%s/actions/runner-groups?per_page=100", url.PathEscape(org))
+	if err := c.do(ctx, http.MethodGet, path, auth, nil, http.StatusOK, &resp); err != nil {
+		return 0, fmt.Errorf("failed to list runner groups for %s: %w", org, err)
+	}
+	for _, group := range resp.RunnerGroups {
+		if group.Name == name {
+			return group.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("runner group %q not found in organization %s", name, org)
+}
+
+// do performs a GitHub API request and decodes the JSON response into out.
+func (c *Client) do(ctx context.Context, method, path, auth string, body interface{}, wantStatus int, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request body: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.cfg.GitHubAPIURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	req.Header.Set("Authorization", auth)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != wantStatus {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode response from %s: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package heartbeat
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// Bounds of the heartbeat interval set-interval commands may set.
+const (
+	minCommandInterval = 5 * time.Second
+	maxCommandInterval = time.Hour
+)
+
+// maxRememberedCommands bounds the command IDs remembered to skip commands
+// the orchestrator sends again before it saw their results.
+const maxRememberedCommands = 256
+
+// CommandHandler runs a command from a heartbeat response. Commands that take
+// long, such as deletes and prefetches, are started and the handler returns
+// whether they were accepted.
+type CommandHandler func(cmd models.HeartbeatCommand) error
+
+// SetCommandHandler makes heartbeats offer the commands the agent runs from
+// heartbeat responses, so orchestrators can drive nodes they can't send
+// requests to. The sender handles set-interval itself and passes the other
+// commands to handle.
+func (s *Sender) SetCommandHandler(handle CommandHandler) {
+	s.handleCommand = handle
+}
+
+// supportedCommands returns the command types heartbeats offer, or nil if
+// the agent doesn't take commands from heartbeat responses.
+func (s *Sender) supportedCommands() []string {
+	if s.handleCommand == nil {
+		return nil
+	}
+	return []string{
+		models.HeartbeatCordon,
+		models.HeartbeatUncordon,
+		models.HeartbeatPrefetchImage,
+		models.HeartbeatSetInterval,
+		models.HeartbeatDeleteVM,
+	}
+}
+
+// runCommands runs the commands of a heartbeat response in order and queues
+// their results for the next heartbeat. Commands whose ID already ran are
+// skipped.
+func (s *Sender) runCommands(commands []models.HeartbeatCommand) {
+	if s.handleCommand == nil {
+		if len(commands) > 0 {
+			log.Printf("Warning: Ignoring %d commands in heartbeat response, heartbeat commands are disabled", len(commands))
+		}
+		return
+	}
+	for _, cmd := range commands {
+		if cmd.ID == "" {
+			log.Printf("Warning: Ignoring %s command without an ID in heartbeat response", cmd.Type)
+			continue
+		}
+		if s.ranCommands[cmd.ID] {
+			continue
+		}
+		s.rememberCommand(cmd.ID)
+
+		log.Printf("Running %s command %s from heartbeat response", cmd.Type, cmd.ID)
+		var err error
+		if cmd.Type == models.HeartbeatSetInterval {
+			err = s.setInterval(cmd.IntervalSeconds)
+		} else {
+			err = s.handleCommand(cmd)
+		}
+		result := models.HeartbeatCommandResult{ID: cmd.ID, Type: cmd.Type, OK: err == nil}
+		if err != nil {
+			log.Printf("Error running %s command %s from heartbeat response: %v", cmd.Type, cmd.ID, err)
+			result.Error = err.Error()
+		}
+		s.commandResults = append(s.commandResults, result)
+	}
+}
+
+// rememberCommand records that the command with id ran, forgetting the
+// oldest IDs beyond maxRememberedCommands.
+func (s *Sender) rememberCommand(id string) {
+	if s.ranCommands == nil {
+		s.ranCommands = make(map[string]bool)
+	}
+	s.ranCommands[id] = true
+	s.ranOrder = append(s.ranOrder, id)
+	if len(s.ranOrder) > maxRememberedCommands {
+		delete(s.ranCommands, s.ranOrder[0])
+		s.ranOrder = s.ranOrder[1:]
+	}
+}
+
+// forgetCommandResults drops the first n results, which an accepted
+// heartbeat carried.
+func (s *Sender) forgetCommandResults(n int) {
+	s.commandResults = s.commandResults[n:]
+	if len(s.commandResults) == 0 {
+		s.commandResults = nil
+	}
+}
+
+// setInterval changes the heartbeat interval to seconds, or back to
+// HeartbeatInterval if seconds is 0. The heartbeat loop picks it up after
+// the current heartbeat.
+func (s *Sender) setInterval(seconds int) error {
+	if seconds == 0 {
+		s.interval = s.cfg.HeartbeatInterval
+		log.Printf("Heartbeat interval restored to %s", s.interval)
+		return nil
+	}
+	interval := time.Duration(seconds) * time.Second
+	if interval < minCommandInterval || interval > maxCommandInterval {
+		return fmt.Errorf("invalid interval %ds: expected %s to %s, or 0 for the default", seconds, minCommandInterval, maxCommandInterval)
+	}
+	s.interval = interval
+	log.Printf("Heartbeat interval set to %s", s.interval)
+	return nil
+}
@@ -0,0 +1,88 @@
+package heartbeat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"sort"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// Heartbeat protocol versions.
+const (
+	protocolFull  = 1 // Every heartbeat carries the full VM and image state
+	protocolDelta = 2 // Heartbeats carry changes against the last acknowledged state
+)
+
+// syncState is the part of a heartbeat that differential heartbeats send as
+// changes: the running VMs and the cached images with their manifest digests.
+type syncState struct {
+	VMs    map[string]models.VMInfo `json:"vms"`    // Keyed by VM ID, without per-sample fields
+	Images map[string]string        `json:"images"` // Image name to manifest digest ("" if none)
+}
+
+// newSyncState builds the state of a heartbeat. RuntimeSeconds, AgeSeconds,
+// ReadySeconds, CPUScheduling, Usage and DiskBytes change with every sample,
+// so they don't count as changes.
+func newSyncState(vms []models.VMInfo, cachedImages []string, digests map[string]string) syncState {
+	state := syncState{
+		VMs:    make(map[string]models.VMInfo, len(vms)),
+		Images: make(map[string]string, len(cachedImages)),
+	}
+	for _, vm := range vms {
+		vm.RuntimeSeconds, vm.AgeSeconds, vm.ReadySeconds = 0, 0, 0
+		vm.CPUScheduling = nil
+		vm.Usage = nil
+		vm.DiskBytes = 0
+		state.VMs[vm.VMID] = vm
+	}
+	for _, name := range cachedImages {
+		state.Images[name] = digests[name]
+	}
+	return state
+}
+
+// hash returns the SHA256 of the state's JSON encoding, in which map keys are
+// sorted, so the orchestrator can compute the same hash from its copy.
+func (s syncState) hash() string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// diff returns the changes from base to the current state. Upserted VMs are
+// sent as reported, including their per-sample fields.
+func diff(base syncState, baseHash string, current syncState, vms []models.VMInfo) *models.HeartbeatDelta {
+	delta := &models.HeartbeatDelta{BaseHash: baseHash}
+	for _, vm := range vms {
+		if previous, ok := base.VMs[vm.VMID]; !ok || !reflect.DeepEqual(previous, current.VMs[vm.VMID]) {
+			delta.VMsUpserted = append(delta.VMsUpserted, vm)
+		}
+	}
+	for vmID := range base.VMs {
+		if _, ok := current.VMs[vmID]; !ok {
+			delta.VMsRemoved = append(delta.VMsRemoved, vmID)
+		}
+	}
+	for name, digest := range current.Images {
+		if previous, ok := base.Images[name]; !ok || previous != digest {
+			if delta.ImagesUpserted == nil {
+				delta.ImagesUpserted = make(map[string]string)
+			}
+			delta.ImagesUpserted[name] = digest
+		}
+	}
+	for name := range base.Images {
+		if _, ok := current.Images[name]; !ok {
+			delta.ImagesRemoved = append(delta.ImagesRemoved, name)
+		}
+	}
+	sort.Strings(delta.VMsRemoved)
+	sort.Strings(delta.ImagesRemoved)
+	return delta
+}
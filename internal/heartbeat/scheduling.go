@@ -0,0 +1,51 @@
+package heartbeat
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// schedulingSampleMs is how long each powermetrics sample of CPU scheduling runs.
+const schedulingSampleMs = 1000
+
+// schedulingSampler samples CPU scheduling with powermetrics in the
+// background, since each sample blocks for schedulingSampleMs, and keeps the
+// last sample for heartbeats to report.
+type schedulingSampler struct {
+	mu   sync.RWMutex            // Protects last
+	last *utils.SchedulingSample // nil before the first sample and after a failed one
+}
+
+// start samples CPU scheduling right away and then every interval until the
+// process exits.
+func (s *schedulingSampler) start(interval time.Duration) {
+	s.sample()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.sample()
+	}
+}
+
+// sample samples CPU scheduling now and keeps the result. A failed sample
+// drops the previous one, so heartbeats don't keep reporting it.
+func (s *schedulingSampler) sample() {
+	sample, err := utils.SampleCPUScheduling(schedulingSampleMs)
+	if err != nil {
+		log.Printf("Error sampling CPU scheduling: %v", err)
+	}
+	s.mu.Lock()
+	s.last = sample
+	s.mu.Unlock()
+}
+
+// Last returns the last sample, or nil if there is none.
+func (s *schedulingSampler) Last() *utils.SchedulingSample {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.last
+}
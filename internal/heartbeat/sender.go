@@ -1,18 +1,27 @@
 package heartbeat
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
+	"runtime"
+	"slices"
 	"time"
 
 	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/cordon"
+	"github.com/changty97/macvmagt/internal/diskusage"
 	"github.com/changty97/macvmagt/internal/imagemgr"
+	"github.com/changty97/macvmagt/internal/maintenance"
 	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/orchestrator"
+	"github.com/changty97/macvmagt/internal/scheduler"
+	"github.com/changty97/macvmagt/internal/thermal"
+	"github.com/changty97/macvmagt/internal/utilization"
 	"github.com/changty97/macvmagt/internal/utils"
+	"github.com/changty97/macvmagt/internal/version"
 	"github.com/changty97/macvmagt/internal/vmgr"
+	"github.com/changty97/macvmagt/internal/vmrecords"
 )
 
 // Sender is responsible for collecting system info and sending heartbeats.
@@ -20,24 +29,106 @@ type Sender struct {
 	cfg          *config.Config
 	imageManager *imagemgr.Manager
 	vmManager    *vmgr.Manager
+	utilization  *utilization.Recorder
+	thermal      *thermal.Monitor
+	vmRecords    *vmrecords.Store
+	orchestrator *orchestrator.Client
+	cordon       *cordon.Store
+	nodeInfo     *models.NodeInfo
+	started      time.Time // When the agent started, for uptime
+	tlsPin       string    // Public key pin of the command server's TLS certificate; empty without TLS
+	commands     *scheduler.CommandQueue
+	maintenance  *maintenance.Scheduler
+	hostPower    *models.HostPowerAction
+	diskUsage    *diskusage.Sampler
+	scheduling   *schedulingSampler // Samples CPU scheduling in the background; nil without CoreSchedulingSampling
+
+	// Differential heartbeat state, only touched by the heartbeat loop.
+	protocol int        // Protocol the orchestrator picked; protocolFull until it picks protocolDelta
+	base     *syncState // Last state the orchestrator acknowledged; nil before the first one
+	baseHash string     // Hash of base
+	lastFull time.Time  // When the last full heartbeat was acknowledged
+	resync   bool       // The orchestrator asked for a full heartbeat
+
+	// Heartbeat command state, only touched by the heartbeat loop.
+	handleCommand  CommandHandler                  // nil when the agent takes no commands from heartbeat responses
+	interval       time.Duration                   // Current heartbeat interval, which set-interval commands change
+	ranCommands    map[string]bool                 // IDs of the commands that ran, to skip them when sent again
+	ranOrder       []string                        // ranCommands' IDs, oldest first
+	commandResults []models.HeartbeatCommandResult // Results not yet carried by an accepted heartbeat
+}
+
+// SetTLSPublicKeyPin makes heartbeats carry the public key pin of the command
+// server's certificate, so the orchestrator can pin self-signed certificates.
+// The agent loads the certificate, so it provides the pin.
+func (s *Sender) SetTLSPublicKeyPin(pin string) {
+	s.tlsPin = pin
+}
+
+// SetMaintenance makes heartbeats report the schedule and state of the
+// node's maintenance windows.
+func (s *Sender) SetMaintenance(m *maintenance.Scheduler) {
+	s.maintenance = m
+}
+
+// SetLastHostPower makes heartbeats report the reboot or shutdown the host
+// went down for before the agent started, explaining the gap in heartbeats.
+func (s *Sender) SetLastHostPower(action *models.HostPowerAction) {
+	s.hostPower = action
+}
+
+// SetDiskUsage makes heartbeats report where the node's disk space went, as
+// the sampler last measured it, and each VM's share.
+func (s *Sender) SetDiskUsage(d *diskusage.Sampler) {
+	s.diskUsage = d
+}
+
+// SetCommandQueue makes heartbeats report the depth and age of the queue VM
+// commands run from, so the orchestrator can back off a saturated node.
+func (s *Sender) SetCommandQueue(q *scheduler.CommandQueue) {
+	s.commands = q
 }
 
 // NewSender creates a new Heartbeat Sender.
-func NewSender(cfg *config.Config, im *imagemgr.Manager, vmm *vmgr.Manager) *Sender {
+func NewSender(cfg *config.Config, im *imagemgr.Manager, vmm *vmgr.Manager, ur *utilization.Recorder, tm *thermal.Monitor, rs *vmrecords.Store, oc *orchestrator.Client, cs *cordon.Store, nodeInfo *models.NodeInfo) *Sender {
+	var scheduling *schedulingSampler
+	if cfg.CoreSchedulingSampling {
+		scheduling = &schedulingSampler{}
+	}
 	return &Sender{
 		cfg:          cfg,
 		imageManager: im,
 		vmManager:    vmm,
+		utilization:  ur,
+		thermal:      tm,
+		vmRecords:    rs,
+		orchestrator: oc,
+		cordon:       cs,
+		nodeInfo:     nodeInfo,
+		started:      time.Now(),
+		protocol:     protocolFull,
+		interval:     cfg.HeartbeatInterval,
+		scheduling:   scheduling,
 	}
 }
 
-// StartSendingHeartbeats periodically collects data and sends it to the orchestrator.
+// StartSendingHeartbeats periodically collects data and sends it to the
+// orchestrator. With CoreSchedulingSampling, CPU scheduling is sampled in the
+// background once per HeartbeatInterval.
 func (s *Sender) StartSendingHeartbeats() {
-	ticker := time.NewTicker(s.cfg.HeartbeatInterval)
+	if s.scheduling != nil {
+		go s.scheduling.start(s.cfg.HeartbeatInterval)
+	}
+	interval := s.interval
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for range ticker.C {
 		s.sendHeartbeat()
+		if s.interval != interval {
+			interval = s.interval
+			ticker.Reset(interval)
+		}
 	}
 }
 
@@ -67,10 +158,52 @@ func (s *Sender) sendHeartbeat() {
 		log.Printf("Error getting running VMs: %v", err)
 		runningVMs = []models.VMInfo{}
 	}
+	// Warm pool standbys are reported as part of the pool, not as VMs holding a slot.
+	runningVMs = slices.DeleteFunc(runningVMs, func(vm models.VMInfo) bool { return vmgr.IsStandby(vm.VMID) })
+	for i := range runningVMs {
+		runningVMs[i].Reachability = s.vmManager.Reachability(runningVMs[i].VMID)
+		runningVMs[i].NetworkMode, runningVMs[i].MACAddress = s.vmManager.Network(runningVMs[i].VMID)
+		runningVMs[i].Profile = s.vmManager.Profile(runningVMs[i].VMID)
+		runningVMs[i].Guest = s.vmManager.GuestStatus(runningVMs[i].VMID)
+		if hostname := s.vmManager.Hostname(runningVMs[i].VMID); hostname != "" {
+			runningVMs[i].VMHostname = hostname
+		}
+		if runningVMs[i].VMIPAddress == "" {
+			runningVMs[i].VMIPAddress, _ = s.vmManager.IPAddress(runningVMs[i].VMID)
+		}
+		runningVMs[i].Usage, _ = s.vmManager.ResourceUsage(runningVMs[i].VMID)
+		if s.diskUsage != nil {
+			runningVMs[i].DiskBytes, _ = s.diskUsage.VMBytes(runningVMs[i].VMID)
+		}
+		lifetime := s.vmManager.Runtime(runningVMs[i].VMID)
+		runningVMs[i].RuntimeSeconds, runningVMs[i].AgeSeconds, runningVMs[i].ReadySeconds = lifetime.RuntimeSeconds, lifetime.AgeSeconds, lifetime.ReadySeconds
+	}
+	s.vmManager.ForgetResourceUsage(runningVMs)
+	suspendedVMs, err := s.vmManager.SuspendedVMs()
+	if err != nil {
+		log.Printf("Error getting suspended VMs: %v", err)
+	}
+	var coreClusters []models.CoreCluster
+	if s.scheduling != nil {
+		coreClusters = addCPUScheduling(s.scheduling.Last(), runningVMs)
+	}
 	vmCount := len(runningVMs)
 
+	// Record locally first so history is kept even if the orchestrator is unreachable
+	s.utilization.RecordSample(vmCount, cpuUsage, memUsed)
+
 	cachedImages := s.imageManager.GetCachedImageNames()
 
+	status := "healthy" // Determine status based on thresholds later
+	if s.thermal.Active() {
+		status = "warning" // VMs are suspended for thermal protection
+	}
+	var cordonState *models.CordonState
+	if state := s.cordon.State(); state.Cordoned {
+		status = "cordoned" // Running VMs are fine, but the node takes no new ones
+		cordonState = &state
+	}
+
 	payload := models.HeartbeatPayload{
 		NodeID:          s.cfg.NodeID,
 		VMCount:         vmCount,
@@ -80,17 +213,67 @@ func (s *Sender) sendHeartbeat() {
 		TotalMemoryGB:   memTotal,
 		DiskUsageGB:     diskUsed,
 		TotalDiskGB:     diskTotal,
-		Status:          "healthy", // Determine status based on thresholds later
+		Status:          status,
 		CachedImages:    cachedImages,
+		SuspendedVMs:    suspendedVMs,
+		VMRecords:       s.vmRecords.Pending(),
+		CoreClusters:    coreClusters,
+		// Digests let the orchestrator tell apart image versions cached under the same name.
+		CachedImageDigests: s.imageManager.ManifestDigests(),
+		CachedImageTools:   s.imageManager.ImageTools(),
+		ImageEvictions:     s.imageManager.Evictions(),
+		Downloads:          s.imageManager.Downloads(),
+		ImageSync:          s.imageManager.ImageSyncStatus(),
+		Cordon:             cordonState,
+		WarmPool:           s.vmManager.WarmPool(),
+		AgentVersion:       version.Version,
+		GoVersion:          runtime.Version(),
+		UptimeSeconds:      int64(time.Since(s.started).Seconds()),
+		Drivers:            s.drivers(),
+		MaxSlots:           s.cfg.MaxVMs,
+		HostArch:           s.nodeInfo.Arch,
+		HostOSVersion:      s.nodeInfo.OSVersion,
+		FeatureFlags:       featureFlags(s.cfg),
+		NodeLabels:         s.nodeInfo.Labels,
+		NodeTaints:         s.nodeInfo.Taints,
+		APIVersions:        version.APIVersions,
+		TLSPublicKeyPin:    s.tlsPin,
+		HeartbeatCommands:  s.supportedCommands(),
+		CommandResults:     s.commandResults,
+		// Set-interval commands change it, so the orchestrator can tell a node overdue from one slowed down.
+		HeartbeatIntervalSeconds: int64(s.interval.Seconds()),
 	}
 
-	jsonPayload, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Error marshalling heartbeat payload: %v", err)
-		return
+	imageCache := s.imageManager.CacheStats()
+	payload.ImageCache = &imageCache
+	if s.maintenance != nil {
+		payload.Maintenance = s.maintenance.Status()
+	}
+	payload.LastHostPower = s.hostPower
+	if s.diskUsage != nil {
+		payload.DiskUsage = s.diskUsage.Usage()
+	}
+	if s.commands != nil {
+		queue := s.commands.Status()
+		payload.CommandQueue = &queue
+	}
+
+	var state syncState
+	if s.cfg.HeartbeatDeltas {
+		state = newSyncState(runningVMs, cachedImages, payload.CachedImageDigests)
+		payload.StateHash = state.hash()
+		payload.ProtocolVersion = s.protocol
+		if s.protocol == protocolFull {
+			payload.SupportedProtocols = []int{protocolFull, protocolDelta}
+		} else if s.base != nil && !s.resync && time.Since(s.lastFull) < s.cfg.FullHeartbeatInterval {
+			payload.Delta = diff(*s.base, s.baseHash, state, runningVMs)
+			payload.VMs = nil
+			payload.CachedImages = nil
+			payload.CachedImageDigests = nil
+		}
 	}
 
-	resp, err := http.Post(fmt.Sprintf("%s/api/heartbeat", s.cfg.OrchestratorURL), "application/json", bytes.NewBuffer(jsonPayload))
+	resp, err := s.orchestrator.Post("/api/heartbeat", payload)
 	if err != nil {
 		log.Printf("Error sending heartbeat to orchestrator: %v", err)
 		return
@@ -101,5 +284,116 @@ func (s *Sender) sendHeartbeat() {
 		log.Printf("Received non-OK response for heartbeat: %s", resp.Status)
 	} else {
 		log.Printf("Heartbeat sent successfully from NodeID: %s", s.cfg.NodeID)
+
+		// Orchestrators that don't ack records reply with an empty body; records are then just repeated.
+		var response models.HeartbeatResponse
+		if err := json.NewDecoder(resp.Body).Decode(&response); err == nil {
+			s.vmRecords.Ack(response.AckedVMRecords)
+		}
+		s.imageManager.ForgetEvictions(len(payload.ImageEvictions))
+		s.forgetCommandResults(len(payload.CommandResults))
+		if s.cfg.HeartbeatDeltas {
+			s.acknowledged(payload, state, response)
+		}
+		if response.DesiredImages != nil {
+			if _, err := s.imageManager.SetDesiredImages(*response.DesiredImages); err != nil {
+				log.Printf("Error applying desired images from heartbeat response: %v", err)
+			}
+		}
+		s.runCommands(response.Commands)
+	}
+}
+
+// acknowledged records the state the orchestrator now has, as the base of the
+// next delta, and applies its protocol choice and resync requests.
+func (s *Sender) acknowledged(payload models.HeartbeatPayload, state syncState, response models.HeartbeatResponse) {
+	s.base = &state
+	s.baseHash = payload.StateHash
+	if payload.Delta == nil {
+		s.lastFull = time.Now()
+		s.resync = false
+	}
+
+	switch response.ProtocolVersion {
+	case protocolDelta:
+		if s.protocol != protocolDelta {
+			log.Printf("Orchestrator accepted differential heartbeats (protocol %d)", protocolDelta)
+		}
+		s.protocol = protocolDelta
+	case protocolFull:
+		s.protocol = protocolFull
+	}
+	if response.Resync {
+		log.Printf("Orchestrator requested a full heartbeat")
+		s.resync = true
+	}
+}
+
+// drivers returns the VM backends usable on this node.
+func (s *Sender) drivers() []string {
+	drivers := []string{}
+	for _, backend := range s.nodeInfo.Backends {
+		if backend.Usable {
+			drivers = append(drivers, backend.Name)
+		}
+	}
+	return drivers
+}
+
+// featureFlags lists the optional features enabled in the configuration.
+func featureFlags(cfg *config.Config) []string {
+	var flags []string
+	add := func(enabled bool, flag string) {
+		if enabled {
+			flags = append(flags, flag)
+		}
+	}
+	add(cfg.ThermalProtection, "thermal-protection")
+	add(cfg.CoreSchedulingSampling, "core-scheduling-sampling")
+	add(len(cfg.ReachabilityEndpoints) > 0, "reachability-checks")
+	add(cfg.ImageSmokeTest, "image-smoke-test")
+	add(cfg.MaxConcurrentProvisions > 0, "provision-queue")
+	add(cfg.RunnerRegistration == "jit", "jit-runners")
+	add(cfg.UpdateURL != "" && cfg.UpdateInterval > 0, "auto-update")
+	add(cfg.TLSCertPath != "" || cfg.TLSSelfSigned, "tls")
+	add(cfg.WarmPoolSize > 0, "warm-pool")
+	add(cfg.MaintenanceSchedule != "", "maintenance-windows")
+	add(cfg.HeartbeatCommands, "heartbeat-commands")
+	add(len(cfg.CommandPublicKeys) > 0, "signed-commands")
+	add(cfg.OperatorTokenSecret != "", "api-tokens")
+	return flags
+}
+
+// addCPUScheduling attributes each VM's CPU time in a powermetrics sample to
+// it through the coalition of its `tart run` process. It returns the host's
+// core cluster activity from the same sample, or nil without a sample.
+func addCPUScheduling(sample *utils.SchedulingSample, vms []models.VMInfo) []models.CoreCluster {
+	if sample == nil {
+		return nil
+	}
+
+	for i := range vms {
+		pid, err := utils.GetVMProcessID(vms[i].VMID)
+		if err != nil {
+			continue
+		}
+		coalition, ok := sample.CoalitionForPID(pid)
+		if !ok {
+			continue
+		}
+
+		scheduling := &models.VMCPUScheduling{
+			CPUMsPerSec: coalition.CPUMsPerSec,
+			QoSMsPerSec: coalition.QoSMsPerSec,
+		}
+		var total float64
+		for _, ms := range coalition.QoSMsPerSec {
+			total += ms
+		}
+		if total > 0 {
+			scheduling.MinEfficiencyCoreShare = (coalition.QoSMsPerSec["background"] + coalition.QoSMsPerSec["maintenance"]) / total
+		}
+		vms[i].CPUScheduling = scheduling
 	}
+	return sample.Clusters
 }
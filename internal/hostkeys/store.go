@@ -0,0 +1,138 @@
+package hostkeys
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// guestHostKeyPath is the host key read from the guest when capturing it via the tart guest agent.
+const guestHostKeyPath = "/etc/ssh/ssh_host_ed25519_key.pub"
+
+// Store keeps the SSH host key of each VM so later connections can be verified.
+// Keys are stored one file per VM under <StateDir>/hostkeys.
+type Store struct {
+	dir      string
+	insecure bool       // Skip verification entirely (development only)
+	mu       sync.Mutex // Serializes trust-on-first-use writes
+}
+
+// NewStore creates a host key Store.
+func NewStore(cfg *config.Config) (*Store, error) {
+	dir := filepath.Join(cfg.StateDir, "hostkeys")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create host key directory %s: %w", dir, err)
+	}
+	if cfg.VMSSHInsecureHostKey {
+		log.Println("Warning: VM SSH host key verification is disabled.")
+	}
+	return &Store{dir: dir, insecure: cfg.VMSSHInsecureHostKey}, nil
+}
+
+func (s *Store) path(vmID string) string {
+	return filepath.Join(s.dir, vmID+".pub")
+}
+
+// Capture reads the VM's host key out-of-band through the tart guest agent
+// (`tart exec`) and records it, so the first SSH connection is already verified.
+// `tart exec` is killed if ctx is done first.
+func (s *Store) Capture(ctx context.Context, vmID string) error {
+	if s.insecure {
+		return nil
+	}
+	output, err := utils.ExecuteCommandContext(ctx, "tart", "exec", vmID, "cat", guestHostKeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read host key of VM %s via tart exec: %w", vmID, err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(output))
+	if err != nil {
+		return fmt.Errorf("failed to parse host key of VM %s: %w", vmID, err)
+	}
+	if err := s.save(vmID, key); err != nil {
+		return err
+	}
+	log.Printf("Captured SSH host key for VM %s (%s)", vmID, ssh.FingerprintSHA256(key))
+	return nil
+}
+
+// Forget removes the stored host key of a deleted VM.
+func (s *Store) Forget(vmID string) {
+	if err := os.Remove(s.path(vmID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: Failed to remove host key for VM %s: %v", vmID, err)
+	}
+}
+
+// Rename moves the stored host key of a VM that was renamed to newID.
+func (s *Store) Rename(vmID, newID string) error {
+	if err := os.Rename(s.path(vmID), s.path(newID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to move host key of VM %s to %s: %w", vmID, newID, err)
+	}
+	return nil
+}
+
+// HostKeyAlgorithms returns the algorithm of the stored key so the server offers
+// the same key type, or nil when no key is stored yet.
+func (s *Store) HostKeyAlgorithms(vmID string) []string {
+	if s.insecure {
+		return nil
+	}
+	key, err := s.load(vmID)
+	if err != nil {
+		return nil
+	}
+	return []string{key.Type()}
+}
+
+// Callback returns the host key callback for a VM. A VM without a stored key is
+// trusted on first use and its key recorded; afterwards any mismatch is rejected.
+func (s *Store) Callback(vmID string) ssh.HostKeyCallback {
+	if s.insecure {
+		return ssh.InsecureIgnoreHostKey()
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		known, err := s.load(vmID)
+		if os.IsNotExist(err) {
+			log.Printf("No stored host key for VM %s, trusting on first use (%s)", vmID, ssh.FingerprintSHA256(key))
+			return s.save(vmID, key)
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(known.Marshal(), key.Marshal()) {
+			return fmt.Errorf("host key mismatch for VM %s at %s: expected %s, got %s",
+				vmID, hostname, ssh.FingerprintSHA256(known), ssh.FingerprintSHA256(key))
+		}
+		return nil
+	}
+}
+
+func (s *Store) load(vmID string) (ssh.PublicKey, error) {
+	data, err := os.ReadFile(s.path(vmID))
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse stored host key for VM %s: %w", vmID, err)
+	}
+	return key, nil
+}
+
+func (s *Store) save(vmID string, key ssh.PublicKey) error {
+	if err := os.WriteFile(s.path(vmID), ssh.MarshalAuthorizedKey(key), 0600); err != nil {
+		return fmt.Errorf("failed to store host key for VM %s: %w", vmID, err)
+	}
+	return nil
+}
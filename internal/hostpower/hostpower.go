@@ -0,0 +1,145 @@
+// Package hostpower reboots and shuts down the host on request. The request
+// is persisted in host_power.json in the state directory until the host boots
+// again, so the first run of the agent after the boot can tell the
+// orchestrator why its heartbeats stopped.
+package hostpower
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// shutdownFlags are the shutdown(8) flags of each action.
+var shutdownFlags = map[string]string{
+	models.HostReboot:   "-r",
+	models.HostShutdown: "-h",
+}
+
+// Store persists the pending host power action and remembers the one that
+// preceded the current boot.
+type Store struct {
+	path    string
+	mu      sync.Mutex // Protects pending
+	pending bool       // An action was requested and the host hasn't gone down yet
+	last    *models.HostPowerAction
+}
+
+// NewStore creates a Store backed by host_power.json in the state directory
+// and picks up the action the host went down for, if any.
+func NewStore(cfg *config.Config) (*Store, error) {
+	if err := os.MkdirAll(cfg.StateDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory %s: %w", cfg.StateDir, err)
+	}
+	s := &Store{
+		path: filepath.Join(cfg.StateDir, "host_power.json"),
+	}
+	s.load()
+	return s, nil
+}
+
+// load reads the persisted action and removes it. An action requested after
+// the host last booted didn't take place, e.g. because only the agent was
+// restarted, so it is dropped.
+func (s *Store) load() {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: Could not read host power state %s: %v", s.path, err)
+		}
+		return
+	}
+	defer os.Remove(s.path)
+	var action models.HostPowerAction
+	if err := json.Unmarshal(data, &action); err != nil {
+		log.Printf("Warning: Could not parse host power state %s: %v", s.path, err)
+		return
+	}
+	switch bootedAt, err := utils.GetBootTime(); {
+	case err != nil:
+		log.Printf("Warning: Could not tell whether the host went down for the requested %s: %v", action.Action, err)
+	case bootedAt.Before(action.RequestedAt):
+		log.Printf("Warning: The host didn't go down for the %s requested at %s", action.Action, action.RequestedAt.Format(time.RFC3339))
+		return
+	default:
+		action.BootedAt = bootedAt.UTC()
+	}
+	log.Printf("Host came back from the %s requested at %s", action.Action, action.RequestedAt.Format(time.RFC3339))
+	s.last = &action
+}
+
+// Last returns the action the host went down for before the agent started,
+// or nil if it wasn't one requested through the agent.
+func (s *Store) Last() *models.HostPowerAction {
+	return s.last
+}
+
+// Pending reports whether an action was requested and is under way.
+func (s *Store) Pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// Begin persists action as pending. It fails if another action is under way.
+func (s *Store) Begin(action models.HostPowerAction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending {
+		return fmt.Errorf("a host reboot or shutdown is already under way")
+	}
+	data, err := json.Marshal(action)
+	if err != nil {
+		return fmt.Errorf("failed to marshal host power state: %w", err)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to persist host power state: %w", err)
+	}
+	s.pending = true
+	return nil
+}
+
+// Execute runs shutdown(8) for a pending action. If it fails, the action is
+// no longer pending and its marker is removed.
+func (s *Store) Execute(action models.HostPowerAction) error {
+	if output, err := utils.ExecuteCommand("shutdown", shutdownFlags[action.Action], "now"); err != nil {
+		s.mu.Lock()
+		s.pending = false
+		os.Remove(s.path)
+		s.mu.Unlock()
+		return fmt.Errorf("failed to %s the host: %w: %s", action.Action, err, strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// CheckLaunchd verifies the agent's launchd job is loaded and enabled, so
+// launchd starts the agent again once the host boots.
+func CheckLaunchd(label string) error {
+	if label == "" {
+		return fmt.Errorf("no launchd label configured, so the agent can't check it restarts after boot")
+	}
+	if _, err := utils.ExecuteCommand("launchctl", "print", "system/"+label); err != nil {
+		return fmt.Errorf("launchd job %s is not loaded: %w", label, err)
+	}
+	disabled, err := utils.ExecuteCommand("launchctl", "print-disabled", "system")
+	if err != nil {
+		return fmt.Errorf("failed to list disabled launchd jobs: %w", err)
+	}
+	if strings.Contains(disabled, fmt.Sprintf("%q => disabled", label)) || strings.Contains(disabled, fmt.Sprintf("%q => true", label)) {
+		return fmt.Errorf("launchd job %s is disabled and won't start after boot", label)
+	}
+	return nil
+}
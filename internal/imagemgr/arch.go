@@ -0,0 +1,68 @@
+package imagemgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// ErrArchMismatch is returned for an image built for another CPU architecture
+// than the host's, which could never boot on it.
+var ErrArchMismatch = errors.New("image architecture does not match the host")
+
+// NormalizeArch returns the architecture arch names as models.ArchARM64 or
+// models.ArchAMD64, accepting the names uname, Go and Apple use. Others are
+// returned lowercased.
+func NormalizeArch(arch string) string {
+	switch arch = strings.ToLower(strings.TrimSpace(arch)); arch {
+	case "arm64", "aarch64", "apple-silicon":
+		return models.ArchARM64
+	case "amd64", "x86_64", "x86-64", "intel":
+		return models.ArchAMD64
+	}
+	return arch
+}
+
+// SetHostArch sets the host's CPU architecture, which templates captured on
+// the host are built for and images are checked against.
+func (m *Manager) SetHostArch(arch string) {
+	m.hostArch = NormalizeArch(arch)
+}
+
+// CheckArch returns an error wrapping ErrArchMismatch if an image is built for
+// another architecture than the host's. The architecture of a cached image
+// comes from its manifest; that of an image not cached yet from its source's
+// metadata, so a mismatch is caught before the download. Images of unknown
+// architecture pass.
+func (m *Manager) CheckArch(ctx context.Context, imageName string) error {
+	if m.hostArch == "" {
+		return nil
+	}
+	m.mu.RLock()
+	info, ok := m.cache[imageName]
+	cached := ok && !info.IsDownloading && info.Manifest != nil
+	var arch string
+	if cached {
+		arch = info.Manifest.Arch
+	}
+	m.mu.RUnlock()
+	if !cached {
+		src, err := m.resolveSource(ctx, imageName)
+		if err != nil {
+			// Don't block provisioning on a metadata lookup; the download reports real errors.
+			log.Printf("Warning: Skipping architecture check of image %s: %v", imageName, err)
+			return nil
+		}
+		if src.attrs != nil {
+			arch = NormalizeArch(src.attrs.Metadata[metadataArch])
+		}
+	}
+	if arch != "" && arch != m.hostArch {
+		return fmt.Errorf("%w: %s is built for %s, the host is %s", ErrArchMismatch, imageName, arch, m.hostArch)
+	}
+	return nil
+}
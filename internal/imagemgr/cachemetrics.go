@@ -0,0 +1,77 @@
+package imagemgr
+
+import (
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// CacheMetrics is told how the image cache serves provisions, e.g. to keep
+// hit ratios over rolling windows for the orchestrator to tune
+// MaxCachedImages by. Its methods may be called with the Manager's lock held,
+// so they must not call back into the Manager.
+type CacheMetrics interface {
+	Hit(imageName string, bytes int64)        // A provision found the image cached
+	Miss(imageName string)                    // A provision had to wait for the image to download
+	Downloaded(imageName string, bytes int64) // A download finished
+	Evicted(imageName, reason string)         // The image was removed from the cache
+	Windows() []models.ImageCacheWindow       // Activity over the rolling windows kept
+}
+
+// SetCacheMetrics makes cm be told about cache hits, misses, downloads and
+// evictions. Without it nothing is recorded.
+func (m *Manager) SetCacheMetrics(cm CacheMetrics) {
+	m.metrics = cm
+}
+
+// UseCachedImage is GetCachedImagePath for a provision: it also counts a
+// cache hit, or a miss if the image isn't cached or is still downloading, in
+// which case it isn't returned either, so the provision waits for it.
+func (m *Manager) UseCachedImage(imageName string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, ok := m.cache[imageName]
+	if !ok || info.IsDownloading {
+		if m.metrics != nil {
+			m.metrics.Miss(imageName)
+		}
+		return "", false
+	}
+	info.LastUsed = time.Now()
+	if m.metrics != nil {
+		m.metrics.Hit(imageName, info.Size)
+	}
+	return info.Path, true
+}
+
+// countEviction tells the cache metrics about an image removed from the
+// cache. m.mu must be held.
+func (m *Manager) countEviction(imageName, reason string) {
+	if m.metrics != nil {
+		m.metrics.Evicted(imageName, reason)
+	}
+}
+
+// CacheStats returns the size and average age of the cache, with the
+// activity over the rolling windows if cache metrics are set.
+func (m *Manager) CacheStats() models.ImageCacheStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stats := models.ImageCacheStats{MaxCachedImages: m.cfg.MaxCachedImages}
+	var totalAge time.Duration
+	for _, info := range m.cache {
+		if info.IsDownloading {
+			continue
+		}
+		stats.CachedImages++
+		stats.CachedBytes += info.Size
+		totalAge += time.Since(info.CachedAt)
+	}
+	if stats.CachedImages > 0 {
+		stats.AverageImageAgeSeconds = int64((totalAge / time.Duration(stats.CachedImages)).Seconds())
+	}
+	if m.metrics != nil {
+		stats.Windows = m.metrics.Windows()
+	}
+	return stats
+}
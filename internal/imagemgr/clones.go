@@ -0,0 +1,89 @@
+package imagemgr
+
+import (
+	"log"
+	"os"
+	"slices"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// readOnlyMode is the mode of cached images. VMs get clones or copies of an
+// image, so the cached file itself is never written once downloaded.
+const readOnlyMode = 0444
+
+// makeReadOnly keeps a cached image from being modified in place, e.g. by a
+// VM mistakenly booted from it, so every VM created from it starts the same.
+func makeReadOnly(path string) {
+	if err := os.Chmod(path, readOnlyMode); err != nil {
+		log.Printf("Warning: Could not make cached image %s read-only: %v", path, err)
+	}
+}
+
+// AddClone records in an image's manifest that a VM's disk is an APFS clone
+// of it.
+func (m *Manager) AddClone(imageName, vmID string) {
+	m.updateClones(func(name string, clones []string) []string {
+		if name != imageName || slices.Contains(clones, vmID) {
+			return clones
+		}
+		return append(clones, vmID)
+	})
+}
+
+// RenameClone updates the manifests listing a VM that was renamed to newID.
+func (m *Manager) RenameClone(vmID, newID string) {
+	m.updateClones(func(_ string, clones []string) []string {
+		if i := slices.Index(clones, vmID); i >= 0 {
+			clones = slices.Clone(clones)
+			clones[i] = newID
+		}
+		return clones
+	})
+}
+
+// RemoveClone drops a deleted VM from the manifests listing it.
+func (m *Manager) RemoveClone(vmID string) {
+	m.updateClones(func(_ string, clones []string) []string {
+		return slices.DeleteFunc(slices.Clone(clones), func(id string) bool { return id == vmID })
+	})
+}
+
+// pruneClones drops VMs that no longer use an image from its manifest, e.g.
+// ones removed while the agent wasn't running.
+func (m *Manager) pruneClones(inUse InUseFunc) {
+	m.updateClones(func(name string, clones []string) []string {
+		if len(clones) == 0 {
+			return clones
+		}
+		using := inUse(name)
+		return slices.DeleteFunc(slices.Clone(clones), func(id string) bool { return !slices.Contains(using, id) })
+	})
+}
+
+// updateClones applies update to the clones of every cached image and
+// rewrites the manifests that changed.
+func (m *Manager) updateClones(update func(imageName string, clones []string) []string) {
+	var paths []string
+	var manifests []models.ImageManifest
+	m.mu.Lock()
+	for name, info := range m.cache {
+		if info.Manifest == nil {
+			continue
+		}
+		clones := update(name, info.Manifest.Clones)
+		if slices.Equal(clones, info.Manifest.Clones) {
+			continue
+		}
+		info.Manifest.Clones = clones
+		paths = append(paths, info.Path)
+		manifests = append(manifests, *info.Manifest)
+	}
+	m.mu.Unlock()
+
+	for i := range manifests {
+		if err := writeManifest(paths[i], &manifests[i]); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
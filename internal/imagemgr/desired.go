@@ -0,0 +1,416 @@
+package imagemgr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/utils"
+	"github.com/changty97/macvmagt/internal/validate"
+)
+
+// imageSyncInterval is how often the cache is reconciled with the desired
+// images even if nothing happened, e.g. to pick up freed disk space.
+const imageSyncInterval = time.Minute
+
+// imageSyncRetryDelay is how long after a failed download an image sync
+// downloads the image again.
+const imageSyncRetryDelay = 5 * time.Minute
+
+// desiredImages is the image set the orchestrator wants cached, and what
+// holds the cache up from converging on it.
+type desiredImages struct {
+	mu          sync.Mutex
+	request     *models.ImageSyncRequest // nil until images are set
+	listed      map[string]bool          // request's images
+	updatedAt   time.Time
+	convergedAt time.Time
+	ctx         context.Context           // Downloads for request wait on it
+	cancel      context.CancelFunc        // Cancels ctx once request is replaced
+	stale       context.CancelFunc        // Cancels the previous request's downloads once ctx waits for those still listed
+	waiting     map[string]bool           // Downloads ctx waits for
+	blocked     map[string]string         // Images that can't be downloaded or removed for now, and why
+	failed      map[string]failedDownload // Listed images whose last download failed
+	kick        chan struct{}             // Signals the sync loop to reconcile now
+}
+
+// failedDownload is the last failed download of a desired image.
+type failedDownload struct {
+	reason string
+	at     time.Time
+}
+
+// persistedImageSync is the content of image_sync.json.
+type persistedImageSync struct {
+	models.ImageSyncRequest
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// SetDesiredImages makes the cache converge on req's images: they are
+// downloaded in order, as download slots and disk space allow, and with
+// Evict, other cached images are removed. Setting the same images again
+// changes nothing. The request is kept in image_sync.json in the state
+// directory, so it survives agent restarts.
+func (m *Manager) SetDesiredImages(req models.ImageSyncRequest) (*models.ImageSyncStatus, error) {
+	seen := make(map[string]bool, len(req.Images))
+	images := make([]string, 0, len(req.Images))
+	for _, name := range req.Images {
+		if err := validate.ImageName(name); err != nil {
+			return nil, err
+		}
+		if !seen[name] {
+			seen[name] = true
+			images = append(images, name)
+		}
+	}
+	req.Images = images
+
+	updatedAt := time.Now().UTC()
+	if m.applyDesired(req, updatedAt) {
+		m.persistDesired(persistedImageSync{ImageSyncRequest: req, UpdatedAt: updatedAt})
+	}
+	return m.ImageSyncStatus(), nil
+}
+
+// applyDesired replaces the desired images with req, unless they are the
+// same, and reports whether they changed.
+func (m *Manager) applyDesired(req models.ImageSyncRequest, updatedAt time.Time) bool {
+	d := &m.desired
+	d.mu.Lock()
+	if d.request != nil && slices.Equal(d.request.Images, req.Images) && d.request.Evict == req.Evict {
+		d.mu.Unlock()
+		m.kickImageSync()
+		return false
+	}
+	if d.stale != nil {
+		d.stale() // The request before the previous one was never reconciled
+	}
+	d.stale = d.cancel
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.request = &req
+	d.listed = make(map[string]bool, len(req.Images))
+	for _, name := range req.Images {
+		d.listed[name] = true
+	}
+	d.updatedAt, d.convergedAt = updatedAt, time.Time{}
+	d.waiting, d.blocked, d.failed = map[string]bool{}, map[string]string{}, map[string]failedDownload{}
+	d.mu.Unlock()
+
+	log.Printf("Desired images set to [%s] (evict: %t)", strings.Join(req.Images, ", "), req.Evict)
+	m.kickImageSync()
+	return true
+}
+
+// desiredPath returns the path of image_sync.json.
+func (m *Manager) desiredPath() string {
+	return filepath.Join(m.cfg.StateDir, "image_sync.json")
+}
+
+// persistDesired writes the desired images to image_sync.json.
+func (m *Manager) persistDesired(state persistedImageSync) {
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = os.MkdirAll(m.cfg.StateDir, 0755)
+	}
+	if err == nil {
+		tmpPath := m.desiredPath() + ".tmp"
+		if err = os.WriteFile(tmpPath, data, 0644); err == nil {
+			err = os.Rename(tmpPath, m.desiredPath())
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: Could not persist desired images: %v", err)
+	}
+}
+
+// loadDesired picks up the desired images set before the agent restarted.
+func (m *Manager) loadDesired() {
+	data, err := os.ReadFile(m.desiredPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: Could not read desired images %s: %v", m.desiredPath(), err)
+		}
+		return
+	}
+	var state persistedImageSync
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("Warning: Could not parse desired images %s: %v", m.desiredPath(), err)
+		return
+	}
+	m.applyDesired(state.ImageSyncRequest, state.UpdatedAt)
+}
+
+// kickImageSync makes the sync loop reconcile the cache now.
+func (m *Manager) kickImageSync() {
+	select {
+	case m.desired.kick <- struct{}{}:
+	default:
+	}
+}
+
+// StartImageSync reconciles the cache with the desired images whenever they
+// change or a download finishes, and every imageSyncInterval.
+func (m *Manager) StartImageSync() {
+	m.loadDesired()
+	ticker := time.NewTicker(imageSyncInterval)
+	defer ticker.Stop()
+	for {
+		m.reconcileImages()
+		select {
+		case <-ticker.C:
+		case <-m.desired.kick:
+		}
+	}
+}
+
+// reconcileImages removes unlisted images if the desired images ask for it,
+// and queues downloads of the listed ones that aren't cached, in order. At
+// most MaxConcurrentDownloads listed images download at once, only
+// MaxCachedImages of them are downloaded, and only as many as fit on disk
+// beyond DiskSpaceReserve.
+func (m *Manager) reconcileImages() {
+	defer utils.Recover("image sync")
+	d := &m.desired
+	d.mu.Lock()
+	if d.request == nil {
+		d.mu.Unlock()
+		return
+	}
+	req, listed, ctx := *d.request, d.listed, d.ctx
+	waiting, failed := maps.Clone(d.waiting), maps.Clone(d.failed)
+	d.mu.Unlock()
+
+	blocked := make(map[string]string)
+	if req.Evict {
+		m.removeUnlisted(listed, blocked)
+	}
+	budget, err := m.downloadBudget(listed)
+	if err != nil {
+		log.Printf("Warning: Could not tell the disk space left for desired images, leaving it to the downloads: %v", err)
+		budget = math.MaxInt64
+	}
+
+	slots := max(m.cfg.MaxConcurrentDownloads, 1)
+	var missing []string
+	for i, name := range req.Images {
+		if m.cfg.MaxCachedImages > 0 && i >= m.cfg.MaxCachedImages {
+			blocked[name] = fmt.Sprintf("beyond the %d images the cache holds (max cached images)", m.cfg.MaxCachedImages)
+			continue
+		}
+		m.mu.RLock()
+		info, cached := m.cache[name]
+		m.mu.RUnlock()
+		switch {
+		case cached && info.IsDownloading:
+			slots--
+			if !waiting[name] {
+				// Wait for it too, so replacing the request it was queued for doesn't cancel it.
+				m.RequestImageDownload(ctx, name)
+				waiting[name] = true
+			}
+		case cached:
+		case time.Since(failed[name].at) < imageSyncRetryDelay:
+		default:
+			missing = append(missing, name)
+		}
+	}
+
+	for _, name := range missing {
+		if slots <= 0 {
+			break
+		}
+		if err := m.CheckArch(ctx, name); err != nil {
+			blocked[name] = err.Error()
+			continue
+		}
+		size, err := m.ImageSize(ctx, name)
+		if err != nil {
+			failed[name] = failedDownload{reason: err.Error(), at: time.Now()}
+			continue
+		}
+		if size > budget {
+			blocked[name] = fmt.Sprintf("%v: needs %d bytes, %d available beyond the reserve", ErrInsufficientStorage, size, max(budget, 0))
+			continue
+		}
+		budget -= size
+		slots--
+		log.Printf("Downloading desired image %s", name)
+		m.RequestImageDownload(ctx, name)
+		waiting[name] = true
+	}
+
+	d.mu.Lock()
+	if d.ctx != ctx {
+		d.mu.Unlock()
+		return // Replaced meanwhile; the next round reconciles the new images
+	}
+	d.waiting, d.blocked, d.failed = waiting, blocked, failed
+	if d.stale != nil {
+		d.stale()
+		d.stale = nil
+	}
+	d.mu.Unlock()
+
+	if status := m.ImageSyncStatus(); status != nil && status.State == models.ImageSyncConverged {
+		d.mu.Lock()
+		if d.ctx == ctx && d.convergedAt.IsZero() {
+			d.convergedAt = time.Now()
+			log.Printf("Image cache converged on the desired images")
+		}
+		d.mu.Unlock()
+	}
+}
+
+// removeUnlisted removes the cached images that aren't listed, but templates,
+// which can't be downloaded again. Those that can't be removed yet, e.g.
+// because VMs use them, are added to blocked.
+func (m *Manager) removeUnlisted(listed map[string]bool, blocked map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, info := range m.cache {
+		if listed[name] || info.IsDownloading || isTemplate(info) {
+			continue
+		}
+		if _, err := m.deleteImage(name, models.ImageUnlisted); err != nil {
+			blocked[name] = err.Error()
+		}
+	}
+}
+
+// downloadBudget returns how many bytes can still be downloaded into the
+// cache: the free space beyond DiskSpaceReserve, less what running downloads
+// have yet to write, plus the unlisted images downloads may evict.
+func (m *Manager) downloadBudget(listed map[string]bool) (int64, error) {
+	free, _, err := m.commands.GetFreeDiskSpace(m.cfg.ImageCacheDir)
+	if err != nil {
+		return 0, err
+	}
+	budget := free - m.cfg.DiskSpaceReserve
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, download := range m.activeDownloads {
+		download.progress.mu.Lock()
+		budget -= max(download.progress.total-download.progress.done, 0)
+		download.progress.mu.Unlock()
+	}
+	for name, info := range m.cache {
+		if !listed[name] && !info.IsDownloading && !isTemplate(info) {
+			budget += info.Size
+		}
+	}
+	return budget, nil
+}
+
+// downloadFinished records how the download of a listed image went, and
+// lets the sync loop queue the next one.
+func (m *Manager) downloadFinished(imageName string, err error) {
+	d := &m.desired
+	d.mu.Lock()
+	if d.listed[imageName] {
+		if err != nil {
+			d.failed[imageName] = failedDownload{reason: err.Error(), at: time.Now()}
+		} else {
+			delete(d.failed, imageName)
+		}
+	}
+	d.mu.Unlock()
+	m.kickImageSync()
+}
+
+// listedImages returns the desired images as a set, for eviction to keep
+// them longest.
+func (m *Manager) listedImages() map[string]bool {
+	m.desired.mu.Lock()
+	defer m.desired.mu.Unlock()
+	return maps.Clone(m.desired.listed)
+}
+
+// sortForEviction orders images for LRU eviction: unlisted images first,
+// then least recently used first.
+func sortForEviction(images []*ImageInfo, listed map[string]bool) {
+	sort.Slice(images, func(i, j int) bool {
+		if listed[images[i].Name] != listed[images[j].Name] {
+			return !listed[images[i].Name]
+		}
+		return images[i].LastUsed.Before(images[j].LastUsed)
+	})
+}
+
+// ImageSyncStatus reports how far the cache got towards the desired images,
+// or nil if none were set.
+func (m *Manager) ImageSyncStatus() *models.ImageSyncStatus {
+	d := &m.desired
+	d.mu.Lock()
+	if d.request == nil {
+		d.mu.Unlock()
+		return nil
+	}
+	status := &models.ImageSyncStatus{
+		Images:    slices.Clone(d.request.Images),
+		Evict:     d.request.Evict,
+		Cached:    []string{},
+		UpdatedAt: d.updatedAt.UTC(),
+	}
+	if !d.convergedAt.IsZero() {
+		convergedAt := d.convergedAt.UTC()
+		status.ConvergedAt = &convergedAt
+	}
+	listed, blocked, failed := d.listed, maps.Clone(d.blocked), maps.Clone(d.failed)
+	d.mu.Unlock()
+
+	m.mu.RLock()
+	for _, name := range status.Images {
+		info, cached := m.cache[name]
+		switch {
+		case cached && info.IsDownloading:
+			status.Downloading = append(status.Downloading, name)
+		case cached:
+			status.Cached = append(status.Cached, name)
+		case blocked[name] != "":
+			status.Blocked = append(status.Blocked, models.ImageSyncIssue{Image: name, Reason: blocked[name]})
+		case failed[name].reason != "":
+			status.Failed = append(status.Failed, models.ImageSyncIssue{Image: name, Reason: failed[name].reason})
+		default:
+			status.Pending = append(status.Pending, name)
+		}
+	}
+	removing := false // Unlisted images are still to be removed
+	if status.Evict {
+		var unlisted []string
+		for name, info := range m.cache {
+			if !listed[name] && !isTemplate(info) {
+				unlisted = append(unlisted, name)
+			}
+		}
+		sort.Strings(unlisted)
+		for _, name := range unlisted {
+			if reason := blocked[name]; reason != "" {
+				status.Blocked = append(status.Blocked, models.ImageSyncIssue{Image: name, Reason: reason})
+			} else {
+				removing = true
+			}
+		}
+	}
+	m.mu.RUnlock()
+
+	switch {
+	case len(status.Downloading) > 0 || len(status.Pending) > 0 || removing:
+		status.State = models.ImageSyncConverging
+	case len(status.Blocked) > 0 || len(status.Failed) > 0:
+		status.State = models.ImageSyncBlocked
+	default:
+		status.State = models.ImageSyncConverged
+	}
+	return status
+}
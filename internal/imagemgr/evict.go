@@ -0,0 +1,108 @@
+package imagemgr
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// Errors of DeleteImage.
+var (
+	ErrImageNotCached   = errors.New("image is not cached")
+	ErrImageInUse       = errors.New("image is in use by VMs")
+	ErrImageDownloading = errors.New("image is downloading")
+)
+
+// InUseFunc returns the IDs of the VMs using a cached image.
+type InUseFunc func(imageName string) []string
+
+// SetInUse keeps images that fn reports VMs for from being deleted on request,
+// and drops VMs fn doesn't report from the images' clones. The VM manager
+// knows which image each VM comes from, so it provides fn.
+func (m *Manager) SetInUse(fn InUseFunc) {
+	m.inUse = fn
+	m.pruneClones(fn)
+}
+
+// DeleteImage removes a cached image and its sidecar files, e.g. after a bad
+// build. It refuses images that are downloading or used by a VM.
+func (m *Manager) DeleteImage(imageName string) (models.ImageEviction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deleteImage(imageName, models.ImageDeleted)
+}
+
+// PurgeImages removes every cached image that can be deleted, reporting the
+// ones left in place and why.
+func (m *Manager) PurgeImages() models.ImagePurgeResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.cache))
+	for name := range m.cache {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := models.ImagePurgeResult{Evicted: []models.ImageEviction{}}
+	for _, name := range names {
+		eviction, err := m.deleteImage(name, models.ImagePurged)
+		if err != nil {
+			result.Skipped = append(result.Skipped, models.ImagePurgeSkipped{Image: name, Reason: err.Error()})
+			continue
+		}
+		result.Evicted = append(result.Evicted, eviction)
+	}
+	return result
+}
+
+// deleteImage removes a cached image for reason. m.mu must be held.
+func (m *Manager) deleteImage(imageName, reason string) (models.ImageEviction, error) {
+	info, ok := m.cache[imageName]
+	if !ok {
+		return models.ImageEviction{}, fmt.Errorf("%w: %s", ErrImageNotCached, imageName)
+	}
+	if info.IsDownloading {
+		return models.ImageEviction{}, fmt.Errorf("%w: %s", ErrImageDownloading, imageName)
+	}
+	if m.inUse != nil {
+		if vmIDs := m.inUse(imageName); len(vmIDs) > 0 {
+			return models.ImageEviction{}, fmt.Errorf("%w %s", ErrImageInUse, strings.Join(vmIDs, ", "))
+		}
+	}
+
+	if err := removeWithSidecars(info.Path); err != nil {
+		return models.ImageEviction{}, fmt.Errorf("failed to remove image %s: %w", imageName, err)
+	}
+	delete(m.cache, imageName)
+	m.countEviction(imageName, reason)
+
+	eviction := models.ImageEviction{Image: imageName, Reason: reason, EvictedAt: time.Now().UTC()}
+	if info.Manifest != nil {
+		eviction.Digest = info.Manifest.Digest
+	}
+	m.evictions = append(m.evictions, eviction)
+	log.Printf("Removed cached image %s (%s)", imageName, reason)
+	return eviction, nil
+}
+
+// Evictions returns the images removed on request that no heartbeat has
+// reported yet.
+func (m *Manager) Evictions() []models.ImageEviction {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]models.ImageEviction(nil), m.evictions...)
+}
+
+// ForgetEvictions drops the first n evictions, once a heartbeat carrying them
+// was accepted. Evictions since then are kept for the next one.
+func (m *Manager) ForgetEvictions(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.evictions = m.evictions[min(n, len(m.evictions)):]
+}
@@ -0,0 +1,319 @@
+package imagemgr
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/changty97/macvmagt/internal/fakedriver"
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// An image can be stored in GCS in one of these formats. For an image name,
+// the agent looks for a chunk index, then a zstd-compressed object, then the
+// plain image, and downloads the first that exists.
+const (
+	formatChunked = "chunked" // <image>.chunks.json listing content-addressed chunks
+	formatZstd    = "zstd"    // <image>.zst, a zstd stream of the image
+	formatRaw     = "raw"     // <image>, the image as is
+	formatFake    = "fake"    // A stub image made up by the fake driver, which has no bucket
+)
+
+// Object name suffixes of the stored image formats. A chunked image's index
+// is also cached next to the assembled image, so later downloads can reuse
+// its chunks.
+const (
+	ChunkIndexSuffix = ".chunks.json"
+	ZstdSuffix       = ".zst"
+)
+
+// defaultChunkPrefix is where chunks are stored in the bucket when the index
+// doesn't say.
+const defaultChunkPrefix = "chunks/"
+
+// metadataUncompressedSize is the GCS object metadata key giving the size of
+// a zstd-compressed image once decompressed.
+const metadataUncompressedSize = "uncompressed-size"
+
+// chunkIndex describes an image stored as content-addressed chunks, in the
+// style of casync. Chunks shared by several images or image versions are
+// stored once, and downloaded once if an image cached with them is still
+// around.
+type chunkIndex struct {
+	Size        int64      `json:"size"`                  // Size of the assembled image
+	SHA256      string     `json:"sha256,omitempty"`      // SHA256 of the assembled image, checked if set
+	ChunkPrefix string     `json:"chunkPrefix,omitempty"` // Object name prefix of the chunks, defaults to "chunks/"
+	Chunks      []chunkRef `json:"chunks"`                // In image order
+}
+
+// chunkRef is one chunk of a chunked image. Its object is named after its
+// SHA256, plus ".zst" if it is compressed.
+type chunkRef struct {
+	SHA256      string `json:"sha256"`                // SHA256 of the uncompressed chunk
+	Size        int64  `json:"size"`                  // Uncompressed size
+	Compression string `json:"compression,omitempty"` // "" or "zstd"
+}
+
+// imageSource is the GCS object an image is downloaded from.
+type imageSource struct {
+	object string // Object name
+	format string // One of the format* constants
+	attrs  *storage.ObjectAttrs
+	size   int64       // Size of the image once downloaded, or the best guess
+	index  *chunkIndex // Chunk index of a chunked image
+}
+
+// resolveSource finds the GCS object an image is stored as.
+func (m *Manager) resolveSource(ctx context.Context, imageName string) (*imageSource, error) {
+	if m.gcsClient == nil {
+		attrs := fakedriver.ImageAttrs(imageName)
+		return &imageSource{object: imageName, format: formatFake, attrs: attrs, size: attrs.Size}, nil
+	}
+	bucket := m.gcsClient.Bucket(m.cfg.GCSBucketName)
+	candidates := []imageSource{
+		{object: imageName + ChunkIndexSuffix, format: formatChunked},
+		{object: imageName + ZstdSuffix, format: formatZstd},
+		{object: imageName, format: formatRaw}, // Assuming image name is the object name in GCS
+	}
+	for _, src := range candidates {
+		attrs, err := bucket.Object(src.object).Attrs(ctx)
+		if errors.Is(err, storage.ErrObjectNotExist) && src.format != formatRaw {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get GCS object attributes for %s: %w", src.object, err)
+		}
+		src.attrs = attrs
+		src.size = attrs.Size
+		switch src.format {
+		case formatChunked:
+			if src.index, err = m.readChunkIndex(ctx, src.object); err != nil {
+				return nil, err
+			}
+			src.size = src.index.Size
+		case formatZstd:
+			if size, err := strconv.ParseInt(attrs.Metadata[metadataUncompressedSize], 10, 64); err == nil {
+				src.size = size
+			} else {
+				log.Printf("Warning: %s has no %s metadata, assuming it decompresses to 3 times its size", src.object, metadataUncompressedSize)
+				src.size = attrs.Size * 3
+			}
+		}
+		return &src, nil
+	}
+	panic("unreachable")
+}
+
+// readChunkIndex downloads and parses a chunk index.
+func (m *Manager) readChunkIndex(ctx context.Context, object string) (*chunkIndex, error) {
+	reader, err := m.gcsClient.Bucket(m.cfg.GCSBucketName).Object(object).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk index %s: %w", object, err)
+	}
+	defer reader.Close()
+	var index chunkIndex
+	if err := json.NewDecoder(reader).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to parse chunk index %s: %w", object, err)
+	}
+	var total int64
+	for _, chunk := range index.Chunks {
+		if len(chunk.SHA256) != sha256.Size*2 || strings.ContainsAny(chunk.SHA256, "/.") {
+			return nil, fmt.Errorf("chunk index %s lists invalid chunk %q", object, chunk.SHA256)
+		}
+		if chunk.Compression != "" && chunk.Compression != formatZstd {
+			return nil, fmt.Errorf("chunk index %s lists chunk %s with unknown compression %q", object, chunk.SHA256, chunk.Compression)
+		}
+		total += chunk.Size
+	}
+	if total != index.Size {
+		return nil, fmt.Errorf("chunk index %s: chunks add up to %d bytes, not %d", object, total, index.Size)
+	}
+	if index.ChunkPrefix == "" {
+		index.ChunkPrefix = defaultChunkPrefix
+	}
+	return &index, nil
+}
+
+// fetch writes the image stored as src to w, throttled like every download,
+// and returns the number of bytes written. destPath is where the image is
+// cached once complete.
+func (m *Manager) fetch(ctx context.Context, src *imageSource, destPath string, w io.Writer) (int64, error) {
+	switch src.format {
+	case formatChunked:
+		return m.fetchChunks(ctx, src.index, destPath, w)
+	case formatFake:
+		return fakedriver.WriteImage(ctx, w)
+	case formatZstd:
+		reader, err := m.gcsClient.Bucket(m.cfg.GCSBucketName).Object(src.object).NewReader(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create GCS object reader for %s: %w", src.object, err)
+		}
+		defer reader.Close()
+		counter := &countingWriter{w: w}
+		err = decompressZstd(ctx, &throttledReader{ctx: ctx, r: reader, m: m}, counter)
+		return counter.n, err
+	default:
+		reader, err := m.gcsClient.Bucket(m.cfg.GCSBucketName).Object(src.object).NewReader(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create GCS object reader for %s: %w", src.object, err)
+		}
+		defer reader.Close()
+		return io.Copy(w, &throttledReader{ctx: ctx, r: reader, m: m})
+	}
+}
+
+// localChunk is a chunk found in an image already in the cache.
+type localChunk struct {
+	path   string
+	offset int64
+	size   int64
+}
+
+// fetchChunks assembles a chunked image into w, copying chunks that cached
+// images assembled earlier share with it and downloading the others. Every
+// chunk is checked against its SHA256. The index is cached next to destPath.
+func (m *Manager) fetchChunks(ctx context.Context, index *chunkIndex, destPath string, w io.Writer) (int64, error) {
+	local := m.localChunks()
+	bucket := m.gcsClient.Bucket(m.cfg.GCSBucketName)
+	var written, reused int64
+	for _, chunk := range index.Chunks {
+		var buf bytes.Buffer
+		if found, ok := local[chunk.SHA256]; ok && found.size == chunk.Size {
+			if err := readLocalChunk(found, &buf); err == nil && chunkMatches(buf.Bytes(), chunk.SHA256) {
+				n, err := w.Write(buf.Bytes())
+				written += int64(n)
+				reused += int64(n)
+				if err != nil {
+					return written, err
+				}
+				continue
+			}
+			buf.Reset() // Evicted or changed since, download it instead
+		}
+
+		object := index.ChunkPrefix + chunk.SHA256
+		if chunk.Compression == formatZstd {
+			object += ZstdSuffix
+		}
+		reader, err := bucket.Object(object).NewReader(ctx)
+		if err != nil {
+			return written, fmt.Errorf("failed to create GCS object reader for chunk %s: %w", object, err)
+		}
+		throttled := &throttledReader{ctx: ctx, r: reader, m: m}
+		if chunk.Compression == formatZstd {
+			err = decompressZstd(ctx, throttled, &buf)
+		} else {
+			_, err = io.Copy(&buf, throttled)
+		}
+		reader.Close()
+		if err != nil {
+			return written, fmt.Errorf("failed to download chunk %s: %w", object, err)
+		}
+		if int64(buf.Len()) != chunk.Size || !chunkMatches(buf.Bytes(), chunk.SHA256) {
+			return written, fmt.Errorf("chunk %s does not match its checksum", object)
+		}
+		n, err := w.Write(buf.Bytes())
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	if reused > 0 {
+		log.Printf("Reused %d of %d bytes of %s from cached images", reused, written, destPath)
+	}
+
+	data, err := json.Marshal(index)
+	if err == nil {
+		err = os.WriteFile(destPath+ChunkIndexSuffix, data, 0644)
+	}
+	if err != nil {
+		log.Printf("Warning: Could not cache chunk index of %s: %v", destPath, err)
+	}
+	return written, nil
+}
+
+// localChunks returns where each chunk of the cached chunked images is.
+func (m *Manager) localChunks() map[string]localChunk {
+	var paths []string
+	m.mu.RLock()
+	for _, info := range m.cache {
+		if !info.IsDownloading && info.Path != "" {
+			paths = append(paths, info.Path)
+		}
+	}
+	m.mu.RUnlock()
+
+	chunks := make(map[string]localChunk)
+	for _, path := range paths {
+		data, err := os.ReadFile(path + ChunkIndexSuffix)
+		if err != nil {
+			continue
+		}
+		var index chunkIndex
+		if err := json.Unmarshal(data, &index); err != nil {
+			continue
+		}
+		var offset int64
+		for _, chunk := range index.Chunks {
+			chunks[chunk.SHA256] = localChunk{path: path, offset: offset, size: chunk.Size}
+			offset += chunk.Size
+		}
+	}
+	return chunks
+}
+
+// readLocalChunk copies a chunk out of a cached image into buf.
+func readLocalChunk(chunk localChunk, buf *bytes.Buffer) error {
+	file, err := os.Open(chunk.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(buf, io.NewSectionReader(file, chunk.offset, chunk.size))
+	return err
+}
+
+// chunkMatches reports whether data hashes to checksum.
+func chunkMatches(data []byte, checksum string) bool {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) == checksum
+}
+
+// decompressZstd decompresses the zstd stream r into w with the zstd tool,
+// trading CPU for a smaller download.
+func decompressZstd(ctx context.Context, r io.Reader, w io.Writer) error {
+	var stderr bytes.Buffer
+	cmd := utils.CommandContext(ctx, "zstd", "-d", "-c", "-q")
+	cmd.Stdin = r
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("zstd failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -9,13 +9,20 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/changty97/macvmagt/internal/config" // Assuming models are shared or duplicated
+	"github.com/changty97/macvmagt/internal/fakedriver"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/operations"
+	"github.com/changty97/macvmagt/internal/requestid"
+	"github.com/changty97/macvmagt/internal/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 	"google.golang.org/api/option"
 )
 
@@ -24,43 +31,84 @@ type ImageInfo struct {
 	Name          string    // Image name (e.g., "macos-sonoma-github-runner")
 	Path          string    // Full path to the cached file
 	LastUsed      time.Time // For LRU eviction
+	CachedAt      time.Time // When the image was downloaded, for the cache's average age
 	Size          int64     // Size in bytes
 	Checksum      string    // SHA256 checksum for verification
-	IsDownloading bool      // Flag to indicate if currently downloading
+	IsDownloading bool      // Flag to indicate if currently downloading (or being smoke tested)
+	// Manifest describes the image version; nil while downloading.
+	Manifest *models.ImageManifest
+}
+
+// downloadRequest is a queued image download.
+type downloadRequest struct {
+	imageName string
+	requester trace.SpanContext // Span of the provision that requested the download, to trace it under
+	requestID string            // Of the provision that requested the download
+}
+
+// pendingDownload is a queued or running image download. It is canceled once
+// no provision is waiting for it anymore.
+type pendingDownload struct {
+	waiters  int                // Provisions waiting for the image
+	cancel   context.CancelFunc // Cancels the download once it runs
+	canceled bool               // Every waiter gave up, so the download is skipped or aborted
+	queuedAt time.Time
+	progress downloadProgress
 }
 
 // Manager handles caching, downloading, and evicting VM images.
 type Manager struct {
 	cfg             *config.Config
 	cache           map[string]*ImageInfo // Map image name to ImageInfo
-	mu              sync.RWMutex          // Protects cache map
+	mu              sync.RWMutex          // Protects cache map, activeDownloads and evictions
 	gcsClient       *storage.Client
-	downloadQueue   chan string // Channel for images to download
-	activeDownloads sync.Map    // Map[string]context.CancelFunc for active downloads
+	downloadQueue   chan downloadRequest        // Channel for images to download
+	activeDownloads map[string]*pendingDownload // Queued and running downloads by image name
+	evictions       []models.ImageEviction      // Images removed on request, until a heartbeat reports them
+	ops             *operations.Tracker
+	smokeTest       SmokeTestFunc   // Validates new downloads before they're usable; nil disables smoke tests
+	inUse           InUseFunc       // VMs using an image, which keep it from being deleted on request; nil means none
+	busy            BusyFunc        // Whether VMs are running jobs, which slows downloads down; nil means never
+	downloaded      DownloadedFunc  // Told about each image that finished downloading and is usable; nil tells nobody
+	bandwidth       bandwidth       // Rate limit shared by all downloads
+	verifyMu        sync.Mutex      // Serializes image hashes
+	metrics         CacheMetrics    // Told about hits, misses, downloads and evictions; nil records nothing
+	hostArch        string          // CPU architecture of the host; empty skips architecture checks
+	desired         desiredImages   // Images the orchestrator wants cached
+	commands        *utils.Commands // Runs the commands that measure free disk space
 }
 
 // NewManager creates a new Image Manager.
-func NewManager(cfg *config.Config) (*Manager, error) {
-	// Initialize GCS client
-	ctx := context.Background()
-	var opts []option.ClientOption
-	if cfg.GCPCredentialsPath != "" {
-		opts = append(opts, option.WithCredentialsFile(cfg.GCPCredentialsPath))
-	} else {
-		// Use default application credentials if path is not provided
-		log.Println("GCP_CREDENTIALS_PATH not set, using default application credentials.")
-	}
+func NewManager(cfg *config.Config, ops *operations.Tracker) (*Manager, error) {
+	// Initialize GCS client. The fake driver's stub images need none.
+	var client *storage.Client
+	if cfg.Driver != fakedriver.Name {
+		ctx := context.Background()
+		var opts []option.ClientOption
+		if cfg.GCPCredentialsPath != "" {
+			opts = append(opts, option.WithCredentialsFile(cfg.GCPCredentialsPath))
+		} else {
+			// Use default application credentials if path is not provided
+			log.Println("GCP_CREDENTIALS_PATH not set, using default application credentials.")
+		}
 
-	client, err := storage.NewClient(ctx, opts...)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create GCS client: %w", err)
+		var err error
+		client, err = storage.NewClient(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCS client: %w", err)
+		}
 	}
 
 	im := &Manager{
-		cfg:           cfg,
-		cache:         make(map[string]*ImageInfo),
-		gcsClient:     client,
-		downloadQueue: make(chan string, 10), // Buffered channel for download requests
+		cfg:             cfg,
+		cache:           make(map[string]*ImageInfo),
+		gcsClient:       client,
+		downloadQueue:   make(chan downloadRequest, 10), // Buffered channel for download requests
+		activeDownloads: make(map[string]*pendingDownload),
+		ops:             ops,
+		bandwidth:       bandwidth{limiter: rate.NewLimiter(rate.Inf, downloadBurst)},
+		desired:         desiredImages{kick: make(chan struct{}, 1)},
+		commands:        &utils.Commands{},
 	}
 
 	// Ensure cache directory exists
@@ -68,17 +116,26 @@ func NewManager(cfg *config.Config) (*Manager, error) {
 		return nil, fmt.Errorf("failed to create image cache directory %s: %w", cfg.ImageCacheDir, err)
 	}
 
-	// Load existing cached images on startup
-	im.loadExistingImages()
+	// Load existing cached images on startup, hashing them all again after a crash
+	crashed := markRunning(cfg.ImageCacheDir)
+	if crashed {
+		log.Printf("The agent did not stop cleanly, verifying all cached images")
+	}
+	im.loadExistingImages(crashed)
 
-	// Start background download worker
-	go im.downloadWorker()
+	// Start background download workers
+	for range max(cfg.MaxConcurrentDownloads, 1) {
+		go im.downloadWorker()
+	}
 
 	return im, nil
 }
 
 // loadExistingImages scans the cache directory and populates the cache map.
-func (m *Manager) loadExistingImages() {
+// An image is hashed unless it is unchanged since it was last verified and
+// rehash isn't set. One that doesn't match its manifest is removed, so it
+// is downloaded again.
+func (m *Manager) loadExistingImages(rehash bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -89,10 +146,17 @@ func (m *Manager) loadExistingImages() {
 	}
 
 	for _, file := range files {
-		if file.IsDir() {
+		if file.IsDir() || isSidecar(file.Name()) || strings.HasPrefix(file.Name(), ".") {
 			continue
 		}
 		filePath := filepath.Join(m.cfg.ImageCacheDir, file.Name())
+		if strings.HasSuffix(file.Name(), partialSuffix) {
+			log.Printf("Removing interrupted download %s", filePath)
+			if err := os.Remove(filePath); err != nil {
+				log.Printf("Warning: Could not remove %s: %v", filePath, err)
+			}
+			continue
+		}
 		info, err := os.Stat(filePath)
 		if err != nil {
 			log.Printf("Warning: Could not stat file %s: %v", filePath, err)
@@ -101,23 +165,61 @@ func (m *Manager) loadExistingImages() {
 
 		// Assuming filename is the image name for simplicity, or you can parse metadata
 		imageName := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())) // Remove extension
-		checksum, err := calculateFileChecksum(filePath)
-		if err != nil {
-			log.Printf("Warning: Could not calculate checksum for %s: %v", filePath, err)
-			checksum = "" // Indicate unknown checksum
+		manifest := readManifest(filePath)
+		if manifest != nil && manifest.Size != info.Size() {
+			m.removeCorrupt(imageName, filePath, manifest, fmt.Sprintf("size %d does not match %d", info.Size(), manifest.Size))
+			continue
+		}
+		var checksum string
+		if !rehash && manifest != nil && unchangedSinceVerified(manifest, info) {
+			checksum = manifest.Checksum
+		} else {
+			checksum, err = hashFile(context.Background(), filePath)
+			if err != nil {
+				log.Printf("Warning: Could not calculate checksum for %s: %v", filePath, err)
+				checksum = "" // Indicate unknown checksum
+			}
+		}
+		if manifest != nil && checksum != "" && manifest.Checksum != checksum {
+			m.removeCorrupt(imageName, filePath, manifest, fmt.Sprintf("checksum %s does not match %s", checksum, manifest.Checksum))
+			continue
 		}
 
-		m.cache[imageName] = &ImageInfo{
+		image := &ImageInfo{
 			Name:     imageName,
 			Path:     filePath,
 			LastUsed: info.ModTime(), // Use modification time as initial last used
+			CachedAt: info.ModTime(), // Images are read-only once downloaded
 			Size:     info.Size(),
 			Checksum: checksum,
+			Manifest: manifest,
+		}
+		if image.Manifest == nil {
+			image.Manifest = localManifest(image, info.ModTime())
 		}
+		if checksum != "" && !unchangedSinceVerified(image.Manifest, info) {
+			image.Manifest.Verification = &models.ImageVerification{ModTime: info.ModTime().UTC(), VerifiedAt: time.Now().UTC()}
+		}
+		if err := writeManifest(filePath, image.Manifest); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		makeReadOnly(filePath)
+		m.cache[imageName] = image
 		log.Printf("Loaded cached image: %s (%s)", imageName, filePath)
 	}
 }
 
+// removeCorrupt removes a cached image found at startup not to match its
+// manifest, so it is downloaded again. m.mu must be held.
+func (m *Manager) removeCorrupt(imageName, imagePath string, manifest *models.ImageManifest, reason string) {
+	log.Printf("Cached image %s is corrupt: %s, removing it", imageName, reason)
+	if err := removeWithSidecars(imagePath); err != nil {
+		log.Printf("Warning: Could not remove corrupt image %s: %v", imagePath, err)
+	}
+	m.evictions = append(m.evictions, models.ImageEviction{Image: imageName, Digest: manifest.Digest, Reason: models.ImageCorrupt, EvictedAt: time.Now().UTC()})
+	m.countEviction(imageName, models.ImageCorrupt)
+}
+
 // GetCachedImagePath returns the path to a cached image if available and valid.
 // It also updates the LastUsed timestamp.
 func (m *Manager) GetCachedImagePath(imageName string) (string, bool) {
@@ -134,43 +236,54 @@ func (m *Manager) GetCachedImagePath(imageName string) (string, bool) {
 	return "", false
 }
 
-// GetCachedImageNames returns a list of names of all currently cached images.
+// GetCachedImageNames returns a list of names of all currently cached images,
+// leaving out those that failed their smoke test.
 func (m *Manager) GetCachedImageNames() []string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	names := make([]string, 0, len(m.cache))
-	for name := range m.cache {
-		names = append(names, name)
+	for name, info := range m.cache {
+		if !smokeTestFailed(info) {
+			names = append(names, name)
+		}
 	}
 	return names
 }
 
 // RequestImageDownload adds an image to the download queue if not already present or downloading.
-func (m *Manager) RequestImageDownload(imageName string) {
-	m.mu.RLock()
+// The download is traced as part of the trace in ctx. The caller waits for the
+// image until ctx is done; once every caller waiting for a download is done,
+// the download is canceled.
+func (m *Manager) RequestImageDownload(ctx context.Context, imageName string) {
+	m.mu.Lock()
 	info, exists := m.cache[imageName]
-	m.mu.RUnlock()
-
 	if exists && !info.IsDownloading {
+		m.mu.Unlock()
 		log.Printf("Image %s already cached and not downloading.", imageName)
 		return
 	}
 	if exists && info.IsDownloading {
+		if download, ok := m.activeDownloads[imageName]; ok {
+			m.addWaiter(ctx, imageName, download)
+		}
+		m.mu.Unlock()
 		log.Printf("Image %s is already downloading.", imageName)
 		return
 	}
 
 	log.Printf("Requesting download for image: %s", imageName)
 	// Add to cache as downloading
-	m.mu.Lock()
 	m.cache[imageName] = &ImageInfo{
 		Name:          imageName,
 		IsDownloading: true,
 	}
+	download := &pendingDownload{queuedAt: time.Now()}
+	m.activeDownloads[imageName] = download
+	m.addWaiter(ctx, imageName, download)
 	m.mu.Unlock()
 
 	select {
-	case m.downloadQueue <- imageName:
+	case m.downloadQueue <- downloadRequest{imageName: imageName, requester: trace.SpanContextFromContext(ctx), requestID: requestid.FromContext(ctx)}:
 		log.Printf("Image %s added to download queue.", imageName)
 	default:
 		log.Printf("Download queue full for image %s, will retry.", imageName)
@@ -178,6 +291,45 @@ func (m *Manager) RequestImageDownload(imageName string) {
 	}
 }
 
+// addWaiter counts the caller whose request context is ctx as waiting for
+// download until ctx is done. m.mu must be held.
+func (m *Manager) addWaiter(ctx context.Context, imageName string, download *pendingDownload) {
+	download.waiters++
+	context.AfterFunc(ctx, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.activeDownloads[imageName] != download {
+			return // Already finished
+		}
+		download.waiters--
+		if download.waiters > 0 {
+			return
+		}
+		log.Printf("No provision is waiting for image %s anymore, canceling its download.", imageName)
+		download.canceled = true
+		if download.cancel != nil {
+			download.cancel()
+		}
+	})
+}
+
+// DownloadedFunc is told about an image that finished downloading, and
+// passed its smoke test if smoke tests are enabled, with its size in bytes.
+type DownloadedFunc func(imageName string, size int64)
+
+// SetDownloaded makes fn be told about every image that becomes usable
+// after a download, e.g. to emit an event.
+func (m *Manager) SetDownloaded(fn DownloadedFunc) {
+	m.downloaded = fn
+}
+
+// SetCommandRunner makes the manager run its commands, such as df, with r
+// rather than the CommandRunner set with utils.SetCommandRunner, e.g. a
+// utils.ReplayRunner in tests.
+func (m *Manager) SetCommandRunner(r utils.CommandRunner) {
+	m.commands = utils.NewCommands(r)
+}
+
 // IsImageDownloading checks if a specific image is currently being downloaded.
 func (m *Manager) IsImageDownloading(imageName string) bool {
 	m.mu.RLock()
@@ -187,82 +339,161 @@ func (m *Manager) IsImageDownloading(imageName string) bool {
 }
 
 // downloadWorker processes image download requests from the queue.
+// MaxConcurrentDownloads workers run at once.
 func (m *Manager) downloadWorker() {
-	for imageName := range m.downloadQueue {
-		log.Printf("Starting download for image: %s", imageName)
-		ctx, cancel := context.WithCancel(context.Background())
-		m.activeDownloads.Store(imageName, cancel) // Store cancel function
+	for request := range m.downloadQueue {
+		m.processDownload(request)
+	}
+}
 
-		err := m.downloadImageFromGCS(ctx, imageName)
-		m.activeDownloads.Delete(imageName) // Remove cancel function
+// processDownload downloads and smoke tests a queued image. A panic fails
+// only this download, leaving the worker to process the next one.
+func (m *Manager) processDownload(request downloadRequest) {
+	defer utils.Recover("download of image " + request.imageName)
+	imageName := request.imageName
+	m.mu.Lock()
+	download, ok := m.activeDownloads[imageName]
+	if !ok || download.canceled {
+		// Nobody waits for it anymore, so it is never started.
+		delete(m.activeDownloads, imageName)
+		delete(m.cache, imageName)
+		m.mu.Unlock()
+		log.Printf("Skipping canceled download of image %s.", imageName)
+		return
+	}
+	log.Printf("Starting download for image: %s", imageName)
+	requester := requestid.NewContext(trace.ContextWithSpanContext(context.Background(), request.requester), request.requestID)
+	op := m.ops.StartContext(requester, "image-download", imageName)
+	op.SetPhase("downloading")
+	ctx, cancel := context.WithCancel(op.Context())
+	download.cancel = cancel
+	m.mu.Unlock()
 
-		m.mu.Lock()
-		info, ok := m.cache[imageName]
-		if !ok {
-			log.Printf("Error: Image %s disappeared from cache during download.", imageName)
-			m.mu.Unlock()
-			continue
+	err := utils.CatchPanic("download of image "+imageName, func() error {
+		return m.downloadImageFromGCS(ctx, imageName, &download.progress)
+	})
+	m.mu.Lock()
+	delete(m.activeDownloads, imageName)
+	m.mu.Unlock()
+	cancel()
+	op.Fail(err)
+
+	// The image stays marked as downloading, so provisions keep waiting, until it passes.
+	if err == nil && m.smokeTest != nil {
+		op.SetPhase("smoke testing")
+		if err := m.runSmokeTest(op.Context(), imageName); err != nil {
+			log.Printf("Image %s is not usable: %v", imageName, err)
+			op.Fail(err)
 		}
-		info.IsDownloading = false // Mark as no longer downloading
+	}
+
+	m.mu.Lock()
+	info, ok := m.cache[imageName]
+	if !ok {
+		log.Printf("Error: Image %s disappeared from cache during download.", imageName)
 		m.mu.Unlock()
+		op.Done()
+		return
+	}
+	info.IsDownloading = false // Mark as no longer downloading
+	size, usable := info.Size, !smokeTestFailed(info)
+	m.mu.Unlock()
 
-		if err != nil {
-			log.Printf("Failed to download image %s: %v", imageName, err)
-			// On failure, remove from cache so it can be retried
-			m.mu.Lock()
-			delete(m.cache, imageName)
-			m.mu.Unlock()
-		} else {
-			log.Printf("Successfully downloaded and cached image: %s", imageName)
-			m.evictOldImages() // Evict if needed after a successful download
+	if err != nil {
+		log.Printf("Failed to download image %s: %v", imageName, err)
+		// On failure, remove from cache so it can be retried
+		m.mu.Lock()
+		delete(m.cache, imageName)
+		m.mu.Unlock()
+	} else {
+		log.Printf("Successfully downloaded and cached image: %s", imageName)
+		if m.metrics != nil {
+			m.metrics.Downloaded(imageName, size)
 		}
+		if m.downloaded != nil && usable {
+			m.downloaded(imageName, size)
+		}
+		op.SetPhase("evicting old images")
+		m.evictOldImages() // Evict if needed after a successful download
 	}
+	m.downloadFinished(imageName, err)
+	op.Done()
 }
 
-// downloadImageFromGCS downloads an image from GCP Cloud Storage.
+// downloadImageFromGCS downloads an image from GCP Cloud Storage, as stored
+// in any of the formats resolveSource looks for, and reports how far it got
+// to progress.
 // Assumes blob name in GCS is the same as imageName (e.g., "macos-sonoma.dmg").
-func (m *Manager) downloadImageFromGCS(ctx context.Context, imageName string) error {
-	bucket := m.gcsClient.Bucket(m.cfg.GCSBucketName)
-	obj := bucket.Object(imageName) // Assuming image name is the object name in GCS
-
-	reader, err := obj.NewReader(ctx)
+func (m *Manager) downloadImageFromGCS(ctx context.Context, imageName string, progress *downloadProgress) error {
+	src, err := m.resolveSource(ctx, imageName)
 	if err != nil {
-		return fmt.Errorf("failed to create GCS object reader for %s: %w", imageName, err)
+		return err
+	}
+	log.Printf("Downloading image %s from %s (%s)", imageName, src.object, src.format)
+	progress.start(src.object, src.size)
+
+	// Make room up front rather than failing halfway with a full disk.
+	if err := m.EnsureFreeSpace(m.cfg.ImageCacheDir, src.size, imageName); err != nil {
+		return err
 	}
-	defer reader.Close()
 
 	destPath := filepath.Join(m.cfg.ImageCacheDir, imageName)
-	file, err := os.Create(destPath)
+	partialPath := destPath + partialSuffix
+	file, err := os.Create(partialPath)
 	if err != nil {
-		return fmt.Errorf("failed to create local file %s: %w", destPath, err)
+		return fmt.Errorf("failed to create local file %s: %w", partialPath, err)
 	}
 	defer file.Close()
 
 	hash := sha256.New()
-	mw := io.MultiWriter(file, hash)
+	mw := io.MultiWriter(file, hash, progress)
 
-	bytesCopied, err := io.Copy(mw, reader)
+	bytesCopied, err := m.fetch(ctx, src, destPath, mw)
+	if err == nil {
+		err = file.Sync()
+	}
 	if err != nil {
-		os.Remove(destPath) // Clean up partial download
-		return fmt.Errorf("failed to copy data to %s: %w", destPath, err)
+		os.Remove(partialPath) // Clean up partial download
+		return fmt.Errorf("failed to copy data to %s: %w", partialPath, err)
 	}
 
 	// Get expected checksum from GCS metadata if available, or from a local registry
 	// For simplicity, we'll assume the orchestrator or a separate registry provides this.
-	// For now, we'll just calculate and store it.
+	// For now, we'll just calculate and store it. Chunk indexes may carry one.
 	calculatedChecksum := hex.EncodeToString(hash.Sum(nil))
+	if src.index != nil && src.index.SHA256 != "" && src.index.SHA256 != calculatedChecksum {
+		os.Remove(partialPath)
+		os.Remove(destPath + ChunkIndexSuffix)
+		return fmt.Errorf("assembled image %s has checksum %s, expected %s", imageName, calculatedChecksum, src.index.SHA256)
+	}
+	if err := os.Rename(partialPath, destPath); err != nil {
+		os.Remove(partialPath)
+		return fmt.Errorf("failed to move %s into place: %w", partialPath, err)
+	}
 	log.Printf("Downloaded %s, size: %d bytes, checksum: %s", imageName, bytesCopied, calculatedChecksum)
+	makeReadOnly(destPath)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("macvmagt.image.bytes", bytesCopied))
 
-	// Update cache entry with full details
-	m.mu.Lock()
-	m.cache[imageName] = &ImageInfo{
+	image := &ImageInfo{
 		Name:          imageName,
 		Path:          destPath,
 		LastUsed:      time.Now(),
+		CachedAt:      time.Now(),
 		Size:          bytesCopied,
 		Checksum:      calculatedChecksum,
-		IsDownloading: false,
+		IsDownloading: m.smokeTest != nil, // Not usable until the smoke test passes
+	}
+	image.Manifest = m.downloadedManifest(image, src)
+	if stat, err := os.Stat(destPath); err == nil {
+		image.Manifest.Verification = &models.ImageVerification{ModTime: stat.ModTime().UTC(), VerifiedAt: time.Now().UTC()}
+	}
+	if err := writeManifest(destPath, image.Manifest); err != nil {
+		log.Printf("Warning: %v", err)
 	}
+
+	// Update cache entry with full details
+	m.mu.Lock()
+	m.cache[imageName] = image
 	m.mu.Unlock()
 
 	return nil
@@ -282,43 +513,27 @@ func (m *Manager) evictOldImages() {
 	// Convert map to slice for sorting
 	var images []*ImageInfo
 	for _, info := range m.cache {
-		if !info.IsDownloading { // Don't evict images currently being downloaded
+		if !info.IsDownloading && !isTemplate(info) { // Don't evict images currently being downloaded, or templates that can't be downloaded again
 			images = append(images, info)
 		}
 	}
 
-	// Sort by LastUsed (oldest first)
-	sort.Slice(images, func(i, j int) bool {
-		return images[i].LastUsed.Before(images[j].LastUsed)
-	})
+	// Sort by LastUsed (oldest first), keeping desired images longest
+	sortForEviction(images, m.listedImages())
 
 	// Evict until we are within the limit
 	for len(images) > m.cfg.MaxCachedImages {
 		imageToEvict := images[0]
 		log.Printf("Evicting image: %s (last used: %s)", imageToEvict.Name, imageToEvict.LastUsed.Format(time.RFC3339))
 
-		if err := os.Remove(imageToEvict.Path); err != nil {
+		if err := removeWithSidecars(imageToEvict.Path); err != nil {
 			log.Printf("Error evicting file %s: %v", imageToEvict.Path, err)
 			// If we can't remove the file, don't remove it from cache either,
 			// it might be in use or permissions issue.
 		} else {
 			delete(m.cache, imageToEvict.Name)
+			m.countEviction(imageToEvict.Name, models.ImageEvictedLRU)
 			images = images[1:] // Remove from the slice
 		}
 	}
 }
-
-// calculateFileChecksum calculates the SHA256 checksum of a file.
-func calculateFileChecksum(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to open file %s: %w", filePath, err)
-	}
-	defer file.Close()
-
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", fmt.Errorf("failed to calculate checksum for %s: %w", filePath, err)
-	}
-	return hex.EncodeToString(hash.Sum(nil)), nil
-}
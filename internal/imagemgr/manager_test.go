@@ -0,0 +1,112 @@
+package imagemgr
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/fakedriver"
+	"github.com/changty97/macvmagt/internal/operations"
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// newReplayManager returns a Manager caching the fake driver's stub images
+// in images/ under a new working directory, whose commands are replayed from
+// the fixture file testdata/<fixture>.jsonl. The cache directory is relative,
+// so the fixtures name it the same on every run.
+func newReplayManager(t *testing.T, fixture string) *Manager {
+	t.Helper()
+	replayer, err := utils.NewReplayRunner(filepath.Join("testdata", fixture+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(t.TempDir())
+	m, err := NewManager(&config.Config{Driver: fakedriver.Name, ImageCacheDir: "images", MaxCachedImages: 2}, operations.NewTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	m.SetCommandRunner(replayer)
+	return m
+}
+
+// waitForDownload waits for the download of an image to finish.
+func waitForDownload(t *testing.T, m *Manager, imageName string) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Minute); m.IsImageDownloading(imageName); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("image %s is still downloading", imageName)
+		}
+	}
+}
+
+func TestDownloadAndVerifyImage(t *testing.T) {
+	m := newReplayManager(t, "download")
+
+	m.RequestImageDownload(context.Background(), "macos-15")
+	waitForDownload(t, m, "macos-15")
+	path, ok := m.GetCachedImagePath("macos-15")
+	if !ok {
+		t.Fatal("downloaded image is not cached")
+	}
+	if path != filepath.Join("images", "macos-15") {
+		t.Errorf("image cached at %s", path)
+	}
+	if _, err := os.Stat(path + partialSuffix); !os.IsNotExist(err) {
+		t.Errorf("partial download left behind: %v", err)
+	}
+
+	result, err := m.VerifyImage(context.Background(), "macos-15", true)
+	if err != nil || !result.Passed || result.Actual != result.Checksum {
+		t.Fatalf("VerifyImage = %+v, %v, want it to pass", result, err)
+	}
+
+	// A cached image that no longer matches its manifest is evicted.
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err = m.VerifyImage(context.Background(), "macos-15", false)
+	if err != nil || result.Passed || !result.Evicted {
+		t.Fatalf("VerifyImage of corrupt image = %+v, %v, want it evicted", result, err)
+	}
+	if _, ok := m.GetCachedImagePath("macos-15"); ok {
+		t.Error("corrupt image is still cached")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("corrupt image left on disk: %v", err)
+	}
+	if _, err := m.VerifyImage(context.Background(), "macos-15", true); !errors.Is(err, ErrImageNotCached) {
+		t.Errorf("VerifyImage of evicted image: %v, want ErrImageNotCached", err)
+	}
+}
+
+func TestDownloadImageNoSpace(t *testing.T) {
+	m := newReplayManager(t, "download-no-space")
+
+	m.RequestImageDownload(context.Background(), "macos-15")
+	waitForDownload(t, m, "macos-15")
+	if _, ok := m.GetCachedImagePath("macos-15"); ok {
+		t.Fatal("image cached without room for it")
+	}
+	entries, err := os.ReadDir("images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != runningMarker {
+			t.Errorf("failed download left %s behind", entry.Name())
+		}
+	}
+	for _, op := range m.ops.List() {
+		if op.Kind == "image-download" && op.Phase != "downloading" {
+			t.Errorf("failed download went on to %s", op.Phase)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package imagemgr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// GCS object metadata keys read into the manifest of a downloaded image.
+const (
+	metadataMacOSVersion  = "macos-version"
+	metadataHardwareModel = "hardware-model"
+	metadataArch          = "arch"
+)
+
+// ManifestSuffix names the manifest cached next to each disk image.
+const ManifestSuffix = ".manifest.json"
+
+// manifestDigest returns the SHA256 of a manifest's fields other than Digest,
+// SmokeTest, Clones, Verification and Tools, so recording a test result, the
+// image's use, a verification or an introspection doesn't change its identity.
+func manifestDigest(manifest models.ImageManifest) (string, error) {
+	manifest.Digest = ""
+	manifest.SmokeTest = nil
+	manifest.Clones = nil
+	manifest.Verification = nil
+	manifest.Tools = nil
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// writeManifest sets the digest of manifest and writes it next to the image.
+func writeManifest(imagePath string, manifest *models.ImageManifest) error {
+	digest, err := manifestDigest(*manifest)
+	if err != nil {
+		return fmt.Errorf("failed to compute manifest digest for %s: %w", manifest.Name, err)
+	}
+	manifest.Digest = digest
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest for %s: %w", manifest.Name, err)
+	}
+	if err := os.WriteFile(imagePath+ManifestSuffix, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest for %s: %w", manifest.Name, err)
+	}
+	return nil
+}
+
+// readManifest reads the manifest cached next to an image. It returns nil if
+// there is none or it can't be read.
+func readManifest(imagePath string) *models.ImageManifest {
+	data, err := os.ReadFile(imagePath + ManifestSuffix)
+	if err != nil {
+		return nil
+	}
+	var manifest models.ImageManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		log.Printf("Warning: Ignoring unreadable manifest of %s: %v", imagePath, err)
+		return nil
+	}
+	return &manifest
+}
+
+// localHardwareModels returns the hardware model cached next to an image, if any.
+func localHardwareModels(imagePath string) []string {
+	data, err := os.ReadFile(imagePath + HardwareModelSuffix)
+	if err != nil {
+		return nil
+	}
+	model := strings.TrimSpace(string(data))
+	if err := ValidateHardwareModel(model); err != nil {
+		log.Printf("Warning: Ignoring hardware model of %s: %v", imagePath, err)
+		return nil
+	}
+	return []string{model}
+}
+
+// downloadedManifest builds the manifest of an image just downloaded from GCS,
+// taking its version details from the source object's metadata. A hardware
+// model in the metadata is also cached as the image's hardware model sidecar,
+// unless one is already there.
+func (m *Manager) downloadedManifest(info *ImageInfo, src *imageSource) *models.ImageManifest {
+	manifest := &models.ImageManifest{
+		Name:      info.Name,
+		SourceURI: fmt.Sprintf("gs://%s/%s", m.cfg.GCSBucketName, src.object),
+		Checksum:  info.Checksum,
+		Size:      info.Size,
+		CreatedAt: src.attrs.Created,
+	}
+	manifest.MacOSVersion = src.attrs.Metadata[metadataMacOSVersion]
+	manifest.Arch = NormalizeArch(src.attrs.Metadata[metadataArch])
+	if model := src.attrs.Metadata[metadataHardwareModel]; model != "" {
+		if _, err := os.Stat(info.Path + HardwareModelSuffix); os.IsNotExist(err) {
+			if err := os.WriteFile(info.Path+HardwareModelSuffix, []byte(model), 0644); err != nil {
+				log.Printf("Warning: Could not cache hardware model of %s: %v", info.Name, err)
+			}
+		}
+	}
+	manifest.HardwareModels = localHardwareModels(info.Path)
+	manifest.Tools = toolsFromMetadata(src.attrs.Metadata)
+	return manifest
+}
+
+// localManifest builds the manifest of an image found in the cache without one,
+// e.g. cached by an older agent. Its source is unknown.
+func localManifest(info *ImageInfo, modTime time.Time) *models.ImageManifest {
+	return &models.ImageManifest{
+		Name:           info.Name,
+		Checksum:       info.Checksum,
+		Size:           info.Size,
+		CreatedAt:      modTime,
+		HardwareModels: localHardwareModels(info.Path),
+	}
+}
+
+// Manifests returns the manifests of all cached images, sorted by name.
+func (m *Manager) Manifests() []models.ImageManifest {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	manifests := make([]models.ImageManifest, 0, len(m.cache))
+	for _, info := range m.cache {
+		if info.Manifest != nil {
+			manifests = append(manifests, *info.Manifest)
+		}
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Name < manifests[j].Name })
+	return manifests
+}
+
+// ManifestDigests returns the manifest digest of each cached image, keyed by image name.
+func (m *Manager) ManifestDigests() map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	digests := make(map[string]string, len(m.cache))
+	for name, info := range m.cache {
+		if info.Manifest != nil {
+			digests[name] = info.Manifest.Digest
+		}
+	}
+	return digests
+}
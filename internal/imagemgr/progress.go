@@ -0,0 +1,95 @@
+package imagemgr
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// rateSampleInterval is how often the transfer rate of a download is sampled.
+const rateSampleInterval = time.Second
+
+// rateSmoothing is the weight of the latest sample in a download's rate, so
+// the ETA doesn't jump around with every hiccup of the network.
+const rateSmoothing = 0.3
+
+// downloadProgress tracks how much of an image has been written. It is the
+// io.Writer the downloaded image goes through.
+type downloadProgress struct {
+	mu          sync.Mutex
+	source      string // GCS object being downloaded
+	total       int64  // Size of the image once downloaded; 0 while unknown
+	done        int64
+	startedAt   time.Time
+	rate        float64 // Smoothed bytes per second
+	sampledAt   time.Time
+	sampledDone int64
+}
+
+// start records that the download of source began, for an image of total bytes.
+func (p *downloadProgress) start(source string, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.source, p.total = source, total
+	p.startedAt = time.Now()
+	p.sampledAt = p.startedAt
+}
+
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += int64(len(b))
+	if elapsed := time.Since(p.sampledAt); elapsed >= rateSampleInterval {
+		sample := float64(p.done-p.sampledDone) / elapsed.Seconds()
+		if p.rate == 0 {
+			p.rate = sample
+		} else {
+			p.rate = rateSmoothing*sample + (1-rateSmoothing)*p.rate
+		}
+		p.sampledAt, p.sampledDone = time.Now(), p.done
+	}
+	return len(b), nil
+}
+
+// report fills in the progress of a download that started.
+func (p *downloadProgress) report(download *models.ImageDownload) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.startedAt.IsZero() {
+		return
+	}
+	startedAt := p.startedAt.UTC()
+	download.State = models.DownloadDownloading
+	download.StartedAt = &startedAt
+	download.Source = p.source
+	download.BytesDone = p.done
+	download.BytesTotal = p.total
+	download.BytesPerSecond = int64(p.rate)
+	if p.rate > 0 && p.total > p.done {
+		download.ETASeconds = int64(float64(p.total-p.done) / p.rate)
+	}
+}
+
+// Downloads returns the image downloads queued or in progress, oldest first.
+func (m *Manager) Downloads() []models.ImageDownload {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	downloads := make([]models.ImageDownload, 0, len(m.activeDownloads))
+	for imageName, pending := range m.activeDownloads {
+		if pending.canceled {
+			continue
+		}
+		download := models.ImageDownload{
+			Image:    imageName,
+			State:    models.DownloadQueued,
+			Waiters:  pending.waiters,
+			QueuedAt: pending.queuedAt.UTC(),
+		}
+		pending.progress.report(&download)
+		downloads = append(downloads, download)
+	}
+	sort.Slice(downloads, func(i, j int) bool { return downloads[i].QueuedAt.Before(downloads[j].QueuedAt) })
+	return downloads
+}
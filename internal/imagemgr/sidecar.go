@@ -0,0 +1,81 @@
+package imagemgr
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"howett.net/plist"
+)
+
+// Sidecar files are cached next to a disk image and share its path plus a suffix.
+const (
+	AuxSuffix           = ".aux"     // Auxiliary storage image
+	HardwareModelSuffix = ".hwmodel" // Base64 Virtualization framework hardware model the image was installed on
+)
+
+var sidecarSuffixes = []string{AuxSuffix, HardwareModelSuffix, ManifestSuffix, ChunkIndexSuffix}
+
+// isSidecar reports whether a cache directory entry belongs to a disk image
+// rather than being an image itself.
+func isSidecar(name string) bool {
+	for _, suffix := range sidecarSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeWithSidecars removes a cached image together with its sidecar files.
+func removeWithSidecars(imagePath string) error {
+	if err := os.Remove(imagePath); err != nil {
+		return err
+	}
+	for _, suffix := range sidecarSuffixes {
+		if err := os.Remove(imagePath + suffix); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to remove %s: %v", imagePath+suffix, err)
+		}
+	}
+	return nil
+}
+
+// HardwareModel returns the hardware model stored next to a cached image, or
+// "" if the image has none.
+func (m *Manager) HardwareModel(imageName string) (string, error) {
+	m.mu.RLock()
+	info, ok := m.cache[imageName]
+	m.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("image %s is not cached", imageName)
+	}
+
+	data, err := os.ReadFile(info.Path + HardwareModelSuffix)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read hardware model of image %s: %w", imageName, err)
+	}
+	model := strings.TrimSpace(string(data))
+	if err := ValidateHardwareModel(model); err != nil {
+		return "", fmt.Errorf("image %s: %w", imageName, err)
+	}
+	return model, nil
+}
+
+// ValidateHardwareModel checks that model is a base64-encoded property list,
+// the form the Virtualization framework serializes hardware models in.
+func ValidateHardwareModel(model string) error {
+	data, err := base64.StdEncoding.DecodeString(model)
+	if err != nil {
+		return fmt.Errorf("hardware model is not valid base64: %w", err)
+	}
+	var fields map[string]interface{}
+	if _, err := plist.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("hardware model is not a property list: %w", err)
+	}
+	return nil
+}
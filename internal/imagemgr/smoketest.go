@@ -0,0 +1,117 @@
+package imagemgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// maxSmokeTestDetail bounds the detail recorded in a manifest; longer output keeps its end.
+const maxSmokeTestDetail = 2048
+
+// ErrSmokeTestFailed is returned for an image whose cached copy failed its smoke test.
+var ErrSmokeTestFailed = errors.New("image failed its smoke test")
+
+// SmokeTestFunc boots a throwaway VM from the image at imagePath and validates
+// it, returning the validation output. While the VM is up it also inspects
+// the tools installed in the image, returning nil tools if that fails.
+type SmokeTestFunc func(ctx context.Context, imageName, imagePath string) (string, *models.ImageTools, error)
+
+// SetSmokeTest makes newly downloaded images pass fn before they are usable.
+// Booting a VM is the VM manager's job, so it provides fn.
+func (m *Manager) SetSmokeTest(fn SmokeTestFunc) {
+	m.smokeTest = fn
+}
+
+// runSmokeTest smoke tests a just-downloaded image and records the result,
+// and the tools found in the image, in its manifest. It returns an error wrapping ErrSmokeTestFailed if it failed.
+func (m *Manager) runSmokeTest(ctx context.Context, imageName string) error {
+	m.mu.RLock()
+	info, ok := m.cache[imageName]
+	m.mu.RUnlock()
+	if !ok || info.Manifest == nil {
+		return fmt.Errorf("image %s has no manifest to record its smoke test in", imageName)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.cfg.ImageSmokeTestTimeout)
+	defer cancel()
+	start := time.Now()
+	detail, tools, err := m.smokeTest(ctx, imageName, info.Path)
+	if err != nil {
+		detail = err.Error()
+	}
+	if len(detail) > maxSmokeTestDetail {
+		detail = "..." + detail[len(detail)-maxSmokeTestDetail:]
+	}
+	result := &models.ImageSmokeTest{
+		Passed:     err == nil,
+		Detail:     detail,
+		TestedAt:   start.UTC(),
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+
+	m.mu.Lock()
+	info.Manifest.SmokeTest = result
+	if tools != nil {
+		info.Manifest.Tools = tools
+	}
+	manifest := *info.Manifest
+	m.mu.Unlock()
+	if err := writeManifest(info.Path, &manifest); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSmokeTestFailed, err)
+	}
+	log.Printf("Image %s passed its smoke test in %s", imageName, time.Since(start).Round(time.Second))
+	return nil
+}
+
+// CheckUsable verifies the cached copy of an image as ImageVerify says, and
+// returns an error wrapping ErrSmokeTestFailed if it failed its smoke test.
+// A corrupt copy is evicted, and so is a failed one if the GCS object has been
+// replaced since, so the image gets downloaded again.
+func (m *Manager) CheckUsable(ctx context.Context, imageName string) error {
+	if err := m.verifyBeforeUse(ctx, imageName); err != nil {
+		return err
+	}
+	m.mu.RLock()
+	info, ok := m.cache[imageName]
+	failed := ok && smokeTestFailed(info)
+	var createdAt time.Time
+	var result models.ImageSmokeTest
+	if failed {
+		createdAt = info.Manifest.CreatedAt
+		result = *info.Manifest.SmokeTest
+	}
+	m.mu.RUnlock()
+	if !failed {
+		return nil
+	}
+
+	src, err := m.resolveSource(ctx, imageName)
+	if err == nil && src.attrs.Created.After(createdAt) {
+		log.Printf("Image %s was replaced in GCS since it failed its smoke test, evicting the cached copy", imageName)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.cache[imageName] == info {
+			if err := removeWithSidecars(info.Path); err != nil {
+				return fmt.Errorf("failed to evict image %s that failed its smoke test: %w", imageName, err)
+			}
+			delete(m.cache, imageName)
+			m.countEviction(imageName, models.ImageReplaced)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s (tested %s): %s", ErrSmokeTestFailed, imageName, result.TestedAt.Format(time.RFC3339), result.Detail)
+}
+
+// smokeTestFailed reports whether an image's cached copy failed its smoke test.
+func smokeTestFailed(info *ImageInfo) bool {
+	return info.Manifest != nil && info.Manifest.SmokeTest != nil && !info.Manifest.SmokeTest.Passed
+}
@@ -0,0 +1,102 @@
+package imagemgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// ErrInsufficientStorage is returned when a download or clone can't fit on
+// disk even after evicting cached images.
+var ErrInsufficientStorage = errors.New("insufficient disk space")
+
+// ImageSize returns the size in bytes of an image, from the cache if it is
+// already downloaded and from its GCS object otherwise. The size of a
+// compressed object is that of the image once decompressed.
+func (m *Manager) ImageSize(ctx context.Context, imageName string) (int64, error) {
+	m.mu.RLock()
+	info, ok := m.cache[imageName]
+	m.mu.RUnlock()
+	if ok && !info.IsDownloading && info.Size > 0 {
+		return info.Size, nil
+	}
+
+	src, err := m.resolveSource(ctx, imageName)
+	if err != nil {
+		return 0, err
+	}
+	return src.size, nil
+}
+
+// EnsureFreeSpace makes sure the volume holding path has room for needed bytes
+// plus the configured reserve. If it doesn't and the image cache lives on the
+// same volume, least recently used images other than keep are evicted until it
+// does. ErrInsufficientStorage is returned if space still can't be freed.
+func (m *Manager) EnsureFreeSpace(path string, needed int64, keep string) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", path, err)
+	}
+	required := needed + m.cfg.DiskSpaceReserve
+
+	free, volume, err := m.commands.GetFreeDiskSpace(path)
+	if err != nil {
+		return err
+	}
+	if free >= required {
+		return nil
+	}
+
+	_, cacheVolume, err := m.commands.GetFreeDiskSpace(m.cfg.ImageCacheDir)
+	if err != nil {
+		return err
+	}
+	if cacheVolume == volume {
+		for free < required {
+			evicted, ok := m.evictOldestImage(keep)
+			if !ok {
+				break
+			}
+			log.Printf("Evicted image %s to free disk space on %s", evicted, volume)
+			if free, _, err = m.commands.GetFreeDiskSpace(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	if free < required {
+		return fmt.Errorf("%w on %s: need %d bytes (including %d reserved), %d available",
+			ErrInsufficientStorage, volume, required, m.cfg.DiskSpaceReserve, free)
+	}
+	return nil
+}
+
+// evictOldestImage removes the least recently used cached image other than
+// keep and templates, preferring images that aren't desired, and returns its
+// name, or false if nothing could be evicted.
+func (m *Manager) evictOldestImage(keep string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var images []*ImageInfo
+	for _, info := range m.cache {
+		if !info.IsDownloading && !isTemplate(info) && info.Name != keep && info.Path != "" {
+			images = append(images, info)
+		}
+	}
+	sortForEviction(images, m.listedImages())
+
+	for _, info := range images {
+		if err := removeWithSidecars(info.Path); err != nil {
+			log.Printf("Error evicting file %s: %v", info.Path, err)
+			continue
+		}
+		delete(m.cache, info.Name)
+		m.countEviction(info.Name, models.ImageEvictedSpace)
+		return info.Name, true
+	}
+	return "", false
+}
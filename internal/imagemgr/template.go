@@ -0,0 +1,142 @@
+package imagemgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// ErrNotTemplate is returned when capturing a template under the name of an
+// image downloaded from GCS.
+var ErrNotTemplate = errors.New("image is not a template")
+
+// TemplateWriter writes the disk of the VM a template is captured from to
+// diskPath, and its aux image, if it has one, to auxPath.
+type TemplateWriter func(ctx context.Context, diskPath, auxPath string) error
+
+// isTemplate reports whether a cached image was captured from a VM.
+func isTemplate(info *ImageInfo) bool {
+	return info.Manifest != nil && info.Manifest.SourceVM != ""
+}
+
+// AddTemplate caches the current disk of VM vmID, written by write, as the
+// image name, so VMs can be provisioned from it like from any cached image.
+// It replaces an earlier template of the same name unless VMs use it, but
+// never an image downloaded from GCS.
+func (m *Manager) AddTemplate(ctx context.Context, name, vmID, hardwareModel string, write TemplateWriter) (models.ImageManifest, error) {
+	if err := m.checkReplaceable(name); err != nil {
+		return models.ImageManifest{}, err
+	}
+
+	destPath := filepath.Join(m.cfg.ImageCacheDir, name)
+	// Named after the VM, so concurrent captures under one name don't collide,
+	// and ending in partialSuffix, so an interrupted capture is cleaned up at startup.
+	tmpPath := fmt.Sprintf("%s.%s%s", destPath, vmID, partialSuffix)
+	tmpAuxPath := strings.TrimSuffix(tmpPath, partialSuffix) + AuxSuffix + partialSuffix
+	cleanup := func() {
+		os.Remove(tmpPath)
+		os.Remove(tmpAuxPath)
+	}
+	if err := write(ctx, tmpPath, tmpAuxPath); err != nil {
+		cleanup()
+		return models.ImageManifest{}, fmt.Errorf("failed to copy the disk of VM %s: %w", vmID, err)
+	}
+	checksum, err := hashFile(ctx, tmpPath)
+	if err != nil {
+		cleanup()
+		return models.ImageManifest{}, err
+	}
+	stat, err := os.Stat(tmpPath)
+	if err != nil {
+		cleanup()
+		return models.ImageManifest{}, fmt.Errorf("failed to stat %s: %w", tmpPath, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkReplaceableLocked(name); err != nil {
+		cleanup()
+		return models.ImageManifest{}, err
+	}
+	if _, ok := m.cache[name]; ok {
+		if err := removeWithSidecars(destPath); err != nil && !os.IsNotExist(err) {
+			cleanup()
+			return models.ImageManifest{}, fmt.Errorf("failed to replace template %s: %w", name, err)
+		}
+		delete(m.cache, name)
+	}
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		cleanup()
+		return models.ImageManifest{}, fmt.Errorf("failed to move %s into place: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpAuxPath, destPath+AuxSuffix); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: Could not cache the aux image of template %s: %v", name, err)
+	}
+	if hardwareModel != "" {
+		if err := os.WriteFile(destPath+HardwareModelSuffix, []byte(hardwareModel), 0644); err != nil {
+			log.Printf("Warning: Could not cache hardware model of template %s: %v", name, err)
+		}
+	}
+	makeReadOnly(destPath)
+
+	image := &ImageInfo{
+		Name:     name,
+		Path:     destPath,
+		LastUsed: time.Now(),
+		CachedAt: time.Now(),
+		Size:     stat.Size(),
+		Checksum: checksum,
+	}
+	image.Manifest = &models.ImageManifest{
+		Name:           name,
+		SourceURI:      "vm://" + vmID,
+		Checksum:       checksum,
+		Size:           stat.Size(),
+		CreatedAt:      time.Now().UTC(),
+		HardwareModels: localHardwareModels(destPath),
+		Arch:           m.hostArch, // Captured from a VM that ran on the host
+		SourceVM:       vmID,
+	}
+	if stat, err := os.Stat(destPath); err == nil {
+		image.Manifest.Verification = &models.ImageVerification{ModTime: stat.ModTime().UTC(), VerifiedAt: time.Now().UTC()}
+	}
+	if err := writeManifest(destPath, image.Manifest); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	m.cache[name] = image
+	log.Printf("Captured VM %s as template %s (%d bytes, checksum %s)", vmID, name, image.Size, checksum)
+	return *image.Manifest, nil
+}
+
+// checkReplaceable checks that a template can be captured under name.
+func (m *Manager) checkReplaceable(name string) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.checkReplaceableLocked(name)
+}
+
+// checkReplaceableLocked is checkReplaceable with m.mu held.
+func (m *Manager) checkReplaceableLocked(name string) error {
+	info, ok := m.cache[name]
+	switch {
+	case !ok:
+		return nil
+	case info.IsDownloading:
+		return fmt.Errorf("%w: %s", ErrImageDownloading, name)
+	case !isTemplate(info):
+		return fmt.Errorf("%w: %s was downloaded from GCS", ErrNotTemplate, name)
+	}
+	if m.inUse != nil {
+		if vmIDs := m.inUse(name); len(vmIDs) > 0 {
+			return fmt.Errorf("%w %s", ErrImageInUse, strings.Join(vmIDs, ", "))
+		}
+	}
+	return nil
+}
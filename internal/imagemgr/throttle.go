@@ -0,0 +1,88 @@
+package imagemgr
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// downloadBurst is the most bytes a rate-limited download reads at once.
+const downloadBurst = 256 << 10
+
+// busyCheckInterval is how often downloads check whether VMs are running jobs.
+const busyCheckInterval = 10 * time.Second
+
+// BusyFunc reports whether VMs are running jobs.
+type BusyFunc func() bool
+
+// SetBusy slows downloads to DownloadBusyRateLimit while fn reports VMs
+// running jobs, so image downloads don't starve them of bandwidth. The VM
+// manager knows what VMs are doing, so it provides fn.
+func (m *Manager) SetBusy(fn BusyFunc) {
+	m.busy = fn
+}
+
+// bandwidth is the download bandwidth shared by all image downloads.
+type bandwidth struct {
+	limiter   *rate.Limiter
+	mu        sync.Mutex // Protects busy and checkedAt
+	busy      bool       // Whether VMs were running jobs when last checked
+	checkedAt time.Time
+}
+
+// downloadRate returns the current limit on the combined download rate:
+// DownloadRateLimit, or DownloadBusyRateLimit if it is lower and VMs are
+// running jobs.
+func (m *Manager) downloadRate() rate.Limit {
+	b := &m.bandwidth
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if m.busy != nil && m.cfg.DownloadBusyRateLimit > 0 && time.Since(b.checkedAt) >= busyCheckInterval {
+		busy := m.busy()
+		if busy != b.busy {
+			if busy {
+				log.Printf("VMs are running jobs, slowing image downloads to %d bytes/s", m.cfg.DownloadBusyRateLimit)
+			} else {
+				log.Printf("No VM is running a job, image downloads are no longer slowed down")
+			}
+		}
+		b.busy, b.checkedAt = busy, time.Now()
+	}
+
+	limit := m.cfg.DownloadRateLimit
+	if b.busy && m.cfg.DownloadBusyRateLimit > 0 && (limit <= 0 || m.cfg.DownloadBusyRateLimit < limit) {
+		limit = m.cfg.DownloadBusyRateLimit
+	}
+	if limit <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(limit)
+}
+
+// throttledReader reads an image download no faster than downloadRate allows.
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	m   *Manager
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	limiter := t.m.bandwidth.limiter
+	if limit := t.m.downloadRate(); limiter.Limit() != limit {
+		limiter.SetLimit(limit)
+	}
+	if len(p) > downloadBurst {
+		p = p[:downloadBurst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if err := limiter.WaitN(t.ctx, n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
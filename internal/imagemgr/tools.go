@@ -0,0 +1,221 @@
+package imagemgr
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// GCS object metadata keys describing the tools installed in an image, as
+// comma-separated lists where there can be several.
+const (
+	metadataMacOSBuild    = "macos-build"
+	metadataXcodeVersions = "xcode-versions"
+	metadataSDKs          = "sdks"
+)
+
+// ErrRequirementsNotMet is returned when a cached image doesn't satisfy a
+// provision request's image requirements.
+var ErrRequirementsNotMet = errors.New("image does not meet requirements")
+
+// toolsFromMetadata reads an image's tools from its GCS object metadata. It
+// returns nil if the metadata lists no Xcode version, build or SDK.
+func toolsFromMetadata(metadata map[string]string) *models.ImageTools {
+	tools := &models.ImageTools{
+		MacOSVersion: metadata[metadataMacOSVersion],
+		MacOSBuild:   metadata[metadataMacOSBuild],
+		Xcode:        splitList(metadata[metadataXcodeVersions]),
+		SDKs:         splitList(metadata[metadataSDKs]),
+		Source:       models.ImageToolsMetadata,
+		InspectedAt:  time.Now().UTC(),
+	}
+	if tools.MacOSBuild == "" && len(tools.Xcode) == 0 && len(tools.SDKs) == 0 {
+		return nil
+	}
+	return tools
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ImageTools returns the tools of each cached image whose tools are known,
+// keyed by image name.
+func (m *Manager) ImageTools() map[string]models.ImageTools {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	tools := make(map[string]models.ImageTools)
+	for name, info := range m.cache {
+		if info.Manifest != nil && info.Manifest.Tools != nil {
+			tools[name] = *info.Manifest.Tools
+		}
+	}
+	return tools
+}
+
+// CheckRequirements checks a cached image against a provision request's
+// image requirements, returning an error wrapping ErrRequirementsNotMet for
+// the first that doesn't hold. An image that isn't cached yet or is still
+// downloading passes, and is checked again once it is ready.
+//
+// A requirement is <name><operator><version>, where the operator is one of
+// =, ==, !=, <, <=, > or >=, and the name is "xcode" (met if any installed
+// Xcode version is), "macos", "macos-build", or an SDK platform such as
+// "iphoneos" (met if any SDK of that platform is).
+func (m *Manager) CheckRequirements(imageName string, requirements []string) error {
+	if len(requirements) == 0 {
+		return nil
+	}
+	m.mu.RLock()
+	info, ok := m.cache[imageName]
+	var manifest models.ImageManifest
+	ready := ok && !info.IsDownloading && info.Manifest != nil
+	if ready {
+		manifest = *info.Manifest
+	}
+	m.mu.RUnlock()
+	if !ready {
+		return nil
+	}
+
+	tools := models.ImageTools{MacOSVersion: manifest.MacOSVersion}
+	if manifest.Tools != nil {
+		tools = *manifest.Tools
+		if tools.MacOSVersion == "" {
+			tools.MacOSVersion = manifest.MacOSVersion
+		}
+	}
+	for _, requirement := range requirements {
+		name, op, want, err := parseRequirement(requirement)
+		if err != nil {
+			return err
+		}
+		var candidates []string
+		switch name {
+		case "xcode":
+			candidates = tools.Xcode
+		case "macos":
+			candidates = []string{tools.MacOSVersion}
+		case "macos-build":
+			candidates = []string{tools.MacOSBuild}
+		default:
+			for _, sdk := range tools.SDKs {
+				if platform, version := splitSDK(sdk); platform == name {
+					candidates = append(candidates, version)
+				}
+			}
+		}
+		if !anyVersionMatches(candidates, op, want) {
+			if manifest.Tools == nil && name != "macos" {
+				return fmt.Errorf("%w: %s: the image's tools are unknown, so %q cannot be checked", ErrRequirementsNotMet, imageName, requirement)
+			}
+			return fmt.Errorf("%w: %s does not satisfy %q", ErrRequirementsNotMet, imageName, requirement)
+		}
+	}
+	return nil
+}
+
+// requirementOperators are the operators of image requirements, two-character
+// ones first so they are matched before their prefixes.
+var requirementOperators = []string{">=", "<=", "!=", "==", "=", ">", "<"}
+
+// parseRequirement splits an image requirement such as "xcode>=15.2".
+func parseRequirement(requirement string) (name, op, version string, err error) {
+	i := strings.IndexAny(requirement, "<>=!")
+	if i > 0 {
+		for _, candidate := range requirementOperators {
+			if strings.HasPrefix(requirement[i:], candidate) {
+				name, op, version = requirement[:i], candidate, requirement[i+len(candidate):]
+				break
+			}
+		}
+	}
+	if op == "" || version == "" {
+		return "", "", "", fmt.Errorf("invalid image requirement %q, expected e.g. xcode>=15.2", requirement)
+	}
+	return strings.ToLower(name), op, version, nil
+}
+
+// splitSDK splits an SDK name such as "iphoneos17.2" into its platform and version.
+func splitSDK(sdk string) (string, string) {
+	i := strings.IndexAny(sdk, "0123456789")
+	if i < 0 {
+		return sdk, ""
+	}
+	return sdk[:i], sdk[i:]
+}
+
+// anyVersionMatches reports whether any of versions compares to want as op says.
+func anyVersionMatches(versions []string, op, want string) bool {
+	for _, version := range versions {
+		if version == "" {
+			continue
+		}
+		c := compareVersions(version, want)
+		switch op {
+		case "=", "==":
+			if c == 0 {
+				return true
+			}
+		case "!=":
+			if c != 0 {
+				return true
+			}
+		case "<":
+			if c < 0 {
+				return true
+			}
+		case "<=":
+			if c <= 0 {
+				return true
+			}
+		case ">":
+			if c > 0 {
+				return true
+			}
+		case ">=":
+			if c >= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compareVersions compares dotted versions such as "15.2" and "15.10" part by
+// part, numerically where both parts are numbers. Missing parts count as 0,
+// so "15" equals "15.0".
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < max(len(as), len(bs)); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, xerr := strconv.Atoi(x)
+		yn, yerr := strconv.Atoi(y)
+		switch {
+		case xerr == nil && yerr == nil && xn != yn:
+			if xn < yn {
+				return -1
+			}
+			return 1
+		case (xerr != nil || yerr != nil) && x != y:
+			return strings.Compare(x, y)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,32 @@
+package imagemgr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// UploadObject uploads the file at path to the image bucket as object, e.g.
+// a bundle of VM logs. The agent's credentials need write access to the
+// bucket for it.
+func (m *Manager) UploadObject(ctx context.Context, object, path string) error {
+	if m.gcsClient == nil {
+		return fmt.Errorf("cannot upload %s: the fake driver has no bucket", path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := m.gcsClient.Bucket(m.cfg.GCSBucketName).Object(object).NewWriter(ctx)
+	if _, err := io.Copy(writer, file); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to upload %s to gs://%s/%s: %w", path, m.cfg.GCSBucketName, object, err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to upload %s to gs://%s/%s: %w", path, m.cfg.GCSBucketName, object, err)
+	}
+	return nil
+}
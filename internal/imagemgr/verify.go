@@ -0,0 +1,202 @@
+package imagemgr
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// Image verification modes, see ImageVerify.
+const (
+	verifyFast = "fast" // Rehash only if the file's size or modification time changed
+	verifyFull = "full" // Rehash before every use
+	verifyOff  = "off"  // Never verify before use
+)
+
+// runningMarker is kept in the image cache directory while the agent runs.
+// Finding it at startup means the agent or the host crashed, possibly in the
+// middle of writing an image, so every cached image is hashed again.
+const runningMarker = ".agent-running"
+
+// partialSuffix names an image while it downloads. It is renamed to the
+// image's path once complete, so a crash never leaves a truncated image behind.
+const partialSuffix = ".partial"
+
+// ErrImageNoManifest is returned when verifying an image without a manifest
+// to compare it with.
+var ErrImageNoManifest = errors.New("image has no manifest")
+
+// ValidateImageVerify checks that the configured image verification mode is known.
+func ValidateImageVerify(mode string) error {
+	switch mode {
+	case verifyFast, verifyFull, verifyOff:
+		return nil
+	}
+	return fmt.Errorf("unknown image verification mode '%s', expected fast, full or off", mode)
+}
+
+// markRunning creates the running marker in the cache directory and reports
+// whether it was already there.
+func markRunning(cacheDir string) bool {
+	path := filepath.Join(cacheDir, runningMarker)
+	_, err := os.Stat(path)
+	crashed := err == nil
+	if err := os.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+		log.Printf("Warning: Could not create %s: %v", path, err)
+	}
+	return crashed
+}
+
+// Close removes the running marker, so the next start trusts the recorded
+// verifications of cached images. Call it when the agent stops cleanly.
+func (m *Manager) Close() {
+	if err := os.Remove(filepath.Join(m.cfg.ImageCacheDir, runningMarker)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: Could not remove running marker: %v", err)
+	}
+}
+
+// VerifyImage checks a cached image against the checksum in its manifest.
+// Unless full is set, an image whose size and modification time are those
+// of its last verification passes without being hashed. An image that fails
+// is evicted, so the next provision downloads it again.
+func (m *Manager) VerifyImage(ctx context.Context, imageName string, full bool) (models.ImageVerifyResult, error) {
+	// Hashes of large images take minutes, so provisions that need the same
+	// image wait for one hash rather than each running their own.
+	m.verifyMu.Lock()
+	defer m.verifyMu.Unlock()
+
+	m.mu.RLock()
+	info, ok := m.cache[imageName]
+	var manifest models.ImageManifest
+	downloading := ok && info.IsDownloading
+	if ok && info.Manifest != nil {
+		manifest = *info.Manifest
+	}
+	m.mu.RUnlock()
+	switch {
+	case !ok:
+		return models.ImageVerifyResult{}, fmt.Errorf("%w: %s", ErrImageNotCached, imageName)
+	case downloading:
+		return models.ImageVerifyResult{}, fmt.Errorf("%w: %s", ErrImageDownloading, imageName)
+	case manifest.Checksum == "":
+		return models.ImageVerifyResult{}, fmt.Errorf("%w: %s", ErrImageNoManifest, imageName)
+	}
+
+	start := time.Now()
+	result := models.ImageVerifyResult{Image: imageName, Checksum: manifest.Checksum}
+	stat, err := os.Stat(info.Path)
+	if err == nil && !full && unchangedSinceVerified(&manifest, stat) {
+		result.Passed = true
+		return result, nil
+	}
+	if err == nil {
+		op := m.ops.StartContext(ctx, "image-verify", imageName)
+		op.SetPhase("hashing")
+		result.Actual, err = hashFile(op.Context(), info.Path)
+		op.Fail(err)
+		op.Done()
+		if err != nil {
+			return result, err
+		}
+	} else if !os.IsNotExist(err) {
+		return result, fmt.Errorf("failed to stat image %s: %w", imageName, err)
+	}
+	result.DurationMs = time.Since(start).Milliseconds()
+
+	if result.Actual == manifest.Checksum {
+		result.Passed = true
+		m.recordVerification(info, stat.ModTime())
+		log.Printf("Image %s verified in %s", imageName, time.Since(start).Round(time.Second))
+		return result, nil
+	}
+
+	log.Printf("Image %s is corrupt: checksum %q does not match %s, evicting it", imageName, result.Actual, manifest.Checksum)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cache[imageName] == info {
+		if err := removeWithSidecars(info.Path); err != nil && !os.IsNotExist(err) {
+			return result, fmt.Errorf("failed to evict corrupt image %s: %w", imageName, err)
+		}
+		delete(m.cache, imageName)
+		m.countEviction(imageName, models.ImageCorrupt)
+		m.evictions = append(m.evictions, models.ImageEviction{Image: imageName, Digest: manifest.Digest, Reason: models.ImageCorrupt, EvictedAt: time.Now().UTC()})
+		result.Evicted = true
+	}
+	return result, nil
+}
+
+// verifyBeforeUse verifies a cached image as ImageVerify says before a VM is
+// created from it. Images that aren't cached or are downloading are skipped.
+func (m *Manager) verifyBeforeUse(ctx context.Context, imageName string) error {
+	if m.cfg.ImageVerify == verifyOff {
+		return nil
+	}
+	m.mu.RLock()
+	info, ok := m.cache[imageName]
+	skip := !ok || info.IsDownloading || info.Manifest == nil
+	m.mu.RUnlock()
+	if skip {
+		return nil
+	}
+	_, err := m.VerifyImage(ctx, imageName, m.cfg.ImageVerify == verifyFull)
+	return err
+}
+
+// recordVerification records in an image's manifest that it was hashed and
+// matched while its modification time was modTime.
+func (m *Manager) recordVerification(info *ImageInfo, modTime time.Time) {
+	m.mu.Lock()
+	if info.Manifest == nil {
+		m.mu.Unlock()
+		return
+	}
+	info.Manifest.Verification = &models.ImageVerification{ModTime: modTime.UTC(), VerifiedAt: time.Now().UTC()}
+	manifest := *info.Manifest
+	m.mu.Unlock()
+	if err := writeManifest(info.Path, &manifest); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// unchangedSinceVerified reports whether an image file still has the size
+// and modification time it had when it last matched its manifest.
+func unchangedSinceVerified(manifest *models.ImageManifest, stat os.FileInfo) bool {
+	return manifest.Verification != nil && stat.Size() == manifest.Size && stat.ModTime().Equal(manifest.Verification.ModTime)
+}
+
+// hashFile returns the SHA256 of a file, stopping early once ctx is done.
+func hashFile(ctx context.Context, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, &contextReader{ctx: ctx, r: file}); err != nil {
+		return "", fmt.Errorf("failed to calculate checksum for %s: %w", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// contextReader fails reads once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,177 @@
+package janitor
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// gcArchiveDir holds the logs of collected VM directories, under the state directory.
+const gcArchiveDir = "gc-archive"
+
+// StartGC collects stale VM directories every VMGCInterval.
+func (j *Janitor) StartGC() {
+	ticker := time.NewTicker(j.cfg.VMGCInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := j.CollectVMDirs(); err != nil {
+			log.Printf("Error collecting stale VM directories: %v", err)
+		}
+	}
+}
+
+// CollectVMDirs deletes the directories of VMs that are gone, e.g. after a
+// crashed provision: no VM by that name is known to the backend, no process
+// is running it, no operation is in flight on it and nothing in it changed
+// for VMGCGracePeriod. Their logs are archived under the state directory first.
+func (j *Janitor) CollectVMDirs() (*models.GCResult, error) {
+	j.gcMu.Lock()
+	defer j.gcMu.Unlock()
+
+	op := j.ops.Start("vm-gc", j.layout.Root())
+	defer op.Done()
+
+	vmIDs, err := j.layout.List()
+	if err != nil {
+		return nil, err
+	}
+	// Without the backend's view, a stopped VM would look like garbage.
+	known, err := utils.ListVMs()
+	if err != nil {
+		return nil, fmt.Errorf("not collecting VM directories: %w", err)
+	}
+
+	result := &models.GCResult{Removed: []string{}}
+	cutoff := time.Now().Add(-j.cfg.VMGCGracePeriod)
+	for _, vmID := range vmIDs {
+		if _, ok := known[vmID]; ok || j.ops.Busy(vmID) || j.processAlive(vmID) {
+			continue
+		}
+		dir := j.layout.VMDir(vmID)
+		if latestModTime(dir).After(cutoff) {
+			continue
+		}
+
+		op.SetPhase("collecting " + vmID)
+		archive, err := j.archiveLogs(vmID)
+		if err != nil {
+			log.Printf("Warning: Not collecting VM directory %s: %v", dir, err)
+			continue
+		}
+		size := treeSize(dir)
+		if err := j.layout.Remove(vmID); err != nil {
+			log.Printf("Warning: Failed to remove stale VM directory %s: %v", dir, err)
+			continue
+		}
+		log.Printf("Collected stale VM directory %s (%d bytes)", dir, size)
+		result.Removed = append(result.Removed, vmID)
+		if archive != "" {
+			result.Archived = append(result.Archived, archive)
+		}
+		result.ReclaimedBytes += size
+	}
+
+	if len(result.Removed) > 0 {
+		j.events.Emit("janitor.vm-dirs-collected", "Removed stale VM directories", map[string]string{
+			"vms":   strings.Join(result.Removed, ","),
+			"bytes": strconv.FormatInt(result.ReclaimedBytes, 10),
+		})
+	}
+	return result, nil
+}
+
+// processAlive reports whether a process is still running the VM, according
+// to its PID file or the process table.
+func (j *Janitor) processAlive(vmID string) bool {
+	if _, err := utils.ReadPIDFile(j.layout.PIDPath(vmID)); err == nil {
+		return true
+	}
+	_, err := utils.GetVMProcessID(vmID)
+	return err == nil
+}
+
+// archiveLogs writes the VM's logs directory to a tar.gz under the state
+// directory and returns its path, or "" if there are no logs.
+func (j *Janitor) archiveLogs(vmID string) (string, error) {
+	logsDir := j.layout.LogsDir(vmID)
+	entries, err := os.ReadDir(logsDir)
+	if err != nil || len(entries) == 0 {
+		return "", nil
+	}
+
+	archiveDir := filepath.Join(j.cfg.StateDir, gcArchiveDir)
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create log archive directory %s: %w", archiveDir, err)
+	}
+	archivePath := filepath.Join(archiveDir, fmt.Sprintf("%s-%s.tar.gz", vmID, time.Now().UTC().Format("20060102T150405Z")))
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create log archive %s: %w", archivePath, err)
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+	err = filepath.WalkDir(logsDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(logsDir, path)
+		header.Name = filepath.ToSlash(filepath.Join(vmID, rel))
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		os.Remove(archivePath)
+		return "", fmt.Errorf("failed to archive logs of VM %s: %w", vmID, err)
+	}
+	return archivePath, nil
+}
+
+// latestModTime returns the most recent modification time of anything under dir.
+func latestModTime(dir string) time.Time {
+	var latest time.Time
+	filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest
+}
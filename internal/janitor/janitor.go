@@ -0,0 +1,174 @@
+package janitor
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/events"
+	"github.com/changty97/macvmagt/internal/operations"
+	"github.com/changty97/macvmagt/internal/paths"
+)
+
+// tempPatterns match leftovers of interrupted operations: partial copies,
+// temporary bundles (e.g., from an interrupted `tart create`) and mktemp files.
+var tempPatterns = []string{"*.partial", "*.tmp", "tmp.*"}
+
+// nohupOutput is the file nohup writes a detached process's output to when it isn't redirected.
+const nohupOutput = "nohup.out"
+
+// Janitor periodically removes leftovers from the VM storage root that nothing
+// else cleans up.
+type Janitor struct {
+	cfg    *config.Config
+	layout *paths.Layout
+	ops    *operations.Tracker
+	events *events.Emitter
+	gcMu   sync.Mutex // Serializes scheduled and manual VM directory collection
+}
+
+// NewJanitor creates a Janitor for the VM directories of layout.
+func NewJanitor(cfg *config.Config, layout *paths.Layout, ops *operations.Tracker, em *events.Emitter) *Janitor {
+	return &Janitor{
+		cfg:    cfg,
+		layout: layout,
+		ops:    ops,
+		events: em,
+	}
+}
+
+// Start sweeps once and then every JanitorInterval.
+func (j *Janitor) Start() {
+	j.Sweep()
+
+	ticker := time.NewTicker(j.cfg.JanitorInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		j.Sweep()
+	}
+}
+
+// Sweep removes stale temp files and bundles, orphaned nohup output and
+// zero-byte disk images under the VM storage root, and returns the number of
+// bytes reclaimed. Entries younger than JanitorMinAge and directories of VMs
+// with an operation in flight are left alone.
+func (j *Janitor) Sweep() int64 {
+	return j.sweep(j.cfg.JanitorMinAge)
+}
+
+// SweepInterrupted is Sweep regardless of the age of entries. At startup,
+// before the agent accepts commands, nothing is writing them, so whatever
+// Sweep would remove was left by operations the last run didn't finish.
+func (j *Janitor) SweepInterrupted() int64 {
+	return j.sweep(0)
+}
+
+// sweep removes the leftovers older than minAge.
+func (j *Janitor) sweep(minAge time.Duration) int64 {
+	op := j.ops.Start("janitor", j.layout.Root())
+	defer op.Done()
+
+	root := j.layout.Root()
+	cutoff := time.Now().Add(-minAge)
+	var removed int
+	var reclaimed int64
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Warning: Janitor could not read %s: %v", path, err)
+			return nil
+		}
+		if path == root {
+			return nil
+		}
+		// Top-level directories are VM directories; skip those in use.
+		if entry.IsDir() && filepath.Dir(path) == root && j.ops.Busy(entry.Name()) {
+			return filepath.SkipDir
+		}
+		if !j.isGarbage(path, entry) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+		size := diskUsage(path, entry)
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Warning: Janitor failed to remove %s: %v", path, err)
+			return nil
+		}
+		log.Printf("Janitor removed %s (%d bytes)", path, size)
+		removed++
+		reclaimed += size
+		if entry.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Warning: Janitor sweep of %s failed: %v", root, err)
+	}
+
+	if removed > 0 {
+		j.events.Emit("janitor.reclaimed", "Removed stale files from the VM storage root", map[string]string{
+			"entries": strconv.Itoa(removed),
+			"bytes":   strconv.FormatInt(reclaimed, 10),
+		})
+	}
+	return reclaimed
+}
+
+// isGarbage reports whether an entry is a leftover the janitor removes.
+func (j *Janitor) isGarbage(path string, entry fs.DirEntry) bool {
+	name := entry.Name()
+	for _, pattern := range tempPatterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	if entry.IsDir() {
+		return false
+	}
+	if name == nohupOutput {
+		return true
+	}
+	// A zero-byte disk image is what an interrupted clone leaves behind.
+	if filepath.Base(filepath.Dir(path)) == "disk" && strings.HasSuffix(name, ".sparseimage") {
+		if info, err := entry.Info(); err == nil && info.Size() == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// diskUsage returns the size of a file, or of everything under a directory.
+func diskUsage(path string, entry fs.DirEntry) int64 {
+	if !entry.IsDir() {
+		if info, err := entry.Info(); err == nil {
+			return info.Size()
+		}
+		return 0
+	}
+	return treeSize(path)
+}
+
+// treeSize returns the total size of the files under dir.
+func treeSize(dir string) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
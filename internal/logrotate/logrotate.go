@@ -0,0 +1,132 @@
+// Package logrotate writes logs to files that are rotated once they grow too
+// large or too old, so long-running VMs and agents can't fill the disk.
+package logrotate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+)
+
+// Policy says when a log file is rotated and how many rotated files are kept.
+type Policy struct {
+	MaxBytes int64         // Size the file is rotated at; 0 disables size-based rotation
+	MaxAge   time.Duration // Age the file is rotated at, counted from when it was opened; 0 disables age-based rotation
+	MaxFiles int           // Rotated files kept, as <path>.1 (newest) to <path>.<MaxFiles>
+}
+
+// FromConfig returns the Policy of the agent's log file and of VM logs.
+func FromConfig(cfg *config.Config) Policy {
+	return Policy{MaxBytes: cfg.LogMaxBytes, MaxAge: cfg.LogMaxAge, MaxFiles: cfg.LogMaxFiles}
+}
+
+// Writer appends to a log file, rotating it to <path>.1 by its Policy and
+// shifting older files up to <path>.<MaxFiles>; the oldest file is dropped.
+// Output that can't be written, e.g. because the disk is full or the file
+// couldn't be reopened after a rotation, is dropped rather than failing the
+// write, so a process whose output goes to the Writer never sees a broken
+// pipe. It is safe for concurrent use.
+type Writer struct {
+	path   string
+	policy Policy
+	mu     sync.Mutex // Protects the fields below
+	file   *os.File   // nil once closed, or if reopening it failed
+	closed bool
+	size   int64
+	opened time.Time
+}
+
+// Open opens the log file at path for appending, creating it and its
+// directory if needed.
+func Open(path string, policy Policy) (*Writer, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory %s: %w", filepath.Dir(path), err)
+	}
+	w := &Writer{path: path, policy: policy}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open opens the current file for appending.
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log %s: %w", w.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log %s: %w", w.path, err)
+	}
+	w.file, w.size, w.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would take it past
+// MaxBytes or the file is older than MaxAge. A write is never split across
+// files. It only fails once the Writer is closed.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.file != nil && w.size > 0 && w.due(int64(len(p))) {
+		w.rotate()
+	}
+	if w.file == nil {
+		return len(p), nil
+	}
+	n, _ := w.file.Write(p)
+	w.size += int64(n)
+	return len(p), nil
+}
+
+// due reports whether the file must be rotated before n more bytes are written.
+func (w *Writer) due(n int64) bool {
+	if w.policy.MaxBytes > 0 && w.size+n > w.policy.MaxBytes {
+		return true
+	}
+	return w.policy.MaxAge > 0 && time.Since(w.opened) >= w.policy.MaxAge
+}
+
+// rotate shifts the rotated files up by one, dropping the oldest, and starts
+// a new current file.
+func (w *Writer) rotate() {
+	w.file.Close()
+	if w.policy.MaxFiles < 1 {
+		os.Remove(w.path) // No rotated files are kept
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.policy.MaxFiles))
+		for i := w.policy.MaxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			// Not logged with log, whose output may be this very file.
+			fmt.Fprintf(os.Stderr, "Warning: Failed to rotate log %s: %v\n", w.path, err)
+		}
+	}
+	if err := w.open(); err != nil {
+		w.file = nil
+		fmt.Fprintf(os.Stderr, "Warning: %v, dropping its output\n", err)
+	}
+}
+
+// Close closes the file. Writes after Close fail.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || w.file == nil {
+		w.closed = true
+		return nil
+	}
+	err := w.file.Close()
+	w.file, w.closed = nil, true
+	return err
+}
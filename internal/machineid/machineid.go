@@ -0,0 +1,44 @@
+package machineid
+
+import (
+	crand "crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"math/big"
+
+	"howett.net/plist"
+)
+
+// RandomECID returns a random ECID in [1, 2^63-2], matching the range used by
+// Apple's own tooling.
+func RandomECID() (uint64, error) {
+	// crand.Int returns a value in [0, N-1], so N = MaxInt64 - 1 gives [0, 2^63-3].
+	upperBound := big.NewInt(0).Sub(big.NewInt(math.MaxInt64), big.NewInt(1))
+	n, err := crand.Int(crand.Reader, upperBound)
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate random ECID: %w", err)
+	}
+	return n.Uint64() + 1, nil
+}
+
+// Generate returns a new random machine identifier: a binary plist holding
+// the ECID, base64 encoded without line wrapping.
+func Generate() (string, error) {
+	ecid, err := RandomECID()
+	if err != nil {
+		return "", err
+	}
+	return Encode(ecid)
+}
+
+// Encode returns the base64-encoded binary plist machine identifier for ecid.
+func Encode(ecid uint64) (string, error) {
+	binaryPlist, err := plist.Marshal(map[string]interface{}{"ECID": ecid}, plist.BinaryFormat)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode machine identifier plist: %w", err)
+	}
+
+	// Go's base64.StdEncoding.EncodeToString does not add line breaks.
+	return base64.StdEncoding.EncodeToString(binaryPlist), nil
+}
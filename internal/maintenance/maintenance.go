@@ -0,0 +1,320 @@
+// Package maintenance runs the node's recurring maintenance windows: when one
+// opens, the agent cordons the node, waits for its VMs to finish, runs the
+// maintenance hook (e.g. softwareupdate and a reboot) and uncordons it again.
+package maintenance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/cordon"
+	"github.com/changty97/macvmagt/internal/events"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/operations"
+	"github.com/changty97/macvmagt/internal/utils"
+	"github.com/changty97/macvmagt/internal/vmgr"
+)
+
+// drainPollInterval is how often a window checks whether the node drained.
+const drainPollInterval = 30 * time.Second
+
+// cordonReason is the reason a window cordons the node with.
+const cordonReason = "maintenance window"
+
+// state is the scheduler's progress, persisted in maintenance.json in the
+// state directory so a window survives the agent restarts its hook causes.
+type state struct {
+	State       string                 `json:"state"`
+	WindowStart time.Time              `json:"windowStart,omitzero"`
+	WindowEnd   time.Time              `json:"windowEnd,omitzero"`
+	Cordoned    bool                   `json:"cordoned,omitempty"` // The window cordoned the node, so it uncordons it
+	LastWindow  *models.MaintenanceRun `json:"lastWindow,omitempty"`
+}
+
+// Scheduler opens maintenance windows on MaintenanceSchedule.
+type Scheduler struct {
+	cfg      *config.Config
+	schedule *Schedule // nil when maintenance windows are disabled
+	cordon   *cordon.Store
+	ops      *operations.Tracker
+	events   *events.Emitter
+	path     string
+	mu       sync.Mutex // Protects state
+	state    state
+}
+
+// New creates a Scheduler. It fails if MaintenanceSchedule is set but invalid.
+func New(cfg *config.Config, cs *cordon.Store, ops *operations.Tracker, em *events.Emitter) (*Scheduler, error) {
+	s := &Scheduler{
+		cfg:    cfg,
+		cordon: cs,
+		ops:    ops,
+		events: em,
+		path:   filepath.Join(cfg.StateDir, "maintenance.json"),
+		state:  state{State: models.MaintenanceIdle},
+	}
+	if cfg.MaintenanceSchedule == "" {
+		return s, nil
+	}
+	schedule, err := ParseSchedule(cfg.MaintenanceSchedule)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaintenanceWindow <= 0 {
+		return nil, fmt.Errorf("maintenance window must be positive, got %s", cfg.MaintenanceWindow)
+	}
+	s.schedule = schedule
+	s.load()
+	return s, nil
+}
+
+// Enabled reports whether maintenance windows are scheduled.
+func (s *Scheduler) Enabled() bool {
+	return s.schedule != nil
+}
+
+// load reads the persisted state, treating a missing or corrupt file as idle.
+func (s *Scheduler) load() {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: Could not read maintenance state %s: %v", s.path, err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		log.Printf("Warning: Could not parse maintenance state %s: %v", s.path, err)
+		s.state = state{State: models.MaintenanceIdle}
+	}
+}
+
+// update applies fn to the state and persists it.
+func (s *Scheduler) update(fn func(*state)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.state)
+	data, err := json.Marshal(s.state)
+	if err == nil {
+		tmpPath := s.path + ".tmp"
+		if err = os.WriteFile(tmpPath, data, 0644); err == nil {
+			err = os.Rename(tmpPath, s.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: Could not persist maintenance state: %v", err)
+	}
+}
+
+// Status returns the schedule and state of maintenance windows, or nil if
+// none are scheduled.
+func (s *Scheduler) Status() *models.MaintenanceStatus {
+	if s.schedule == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := &models.MaintenanceStatus{
+		Schedule:      s.schedule.String(),
+		WindowSeconds: int64(s.cfg.MaintenanceWindow.Seconds()),
+		State:         s.state.State,
+		WindowStart:   s.state.WindowStart,
+		WindowEnd:     s.state.WindowEnd,
+		NextWindow:    s.nextWindow(time.Now()),
+		LastWindow:    s.state.LastWindow,
+	}
+	if status.State == models.MaintenanceIdle {
+		status.WindowStart, status.WindowEnd = time.Time{}, time.Time{}
+	}
+	return status
+}
+
+// nextWindow returns the start of the first window after t. Windows opening
+// before the open one closes are skipped, so that is at its end at the
+// earliest. Callers must hold s.mu.
+func (s *Scheduler) nextWindow(t time.Time) time.Time {
+	if s.state.State != models.MaintenanceIdle && s.state.WindowEnd.After(t) {
+		t = s.state.WindowEnd
+	}
+	return s.schedule.Next(t)
+}
+
+// Start opens maintenance windows as they come up. A window the agent was
+// restarted in is picked up where it left off: a restart while the hook ran,
+// e.g. for a reboot, counts as the hook completing.
+func (s *Scheduler) Start() {
+	if s.state.State != models.MaintenanceIdle {
+		s.resume()
+	}
+	for {
+		start, end := s.upcoming(time.Now())
+		if start.IsZero() {
+			log.Printf("Warning: Maintenance schedule %q never matches, no windows will open", s.schedule)
+			return
+		}
+		if wait := time.Until(start); wait > 0 {
+			log.Printf("Next maintenance window opens at %s", start.Format(time.RFC3339))
+			time.Sleep(wait)
+		}
+		s.open(start, end)
+	}
+}
+
+// upcoming returns the window that is open at t or opens next. Windows that
+// opened before the last one closed are skipped, so a window doesn't run
+// again after its hook rebooted the host, and overlapping windows run once.
+func (s *Scheduler) upcoming(t time.Time) (time.Time, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from := t.Add(-s.cfg.MaintenanceWindow)
+	if last := s.state.LastWindow; last != nil && last.End.After(from) {
+		from = last.End
+	}
+	start := s.schedule.Next(from)
+	if start.IsZero() {
+		return start, start
+	}
+	// Of the windows open at t, the latest stays open longest.
+	for next := s.schedule.Next(start); !next.IsZero() && !next.After(t); next = s.schedule.Next(next) {
+		start = next
+	}
+	return start, start.Add(s.cfg.MaintenanceWindow)
+}
+
+// resume finishes the window the agent was restarted in.
+func (s *Scheduler) resume() {
+	switch s.state.State {
+	case models.MaintenanceRunning:
+		log.Printf("Agent restarted while the maintenance hook ran, completing the maintenance window")
+		s.close(models.MaintenanceCompleted, nil)
+	case models.MaintenanceDraining:
+		if time.Now().Before(s.state.WindowEnd) {
+			log.Printf("Resuming maintenance window until %s", s.state.WindowEnd.Format(time.RFC3339))
+			s.drainAndRun()
+			return
+		}
+		s.close(models.MaintenanceNotDrained, fmt.Errorf("the window closed while the agent was down"))
+	}
+}
+
+// open runs the window from start to end.
+func (s *Scheduler) open(start, end time.Time) {
+	if time.Now().After(end) {
+		return
+	}
+	wasCordoned := s.cordon.Cordoned()
+	s.update(func(st *state) {
+		st.State, st.WindowStart, st.WindowEnd, st.Cordoned = models.MaintenanceDraining, start, end, !wasCordoned
+	})
+	if !wasCordoned {
+		if _, err := s.cordon.Cordon(cordonReason); err != nil {
+			s.update(func(st *state) { st.Cordoned = false })
+			s.close(models.MaintenanceCompleted, fmt.Errorf("failed to cordon the node: %w", err))
+			return
+		}
+	}
+	log.Printf("Maintenance window open until %s, waiting for VMs to drain", end.Format(time.RFC3339))
+	s.events.Emit("maintenance.started", "Maintenance window opened, node cordoned until its VMs drain", map[string]string{
+		"windowEnd": end.Format(time.RFC3339),
+	})
+	s.drainAndRun()
+}
+
+// drainAndRun waits for the open window's VMs to drain, then runs the hook.
+func (s *Scheduler) drainAndRun() {
+	end, cordoned := s.state.WindowEnd, s.state.Cordoned
+	for !s.drained() {
+		if cordoned && !s.cordon.Cordoned() {
+			s.close(models.MaintenanceAborted, fmt.Errorf("the node was uncordoned during the window"))
+			return
+		}
+		if !time.Now().Add(drainPollInterval).Before(end) {
+			s.close(models.MaintenanceNotDrained, fmt.Errorf("VMs were still running when the window closed"))
+			return
+		}
+		time.Sleep(drainPollInterval)
+	}
+	if s.cfg.MaintenanceHook == "" {
+		s.close(models.MaintenanceCompleted, nil)
+		return
+	}
+
+	s.update(func(st *state) { st.State = models.MaintenanceRunning })
+	s.close(models.MaintenanceCompleted, s.runHook(end))
+}
+
+// drained reports whether the node has no work left: no operations in flight
+// and no VMs running but warm pool standbys.
+func (s *Scheduler) drained() bool {
+	if len(s.ops.List()) > 0 {
+		return false
+	}
+	vms, err := utils.GetRunningVMs()
+	if err != nil {
+		log.Printf("Warning: Could not list running VMs during maintenance window: %v", err)
+		return false
+	}
+	return !slices.ContainsFunc(vms, func(vm models.VMInfo) bool { return !vmgr.IsStandby(vm.VMID) })
+}
+
+// runHook runs MaintenanceHook with the window's details in its environment.
+// It is killed once the window closes.
+func (s *Scheduler) runHook(end time.Time) error {
+	ctx, cancel := context.WithDeadline(context.Background(), end)
+	defer cancel()
+	cmd := utils.CommandContext(ctx, s.cfg.MaintenanceHook)
+	cmd.Env = append(os.Environ(),
+		"MACVMAGT_HOOK=maintenance",
+		"MACVMAGT_NODE_ID="+s.cfg.NodeID,
+		"MACVMAGT_WINDOW_END="+end.Format(time.RFC3339),
+	)
+	log.Printf("Running maintenance hook %s", s.cfg.MaintenanceHook)
+	output, err := cmd.CombinedOutput()
+	if out := strings.TrimSpace(string(output)); out != "" {
+		log.Printf("Maintenance hook: %s", out)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("maintenance hook did not finish before the window closed: %w", ctx.Err())
+		}
+		return fmt.Errorf("maintenance hook failed: %w", err)
+	}
+	return nil
+}
+
+// close ends the open window with result, or MaintenanceFailed if err is set
+// for a completed window, and uncordons the node if the window cordoned it.
+func (s *Scheduler) close(result string, err error) {
+	run := &models.MaintenanceRun{Start: s.state.WindowStart, End: time.Now().UTC(), Result: result}
+	if err != nil {
+		if result == models.MaintenanceCompleted {
+			run.Result = models.MaintenanceFailed
+		}
+		run.Error = err.Error()
+		log.Printf("Maintenance window %s: %v", run.Result, err)
+	} else {
+		log.Printf("Maintenance window %s", run.Result)
+	}
+
+	if s.state.Cordoned && result != models.MaintenanceAborted {
+		if _, err := s.cordon.Uncordon(); err != nil {
+			log.Printf("Error uncordoning node after maintenance window: %v", err)
+		}
+	}
+	s.update(func(st *state) {
+		*st = state{State: models.MaintenanceIdle, LastWindow: run}
+	})
+	details := map[string]string{"result": run.Result}
+	if run.Error != "" {
+		details["error"] = run.Error
+	}
+	s.events.Emit("maintenance.finished", "Maintenance window closed", details)
+}
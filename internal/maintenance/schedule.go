@@ -0,0 +1,156 @@
+package maintenance
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLookahead bounds the search for a schedule's next time, so a spec that
+// never matches, such as February 30th, doesn't loop forever.
+const maxLookahead = 5 * 366 * 24 * time.Hour
+
+// Schedule is a parsed cron spec: minute, hour, day of month, month and day
+// of week. Each field is "*", a number, a range "a-b", a step "*/n" or
+// "a-b/n", or a comma-separated list of those. Days of the week run from 0
+// (Sunday) to 6, with 7 as Sunday too. As in cron, a time matches either day
+// field when both are restricted.
+type Schedule struct {
+	spec                             string
+	minutes, hours, days, months, wd fieldSet
+	anyDay, anyWeekday               bool
+}
+
+// fieldSet holds the values a field matches, as bits.
+type fieldSet uint64
+
+func (s fieldSet) has(v int) bool {
+	return s&(1<<uint(v)) != 0
+}
+
+// fieldBounds are the ranges of the five fields, in order.
+var fieldBounds = [5]struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// ParseSchedule parses a five-field cron spec.
+func ParseSchedule(spec string) (*Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(fieldBounds) {
+		return nil, fmt.Errorf("invalid schedule %q: expected 5 fields (minute hour day-of-month month day-of-week), got %d", spec, len(fields))
+	}
+	var sets [5]fieldSet
+	for i, field := range fields {
+		set, err := parseField(field, fieldBounds[i].min, fieldBounds[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %s: %w", spec, fieldBounds[i].name, err)
+		}
+		sets[i] = set
+	}
+	if sets[4].has(7) {
+		sets[4] |= 1 // Sunday
+	}
+	return &Schedule{
+		spec:       spec,
+		minutes:    sets[0],
+		hours:      sets[1],
+		days:       sets[2],
+		months:     sets[3],
+		wd:         sets[4],
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}, nil
+}
+
+// parseField parses one field whose values range from min to max.
+func parseField(field string, min, max int) (fieldSet, error) {
+	var set fieldSet
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = parseValue(first, min, max); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = parseValue(last, min, max); err != nil {
+					return 0, err
+				}
+				if hi < lo {
+					return 0, fmt.Errorf("invalid range %q", rangePart)
+				}
+			} else if hasStep {
+				hi = max // "a/n" steps from a to the end of the range
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// parseValue parses a number between min and max.
+func parseValue(s string, min, max int) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("invalid value %q: expected %d to %d", s, min, max)
+	}
+	return v, nil
+}
+
+// String returns the spec the schedule was parsed from.
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// Next returns the first time after t the schedule matches, in t's location,
+// or the zero time if it matches none within the next five years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.Add(maxLookahead); next.Before(limit); {
+		switch {
+		case !s.months.has(int(next.Month())):
+			next = time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, next.Location())
+		case !s.matchesDay(next):
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, 0, 0, 0, 0, next.Location())
+		case !s.hours.has(next.Hour()):
+			next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour()+1, 0, 0, 0, next.Location())
+		case !s.minutes.has(next.Minute()):
+			next = next.Add(time.Minute)
+		default:
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// matchesDay reports whether t's day matches the day of month and day of
+// week fields: either one if both are restricted, else the restricted one.
+func (s *Schedule) matchesDay(t time.Time) bool {
+	day, weekday := s.days.has(t.Day()), s.wd.has(int(t.Weekday()))
+	if !s.anyDay && !s.anyWeekday {
+		return day || weekday
+	}
+	return day && weekday
+}
@@ -1,12 +1,98 @@
 package models
 
+import "time"
+
 // VMInfo represents details about a single VM running on a Mac Mini.
 type VMInfo struct {
 	VMID           string `json:"vmId"`           // Unique ID of the VM
 	ImageName      string `json:"imageName"`      // Name of the image used for this VM
-	RuntimeSeconds int64  `json:"runtimeSeconds"` // How long the VM has been running in seconds
+	RuntimeSeconds int64  `json:"runtimeSeconds"` // How long the VM has run since it booted, in seconds
+	AgeSeconds     int64  `json:"ageSeconds"`     // Wall-clock time since the VM was created, in seconds
+	ReadySeconds   int64  `json:"readySeconds"`   // How long the VM has been ready for jobs, in seconds; 0 while provisioning
 	VMHostname     string `json:"vmHostname"`     // Hostname of the VM
 	VMIPAddress    string `json:"vmIpAddress"`    // IP address of the VM
+	// Results of the guest network self-test run at provision time, if enabled.
+	Reachability []ReachabilityResult `json:"reachability,omitempty"`
+	// How the VM's CPU time was scheduled during the last sample, if core sampling is enabled.
+	CPUScheduling *VMCPUScheduling `json:"cpuScheduling,omitempty"`
+	NetworkMode   string           `json:"networkMode,omitempty"` // "nat", "bridged", "softnet" or "host-only"
+	MACAddress    string           `json:"macAddress,omitempty"`  // MAC address of the VM's network interface
+	// Last phase reported from inside the VM by the guest helper, if guest events are enabled.
+	Guest *GuestStatus `json:"guest,omitempty"`
+	// Resources the VM used as of this heartbeat, if its process was found.
+	Usage *VMResourceUsage `json:"usage,omitempty"`
+	// VM profile the VM was provisioned with, if any.
+	Profile string `json:"profile,omitempty"`
+	// Disk space allocated to the VM's directory and tart bundle, as of the
+	// last disk usage sample; 0 before the first one.
+	DiskBytes uint64 `json:"diskBytes,omitempty"`
+}
+
+// VMRuntime is how long a VM has existed, run and been ready, in seconds.
+type VMRuntime struct {
+	RuntimeSeconds int64
+	AgeSeconds     int64
+	ReadySeconds   int64
+}
+
+// VMResourceUsage is what a VM consumes on the host, sampled from its `tart run`
+// process tree, its directory and its vmnet interface.
+type VMResourceUsage struct {
+	CPUPercent       float64 `json:"cpuPercent"`                 // CPU used since the previous sample, 100 per core
+	MemoryRSSBytes   uint64  `json:"memoryRssBytes"`             // Resident memory of the VM's processes
+	DiskBytes        uint64  `json:"diskBytes"`                  // Disk space allocated to the VM's directory
+	NetworkInterface string  `json:"networkInterface,omitempty"` // Host vmnet interface of the VM, if found
+	NetRxBytes       uint64  `json:"netRxBytes,omitempty"`       // Bytes received by the guest
+	NetTxBytes       uint64  `json:"netTxBytes,omitempty"`       // Bytes sent by the guest
+}
+
+// Guest phases reported by the guest helper, in the order a VM goes through them.
+const (
+	GuestBootComplete     = "boot-complete"
+	GuestRunnerRegistered = "runner-registered"
+	GuestJobStarted       = "job-started"
+	GuestJobFinished      = "job-finished"
+)
+
+// GuestEvent is the body of POST /vms/{vmId}/guest-events, sent by the guest
+// helper from inside the VM.
+type GuestEvent struct {
+	Event string `json:"event"`         // One of the Guest* phases
+	Job   string `json:"job,omitempty"` // "<run ID>/<job>" for job events
+}
+
+// GuestStatus is the last phase a VM's guest helper reported.
+type GuestStatus struct {
+	Phase     string    `json:"phase"`         // One of the Guest* phases
+	Job       string    `json:"job,omitempty"` // Job the phase belongs to, for job events
+	UpdatedAt time.Time `json:"updatedAt"`     // When the agent received the event
+}
+
+// VMCPUScheduling describes how a VM's CPU time was scheduled across Apple
+// silicon core types, attributed via the VM process's coalition.
+type VMCPUScheduling struct {
+	CPUMsPerSec float64            `json:"cpuMsPerSec"`           // CPU time consumed per second of wall time
+	QoSMsPerSec map[string]float64 `json:"qosMsPerSec,omitempty"` // CPU time by thread QoS class
+	// Share of CPU time in background and maintenance QoS, which macOS only
+	// schedules on efficiency cores: a lower bound on the E-core share.
+	MinEfficiencyCoreShare float64 `json:"minEfficiencyCoreShare"`
+}
+
+// CoreCluster is the activity of one CPU core cluster during a sample.
+type CoreCluster struct {
+	Name        string  `json:"name"`        // Cluster name as reported by powermetrics (e.g., "E-Cluster", "P0-Cluster")
+	Kind        string  `json:"kind"`        // "P" (performance) or "E" (efficiency)
+	ActiveRatio float64 `json:"activeRatio"` // Fraction of the sample the cluster was active
+	FreqMHz     float64 `json:"freqMHz"`     // Average frequency while active
+}
+
+// ReachabilityResult is the outcome of checking one endpoint from inside a VM.
+type ReachabilityResult struct {
+	Endpoint   string `json:"endpoint"`             // Endpoint as configured (URL or host:port)
+	Reachable  bool   `json:"reachable"`            // Whether a connection was established
+	HTTPStatus int    `json:"httpStatus,omitempty"` // HTTP status returned, if any
+	LatencyMs  int64  `json:"latencyMs,omitempty"`  // Total request time in milliseconds
+	Error      string `json:"error,omitempty"`      // Failure details when unreachable
 }
 
 // HeartbeatPayload represents the data sent by a Mac Mini in its heartbeat.
@@ -21,6 +107,447 @@ type HeartbeatPayload struct {
 	TotalDiskGB     float64  `json:"totalDiskGB"`     // Total disk space in GB
 	Status          string   `json:"status"`          // General status (e.g., "healthy", "warning", "offline")
 	CachedImages    []string `json:"cachedImages"`    // List of VM image names cached on this Mac Mini
+	// VMs suspended to disk. They hold no slot, so a node can host more VMs
+	// than MaxSlots as long as no more than MaxSlots run at once.
+	SuspendedVMs []string `json:"suspendedVms,omitempty"`
+	// Records of VMs that are gone, repeated until the orchestrator acknowledges them.
+	VMRecords []VMRecord `json:"vmRecords,omitempty"`
+	// Activity of each CPU core cluster, if core sampling is enabled.
+	CoreClusters []CoreCluster `json:"coreClusters,omitempty"`
+	// Manifest digest of each cached image, keyed by image name, so the
+	// orchestrator can verify the node has the exact image version it expects.
+	CachedImageDigests map[string]string `json:"cachedImageDigests,omitempty"`
+	// macOS build, Xcode versions and SDKs of each cached image whose tools are
+	// known, keyed by image name.
+	CachedImageTools map[string]ImageTools `json:"cachedImageTools,omitempty"`
+	// Cached images removed on request since the last heartbeat the orchestrator accepted.
+	ImageEvictions []ImageEviction `json:"imageEvictions,omitempty"`
+	// Depth and age of the queue of VM commands, so the orchestrator can back
+	// off while the node is saturated.
+	CommandQueue *CommandQueueStatus `json:"commandQueue,omitempty"`
+	// Where the node's disk space went, once it was sampled.
+	DiskUsage *DiskUsage `json:"diskUsage,omitempty"`
+	// How well the image cache serves provisions, to tune MaxCachedImages by.
+	ImageCache *ImageCacheStats `json:"imageCache,omitempty"`
+	// Image downloads queued or in progress, so a provision waiting for one
+	// doesn't look hung.
+	Downloads []ImageDownload `json:"downloads,omitempty"`
+	// How far the cache got towards the images the orchestrator wants cached,
+	// once it set them.
+	ImageSync *ImageSyncStatus `json:"imageSync,omitempty"`
+	// Cordon is set while the node is cordoned and shouldn't be sent new VMs.
+	Cordon *CordonState `json:"cordon,omitempty"`
+	// Maintenance is set while maintenance windows are scheduled, so the
+	// orchestrator can plan around them.
+	Maintenance *MaintenanceStatus `json:"maintenance,omitempty"`
+	// Commands from heartbeat responses the agent understands, and the results
+	// of those it ran, repeated until a heartbeat carrying them is accepted.
+	HeartbeatCommands []string                 `json:"heartbeatCommands,omitempty"`
+	CommandResults    []HeartbeatCommandResult `json:"commandResults,omitempty"`
+	// Seconds between heartbeats, which set-interval commands change.
+	HeartbeatIntervalSeconds int64 `json:"heartbeatIntervalSeconds,omitempty"`
+	// LastHostPower is set after the agent rebooted or shut down the host, to
+	// explain the gap in heartbeats before this run of the agent.
+	LastHostPower *HostPowerAction `json:"lastHostPower,omitempty"`
+	// WarmPool is set while the warm pool is enabled. Its standby VMs are left
+	// out of VMs and VMCount: they give up their slot to any VM provisioned.
+	WarmPool *WarmPoolStatus `json:"warmPool,omitempty"`
+	// What the agent is and can do, so the orchestrator can schedule on
+	// capabilities and spot outdated agents.
+	AgentVersion  string   `json:"agentVersion"`            // Agent build version
+	GoVersion     string   `json:"goVersion"`               // Go toolchain the agent was built with
+	UptimeSeconds int64    `json:"uptimeSeconds"`           // Seconds since the agent started
+	Drivers       []string `json:"drivers"`                 // Usable VM backends (e.g., "tart")
+	MaxSlots      int      `json:"maxSlots"`                // Maximum number of VMs the node runs at once
+	HostArch      string   `json:"hostArch"`                // Host CPU architecture, ArchARM64 or ArchAMD64, which images must be built for
+	HostOSVersion string   `json:"hostOsVersion,omitempty"` // Host macOS version, e.g. "15.1"
+	FeatureFlags  []string `json:"featureFlags,omitempty"`  // Optional features enabled on this node
+	NodeLabels    []string `json:"nodeLabels,omitempty"`    // Labels provision requests select the node by, e.g. "team=ios"
+	NodeTaints    []string `json:"nodeTaints,omitempty"`    // Taints provision requests must tolerate to run on the node
+	APIVersions   []string `json:"apiVersions,omitempty"`   // Command API versions the agent serves
+	// TLSPublicKeyPin is the sha256//<base64> pin of the command server's
+	// certificate key, for orchestrators to pin self-signed certificates.
+	TLSPublicKeyPin string `json:"tlsPublicKeyPin,omitempty"`
+	// Differential heartbeat protocol. SupportedProtocols is offered until the
+	// orchestrator picks one. With protocol 2, StateHash identifies the VM and
+	// image state, and once the orchestrator has it, Delta carries only the
+	// changes and VMs, CachedImages and CachedImageDigests are left out.
+	SupportedProtocols []int           `json:"supportedProtocols,omitempty"`
+	ProtocolVersion    int             `json:"protocolVersion,omitempty"`
+	StateHash          string          `json:"stateHash,omitempty"`
+	Delta              *HeartbeatDelta `json:"delta,omitempty"`
+}
+
+// VersionInfo is returned by GET /version.
+type VersionInfo struct {
+	AgentVersion string   `json:"agentVersion"`           // Agent build version
+	GoVersion    string   `json:"goVersion"`              // Go toolchain the agent was built with
+	Revision     string   `json:"revision,omitempty"`     // VCS revision the agent was built from
+	RevisionTime string   `json:"revisionTime,omitempty"` // Commit time of Revision
+	Modified     bool     `json:"modified,omitempty"`     // Built with uncommitted changes
+	OS           string   `json:"os"`                     // GOOS of the binary
+	Arch         string   `json:"arch"`                   // GOARCH of the binary
+	APIVersions  []string `json:"apiVersions"`            // Command API versions served, oldest first
+}
+
+// HeartbeatDelta is the change in VM and image state since the state with
+// BaseHash, the last one the orchestrator acknowledged.
+type HeartbeatDelta struct {
+	BaseHash       string            `json:"baseHash"`
+	VMsUpserted    []VMInfo          `json:"vmsUpserted,omitempty"`    // VMs that appeared or changed
+	VMsRemoved     []string          `json:"vmsRemoved,omitempty"`     // IDs of VMs that are gone
+	ImagesUpserted map[string]string `json:"imagesUpserted,omitempty"` // Cached images that appeared or changed, with their manifest digest
+	ImagesRemoved  []string          `json:"imagesRemoved,omitempty"`  // Names of images no longer cached
+}
+
+// ImageManifest describes the version of a cached VM image.
+type ImageManifest struct {
+	Name           string    `json:"name"`                     // Image name
+	SourceURI      string    `json:"sourceUri,omitempty"`      // Where the image was downloaded from (e.g., gs://bucket/object)
+	Checksum       string    `json:"checksum"`                 // SHA256 of the image file
+	Size           int64     `json:"size"`                     // Size in bytes
+	MacOSVersion   string    `json:"macosVersion,omitempty"`   // Guest macOS version, if known
+	CreatedAt      time.Time `json:"createdAt"`                // When the image was created at its source
+	HardwareModels []string  `json:"hardwareModels,omitempty"` // Base64 hardware models the image boots on
+	Arch           string    `json:"arch,omitempty"`           // CPU architecture the image is built for (ArchARM64 or ArchAMD64), if known
+	// SourceVM is the VM the image was captured from as a template; empty for
+	// images downloaded from GCS. Templates are never evicted to make room.
+	SourceVM string `json:"sourceVm,omitempty"`
+	// SmokeTest is the result of booting the image after download; nil if it wasn't tested.
+	SmokeTest *ImageSmokeTest `json:"smokeTest,omitempty"`
+	// Clones are the VMs whose disks are APFS clones of the image, sharing its
+	// blocks until they write to them.
+	Clones []string `json:"clones,omitempty"`
+	// Verification records when the image file was last hashed and matched
+	// Checksum; nil if it never was since the manifest was written.
+	Verification *ImageVerification `json:"verification,omitempty"`
+	// Tools lists the Xcode versions and SDKs installed in the image; nil if unknown.
+	Tools *ImageTools `json:"tools,omitempty"`
+	// Digest is the SHA256 of the manifest's other fields except SmokeTest, Clones, Verification and Tools, identifying this exact image version.
+	Digest string `json:"digest,omitempty"`
+}
+
+// Sources of ImageTools.
+const (
+	ImageToolsMetadata      = "metadata"      // Read from the GCS object's metadata
+	ImageToolsIntrospection = "introspection" // Found by booting the image once it was cached
+)
+
+// ImageTools describes the macOS build and developer tools installed in an
+// image, so provision requests can require e.g. a minimum Xcode version.
+type ImageTools struct {
+	MacOSVersion string    `json:"macosVersion,omitempty"` // e.g. "14.4"
+	MacOSBuild   string    `json:"macosBuild,omitempty"`   // e.g. "23E214"
+	Xcode        []string  `json:"xcode,omitempty"`        // Installed Xcode versions, e.g. "15.2"
+	SDKs         []string  `json:"sdks,omitempty"`         // SDKs as xcodebuild -showsdks names them, e.g. "iphoneos17.2"
+	Source       string    `json:"source"`                 // ImageToolsMetadata or ImageToolsIntrospection
+	InspectedAt  time.Time `json:"inspectedAt"`
+}
+
+// ImageSmokeTest is the result of booting a throwaway VM from a newly downloaded
+// image and running the validation script in it.
+type ImageSmokeTest struct {
+	Passed     bool      `json:"passed"`
+	Detail     string    `json:"detail,omitempty"` // Failure reason, or the tail of the validation script's output
+	TestedAt   time.Time `json:"testedAt"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+// States of ImageDownload.
+const (
+	DownloadQueued      = "queued"      // Waiting for a download slot
+	DownloadDownloading = "downloading" // Transferring
+)
+
+// ImageDownload is the progress of an image download, returned by
+// GET /downloads and reported in heartbeats.
+type ImageDownload struct {
+	Image          string     `json:"image"`
+	State          string     `json:"state"`                    // DownloadQueued or DownloadDownloading
+	Source         string     `json:"source,omitempty"`         // GCS object being downloaded, once known
+	BytesDone      int64      `json:"bytesDone"`                // Bytes of the image written so far
+	BytesTotal     int64      `json:"bytesTotal,omitempty"`     // Size of the image once downloaded, once known; an estimate for compressed objects without their size
+	BytesPerSecond int64      `json:"bytesPerSecond,omitempty"` // Recent transfer rate
+	ETASeconds     int64      `json:"etaSeconds,omitempty"`     // Estimated seconds left at the recent rate
+	Waiters        int        `json:"waiters"`                  // Provisions and image syncs waiting for the image
+	QueuedAt       time.Time  `json:"queuedAt"`
+	StartedAt      *time.Time `json:"startedAt,omitempty"`
+}
+
+// ImageVerification records the last full hash of a cached image file that
+// matched its manifest. As long as the file's size and modification time
+// are unchanged, the image is assumed intact without hashing it again.
+type ImageVerification struct {
+	ModTime    time.Time `json:"modTime"` // Modification time of the file when it was hashed
+	VerifiedAt time.Time `json:"verifiedAt"`
+}
+
+// ImageVerifyResult is the response of POST /images/{name}/verify.
+type ImageVerifyResult struct {
+	Image      string `json:"image"`
+	Checksum   string `json:"checksum"`         // SHA256 recorded in the manifest
+	Actual     string `json:"actual,omitempty"` // SHA256 of the file, if it was hashed
+	Passed     bool   `json:"passed"`
+	Evicted    bool   `json:"evicted,omitempty"` // The corrupt copy was removed, to be downloaded again
+	DurationMs int64  `json:"durationMs"`
+}
+
+// Reasons of ImageEviction.
+const (
+	ImageDeleted  = "deleted"  // Removed by DELETE /images/{name}
+	ImagePurged   = "purged"   // Removed by DELETE /images
+	ImageCorrupt  = "corrupt"  // Failed verification against its manifest's checksum
+	ImageUnlisted = "unlisted" // Not among the desired images of an image sync with evict
+)
+
+// ImageEviction records a cached image removed on request or found corrupt. Evictions are
+// reported in the next heartbeat.
+type ImageEviction struct {
+	Image     string    `json:"image"`
+	Digest    string    `json:"digest,omitempty"` // Manifest digest of the removed copy
+	Reason    string    `json:"reason"`           // ImageDeleted, ImagePurged, ImageCorrupt or ImageUnlisted
+	EvictedAt time.Time `json:"evictedAt"`
+}
+
+// Reasons images leave the cache on their own, counted by the image cache
+// metrics but not reported as an ImageEviction.
+const (
+	ImageEvictedLRU   = "lru"        // Least recently used while the cache held more than MaxCachedImages
+	ImageEvictedSpace = "disk-space" // Least recently used while a download or clone needed the space
+	ImageReplaced     = "replaced"   // Failed its smoke test and was replaced at its source
+)
+
+// DiskUsage is where the disk space of a node went, as of its last sample. It
+// is returned by GET /disk-usage and carried by heartbeats.
+type DiskUsage struct {
+	ImageCacheBytes uint64            `json:"imageCacheBytes"` // Disk space allocated to the image cache, downloads included
+	VMBytes         uint64            `json:"vmBytes"`         // Disk space allocated to all VMs, standbys included
+	VMs             map[string]uint64 `json:"vms"`             // Disk space allocated to each VM, keyed by VM ID
+	SampledAt       time.Time         `json:"sampledAt"`       // When the sample was taken
+	DurationMs      int64             `json:"durationMs"`      // How long measuring took
+	Errors          []string          `json:"errors,omitempty"`
+}
+
+// ImageCacheStats tells how well a node's image cache serves provisions, so
+// the orchestrator can tune MaxCachedImages per node. It is returned by
+// GET /image-cache and carried by heartbeats.
+type ImageCacheStats struct {
+	CachedImages           int   `json:"cachedImages"`           // Images in the cache, not counting downloads
+	MaxCachedImages        int   `json:"maxCachedImages"`        // Configured cache size
+	CachedBytes            int64 `json:"cachedBytes"`            // Size of the cached images
+	AverageImageAgeSeconds int64 `json:"averageImageAgeSeconds"` // Mean time since the cached images were downloaded
+	// Activity over the last hour, day and week; empty if no metrics are recorded.
+	Windows []ImageCacheWindow `json:"windows,omitempty"`
+}
+
+// ImageCacheWindow is the activity of the image cache over a rolling window.
+type ImageCacheWindow struct {
+	Window          string         `json:"window"`                    // Length of the window, e.g. "24h"
+	Hits            int            `json:"hits"`                      // Provisions that found their image cached
+	Misses          int            `json:"misses"`                    // Provisions that had to wait for a download
+	HitRatio        float64        `json:"hitRatio"`                  // Hits out of hits and misses, 0 without either
+	BytesFromCache  int64          `json:"bytesFromCache"`            // Size of the images hits were served
+	BytesDownloaded int64          `json:"bytesDownloaded"`           // Size of the images downloaded
+	Evictions       int            `json:"evictions"`                 // Images removed from the cache, for any reason
+	EvictionReasons map[string]int `json:"evictionReasons,omitempty"` // Evictions by reason, e.g. "lru" or "deleted"
+}
+
+// ImagePurgeResult is the response of DELETE /images.
+type ImagePurgeResult struct {
+	Evicted []ImageEviction     `json:"evicted"`
+	Skipped []ImagePurgeSkipped `json:"skipped,omitempty"`
+}
+
+// ImagePurgeSkipped is a cached image a purge left in place.
+type ImagePurgeSkipped struct {
+	Image  string `json:"image"`
+	Reason string `json:"reason"` // E.g. the VMs using it
+}
+
+// ImageSyncRequest sets the images the agent keeps cached, e.g.
+// POST /sync-images {"images": ["macos-sequoia-xcode:16"], "evict": true}.
+type ImageSyncRequest struct {
+	Images []string `json:"images"`          // Most important first; they are downloaded in this order
+	Evict  bool     `json:"evict,omitempty"` // Remove cached images that aren't listed, but templates and those in use
+}
+
+// States of ImageSyncStatus.
+const (
+	ImageSyncConverging = "converging" // Images are downloading or waiting for a download slot
+	ImageSyncConverged  = "converged"  // The cache holds the desired images, and no others with evict
+	ImageSyncBlocked    = "blocked"    // Nothing is under way, but images are blocked or failed
+)
+
+// ImageSyncStatus reports how far the cache got towards the desired images.
+type ImageSyncStatus struct {
+	Images      []string         `json:"images"`                // Desired images, most important first
+	Evict       bool             `json:"evict,omitempty"`       // Unlisted images are removed
+	State       string           `json:"state"`                 // One of the ImageSync* states
+	Cached      []string         `json:"cached"`                // Desired images in the cache
+	Downloading []string         `json:"downloading,omitempty"` // Desired images downloading
+	Pending     []string         `json:"pending,omitempty"`     // Desired images waiting for a download slot
+	Blocked     []ImageSyncIssue `json:"blocked,omitempty"`     // Images that can't be downloaded or removed for now, and why
+	Failed      []ImageSyncIssue `json:"failed,omitempty"`      // Desired images whose last download failed; they are retried
+	UpdatedAt   time.Time        `json:"updatedAt"`             // When the desired images were last changed
+	ConvergedAt *time.Time       `json:"convergedAt,omitempty"` // When the cache last converged on them
+}
+
+// ImageSyncIssue is an image an image sync is held up by.
+type ImageSyncIssue struct {
+	Image  string `json:"image"`
+	Reason string `json:"reason"`
+}
+
+// HeartbeatResponse is the orchestrator's optional reply to a heartbeat.
+type HeartbeatResponse struct {
+	AckedVMRecords []string `json:"ackedVmRecords,omitempty"` // IDs of VM records the orchestrator has stored
+	// ProtocolVersion is the heartbeat protocol the orchestrator picked from SupportedProtocols.
+	ProtocolVersion int `json:"protocolVersion,omitempty"`
+	// Resync asks for a full heartbeat, e.g. because a delta's base hash didn't match.
+	Resync bool `json:"resync,omitempty"`
+	// DesiredImages replaces the images the agent keeps cached, like
+	// POST /sync-images. nil leaves them unchanged.
+	DesiredImages *ImageSyncRequest `json:"desiredImages,omitempty"`
+	// Commands for the agent to run, in order, so an orchestrator can drive
+	// nodes it can't send requests to. Only types listed in the heartbeat's
+	// HeartbeatCommands are sent.
+	Commands []HeartbeatCommand `json:"commands,omitempty"`
+}
+
+// Types of commands the orchestrator can send in a heartbeat response.
+const (
+	HeartbeatCordon        = "cordon"         // Cordon the node, with Reason
+	HeartbeatUncordon      = "uncordon"       // Uncordon the node
+	HeartbeatPrefetchImage = "prefetch-image" // Download ImageName into the cache
+	HeartbeatSetInterval   = "set-interval"   // Send heartbeats every IntervalSeconds; 0 restores HeartbeatInterval
+	HeartbeatDeleteVM      = "delete-vm"      // Delete VMID, like POST /delete-vm
+)
+
+// HeartbeatCommand is a command sent in a heartbeat response.
+type HeartbeatCommand struct {
+	ID              string `json:"id"`                        // Unique ID; a command whose ID already ran is skipped, so resending is safe
+	Type            string `json:"type"`                      // One of the Heartbeat* command types
+	Reason          string `json:"reason,omitempty"`          // Why the node is cordoned
+	ImageName       string `json:"imageName,omitempty"`       // Image to prefetch
+	IntervalSeconds int    `json:"intervalSeconds,omitempty"` // Heartbeat interval to switch to
+	VMID            string `json:"vmId,omitempty"`            // VM to delete
+}
+
+// HeartbeatCommandResult reports how a command sent in a heartbeat response
+// went. Commands that run in the background, such as deletes and prefetches,
+// report whether they were accepted; their outcome shows up as usual, e.g.
+// in vmRecords and cachedImages.
+type HeartbeatCommandResult struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// VMRecord is a retained record of a VM that reached a final state, such as a
+// tombstone for a deleted VM or a failed provision.
+type VMRecord struct {
+	ID        string    `json:"id"`                  // Unique record ID, echoed back in acknowledgements
+	VMID      string    `json:"vmId"`                // VM the record refers to
+	State     string    `json:"state"`               // Final state (e.g., "deleted", "failed")
+	Message   string    `json:"message,omitempty"`   // Error details or other context
+	RequestID string    `json:"requestId,omitempty"` // X-Request-ID of the command that led to the state, if any
+	Timestamp time.Time `json:"timestamp"`           // When the VM reached the state
+}
+
+// VMHistoryEntry is the local accounting record of a VM provisioned on the
+// node, kept whether or not the orchestrator has seen it.
+type VMHistoryEntry struct {
+	VMID            string     `json:"vmId"`
+	ImageName       string     `json:"imageName,omitempty"`
+	Tenant          string     `json:"tenant,omitempty"`
+	Workload        string     `json:"workload,omitempty"`
+	StartedAt       time.Time  `json:"startedAt"`            // When provisioning started
+	ReadyAt         *time.Time `json:"readyAt,omitempty"`    // When provisioning succeeded
+	EndedAt         *time.Time `json:"endedAt,omitempty"`    // When the VM was deleted or failed; nil while it exists
+	DurationSeconds int64      `json:"durationSeconds"`      // From StartedAt to EndedAt, or until now
+	ExitReason      string     `json:"exitReason,omitempty"` // "deleted", "job-finished", "failed" or "interrupted"
+	Message         string     `json:"message,omitempty"`    // Error of a failed provision
+}
+
+// WarmPoolStatus describes the standby VMs the agent keeps booted so that
+// provisions of their image only need to install the runner.
+type WarmPoolStatus struct {
+	Image     string `json:"image"`     // Image the standby VMs are created from
+	Size      int    `json:"size"`      // Configured number of standby VMs
+	Ready     int    `json:"ready"`     // Standby VMs booted and ready to be adopted
+	Preparing bool   `json:"preparing"` // Whether a standby VM is being cloned and booted
+}
+
+// CordonState tells whether the node is cordoned, i.e. takes no new VMs.
+type CordonState struct {
+	Cordoned bool      `json:"cordoned"`
+	Reason   string    `json:"reason,omitempty"` // Why the node was cordoned (e.g., "macOS update")
+	Since    time.Time `json:"since,omitzero"`   // When the node was cordoned
+}
+
+// CordonRequest is the optional body of POST /cordon.
+type CordonRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// Host power actions of POST /admin/reboot and /admin/shutdown.
+const (
+	HostReboot   = "reboot"
+	HostShutdown = "shutdown"
+)
+
+// HostPowerRequest is the optional body of POST /admin/reboot and /admin/shutdown.
+type HostPowerRequest struct {
+	Reason string `json:"reason,omitempty"`
+	Force  bool   `json:"force,omitempty"` // Act even while VMs are running or the agent's launchd job can't be checked
+}
+
+// HostPowerAction is a reboot or shutdown of the host requested through the
+// agent, persisted until the host boots again.
+type HostPowerAction struct {
+	Action      string    `json:"action"` // HostReboot or HostShutdown
+	Reason      string    `json:"reason,omitempty"`
+	RequestID   string    `json:"requestId,omitempty"`
+	RequestedAt time.Time `json:"requestedAt"`
+	Forced      bool      `json:"forced,omitempty"`
+	RunningVMs  []string  `json:"runningVms,omitempty"` // VMs that were still running, when forced
+	Cordoned    bool      `json:"cordoned,omitempty"`   // The action cordoned the node, so the agent uncordons it after boot
+	BootedAt    time.Time `json:"bootedAt,omitzero"`    // When the host booted again, once it has
+}
+
+// States of the maintenance window scheduler.
+const (
+	MaintenanceIdle     = "idle"     // Waiting for the next window
+	MaintenanceDraining = "draining" // Cordoned, waiting for VMs to finish
+	MaintenanceRunning  = "running"  // Running the maintenance hook
+)
+
+// Results of a maintenance window.
+const (
+	MaintenanceCompleted  = "completed"   // The node drained and the hook, if any, succeeded
+	MaintenanceFailed     = "failed"      // The hook failed or timed out
+	MaintenanceNotDrained = "not-drained" // VMs were still running when the window closed
+	MaintenanceAborted    = "aborted"     // The node was uncordoned during the window
+)
+
+// MaintenanceStatus describes the node's maintenance windows.
+type MaintenanceStatus struct {
+	Schedule      string          `json:"schedule"`             // Cron spec of window starts, in the host's time zone
+	WindowSeconds int64           `json:"windowSeconds"`        // How long each window stays open
+	State         string          `json:"state"`                // MaintenanceIdle, MaintenanceDraining or MaintenanceRunning
+	WindowStart   time.Time       `json:"windowStart,omitzero"` // Start of the open window, if any
+	WindowEnd     time.Time       `json:"windowEnd,omitzero"`   // End of the open window, if any
+	NextWindow    time.Time       `json:"nextWindow,omitzero"`  // Start of the next window
+	LastWindow    *MaintenanceRun `json:"lastWindow,omitempty"` // The most recent window that closed
+}
+
+// MaintenanceRun is the outcome of a maintenance window.
+type MaintenanceRun struct {
+	Start  time.Time `json:"start"`           // When the window opened
+	End    time.Time `json:"end"`             // When maintenance finished or the window closed
+	Result string    `json:"result"`          // MaintenanceCompleted, MaintenanceFailed, MaintenanceNotDrained or MaintenanceAborted
+	Error  string    `json:"error,omitempty"` // Why the window didn't complete
 }
 
 // VMRequest defines the structure for requesting a new VM from the orchestrator.
@@ -31,12 +558,364 @@ type VMRequest struct {
 
 // VMProvisionCommand represents a command from the orchestrator to provision a VM.
 type VMProvisionCommand struct {
-	VMID      string `json:"vmId"`      // Unique ID for the new VM
-	ImageName string `json:"imageName"` // Image to use for the VM
+	VMID        string   `json:"vmId"`                  // Unique ID for the new VM
+	ImageName   string   `json:"imageName"`             // Image to use for the VM
+	GitHubOrg   string   `json:"githubOrg"`             // GitHub organization or user the runner registers with
+	GitHubRepo  string   `json:"githubRepo,omitempty"`  // Repository for repo-level runners; empty for org-level runners
+	RunnerGroup string   `json:"runnerGroup,omitempty"` // Runner group to join (org-level runners only)
+	Labels      []string `json:"labels,omitempty"`      // Runner labels; defaults to "macos"
+	Ephemeral   bool     `json:"ephemeral,omitempty"`   // Register the runner with --ephemeral (one job, then exit)
+	Tenant      string   `json:"tenant,omitempty"`      // Team the request is scheduled for; defaults to GitHubOrg
+	// Workload is the CI agent installed in the VM: "github" (GitHub Actions
+	// runner, the default), "buildkite" (Buildkite agent) or "gitlab" (GitLab
+	// runner). Labels are the Buildkite agent's tags; GitLab runners take
+	// their tags from the runner authentication token.
+	Workload string `json:"workload,omitempty"`
+	// NodeSelector lists requirements on the node's labels ("key",
+	// "key=value", "key!=value" or "!key") that must all hold for the node to
+	// accept the request.
+	NodeSelector []string `json:"nodeSelector,omitempty"`
+	// ImageRequirements lists requirements on the tools installed in the
+	// image, e.g. "xcode>=15.2", "macos>=14.4" or "iphoneos>=17.2", that must
+	// all hold for the VM to be created.
+	ImageRequirements []string `json:"imageRequirements,omitempty"`
+	// Tolerations lists the node taints ("key" or "key=value") the request
+	// tolerates. A node rejects requests that don't tolerate all its taints.
+	Tolerations []string `json:"tolerations,omitempty"`
+	// InstallationToken is an optional GitHub App installation token used for JIT
+	// registration when the agent has no App credentials of its own.
+	InstallationToken string `json:"installationToken,omitempty"`
+	// Steps are custom scripts run inside the VM, in order, before the runner is installed.
+	Steps []ProvisionStep `json:"steps,omitempty"`
+	// Users are guest accounts created inside the VM before any steps run.
+	Users []GuestUser `json:"users,omitempty"`
+	// HardwareModel is the base64 Virtualization framework hardware model to
+	// boot the VM with. It defaults to the one cached with the image.
+	HardwareModel string `json:"hardwareModel,omitempty"`
+	// NetworkMode is how the VM is networked: "nat" (the default), "bridged"
+	// onto NetworkInterface, "softnet" (NAT isolated from other VMs and the
+	// host's LAN) or "host-only".
+	NetworkMode      string `json:"networkMode,omitempty"`
+	NetworkInterface string `json:"networkInterface,omitempty"` // Host interface to bridge onto, e.g. "en0"
+	// MACAddress assigns the VM's MAC address, e.g. one with a DHCP reservation.
+	// It defaults to one derived from the node and VM IDs.
+	MACAddress string `json:"macAddress,omitempty"`
+	// DiskSizeGB grows the VM's boot disk, and its APFS volume, beyond the
+	// image's size. 0 keeps the image's size.
+	DiskSizeGB int `json:"diskSizeGb,omitempty"`
+	// Disks are data disks attached to the VM besides its boot disk, e.g. a
+	// scratch volume for DerivedData. They are deleted with the VM.
+	Disks []VMDisk `json:"disks,omitempty"`
+	// CPUPolicy lowers or raises the scheduling priority of the VM's process
+	// on the host; nil runs it at default priority.
+	CPUPolicy *VMCPUPolicy `json:"cpuPolicy,omitempty"`
+	// CPUs, MemoryMB and Display size the VM; 0 or "" keeps the image's.
+	CPUs     int    `json:"cpus,omitempty"`
+	MemoryMB int    `json:"memoryMb,omitempty"`
+	Display  string `json:"display,omitempty"` // Width x height in pixels, e.g. "1920x1080"
+	// Profile names a VM profile of the node whose settings fill in what the
+	// request leaves out. Without one, the first profile for the request's
+	// image, or else for one of its labels, applies.
+	Profile string `json:"profile,omitempty"`
 	// Add other VM configuration details
 }
 
+// QoS classes of VMCPUPolicy.
+const (
+	VMQoSUtility     = "utility"     // Below default priority, on any core
+	VMQoSBackground  = "background"  // Lowest priority, kept on efficiency cores on Apple Silicon
+	VMQoSInteractive = "interactive" // Highest throughput and latency tiers, favoring performance cores
+)
+
+// VMCPUPolicy sets how the host schedules a VM's process, so VMs running
+// batch work yield the CPU to latency-sensitive CI jobs, e.g. while images
+// download. It is applied whenever the VM's process is started.
+type VMCPUPolicy struct {
+	Nice int    `json:"nice,omitempty"` // Added to the process's nice value, 0 to 20; higher yields more
+	QoS  string `json:"qos,omitempty"`  // VMQoSUtility, VMQoSBackground or VMQoSInteractive; "" for default
+}
+
+// VMDisk is a data disk attached to a VM: a blank sparse disk of SizeGB, or a
+// copy of a cached Image.
+type VMDisk struct {
+	Name   string `json:"name"`             // Identifies the disk within the VM
+	SizeGB int    `json:"sizeGb,omitempty"` // Size of a blank disk
+	Image  string `json:"image,omitempty"`  // Image the disk is cloned from, downloaded if not cached
+}
+
+// GuestUser is a user account to create or configure inside the VM.
+type GuestUser struct {
+	Username          string   `json:"username"`                    // Short (account) name
+	FullName          string   `json:"fullName,omitempty"`          // Display name; defaults to the username
+	Password          string   `json:"password,omitempty"`          // Login password
+	PasswordSecret    string   `json:"passwordSecret,omitempty"`    // Name of a secret holding the password, instead of Password
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"` // Public keys allowed to SSH in as this user
+	Admin             bool     `json:"admin,omitempty"`             // Add the user to the admin group
+	AutoLogin         bool     `json:"autoLogin,omitempty"`         // Log this user in automatically at boot
+}
+
+// ProvisionStep is a script run inside the VM during provisioning.
+type ProvisionStep struct {
+	Name           string `json:"name,omitempty"`           // Label used in logs
+	Interpreter    string `json:"interpreter,omitempty"`    // e.g. "bash", "zsh", "/usr/bin/env python3"; defaults to bash
+	Script         string `json:"script"`                   // Script body, streamed to the interpreter on stdin
+	TimeoutSeconds int    `json:"timeoutSeconds,omitempty"` // Per-step timeout; defaults to ProvisionStepTimeout
+}
+
 // VMDeleteCommand represents a command from the orchestrator to delete a VM.
 type VMDeleteCommand struct {
 	VMID string `json:"vmId"` // ID of the VM to delete
 }
+
+// CommandQueueStatus describes the queue VM commands run from.
+type CommandQueueStatus struct {
+	Workers             int            `json:"workers"`                       // Commands run at once
+	Busy                int            `json:"busy"`                          // Workers running a command
+	Queued              int            `json:"queued"`                        // Commands waiting for a worker
+	ByPriority          map[string]int `json:"byPriority,omitempty"`          // Queued commands per priority: delete, control, provision
+	OldestQueuedSeconds int64          `json:"oldestQueuedSeconds,omitempty"` // How long the oldest queued command has waited
+}
+
+// VMStatusUpdate is sent to the orchestrator when a provision or delete command completes.
+type VMStatusUpdate struct {
+	NodeID  string `json:"nodeId"`            // Node reporting the update
+	VMID    string `json:"vmId"`              // VM the update refers to
+	Status  string `json:"status"`            // Outcome (e.g., "ready", "failed", "deleted", "stopped")
+	Message string `json:"message,omitempty"` // Error details or other context
+	// X-Request-ID of the command the update reports on, also sent as a header.
+	RequestID string `json:"requestId,omitempty"`
+	// Guest network self-test results gathered during provisioning.
+	Reachability []ReachabilityResult `json:"reachability,omitempty"`
+	// Where the time of the provision went; set on "ready" and "failed" updates of provisions.
+	ProvisionReport *ProvisionReport `json:"provisionReport,omitempty"`
+	// How the VM's runner was confirmed registered; set on "ready" updates of
+	// provisions when runner confirmation is enabled.
+	Runner *RunnerRegistration `json:"runner,omitempty"`
+}
+
+// RunnerRegistration confirms that the GitHub runner installed in a VM
+// registered, as checked after its install script ran.
+type RunnerRegistration struct {
+	Name        string    `json:"name"`
+	ID          int64     `json:"id,omitempty"`     // Runner ID at GitHub
+	Status      string    `json:"status,omitempty"` // Runner status at GitHub, "online", when confirmed through its API
+	Labels      []string  `json:"labels,omitempty"` // Labels GitHub lists for the runner, when confirmed through its API
+	ConfirmedBy string    `json:"confirmedBy"`      // "file" or "github"
+	ConfirmedAt time.Time `json:"confirmedAt"`
+}
+
+// ProvisionReport breaks down how long a provision took by stage, so
+// provisioning time can be compared across the fleet and between agent
+// versions. Stages the provision didn't go through are 0.
+type ProvisionReport struct {
+	VMID            string          `json:"vmId"`
+	ImageName       string          `json:"imageName"`
+	Succeeded       bool            `json:"succeeded"`
+	FailedPhase     string          `json:"failedPhase,omitempty"`   // Phase the provision failed in
+	TimedOutStage   string          `json:"timedOutStage,omitempty"` // Stage whose timeout failed the provision: download, create, ip, ssh or runner-install
+	FromWarmPool    bool            `json:"fromWarmPool,omitempty"`  // A standby VM was adopted instead of cloning and booting one
+	IPDiscovery     string          `json:"ipDiscovery,omitempty"`   // IP discovery strategy that found the booted VM's address: tart, dhcp or arp
+	StartedAt       time.Time       `json:"startedAt"`
+	DownloadMs      int64           `json:"downloadMs"`      // Waiting for the image to download
+	CloneMs         int64           `json:"cloneMs"`         // Cloning the image, or adopting a standby VM
+	BootToIPMs      int64           `json:"bootToIpMs"`      // From starting the VM until it had an IP address
+	SSHReadyMs      int64           `json:"sshReadyMs"`      // From having an IP address until SSH answered
+	RunnerInstallMs int64           `json:"runnerInstallMs"` // Installing and registering the runner, retries included
+	TotalMs         int64           `json:"totalMs"`         // The whole provision, from its start to its end
+	Steps           []OperationStep `json:"steps"`           // Every phase and sub-step, in completion order
+}
+
+// UtilizationRollup summarizes node utilization over a single hour.
+type UtilizationRollup struct {
+	Hour              time.Time `json:"hour"`              // Start of the hour (UTC)
+	Samples           int       `json:"samples"`           // Number of heartbeat samples in the hour
+	AvgVMCount        float64   `json:"avgVmCount"`        // Average number of running VMs
+	MaxVMCount        int       `json:"maxVmCount"`        // Peak number of running VMs
+	AvgCPUPercent     float64   `json:"avgCpuPercent"`     // Average host CPU usage percentage
+	AvgMemoryUsageGB  float64   `json:"avgMemoryUsageGB"`  // Average host memory usage in GB
+	Provisions        int       `json:"provisions"`        // Provisioning attempts completed in the hour
+	ProvisionFailures int       `json:"provisionFailures"` // Provisioning attempts that failed
+	Deletions         int       `json:"deletions"`         // VMs deleted in the hour
+}
+
+// NodeEvent is an out-of-band notification from the agent (e.g., a thermal alert).
+type NodeEvent struct {
+	NodeID    string            `json:"nodeId"`              // Node emitting the event
+	Type      string            `json:"type"`                // Event type (e.g., "thermal.critical")
+	Message   string            `json:"message"`             // Human-readable description
+	Details   map[string]string `json:"details,omitempty"`   // Additional event-specific data
+	RequestID string            `json:"requestId,omitempty"` // X-Request-ID of the command the event belongs to, if any
+	Timestamp time.Time         `json:"timestamp"`           // When the event occurred (UTC)
+}
+
+// DryRunResult contains the rendered provisioning artifacts for a request that was not executed.
+type DryRunResult struct {
+	VMID        string            `json:"vmId"`                // VM ID from the request
+	ImageName   string            `json:"imageName"`           // Image the VM would boot from
+	ImageCached bool              `json:"imageCached"`         // Whether the image is already cached on this node
+	ImagePath   string            `json:"imagePath,omitempty"` // Cached image path, if cached
+	Artifacts   map[string]string `json:"artifacts"`           // Rendered artifacts keyed by file name
+	Warnings    []string          `json:"warnings,omitempty"`  // Placeholder leaks and other problems found
+}
+
+// BackendStatus describes whether a VM backend is usable on this node.
+type BackendStatus struct {
+	Name     string `json:"name"`              // Backend name (e.g., "tart")
+	Path     string `json:"path,omitempty"`    // Resolved path of the backend binary
+	Version  string `json:"version,omitempty"` // Reported version, if available
+	Entitled bool   `json:"entitled"`          // Binary carries the Virtualization entitlement
+	Usable   bool   `json:"usable"`            // Backend can be used to provision VMs
+	Reason   string `json:"reason,omitempty"`  // Why the backend is not usable
+	Fix      string `json:"fix,omitempty"`     // How to make the backend usable
+}
+
+// Host and image CPU architectures.
+const (
+	ArchARM64 = "arm64" // Apple Silicon
+	ArchAMD64 = "amd64" // Intel
+)
+
+// NodeInfo describes the host and the VM backends detected at startup.
+type NodeInfo struct {
+	NodeID              string          `json:"nodeId"`              // Unique identifier for the Mac Mini
+	OS                  string          `json:"os"`                  // Host operating system
+	Arch                string          `json:"arch"`                // Host CPU architecture, ArchARM64 or ArchAMD64 even if the agent runs under Rosetta
+	OSVersion           string          `json:"osVersion,omitempty"` // Host macOS version, e.g. "15.1"
+	HypervisorSupported bool            `json:"hypervisorSupported"` // Host supports hardware virtualization
+	Backends            []BackendStatus `json:"backends"`            // Detection result for every known backend
+	SelectedBackend     string          `json:"selectedBackend"`     // Backend in use; empty if none is usable
+	Labels              []string        `json:"labels,omitempty"`    // Labels provision requests select the node by
+	Taints              []string        `json:"taints,omitempty"`    // Taints provision requests must tolerate
+}
+
+// VMTemplateRequest is the payload of POST /vms/{vmId}/template.
+type VMTemplateRequest struct {
+	Name string `json:"name"` // Image name the template is cached as
+}
+
+// VMExecRequest is the payload of POST /vms/{vmId}/exec.
+type VMExecRequest struct {
+	Command        string `json:"command"`                  // Shell command to run inside the VM
+	TimeoutSeconds int    `json:"timeoutSeconds,omitempty"` // Kill the command after this many seconds
+}
+
+// VMExecOutput is one newline-delimited JSON chunk of an exec response. Output
+// chunks carry Stream and Data; the final chunk carries ExitCode.
+type VMExecOutput struct {
+	Stream   string `json:"stream,omitempty"`   // "stdout" or "stderr"
+	Data     string `json:"data,omitempty"`     // Output text
+	ExitCode *int   `json:"exitCode,omitempty"` // Exit code of the command (-1 if it didn't complete)
+	Error    string `json:"error,omitempty"`    // Set if the command couldn't be run or timed out
+}
+
+// Operation describes a background task currently running in the agent.
+type Operation struct {
+	ID             string     `json:"id"`                  // Unique operation ID
+	Kind           string     `json:"kind"`                // Operation type (e.g., "provision", "delete", "image-download")
+	Target         string     `json:"target"`              // VM ID or image name the operation acts on
+	RequestID      string     `json:"requestId,omitempty"` // X-Request-ID of the command that started the operation
+	Phase          string     `json:"phase"`               // Current step of the operation
+	StartedAt      time.Time  `json:"startedAt"`           // When the operation started
+	ElapsedSeconds int64      `json:"elapsedSeconds"`      // Time since the operation started
+	Deadline       *time.Time `json:"deadline,omitempty"`  // When the current phase times out, if bounded
+	// Timings of completed phases and sub-steps, in completion order.
+	Steps []OperationStep `json:"steps,omitempty"`
+}
+
+// OperationStep is the duration of one completed phase or sub-step of an operation.
+type OperationStep struct {
+	Name       string `json:"name"`       // Phase or sub-step name
+	DurationMs int64  `json:"durationMs"` // How long it took
+}
+
+// GCResult is the outcome of collecting stale VM directories.
+type GCResult struct {
+	Removed        []string `json:"removed"`            // IDs of VMs whose directories were deleted
+	Archived       []string `json:"archived,omitempty"` // Log archives written for them
+	ReclaimedBytes int64    `json:"reclaimedBytes"`     // Disk space freed
+}
+
+// ErrorResponse is the body of every error response of the agent API.
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// APIError describes why a request failed.
+type APIError struct {
+	Code    string `json:"code"`    // Stable, machine-readable error code (e.g., "invalid_vm_id")
+	Message string `json:"message"` // Human-readable details
+}
+
+// HealthReport is the result of an on-demand health check of a running VM.
+type HealthReport struct {
+	VMID      string              `json:"vmId"`      // VM that was checked
+	Healthy   bool                `json:"healthy"`   // Whether every check passed
+	CheckedAt time.Time           `json:"checkedAt"` // When the checks started
+	Checks    []HealthCheckResult `json:"checks"`    // Result of each check, in the order run
+}
+
+// HealthCheckResult is the outcome of one check of a health report.
+type HealthCheckResult struct {
+	Name       string `json:"name"`             // Check name (e.g., "ssh", "disk", "runner", "clock")
+	Healthy    bool   `json:"healthy"`          // Whether the check passed
+	Detail     string `json:"detail,omitempty"` // Measured value, e.g. free disk space or clock skew
+	Error      string `json:"error,omitempty"`  // Why the check failed
+	DurationMs int64  `json:"durationMs"`       // How long the check took
+}
+
+// DoctorReport is the result of checking the host prerequisites of the agent.
+type DoctorReport struct {
+	NodeID    string        `json:"nodeId"`
+	Healthy   bool          `json:"healthy"`   // Whether every check passed
+	CheckedAt time.Time     `json:"checkedAt"` // When the checks started
+	Checks    []DoctorCheck `json:"checks"`    // Result of each check, in the order run
+}
+
+// Liveness is the response of GET /healthz: the agent process is up and
+// serving with its configuration loaded.
+type Liveness struct {
+	Status        string `json:"status"` // Always "ok"
+	NodeID        string `json:"nodeId"`
+	AgentVersion  string `json:"agentVersion"`
+	UptimeSeconds int64  `json:"uptimeSeconds"`
+}
+
+// DoctorCheck is the outcome of one prerequisite check of a doctor report.
+type DoctorCheck struct {
+	Name   string `json:"name"`             // Check name (e.g., "backend", "directories", "gcs")
+	OK     bool   `json:"ok"`               // Whether the check passed
+	Detail string `json:"detail,omitempty"` // What was found, or why the check failed
+	Fix    string `json:"fix,omitempty"`    // What to do about a failure
+}
+
+// Outcomes of audited commands. Asynchronous commands get an "accepted" entry
+// when they are received and a "succeeded" or "failed" one when they finish.
+const (
+	AuditAccepted  = "accepted"  // Asynchronous command accepted; its result follows in a later entry
+	AuditRejected  = "rejected"  // Command refused with an error response
+	AuditCompleted = "completed" // Synchronous command finished, e.g. exec with its exit code
+	AuditSucceeded = "succeeded" // Asynchronous command finished successfully
+	AuditFailed    = "failed"    // Command failed after it was accepted
+)
+
+// AuditEntry is one line of the audit log of orchestrator commands.
+type AuditEntry struct {
+	Seq           int64     `json:"seq"`                // Position in the log, increasing by one per entry
+	Time          time.Time `json:"time"`               // When the entry was written
+	RequestID     string    `json:"requestId"`          // X-Request-ID of the command, shared by its entries
+	Source        string    `json:"source"`             // Client IP of the command, or "heartbeat" for commands from heartbeat responses
+	Principal     string    `json:"principal"`          // Authenticated identity of the caller
+	Command       string    `json:"command"`            // "provision", "delete" or "exec"
+	VMID          string    `json:"vmId,omitempty"`     // VM the command targets
+	PayloadSHA256 string    `json:"payloadSha256"`      // SHA256 of the request body
+	Outcome       string    `json:"outcome"`            // One of the Audit* outcomes
+	Status        int       `json:"status,omitempty"`   // HTTP status of the response; 0 for results of asynchronous commands
+	ExitCode      *int      `json:"exitCode,omitempty"` // Exit code of an exec command
+	Error         string    `json:"error,omitempty"`    // Why the command failed
+}
+
+// AuditPage is a page of audit log entries returned by GET /audit.
+type AuditPage struct {
+	Entries   []AuditEntry `json:"entries"`             // Oldest first
+	NextAfter int64        `json:"nextAfter,omitempty"` // Pass as ?after= for the next page; absent on the last page
+}
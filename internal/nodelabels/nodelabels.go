@@ -0,0 +1,196 @@
+package nodelabels
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrSelectorMismatch is returned when a provision request's node
+	// selector doesn't match the node's labels.
+	ErrSelectorMismatch = errors.New("node selector does not match")
+	// ErrTaintNotTolerated is returned when a provision request doesn't
+	// tolerate one of the node's taints.
+	ErrTaintNotTolerated = errors.New("node taint not tolerated")
+)
+
+// Node holds the labels and taints a node is configured with. Labels are
+// "key" or "key=value", e.g. "xcode15" or "team=ios", and let provision
+// requests select the nodes they run on. Taints use the same form and keep
+// off every provision request that doesn't tolerate them, so a node can be
+// reserved for a team or a kind of job.
+type Node struct {
+	labels map[string]string
+	taints map[string]string
+}
+
+// Parse parses the configured labels and taints of the node.
+func Parse(labels, taints []string) (*Node, error) {
+	n := &Node{labels: make(map[string]string), taints: make(map[string]string)}
+	for _, label := range labels {
+		key, value, err := parsePair(label)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node label '%s': %w", label, err)
+		}
+		n.labels[key] = value
+	}
+	for _, taint := range taints {
+		key, value, err := parsePair(taint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node taint '%s': %w", taint, err)
+		}
+		n.taints[key] = value
+	}
+	return n, nil
+}
+
+// Labels returns the node's labels as "key" or "key=value", sorted.
+func (n *Node) Labels() []string {
+	return format(n.labels)
+}
+
+// Taints returns the node's taints as "key" or "key=value", sorted.
+func (n *Node) Taints() []string {
+	return format(n.taints)
+}
+
+// Admit checks a provision request's node selector and tolerations against
+// the node. Each selector requirement is one of:
+//
+//	key          the node has label key
+//	key=value    the node has label key with value
+//	key!=value   the node doesn't have label key with value
+//	!key         the node doesn't have label key
+//
+// A toleration "key" tolerates the taint key whatever its value, and
+// "key=value" only the taint key with that value.
+func (n *Node) Admit(selector, tolerations []string) error {
+	for _, req := range selector {
+		ok, err := n.matches(req)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: node labels %s do not satisfy %q", ErrSelectorMismatch, describe(n.Labels()), req)
+		}
+	}
+	for _, key := range sortedKeys(n.taints) {
+		if !tolerates(tolerations, key, n.taints[key]) {
+			return fmt.Errorf("%w: %s", ErrTaintNotTolerated, pair(key, n.taints[key]))
+		}
+	}
+	return nil
+}
+
+// matches reports whether the node's labels satisfy a selector requirement.
+func (n *Node) matches(req string) (bool, error) {
+	if key, ok := strings.CutPrefix(req, "!"); ok {
+		if err := checkPart(key); err != nil {
+			return false, fmt.Errorf("invalid node selector %q: %w", req, err)
+		}
+		_, found := n.labels[key]
+		return !found, nil
+	}
+	if key, value, ok := strings.Cut(req, "!="); ok {
+		if err := checkParts(key, value); err != nil {
+			return false, fmt.Errorf("invalid node selector %q: %w", req, err)
+		}
+		actual, found := n.labels[key]
+		return !found || actual != value, nil
+	}
+	key, value, err := parsePair(req)
+	if err != nil {
+		return false, fmt.Errorf("invalid node selector %q: %w", req, err)
+	}
+	actual, found := n.labels[key]
+	if !strings.Contains(req, "=") {
+		return found, nil
+	}
+	return found && actual == value, nil
+}
+
+// ValidSelector checks the syntax of a node selector requirement.
+func ValidSelector(req string) error {
+	_, err := (&Node{}).matches(req)
+	return err
+}
+
+// ValidToleration checks the syntax of a toleration.
+func ValidToleration(toleration string) error {
+	if _, _, err := parsePair(toleration); err != nil {
+		return fmt.Errorf("invalid toleration %q: %w", toleration, err)
+	}
+	return nil
+}
+
+// tolerates reports whether tolerations tolerate the taint key=value.
+func tolerates(tolerations []string, key, value string) bool {
+	for _, toleration := range tolerations {
+		k, v, hasValue := strings.Cut(toleration, "=")
+		if k == key && (!hasValue || v == value) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePair splits "key" or "key=value" and checks both parts.
+func parsePair(s string) (string, string, error) {
+	key, value, _ := strings.Cut(s, "=")
+	if err := checkParts(key, value); err != nil {
+		return "", "", err
+	}
+	return key, value, nil
+}
+
+func checkParts(key, value string) error {
+	if err := checkPart(key); err != nil {
+		return err
+	}
+	if value != "" {
+		return checkPart(value)
+	}
+	return nil
+}
+
+// checkPart checks a label key or value: 1-63 characters, none of them
+// whitespace, commas or the operators of selectors.
+func checkPart(s string) error {
+	if s == "" || len(s) > 63 || strings.ContainsAny(s, "=!, \t\r\n") {
+		return errors.New("expected key or key=value of 1-63 characters without whitespace, commas, '=' or '!'")
+	}
+	return nil
+}
+
+func pair(key, value string) string {
+	if value == "" {
+		return key
+	}
+	return key + "=" + value
+}
+
+func format(m map[string]string) []string {
+	out := make([]string, 0, len(m))
+	for _, key := range sortedKeys(m) {
+		out = append(out, pair(key, m[key]))
+	}
+	return out
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func describe(labels []string) string {
+	if len(labels) == 0 {
+		return "(none)"
+	}
+	return "[" + strings.Join(labels, ", ") + "]"
+}
@@ -0,0 +1,221 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/requestid"
+	"github.com/changty97/macvmagt/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracker records the background operations (provisions, deletes, image
+// downloads) currently running in the agent.
+type Tracker struct {
+	mu     sync.Mutex            // Protects active
+	active map[string]*Operation // Keyed by operation ID
+	nextID atomic.Uint64
+}
+
+// NewTracker creates an empty operation Tracker.
+func NewTracker() *Tracker {
+	return &Tracker{active: make(map[string]*Operation)}
+}
+
+// Operation is a single in-flight background task. Call Done when it finishes.
+// It is traced as a span with a child span per phase and sub-step.
+type Operation struct {
+	tracker      *Tracker
+	id           string
+	kind         string
+	target       string
+	requestID    string // Of the command that started the operation, if any
+	startedAt    time.Time
+	span         trace.Span // Spans the whole operation
+	mu           sync.Mutex // Protects the fields below
+	phase        string
+	phaseStarted time.Time
+	deadline     time.Time
+	steps        []models.OperationStep // Completed phases and sub-steps, in completion order
+	ctx          context.Context        // Carries phaseSpan, the span of the current phase
+	phaseSpan    trace.Span
+}
+
+// Start registers a new operation of the given kind (e.g., "provision") acting
+// on target (e.g., a VM ID or image name), starting a new trace for it.
+func (t *Tracker) Start(kind, target string) *Operation {
+	return t.StartContext(context.Background(), kind, target)
+}
+
+// StartContext is like Start, but traces the operation as part of the trace in
+// ctx, e.g. that of the request that started it, and records the request's
+// ID. The operation outlives ctx: its Context isn't canceled with it.
+func (t *Tracker) StartContext(ctx context.Context, kind, target string) *Operation {
+	op := &Operation{
+		tracker:   t,
+		id:        fmt.Sprintf("%s-%d", kind, t.nextID.Add(1)),
+		kind:      kind,
+		target:    target,
+		requestID: requestid.FromContext(ctx),
+		startedAt: time.Now(),
+		phase:     "starting",
+	}
+	op.phaseStarted = op.startedAt
+	ctx, op.span = tracing.Start(context.WithoutCancel(ctx), kind,
+		attribute.String("macvmagt.operation.id", op.id),
+		attribute.String("macvmagt.operation.target", target),
+		attribute.String("macvmagt.request.id", op.requestID),
+	)
+	op.ctx, op.phaseSpan = tracing.Start(ctx, op.phase)
+	t.mu.Lock()
+	t.active[op.id] = op
+	t.mu.Unlock()
+	return op
+}
+
+// Busy reports whether any running operation acts on target.
+func (t *Tracker) Busy(target string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, op := range t.active {
+		if op.target == target {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns a snapshot of all running operations, oldest first.
+func (t *Tracker) List() []models.Operation {
+	t.mu.Lock()
+	ops := make([]*Operation, 0, len(t.active))
+	for _, op := range t.active {
+		ops = append(ops, op)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(ops, func(i, j int) bool { return ops[i].startedAt.Before(ops[j].startedAt) })
+
+	list := make([]models.Operation, 0, len(ops))
+	for _, op := range ops {
+		list = append(list, op.snapshot())
+	}
+	return list
+}
+
+// SetPhase records the step the operation is currently in, records how long
+// the previous phase took and clears any deadline belonging to it.
+func (op *Operation) SetPhase(phase string) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	now := time.Now()
+	op.steps = append(op.steps, models.OperationStep{Name: op.phase, DurationMs: now.Sub(op.phaseStarted).Milliseconds()})
+	op.phase = phase
+	op.phaseStarted = now
+	op.deadline = time.Time{}
+
+	op.phaseSpan.End(trace.WithTimestamp(now))
+	op.ctx, op.phaseSpan = tracing.Tracer().Start(trace.ContextWithSpan(op.ctx, op.span), phase, trace.WithTimestamp(now))
+}
+
+// RecordStep records the duration of a sub-step that ran within the current
+// phase, e.g. one of several concurrent copies.
+func (op *Operation) RecordStep(name string, duration time.Duration) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.steps = append(op.steps, models.OperationStep{Name: name, DurationMs: duration.Milliseconds()})
+
+	end := time.Now()
+	_, span := tracing.Tracer().Start(op.ctx, name, trace.WithTimestamp(end.Add(-duration)))
+	span.End(trace.WithTimestamp(end))
+}
+
+// Context returns a context carrying the span of the current phase, so work
+// done in it, such as SSH commands, is traced as part of the operation.
+func (op *Operation) Context() context.Context {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.ctx
+}
+
+// Trace returns ctx carrying the span of the current phase, for work that has
+// to keep ctx's deadline and cancellation.
+func (op *Operation) Trace(ctx context.Context) context.Context {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return trace.ContextWithSpan(ctx, op.phaseSpan)
+}
+
+// Fail marks the operation's span as failed with err, if non-nil.
+func (op *Operation) Fail(err error) {
+	tracing.Fail(op.span, err)
+}
+
+// Steps returns the timings of completed phases and sub-steps so far.
+func (op *Operation) Steps() []models.OperationStep {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return append([]models.OperationStep(nil), op.steps...)
+}
+
+// Timings returns the timings of completed phases and sub-steps, followed by
+// the current phase so far, e.g. to report where a failed operation stopped.
+func (op *Operation) Timings() []models.OperationStep {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	steps := append([]models.OperationStep(nil), op.steps...)
+	return append(steps, models.OperationStep{Name: op.phase, DurationMs: time.Since(op.phaseStarted).Milliseconds()})
+}
+
+// Phase returns the step the operation is currently in.
+func (op *Operation) Phase() string {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.phase
+}
+
+// SetDeadline records when the current phase will be abandoned.
+func (op *Operation) SetDeadline(deadline time.Time) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.deadline = deadline
+}
+
+// Done removes the operation from its tracker and ends its spans.
+func (op *Operation) Done() {
+	op.tracker.mu.Lock()
+	delete(op.tracker.active, op.id)
+	op.tracker.mu.Unlock()
+
+	op.mu.Lock()
+	op.phaseSpan.End()
+	op.mu.Unlock()
+	op.span.End()
+}
+
+func (op *Operation) snapshot() models.Operation {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	snapshot := models.Operation{
+		ID:             op.id,
+		Kind:           op.kind,
+		Target:         op.target,
+		RequestID:      op.requestID,
+		Phase:          op.phase,
+		StartedAt:      op.startedAt,
+		ElapsedSeconds: int64(time.Since(op.startedAt).Seconds()),
+		Steps:          append([]models.OperationStep(nil), op.steps...),
+	}
+	if !op.deadline.IsZero() {
+		deadline := op.deadline
+		snapshot.Deadline = &deadline
+	}
+	return snapshot
+}
@@ -0,0 +1,92 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/requestid"
+	"github.com/changty97/macvmagt/internal/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Headers identifying the node on every request to the orchestrator, so its
+// logs and WAF rules can attribute traffic without parsing request bodies.
+const (
+	HeaderNodeID       = "X-Macvmagt-Node-Id"
+	HeaderVersion      = "X-Macvmagt-Version"
+	HeaderCapabilities = "X-Macvmagt-Capabilities"
+)
+
+// Client sends heartbeats, status updates and events to the orchestrator.
+type Client struct {
+	cfg            *config.Config
+	httpClient     *http.Client
+	userAgent      string
+	capabilityHash string
+}
+
+// NewClient creates an orchestrator Client for a node with the given detected capabilities.
+func NewClient(cfg *config.Config, nodeInfo *models.NodeInfo) *Client {
+	userAgent := cfg.UserAgent
+	if userAgent == "" {
+		userAgent = "macvmagt/" + version.Version
+	}
+	return &Client{
+		cfg:            cfg,
+		httpClient:     &http.Client{Timeout: 30 * time.Second},
+		userAgent:      userAgent,
+		capabilityHash: CapabilityHash(nodeInfo),
+	}
+}
+
+// CapabilityHash returns a short hash of what a node can run (OS, architecture,
+// hypervisor support and backends), which changes whenever any of it does.
+func CapabilityHash(nodeInfo *models.NodeInfo) string {
+	capabilities := *nodeInfo
+	capabilities.NodeID = "" // Identical nodes should hash identically
+	data, err := json.Marshal(capabilities)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Post sends payload as JSON to path (e.g., "/api/heartbeat") on the orchestrator.
+// The caller must close the response body.
+func (c *Client) Post(path string, payload interface{}) (*http.Response, error) {
+	return c.PostContext(context.Background(), path, payload)
+}
+
+// PostContext is like Post, but sends the request ID and trace context of
+// ctx along, e.g. those of the command a status update reports on. The
+// request isn't canceled with ctx.
+func (c *Client) PostContext(ctx context.Context, path string, payload interface{}) (*http.Response, error) {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload for %s: %w", path, err)
+	}
+
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), http.MethodPost, c.cfg.OrchestratorURL+path, bytes.NewReader(jsonPayload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for %s: %w", path, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", c.userAgent)
+	req.Header.Set(HeaderNodeID, c.cfg.NodeID)
+	req.Header.Set(HeaderVersion, version.Version)
+	req.Header.Set(HeaderCapabilities, c.capabilityHash)
+	requestid.Set(ctx, req.Header)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	return c.httpClient.Do(req)
+}
@@ -0,0 +1,204 @@
+package paths
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// legacyDirPrefix marks per-VM directories created by older agents (vm_<id>).
+const legacyDirPrefix = "vm_"
+
+// Per-VM subdirectories, relative to the VM's directory.
+const (
+	diskDir     = "disk"     // Cloned disk image
+	auxDir      = "aux"      // Auxiliary storage (NVRAM, machine identifier)
+	configDir   = "config"   // Rendered VM configuration
+	logsDir     = "logs"     // Console and provisioning logs
+	pidDir      = "pid"      // PID file of the process running the VM
+	metadataDir = "metadata" // Agent metadata about the VM
+)
+
+// Layout is the single on-disk layout of per-VM directories shared by every
+// package that reads or writes VM files:
+//
+//	<root>/<vmID>/disk/<vmID>.sparseimage
+//	<root>/<vmID>/disk/data-<name>.img
+//	<root>/<vmID>/aux/
+//	<root>/<vmID>/config/
+//	<root>/<vmID>/logs/
+//	<root>/<vmID>/pid/vm.pid
+//	<root>/<vmID>/metadata/vm.json
+type Layout struct {
+	root string
+}
+
+// New creates a Layout rooted at root.
+func New(root string) *Layout {
+	return &Layout{root: root}
+}
+
+// Root returns the directory holding all per-VM directories.
+func (l *Layout) Root() string { return l.root }
+
+// VMDir returns the directory of a VM.
+func (l *Layout) VMDir(vmID string) string { return filepath.Join(l.root, vmID) }
+
+// DiskPath returns the path of a VM's cloned disk image.
+func (l *Layout) DiskPath(vmID string) string {
+	return filepath.Join(l.VMDir(vmID), diskDir, vmID+".sparseimage")
+}
+
+// DataDiskPath returns the path of one of a VM's data disks.
+func (l *Layout) DataDiskPath(vmID, name string) string {
+	return filepath.Join(l.VMDir(vmID), diskDir, "data-"+name+".img")
+}
+
+// AuxDir returns the directory for a VM's auxiliary storage.
+func (l *Layout) AuxDir(vmID string) string { return filepath.Join(l.VMDir(vmID), auxDir) }
+
+// ConfigDir returns the directory for a VM's rendered configuration.
+func (l *Layout) ConfigDir(vmID string) string { return filepath.Join(l.VMDir(vmID), configDir) }
+
+// LogsDir returns the directory for a VM's logs.
+func (l *Layout) LogsDir(vmID string) string { return filepath.Join(l.VMDir(vmID), logsDir) }
+
+// PIDPath returns the PID file of the process running a VM.
+func (l *Layout) PIDPath(vmID string) string {
+	return filepath.Join(l.VMDir(vmID), pidDir, "vm.pid")
+}
+
+// MetadataPath returns the file holding the agent's metadata about a VM.
+func (l *Layout) MetadataPath(vmID string) string {
+	return filepath.Join(l.VMDir(vmID), metadataDir, "vm.json")
+}
+
+// Init creates the root directory with the given octal permissions (e.g.
+// "0755") and verifies the agent can write to it, so a misconfigured root is
+// reported at startup rather than on the first provision.
+func (l *Layout) Init(mode string) error {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return fmt.Errorf("invalid VM directory mode %q, expected octal permissions such as 0755", mode)
+	}
+	if err := os.MkdirAll(l.root, os.FileMode(perm)); err != nil {
+		return fmt.Errorf("failed to create VM directory root %s: %w", l.root, err)
+	}
+
+	probe, err := os.CreateTemp(l.root, ".write-check-")
+	if err != nil {
+		return fmt.Errorf("VM directory root %s is not writable by the agent: %w", l.root, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
+
+// Create makes a VM's directory and all of its subdirectories.
+func (l *Layout) Create(vmID string) error {
+	for _, sub := range []string{diskDir, auxDir, configDir, logsDir, pidDir, metadataDir} {
+		dir := filepath.Join(l.VMDir(vmID), sub)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create VM directory %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// List returns the IDs of all VMs that have a directory in the layout.
+func (l *Layout) List() ([]string, error) {
+	entries, err := os.ReadDir(l.root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM directory %s: %w", l.root, err)
+	}
+	var vmIDs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			vmIDs = append(vmIDs, entry.Name())
+		}
+	}
+	return vmIDs, nil
+}
+
+// Remove deletes a VM's directory and everything in it.
+func (l *Layout) Remove(vmID string) error {
+	return os.RemoveAll(l.VMDir(vmID))
+}
+
+// Rename moves a VM's directory to the one of newID, which must not exist yet.
+func (l *Layout) Rename(vmID, newID string) error {
+	newDir := l.VMDir(newID)
+	if _, err := os.Stat(newDir); err == nil {
+		return fmt.Errorf("cannot rename VM directory %s: %s already exists", l.VMDir(vmID), newDir)
+	}
+	if err := os.Rename(l.VMDir(vmID), newDir); err != nil {
+		return fmt.Errorf("failed to rename VM directory %s to %s: %w", l.VMDir(vmID), newDir, err)
+	}
+	return nil
+}
+
+// Migrate moves VM directories from older layouts into this one: vm_<id>
+// directories (in the root or in any legacyRoots) are renamed to <root>/<id>,
+// and disk images stored directly in a VM directory are moved into disk/.
+// Directories that would overwrite an existing VM are left in place. The root
+// must already exist (see Init).
+func (l *Layout) Migrate(legacyRoots ...string) error {
+	for _, legacyRoot := range append([]string{l.root}, legacyRoots...) {
+		entries, err := os.ReadDir(legacyRoot)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("failed to read VM directory %s: %w", legacyRoot, err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			vmID := entry.Name()
+			if legacyRoot != l.root || strings.HasPrefix(vmID, legacyDirPrefix) {
+				vmID = strings.TrimPrefix(vmID, legacyDirPrefix)
+				if err := l.moveDir(filepath.Join(legacyRoot, entry.Name()), vmID); err != nil {
+					log.Printf("Warning: %v", err)
+					continue
+				}
+			}
+			if err := l.migrateDisk(vmID); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// moveDir renames a legacy VM directory to its place in the layout.
+func (l *Layout) moveDir(oldDir, vmID string) error {
+	newDir := l.VMDir(vmID)
+	if _, err := os.Stat(newDir); err == nil {
+		return fmt.Errorf("not migrating %s: %s already exists", oldDir, newDir)
+	}
+	if err := os.Rename(oldDir, newDir); err != nil {
+		return fmt.Errorf("failed to migrate %s to %s: %w", oldDir, newDir, err)
+	}
+	log.Printf("Migrated VM directory %s to %s", oldDir, newDir)
+	return nil
+}
+
+// migrateDisk moves a flat <vmDir>/<vmID>.sparseimage into disk/.
+func (l *Layout) migrateDisk(vmID string) error {
+	flatDisk := filepath.Join(l.VMDir(vmID), vmID+".sparseimage")
+	if _, err := os.Stat(flatDisk); err != nil {
+		return nil
+	}
+	if err := l.Create(vmID); err != nil {
+		return err
+	}
+	if err := os.Rename(flatDisk, l.DiskPath(vmID)); err != nil {
+		return fmt.Errorf("failed to migrate disk of VM %s: %w", vmID, err)
+	}
+	log.Printf("Migrated disk image of VM %s to %s", vmID, l.DiskPath(vmID))
+	return nil
+}
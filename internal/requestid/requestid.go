@@ -0,0 +1,91 @@
+// Package requestid carries the ID correlating an orchestrator command with
+// everything the agent does for it: log lines, operations, status callbacks,
+// events and VM records. A CI job's provisioning path can then be followed
+// from the orchestrator through the agent and back.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Header carries the request ID on commands, their responses and the
+// agent's callbacks to the orchestrator.
+const Header = "X-Request-ID"
+
+// maxLength bounds the IDs accepted from callers, which end up in log lines.
+const maxLength = 128
+
+// contextKey carries the request ID in a context.
+type contextKey struct{}
+
+// New returns a random request ID.
+func New() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// FromRequest returns the ID of a request: its X-Request-ID header, else the
+// trace ID of its traceparent header, else a new ID. Header values that
+// aren't printable ASCII or are too long are ignored, so they can't forge
+// log lines.
+func FromRequest(r *http.Request) string {
+	if id := r.Header.Get(Header); valid(id) {
+		return id
+	}
+	carrier := propagation.HeaderCarrier(r.Header)
+	if sc := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), carrier)); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	return New()
+}
+
+// valid reports whether id may be used as a request ID.
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewContext returns ctx carrying the request ID id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID carried by ctx, or "" if there is none,
+// e.g. for work the agent started on its own.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// LogSuffix returns " (request <id>)", to end the log lines of the command
+// whose request ID ctx carries, or "" if it carries none.
+func LogSuffix(ctx context.Context) string {
+	if id := FromContext(ctx); id != "" {
+		return " (request " + id + ")"
+	}
+	return ""
+}
+
+// Set sets the request ID carried by ctx, if any, on the headers of an
+// outgoing request.
+func Set(ctx context.Context, header http.Header) {
+	if id := FromContext(ctx); id != "" {
+		header.Set(Header, id)
+	}
+}
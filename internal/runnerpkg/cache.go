@@ -0,0 +1,225 @@
+// Package runnerpkg caches the GitHub Actions runner package on the host, so
+// VMs install the runner from a local copy instead of downloading it.
+package runnerpkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+)
+
+const (
+	// latestReleaseURL is where the latest runner version is looked up.
+	latestReleaseURL = "https://api.github.com/repos/actions/runner/releases/latest"
+	// downloadURL is where runner packages are downloaded from, by version and file name.
+	downloadURL = "https://github.com/actions/runner/releases/download/v%s/%s"
+	// latestTTL is how long the latest version is trusted before it's looked up again.
+	latestTTL = time.Hour
+	// keepVersions is how many versions stay cached; older ones are removed.
+	keepVersions = 2
+)
+
+// Package is a cached runner package.
+type Package struct {
+	Version string // Runner version, e.g. "2.319.1"
+	Path    string // Package tarball on the host
+}
+
+// Cache downloads runner packages into RunnerPackageDir, one tarball per
+// version, and hands out the pinned or latest one.
+type Cache struct {
+	cfg        *config.Config
+	httpClient *http.Client
+
+	mu           sync.Mutex // Held while a package is resolved or downloaded, so concurrent provisions share one download
+	latest       string     // Latest runner version, as last looked up
+	latestLooked time.Time  // When latest was looked up
+}
+
+// NewCache creates a runner package cache.
+func NewCache(cfg *config.Config) *Cache {
+	return &Cache{cfg: cfg, httpClient: &http.Client{Timeout: 10 * time.Minute}}
+}
+
+// packageSuffix ends the file names of runner packages.
+const packageSuffix = ".tar.gz"
+
+// packagePrefix starts the file names of runner packages for this host's
+// architecture, which VMs share.
+func packagePrefix() string {
+	if runtime.GOARCH == "arm64" {
+		return "actions-runner-osx-arm64-"
+	}
+	return "actions-runner-osx-x64-"
+}
+
+// fileName returns the name of the runner package of a version.
+func fileName(version string) string {
+	return packagePrefix() + version + packageSuffix
+}
+
+// Get returns the runner package of RunnerVersion, or the latest version if
+// none is pinned, downloading it if it isn't cached yet. When the latest
+// version can't be looked up, the newest cached package is used.
+func (c *Cache) Get(ctx context.Context) (Package, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	version, err := c.version(ctx)
+	if err != nil {
+		if pkg, ok := c.newestCached(); ok {
+			log.Printf("Warning: Could not look up the latest runner version, using cached %s: %v", pkg.Version, err)
+			return pkg, nil
+		}
+		return Package{}, err
+	}
+
+	pkg := Package{Version: version, Path: filepath.Join(c.cfg.RunnerPackageDir, fileName(version))}
+	if _, err := os.Stat(pkg.Path); err == nil {
+		return pkg, nil
+	}
+	if err := c.download(ctx, version, pkg.Path); err != nil {
+		return Package{}, err
+	}
+	c.prune(version)
+	return pkg, nil
+}
+
+// version returns the pinned runner version or the latest one. Callers must hold c.mu.
+func (c *Cache) version(ctx context.Context) (string, error) {
+	if c.cfg.RunnerVersion != "" {
+		return strings.TrimPrefix(c.cfg.RunnerVersion, "v"), nil
+	}
+	if c.latest != "" && time.Since(c.latestLooked) < latestTTL {
+		return c.latest, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, latestReleaseURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the latest runner version: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to look up the latest runner version: %s", resp.Status)
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil || release.TagName == "" {
+		return "", fmt.Errorf("failed to parse the latest runner release: %v", err)
+	}
+
+	c.latest = strings.TrimPrefix(release.TagName, "v")
+	c.latestLooked = time.Now()
+	return c.latest, nil
+}
+
+// download fetches the runner package of a version to path, through a
+// temporary file so an interrupted download is never used.
+func (c *Cache) download(ctx context.Context, version, path string) error {
+	url := fmt.Sprintf(downloadURL, version, fileName(version))
+	log.Printf("Caching GitHub runner %s from %s...", version, url)
+	if err := os.MkdirAll(c.cfg.RunnerPackageDir, 0755); err != nil {
+		return fmt.Errorf("failed to create runner package directory: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download runner %s: %w", version, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download runner %s: %s", version, resp.Status)
+	}
+
+	tmp, err := os.CreateTemp(c.cfg.RunnerPackageDir, fileName(version)+".*.part")
+	if err != nil {
+		return fmt.Errorf("failed to create runner package file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to download runner %s: %w", version, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write runner package: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store runner package: %w", err)
+	}
+	log.Printf("GitHub runner %s cached at %s.", version, path)
+	return nil
+}
+
+// cached returns the cached packages, newest first.
+func (c *Cache) cached() []Package {
+	prefix := packagePrefix()
+	matches, _ := filepath.Glob(filepath.Join(c.cfg.RunnerPackageDir, prefix+"*"+packageSuffix))
+	packages := make([]Package, 0, len(matches))
+	for _, path := range matches {
+		version := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), prefix), packageSuffix)
+		packages = append(packages, Package{Version: version, Path: path})
+	}
+	sort.Slice(packages, func(i, j int) bool { return newer(packages[i].Version, packages[j].Version) })
+	return packages
+}
+
+// newestCached returns the newest cached package, if any.
+func (c *Cache) newestCached() (Package, bool) {
+	packages := c.cached()
+	if len(packages) == 0 {
+		return Package{}, false
+	}
+	return packages[0], true
+}
+
+// prune removes all but the keepVersions newest cached packages, never the
+// package of current.
+func (c *Cache) prune(current string) {
+	packages := c.cached()
+	for i, pkg := range packages {
+		if i < keepVersions || pkg.Version == current {
+			continue
+		}
+		// A VM being provisioned may still be uploading it; the upload keeps its open file
+		if err := os.Remove(pkg.Path); err != nil {
+			log.Printf("Warning: Could not remove old runner package %s: %v", pkg.Path, err)
+		}
+	}
+}
+
+// newer reports whether version a is newer than b, comparing their dotted
+// numbers.
+func newer(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		var an, bn int
+		fmt.Sscan(as[i], &an)
+		fmt.Sscan(bs[i], &bn)
+		if an != bn {
+			return an > bn
+		}
+	}
+	return len(as) > len(bs)
+}
@@ -0,0 +1,186 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/operations"
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// Command priorities, most urgent first. Deletes free slots and cancel
+// provisions, so they overtake everything else.
+const (
+	PriorityDelete    = iota // Deleting VMs
+	PriorityControl          // Shutting down, suspending and resuming VMs
+	PriorityProvision        // Provisioning VMs
+	numPriorities
+)
+
+// priorityNames name the priorities in CommandQueueStatus.
+var priorityNames = [numPriorities]string{"delete", "control", "provision"}
+
+// ErrCommandQueueFull is returned by Submit when maxQueued commands are already queued.
+var ErrCommandQueueFull = errors.New("command queue is full")
+
+// command is a queued VM command.
+type command struct {
+	name     string // Describes the command in logs, e.g. "deletion of VM runner-1"
+	run      func()
+	op       *operations.Operation // Shows the command as queued until it starts
+	enqueued time.Time
+	done     chan struct{} // Closed once run returns
+}
+
+// CommandQueue runs VM commands on a fixed number of workers, most urgent
+// first and in arrival order within a priority. Provisions never take the
+// last worker, so a delete doesn't wait for a provision to finish.
+type CommandQueue struct {
+	workers   int
+	maxQueued int // Maximum commands queued by Submit; 0 means unlimited
+	ops       *operations.Tracker
+
+	mu             sync.Mutex // Protects the fields below
+	ready          *sync.Cond // Signaled when a command is queued or a worker frees up
+	queues         [numPriorities][]*command
+	busy           int // Workers running a command
+	busyProvisions int // Workers running a provision
+}
+
+// NewCommandQueue starts a CommandQueue with workers workers (at least one)
+// that queues at most maxQueued commands submitted with Submit.
+func NewCommandQueue(workers, maxQueued int, ops *operations.Tracker) *CommandQueue {
+	q := &CommandQueue{workers: max(workers, 1), maxQueued: maxQueued, ops: ops}
+	q.ready = sync.NewCond(&q.mu)
+	for range q.workers {
+		go q.work()
+	}
+	return q
+}
+
+// Submit queues run at priority and returns immediately. The command shows
+// up in GET /operations as <kind>-queued on target until a worker runs it,
+// traced as part of the trace in ctx. It fails with ErrCommandQueueFull if
+// the queue is at its bound.
+func (q *CommandQueue) Submit(ctx context.Context, priority int, kind, target string, run func()) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.maxQueued > 0 && q.queued() >= q.maxQueued {
+		return ErrCommandQueueFull
+	}
+	q.enqueue(ctx, priority, kind, target, run)
+	return nil
+}
+
+// Run queues run at priority like Submit, regardless of the queue's bound,
+// and waits for it to complete. Provisions, which the Scheduler already
+// bounds, are run through it.
+func (q *CommandQueue) Run(ctx context.Context, priority int, kind, target string, run func()) {
+	q.mu.Lock()
+	cmd := q.enqueue(ctx, priority, kind, target, run)
+	q.mu.Unlock()
+	<-cmd.done
+}
+
+// enqueue queues a command. Callers must hold q.mu.
+func (q *CommandQueue) enqueue(ctx context.Context, priority int, kind, target string, run func()) *command {
+	op := q.ops.StartContext(ctx, kind+"-queued", target)
+	op.SetPhase("waiting for a worker")
+	cmd := &command{
+		name:     kind + " of " + target,
+		run:      run,
+		op:       op,
+		enqueued: time.Now(),
+		done:     make(chan struct{}),
+	}
+	q.queues[priority] = append(q.queues[priority], cmd)
+	q.ready.Signal()
+	return cmd
+}
+
+// queued returns the number of queued commands. Callers must hold q.mu.
+func (q *CommandQueue) queued() int {
+	n := 0
+	for _, queue := range q.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// next dequeues the most urgent command a free worker may run, reporting its
+// priority. Callers must hold q.mu.
+func (q *CommandQueue) next() (*command, int, bool) {
+	for priority, queue := range q.queues {
+		if len(queue) == 0 {
+			continue
+		}
+		if priority == PriorityProvision && q.workers > 1 && q.busyProvisions >= q.workers-1 {
+			continue
+		}
+		q.queues[priority] = queue[1:]
+		return queue[0], priority, true
+	}
+	return nil, 0, false
+}
+
+// work runs queued commands until the agent exits.
+func (q *CommandQueue) work() {
+	for {
+		q.mu.Lock()
+		cmd, priority, ok := q.next()
+		for !ok {
+			q.ready.Wait()
+			cmd, priority, ok = q.next()
+		}
+		q.busy++
+		if priority == PriorityProvision {
+			q.busyProvisions++
+		}
+		q.mu.Unlock()
+
+		cmd.op.Done()
+		func() {
+			defer close(cmd.done)
+			defer utils.Recover(cmd.name)
+			cmd.run()
+		}()
+
+		q.mu.Lock()
+		q.busy--
+		if priority == PriorityProvision {
+			q.busyProvisions--
+		}
+		q.ready.Broadcast() // A provision may have been waiting for a worker other than the last
+		q.mu.Unlock()
+	}
+}
+
+// Status returns the depth of the queue, per priority, and the age of the
+// oldest queued command, so the orchestrator can back off a saturated node.
+func (q *CommandQueue) Status() models.CommandQueueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	status := models.CommandQueueStatus{
+		Workers:    q.workers,
+		Busy:       q.busy,
+		Queued:     q.queued(),
+		ByPriority: make(map[string]int),
+	}
+	var oldest time.Time
+	for priority, queue := range q.queues {
+		if len(queue) == 0 {
+			continue
+		}
+		status.ByPriority[priorityNames[priority]] = len(queue)
+		if oldest.IsZero() || queue[0].enqueued.Before(oldest) {
+			oldest = queue[0].enqueued
+		}
+	}
+	if !oldest.IsZero() {
+		status.OldestQueuedSeconds = int64(time.Since(oldest).Seconds())
+	}
+	return status
+}
@@ -0,0 +1,207 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/operations"
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// defaultWeight applies to tenants without a configured weight.
+const defaultWeight = 1
+
+// ErrQueueFull is returned by Submit when maxPending jobs are already queued.
+var ErrQueueFull = errors.New("provisioning queue is full")
+
+// ErrDuplicate is returned by Submit when a job for the VM is already queued or running.
+var ErrDuplicate = errors.New("VM is already being provisioned")
+
+// job is a queued provision request.
+type job struct {
+	vmID string
+	run  func()
+	op   *operations.Operation // Shows the request as queued until it starts
+}
+
+// Scheduler runs provision requests with bounded concurrency. Queued requests
+// are picked with smooth weighted round robin across tenants rather than in
+// arrival order, so a burst from one tenant doesn't starve the others.
+type Scheduler struct {
+	limit      int            // Maximum concurrent jobs; 0 means unlimited
+	maxPending int            // Maximum queued jobs across tenants; 0 means unlimited
+	weights    map[string]int // Configured tenant weights
+	ops        *operations.Tracker
+
+	mu      sync.Mutex       // Protects the fields below
+	running int              // Jobs currently running
+	pending int              // Jobs currently queued
+	active  map[string]bool  // VMs with a job queued or running
+	queues  map[string][]job // Pending jobs per tenant, in arrival order
+	credit  map[string]int   // Smooth weighted round robin state per tenant
+}
+
+// New creates a Scheduler that runs at most limit jobs at once and queues at
+// most maxPending more, with tenants weighted by weights.
+func New(limit, maxPending int, weights map[string]int, ops *operations.Tracker) *Scheduler {
+	return &Scheduler{
+		limit:      limit,
+		maxPending: maxPending,
+		weights:    weights,
+		ops:        ops,
+		active:     make(map[string]bool),
+		queues:     make(map[string][]job),
+		credit:     make(map[string]int),
+	}
+}
+
+// Submit queues run for a tenant and returns immediately. run is called in its
+// own goroutine once a slot is free and the tenant's turn comes up. Time spent
+// queued is traced as part of the trace in ctx. It fails with ErrDuplicate if
+// a job for vmID is already queued or running, and with ErrQueueFull if the
+// queue is at its bound.
+func (s *Scheduler) Submit(ctx context.Context, tenant, vmID string, run func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active[vmID] {
+		return ErrDuplicate
+	}
+	if s.limit <= 0 {
+		s.active[vmID] = true
+		go func() {
+			defer s.release(vmID)
+			defer utils.Recover("provision of VM " + vmID)
+			run()
+		}()
+		return nil
+	}
+	if s.maxPending > 0 && s.pending >= s.maxPending {
+		return ErrQueueFull
+	}
+
+	s.active[vmID] = true
+	op := s.ops.StartContext(ctx, "provision-queued", vmID)
+	op.SetPhase("waiting for a provisioning slot (tenant " + tenant + ")")
+	s.queues[tenant] = append(s.queues[tenant], job{vmID: vmID, run: run, op: op})
+	s.pending++
+	s.dispatch()
+	return nil
+}
+
+// Pending returns the number of queued jobs per tenant.
+func (s *Scheduler) Pending() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := make(map[string]int, len(s.queues))
+	for tenant, queue := range s.queues {
+		pending[tenant] = len(queue)
+	}
+	return pending
+}
+
+// dispatch starts queued jobs while slots are free. Callers must hold s.mu.
+func (s *Scheduler) dispatch() {
+	for s.running < s.limit {
+		tenant, ok := s.next()
+		if !ok {
+			return
+		}
+		queue := s.queues[tenant]
+		next := queue[0]
+		if len(queue) == 1 {
+			delete(s.queues, tenant)
+			delete(s.credit, tenant)
+		} else {
+			s.queues[tenant] = queue[1:]
+		}
+
+		s.pending--
+		s.running++
+		next.op.Done()
+		log.Printf("Starting queued provision of VM %s for tenant %s", next.vmID, tenant)
+		go func() {
+			defer s.finish(next.vmID)
+			defer utils.Recover("provision of VM " + next.vmID)
+			next.run()
+		}()
+	}
+}
+
+// next picks the tenant whose job runs next using smooth weighted round
+// robin: every tenant with pending jobs gains its weight in credit, the one
+// with the most credit wins and pays back the total. Over time each tenant
+// gets turns in proportion to its weight, interleaved rather than in bursts.
+// Callers must hold s.mu.
+func (s *Scheduler) next() (string, bool) {
+	var best string
+	total := 0
+	for tenant := range s.queues {
+		weight := s.weight(tenant)
+		s.credit[tenant] += weight
+		total += weight
+		if best == "" || s.credit[tenant] > s.credit[best] || (s.credit[tenant] == s.credit[best] && tenant < best) {
+			best = tenant
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	s.credit[best] -= total
+	return best, true
+}
+
+func (s *Scheduler) weight(tenant string) int {
+	if weight, ok := s.weights[tenant]; ok && weight > 0 {
+		return weight
+	}
+	return defaultWeight
+}
+
+// finish frees the slot of a completed job and starts the next one.
+func (s *Scheduler) finish(vmID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, vmID)
+	s.running--
+	s.dispatch()
+}
+
+// release forgets a completed job that ran without a slot.
+func (s *Scheduler) release(vmID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, vmID)
+}
+
+// ParseWeights parses tenant=weight pairs (e.g., "team-a=2").
+func ParseWeights(pairs []string) (map[string]int, error) {
+	weights := make(map[string]int, len(pairs))
+	for _, pair := range pairs {
+		tenant, value, ok := strings.Cut(pair, "=")
+		weight, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid tenant weight '%s', expected tenant=<positive integer>", pair)
+		}
+		weights[strings.TrimSpace(tenant)] = weight
+	}
+	return weights, nil
+}
+
+// Tenant returns the tenant a provision request is scheduled under: its
+// explicit tenant, or else the GitHub organization it registers with.
+func Tenant(cmd models.VMProvisionCommand) string {
+	if cmd.Tenant != "" {
+		return cmd.Tenant
+	}
+	if cmd.GitHubOrg != "" {
+		return cmd.GitHubOrg
+	}
+	return "default"
+}
@@ -0,0 +1,81 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/operations"
+)
+
+func TestSchedulerInterleavesWeightedTenants(t *testing.T) {
+	s := New(1, 6, map[string]int{"team-a": 2, "team-b": 1}, operations.NewTracker())
+	ctx := context.Background()
+	started := make(chan string, 10)
+	record := func(vmID string) func() {
+		return func() { started <- vmID }
+	}
+
+	// A running job holds the only slot while both tenants' bursts queue up.
+	unblock := make(chan struct{})
+	if err := s.Submit(ctx, "team-c", "vm-c1", func() { <-unblock }); err != nil {
+		t.Fatalf("Submit(vm-c1): %v", err)
+	}
+	for _, vmID := range []string{"vm-a1", "vm-a2", "vm-a3", "vm-a4"} {
+		if err := s.Submit(ctx, "team-a", vmID, record(vmID)); err != nil {
+			t.Fatalf("Submit(%s): %v", vmID, err)
+		}
+	}
+	for _, vmID := range []string{"vm-b1", "vm-b2"} {
+		if err := s.Submit(ctx, "team-b", vmID, record(vmID)); err != nil {
+			t.Fatalf("Submit(%s): %v", vmID, err)
+		}
+	}
+	if got, want := s.Pending(), map[string]int{"team-a": 4, "team-b": 2}; !maps.Equal(got, want) {
+		t.Errorf("Pending() = %v, want %v", got, want)
+	}
+
+	if err := s.Submit(ctx, "team-b", "vm-b3", record("vm-b3")); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Submit over maxPending: %v, want ErrQueueFull", err)
+	}
+	// Duplicates are rejected before the queue bound is checked.
+	for _, vmID := range []string{"vm-a1", "vm-c1"} {
+		if err := s.Submit(ctx, "team-b", vmID, record(vmID)); !errors.Is(err, ErrDuplicate) {
+			t.Errorf("Submit(%s) again: %v, want ErrDuplicate", vmID, err)
+		}
+	}
+
+	close(unblock)
+	var order []string
+	for range 6 {
+		select {
+		case vmID := <-started:
+			order = append(order, vmID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %v started", order)
+		}
+	}
+	// team-a gets two turns for each of team-b's, interleaved.
+	if want := []string{"vm-a1", "vm-b1", "vm-a2", "vm-a3", "vm-b2", "vm-a4"}; !slices.Equal(order, want) {
+		t.Errorf("jobs started in order %v, want %v", order, want)
+	}
+
+	// Once the queue drains, a VM whose job finished can be provisioned again.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := s.Submit(ctx, "team-a", "vm-a4", record("vm-a4"))
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrDuplicate) || time.Now().After(deadline) {
+			t.Fatalf("Submit(vm-a4) after it finished: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if vmID := <-started; vmID != "vm-a4" {
+		t.Errorf("started %s, want vm-a4", vmID)
+	}
+}
@@ -0,0 +1,109 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"google.golang.org/api/option"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// Provider resolves named secrets such as the GitHub runner registration token.
+type Provider interface {
+	GetSecret(ctx context.Context, name string) (string, error)
+}
+
+// NewProvider returns the Provider selected by cfg.SecretsProvider ("env", "file" or "gcp").
+func NewProvider(cfg *config.Config) (Provider, error) {
+	switch cfg.SecretsProvider {
+	case "", "env":
+		return &EnvProvider{}, nil
+	case "file":
+		return &FileProvider{Dir: cfg.SecretsDir}, nil
+	case "gcp":
+		return NewGCPProvider(cfg)
+	default:
+		return nil, fmt.Errorf("unknown secrets provider %q (expected env, file or gcp)", cfg.SecretsProvider)
+	}
+}
+
+// EnvProvider reads secrets from environment variables named after the secret.
+type EnvProvider struct{}
+
+// GetSecret returns the value of the environment variable called name.
+func (p *EnvProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return "", fmt.Errorf("secret %s is not set in the environment", name)
+	}
+	return value, nil
+}
+
+// FileProvider reads each secret from a file named after it inside Dir.
+type FileProvider struct {
+	Dir string
+}
+
+// GetSecret returns the trimmed contents of Dir/name.
+func (p *FileProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	if strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid secret name %q", name)
+	}
+	path := filepath.Join(p.Dir, name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file %s: %w", path, err)
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return value, nil
+}
+
+// GCPProvider reads the latest version of secrets from GCP Secret Manager.
+type GCPProvider struct {
+	project string
+	service *secretmanager.Service
+}
+
+// NewGCPProvider creates a Secret Manager backed provider using the agent's GCP credentials.
+func NewGCPProvider(cfg *config.Config) (*GCPProvider, error) {
+	if cfg.GCPProject == "" {
+		return nil, fmt.Errorf("GCP project must be set to use the gcp secrets provider")
+	}
+
+	var opts []option.ClientOption
+	if cfg.GCPCredentialsPath != "" {
+		opts = append(opts, option.WithCredentialsFile(cfg.GCPCredentialsPath))
+	}
+
+	service, err := secretmanager.NewService(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Secret Manager client: %w", err)
+	}
+	return &GCPProvider{project: cfg.GCPProject, service: service}, nil
+}
+
+// GetSecret returns the latest version of the named secret.
+func (p *GCPProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	resource := fmt.Sprintf("projects/%s/secrets/%s/versions/latest", p.project, name)
+	resp, err := p.service.Projects.Secrets.Versions.Access(resource).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to access secret %s: %w", resource, err)
+	}
+	if resp.Payload == nil {
+		return "", fmt.Errorf("secret %s has no payload", resource)
+	}
+	// The REST API returns the payload base64-encoded.
+	value, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode secret %s: %w", resource, err)
+	}
+	return strings.TrimSpace(string(value)), nil
+}
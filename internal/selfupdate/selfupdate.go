@@ -0,0 +1,342 @@
+package selfupdate
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/operations"
+	"github.com/changty97/macvmagt/internal/utils"
+	"github.com/changty97/macvmagt/internal/version"
+	"github.com/changty97/macvmagt/internal/vmgr"
+	"google.golang.org/api/option"
+)
+
+// manifestName is the release manifest looked up under UpdateURL.
+const manifestName = "latest.json"
+
+// PreviousSuffix names the copy of the replaced binary kept next to it for rollback.
+const PreviousSuffix = ".previous"
+
+// idlePollInterval is how often an installed update waits for the node to go idle before restarting.
+const idlePollInterval = time.Minute
+
+// ErrUpToDate is returned by Update when the published release is the running version.
+var ErrUpToDate = errors.New("agent is up to date")
+
+// ErrNotNewer is returned by Update when the published release isn't newer
+// than the running version and isn't marked as a rollback.
+var ErrNotNewer = errors.New("published release is not newer than the running agent")
+
+// Release is the manifest describing the published agent binary.
+type Release struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`    // Binary location, absolute or relative to UpdateURL
+	SHA256  string `json:"sha256"` // Hex SHA256 of the binary
+	// Rollback allows installing the release over newer versions, e.g. to
+	// back out a bad release.
+	Rollback bool `json:"rollback,omitempty"`
+	// Signature is the base64 Ed25519 signature of SignedMessage.
+	Signature string `json:"signature"`
+}
+
+// SignedMessage returns the message a release's signature covers. It binds the
+// version to the binary's checksum, so a signed binary can't be passed off as
+// another version, and to whether it is a rollback, so an old signed release
+// can't be replayed to downgrade nodes.
+func (r *Release) SignedMessage() []byte {
+	if r.Rollback {
+		return []byte(fmt.Sprintf("macvmagt %s %s rollback", r.Version, r.SHA256))
+	}
+	return []byte(fmt.Sprintf("macvmagt %s %s", r.Version, r.SHA256))
+}
+
+// Updater replaces the agent binary with signed releases published under UpdateURL.
+type Updater struct {
+	cfg       *config.Config
+	ops       *operations.Tracker // In-flight operations that hold off a restart; nil when not running as the agent
+	publicKey ed25519.PublicKey
+	http      *http.Client
+}
+
+// New creates an Updater. It fails if UpdateURL is set without a valid
+// UpdatePublicKey, since unsigned updates are never installed.
+func New(cfg *config.Config, ops *operations.Tracker) (*Updater, error) {
+	u := &Updater{
+		cfg:  cfg,
+		ops:  ops,
+		http: &http.Client{Timeout: 10 * time.Minute},
+	}
+	if cfg.UpdateURL == "" {
+		return u, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(cfg.UpdatePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("update public key must be a base64 Ed25519 public key when an update URL is set")
+	}
+	u.publicKey = ed25519.PublicKey(key)
+	return u, nil
+}
+
+// Start checks for updates every UpdateInterval and installs them. The agent
+// is restarted once no operations are in flight and no VMs are running, since
+// stopping the agent's launchd job also stops the VM processes it started.
+func (u *Updater) Start() {
+	ticker := time.NewTicker(u.cfg.UpdateInterval)
+	defer ticker.Stop()
+	installed := "" // Version installed but not yet running, if a restart failed
+	for range ticker.C {
+		if installed == "" {
+			release, err := u.Update(context.Background())
+			if errors.Is(err, ErrUpToDate) {
+				continue
+			}
+			if err != nil {
+				log.Printf("Error updating agent: %v", err)
+				continue
+			}
+			installed = release.Version
+			log.Printf("Installed agent %s, restarting once the node is idle", installed)
+		}
+
+		for !u.idle() {
+			time.Sleep(idlePollInterval)
+		}
+		if err := u.Restart(); err != nil {
+			log.Printf("Error restarting agent after update: %v", err)
+		}
+	}
+}
+
+// Check fetches the published release manifest.
+func (u *Updater) Check(ctx context.Context) (*Release, error) {
+	if u.cfg.UpdateURL == "" {
+		return nil, fmt.Errorf("no update URL configured")
+	}
+	body, err := u.fetch(ctx, u.resolve(manifestName))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var release Release
+	if err := json.NewDecoder(body).Decode(&release); err != nil {
+		return nil, fmt.Errorf("failed to parse release manifest: %w", err)
+	}
+	if release.Version == "" || release.URL == "" || release.SHA256 == "" || release.Signature == "" {
+		return nil, fmt.Errorf("release manifest is missing version, url, sha256 or signature")
+	}
+	return &release, nil
+}
+
+// Update installs the published release if it is newer than the running
+// version, or marked as a rollback and not the running version, and returns
+// it. Any release is newer than a running version without dotted numbers,
+// such as "dev". It doesn't restart the agent.
+func (u *Updater) Update(ctx context.Context) (*Release, error) {
+	release, err := u.Check(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if release.Version == version.Version {
+		return release, ErrUpToDate
+	}
+	if err := checkNewer(release); err != nil {
+		return release, err
+	}
+	if err := u.Apply(ctx, release); err != nil {
+		return nil, err
+	}
+	return release, nil
+}
+
+// checkNewer returns an error wrapping ErrNotNewer unless release is newer
+// than the running version or marked as a rollback.
+func checkNewer(release *Release) error {
+	if release.Rollback {
+		return nil
+	}
+	running, ok := parseVersion(version.Version)
+	if !ok {
+		return nil
+	}
+	published, ok := parseVersion(release.Version)
+	if !ok {
+		return fmt.Errorf("%w: can't order release %s after %s", ErrNotNewer, release.Version, version.Version)
+	}
+	if published.compare(running) <= 0 {
+		return fmt.Errorf("%w: release %s is not newer than %s, publish it with rollback set to downgrade", ErrNotNewer, release.Version, version.Version)
+	}
+	return nil
+}
+
+// Apply downloads a release next to the running binary, verifies its
+// signature and checksum and that it runs and reports the release's version,
+// then atomically renames it over the running binary. The replaced binary is
+// kept with PreviousSuffix.
+func (u *Updater) Apply(ctx context.Context, release *Release) error {
+	signature, err := base64.StdEncoding.DecodeString(release.Signature)
+	if err != nil || !ed25519.Verify(u.publicKey, release.SignedMessage(), signature) {
+		return fmt.Errorf("release %s has an invalid signature", release.Version)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the running binary: %w", err)
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the running binary: %w", err)
+	}
+
+	// Download into the binary's directory so the final rename stays on one volume.
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".macvmagt-update-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for update: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed into place
+
+	log.Printf("Downloading agent %s from %s", release.Version, release.URL)
+	body, err := u.fetch(ctx, u.resolve(release.URL))
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), body)
+	body.Close()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download agent %s: %w", release.Version, err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, release.SHA256) {
+		return fmt.Errorf("checksum mismatch for agent %s: got %s, want %s", release.Version, sum, release.SHA256)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return fmt.Errorf("failed to make update executable: %w", err)
+	}
+	// Only stdout: the agent logs its configuration to stderr on startup.
+	output, err := exec.CommandContext(ctx, tmp.Name(), "version").Output()
+	if err != nil {
+		return fmt.Errorf("downloaded agent %s does not run: %w", release.Version, err)
+	}
+	if reported := strings.TrimSpace(string(output)); reported != release.Version {
+		return fmt.Errorf("downloaded agent reports version %q, expected %q", reported, release.Version)
+	}
+
+	previous := exe + PreviousSuffix
+	os.Remove(previous)
+	if err := os.Link(exe, previous); err != nil {
+		log.Printf("Warning: Could not keep the replaced binary as %s: %v", previous, err)
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", exe, err)
+	}
+	log.Printf("Replaced %s %s with %s", exe, version.Version, release.Version)
+	return nil
+}
+
+// Restart restarts the agent's launchd job so the new binary takes over.
+// Without a configured job label, the agent exits and relies on KeepAlive.
+func (u *Updater) Restart() error {
+	if u.cfg.UpdateLaunchdLabel == "" {
+		log.Printf("No launchd label configured, exiting so launchd restarts the agent")
+		os.Exit(0)
+	}
+	if _, err := utils.ExecuteCommand("launchctl", "kickstart", "-k", "system/"+u.cfg.UpdateLaunchdLabel); err != nil {
+		return fmt.Errorf("failed to restart launchd job %s: %w", u.cfg.UpdateLaunchdLabel, err)
+	}
+	return nil
+}
+
+// idle reports whether the agent can restart without disrupting work.
+func (u *Updater) idle() bool {
+	if u.ops != nil && len(u.ops.List()) > 0 {
+		return false
+	}
+	vms, err := utils.GetRunningVMs()
+	if err != nil {
+		log.Printf("Warning: Could not list running VMs before restarting: %v", err)
+		return false
+	}
+	// Warm pool standbys hold no work, and are replaced after the restart.
+	return !slices.ContainsFunc(vms, func(vm models.VMInfo) bool { return !vmgr.IsStandby(vm.VMID) })
+}
+
+// resolve returns the location of name: itself if absolute, else under UpdateURL.
+func (u *Updater) resolve(name string) string {
+	if strings.Contains(name, "://") {
+		return name
+	}
+	return strings.TrimSuffix(u.cfg.UpdateURL, "/") + "/" + name
+}
+
+// fetch opens an http(s):// or gs:// location for reading.
+func (u *Updater) fetch(ctx context.Context, location string) (io.ReadCloser, error) {
+	if path, ok := strings.CutPrefix(location, "gs://"); ok {
+		bucket, object, ok := strings.Cut(path, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid GCS location %s", location)
+		}
+		var opts []option.ClientOption
+		if u.cfg.GCPCredentialsPath != "" {
+			opts = append(opts, option.WithCredentialsFile(u.cfg.GCPCredentialsPath))
+		}
+		client, err := storage.NewClient(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCS client: %w", err)
+		}
+		reader, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed to read %s: %w", location, err)
+		}
+		return &gcsReader{Reader: reader, client: client}, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for %s: %w", location, err)
+	}
+	resp, err := u.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", location, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to fetch %s: %s", location, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// gcsReader closes the GCS client along with the object reader.
+type gcsReader struct {
+	*storage.Reader
+	client *storage.Client
+}
+
+func (r *gcsReader) Close() error {
+	err := r.Reader.Close()
+	r.client.Close()
+	return err
+}
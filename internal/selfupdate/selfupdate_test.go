@@ -0,0 +1,167 @@
+package selfupdate
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/version"
+)
+
+// testSHA256 stands in for the checksum of a release's binary.
+const testSHA256 = "0f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0"
+
+// setRunningVersion makes the agent report v as its version for the test.
+func setRunningVersion(t *testing.T, v string) {
+	t.Helper()
+	previous := version.Version
+	version.Version = v
+	t.Cleanup(func() { version.Version = previous })
+}
+
+// signRelease signs a release with key the way scripts/package.sh does,
+// signing it as a rollback if signedRollback is set, whatever its Rollback.
+func signRelease(key ed25519.PrivateKey, release Release, signedRollback bool) Release {
+	signed := release
+	signed.Rollback = signedRollback
+	release.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, signed.SignedMessage()))
+	return release
+}
+
+// newTestUpdater returns an Updater trusting key that finds release at a test
+// server's latest.json. The server has no binaries, so an update that gets
+// past the signature check fails downloading one; downloads counts the tries.
+func newTestUpdater(t *testing.T, key ed25519.PrivateKey, release Release) (u *Updater, downloads *atomic.Int32) {
+	t.Helper()
+	downloads = new(atomic.Int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+manifestName {
+			json.NewEncoder(w).Encode(release)
+			return
+		}
+		downloads.Add(1)
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(server.Close)
+	publicKey := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	u, err := New(&config.Config{UpdateURL: server.URL, UpdatePublicKey: publicKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, downloads
+}
+
+func TestUpdate(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	otherKey := ed25519.NewKeyFromSeed([]byte(strings.Repeat("k", ed25519.SeedSize)))
+	upgrade := Release{Version: "v1.5.0", URL: "macvmagt-v1.5.0", SHA256: testSHA256}
+	downgrade := Release{Version: "v1.3.0", URL: "macvmagt-v1.3.0", SHA256: testSHA256}
+	rollback := downgrade
+	rollback.Rollback = true
+
+	tests := []struct {
+		name         string
+		running      string
+		release      Release
+		wantErr      error  // Sentinel error Update returns, if any
+		wantMessage  string // Part of the error Update returns
+		wantDownload bool   // Whether the release passes its checks and is downloaded
+	}{
+		{name: "signed upgrade", running: "v1.4.0", release: signRelease(key, upgrade, false), wantMessage: "404", wantDownload: true},
+		{name: "upgrade signed with another key", running: "v1.4.0", release: signRelease(otherKey, upgrade, false), wantMessage: "invalid signature"},
+		{name: "upgrade with a garbled signature", running: "v1.4.0", release: func() Release {
+			r := signRelease(key, upgrade, false)
+			r.Signature = "not base64!"
+			return r
+		}(), wantMessage: "invalid signature"},
+		{name: "signed release with another version", running: "v1.4.0", release: func() Release {
+			r := signRelease(key, upgrade, false)
+			r.Version = "v1.6.0"
+			return r
+		}(), wantMessage: "invalid signature"},
+		{name: "running version", running: "v1.5.0", release: signRelease(key, upgrade, false), wantErr: ErrUpToDate},
+		{name: "downgrade", running: "v1.4.0", release: signRelease(key, downgrade, false), wantErr: ErrNotNewer},
+		{name: "downgrade to a pre-release", running: "v1.4.0", release: signRelease(key, Release{Version: "v1.4.0-rc2", URL: "rc", SHA256: testSHA256}, false), wantErr: ErrNotNewer},
+		{name: "unordered release", running: "v1.4.0", release: signRelease(key, Release{Version: "nightly", URL: "nightly", SHA256: testSHA256}, false), wantErr: ErrNotNewer},
+		{name: "signed rollback", running: "v1.4.0", release: signRelease(key, rollback, true), wantMessage: "404", wantDownload: true},
+		{name: "rollback signed without the flag", running: "v1.4.0", release: signRelease(key, rollback, false), wantMessage: "invalid signature"},
+		{name: "rollback flag stripped from signed rollback", running: "v1.4.0", release: signRelease(key, downgrade, true), wantErr: ErrNotNewer},
+		{name: "any release over a dev build", running: "dev", release: signRelease(key, downgrade, false), wantMessage: "404", wantDownload: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRunningVersion(t, tt.running)
+			u, downloads := newTestUpdater(t, key, tt.release)
+
+			_, err := u.Update(context.Background())
+			if err == nil {
+				t.Fatal("Update succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Update: %v, want %v", err, tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantMessage) {
+				t.Errorf("Update: %v, want it to mention %q", err, tt.wantMessage)
+			}
+			if got := downloads.Load() > 0; got != tt.wantDownload {
+				t.Errorf("downloaded the release: %v, want %v", got, tt.wantDownload)
+			}
+		})
+	}
+}
+
+func TestVersionOrder(t *testing.T) {
+	// Each version is older than the ones after it.
+	ordered := []string{
+		"v0.9",
+		"v1.3.9",
+		"v1.4.0-beta",
+		"v1.4.0-rc1",
+		"v1.4.0-rc2",
+		"v1.4.0",
+		"v1.4.0-3-gabc1234",
+		"v1.4.0-12-g0123abc",
+		"v1.4.1",
+		"v1.10.0",
+		"2",
+	}
+	for i, a := range ordered {
+		v, ok := parseVersion(a)
+		if !ok {
+			t.Fatalf("parseVersion(%q) failed", a)
+		}
+		for j, b := range ordered {
+			w, _ := parseVersion(b)
+			if got, want := v.compare(w), sign(i-j); got != want {
+				t.Errorf("compare(%q, %q) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+
+	for _, same := range [][2]string{
+		{"v1.4.0", "1.4.0"},
+		{"v1.4.0", "v1.4"},
+		{"v1.4.0", "v1.4.0-dirty"},
+		{"v1.4.0-3-gabc1234", "v1.4.0-3-gdef5678-dirty"},
+	} {
+		v, _ := parseVersion(same[0])
+		w, _ := parseVersion(same[1])
+		if got := v.compare(w); got != 0 {
+			t.Errorf("compare(%q, %q) = %d, want 0", same[0], same[1], got)
+		}
+	}
+
+	for _, malformed := range []string{"", "dev", "v", "abc1234", "1.x", "v1..2", "-rc1"} {
+		if _, ok := parseVersion(malformed); ok {
+			t.Errorf("parseVersion(%q) succeeded", malformed)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package selfupdate
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// describeSuffix matches the part `git describe --tags` appends to a tag for
+// commits past it, e.g. "3-gabc1234".
+var describeSuffix = regexp.MustCompile(`^([0-9]+)-g[0-9a-f]+$`)
+
+// releaseVersion is a version as scripts/package.sh names releases after
+// `git describe --tags`: "v1.4.0", a pre-release such as "v1.4.0-rc1", or a
+// build some commits past a tag, such as "v1.4.0-3-gabc1234".
+type releaseVersion struct {
+	parts      []int  // Dotted numbers, major first
+	prerelease string // Suffix other than commits past the tag; "" for none
+	commits    int    // Commits past the tag
+}
+
+// parseVersion parses a release version. A leading "v" and a trailing
+// "-dirty" are ignored. It returns false for versions without dotted numbers,
+// such as "dev" or a bare commit hash.
+func parseVersion(s string) (releaseVersion, bool) {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "v"), "-dirty")
+	core, suffix, _ := strings.Cut(s, "-")
+	var v releaseVersion
+	for _, part := range strings.Split(core, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return releaseVersion{}, false
+		}
+		v.parts = append(v.parts, n)
+	}
+	if m := describeSuffix.FindStringSubmatch(suffix); m != nil {
+		v.commits, _ = strconv.Atoi(m[1])
+	} else {
+		v.prerelease = suffix
+	}
+	return v, true
+}
+
+// compare returns -1, 0 or 1 as v is older than, the same as or newer than w.
+// Missing parts count as 0, a pre-release is older than its release, and a
+// build past a tag is newer than the tag.
+func (v releaseVersion) compare(w releaseVersion) int {
+	for i := 0; i < max(len(v.parts), len(w.parts)); i++ {
+		var x, y int
+		if i < len(v.parts) {
+			x = v.parts[i]
+		}
+		if i < len(w.parts) {
+			y = w.parts[i]
+		}
+		if x != y {
+			return sign(x - y)
+		}
+	}
+	switch {
+	case v.prerelease == w.prerelease:
+	case v.prerelease == "":
+		return 1
+	case w.prerelease == "":
+		return -1
+	default:
+		return strings.Compare(v.prerelease, w.prerelease)
+	}
+	return sign(v.commits - w.commits)
+}
+
+// sign returns -1, 0 or 1 as n is negative, 0 or positive.
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,385 @@
+package sshclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/tracing"
+	"github.com/pkg/sftp"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/ssh"
+)
+
+// dialTimeout bounds the TCP connect and SSH handshake with a VM.
+const dialTimeout = 15 * time.Second
+
+// Target describes how to reach and authenticate against a VM over SSH.
+type Target struct {
+	Host              string              // VM IP address or hostname
+	User              string              // SSH user inside the VM
+	KeyPath           string              // Private key used for authentication
+	HostKeyCallback   ssh.HostKeyCallback // Verifies the VM's host key
+	HostKeyAlgorithms []string            // Preferred host key types; nil for the library default
+}
+
+// DialFunc opens the TCP connection to a VM's SSH server at addr, like
+// net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+var (
+	dialerMu sync.RWMutex
+	dialer   DialFunc = (&net.Dialer{}).DialContext
+)
+
+// SetDialer makes every connection to a VM go through fn, e.g. to the
+// simulated VMs of the fake driver.
+func SetDialer(fn DialFunc) {
+	dialerMu.Lock()
+	defer dialerMu.Unlock()
+	dialer = fn
+}
+
+// dialContext returns the DialFunc connections are opened with.
+func dialContext() DialFunc {
+	dialerMu.RLock()
+	defer dialerMu.RUnlock()
+	return dialer
+}
+
+// Resolver returns the current SSH target for a VM. It is called whenever a
+// connection has to be (re)established, since a VM's IP can change across reboots.
+type Resolver func(vmID string) (Target, error)
+
+// Pool keeps one SSH connection per VM and hands out clients that reuse it.
+type Pool struct {
+	resolve Resolver
+	mu      sync.Mutex         // Protects clients
+	clients map[string]*Client // Keyed by VM ID
+}
+
+// NewPool creates a connection Pool that resolves VM targets with resolve.
+func NewPool(resolve Resolver) *Pool {
+	return &Pool{
+		resolve: resolve,
+		clients: make(map[string]*Client),
+	}
+}
+
+// Client returns the pooled client for a VM. No connection is made until it is used.
+func (p *Pool) Client(vmID string) *Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	client, ok := p.clients[vmID]
+	if !ok {
+		client = &Client{vmID: vmID, resolve: p.resolve}
+		p.clients[vmID] = client
+	}
+	return client
+}
+
+// Close drops and closes the pooled connection of a VM, e.g. when it is deleted.
+func (p *Pool) Close(vmID string) {
+	p.mu.Lock()
+	client, ok := p.clients[vmID]
+	delete(p.clients, vmID)
+	p.mu.Unlock()
+
+	if ok {
+		client.Close()
+	}
+}
+
+// CloseAll closes every pooled connection.
+func (p *Pool) CloseAll() {
+	p.mu.Lock()
+	clients := p.clients
+	p.clients = make(map[string]*Client)
+	p.mu.Unlock()
+
+	for _, client := range clients {
+		client.Close()
+	}
+}
+
+// Client runs commands and transfers files on a single VM over a shared,
+// automatically re-established SSH connection.
+type Client struct {
+	vmID    string
+	resolve Resolver
+	mu      sync.Mutex // Protects conn
+	conn    *ssh.Client
+	host    string // Host conn is connected to, for error messages
+}
+
+// Run executes a command and returns its combined output. If stdin is non-nil
+// it is streamed to the remote command (e.g. a script for `bash -s`).
+func (c *Client) Run(ctx context.Context, command string, stdin io.Reader) (string, error) {
+	var output bytes.Buffer
+	if err := c.Stream(ctx, command, stdin, &output, &output); err != nil {
+		return output.String(), fmt.Errorf("%w (output: %s)", err, output.String())
+	}
+	return output.String(), nil
+}
+
+// Stream executes a command, writing its stdout and stderr to the given writers
+// as it runs. The remote process is killed if ctx is done first.
+func (c *Client) Stream(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) (err error) {
+	// Only the program is recorded: commands can carry arguments callers consider private.
+	program, _, _ := strings.Cut(command, " ")
+	ctx, span := tracing.Start(ctx, "ssh "+program, attribute.String("macvmagt.vm.id", c.vmID))
+	defer func() { tracing.End(span, err) }()
+
+	session, host, err := c.newSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if stdin != nil {
+		session.Stdin = stdin
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- session.Run(command) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("SSH command '%s' on %s failed: %w", command, host, err)
+		}
+		return nil
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		return fmt.Errorf("SSH command '%s' on %s aborted: %w", command, host, ctx.Err())
+	}
+}
+
+// Upload writes src to remotePath inside the VM over SFTP, creating or
+// truncating the file and setting its permissions to mode.
+func (c *Client) Upload(ctx context.Context, src io.Reader, remotePath string, mode os.FileMode) (err error) {
+	ctx, span := tracing.Start(ctx, "sftp upload", attribute.String("macvmagt.vm.id", c.vmID))
+	defer func() { tracing.End(span, err) }()
+
+	sftpClient, err := c.sftp(ctx)
+	if err != nil {
+		return err
+	}
+	defer sftpClient.Close()
+
+	file, err := sftpClient.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("failed to open %s on VM %s for writing: %w", remotePath, c.vmID, err)
+	}
+	defer file.Close()
+
+	if _, err := copyContext(ctx, file, src); err != nil {
+		return fmt.Errorf("failed to upload %s to VM %s: %w", remotePath, c.vmID, err)
+	}
+	if err := file.Chmod(mode); err != nil {
+		return fmt.Errorf("failed to set permissions on %s on VM %s: %w", remotePath, c.vmID, err)
+	}
+	return nil
+}
+
+// Download copies remotePath from inside the VM to dst over SFTP.
+func (c *Client) Download(ctx context.Context, remotePath string, dst io.Writer) (err error) {
+	ctx, span := tracing.Start(ctx, "sftp download", attribute.String("macvmagt.vm.id", c.vmID))
+	defer func() { tracing.End(span, err) }()
+
+	sftpClient, err := c.sftp(ctx)
+	if err != nil {
+		return err
+	}
+	defer sftpClient.Close()
+
+	file, err := sftpClient.Open(remotePath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s on VM %s: %w", remotePath, c.vmID, err)
+	}
+	defer file.Close()
+
+	if _, err := copyContext(ctx, dst, file); err != nil {
+		return fmt.Errorf("failed to download %s from VM %s: %w", remotePath, c.vmID, err)
+	}
+	return nil
+}
+
+// Remove deletes remotePath inside the VM over SFTP.
+func (c *Client) Remove(ctx context.Context, remotePath string) (err error) {
+	ctx, span := tracing.Start(ctx, "sftp remove", attribute.String("macvmagt.vm.id", c.vmID))
+	defer func() { tracing.End(span, err) }()
+
+	sftpClient, err := c.sftp(ctx)
+	if err != nil {
+		return err
+	}
+	defer sftpClient.Close()
+
+	if err := sftpClient.Remove(remotePath); err != nil {
+		return fmt.Errorf("failed to remove %s on VM %s: %w", remotePath, c.vmID, err)
+	}
+	return nil
+}
+
+// VMID returns the ID of the VM the client connects to.
+func (c *Client) VMID() string {
+	return c.vmID
+}
+
+// Close closes the underlying connection. The client reconnects on next use.
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// newSession opens a session on the pooled connection, reconnecting once if
+// the connection has gone stale (e.g. the VM was rebooted or suspended).
+func (c *Client) newSession(ctx context.Context) (*ssh.Session, string, error) {
+	conn, host, err := c.connection(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	session, err := conn.NewSession()
+	if err == nil {
+		return session, host, nil
+	}
+
+	log.Printf("SSH connection to VM %s is stale, reconnecting: %v", c.vmID, err)
+	c.Close()
+	conn, host, err = c.connection(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	session, err = conn.NewSession()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open SSH session on %s: %w", host, err)
+	}
+	return session, host, nil
+}
+
+func (c *Client) sftp(ctx context.Context) (*sftp.Client, error) {
+	conn, host, err := c.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sftpClient, err := sftp.NewClient(conn)
+	if err == nil {
+		return sftpClient, nil
+	}
+
+	c.Close()
+	conn, host, err = c.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sftpClient, err = sftp.NewClient(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start SFTP session on %s: %w", host, err)
+	}
+	return sftpClient, nil
+}
+
+// connection returns the pooled connection, dialing a new one if needed.
+func (c *Client) connection(ctx context.Context) (*ssh.Client, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		return c.conn, c.host, nil
+	}
+
+	ctx, span := tracing.Start(ctx, "ssh connect", attribute.String("macvmagt.vm.id", c.vmID))
+	target, err := c.resolve(c.vmID)
+	if err != nil {
+		tracing.End(span, err)
+		return nil, "", err
+	}
+	span.SetAttributes(attribute.String("server.address", target.Host))
+	conn, err := dial(ctx, target)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, "", err
+	}
+	c.conn = conn
+	c.host = target.Host
+	return conn, target.Host, nil
+}
+
+func dial(ctx context.Context, target Target) (*ssh.Client, error) {
+	key, err := os.ReadFile(target.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key %s: %w", target.KeyPath, err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key %s: %w", target.KeyPath, err)
+	}
+
+	sshConfig := &ssh.ClientConfig{
+		User:              target.User,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback:   target.HostKeyCallback,
+		HostKeyAlgorithms: target.HostKeyAlgorithms,
+		Timeout:           dialTimeout,
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(target.Host, "22")
+	netConn, err := dialContext()(dialCtx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s via SSH: %w", target.Host, err)
+	}
+	if deadline, ok := dialCtx.Deadline(); ok {
+		netConn.SetDeadline(deadline)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, addr, sshConfig)
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("failed to connect to %s via SSH: %w", target.Host, err)
+	}
+	netConn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// copyContext copies src to dst, stopping early if ctx is done.
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			w, err := dst.Write(buf[:n])
+			written += int64(w)
+			if err != nil {
+				return written, err
+			}
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
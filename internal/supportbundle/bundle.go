@@ -0,0 +1,315 @@
+// Package supportbundle gathers what is needed to look into a problem on a
+// node into a single tar.gz to attach to bug reports: the configuration with
+// secrets redacted, recent agent and VM logs, VM states, image manifests,
+// the agent's state files, disk and thermal stats and backend versions.
+package supportbundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/backend"
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/doctor"
+	"github.com/changty97/macvmagt/internal/imagemgr"
+	"github.com/changty97/macvmagt/internal/paths"
+	"github.com/changty97/macvmagt/internal/utils"
+	"github.com/changty97/macvmagt/internal/version"
+)
+
+const (
+	// maxLogBytes bounds what is kept of each log and state file, from its end.
+	maxLogBytes = 8 << 20
+	// redacted replaces credentials in the configuration.
+	redacted = "REDACTED"
+)
+
+// stateDirs are the directories under the state directory whose files are
+// bundled besides its top-level ones. TLS keys, host keys and VM log bundles
+// are left out.
+var stateDirs = []string{"provisioning"}
+
+// Manifest describes a bundle, as bundle.json at its root.
+type Manifest struct {
+	NodeID       string    `json:"nodeId"`
+	AgentVersion string    `json:"agentVersion"`
+	CreatedAt    time.Time `json:"createdAt"`
+	Source       string    `json:"source"`           // "cli", or "api" if a running agent wrote it
+	Errors       []string  `json:"errors,omitempty"` // Parts that couldn't be gathered
+}
+
+// bundle writes the files of a support bundle, recording the parts that
+// couldn't be gathered instead of failing.
+type bundle struct {
+	cfg      *config.Config
+	tw       *tar.Writer
+	manifest Manifest
+}
+
+// Write writes a support bundle of the node to w as a tar.gz. source says
+// what asked for it, "cli" or "api", and extra holds more files to add, such
+// as a running agent's in-memory state, as JSON by name. It fails only if w
+// does; parts that can't be gathered are listed in bundle.json.
+func Write(ctx context.Context, cfg *config.Config, w io.Writer, source string, extra map[string]any) error {
+	gz := gzip.NewWriter(w)
+	b := &bundle{
+		cfg: cfg,
+		tw:  tar.NewWriter(gz),
+		manifest: Manifest{
+			NodeID:       cfg.NodeID,
+			AgentVersion: version.Version,
+			CreatedAt:    time.Now().UTC(),
+			Source:       source,
+		},
+	}
+
+	steps := []func(ctx context.Context) error{
+		b.addConfig,
+		b.addHost,
+		b.addLogs,
+		b.addVMs,
+		b.addImages,
+		b.addState,
+	}
+	for _, step := range steps {
+		if err := step(ctx); err != nil {
+			return fmt.Errorf("failed to write support bundle: %w", err)
+		}
+	}
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := b.addJSON(name, extra[name]); err != nil {
+			return fmt.Errorf("failed to write support bundle: %w", err)
+		}
+	}
+
+	err := b.addJSON("bundle.json", b.manifest)
+	if err == nil {
+		err = b.tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write support bundle: %w", err)
+	}
+	return nil
+}
+
+// addConfig adds the configuration, with credentials in URLs redacted.
+// Secrets themselves aren't part of it, only the names they are resolved by.
+func (b *bundle) addConfig(ctx context.Context) error {
+	data, err := json.Marshal(b.cfg)
+	if err != nil {
+		return err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for name, value := range fields {
+		fields[name] = redact(value)
+	}
+	return b.addJSON("config.json", fields)
+}
+
+// redact replaces the password and query parameters of URLs in value, which
+// may hold credentials, e.g. of orchestrator or webhook URLs.
+func redact(value any) any {
+	switch v := value.(type) {
+	case string:
+		u, err := url.Parse(v)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return v
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		if u.RawQuery != "" {
+			query := u.Query()
+			for key := range query {
+				query.Set(key, redacted)
+			}
+			u.RawQuery = query.Encode()
+		}
+		return u.String()
+	case []any:
+		for i := range v {
+			v[i] = redact(v[i])
+		}
+	}
+	return value
+}
+
+// addHost adds the backends found and their versions, the doctor report, and
+// disk and thermal stats.
+func (b *bundle) addHost(ctx context.Context) error {
+	if err := b.addJSON("host/node.json", backend.Detect(b.cfg)); err != nil {
+		return err
+	}
+	if err := b.addJSON("host/doctor.json", doctor.Run(ctx, b.cfg)); err != nil {
+		return err
+	}
+	if output, err := utils.ExecuteCommandContext(ctx, "df", "-h", b.cfg.ImageCacheDir, b.cfg.VMsDir, b.cfg.StateDir); err == nil {
+		if err := b.addFile("host/df.txt", []byte(output)); err != nil {
+			return err
+		}
+	} else {
+		b.failed("disk usage", err)
+	}
+	if pressure, err := utils.GetThermalPressure(); err == nil {
+		if err := b.addFile("host/thermal.txt", []byte(pressure+"\n")); err != nil {
+			return err
+		}
+	} else {
+		b.failed("thermal pressure", err)
+	}
+	return nil
+}
+
+// addLogs adds the tail of the agent's log file and its rotated files.
+func (b *bundle) addLogs(ctx context.Context) error {
+	if b.cfg.LogFile == "" {
+		b.failed("agent logs", fmt.Errorf("the agent logs to stderr, set --log-file to bundle them"))
+		return nil
+	}
+	matches, _ := filepath.Glob(b.cfg.LogFile + "*")
+	for _, path := range matches {
+		if err := b.addTail("logs/"+filepath.Base(path), path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addVMs adds the VMs tart lists with their states, and the logs of each VM
+// directory. Rendered VM configs are left out, since they may hold runner
+// registration tokens.
+func (b *bundle) addVMs(ctx context.Context) error {
+	if output, err := utils.ExecuteCommandContext(ctx, "tart", "list", "--format", "json"); err == nil {
+		if err := b.addFile("vms/tart-list.json", []byte(output)); err != nil {
+			return err
+		}
+	} else {
+		b.failed("tart list", err)
+	}
+
+	layout := paths.New(b.cfg.VMsDir)
+	vmIDs, err := layout.List()
+	if err != nil {
+		b.failed("VM directories", err)
+		return nil
+	}
+	for _, vmID := range vmIDs {
+		logs, _ := os.ReadDir(layout.LogsDir(vmID))
+		for _, entry := range logs {
+			if entry.Type().IsRegular() {
+				if err := b.addTail("vms/"+vmID+"/logs/"+entry.Name(), filepath.Join(layout.LogsDir(vmID), entry.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// addImages adds the manifest of each cached image.
+func (b *bundle) addImages(ctx context.Context) error {
+	matches, err := filepath.Glob(filepath.Join(b.cfg.ImageCacheDir, "*"+imagemgr.ManifestSuffix))
+	if err != nil {
+		b.failed("image manifests", err)
+		return nil
+	}
+	for _, path := range matches {
+		if err := b.addTail("images/"+filepath.Base(path), path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addState adds the JSON state files of the agent, such as VM records,
+// history, the audit log, cordon and image sync state.
+func (b *bundle) addState(ctx context.Context) error {
+	for _, dir := range append([]string{""}, stateDirs...) {
+		entries, err := os.ReadDir(filepath.Join(b.cfg.StateDir, dir))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			b.failed("state files", err)
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.Type().IsRegular() || !(strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".jsonl")) {
+				continue
+			}
+			if err := b.addTail(filepath.ToSlash(filepath.Join("state", dir, name)), filepath.Join(b.cfg.StateDir, dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addTail adds up to the last maxLogBytes of the file at path. Files that
+// can't be read are recorded as failed, except missing ones.
+func (b *bundle) addTail(name, path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		b.failed(name, err)
+		return nil
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err == nil && info.Size() > maxLogBytes {
+		file.Seek(info.Size()-maxLogBytes, io.SeekStart)
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxLogBytes))
+	if err != nil {
+		b.failed(name, err)
+		return nil
+	}
+	return b.addFile(name, data)
+}
+
+// addJSON adds value as an indented JSON file.
+func (b *bundle) addJSON(name string, value any) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.addFile(name, append(data, '\n'))
+}
+
+// addFile adds a file to the bundle.
+func (b *bundle) addFile(name string, data []byte) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+	if err := b.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := b.tw.Write(data)
+	return err
+}
+
+// failed records a part of the bundle that couldn't be gathered.
+func (b *bundle) failed(part string, err error) {
+	b.manifest.Errors = append(b.manifest.Errors, fmt.Sprintf("%s: %v", part, err))
+}
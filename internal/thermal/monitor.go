@@ -0,0 +1,140 @@
+package thermal
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/events"
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// pressureLevels orders the thermal pressure levels reported by macOS, lowest first.
+var pressureLevels = map[string]int{
+	"Nominal":  0,
+	"Moderate": 1,
+	"Heavy":    2,
+	"Trapping": 3,
+	"Sleeping": 4,
+}
+
+// Monitor watches host thermal pressure and suspends running VMs while it is
+// critical, resuming them once the host has cooled down to nominal.
+type Monitor struct {
+	cfg          *config.Config
+	events       *events.Emitter
+	mu           sync.Mutex // Protects suspendedVMs and active
+	suspendedVMs []string   // VMs suspended by the monitor, resumed on recovery
+	active       bool       // True while protective mode is engaged
+	launch       LaunchFunc // How each VM is resumed; nil resumes VMs with tart's defaults
+}
+
+// LaunchFunc returns how a VM is resumed.
+type LaunchFunc func(vmID string) utils.VMLaunch
+
+// SetLaunch makes VMs resume the way fn returns, such as with their network
+// mode and CPU policy. The VM manager knows each VM's config, so it provides fn.
+func (m *Monitor) SetLaunch(fn LaunchFunc) {
+	m.launch = fn
+}
+
+// NewMonitor creates a new thermal Monitor.
+func NewMonitor(cfg *config.Config, em *events.Emitter) *Monitor {
+	return &Monitor{
+		cfg:    cfg,
+		events: em,
+	}
+}
+
+// Start polls thermal pressure at ThermalCheckInterval until the process exits.
+func (m *Monitor) Start() {
+	if _, ok := pressureLevels[m.cfg.ThermalCriticalLevel]; !ok {
+		log.Printf("Warning: Unknown thermal critical level %q, thermal protection disabled.", m.cfg.ThermalCriticalLevel)
+		return
+	}
+
+	ticker := time.NewTicker(m.cfg.ThermalCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.check()
+	}
+}
+
+// Active reports whether VMs are currently suspended for thermal protection.
+func (m *Monitor) Active() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active
+}
+
+func (m *Monitor) check() {
+	level, err := utils.GetThermalPressure()
+	if err != nil {
+		log.Printf("Error getting thermal pressure: %v", err)
+		return
+	}
+	severity, ok := pressureLevels[level]
+	if !ok {
+		log.Printf("Warning: Unknown thermal pressure level %q", level)
+		return
+	}
+
+	// Events are emitted once m.mu is released, since emitting posts to the
+	// orchestrator and would keep Active, and with it heartbeats, waiting.
+	var emit func()
+	m.mu.Lock()
+	switch {
+	case !m.active && severity >= pressureLevels[m.cfg.ThermalCriticalLevel]:
+		emit = m.engage(level)
+	case m.active && severity == pressureLevels["Nominal"]:
+		emit = m.release(level)
+	}
+	m.mu.Unlock()
+	if emit != nil {
+		emit()
+	}
+}
+
+// engage suspends all running VMs and returns the thermal.critical event's
+// emission. Callers must hold m.mu.
+func (m *Monitor) engage(level string) func() {
+	m.active = true
+	emit := func() {
+		m.events.Emit("thermal.critical", "Host thermal pressure is critical, suspending VMs", map[string]string{"pressure": level})
+	}
+
+	runningVMs, err := utils.GetRunningVMs()
+	if err != nil {
+		log.Printf("Error listing VMs for thermal protection: %v", err)
+		return emit
+	}
+	for _, vm := range runningVMs {
+		if err := utils.SuspendVM(vm.VMID); err != nil {
+			log.Printf("Error suspending VM %s for thermal protection: %v", vm.VMID, err)
+			continue
+		}
+		m.suspendedVMs = append(m.suspendedVMs, vm.VMID)
+	}
+	return emit
+}
+
+// release resumes the VMs suspended by engage and returns the
+// thermal.recovered event's emission. Callers must hold m.mu.
+func (m *Monitor) release(level string) func() {
+	for _, vmID := range m.suspendedVMs {
+		var launch utils.VMLaunch
+		if m.launch != nil {
+			launch = m.launch(vmID)
+		}
+		if err := utils.ResumeVM(vmID, launch); err != nil {
+			log.Printf("Error resuming VM %s after thermal protection: %v", vmID, err)
+		}
+	}
+	m.suspendedVMs = nil
+	m.active = false
+	return func() {
+		m.events.Emit("thermal.recovered", "Host thermal pressure is back to normal, resuming VMs", map[string]string{"pressure": level})
+	}
+}
@@ -0,0 +1,77 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the agent's spans.
+const instrumentationName = "github.com/changty97/macvmagt"
+
+// Setup installs the W3C trace context propagator, so spans join the traces
+// of incoming orchestrator requests, and, if OTLPEndpoint is set, a tracer
+// provider exporting spans there over OTLP/HTTP. Without an endpoint spans
+// are not recorded. The standard OTEL_EXPORTER_OTLP_* variables, such as
+// OTEL_EXPORTER_OTLP_HEADERS for authentication, apply to the exporter.
+func Setup(cfg *config.Config) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if cfg.OTLPEndpoint == "" {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.OTLPEndpoint))
+	if err != nil {
+		return fmt.Errorf("failed to create OTLP trace exporter for %s: %w", cfg.OTLPEndpoint, err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("macvmagt"),
+		semconv.ServiceVersion(version.Version),
+		semconv.ServiceInstanceID(cfg.NodeID),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to create trace resource: %w", err)
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// Sampled orchestrator traces stay sampled; the ratio applies to traces the agent starts.
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TraceSampleRatio))),
+	))
+	return nil
+}
+
+// Tracer returns the tracer the agent's spans are created with.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName, trace.WithInstrumentationVersion(version.Version))
+}
+
+// Start starts a span named name as a child of the span in ctx, if any.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Fail marks span as failed with err, if non-nil.
+func Fail(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// End marks span as failed with err, if non-nil, and ends it.
+func End(span trace.Span, err error) {
+	Fail(span, err)
+	span.End()
+}
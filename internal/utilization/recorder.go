@@ -0,0 +1,184 @@
+package utilization
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// retention is how long hourly rollups are kept on disk.
+const retention = 30 * 24 * time.Hour
+
+// hourBucket accumulates raw samples for a single hour.
+type hourBucket struct {
+	Hour              time.Time `json:"hour"`
+	Samples           int       `json:"samples"`
+	VMCountSum        float64   `json:"vmCountSum"`
+	MaxVMCount        int       `json:"maxVmCount"`
+	CPUPercentSum     float64   `json:"cpuPercentSum"`
+	MemoryUsageGBSum  float64   `json:"memoryUsageGBSum"`
+	Provisions        int       `json:"provisions"`
+	ProvisionFailures int       `json:"provisionFailures"`
+	Deletions         int       `json:"deletions"`
+}
+
+// Recorder keeps hourly rollups of node utilization in a local JSON file so
+// the history survives agent restarts and missed heartbeats.
+type Recorder struct {
+	path    string
+	mu      sync.Mutex            // Protects buckets
+	buckets map[int64]*hourBucket // Keyed by the hour's Unix timestamp
+}
+
+// NewRecorder creates a Recorder backed by utilization.json in the state directory.
+func NewRecorder(cfg *config.Config) (*Recorder, error) {
+	if err := os.MkdirAll(cfg.StateDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory %s: %w", cfg.StateDir, err)
+	}
+
+	r := &Recorder{
+		path:    filepath.Join(cfg.StateDir, "utilization.json"),
+		buckets: make(map[int64]*hourBucket),
+	}
+	r.load()
+	return r, nil
+}
+
+// load reads previously persisted rollups, ignoring a missing or corrupt file.
+func (r *Recorder) load() {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: Could not read utilization history %s: %v", r.path, err)
+		}
+		return
+	}
+
+	var buckets []*hourBucket
+	if err := json.Unmarshal(data, &buckets); err != nil {
+		log.Printf("Warning: Could not parse utilization history %s: %v", r.path, err)
+		return
+	}
+	for _, b := range buckets {
+		r.buckets[b.Hour.Unix()] = b
+	}
+	log.Printf("Loaded %d hourly utilization rollups from %s", len(buckets), r.path)
+}
+
+// RecordSample adds a point-in-time resource sample to the current hour.
+func (r *Recorder) RecordSample(vmCount int, cpuPercent, memoryUsageGB float64) {
+	r.update(func(b *hourBucket) {
+		b.Samples++
+		b.VMCountSum += float64(vmCount)
+		if vmCount > b.MaxVMCount {
+			b.MaxVMCount = vmCount
+		}
+		b.CPUPercentSum += cpuPercent
+		b.MemoryUsageGBSum += memoryUsageGB
+	})
+}
+
+// RecordProvision counts a finished provisioning attempt in the current hour.
+func (r *Recorder) RecordProvision(success bool) {
+	r.update(func(b *hourBucket) {
+		b.Provisions++
+		if !success {
+			b.ProvisionFailures++
+		}
+	})
+}
+
+// RecordDeletion counts a VM deletion in the current hour.
+func (r *Recorder) RecordDeletion() {
+	r.update(func(b *hourBucket) {
+		b.Deletions++
+	})
+}
+
+// update applies fn to the current hour's bucket, prunes old data and persists.
+func (r *Recorder) update(fn func(b *hourBucket)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hour := time.Now().UTC().Truncate(time.Hour)
+	b, ok := r.buckets[hour.Unix()]
+	if !ok {
+		b = &hourBucket{Hour: hour}
+		r.buckets[hour.Unix()] = b
+	}
+	fn(b)
+
+	cutoff := hour.Add(-retention).Unix()
+	for key := range r.buckets {
+		if key < cutoff {
+			delete(r.buckets, key)
+		}
+	}
+
+	if err := r.save(); err != nil {
+		log.Printf("Warning: Could not persist utilization history: %v", err)
+	}
+}
+
+// save writes all buckets to disk atomically. Callers must hold r.mu.
+func (r *Recorder) save() error {
+	data, err := json.Marshal(r.sortedBuckets(time.Time{}))
+	if err != nil {
+		return fmt.Errorf("failed to marshal utilization history: %w", err)
+	}
+	tmpPath := r.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+	return os.Rename(tmpPath, r.path)
+}
+
+// sortedBuckets returns buckets starting at or after since, oldest first. Callers must hold r.mu.
+func (r *Recorder) sortedBuckets(since time.Time) []*hourBucket {
+	buckets := make([]*hourBucket, 0, len(r.buckets))
+	for _, b := range r.buckets {
+		if !b.Hour.Before(since) {
+			buckets = append(buckets, b)
+		}
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Hour.Before(buckets[j].Hour)
+	})
+	return buckets
+}
+
+// Rollups returns the hourly rollups covering the last rangeDur, oldest first.
+func (r *Recorder) Rollups(rangeDur time.Duration) []models.UtilizationRollup {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	since := time.Now().UTC().Add(-rangeDur).Truncate(time.Hour)
+	buckets := r.sortedBuckets(since)
+
+	rollups := make([]models.UtilizationRollup, 0, len(buckets))
+	for _, b := range buckets {
+		rollup := models.UtilizationRollup{
+			Hour:              b.Hour,
+			Samples:           b.Samples,
+			MaxVMCount:        b.MaxVMCount,
+			Provisions:        b.Provisions,
+			ProvisionFailures: b.ProvisionFailures,
+			Deletions:         b.Deletions,
+		}
+		if b.Samples > 0 {
+			rollup.AvgVMCount = b.VMCountSum / float64(b.Samples)
+			rollup.AvgCPUPercent = b.CPUPercentSum / float64(b.Samples)
+			rollup.AvgMemoryUsageGB = b.MemoryUsageGBSum / float64(b.Samples)
+		}
+		rollups = append(rollups, rollup)
+	}
+	return rollups
+}
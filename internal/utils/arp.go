@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// arpSettleTime is how long a sweep waits for the ARP replies it provoked.
+const arpSettleTime = 500 * time.Millisecond
+
+// maxSweepHosts bounds the addresses swept per subnet, so a host bridged onto
+// a large LAN isn't flooded.
+const maxSweepHosts = 1024
+
+// LookupARP returns the IP address the host's ARP table maps mac to, from
+// `arp -an` lines such as "? (192.168.64.3) at 1a:2b:3c:4d:5e:6f on bridge100 ifscope [bridge]".
+func (c *Commands) LookupARP(ctx context.Context, mac net.HardwareAddr) (string, error) {
+	output, err := c.RunCommand(ctx, "arp", "-an")
+	if err != nil {
+		return "", fmt.Errorf("failed to read the ARP table: %w: %s", err, strings.TrimSpace(output))
+	}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] != "at" {
+			continue
+		}
+		entryMAC, err := parseLeaseMAC(fields[3]) // arp drops leading zeros too
+		if err != nil || entryMAC.String() != mac.String() {
+			continue
+		}
+		return strings.Trim(fields[1], "()"), nil
+	}
+	return "", fmt.Errorf("no ARP entry for %s", mac)
+}
+
+// SweepVMNetworks provokes ARP traffic with every address of the subnets of
+// the host's vmnet bridges (bridge*), so guests that haven't talked to the
+// host yet show up in its ARP table. It sends one UDP datagram per address to
+// the discard port and waits briefly for the replies.
+func SweepVMNetworks(ctx context.Context) error {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("failed to list network interfaces: %w", err)
+	}
+	swept := false
+	for _, iface := range interfaces {
+		if !strings.HasPrefix(iface.Name, "bridge") || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			sweepSubnet(ctx, ipNet)
+			swept = true
+		}
+	}
+	if !swept {
+		return fmt.Errorf("no vmnet bridge with an IPv4 subnet found")
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(arpSettleTime):
+	}
+	return nil
+}
+
+// sweepSubnet sends a datagram to each host address of subnet but the host's own.
+func sweepSubnet(ctx context.Context, subnet *net.IPNet) {
+	ones, bits := subnet.Mask.Size()
+	hosts := 1<<(bits-ones) - 2
+	if hosts < 1 {
+		return
+	}
+	base := subnet.IP.To4().Mask(subnet.Mask)
+	for i := 1; i <= min(hosts, maxSweepHosts); i++ {
+		if ctx.Err() != nil {
+			return
+		}
+		ip := make(net.IP, 4)
+		copy(ip, base)
+		for n, b := i, 3; n > 0 && b >= 0; n, b = n>>8, b-1 {
+			ip[b] += byte(n)
+		}
+		if ip.Equal(subnet.IP) {
+			continue
+		}
+		conn, err := net.Dial("udp4", net.JoinHostPort(ip.String(), "9"))
+		if err != nil {
+			continue
+		}
+		conn.Write([]byte{0})
+		conn.Close()
+	}
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// defaultCommands runs the commands of the package-level helpers below, with
+// the CommandRunner set with SetCommandRunner.
+var defaultCommands = &Commands{}
+
+// ExecuteCommand runs a shell command and returns its output.
+func ExecuteCommand(name string, args ...string) (string, error) {
+	return defaultCommands.ExecuteCommand(name, args...)
+}
+
+// ExecuteCommandContext is like ExecuteCommand, but kills the command and any
+// processes it started once ctx is done.
+func ExecuteCommandContext(ctx context.Context, name string, args ...string) (string, error) {
+	return defaultCommands.ExecuteCommandContext(ctx, name, args...)
+}
+
+// RunCommand runs a command and returns its combined output, also when it
+// fails, leaving logging failures to the caller.
+func RunCommand(ctx context.Context, name string, args ...string) (string, error) {
+	return defaultCommands.RunCommand(ctx, name, args...)
+}
+
+// LookPath finds an executable in PATH.
+func LookPath(file string) (string, error) {
+	return defaultCommands.LookPath(file)
+}
+
+// GetRunningVMs uses `tart list --json` to get details of running VMs.
+func GetRunningVMs() ([]models.VMInfo, error) {
+	return defaultCommands.GetRunningVMs()
+}
+
+// ListVMs returns the state of every VM known to tart, running or not, keyed by name.
+func ListVMs() (map[string]string, error) {
+	return defaultCommands.ListVMs()
+}
+
+// GetVMState returns the state of a VM as reported by `tart list` (e.g., "running", "stopped").
+func GetVMState(vmID string) (string, error) {
+	return defaultCommands.GetVMState(vmID)
+}
+
+// GetVMIPAddress returns the IP address of a running VM using `tart ip`,
+// which waits up to wait for the VM to get one.
+func GetVMIPAddress(ctx context.Context, vmID string, wait time.Duration) (string, error) {
+	return defaultCommands.GetVMIPAddress(ctx, vmID, wait)
+}
+
+// GetVMProcessID returns the PID of the `tart run` process hosting a VM.
+func GetVMProcessID(vmID string) (int, error) {
+	return defaultCommands.GetVMProcessID(vmID)
+}
+
+// StartVM boots a stopped VM headless with `tart run` in the background.
+func StartVM(vmID string, launch VMLaunch) error {
+	return defaultCommands.StartVM(vmID, launch)
+}
+
+// SuspendVM suspends a running VM using `tart suspend`.
+func SuspendVM(vmID string) error {
+	return defaultCommands.SuspendVM(vmID)
+}
+
+// ResumeVM resumes a suspended VM with `tart run` in the background.
+func ResumeVM(vmID string, launch VMLaunch) error {
+	return defaultCommands.ResumeVM(vmID, launch)
+}
+
+// RenameVM renames a VM with `tart rename`.
+func RenameVM(vmID, newName string) error {
+	return defaultCommands.RenameVM(vmID, newName)
+}
+
+// StopVM stops a VM with `tart stop`, without deleting it.
+func StopVM(vmID string) error {
+	return defaultCommands.StopVM(vmID)
+}
+
+// DeleteVM stops and deletes a virtual machine using `tart`.
+func DeleteVM(vmID string) error {
+	return defaultCommands.DeleteVM(vmID)
+}
+
+// LookupARP returns the IP address the host's ARP table maps mac to.
+func LookupARP(ctx context.Context, mac net.HardwareAddr) (string, error) {
+	return defaultCommands.LookupARP(ctx, mac)
+}
+
+// BridgeMemberForMAC returns the vmnet interface through which a guest with
+// the given MAC address is attached to one of the host's bridges.
+func BridgeMemberForMAC(mac net.HardwareAddr) (string, error) {
+	return defaultCommands.BridgeMemberForMAC(mac)
+}
+
+// GetFreeDiskSpace returns the bytes available to unprivileged users on the
+// volume holding path, along with the volume's device name.
+func GetFreeDiskSpace(path string) (int64, string, error) {
+	return defaultCommands.GetFreeDiskSpace(path)
+}
@@ -1,17 +1,47 @@
 package utils
 
 import (
+	"context"
 	"log"
 	"os/exec"
+	"syscall"
+	"time"
 )
 
+// commandWaitDelay is how long a canceled command's output pipes are waited on
+// after it is killed, in case something it spawned still holds them open.
+const commandWaitDelay = 5 * time.Second
+
 // ExecuteCommand runs a shell command and returns its output.
-func ExecuteCommand(name string, args ...string) (string, error) {
-	cmd := exec.Command(name, args...)
-	output, err := cmd.CombinedOutput()
+func (c *Commands) ExecuteCommand(name string, args ...string) (string, error) {
+	return c.ExecuteCommandContext(context.Background(), name, args...)
+}
+
+// ExecuteCommandContext is like ExecuteCommand, but kills the command and any
+// processes it started once ctx is done. It runs the command with c's
+// CommandRunner.
+func (c *Commands) ExecuteCommandContext(ctx context.Context, name string, args ...string) (string, error) {
+	output, err := c.Runner().Run(ctx, name, args...)
 	if err != nil {
+		if ctx.Err() != nil {
+			log.Printf("Command '%s %v' canceled: %v", name, args, ctx.Err())
+			return "", ctx.Err()
+		}
 		log.Printf("Error executing command '%s %v': %s, Error: %v", name, args, string(output), err)
 		return "", err
 	}
 	return string(output), nil
 }
+
+// CommandContext prepares a command that is killed, along with any processes
+// it started, once ctx is done.
+func CommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	// Run it in its own process group, so canceling kills its children too.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = commandWaitDelay
+	return cmd
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DHCPLease is an entry of the macOS DHCP server's lease database, which
+// vmnet's DHCP server writes for NAT and host-only VMs.
+type DHCPLease struct {
+	Name       string           // Hostname the guest sent, if any
+	IPAddress  string           // Leased address
+	HWAddress  net.HardwareAddr // Guest MAC address
+	Expiration time.Time
+}
+
+// ReadDHCPLeases parses a bootpd lease file (/var/db/dhcpd_leases) made of
+// brace-delimited blocks of key=value lines, e.g.
+//
+//	{
+//		name=runner
+//		ip_address=192.168.64.3
+//		hw_address=1,2e:4c:a1:b:5:6
+//		lease=0x65a1b2c3
+//	}
+//
+// hw_address is the hardware type followed by the MAC, with leading zeros of
+// each octet dropped. A missing file means no leases.
+func ReadDHCPLeases(path string) ([]DHCPLease, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DHCP leases %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var leases []DHCPLease
+	var lease DHCPLease
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch line {
+		case "{":
+			lease = DHCPLease{}
+			continue
+		case "}":
+			if lease.IPAddress != "" && lease.HWAddress != nil {
+				leases = append(leases, lease)
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "name":
+			lease.Name = value
+		case "ip_address":
+			lease.IPAddress = value
+		case "hw_address":
+			_, address, _ := strings.Cut(value, ",")
+			lease.HWAddress, _ = parseLeaseMAC(address)
+		case "lease":
+			if seconds, err := strconv.ParseInt(strings.TrimPrefix(value, "0x"), 16, 64); err == nil {
+				lease.Expiration = time.Unix(seconds, 0)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read DHCP leases %s: %w", path, err)
+	}
+	return leases, nil
+}
+
+// parseLeaseMAC parses a MAC address whose octets may lack leading zeros.
+func parseLeaseMAC(address string) (net.HardwareAddr, error) {
+	octets := strings.Split(address, ":")
+	if len(octets) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %q", address)
+	}
+	mac := make(net.HardwareAddr, len(octets))
+	for i, octet := range octets {
+		value, err := strconv.ParseUint(octet, 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC address %q", address)
+		}
+		mac[i] = byte(value)
+	}
+	return mac, nil
+}
+
+// LookupDHCPLease returns the IP address of the most recent unexpired lease
+// for mac in the lease file at path.
+func LookupDHCPLease(path string, mac net.HardwareAddr) (string, error) {
+	leases, err := ReadDHCPLeases(path)
+	if err != nil {
+		return "", err
+	}
+	var best *DHCPLease
+	for i, lease := range leases {
+		if lease.HWAddress.String() != mac.String() || lease.Expiration.Before(time.Now()) {
+			continue
+		}
+		if best == nil || lease.Expiration.After(best.Expiration) {
+			best = &leases[i]
+		}
+	}
+	if best == nil {
+		return "", fmt.Errorf("no DHCP lease for %s in %s", mac, path)
+	}
+	return best.IPAddress, nil
+}
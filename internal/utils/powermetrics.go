@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"howett.net/plist"
+)
+
+// CoalitionSample is the CPU activity of one process coalition (a process and
+// the XPC services it is responsible for, such as a VM's Virtualization
+// service) during a powermetrics sample.
+type CoalitionSample struct {
+	Name        string
+	PIDs        []int
+	CPUMsPerSec float64
+	QoSMsPerSec map[string]float64 // CPU time by thread QoS class (e.g., "background", "user_interactive")
+}
+
+// SchedulingSample is one powermetrics sample of per-coalition CPU time and
+// per-cluster core activity.
+type SchedulingSample struct {
+	Coalitions []CoalitionSample
+	Clusters   []models.CoreCluster
+}
+
+// SampleCPUScheduling runs powermetrics (root required) for sampleMs
+// milliseconds and returns per-coalition CPU usage by QoS class together with
+// the activity of each Apple silicon core cluster.
+func SampleCPUScheduling(sampleMs int) (*SchedulingSample, error) {
+	output, err := ExecuteCommand("powermetrics", "-n", "1", "-i", strconv.Itoa(sampleMs),
+		"--samplers", "tasks,cpu_power", "--show-process-coalition", "--show-process-qos", "-f", "plist")
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample CPU scheduling with powermetrics: %w", err)
+	}
+
+	// powermetrics separates plist documents with NUL bytes.
+	doc := bytes.Trim([]byte(output), "\x00\n ")
+	if i := bytes.IndexByte(doc, 0); i >= 0 {
+		doc = doc[:i]
+	}
+	var raw map[string]interface{}
+	if _, err := plist.Unmarshal(doc, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse powermetrics output: %w", err)
+	}
+
+	sample := &SchedulingSample{}
+	for _, c := range asSlice(raw["coalitions"]) {
+		coalition := asMap(c)
+		cs := CoalitionSample{
+			Name:        asString(coalition["name"]),
+			CPUMsPerSec: asFloat(coalition["cputime_ms_per_s"]),
+			QoSMsPerSec: make(map[string]float64),
+		}
+		for _, t := range asSlice(coalition["tasks"]) {
+			task := asMap(t)
+			cs.PIDs = append(cs.PIDs, int(asFloat(task["pid"])))
+			for key, value := range asMap(task["qos"]) {
+				if class, ok := strings.CutSuffix(key, "_ms_per_s"); ok {
+					cs.QoSMsPerSec[class] += asFloat(value)
+				}
+			}
+		}
+		sample.Coalitions = append(sample.Coalitions, cs)
+	}
+
+	for _, c := range asSlice(asMap(raw["processor"])["clusters"]) {
+		cluster := asMap(c)
+		name := asString(cluster["name"])
+		kind := "P"
+		if strings.HasPrefix(name, "E") {
+			kind = "E"
+		}
+		sample.Clusters = append(sample.Clusters, models.CoreCluster{
+			Name:        name,
+			Kind:        kind,
+			ActiveRatio: 1 - asFloat(cluster["idle_ratio"]),
+			FreqMHz:     asFloat(cluster["freq_hz"]) / 1e6,
+		})
+	}
+	return sample, nil
+}
+
+// CoalitionForPID returns the coalition containing pid, if any.
+func (s *SchedulingSample) CoalitionForPID(pid int) (*CoalitionSample, bool) {
+	for i := range s.Coalitions {
+		for _, p := range s.Coalitions[i].PIDs {
+			if p == pid {
+				return &s.Coalitions[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+func asMap(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+func asSlice(v interface{}) []interface{} {
+	s, _ := v.([]interface{})
+	return s
+}
+
+func asString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func asFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case float32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	case int:
+		return float64(n)
+	}
+	return 0
+}
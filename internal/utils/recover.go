@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// Recover, when deferred, stops a panic in the background task name from
+// crashing the agent and logs it with its stack trace.
+func Recover(name string) {
+	if r := recover(); r != nil {
+		log.Printf("Panic in %s: %v\n%s", name, r, debug.Stack())
+	}
+}
+
+// CatchPanic calls fn and returns a panic in it as an error, logged with its
+// stack trace, so a task that panics fails like any other rather than taking
+// the agent down.
+func CatchPanic(name string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in %s: %v\n%s", name, r, debug.Stack())
+			err = fmt.Errorf("internal error in %s: %v", name, r)
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,365 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// CommandRunner runs the external commands the agent drives, such as tart,
+// so they can be faked in tests or replayed from recorded outputs in CI.
+type CommandRunner interface {
+	// Run runs a command to completion and returns its combined output. The
+	// command and any processes it started are killed once ctx is done.
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+	// Start starts a command that keeps running, such as `tart run`, without
+	// waiting for it to exit, and returns its PID, or 0 if no process runs it,
+	// e.g. when it is replayed.
+	Start(opts StartOptions, name string, args ...string) (int, error)
+	// LookPath finds an executable in PATH, like exec.LookPath.
+	LookPath(file string) (string, error)
+}
+
+// StartOptions say where the output of a command started with Start goes and
+// who hears about its exit.
+type StartOptions struct {
+	Output io.WriteCloser  // Gets the command's stdout and stderr, and is closed once it exits or fails to start; nil discards them
+	Exited func(err error) // Called once the command exits, with the error it exited with; nil logs the exit instead
+}
+
+// CloseOutput closes the output of a command that failed to start.
+func (o StartOptions) CloseOutput() {
+	if o.Output != nil {
+		o.Output.Close()
+	}
+}
+
+// Finish closes the output of a command that exited and reports its exit.
+func (o StartOptions) Finish(err error) {
+	o.CloseOutput()
+	if o.Exited != nil {
+		o.Exited(err)
+	}
+}
+
+var (
+	runnerMu sync.RWMutex
+	runner   CommandRunner = ExecRunner{}
+)
+
+// SetCommandRunner makes the commands run through the package-level helpers,
+// such as ExecuteCommand, and through Commands without a CommandRunner of
+// their own go through r, e.g. the fake driver.
+func SetCommandRunner(r CommandRunner) {
+	runnerMu.Lock()
+	defer runnerMu.Unlock()
+	runner = r
+}
+
+// commandRunner returns the CommandRunner commands run with.
+func commandRunner() CommandRunner {
+	runnerMu.RLock()
+	defer runnerMu.RUnlock()
+	return runner
+}
+
+// Commands runs the external commands behind the helpers of this package,
+// such as tart, with a CommandRunner of its own, so that code holding one,
+// e.g. the VM manager, can be given a FakeRunner or ReplayRunner without
+// affecting other code, including tests running in parallel. The zero value
+// runs commands with the CommandRunner set with SetCommandRunner.
+type Commands struct {
+	runner CommandRunner
+}
+
+// NewCommands returns Commands that run commands with r.
+func NewCommands(r CommandRunner) *Commands {
+	return &Commands{runner: r}
+}
+
+// Runner returns the CommandRunner c runs commands with.
+func (c *Commands) Runner() CommandRunner {
+	if c == nil || c.runner == nil {
+		return commandRunner()
+	}
+	return c.runner
+}
+
+// LookPath finds an executable with c's CommandRunner.
+func (c *Commands) LookPath(file string) (string, error) {
+	return c.Runner().LookPath(file)
+}
+
+// RunCommand runs a command with c's CommandRunner and returns its combined
+// output, also when it fails. Unlike ExecuteCommandContext, it leaves logging
+// failures to the caller.
+func (c *Commands) RunCommand(ctx context.Context, name string, args ...string) (string, error) {
+	output, err := c.Runner().Run(ctx, name, args...)
+	return string(output), err
+}
+
+// ExecRunner runs commands as processes on the host.
+type ExecRunner struct{}
+
+// Run runs a command as a process in its own process group.
+func (ExecRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+// Start starts a command as a process detached from the agent: in a session
+// of its own, so signals to the agent's process group, e.g. from launchd
+// stopping the agent for an update, don't reach it, and with its output
+// attached directly rather than through a shell. Its stdin is /dev/null. The
+// agent waits for it to exit, but the process outlives the agent.
+func (ExecRunner) Start(opts StartOptions, name string, args ...string) (int, error) {
+	cmd := exec.Command(name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if opts.Output != nil {
+		cmd.Stdout, cmd.Stderr = opts.Output, opts.Output
+	}
+	if err := cmd.Start(); err != nil {
+		opts.CloseOutput()
+		return 0, err
+	}
+	go func() {
+		err := cmd.Wait()
+		if opts.Exited == nil && err != nil {
+			log.Printf("%s exited: %v", commandLine(name, args), err)
+		}
+		opts.Finish(err)
+	}()
+	return cmd.Process.Pid, nil
+}
+
+// LookPath looks an executable up in PATH.
+func (ExecRunner) LookPath(file string) (string, error) {
+	return exec.LookPath(file)
+}
+
+// commandLine renders a command for logs and as the key of canned and
+// recorded outputs. The executable's directory is left out, so fixtures
+// recorded on one host replay on hosts with it installed elsewhere.
+func commandLine(name string, args []string) string {
+	return strings.Join(append([]string{filepath.Base(name)}, args...), " ")
+}
+
+// FakeRunner is a CommandRunner for tests. It answers commands with outputs
+// set with On instead of running them, and remembers the commands it got.
+// Commands without an output fail.
+type FakeRunner struct {
+	mu      sync.Mutex
+	outputs map[string]fixture
+	calls   []string
+}
+
+// NewFakeRunner returns a FakeRunner without any outputs.
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{outputs: make(map[string]fixture)}
+}
+
+// On makes the command line commandLine, e.g. "tart ip runner-1", answer
+// with output, failing with err if it isn't nil.
+func (f *FakeRunner) On(commandLine, output string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fixture := fixture{Command: commandLine, Output: output}
+	if err != nil {
+		fixture.Error = err.Error()
+	}
+	f.outputs[commandLine] = fixture
+}
+
+// Calls returns the command lines run so far, oldest first.
+func (f *FakeRunner) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// Run answers a command with its output.
+func (f *FakeRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	line := commandLine(name, args)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, line)
+	fixture, ok := f.outputs[line]
+	if !ok {
+		return nil, fmt.Errorf("fake runner has no output for %q", line)
+	}
+	return fixture.result()
+}
+
+// Start records a command and fails only if it has an output with an error.
+// No process runs it, so its exit isn't reported.
+func (f *FakeRunner) Start(opts StartOptions, name string, args ...string) (int, error) {
+	opts.CloseOutput()
+	line := commandLine(name, args)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, line)
+	if fixture, ok := f.outputs[line]; ok && fixture.Error != "" {
+		return 0, errors.New(fixture.Error)
+	}
+	return 0, nil
+}
+
+// LookPath finds every executable, as the executable itself.
+func (f *FakeRunner) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+// fixture is a recorded run of a command, one JSON object per line in a
+// fixture file.
+type fixture struct {
+	Command string `json:"command"`
+	Output  string `json:"output"`
+	Error   string `json:"error,omitempty"`
+}
+
+// result returns the recorded output and error.
+func (f fixture) result() ([]byte, error) {
+	if f.Error != "" {
+		return []byte(f.Output), errors.New(f.Error)
+	}
+	return []byte(f.Output), nil
+}
+
+// RecordingRunner runs commands with another CommandRunner and appends
+// their outputs to a fixture file, which a ReplayRunner can replay.
+type RecordingRunner struct {
+	next CommandRunner
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewRecordingRunner records the commands run with next to the fixture file
+// at path, appending to it if it exists.
+func NewRecordingRunner(next CommandRunner, path string) (*RecordingRunner, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open command fixture file %s: %w", path, err)
+	}
+	return &RecordingRunner{next: next, file: file}, nil
+}
+
+// Run runs a command and records its output.
+func (r *RecordingRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	output, err := r.next.Run(ctx, name, args...)
+	r.record(fixture{Command: commandLine(name, args), Output: string(output)}, err)
+	return output, err
+}
+
+// Start starts a command and records whether it started. Its output isn't
+// recorded.
+func (r *RecordingRunner) Start(opts StartOptions, name string, args ...string) (int, error) {
+	pid, err := r.next.Start(opts, name, args...)
+	r.record(fixture{Command: commandLine(name, args)}, err)
+	return pid, err
+}
+
+// LookPath looks an executable up with the recorded runner.
+func (r *RecordingRunner) LookPath(file string) (string, error) {
+	return r.next.LookPath(file)
+}
+
+// record appends a fixture to the file.
+func (r *RecordingRunner) record(f fixture, err error) {
+	if err != nil {
+		f.Error = err.Error()
+	}
+	data, _ := json.Marshal(f)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.file.Write(append(data, '\n')); err != nil {
+		log.Printf("Warning: Could not record output of %s: %v", f.Command, err)
+	}
+}
+
+// ReplayRunner answers commands with the outputs recorded in a fixture file
+// instead of running them. A command recorded several times gets its outputs
+// in the recorded order, and the last one from then on, so polling loops
+// end the way they did when recorded. Commands that weren't recorded fail.
+type ReplayRunner struct {
+	mu       sync.Mutex
+	fixtures map[string][]fixture
+}
+
+// NewReplayRunner loads the fixture file at path.
+func NewReplayRunner(path string) (*ReplayRunner, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open command fixture file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	r := &ReplayRunner{fixtures: make(map[string][]fixture)}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20) // Outputs such as `tart list` can be long
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var f fixture
+		if err := json.Unmarshal(scanner.Bytes(), &f); err != nil {
+			return nil, fmt.Errorf("invalid fixture on line %d of %s: %w", line, path, err)
+		}
+		r.fixtures[f.Command] = append(r.fixtures[f.Command], f)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read command fixture file %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// next returns the next recorded run of a command line.
+func (r *ReplayRunner) next(line string) (fixture, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	queue := r.fixtures[line]
+	if len(queue) == 0 {
+		return fixture{}, false
+	}
+	if len(queue) > 1 {
+		r.fixtures[line] = queue[1:]
+	}
+	return queue[0], true
+}
+
+// Run replays the output of a command.
+func (r *ReplayRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	line := commandLine(name, args)
+	f, ok := r.next(line)
+	if !ok {
+		return nil, fmt.Errorf("no recorded output for %q", line)
+	}
+	return f.result()
+}
+
+// Start replays whether a command started. No process runs it, so its exit
+// isn't reported.
+func (r *ReplayRunner) Start(opts StartOptions, name string, args ...string) (int, error) {
+	opts.CloseOutput()
+	line := commandLine(name, args)
+	f, ok := r.next(line)
+	if !ok {
+		return 0, fmt.Errorf("no recorded output for %q", line)
+	}
+	_, err := f.result()
+	return 0, err
+}
+
+// LookPath finds every executable, as the executable itself, since replayed
+// commands don't run.
+func (r *ReplayRunner) LookPath(file string) (string, error) {
+	return file, nil
+}
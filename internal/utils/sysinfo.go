@@ -2,8 +2,10 @@ package utils
 
 import (
 	"fmt"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // GetCPUUsage returns the current CPU usage percentage.
@@ -104,3 +106,86 @@ func GetDiskUsage() (float64, float64, error) {
 
 	return usedGB, totalGB, nil
 }
+
+// GetThermalPressure returns the current thermal pressure level reported by
+// powermetrics (e.g., "Nominal", "Moderate", "Heavy", "Trapping", "Sleeping").
+// This is macOS specific and requires root.
+func GetThermalPressure() (string, error) {
+	output, err := ExecuteCommand("powermetrics", "-n", "1", "-i", "1000", "--samplers", "thermal")
+	if err != nil {
+		return "", fmt.Errorf("failed to get thermal pressure: %w", err)
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		if strings.Contains(line, "Current pressure level:") {
+			parts := strings.SplitN(line, ":", 2)
+			return strings.TrimSpace(parts[1]), nil
+		}
+	}
+	return "", fmt.Errorf("could not parse thermal pressure from powermetrics output")
+}
+
+// GetHostArch returns the host's CPU architecture, "arm64" or "amd64". An
+// amd64 build of the agent runs under Rosetta on Apple Silicon, so the
+// hw.optional.arm64 sysctl is asked rather than trusting runtime.GOARCH.
+func GetHostArch() string {
+	if output, err := ExecuteCommand("sysctl", "-n", "hw.optional.arm64"); err == nil && strings.TrimSpace(output) == "1" {
+		return "arm64"
+	}
+	return runtime.GOARCH
+}
+
+// GetOSVersion returns the host's macOS version, e.g. "15.1".
+func GetOSVersion() (string, error) {
+	output, err := ExecuteCommand("sw_vers", "-productVersion")
+	if err != nil {
+		return "", fmt.Errorf("failed to get macOS version: %w", err)
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// GetBootTime returns when the host last booted, from sysctl kern.boottime
+// output such as "{ sec = 1729000000, usec = 123456 } Tue Oct 15 ...".
+func GetBootTime() (time.Time, error) {
+	output, err := ExecuteCommand("sysctl", "-n", "kern.boottime")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get boot time: %w", err)
+	}
+	_, rest, ok := strings.Cut(output, "sec = ")
+	if !ok {
+		return time.Time{}, fmt.Errorf("could not parse boot time from %q", strings.TrimSpace(output))
+	}
+	secs, _, _ := strings.Cut(rest, ",")
+	sec, err := strconv.ParseInt(strings.TrimSpace(secs), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse boot time from %q", strings.TrimSpace(output))
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// GetFreeDiskSpace returns the bytes available to unprivileged users on the
+// volume holding path, along with the volume's device name so callers can tell
+// whether two paths share a volume.
+func (c *Commands) GetFreeDiskSpace(path string) (int64, string, error) {
+	// -P keeps each filesystem on one line, -k reports 1024-byte blocks.
+	output, err := c.ExecuteCommand("df", "-P", "-k", path)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get free disk space for %s: %w", path, err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 2 {
+		return 0, "", fmt.Errorf("unexpected df output format for %s", path)
+	}
+
+	// Expected format: Filesystem 1024-blocks Used Available Capacity Mounted on
+	fields := strings.Fields(lines[1])
+	if len(fields) < 6 {
+		return 0, "", fmt.Errorf("unexpected df fields count for %s", path)
+	}
+	availableKB, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to parse available disk space for %s: %w", path, err)
+	}
+	return availableKB * 1024, fields[0], nil
+}
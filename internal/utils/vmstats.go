@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	psnet "github.com/shirou/gopsutil/v4/net"
+	"github.com/shirou/gopsutil/v4/process"
+)
+
+// ProcessTreeUsage returns the total CPU time in seconds and resident memory
+// of a process and all its descendants, e.g. a VM's `tart run` process and
+// the softnet helper it spawns. Descendants that exit while being read are skipped.
+func ProcessTreeUsage(pid int) (cpuSeconds float64, rssBytes uint64, err error) {
+	root, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open process %d: %w", pid, err)
+	}
+	procs := []*process.Process{root}
+	for i := 0; i < len(procs); i++ {
+		proc := procs[i]
+		times, err := proc.Times()
+		if err != nil {
+			if proc == root {
+				return 0, 0, fmt.Errorf("failed to read CPU times of process %d: %w", pid, err)
+			}
+			continue
+		}
+		cpuSeconds += times.User + times.System
+		if memory, err := proc.MemoryInfo(); err == nil {
+			rssBytes += memory.RSS
+		}
+		if children, err := proc.Children(); err == nil {
+			procs = append(procs, children...)
+		}
+	}
+	return cpuSeconds, rssBytes, nil
+}
+
+// DirAllocatedBytes returns the disk space allocated to the files under dir.
+// VM disk images are sparse, so this is usually far less than their size.
+func DirAllocatedBytes(dir string) (uint64, error) {
+	var total uint64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			total += uint64(stat.Blocks) * 512
+		} else {
+			total += uint64(info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure %s: %w", dir, err)
+	}
+	return total, nil
+}
+
+// BridgeMemberForMAC returns the vmnet interface (vmenetN) through which a
+// guest with the given MAC address is attached to one of the host's bridges,
+// from the addresses the bridges have learned (`ifconfig bridgeN addr`).
+func (c *Commands) BridgeMemberForMAC(mac net.HardwareAddr) (string, error) {
+	list, err := c.ExecuteCommand("ifconfig", "-l")
+	if err != nil {
+		return "", fmt.Errorf("failed to list network interfaces: %w", err)
+	}
+	for _, bridge := range strings.Fields(list) {
+		if !strings.HasPrefix(bridge, "bridge") {
+			continue
+		}
+		output, err := c.ExecuteCommand("ifconfig", bridge, "addr")
+		if err != nil {
+			continue
+		}
+		if member, ok := parseBridgeAddrs(output, mac); ok {
+			return member, nil
+		}
+	}
+	return "", fmt.Errorf("no bridge has learned MAC address %s", mac)
+}
+
+// parseBridgeAddrs finds the member interface of mac in `ifconfig bridgeN addr`
+// output, which has one line per learned address, e.g.
+//
+//	2e:4c:a1:b:5:6 Vlan1 vmenet0 1183 flags=0<>
+func parseBridgeAddrs(output string, mac net.HardwareAddr) (string, bool) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		if learned, err := parseLeaseMAC(fields[0]); err == nil && learned.String() == mac.String() {
+			return fields[2], true
+		}
+	}
+	return "", false
+}
+
+// InterfaceCounters returns the bytes sent and received by a host network interface.
+func InterfaceCounters(name string) (sent, received uint64, err error) {
+	counters, err := psnet.IOCounters(true)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read network interface counters: %w", err)
+	}
+	for _, counter := range counters {
+		if counter.Name == name {
+			return counter.BytesSent, counter.BytesRecv, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("no counters for network interface %s", name)
+}
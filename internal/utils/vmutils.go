@@ -2,30 +2,40 @@
 package utils
 
 import (
+	"context"
 	"encoding/json" // For parsing tart list output
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/changty97/macvmagt/internal/logrotate"
 	"github.com/changty97/macvmagt/internal/models"
 )
 
+// ErrVMNotFound is returned for a VM tart doesn't know.
+var ErrVMNotFound = errors.New("VM not found")
+
 // TartVMInfo represents a simplified structure for parsing `tart list --json` output.
 // Adjust fields based on actual `tart` output.
 type TartVMInfo struct {
-	Name   string `json:"name"`
-	State  string `json:"state"`
-	IP     string `json:"ip"`
-	Uptime int64  `json:"uptime"` // Uptime in seconds
+	Name  string `json:"name"`
+	State string `json:"state"`
+	IP    string `json:"ip"`
+	// Tart doesn't report how long a VM has run; the VM manager tracks it.
 	// Tart does not directly expose the base image name in `list --json` output.
 	// You might need to track this internally in your vmgr.Manager or imagemgr.Manager.
 	// For now, we'll set it to "unknown" or derive it if possible.
 }
 
 // GetRunningVMs uses `tart list --json` to get details of running VMs.
-func GetRunningVMs() ([]models.VMInfo, error) {
-	output, err := ExecuteCommand("tart", "list", "--format", "json")
+func (c *Commands) GetRunningVMs() ([]models.VMInfo, error) {
+	output, err := c.ExecuteCommand("tart", "list", "--format", "json")
 	if err != nil {
 		// Tart list might return an error if no VMs, or empty JSON array
 		if strings.Contains(err.Error(), "no VMs found") || strings.TrimSpace(output) == "[]" || strings.Contains(err.Error(), "exit status 1") {
@@ -43,11 +53,10 @@ func GetRunningVMs() ([]models.VMInfo, error) {
 	for _, tvm := range tartVMs {
 		if tvm.State == "Running" {
 			vms = append(vms, models.VMInfo{
-				VMID:           tvm.Name,
-				ImageName:      "unknown", // Tart doesn't directly expose base image name in `list --json`.
-				RuntimeSeconds: tvm.Uptime,
-				VMHostname:     "unknown", // Tart doesn't directly expose hostname. May need SSH to get it.
-				VMIPAddress:    tvm.IP,
+				VMID:        tvm.Name,
+				ImageName:   "unknown", // Tart doesn't directly expose base image name in `list --json`.
+				VMHostname:  "unknown", // Tart doesn't directly expose hostname. May need SSH to get it.
+				VMIPAddress: tvm.IP,
 			})
 		}
 	}
@@ -57,14 +66,15 @@ func GetRunningVMs() ([]models.VMInfo, error) {
 // CreateVM creates a new virtual machine using the specified image via `tart`.
 // Assumes `imageName` corresponds to a base image known to tart (e.g., `tart pull` has been run).
 // `imagePath` is no longer directly used for cloning, but `imageName` is the key for tart.
-func CreateVM(vmID, imageName string) error {
+// The clone is killed if ctx is done before it finishes.
+func CreateVM(ctx context.Context, vmID, imageName string) error {
 	log.Printf("Creating VM %s from tart base image %s...", vmID, imageName)
 
 	// Clone the base image to create a new VM instance.
 	// This command creates a new VM based on an existing base image.
 	// You might need to add more arguments for CPU, memory, disk size, etc.
 	// Example: tart clone <base_image_name> <new_vm_name> --cpu 2 --memory 4GB --disk 50GB
-	_, err := ExecuteCommand("tart", "clone", imageName, vmID)
+	_, err := ExecuteCommandContext(ctx, "tart", "clone", imageName, vmID)
 	if err != nil {
 		return fmt.Errorf("failed to clone VM %s from image %s using tart: %w", vmID, imageName, err)
 	}
@@ -72,29 +82,316 @@ func CreateVM(vmID, imageName string) error {
 
 	// Start the VM.
 	// This command runs the cloned VM.
-	_, err = ExecuteCommand("tart", "run", vmID)
+	_, err = ExecuteCommandContext(ctx, "tart", "run", vmID)
 	if err != nil {
 		return fmt.Errorf("failed to start VM %s using tart: %w", vmID, err)
 	}
 	log.Printf("VM %s started.", vmID)
 
 	// Simulate VM creation/boot time if needed for testing, otherwise remove.
-	time.Sleep(10 * time.Second)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(10 * time.Second):
+	}
+
+	return nil
+}
+
+// GetVMIPAddress returns the IP address of a running VM using `tart ip`,
+// which waits up to wait for the VM to get one.
+func (c *Commands) GetVMIPAddress(ctx context.Context, vmID string, wait time.Duration) (string, error) {
+	args := []string{"ip", vmID}
+	if seconds := int(wait.Seconds()); seconds > 0 {
+		args = append(args, "--wait", strconv.Itoa(seconds))
+	}
+	output, err := c.RunCommand(ctx, "tart", args...)
+	if err != nil {
+		return "", fmt.Errorf("failed to get IP address of VM %s using tart: %w: %s", vmID, err, strings.TrimSpace(output))
+	}
+	ip := strings.TrimSpace(output)
+	if ip == "" {
+		return "", fmt.Errorf("tart returned no IP address for VM %s", vmID)
+	}
+	return ip, nil
+}
 
+// TartVMDir returns the bundle tart keeps a VM in under TART_HOME (default
+// ~/.tart), holding its disk, NVRAM and config.json.
+func TartVMDir(vmID string) (string, error) {
+	home := os.Getenv("TART_HOME")
+	if home == "" {
+		userHome, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to locate tart home: %w", err)
+		}
+		home = filepath.Join(userHome, ".tart")
+	}
+	return filepath.Join(home, "vms", vmID), nil
+}
+
+// SetTartConfig sets fields of the config tart boots a VM with, such as its
+// macAddress or cpuCount, which tart keeps in the VM's config.json under
+// TART_HOME (default ~/.tart). Object fields are merged into the existing
+// ones, so keys the agent doesn't set are kept.
+func SetTartConfig(vmID string, fields map[string]interface{}) error {
+	dir, err := TartVMDir(vmID)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "config.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read tart config of VM %s: %w", vmID, err)
+	}
+	// Decoded generically so fields the agent doesn't know about are kept.
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to parse tart config of VM %s: %w", vmID, err)
+	}
+	for key, value := range fields {
+		if object, ok := value.(map[string]int); ok {
+			existing, _ := config[key].(map[string]interface{})
+			if existing == nil {
+				existing = make(map[string]interface{})
+			}
+			for k, v := range object {
+				existing[k] = v
+			}
+			value = existing
+		}
+		config[key] = value
+	}
+	data, err = json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to encode tart config of VM %s: %w", vmID, err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write tart config of VM %s: %w", vmID, err)
+	}
+	return nil
+}
+
+// GetVMProcessID returns the PID of the `tart run` process hosting a VM.
+func (c *Commands) GetVMProcessID(vmID string) (int, error) {
+	output, err := c.ExecuteCommand("pgrep", "-f", fmt.Sprintf("tart run .*%s$", vmID))
+	if err != nil {
+		return 0, fmt.Errorf("failed to find process of VM %s: %w", vmID, err)
+	}
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("no process found for VM %s", vmID)
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse PID of VM %s: %w", vmID, err)
+	}
+	return pid, nil
+}
+
+// SuspendVM suspends a running VM using `tart suspend`, saving its memory state to disk.
+func (c *Commands) SuspendVM(vmID string) error {
+	_, err := c.ExecuteCommand("tart", "suspend", vmID)
+	if err != nil {
+		return fmt.Errorf("failed to suspend VM %s using tart: %w", vmID, err)
+	}
+	log.Printf("VM %s suspended.", vmID)
+	return nil
+}
+
+// VMLaunch is how a VM's `tart run` process is started.
+type VMLaunch struct {
+	Args      []string            // Extra `tart run` arguments, such as TartNetworkArgs
+	CPU       *models.VMCPUPolicy // Scheduling priority of the process; nil for the default
+	Log       string              // File the process's output is appended to; empty discards it
+	LogPolicy logrotate.Policy    // When Log is rotated
+	PIDFile   string              // File the process's PID is kept in while it runs; empty keeps none
+}
+
+// Command returns the command line that runs a VM: `tart run`, wrapped in nice
+// and taskpolicy to apply the launch's CPU policy. Both exec the command they
+// wrap, so the VM's process still shows up as `tart run`.
+func (l VMLaunch) Command(vmID string) []string {
+	command := append(append([]string{"tart", "run", "--no-graphics"}, l.Args...), vmID)
+	if l.CPU == nil {
+		return command
+	}
+	switch l.CPU.QoS {
+	case models.VMQoSUtility, models.VMQoSBackground:
+		// Clamped to the class, which keeps background work on efficiency cores.
+		command = append([]string{"taskpolicy", "-c", l.CPU.QoS}, command...)
+	case models.VMQoSInteractive:
+		command = append([]string{"taskpolicy", "-t", "0", "-l", "0"}, command...)
+	}
+	if l.CPU.Nice > 0 {
+		command = append([]string{"nice", "-n", strconv.Itoa(l.CPU.Nice)}, command...)
+	}
+	return command
+}
+
+// ResumeVM resumes a suspended VM. `tart run` restores the saved state and keeps
+// running for the lifetime of the VM, so it is started in the background.
+func (c *Commands) ResumeVM(vmID string, launch VMLaunch) error {
+	if err := c.runInBackground(vmID, launch); err != nil {
+		return fmt.Errorf("failed to resume VM %s using tart: %w", vmID, err)
+	}
+	log.Printf("VM %s resumed.", vmID)
+	return nil
+}
+
+// StartVM boots a stopped VM headless with `tart run` in the background.
+func (c *Commands) StartVM(vmID string, launch VMLaunch) error {
+	if err := c.runInBackground(vmID, launch); err != nil {
+		return fmt.Errorf("failed to start VM %s using tart: %w", vmID, err)
+	}
+	log.Printf("VM %s started.", vmID)
+	return nil
+}
+
+// runInBackground starts `tart run` for a VM, detached from the agent, without
+// waiting for it to exit. Its output goes to the launch's log and its PID to
+// the launch's PID file until it exits, which is logged. A log or PID file
+// that can't be written doesn't keep the VM from starting.
+func (c *Commands) runInBackground(vmID string, launch VMLaunch) error {
+	started := make(chan int, 1) // Passes the PID to the exit watcher once the PID file is written
+	opts := StartOptions{
+		Exited: func(err error) {
+			pid := <-started
+			if err != nil {
+				log.Printf("Process %d running VM %s exited: %v", pid, vmID, err)
+			} else {
+				log.Printf("Process %d running VM %s exited", pid, vmID)
+			}
+			removePIDFile(launch.PIDFile, pid)
+		},
+	}
+	if launch.Log != "" {
+		logFile, err := logrotate.Open(launch.Log, launch.LogPolicy)
+		if err != nil {
+			log.Printf("Warning: Output of VM %s is discarded: %v", vmID, err)
+		} else {
+			opts.Output = logFile
+		}
+	}
+	command := launch.Command(vmID)
+	pid, err := c.Runner().Start(opts, command[0], command[1:]...)
+	if err != nil {
+		return err
+	}
+	if launch.PIDFile != "" && pid > 0 {
+		if err := os.WriteFile(launch.PIDFile, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+			log.Printf("Warning: Could not write PID file of VM %s: %v", vmID, err)
+		}
+	}
+	started <- pid
+	return nil
+}
+
+// removePIDFile removes a VM's PID file if it still holds pid, i.e. the VM
+// wasn't started again in the meantime.
+func removePIDFile(path string, pid int) {
+	if path == "" || pid <= 0 {
+		return
+	}
+	if data, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(data)) == strconv.Itoa(pid) {
+		os.Remove(path)
+	}
+}
+
+// ReadPIDFile returns the PID kept in a VM's PID file if that process is
+// still alive.
+func ReadPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid PID file %s", path)
+	}
+	if err := syscall.Kill(pid, 0); err != nil && !errors.Is(err, syscall.EPERM) {
+		return 0, fmt.Errorf("process %d of PID file %s is gone: %w", pid, path, err)
+	}
+	return pid, nil
+}
+
+// TartNetworkArgs returns the `tart run` arguments for a VM network mode.
+// NAT is tart's default and needs none.
+func TartNetworkArgs(mode, iface string) []string {
+	switch mode {
+	case "bridged":
+		return []string{"--net-bridged=" + iface}
+	case "softnet":
+		return []string{"--net-softnet"}
+	case "host-only":
+		return []string{"--net-host"}
+	}
+	return nil
+}
+
+// ListVMs returns the state of every VM known to tart, running or not, keyed by name.
+func (c *Commands) ListVMs() (map[string]string, error) {
+	output, err := c.ExecuteCommand("tart", "list", "--format", "json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VMs with tart: %w", err)
+	}
+
+	var tartVMs []TartVMInfo
+	if err := json.Unmarshal([]byte(output), &tartVMs); err != nil {
+		return nil, fmt.Errorf("failed to parse tart list JSON output: %w", err)
+	}
+	states := make(map[string]string, len(tartVMs))
+	for _, tvm := range tartVMs {
+		states[tvm.Name] = strings.ToLower(tvm.State)
+	}
+	return states, nil
+}
+
+// GetVMState returns the state of a VM as reported by `tart list` (e.g., "running", "stopped"),
+// or an error wrapping ErrVMNotFound if tart doesn't list it.
+func (c *Commands) GetVMState(vmID string) (string, error) {
+	states, err := c.ListVMs()
+	if err != nil {
+		return "", err
+	}
+	state, ok := states[vmID]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrVMNotFound, vmID)
+	}
+	return state, nil
+}
+
+// RenameVM renames a VM with `tart rename`.
+func (c *Commands) RenameVM(vmID, newName string) error {
+	_, err := c.ExecuteCommand("tart", "rename", vmID, newName)
+	if err != nil {
+		return fmt.Errorf("failed to rename VM %s to %s using tart: %w", vmID, newName, err)
+	}
+	log.Printf("VM %s renamed to %s.", vmID, newName)
+	return nil
+}
+
+// StopVM stops a VM through the hypervisor with `tart stop`, without deleting it.
+func (c *Commands) StopVM(vmID string) error {
+	_, err := c.ExecuteCommand("tart", "stop", vmID)
+	if err != nil {
+		return fmt.Errorf("failed to stop VM %s using tart: %w", vmID, err)
+	}
+	log.Printf("VM %s stopped.", vmID)
 	return nil
 }
 
 // DeleteVM stops and deletes a virtual machine using `tart`.
-func DeleteVM(vmID string) error {
+func (c *Commands) DeleteVM(vmID string) error {
 	log.Printf("Deleting VM %s using tart...", vmID)
 	// Stop the VM first (tart stop is idempotent, won't error if not running)
-	_, err := ExecuteCommand("tart", "stop", vmID)
+	_, err := c.ExecuteCommand("tart", "stop", vmID)
 	if err != nil {
 		log.Printf("Warning: Failed to stop VM %s (might not be running or other error): %v", vmID, err)
 	}
 
 	// Delete the VM
-	_, err = ExecuteCommand("tart", "delete", vmID)
+	_, err = c.ExecuteCommand("tart", "delete", vmID)
 	if err != nil {
 		return fmt.Errorf("failed to delete VM %s using tart: %w", vmID, err)
 	}
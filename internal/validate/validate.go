@@ -0,0 +1,309 @@
+package validate
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/nodelabels"
+)
+
+// Limits on request fields.
+const (
+	maxLabels      = 32  // Runner labels per VM
+	maxLabelLength = 64  // Characters per runner label
+	maxTenantLen   = 128 // Characters in a tenant name
+	maxSelectors   = 32  // Node selector requirements, tolerations or image requirements per VM
+	maxNice        = 20  // Highest nice value of a VM's process
+)
+
+// Limits on the size of a VM.
+const (
+	maxCPUs     = 64        // Virtual CPUs per VM
+	minMemoryMB = 1024      // Memory per VM
+	maxMemoryMB = 512 << 10 // Memory per VM
+)
+
+// Limits on data disks.
+const (
+	maxDisks      = 8    // Data disks per VM
+	maxDiskSizeGB = 4096 // Size of a blank data disk or grown boot disk
+)
+
+var (
+	// vmIDPattern keeps VM IDs usable as a single path component and tart VM name.
+	vmIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+	// imageRequirementPattern matches image requirements such as "xcode>=15.2".
+	imageRequirementPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z-]{0,31}(>=|<=|==|!=|=|>|<)[A-Za-z0-9._-]{1,32}$`)
+	// imageNamePattern keeps image names usable as a cache file name and GCS object name.
+	imageNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:+-]{0,254}$`)
+	// interfacePattern matches BSD network interface names, e.g. en0 or bridge100.
+	interfacePattern = regexp.MustCompile(`^[a-z][a-z0-9]{0,14}$`)
+	// diskNamePattern keeps data disk names usable as a file name.
+	diskNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+	// displayPattern matches a display size such as "1920x1080".
+	displayPattern = regexp.MustCompile(`^[1-9][0-9]{2,4}x[1-9][0-9]{2,4}$`)
+	// profileNamePattern matches the names of VM profiles.
+	profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+	// guestJobPattern matches the "<run ID>/<job>" the guest helper reports for job events.
+	guestJobPattern = regexp.MustCompile(`^[A-Za-z0-9._/-]{1,200}$`)
+)
+
+// NetworkModes are the accepted VM network modes; "" means "nat".
+var NetworkModes = []string{"nat", "bridged", "softnet", "host-only"}
+
+// Workloads are the accepted CI agents installed in VMs; "" means "github".
+var Workloads = []string{"github", "buildkite", "gitlab"}
+
+// QoSClasses are the accepted QoS classes of a VM's CPU policy; "" means default.
+var QoSClasses = []string{models.VMQoSUtility, models.VMQoSBackground, models.VMQoSInteractive}
+
+// GuestEvents are the phases a guest helper can report.
+var GuestEvents = []string{models.GuestBootComplete, models.GuestRunnerRegistered, models.GuestJobStarted, models.GuestJobFinished}
+
+// Error is a validation failure of one request field. Code is a stable,
+// machine-readable identifier of the failure (e.g., "invalid_vm_id").
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// VMID checks that a VM ID is a safe, non-traversing path component.
+func VMID(vmID string) error {
+	if !vmIDPattern.MatchString(vmID) || strings.Contains(vmID, "..") {
+		return &Error{Code: "invalid_vm_id", Message: fmt.Sprintf("invalid vmId %q: expected 1-128 letters, digits, '.', '_' or '-', starting with a letter or digit", vmID)}
+	}
+	return nil
+}
+
+// ImageName checks that an image name contains no path separators.
+func ImageName(name string) error {
+	if !imageNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return &Error{Code: "invalid_image_name", Message: fmt.Sprintf("invalid imageName %q: expected letters, digits, '.', '_', ':', '+' or '-' without path separators", name)}
+	}
+	return nil
+}
+
+// Labels checks the number and length of runner labels.
+func Labels(labels []string) error {
+	if len(labels) > maxLabels {
+		return &Error{Code: "invalid_labels", Message: fmt.Sprintf("too many labels: %d, at most %d are allowed", len(labels), maxLabels)}
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > maxLabelLength || strings.ContainsAny(label, ", \t\r\n") {
+			return &Error{Code: "invalid_labels", Message: fmt.Sprintf("invalid label %q: expected 1-%d characters without commas or whitespace", label, maxLabelLength)}
+		}
+	}
+	return nil
+}
+
+// Workload checks that a requested CI agent is one the agent can install.
+func Workload(workload string) error {
+	if workload != "" && !slices.Contains(Workloads, workload) {
+		return &Error{Code: "invalid_workload", Message: fmt.Sprintf("invalid workload %q: expected one of %s", workload, strings.Join(Workloads, ", "))}
+	}
+	return nil
+}
+
+// Network checks a VM network mode and, for bridged networking, the host
+// interface to bridge onto, which only that mode takes.
+func Network(mode, iface string) error {
+	if mode != "" && !slices.Contains(NetworkModes, mode) {
+		return &Error{Code: "invalid_network_mode", Message: fmt.Sprintf("invalid networkMode %q: expected one of %s", mode, strings.Join(NetworkModes, ", "))}
+	}
+	if mode == "bridged" && iface == "" {
+		return &Error{Code: "invalid_network_interface", Message: "networkMode bridged requires networkInterface, e.g. en0"}
+	}
+	if mode != "bridged" && iface != "" {
+		return &Error{Code: "invalid_network_interface", Message: "networkInterface is only used with networkMode bridged"}
+	}
+	if iface != "" && !interfacePattern.MatchString(iface) {
+		return &Error{Code: "invalid_network_interface", Message: fmt.Sprintf("invalid networkInterface %q: expected an interface name such as en0", iface)}
+	}
+	return nil
+}
+
+// MACAddress checks that a requested MAC address, if any, is a unicast
+// Ethernet address.
+func MACAddress(address string) error {
+	if address == "" {
+		return nil
+	}
+	mac, err := net.ParseMAC(address)
+	if err != nil || len(mac) != 6 || mac[0]&0x01 != 0 {
+		return &Error{Code: "invalid_mac_address", Message: fmt.Sprintf("invalid macAddress %q: expected a unicast Ethernet address such as 02:00:00:aa:bb:cc", address)}
+	}
+	return nil
+}
+
+// CPUPolicy checks a VM's CPU policy, if any. Nice values only lower the
+// priority, so requests can't starve other VMs.
+func CPUPolicy(policy *models.VMCPUPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	if policy.Nice < 0 || policy.Nice > maxNice {
+		return &Error{Code: "invalid_cpu_policy", Message: fmt.Sprintf("invalid cpuPolicy.nice %d: expected 0 to %d", policy.Nice, maxNice)}
+	}
+	if policy.QoS != "" && !slices.Contains(QoSClasses, policy.QoS) {
+		return &Error{Code: "invalid_cpu_policy", Message: fmt.Sprintf("invalid cpuPolicy.qos %q: expected one of %s", policy.QoS, strings.Join(QoSClasses, ", "))}
+	}
+	if policy.QoS == models.VMQoSInteractive && policy.Nice > 0 {
+		return &Error{Code: "invalid_cpu_policy", Message: "cpuPolicy.qos interactive can't be combined with a nice value"}
+	}
+	return nil
+}
+
+// Hardware checks the CPUs, memory and display size of a VM, where 0 and ""
+// keep the image's.
+func Hardware(cpus, memoryMB int, display string) error {
+	if cpus < 0 || cpus > maxCPUs {
+		return &Error{Code: "invalid_cpus", Message: fmt.Sprintf("cpus must be between 1 and %d, or 0 for the image's", maxCPUs)}
+	}
+	if memoryMB != 0 && (memoryMB < minMemoryMB || memoryMB > maxMemoryMB) {
+		return &Error{Code: "invalid_memory", Message: fmt.Sprintf("memoryMb must be between %d and %d, or 0 for the image's", minMemoryMB, maxMemoryMB)}
+	}
+	if display != "" && !displayPattern.MatchString(display) {
+		return &Error{Code: "invalid_display", Message: fmt.Sprintf("invalid display %q: expected <width>x<height> in pixels, e.g. 1920x1080", display)}
+	}
+	return nil
+}
+
+// ProfileName checks the name of a VM profile.
+func ProfileName(name string) error {
+	if !profileNamePattern.MatchString(name) {
+		return &Error{Code: "invalid_profile", Message: fmt.Sprintf("invalid profile %q: expected 1-64 letters, digits, '.', '_' or '-', starting with a letter or digit", name)}
+	}
+	return nil
+}
+
+// ImageRequirements checks the syntax of a provision request's requirements
+// on the tools installed in its image.
+func ImageRequirements(requirements []string) error {
+	if len(requirements) > maxSelectors {
+		return &Error{Code: "invalid_image_requirements", Message: fmt.Sprintf("too many image requirements: %d, at most %d are allowed", len(requirements), maxSelectors)}
+	}
+	for _, requirement := range requirements {
+		if !imageRequirementPattern.MatchString(requirement) {
+			return &Error{Code: "invalid_image_requirements", Message: fmt.Sprintf("invalid image requirement %q: expected <name><operator><version>, e.g. xcode>=15.2", requirement)}
+		}
+	}
+	return nil
+}
+
+// NodeSelector checks the syntax of a provision request's node selector and
+// tolerations. Whether they match the node is checked by the agent.
+func NodeSelector(selector, tolerations []string) error {
+	if len(selector) > maxSelectors {
+		return &Error{Code: "invalid_node_selector", Message: fmt.Sprintf("too many node selector requirements: %d, at most %d are allowed", len(selector), maxSelectors)}
+	}
+	for _, req := range selector {
+		if err := nodelabels.ValidSelector(req); err != nil {
+			return &Error{Code: "invalid_node_selector", Message: err.Error()}
+		}
+	}
+	if len(tolerations) > maxSelectors {
+		return &Error{Code: "invalid_tolerations", Message: fmt.Sprintf("too many tolerations: %d, at most %d are allowed", len(tolerations), maxSelectors)}
+	}
+	for _, toleration := range tolerations {
+		if err := nodelabels.ValidToleration(toleration); err != nil {
+			return &Error{Code: "invalid_tolerations", Message: err.Error()}
+		}
+	}
+	return nil
+}
+
+// Disks checks a VM's data disks: each has a unique name and is either blank
+// with a size or cloned from an image.
+func Disks(disks []models.VMDisk) error {
+	if len(disks) > maxDisks {
+		return &Error{Code: "invalid_disk", Message: fmt.Sprintf("too many disks: %d, at most %d are allowed", len(disks), maxDisks)}
+	}
+	names := make(map[string]bool, len(disks))
+	for _, disk := range disks {
+		if !diskNamePattern.MatchString(disk.Name) {
+			return &Error{Code: "invalid_disk", Message: fmt.Sprintf("invalid disk name %q: expected 1-64 letters, digits, '_' or '-', starting with a letter or digit", disk.Name)}
+		}
+		if names[disk.Name] {
+			return &Error{Code: "invalid_disk", Message: fmt.Sprintf("duplicate disk name %q", disk.Name)}
+		}
+		names[disk.Name] = true
+		switch {
+		case disk.Image != "" && disk.SizeGB != 0:
+			return &Error{Code: "invalid_disk", Message: fmt.Sprintf("disk %q: sizeGb and image are mutually exclusive", disk.Name)}
+		case disk.Image != "":
+			if err := ImageName(disk.Image); err != nil {
+				return err
+			}
+		case disk.SizeGB < 1 || disk.SizeGB > maxDiskSizeGB:
+			return &Error{Code: "invalid_disk", Message: fmt.Sprintf("disk %q: sizeGb must be between 1 and %d, or an image must be given", disk.Name, maxDiskSizeGB)}
+		}
+	}
+	return nil
+}
+
+// GuestEvent checks an event reported by a guest helper.
+func GuestEvent(event models.GuestEvent) error {
+	if !slices.Contains(GuestEvents, event.Event) {
+		return &Error{Code: "invalid_guest_event", Message: fmt.Sprintf("invalid event %q: expected one of %s", event.Event, strings.Join(GuestEvents, ", "))}
+	}
+	if event.Job != "" && !guestJobPattern.MatchString(event.Job) {
+		return &Error{Code: "invalid_guest_event", Message: fmt.Sprintf("invalid job %q: expected <run ID>/<job>", event.Job)}
+	}
+	return nil
+}
+
+// ProvisionCommand checks the fields of a provision request that end up in
+// paths, commands or the runner configuration.
+func ProvisionCommand(cmd models.VMProvisionCommand) error {
+	if err := VMID(cmd.VMID); err != nil {
+		return err
+	}
+	if err := ImageName(cmd.ImageName); err != nil {
+		return err
+	}
+	if err := Labels(cmd.Labels); err != nil {
+		return err
+	}
+	if err := Workload(cmd.Workload); err != nil {
+		return err
+	}
+	if err := Network(cmd.NetworkMode, cmd.NetworkInterface); err != nil {
+		return err
+	}
+	if err := MACAddress(cmd.MACAddress); err != nil {
+		return err
+	}
+	if cmd.DiskSizeGB < 0 || cmd.DiskSizeGB > maxDiskSizeGB {
+		return &Error{Code: "invalid_disk_size", Message: fmt.Sprintf("diskSizeGb must be between 0 and %d", maxDiskSizeGB)}
+	}
+	if err := Disks(cmd.Disks); err != nil {
+		return err
+	}
+	if err := ImageRequirements(cmd.ImageRequirements); err != nil {
+		return err
+	}
+	if err := CPUPolicy(cmd.CPUPolicy); err != nil {
+		return err
+	}
+	if err := Hardware(cmd.CPUs, cmd.MemoryMB, cmd.Display); err != nil {
+		return err
+	}
+	if cmd.Profile != "" {
+		if err := ProfileName(cmd.Profile); err != nil {
+			return err
+		}
+	}
+	if err := NodeSelector(cmd.NodeSelector, cmd.Tolerations); err != nil {
+		return err
+	}
+	if len(cmd.Tenant) > maxTenantLen {
+		return &Error{Code: "invalid_tenant", Message: fmt.Sprintf("tenant is longer than %d characters", maxTenantLen)}
+	}
+	return nil
+}
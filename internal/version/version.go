@@ -0,0 +1,33 @@
+package version
+
+import "runtime/debug"
+
+// Version is the agent version, set at build time with
+// -ldflags "-X github.com/changty97/macvmagt/internal/version.Version=<version>".
+var Version = "dev"
+
+// APIVersions are the versions of the command API this agent serves, oldest
+// first. Each is served under /v<version>/; unversioned paths are aliases of
+// the oldest.
+var APIVersions = []string{"1"}
+
+// VCS returns the revision the binary was built from, its commit time and
+// whether the working tree had uncommitted changes, as recorded by the Go
+// toolchain. They are empty when the build had no VCS information.
+func VCS() (revision, time string, modified bool) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", "", false
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.time":
+			time = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	return revision, time, modified
+}
@@ -0,0 +1,263 @@
+package vmgr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/imagemgr"
+	"github.com/changty97/macvmagt/internal/machineid"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/operations"
+	"golang.org/x/sync/errgroup"
+)
+
+// vmConfig is the per-VM configuration written to the VM's config directory.
+type vmConfig struct {
+	VMID              string              `json:"vmId"`
+	ImageName         string              `json:"imageName"`
+	MachineIdentifier string              `json:"machineIdentifier"`       // Base64 binary plist holding the ECID
+	HardwareModel     string              `json:"hardwareModel,omitempty"` // Base64 hardware model the guest was installed on
+	Network           vmNetwork           `json:"network"`
+	Disks             []vmDisk            `json:"disks,omitempty"`      // Data disks attached besides the boot disk
+	CPUPolicy         *models.VMCPUPolicy `json:"cpuPolicy,omitempty"`  // Scheduling priority of the VM's process
+	CPUs              int                 `json:"cpus,omitempty"`       // Virtual CPUs; 0 keeps the image's
+	MemoryMB          int                 `json:"memoryMb,omitempty"`   // Memory; 0 keeps the image's
+	Display           string              `json:"display,omitempty"`    // Width x height in pixels; "" keeps the image's
+	Profile           string              `json:"profile,omitempty"`    // VM profile the VM was provisioned with
+	GuestToken        string              `json:"guestToken,omitempty"` // Authenticates the guest helper's events
+	Runner            *vmRunner           `json:"runner,omitempty"`     // The runner installed in the VM, once installation started
+	CreatedAt         time.Time           `json:"createdAt"`
+	BootedAt          time.Time           `json:"bootedAt,omitempty"` // When the VM answered over SSH or was adopted, for its runtime
+	ReadyAt           time.Time           `json:"readyAt,omitempty"`  // When the VM's provision succeeded
+}
+
+// vmDisk is a data disk in a VM's config. Its file is the layout's DataDiskPath.
+type vmDisk struct {
+	Name   string `json:"name"`
+	SizeGB int    `json:"sizeGb,omitempty"` // Size of a blank disk
+	Image  string `json:"image,omitempty"`  // Image the disk was cloned from
+}
+
+// cloneVM copies the base disk image, and its aux image if one is cached,
+// into the VM's directory and creates its data disks while generating the
+// machine identifier and writing the VM config. The steps are independent, so they run concurrently and each
+// one's duration is recorded on op. The copies are killed if ctx is done first.
+func (m *Manager) cloneVM(ctx context.Context, op *operations.Operation, cmd models.VMProvisionCommand, imagePath string) error {
+	vmID := cmd.VMID
+	var g errgroup.Group
+
+	g.Go(func() error {
+		return timeStep(op, "clone disk", func() error {
+			diskPath := m.paths.DiskPath(vmID)
+			log.Printf("Cloning image %s to %s for VM %s...", imagePath, diskPath, vmID)
+			cloned, err := m.copyImage(ctx, imagePath, diskPath)
+			if err != nil {
+				return fmt.Errorf("failed to clone VM disk image: %w", err)
+			}
+			if cloned {
+				m.imageManager.AddClone(cmd.ImageName, vmID)
+			}
+			return nil
+		})
+	})
+
+	auxPath := imagePath + imagemgr.AuxSuffix
+	if _, err := os.Stat(auxPath); err == nil {
+		g.Go(func() error {
+			return timeStep(op, "clone aux", func() error {
+				if _, err := m.copyImage(ctx, auxPath, filepath.Join(m.paths.AuxDir(vmID), "aux.img")); err != nil {
+					return fmt.Errorf("failed to clone VM aux image: %w", err)
+				}
+				return nil
+			})
+		})
+	}
+
+	for _, disk := range cmd.Disks {
+		g.Go(func() error {
+			return timeStep(op, "create disk "+disk.Name, func() error {
+				return m.createDataDisk(ctx, vmID, disk)
+			})
+		})
+	}
+
+	g.Go(func() error {
+		return timeStep(op, "write config", func() error {
+			return m.writeVMConfig(cmd)
+		})
+	})
+
+	if err := g.Wait(); err != nil {
+		m.paths.Remove(vmID) // Don't leave a partial clone behind
+		m.imageManager.RemoveClone(vmID)
+		return err
+	}
+	log.Printf("Image cloned for VM %s.", vmID)
+	return nil
+}
+
+// writeVMConfig generates a fresh machine identifier, MAC address and, with
+// guest events, guest token for the VM and writes its config file. The
+// hardware model comes from the request if it has one, and from the image's
+// cached hardware model otherwise; applyTartConfig boots the VM with both.
+func (m *Manager) writeVMConfig(cmd models.VMProvisionCommand) error {
+	vmID := cmd.VMID
+	identifier, err := machineid.Generate()
+	if err != nil {
+		return fmt.Errorf("failed to generate machine identifier for VM %s: %w", vmID, err)
+	}
+	network, err := newVMNetwork(m.cfg.NodeID, cmd)
+	if err != nil {
+		return fmt.Errorf("failed to configure network of VM %s: %w", vmID, err)
+	}
+	var guestToken string
+	if m.cfg.GuestEvents {
+		if guestToken, err = newGuestToken(); err != nil {
+			return err
+		}
+	}
+
+	hardwareModel := cmd.HardwareModel
+	if hardwareModel != "" {
+		if err := imagemgr.ValidateHardwareModel(hardwareModel); err != nil {
+			return fmt.Errorf("invalid hardware model for VM %s: %w", vmID, err)
+		}
+	} else {
+		hardwareModel, err = m.imageManager.HardwareModel(cmd.ImageName)
+		if err != nil {
+			return err
+		}
+		if hardwareModel == "" {
+			log.Printf("Warning: Image %s has no cached hardware model; VM %s keeps the one it was cloned with", cmd.ImageName, vmID)
+		}
+	}
+
+	var disks []vmDisk
+	for _, disk := range cmd.Disks {
+		disks = append(disks, vmDisk{Name: disk.Name, SizeGB: disk.SizeGB, Image: disk.Image})
+	}
+
+	return m.saveVMConfig(&vmConfig{
+		VMID:              vmID,
+		ImageName:         cmd.ImageName,
+		MachineIdentifier: identifier,
+		HardwareModel:     hardwareModel,
+		Network:           network,
+		Disks:             disks,
+		CPUPolicy:         cmd.CPUPolicy,
+		CPUs:              cmd.CPUs,
+		MemoryMB:          cmd.MemoryMB,
+		Display:           cmd.Display,
+		Profile:           cmd.Profile,
+		GuestToken:        guestToken,
+		CreatedAt:         time.Now(),
+	})
+}
+
+// createDataDisk creates one of a VM's data disks: a copy of its cached image,
+// or a blank sparse file of its size that only takes up space once written.
+func (m *Manager) createDataDisk(ctx context.Context, vmID string, disk models.VMDisk) error {
+	path := m.paths.DataDiskPath(vmID, disk.Name)
+	if disk.Image != "" {
+		imagePath, ok := m.imageManager.GetCachedImagePath(disk.Image)
+		if !ok {
+			return fmt.Errorf("image %s of disk %s is not cached", disk.Image, disk.Name)
+		}
+		log.Printf("Cloning image %s to disk %s of VM %s...", disk.Image, disk.Name, vmID)
+		cloned, err := m.copyImage(ctx, imagePath, path)
+		if err != nil {
+			return fmt.Errorf("failed to clone disk %s: %w", disk.Name, err)
+		}
+		if cloned {
+			m.imageManager.AddClone(disk.Image, vmID)
+		}
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create disk %s: %w", disk.Name, err)
+	}
+	defer f.Close()
+	if err := f.Truncate(int64(disk.SizeGB) << 30); err != nil {
+		return fmt.Errorf("failed to size disk %s to %d GB: %w", disk.Name, disk.SizeGB, err)
+	}
+	return nil
+}
+
+// saveVMConfig writes a VM's config file.
+func (m *Manager) saveVMConfig(config *vmConfig) error {
+	vmID := config.VMID
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config for VM %s: %w", vmID, err)
+	}
+
+	path := filepath.Join(m.paths.ConfigDir(vmID), "config.json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write config for VM %s: %w", vmID, err)
+	}
+	return nil
+}
+
+// Disk clone modes, see DiskCloneMode.
+const (
+	cloneModeAuto  = "auto"  // APFS clone where possible, else a full copy
+	cloneModeClone = "clone" // APFS clone only
+	cloneModeCopy  = "copy"  // Full copy only
+)
+
+// ValidateDiskCloneMode checks that the configured disk clone mode is known.
+func ValidateDiskCloneMode(mode string) error {
+	switch mode {
+	case cloneModeAuto, cloneModeClone, cloneModeCopy:
+		return nil
+	}
+	return fmt.Errorf("unknown disk clone mode '%s', expected auto, clone or copy", mode)
+}
+
+// copyImage gives a VM its own writable copy of a cached image. Unless
+// DiskCloneMode is "copy", it is an APFS clone (cp -c), which is instant and
+// shares the image's blocks until the VM writes to them. Where cloning isn't
+// possible, e.g. with the image cache and VMs on different volumes, "auto"
+// falls back to a full copy with cp, which preserves sparseness on APFS. It
+// reports whether the result is a clone.
+func (m *Manager) copyImage(ctx context.Context, src, dst string) (bool, error) {
+	if m.cfg.DiskCloneMode != cloneModeCopy {
+		_, err := m.commands.ExecuteCommandContext(ctx, "cp", "-c", src, dst)
+		if err == nil {
+			return true, makeWritable(dst)
+		}
+		if ctx.Err() != nil || m.cfg.DiskCloneMode == cloneModeClone {
+			return false, fmt.Errorf("failed to create APFS clone of %s: %w", src, err)
+		}
+		log.Printf("Warning: Could not create APFS clone of %s, copying it instead: %v", src, err)
+		os.Remove(dst)
+	}
+	if _, err := m.commands.ExecuteCommandContext(ctx, "cp", src, dst); err != nil { // Consider `hdiutil compact` for sparse images
+		return false, err
+	}
+	return false, makeWritable(dst)
+}
+
+// makeWritable lets a VM write its disk, which cp created with the mode of
+// the read-only cached image.
+func makeWritable(path string) error {
+	if err := os.Chmod(path, 0644); err != nil {
+		return fmt.Errorf("failed to make %s writable: %w", path, err)
+	}
+	return nil
+}
+
+// timeStep runs fn and records its duration on op as the named step.
+func timeStep(op *operations.Operation, name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	op.RecordStep(name, time.Since(start))
+	return err
+}
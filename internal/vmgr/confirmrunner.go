@@ -0,0 +1,175 @@
+package vmgr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// Runner confirmation modes, see RunnerConfirmation.
+const (
+	confirmOff    = "off"    // The install script exiting 0 and the runner verification suffice
+	confirmFile   = "file"   // The runner's .runner file must name it
+	confirmGitHub = "github" // GitHub must list the runner online with its labels
+)
+
+// runnerConfirmPollInterval is how often a new runner is looked for again,
+// in its .runner file or on GitHub.
+const runnerConfirmPollInterval = 5 * time.Second
+
+// utf8BOM prefixes the .runner file, which the runner writes from .NET.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// ValidateRunnerConfirmation checks that the configured runner confirmation mode is known.
+func ValidateRunnerConfirmation(mode string) error {
+	switch mode {
+	case confirmOff, confirmFile, confirmGitHub:
+		return nil
+	}
+	return fmt.Errorf("unknown runner confirmation '%s', expected off, file or github", mode)
+}
+
+// runnerFile is what config.sh, or run.sh for a JIT runner, writes to
+// .runner in the runner's directory once the runner is registered, as far as
+// confirming it goes.
+type runnerFile struct {
+	AgentID   int64  `json:"agentId"`
+	AgentName string `json:"agentName"`
+}
+
+// confirmRunner checks that the GitHub runner the install script set up
+// actually registered, as RunnerConfirmation says, rather than trusting the
+// script's exit status, and records how in the VM's config. Runners of other
+// workloads aren't checked.
+func (m *Manager) confirmRunner(ctx context.Context, cmd models.VMProvisionCommand, name string) error {
+	if m.cfg.RunnerConfirmation == confirmOff || profileFor(cmd.Workload).name != workloadGitHub {
+		return nil
+	}
+	var registration *models.RunnerRegistration
+	var err error
+	if m.cfg.RunnerConfirmation == confirmGitHub {
+		registration, err = m.confirmRunnerWithGitHub(ctx, cmd, name)
+	} else {
+		registration, err = m.confirmRunnerFile(ctx, cmd.VMID, name)
+	}
+	if err != nil {
+		return fmt.Errorf("runner %s is not registered: %w", name, err)
+	}
+	registration.ConfirmedAt = time.Now().UTC()
+
+	config, err := m.readVMConfig(cmd.VMID)
+	if err == nil && config.Runner != nil {
+		config.Runner.Registration = registration
+		err = m.saveVMConfig(config)
+	}
+	if err != nil {
+		log.Printf("Warning: Could not record the registration of runner %s on VM %s: %v", name, cmd.VMID, err)
+	}
+	return nil
+}
+
+// confirmRunnerFile waits up to RunnerConfirmTimeout for the .runner file
+// in the VM to name the runner. config.sh has written it by the time the
+// install script exits; run.sh writes a JIT runner's as it starts.
+func (m *Manager) confirmRunnerFile(ctx context.Context, vmID, name string) (*models.RunnerRegistration, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.cfg.RunnerConfirmTimeout)
+	defer cancel()
+	for {
+		registration, err := m.readRunnerFile(ctx, vmID, name)
+		if err == nil {
+			return registration, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w after %s", err, m.cfg.RunnerConfirmTimeout)
+		case <-time.After(runnerConfirmPollInterval):
+		}
+	}
+}
+
+// readRunnerFile reads the .runner file in the VM. It must name this runner,
+// so a file left in the image by another runner doesn't count.
+func (m *Manager) readRunnerFile(ctx context.Context, vmID, name string) (*models.RunnerRegistration, error) {
+	output, err := m.ssh.Client(vmID).Run(ctx, "cat "+shellQuote(runnerHome+"/.runner"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .runner: %w", err)
+	}
+	var file runnerFile
+	if err := json.Unmarshal(bytes.TrimPrefix([]byte(output), utf8BOM), &file); err != nil {
+		return nil, fmt.Errorf("failed to parse .runner: %w", err)
+	}
+	if file.AgentName != name || file.AgentID == 0 {
+		return nil, fmt.Errorf(".runner is of runner %q (ID %d)", file.AgentName, file.AgentID)
+	}
+	return &models.RunnerRegistration{Name: name, ID: file.AgentID, ConfirmedBy: confirmFile}, nil
+}
+
+// confirmRunnerWithGitHub waits up to RunnerConfirmTimeout for GitHub to list
+// the runner online with the request's labels. It authenticates with the
+// request's installation token, or else like runner deregistration.
+func (m *Manager) confirmRunnerWithGitHub(ctx context.Context, cmd models.VMProvisionCommand, name string) (*models.RunnerRegistration, error) {
+	token := cmd.InstallationToken
+	if token == "" {
+		var err error
+		if token, err = m.githubToken(ctx); err != nil {
+			return nil, err
+		}
+	}
+	labels := cmd.Labels
+	if len(labels) == 0 {
+		labels = defaultRunnerLabels
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.cfg.RunnerConfirmTimeout)
+	defer cancel()
+	for {
+		runner, err := m.github.FindRunner(ctx, token, cmd.GitHubOrg, cmd.GitHubRepo, name)
+		switch {
+		case err != nil:
+		case runner == nil:
+			err = fmt.Errorf("GitHub doesn't list it")
+		case runner.Status != "online":
+			err = fmt.Errorf("GitHub lists it as %s", runner.Status)
+		default:
+			// Labels are set at registration, so waiting won't add missing ones.
+			if missing := missingLabels(runner.Labels, labels); len(missing) > 0 {
+				return nil, fmt.Errorf("GitHub lists it without labels %s", strings.Join(missing, ", "))
+			}
+			return &models.RunnerRegistration{Name: name, ID: runner.ID, Status: runner.Status, Labels: runner.Labels, ConfirmedBy: confirmGitHub}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w after %s", err, m.cfg.RunnerConfirmTimeout)
+		case <-time.After(runnerConfirmPollInterval):
+		}
+	}
+}
+
+// missingLabels returns the labels of want that aren't in have. GitHub
+// compares labels regardless of case.
+func missingLabels(have, want []string) []string {
+	var missing []string
+	for _, label := range want {
+		if !slices.ContainsFunc(have, func(h string) bool { return strings.EqualFold(h, label) }) {
+			missing = append(missing, label)
+		}
+	}
+	return missing
+}
+
+// RunnerRegistration returns how the runner of a VM was confirmed
+// registered, or nil if it wasn't checked.
+func (m *Manager) RunnerRegistration(vmID string) *models.RunnerRegistration {
+	config, err := m.readVMConfig(vmID)
+	if err != nil || config.Runner == nil {
+		return nil
+	}
+	return config.Runner.Registration
+}
@@ -0,0 +1,72 @@
+package vmgr
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// vmRunner is the GitHub runner installed in a VM, kept in its config so the
+// runner can be deregistered when the VM is deleted.
+type vmRunner struct {
+	Name string `json:"name"`
+	Org  string `json:"org"`
+	Repo string `json:"repo,omitempty"` // Empty for an organization-level runner
+	// Ephemeral runners take one job, after which the agent deletes the VM.
+	Ephemeral bool   `json:"ephemeral,omitempty"`
+	Workload  string `json:"workload,omitempty"` // CI agent of the runner; empty for GitHub Actions
+	// How the runner was confirmed registered once installed; nil if it wasn't checked.
+	Registration *models.RunnerRegistration `json:"registration,omitempty"`
+}
+
+// recordRunner adds the runner about to be installed to a VM's config. It is
+// recorded before installation, since a failed attempt may still have
+// registered the runner. The VM profile is recorded along with it, since a
+// standby VM adopted from the warm pool was created without one.
+func (m *Manager) recordRunner(cmd models.VMProvisionCommand, name string) {
+	config, err := m.readVMConfig(cmd.VMID)
+	if err == nil {
+		config.Runner = &vmRunner{Name: name, Org: cmd.GitHubOrg, Repo: cmd.GitHubRepo, Ephemeral: cmd.Ephemeral, Workload: cmd.Workload}
+		config.Profile = cmd.Profile
+		err = m.saveVMConfig(config)
+	}
+	if err != nil {
+		log.Printf("Warning: Could not record runner of VM %s, it won't be deregistered on delete: %v", cmd.VMID, err)
+	}
+}
+
+// deregisterRunner removes a deleted VM's runner from GitHub, so it isn't
+// left listed as offline. It authenticates with the token in the
+// GitHubTokenSecret secret, or else an installation token of the GitHub App.
+func (m *Manager) deregisterRunner(ctx context.Context, runner *vmRunner) error {
+	if profileFor(runner.Workload).name != workloadGitHub {
+		return nil // Buildkite agents disconnect themselves; GitLab runners are managed in GitLab
+	}
+	if runner.Org == "" {
+		return fmt.Errorf("runner %s has no GitHub organization", runner.Name)
+	}
+	token, err := m.githubToken(ctx)
+	if err != nil {
+		return err
+	}
+	if err := m.github.DeleteRunner(ctx, token, runner.Org, runner.Repo, runner.Name); err != nil {
+		return err
+	}
+	log.Printf("Runner '%s' deregistered from GitHub.", runner.Name)
+	return nil
+}
+
+// githubToken returns the token in the GitHubTokenSecret secret, or "" to
+// have the GitHub client mint an installation token of the GitHub App.
+func (m *Manager) githubToken(ctx context.Context) (string, error) {
+	if m.cfg.GitHubTokenSecret == "" {
+		return "", nil
+	}
+	token, err := m.secrets.GetSecret(ctx, m.cfg.GitHubTokenSecret)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch GitHub token: %w", err)
+	}
+	return token, nil
+}
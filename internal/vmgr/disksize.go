@@ -0,0 +1,54 @@
+package vmgr
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// resizeVolumeScript grows the guest's APFS container into the free space
+// behind it after the disk image was enlarged. repairDisk first moves the
+// GPT backup header to the new end of the disk, and asks for confirmation.
+const resizeVolumeScript = `set -e
+yes | sudo diskutil repairDisk disk0 >/dev/null 2>&1 || true
+container=$(diskutil list physical disk0 | awk '/Apple_APFS / {print $NF; exit}')
+if [ -z "$container" ]; then
+  echo "no APFS container found on disk0" >&2
+  exit 1
+fi
+sudo diskutil apfs resizeContainer "$container" 0
+`
+
+// growDisk enlarges a cloned disk image to sizeGB. The added space is sparse,
+// so it takes up no host space until the guest writes to it. Disks are never
+// shrunk, since that would cut off the guest's volume.
+func growDisk(path string, sizeGB int) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to check disk image %s: %w", path, err)
+	}
+	size := int64(sizeGB) << 30
+	if size < info.Size() {
+		return fmt.Errorf("requested disk size of %d GB is smaller than the image's %d GB", sizeGB, info.Size()>>30)
+	}
+	if size == info.Size() {
+		return nil
+	}
+	if err := os.Truncate(path, size); err != nil {
+		return fmt.Errorf("failed to grow disk image %s to %d GB: %w", path, sizeGB, err)
+	}
+	return nil
+}
+
+// resizeGuestVolume has the guest take up the space added by growDisk.
+func (m *Manager) resizeGuestVolume(ctx context.Context, vmID string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.cfg.ProvisionStepTimeout)
+	defer cancel()
+	log.Printf("Resizing the APFS container of VM %s to fill its disk...", vmID)
+	if _, err := m.ssh.Client(vmID).Run(ctx, "bash -s", strings.NewReader(resizeVolumeScript)); err != nil {
+		return fmt.Errorf("failed to resize guest volume: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package vmgr
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/imagemgr"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/paths"
+	"github.com/changty97/macvmagt/internal/utils"
+	"github.com/changty97/macvmagt/internal/validate"
+	"github.com/changty97/macvmagt/internal/vmprofiles"
+)
+
+// Placeholder values substituted for secrets in dry-run output, so nothing is
+// fetched from the secrets provider and no JIT runner is registered with GitHub.
+const (
+	dryRunToken      = "DRY-RUN-REGISTRATION-TOKEN"
+	dryRunJITConfig  = "DRY-RUN-JIT-CONFIG"
+	dryRunGuestToken = "DRY-RUN-GUEST-TOKEN"
+
+	// dryRunMachineIdentifier stands in for the machine identifier each
+	// provision generates afresh.
+	dryRunMachineIdentifier = "DRY-RUN-MACHINE-IDENTIFIER"
+)
+
+// placeholderMarkers flag template output that still contains unrendered or
+// example values and would break a real provision.
+var placeholderMarkers = []string{
+	"<no value>",
+	"{{",
+	"YOUR_",
+	"your-github-",
+	"REPLACE THIS",
+}
+
+// dryRunConfigArtifact names the VM config among the dry-run artifacts by
+// where a provision writes it in the VM's directory.
+const dryRunConfigArtifact = "config/config.json"
+
+// dryRunVMConfig renders the config a provision of cmd would write to the
+// VM's config/config.json, with the machine identifier, which each
+// provision generates afresh, and the guest token as placeholders. The
+// hardware model is the request's; the image's cached one isn't looked up.
+func dryRunVMConfig(cfg *config.Config, cmd models.VMProvisionCommand, guestToken string) ([]byte, error) {
+	network, err := newVMNetwork(cfg.NodeID, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure network of VM %s: %w", cmd.VMID, err)
+	}
+	var disks []vmDisk
+	for _, disk := range cmd.Disks {
+		disks = append(disks, vmDisk{Name: disk.Name, SizeGB: disk.SizeGB, Image: disk.Image})
+	}
+	data, err := json.MarshalIndent(&vmConfig{
+		VMID:              cmd.VMID,
+		ImageName:         cmd.ImageName,
+		MachineIdentifier: dryRunMachineIdentifier,
+		HardwareModel:     cmd.HardwareModel,
+		Network:           network,
+		Disks:             disks,
+		CPUPolicy:         cmd.CPUPolicy,
+		CPUs:              cmd.CPUs,
+		MemoryMB:          cmd.MemoryMB,
+		Display:           cmd.Display,
+		Profile:           cmd.Profile,
+		GuestToken:        guestToken,
+		CreatedAt:         time.Now(),
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to render config of VM %s: %w", cmd.VMID, err)
+	}
+	return data, nil
+}
+
+// RenderDryRun renders every provisioning artifact for cmd without touching
+// the image cache, secrets or any VM. Template errors are returned as errors;
+// suspicious output is reported as warnings. cmd is completed from its VM
+// profile in profiles first, like a provision request.
+func RenderDryRun(cfg *config.Config, profiles *vmprofiles.Set, cmd models.VMProvisionCommand) (*models.DryRunResult, error) {
+	if err := profiles.Apply(&cmd); err != nil {
+		return nil, err
+	}
+	if err := validate.ProvisionCommand(cmd); err != nil {
+		return nil, err
+	}
+	name := runnerName(cfg, cmd.VMID)
+	data, labels, err := newRunnerScriptData(cfg, cmd, name)
+	if err != nil {
+		return nil, err
+	}
+	profile := profileFor(cmd.Workload)
+	registration := "token"
+	if profile.name == workloadGitHub && usesJIT(cfg) {
+		registration = "jit"
+		data.JITConfig = dryRunJITConfig
+	} else {
+		data.Token = dryRunToken
+	}
+	if cfg.GuestEvents {
+		data.GuestEventsURL = guestEventsURL(cfg.GuestAgentURL, cmd.VMID)
+		data.GuestToken = dryRunGuestToken
+	}
+
+	scriptPath := runnerScriptPath(cfg, profiles, cmd)
+	script, err := executeRunnerScript(scriptPath, data)
+	if err != nil {
+		return nil, err
+	}
+
+	runArgs := utils.TartNetworkArgs(cmd.NetworkMode, cmd.NetworkInterface)
+	layout := paths.New(cfg.VMsDir)
+	for _, disk := range cmd.Disks {
+		runArgs = append(runArgs, "--disk="+layout.DataDiskPath(cmd.VMID, disk.Name))
+	}
+
+	config, err := dryRunVMConfig(cfg, cmd, data.GuestToken)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := json.MarshalIndent(map[string]interface{}{
+		"vmId":               cmd.VMID,
+		"imageName":          cmd.ImageName,
+		"workload":           profile.name,
+		"profile":            cmd.Profile,
+		"cpus":               cmd.CPUs,
+		"memoryMb":           cmd.MemoryMB,
+		"display":            cmd.Display,
+		"runnerName":         name,
+		"labels":             labels,
+		"runnerRegistration": registration,
+		"sshUser":            cfg.VMSSHUser,
+		"networkMode":        cmp.Or(cmd.NetworkMode, defaultNetworkMode),
+		"tartRunArgs":        runArgs,
+		"launchCommand":      utils.VMLaunch{Args: runArgs, CPU: cmd.CPUPolicy}.Command(cmd.VMID),
+		"diskSizeGb":         cmd.DiskSizeGB,
+		"disks":              cmd.Disks,
+		"guestEvents":        cfg.GuestEvents,
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to render provision spec: %w", err)
+	}
+
+	if err := validateGuestUsers(cmd.Users); err != nil {
+		return nil, err
+	}
+	if cmd.HardwareModel != "" {
+		if err := imagemgr.ValidateHardwareModel(cmd.HardwareModel); err != nil {
+			return nil, err
+		}
+	}
+	for i, step := range cmd.Steps {
+		if _, err := interpreterCommand(step.Interpreter); err != nil {
+			return nil, fmt.Errorf("step %s: %w", stepName(i, step), err)
+		}
+	}
+
+	result := &models.DryRunResult{
+		VMID:      cmd.VMID,
+		ImageName: cmd.ImageName,
+		Artifacts: map[string]string{
+			filepath.Base(scriptPath): string(script),
+			dryRunConfigArtifact:      string(config),
+			"provision.json":          string(spec),
+		},
+	}
+	if len(cmd.Users) > 0 {
+		passwords := make(map[string]string, len(cmd.Users))
+		for _, user := range cmd.Users {
+			passwords[user.Username] = dryRunPassword
+		}
+		result.Artifacts["guest-users.sh"] = guestUsersScript(cmd.Users, passwords)
+	}
+	for i, step := range cmd.Steps {
+		result.Artifacts["step-"+stepName(i, step)] = step.Script
+	}
+	for _, secret := range []string{dryRunToken, dryRunJITConfig, dryRunGuestToken} {
+		if strings.Contains(string(script), secret) {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s writes secrets into the script file it is uploaded as; read them from $%s, $%s and $%s instead", filepath.Base(scriptPath), envRunnerToken, envJITConfig, envGuestToken))
+			break
+		}
+	}
+	for artifact, content := range result.Artifacts {
+		for _, marker := range placeholderMarkers {
+			if strings.Contains(content, marker) {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("%s contains placeholder text %q", artifact, marker))
+			}
+		}
+	}
+	return result, nil
+}
+
+// DryRun renders the provisioning artifacts for cmd and reports whether its
+// image is already cached on this node. No VM is created.
+func (m *Manager) DryRun(cmd models.VMProvisionCommand) (*models.DryRunResult, error) {
+	result, err := RenderDryRun(m.cfg, m.profiles, cmd)
+	if err != nil {
+		return nil, err
+	}
+	result.ImagePath, result.ImageCached = m.imageManager.GetCachedImagePath(cmd.ImageName)
+	if !result.ImageCached {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("image %s is not cached and would be downloaded first", cmd.ImageName))
+	}
+	return result, nil
+}
@@ -0,0 +1,81 @@
+package vmgr
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// runnerExitedMarker is printed by runnerExitedCommand once the runner process is gone.
+const runnerExitedMarker = "runner-exited"
+
+// runnerExitedCommand checks for the process of a workload's CI agent without
+// failing when it's gone, so a failed SSH connection isn't mistaken for an
+// exited runner.
+func runnerExitedCommand(profile workloadProfile) string {
+	return fmt.Sprintf("pgrep -f %s >/dev/null || echo %s", shellQuote(profile.process), runnerExitedMarker)
+}
+
+// IsEphemeral reports whether a VM that finished provisioning has a runner
+// requested as ephemeral, so the VM is deleted once the runner finished its
+// job. A VM whose job finishes while it's still provisioning is deleted once
+// the provision is done.
+func (m *Manager) IsEphemeral(vmID string) bool {
+	if m.provisioning(vmID) {
+		return false
+	}
+	config, err := m.readVMConfig(vmID)
+	return err == nil && config.Runner != nil && config.Runner.Ephemeral
+}
+
+// EphemeralVMs returns the VMs with an ephemeral runner that finished provisioning.
+func (m *Manager) EphemeralVMs() []string {
+	vmIDs, err := m.paths.List()
+	if err != nil {
+		log.Printf("Warning: Could not list VMs for ephemeral runners: %v", err)
+		return nil
+	}
+	var ephemeral []string
+	for _, vmID := range vmIDs {
+		if IsStandby(vmID) || !m.IsEphemeral(vmID) {
+			continue
+		}
+		ephemeral = append(ephemeral, vmID)
+	}
+	return ephemeral
+}
+
+// provisioning reports whether a VM has a provision in flight.
+func (m *Manager) provisioning(vmID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.provisions[vmID]
+	return ok
+}
+
+// JobFinished reports whether the runner of a running VM finished its job.
+// With guest events, the guest helper reports it; otherwise, or when the
+// agent restarted since the VM's last event, the runner process is looked
+// for over SSH, since an ephemeral runner exits after its job. Suspended or
+// stopped VMs are never finished.
+func (m *Manager) JobFinished(ctx context.Context, vmID string) bool {
+	if status := m.GuestStatus(vmID); status != nil {
+		return status.Phase == models.GuestJobFinished
+	}
+	if state, err := m.commands.GetVMState(vmID); err != nil || state != "running" {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	output, err := m.ssh.Client(vmID).Run(ctx, runnerExitedCommand(m.workloadOf(vmID)), nil)
+	if err != nil {
+		log.Printf("Warning: Could not check the runner of VM %s: %v", vmID, err)
+		return false
+	}
+	return strings.Contains(output, runnerExitedMarker)
+}
@@ -0,0 +1,24 @@
+package vmgr
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Exec runs an ad-hoc command inside a VM, streaming its output to stdout and
+// stderr, and returns the command's exit code. A non-zero exit code is not an
+// error; err is only set when the command could not be run to completion.
+func (m *Manager) Exec(ctx context.Context, vmID, command string, stdout, stderr io.Writer) (int, error) {
+	err := m.ssh.Client(vmID).Stream(ctx, command, nil, stdout, stderr)
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
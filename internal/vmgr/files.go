@@ -0,0 +1,27 @@
+package vmgr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// UploadFile writes src to an absolute path inside a running VM over SFTP,
+// e.g. to inject certificates or provisioning profiles before a job.
+func (m *Manager) UploadFile(ctx context.Context, vmID, remotePath string, src io.Reader, mode os.FileMode) error {
+	if !path.IsAbs(remotePath) {
+		return fmt.Errorf("guest path %q must be absolute", remotePath)
+	}
+	return m.ssh.Client(vmID).Upload(ctx, src, path.Clean(remotePath), mode)
+}
+
+// DownloadFile copies an absolute path from inside a running VM to dst over
+// SFTP, e.g. to retrieve crash logs after a job.
+func (m *Manager) DownloadFile(ctx context.Context, vmID, remotePath string, dst io.Writer) error {
+	if !path.IsAbs(remotePath) {
+		return fmt.Errorf("guest path %q must be absolute", remotePath)
+	}
+	return m.ssh.Client(vmID).Download(ctx, path.Clean(remotePath), dst)
+}
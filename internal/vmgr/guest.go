@@ -0,0 +1,104 @@
+package vmgr
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// guestPollInterval is how often provisioning checks for a guest event it waits on.
+const guestPollInterval = time.Second
+
+// newGuestToken returns a random token the guest helper of a VM
+// authenticates its events with.
+func newGuestToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", fmt.Errorf("failed to generate guest token: %w", err)
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// guestEventsURL returns the URL the guest helper of a VM posts its events to.
+func guestEventsURL(agentURL, vmID string) string {
+	return fmt.Sprintf("%s/v1/vms/%s/guest-events", strings.TrimSuffix(agentURL, "/"), vmID)
+}
+
+// SetAgentPublicKeyPin makes guest helpers verify the agent's HTTPS
+// certificate by its public key pin rather than a CA, which a self-signed
+// certificate has none of. The agent loads the certificate, so it provides pin.
+func (m *Manager) SetAgentPublicKeyPin(pin string) {
+	m.agentPin = pin
+}
+
+// CheckGuestToken reports whether token is the guest token of a VM.
+func (m *Manager) CheckGuestToken(vmID, token string) bool {
+	config, err := m.readVMConfig(vmID)
+	if err != nil || config.GuestToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(config.GuestToken), []byte(token)) == 1
+}
+
+// RecordGuestEvent records a phase reported by a VM's guest helper.
+func (m *Manager) RecordGuestEvent(vmID string, event models.GuestEvent) {
+	log.Printf("VM %s reported %s %s", vmID, event.Event, event.Job)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.guest[vmID] = &models.GuestStatus{Phase: event.Event, Job: event.Job, UpdatedAt: time.Now()}
+}
+
+// GuestStatus returns the last phase a VM's guest helper reported, or nil if
+// it hasn't reported any.
+func (m *Manager) GuestStatus(vmID string) *models.GuestStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if status := m.guest[vmID]; status != nil {
+		copied := *status
+		return &copied
+	}
+	return nil
+}
+
+// RunningJobs reports whether the guest helper of any VM last reported that a
+// job started.
+func (m *Manager) RunningJobs() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, status := range m.guest {
+		if status.Phase == models.GuestJobStarted {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) clearGuestStatus(vmID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.guest, vmID)
+}
+
+// waitForRunnerRegistered waits until the guest helper of a VM reports that
+// the runner is registered, or a job phase that follows it, or until ctx is done.
+func (m *Manager) waitForRunnerRegistered(ctx context.Context, vmID string) error {
+	ticker := time.NewTicker(guestPollInterval)
+	defer ticker.Stop()
+	for {
+		if status := m.GuestStatus(vmID); status != nil && status.Phase != models.GuestBootComplete {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("VM %s did not report runner registration: %w", vmID, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package vmgr
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/sshclient"
+)
+
+// healthCheckTimeout bounds each check of a health check battery.
+const healthCheckTimeout = 30 * time.Second
+
+// healthChecks are the checks a health check battery can include, by name.
+var healthChecks = map[string]func(m *Manager, ctx context.Context, client *sshclient.Client) (string, error){
+	"ssh":    (*Manager).checkSSH,
+	"disk":   (*Manager).checkGuestDisk,
+	"runner": (*Manager).checkRunner,
+	"clock":  (*Manager).checkClockSkew,
+}
+
+// ValidateHealthChecks checks that every configured health check is known.
+func ValidateHealthChecks(names []string) error {
+	for _, name := range names {
+		if _, ok := healthChecks[name]; !ok {
+			return fmt.Errorf("unknown health check '%s', expected ssh, disk, runner or clock", name)
+		}
+	}
+	return nil
+}
+
+// HealthCheck runs the configured battery of checks against a running VM and
+// reports each result. The VM is healthy only if every check passes. Checks
+// run in order and all of them run, even after a failure.
+func (m *Manager) HealthCheck(ctx context.Context, vmID string) *models.HealthReport {
+	client := m.ssh.Client(vmID)
+	report := &models.HealthReport{
+		VMID:      vmID,
+		Healthy:   true,
+		CheckedAt: time.Now().UTC(),
+		Checks:    make([]models.HealthCheckResult, 0, len(m.cfg.HealthChecks)),
+	}
+
+	for _, name := range m.cfg.HealthChecks {
+		checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		start := time.Now()
+		detail, err := healthChecks[name](m, checkCtx, client)
+		cancel()
+
+		result := models.HealthCheckResult{
+			Name:       name,
+			Healthy:    err == nil,
+			Detail:     detail,
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			result.Error = err.Error()
+			report.Healthy = false
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	return report
+}
+
+// checkSSH verifies a command round-trips over SSH.
+func (m *Manager) checkSSH(ctx context.Context, client *sshclient.Client) (string, error) {
+	output, err := client.Run(ctx, "echo ok", nil)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(output) != "ok" {
+		return "", fmt.Errorf("unexpected echo output: %q", strings.TrimSpace(output))
+	}
+	return "", nil
+}
+
+// checkGuestDisk verifies the guest's root volume has HealthCheckMinFreeDisk free.
+func (m *Manager) checkGuestDisk(ctx context.Context, client *sshclient.Client) (string, error) {
+	output, err := client.Run(ctx, "df -Pk /", nil)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 4 {
+		return "", fmt.Errorf("unexpected df output: %q", strings.TrimSpace(output))
+	}
+	availableKB, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("unexpected df output: %q", strings.TrimSpace(output))
+	}
+
+	available := availableKB * 1024
+	detail := fmt.Sprintf("%d bytes free", available)
+	if available < m.cfg.HealthCheckMinFreeDisk {
+		return detail, fmt.Errorf("only %d bytes free on /, need %d", available, m.cfg.HealthCheckMinFreeDisk)
+	}
+	return detail, nil
+}
+
+// checkRunner verifies the GitHub runner service is up.
+func (m *Manager) checkRunner(ctx context.Context, client *sshclient.Client) (string, error) {
+	return "", m.verifyRunner(ctx, client)
+}
+
+// checkClockSkew compares the guest clock with the host's, allowing for the
+// round trip of the query.
+func (m *Manager) checkClockSkew(ctx context.Context, client *sshclient.Client) (string, error) {
+	before := time.Now()
+	output, err := client.Run(ctx, "date +%s", nil)
+	if err != nil {
+		return "", err
+	}
+	after := time.Now()
+
+	guestSeconds, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("unexpected date output: %q", strings.TrimSpace(output))
+	}
+	// The guest read its clock somewhere in [before, after]; compare with the
+	// midpoint and forgive the second-resolution truncation of date +%s.
+	hostTime := before.Add(after.Sub(before) / 2)
+	skew := time.Unix(guestSeconds, 0).Sub(hostTime)
+	if skew < 0 {
+		skew = -skew
+	}
+	skew = max(skew-time.Second, 0)
+
+	detail := fmt.Sprintf("skew %s", skew.Round(time.Millisecond))
+	if skew > m.cfg.HealthCheckMaxClockSkew {
+		return detail, fmt.Errorf("guest clock is off by %s, more than %s", skew.Round(time.Millisecond), m.cfg.HealthCheckMaxClockSkew)
+	}
+	return detail, nil
+}
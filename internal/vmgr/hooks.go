@@ -0,0 +1,120 @@
+package vmgr
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// Hook points, named after the executables run for them in HooksDir.
+const (
+	hookPreProvision  = "pre-provision"
+	hookPostProvision = "post-provision"
+	hookPreDelete     = "pre-delete"
+	hookPostDelete    = "post-delete"
+)
+
+// runHook runs the executable for a hook point from HooksDir, if there is
+// one, with the VM's metadata in its environment: the MACVMAGT_* variables
+// from env plus MACVMAGT_HOOK, MACVMAGT_NODE_ID and MACVMAGT_VM_ID. It is
+// killed after HookTimeout or once ctx is done, and fails if it exits non-zero.
+func (m *Manager) runHook(ctx context.Context, hook, vmID string, env []string) error {
+	if m.cfg.HooksDir == "" {
+		return nil
+	}
+	path := filepath.Join(m.cfg.HooksDir, hook)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check %s hook %s: %w", hook, path, err)
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		log.Printf("Warning: Skipping %s hook %s: not an executable file", hook, path)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.cfg.HookTimeout)
+	defer cancel()
+	cmd := utils.CommandContext(ctx, path)
+	cmd.Env = append(os.Environ(),
+		"MACVMAGT_HOOK="+hook,
+		"MACVMAGT_NODE_ID="+m.cfg.NodeID,
+		"MACVMAGT_VM_ID="+vmID,
+	)
+	cmd.Env = append(cmd.Env, env...)
+	log.Printf("Running %s hook for VM %s", hook, vmID)
+	output, err := cmd.CombinedOutput()
+	if out := strings.TrimSpace(string(output)); out != "" {
+		log.Printf("%s hook for VM %s: %s", hook, vmID, out)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s hook for VM %s did not finish: %w", hook, vmID, ctx.Err())
+		}
+		return fmt.Errorf("%s hook for VM %s failed: %w", hook, vmID, err)
+	}
+	return nil
+}
+
+// provisionHookEnv returns the hook environment describing a provision request.
+func provisionHookEnv(cmd models.VMProvisionCommand) []string {
+	mode := cmd.NetworkMode
+	if mode == "" {
+		mode = defaultNetworkMode
+	}
+	tenant := cmd.Tenant
+	if tenant == "" {
+		tenant = cmd.GitHubOrg
+	}
+	return []string{
+		"MACVMAGT_IMAGE=" + cmd.ImageName,
+		"MACVMAGT_GITHUB_ORG=" + cmd.GitHubOrg,
+		"MACVMAGT_GITHUB_REPO=" + cmd.GitHubRepo,
+		"MACVMAGT_RUNNER_LABELS=" + strings.Join(cmd.Labels, ","),
+		"MACVMAGT_TENANT=" + tenant,
+		"MACVMAGT_NETWORK_MODE=" + mode,
+		"MACVMAGT_PROFILE=" + cmd.Profile,
+	}
+}
+
+// vmHookEnv returns the hook environment describing an existing VM from its
+// config, or nothing for VMs the agent has no config for.
+func (m *Manager) vmHookEnv(vmID string) []string {
+	config, err := m.readVMConfig(vmID)
+	if err != nil {
+		return nil
+	}
+	return []string{
+		"MACVMAGT_IMAGE=" + config.ImageName,
+		"MACVMAGT_NETWORK_MODE=" + config.Network.Type,
+		"MACVMAGT_MAC_ADDRESS=" + config.Network.MACAddress,
+	}
+}
+
+// postProvisionHookEnv adds the outcome of a provision to its hook
+// environment, and the VM's address if it was provisioned.
+func (m *Manager) postProvisionHookEnv(cmd models.VMProvisionCommand, provisionErr error) []string {
+	env := provisionHookEnv(cmd)
+	if provisionErr != nil {
+		env = append(env, "MACVMAGT_RESULT=failure", "MACVMAGT_ERROR="+provisionErr.Error())
+		if stage := TimedOutStage(provisionErr); stage != "" {
+			env = append(env, "MACVMAGT_TIMED_OUT_STAGE="+stage)
+		}
+		return env
+	}
+	env = append(env, "MACVMAGT_RESULT=success")
+	_, mac := m.Network(cmd.VMID)
+	env = append(env, "MACVMAGT_MAC_ADDRESS="+mac)
+	if ip, err := m.IPAddress(cmd.VMID); err == nil {
+		env = append(env, "MACVMAGT_VM_IP="+ip)
+	}
+	return env
+}
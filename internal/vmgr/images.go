@@ -0,0 +1,44 @@
+package vmgr
+
+import (
+	"log"
+	"slices"
+	"sort"
+)
+
+// VMsUsingImage returns the VMs that are created, or being provisioned, from
+// a cached image, for their boot disk or a data disk, so it isn't evicted
+// from under them.
+func (m *Manager) VMsUsingImage(imageName string) []string {
+	users := make(map[string]bool)
+	m.mu.Lock()
+	for vmID, provision := range m.provisions {
+		if slices.Contains(provision.images, imageName) {
+			users[vmID] = true
+		}
+	}
+	m.mu.Unlock()
+
+	vmIDs, err := m.paths.List()
+	if err != nil {
+		log.Printf("Warning: Could not list VMs using image %s: %v", imageName, err)
+	}
+	for _, vmID := range vmIDs {
+		if config, err := m.readVMConfig(vmID); err == nil && config.usesImage(imageName) {
+			users[vmID] = true
+		}
+	}
+
+	using := make([]string, 0, len(users))
+	for vmID := range users {
+		using = append(using, vmID)
+	}
+	sort.Strings(using)
+	return using
+}
+
+// usesImage reports whether the VM's boot disk or one of its data disks was
+// cloned from imageName.
+func (c *vmConfig) usesImage(imageName string) bool {
+	return c.ImageName == imageName || slices.ContainsFunc(c.Disks, func(disk vmDisk) bool { return disk.Image == imageName })
+}
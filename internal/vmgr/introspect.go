@@ -0,0 +1,67 @@
+package vmgr
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// introspectScript prints the macOS version and build of the guest, then the
+// version and SDKs of every Xcode in /Applications, one "<kind> <value>" per line.
+const introspectScript = `
+echo "macos $(sw_vers -productVersion)"
+echo "build $(sw_vers -buildVersion)"
+for app in /Applications/Xcode*.app; do
+  [ -d "$app" ] || continue
+  echo "xcode $(defaults read "$app/Contents/Info" CFBundleShortVersionString 2>/dev/null)"
+  DEVELOPER_DIR="$app/Contents/Developer" xcodebuild -showsdks 2>/dev/null | sed -n 's/.*-sdk \([a-z]*[0-9][0-9.]*\).*/sdk \1/p'
+done
+exit 0
+`
+
+// inspectTools finds the macOS build, Xcode versions and SDKs installed in a
+// booted VM.
+func (m *Manager) inspectTools(ctx context.Context, vmID string) (*models.ImageTools, error) {
+	command, err := interpreterCommand("")
+	if err != nil {
+		return nil, err
+	}
+	output, err := m.ssh.Client(vmID).Run(ctx, command, strings.NewReader(introspectScript))
+	if err != nil {
+		return nil, fmt.Errorf("introspection script failed: %w", err)
+	}
+	return parseTools(output), nil
+}
+
+// parseTools parses the output of introspectScript.
+func parseTools(output string) *models.ImageTools {
+	tools := &models.ImageTools{Source: models.ImageToolsIntrospection, InspectedAt: time.Now().UTC()}
+	for _, line := range strings.Split(output, "\n") {
+		kind, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		switch kind {
+		case "macos":
+			tools.MacOSVersion = value
+		case "build":
+			tools.MacOSBuild = value
+		case "xcode":
+			if !slices.Contains(tools.Xcode, value) {
+				tools.Xcode = append(tools.Xcode, value)
+			}
+		case "sdk":
+			if !slices.Contains(tools.SDKs, value) {
+				tools.SDKs = append(tools.SDKs, value)
+			}
+		}
+	}
+	slices.Sort(tools.Xcode)
+	slices.Sort(tools.SDKs)
+	return tools
+}
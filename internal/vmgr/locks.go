@@ -0,0 +1,58 @@
+package vmgr
+
+import (
+	"context"
+	"fmt"
+)
+
+// vmLock serializes the commands acting on one VM.
+type vmLock struct {
+	held chan struct{} // Holds a token while the lock is held
+	refs int           // Holders and waiters; the lock is dropped at zero
+}
+
+// lockVM waits until no other command acts on vmID and locks it, so e.g. a
+// delete doesn't remove the directory of a VM its canceled provision is still
+// cloning into. Commands on other VMs aren't held up. It fails if ctx is done
+// first. Call the returned function to unlock.
+func (m *Manager) lockVM(ctx context.Context, vmID string) (func(), error) {
+	m.mu.Lock()
+	lock, ok := m.vmLocks[vmID]
+	if !ok {
+		lock = &vmLock{held: make(chan struct{}, 1)}
+		m.vmLocks[vmID] = lock
+	}
+	lock.refs++
+	m.mu.Unlock()
+
+	release := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if lock.refs--; lock.refs == 0 {
+			delete(m.vmLocks, vmID)
+		}
+	}
+	select {
+	case lock.held <- struct{}{}:
+	case <-ctx.Done():
+		release()
+		return nil, fmt.Errorf("gave up waiting for another command on VM %s: %w", vmID, context.Cause(ctx))
+	}
+	return func() {
+		<-lock.held
+		release()
+	}, nil
+}
+
+// acquireSlot waits until fewer than MaxVMs VMs are being provisioned or
+// resumed, so provisions admitted beyond the node's VM slots don't all clone
+// and boot at once. It fails if ctx is done first. Call the returned function
+// to free the slot.
+func (m *Manager) acquireSlot(ctx context.Context) (func(), error) {
+	select {
+	case m.slots <- struct{}{}:
+		return func() { <-m.slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("gave up waiting for a VM slot: %w", context.Cause(ctx))
+	}
+}
@@ -0,0 +1,224 @@
+package vmgr
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// vmLogName is the log of the process running a VM, e.g. `tart run`, in
+	// the VM's logs directory. Rotated files are vm.log.1 and up.
+	vmLogName = "vm.log"
+	// logBundleDir holds the log bundles of failed and deleted VMs, under the state directory.
+	logBundleDir = "vm-logs"
+	// logCollectTimeout bounds collecting a VM's logs, including from the guest.
+	logCollectTimeout = 2 * time.Minute
+	// maxGuestLogBytes bounds the guest logs copied into a bundle.
+	maxGuestLogBytes = 64 << 20
+	// systemLogLines is how much of the guest's system.log is kept.
+	systemLogLines = 2000
+)
+
+// collectLogs bundles the logs of a VM about to be removed into a tar.gz under
+// the state directory, uploading it to the image bucket with VMLogUpload, so
+// a failure can be looked into after the VM is gone. reason, e.g. "failed" or
+// "deleted", is part of the bundle's name. The bundle has the VM's logs
+// directory under host/, its provision report, and, if the VM still runs,
+// the CI agent's logs and the tail of system.log under guest/. Failing is
+// only logged.
+func (m *Manager) collectLogs(vmID, reason string) {
+	if !m.cfg.VMLogCollection {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), logCollectTimeout)
+	defer cancel()
+
+	path, err := m.writeLogBundle(ctx, vmID, reason)
+	if err != nil {
+		log.Printf("Warning: Could not collect logs of VM %s: %v", vmID, err)
+		return
+	}
+	log.Printf("Logs of VM %s collected in %s.", vmID, path)
+	m.pruneLogBundles()
+
+	if m.cfg.VMLogUpload {
+		object := fmt.Sprintf("failures/%s/%s", m.cfg.NodeID, filepath.Base(path))
+		if err := m.imageManager.UploadObject(ctx, object, path); err != nil {
+			log.Printf("Warning: Could not upload logs of VM %s: %v", vmID, err)
+			return
+		}
+		log.Printf("Logs of VM %s uploaded to gs://%s/%s.", vmID, m.cfg.GCSBucketName, object)
+	}
+}
+
+// writeLogBundle writes the log bundle of a VM and returns its path.
+func (m *Manager) writeLogBundle(ctx context.Context, vmID, reason string) (string, error) {
+	dir := filepath.Join(m.cfg.StateDir, logBundleDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create log bundle directory %s: %w", dir, err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s-%s.tar.gz", vmID, reason, time.Now().UTC().Format("20060102T150405Z")))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to create log bundle %s: %w", path, err)
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+	err = m.bundleHostLogs(tw, vmID)
+	if err == nil {
+		err = m.bundleGuestLogs(ctx, tw, vmID)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("failed to write log bundle: %w", err)
+	}
+	return path, nil
+}
+
+// bundleHostLogs adds the VM's logs directory and provision report.
+func (m *Manager) bundleHostLogs(tw *tar.Writer, vmID string) error {
+	if report, ok := m.ProvisionReport(vmID); ok {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		if err := addBundleFile(tw, "provision-report.json", data); err != nil {
+			return err
+		}
+	}
+
+	logsDir := m.paths.LogsDir(vmID)
+	err := filepath.WalkDir(logsDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(logsDir, path)
+		return addBundleFile(tw, filepath.ToSlash(filepath.Join("host", rel)), data)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// bundleGuestLogs adds the CI agent's logs and the tail of system.log from a
+// running VM. Logs that can't be read from the guest are left out.
+func (m *Manager) bundleGuestLogs(ctx context.Context, tw *tar.Writer, vmID string) error {
+	if state, err := m.commands.GetVMState(vmID); err != nil || state != "running" {
+		return nil
+	}
+	client := m.ssh.Client(vmID)
+
+	if output, err := client.Run(ctx, fmt.Sprintf("tail -n %d /var/log/system.log", systemLogLines), nil); err == nil {
+		if err := addBundleFile(tw, "guest/system.log", []byte(output)); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("Warning: Could not read system.log of VM %s: %v", vmID, err)
+	}
+
+	paths := m.workloadOf(vmID).logs
+	quoted := make([]string, len(paths))
+	for i, path := range paths {
+		quoted[i] = shellQuote(strings.TrimPrefix(path, "/"))
+	}
+	// Missing paths make tar fail after archiving the others, so its exit status is ignored
+	command := fmt.Sprintf("tar cf - -C / %s 2>/dev/null; true", strings.Join(quoted, " "))
+	var archive bytes.Buffer
+	if err := client.Stream(ctx, command, nil, &limitedBuffer{buf: &archive, max: maxGuestLogBytes}, io.Discard); err != nil {
+		log.Printf("Warning: Could not read runner logs of VM %s: %v", vmID, err)
+	}
+
+	// Copy whole files only, so a truncated archive still makes a valid bundle
+	tr := tar.NewReader(&archive)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			return nil
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil || int64(len(data)) != header.Size {
+			return nil
+		}
+		if err := addBundleFile(tw, "guest/"+strings.TrimPrefix(header.Name, "/"), data); err != nil {
+			return err
+		}
+	}
+}
+
+// addBundleFile adds a file to a log bundle.
+func addBundleFile(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// limitedBuffer is a writer that keeps up to max bytes and discards the rest.
+type limitedBuffer struct {
+	buf *bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// pruneLogBundles removes the oldest log bundles beyond MaxVMLogBundles.
+func (m *Manager) pruneLogBundles() {
+	if m.cfg.MaxVMLogBundles <= 0 {
+		return
+	}
+	dir := filepath.Join(m.cfg.StateDir, logBundleDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	type bundle struct {
+		path    string
+		modTime time.Time
+	}
+	var bundles []bundle
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !strings.HasSuffix(entry.Name(), ".tar.gz") {
+			continue
+		}
+		bundles = append(bundles, bundle{filepath.Join(dir, entry.Name()), info.ModTime()})
+	}
+	sort.Slice(bundles, func(i, j int) bool { return bundles[i].modTime.After(bundles[j].modTime) })
+	for _, b := range bundles[min(len(bundles), m.cfg.MaxVMLogBundles):] {
+		if err := os.Remove(b.path); err != nil {
+			log.Printf("Warning: Could not remove old log bundle %s: %v", b.path, err)
+		}
+	}
+}
@@ -1,142 +1,629 @@
 package vmgr
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os"
-	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/github"
+	"github.com/changty97/macvmagt/internal/hostkeys"
 	"github.com/changty97/macvmagt/internal/imagemgr"
 	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/operations"
+	"github.com/changty97/macvmagt/internal/paths"
+	"github.com/changty97/macvmagt/internal/requestid"
+	"github.com/changty97/macvmagt/internal/runnerpkg"
+	"github.com/changty97/macvmagt/internal/secrets"
+	"github.com/changty97/macvmagt/internal/sshclient"
+	"github.com/changty97/macvmagt/internal/tracing"
 	"github.com/changty97/macvmagt/internal/utils"
+	"github.com/changty97/macvmagt/internal/vmprofiles"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// runnerHome is where the install script places the GitHub runner inside the VM.
+const runnerHome = "/Users/runner/actions-runner"
+
 // Manager handles VM creation, deletion, and status.
 type Manager struct {
 	cfg          *config.Config
 	imageManager *imagemgr.Manager
-	// Add a mutex if VM operations need to be synchronized
-	// activeVMs sync.Map // Map[string]*models.VMInfo if agent needs to track internal VM state
+	secrets      secrets.Provider
+	github       *github.Client
+	runnerPkgs   *runnerpkg.Cache // GitHub runner packages uploaded into VMs, with RunnerPackageCache
+	hostKeys     *hostkeys.Store
+	ssh          *sshclient.Pool                        // Pooled SSH connections to VMs
+	ops          *operations.Tracker                    // Registry of in-flight operations
+	paths        *paths.Layout                          // On-disk layout of per-VM directories
+	mu           sync.Mutex                             // Protects reachability, mdns, guest, usage, clocks, IP discoveries, provisions, vmLocks, reports, standbys and prepStandby
+	reachability map[string][]models.ReachabilityResult // Guest network self-test results per VM
+	mdns         map[string]mdnsProcess                 // dns-sd processes advertising VMs, by VM ID
+	guest        map[string]*models.GuestStatus         // Last phase reported by each VM's guest helper
+	usage        map[string]usageSample                 // Last resource usage sampled for each running VM
+	clocks       map[string]vmClock                     // When each VM booted and became ready, on the monotonic clock
+	ipMethods    map[string]string                      // IP discovery strategy that found each VM's address while it booted
+	ipCounts     map[string]int64                       // Addresses of booting VMs found per IP discovery strategy
+	agentPin     string                                 // Public key pin the guest helper verifies the agent's HTTPS certificate with
+	provisions   map[string]provision                   // In-flight provision of each VM
+	vmLocks      map[string]*vmLock                     // Lock of each VM a command acts on or waits for
+	slots        chan struct{}                          // Holds a token per VM being provisioned or resumed, up to MaxVMs
+	reports      []models.ProvisionReport               // Timing reports of recent provisions, oldest first
+	standbys     []string                               // Booted warm pool VMs ready to be adopted, oldest first
+	prepStandby  context.CancelFunc                     // Stops preparing the next standby VM; nil while none is prepared
+	refillPool   chan struct{}                          // Signals the warm pool to replace an adopted standby
+	profiles     *vmprofiles.Set                        // VM profiles provision requests are completed from
+	diskBytes    DiskBytesFunc                          // Sampled disk usage of each VM; nil measures it with each usage sample
+	commands     *utils.Commands                        // Runs tart, dns-sd and the other commands VMs are managed with
+}
+
+// provision is a VM provision in progress.
+type provision struct {
+	images []string           // Images the VM is created from, its boot disk's first
+	cancel context.CancelFunc // Stops the provision
 }
 
 // NewManager creates a new VM Manager.
-func NewManager(cfg *config.Config, im *imagemgr.Manager) *Manager {
-	return &Manager{
+func NewManager(cfg *config.Config, im *imagemgr.Manager, sp secrets.Provider, gh *github.Client, hk *hostkeys.Store, ops *operations.Tracker, layout *paths.Layout) *Manager {
+	m := &Manager{
 		cfg:          cfg,
 		imageManager: im,
+		secrets:      sp,
+		github:       gh,
+		runnerPkgs:   runnerpkg.NewCache(cfg),
+		hostKeys:     hk,
+		ops:          ops,
+		paths:        layout,
+		reachability: make(map[string][]models.ReachabilityResult),
+		mdns:         make(map[string]mdnsProcess),
+		guest:        make(map[string]*models.GuestStatus),
+		usage:        make(map[string]usageSample),
+		clocks:       make(map[string]vmClock),
+		ipMethods:    make(map[string]string),
+		ipCounts:     make(map[string]int64),
+		provisions:   make(map[string]provision),
+		vmLocks:      make(map[string]*vmLock),
+		slots:        make(chan struct{}, max(cfg.MaxVMs, 1)),
+		refillPool:   make(chan struct{}, 1),
+		profiles:     &vmprofiles.Set{},
+		commands:     &utils.Commands{},
 	}
+	m.ssh = sshclient.NewPool(m.sshTarget)
+	return m
+}
+
+// SetCommandRunner makes the manager run its commands, such as tart and
+// dns-sd, with r rather than the CommandRunner set with
+// utils.SetCommandRunner, e.g. a utils.ReplayRunner in tests.
+func (m *Manager) SetCommandRunner(r utils.CommandRunner) {
+	m.commands = utils.NewCommands(r)
 }
 
 // ProvisionVM handles the request to provision a new VM.
 // This is the core logic for spinning up a VM for a GitHub runner.
-func (m *Manager) ProvisionVM(cmd models.VMProvisionCommand) error {
-	log.Printf("Received request to provision VM %s with image %s", cmd.VMID, cmd.ImageName)
+// It is traced as part of the trace in ctx, e.g. the orchestrator's request.
+// It stops, killing the commands it runs, when ctx is done or the VM is deleted.
+func (m *Manager) ProvisionVM(ctx context.Context, cmd models.VMProvisionCommand) (err error) {
+	log.Printf("Received request to provision VM %s with image %s%s", cmd.VMID, cmd.ImageName, requestid.LogSuffix(ctx))
+	op := m.ops.StartContext(ctx, "provision", cmd.VMID)
+	started := time.Now()
+	adopted := false
+	defer func() {
+		m.recordProvisionReport(op, cmd, started, adopted, err)
+		op.Fail(err)
+		op.Done()
+	}()
+	ctx, cancel := context.WithCancel(ctx)
+	m.mu.Lock()
+	images := []string{cmd.ImageName}
+	for _, disk := range cmd.Disks {
+		if disk.Image != "" {
+			images = append(images, disk.Image)
+		}
+	}
+	m.provisions[cmd.VMID] = provision{images: images, cancel: cancel}
+	m.mu.Unlock()
+	m.markProvisioning(cmd.VMID, cmd.ImageName, requestid.FromContext(ctx))
+	defer func() {
+		m.unmarkProvisioning(cmd.VMID)
+		m.mu.Lock()
+		delete(m.provisions, cmd.VMID)
+		m.mu.Unlock()
+		cancel()
+	}()
+
+	// A delete of the VM cancels ctx, so the provision gives up waiting.
+	op.SetPhase("waiting for VM lock")
+	unlock, err := m.lockVM(ctx, cmd.VMID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	op.SetPhase("waiting for a VM slot")
+	freeSlot, err := m.acquireSlot(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot provision VM %s: %w", cmd.VMID, err)
+	}
+	defer freeSlot()
+
+	// Site hooks may veto the provision, and hear about its outcome.
+	if err := m.runHook(op.Trace(ctx), hookPreProvision, cmd.VMID, provisionHookEnv(cmd)); err != nil {
+		return fmt.Errorf("cannot provision VM %s: %w", cmd.VMID, err)
+	}
+	defer func() {
+		// The hook runs even if the provision was canceled.
+		hookCtx := context.WithoutCancel(op.Trace(ctx))
+		if err := m.runHook(hookCtx, hookPostProvision, cmd.VMID, m.postProvisionHookEnv(cmd, err)); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}()
+
+	// 1-2. Take over a booted standby VM from the warm pool if one fits the
+	// request, or else create the VM from its image.
+	if adopted = m.adoptStandby(op.Trace(ctx), op, cmd); !adopted {
+		if err := m.createVM(ctx, op, cmd); err != nil {
+			return err
+		}
+	} else {
+		m.markBooted(cmd.VMID)
+	}
+
+	// 3. Create guest accounts, then run the request's custom provisioning steps, each with its own interpreter.
+	if len(cmd.Users) > 0 {
+		op.SetPhase("configuring guest users")
+		if err := m.configureGuestUsers(op.Trace(ctx), cmd.VMID, cmd.Users); err != nil {
+			log.Printf("Guest user setup failed on VM %s, tearing it down: %v", cmd.VMID, err)
+			m.teardownVM(cmd.VMID)
+			return fmt.Errorf("failed to provision VM %s: %w", cmd.VMID, err)
+		}
+	}
+	if len(cmd.Steps) > 0 {
+		op.SetPhase("running provisioning steps")
+		if err := m.runSteps(op.Trace(ctx), cmd.VMID, cmd.Steps); err != nil {
+			log.Printf("Provisioning steps failed on VM %s, tearing it down: %v", cmd.VMID, err)
+			m.teardownVM(cmd.VMID)
+			return fmt.Errorf("failed to provision VM %s: %w", cmd.VMID, err)
+		}
+	}
+
+	// 4. Optionally verify the guest can reach the endpoints jobs depend on,
+	// before the runner registers and can take jobs that would fail.
+	if len(m.cfg.ReachabilityEndpoints) > 0 {
+		op.SetPhase("checking network reachability")
+		results := m.checkReachability(op.Trace(ctx), cmd.VMID)
+		m.setReachability(cmd.VMID, results)
+		if failed := unreachableEndpoints(results); len(failed) > 0 && m.cfg.ReachabilityRequired {
+			m.teardownVM(cmd.VMID)
+			return fmt.Errorf("VM %s cannot reach required endpoints: %s", cmd.VMID, strings.Join(failed, ", "))
+		}
+	}
+
+	// 5. Run Post-Script to Install GitHub Runner
+	// The script template lives on the agent host; it is rendered with the
+	// request's runner settings and streamed into the VM over SSH.
+	// A VM without a working runner is useless and still occupies a slot, so
+	// if installation ultimately fails the VM is torn down.
+	uniqueRunnerName := runnerName(m.cfg, cmd.VMID)
+	op.SetPhase("installing runner")
+	attempts := time.Duration(max(m.cfg.RunnerInstallAttempts, 1))
+	if m.cfg.RunnerInstallTimeout > 0 {
+		op.SetDeadline(time.Now().Add(attempts*m.cfg.RunnerInstallTimeout + (attempts-1)*m.cfg.RunnerInstallRetryDelay))
+	}
+	m.recordRunner(cmd, uniqueRunnerName)
+	if err := m.installRunner(op.Trace(ctx), cmd, uniqueRunnerName); err != nil {
+		log.Printf("GitHub runner installation failed on VM %s, tearing it down: %v", cmd.VMID, err)
+		m.teardownVM(cmd.VMID)
+		return fmt.Errorf("failed to install GitHub runner on VM %s: %w", cmd.VMID, err)
+	}
+
+	if m.cfg.MDNSRegister {
+		op.SetPhase("registering hostname")
+		if err := m.registerMDNS(cmd.VMID); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	op.SetPhase("done")
+	m.markReady(cmd.VMID)
+	log.Printf("VM %s provisioned and ready for GitHub job. Timings: %s", cmd.VMID, formatSteps(op.Steps()))
+	return nil
+}
+
+// createVM waits for the request's image to be cached, clones it for the VM
+// and boots the VM. It stops when ctx is done.
+func (m *Manager) createVM(ctx context.Context, op *operations.Operation, cmd models.VMProvisionCommand) error {
+	// 1. Wait for the images of the boot disk and any data disks to be cached.
+	imagePath, err := m.waitForImage(ctx, op, cmd.VMID, cmd.ImageName)
+	if err != nil {
+		return err
+	}
+	// Requirements of an image that wasn't cached when the request was
+	// accepted can only be checked now.
+	if err := m.imageManager.CheckRequirements(cmd.ImageName, cmd.ImageRequirements); err != nil {
+		return fmt.Errorf("cannot provision VM %s: %w", cmd.VMID, err)
+	}
+	if err := m.imageManager.CheckArch(ctx, cmd.ImageName); err != nil {
+		return fmt.Errorf("cannot provision VM %s: %w", cmd.VMID, err)
+	}
+	needed := []string{cmd.ImageName}
+	for _, disk := range cmd.Disks {
+		if disk.Image != "" {
+			if _, err := m.waitForImage(ctx, op, cmd.VMID, disk.Image); err != nil {
+				return err
+			}
+			needed = append(needed, disk.Image)
+		}
+	}
+
+	// 2. Create and Start the VM
+	// This is where you call macOS `vm` commands or interact with Hypervisor.framework.
+	// For ephemeral runners, you'd want to clone the base image to a new location for the VM.
+	op.SetPhase("creating VM")
+	createCtx, cancelCreate := m.stageContext(ctx, stageCreate)
+	defer cancelCreate()
+	showStageDeadline(op, createCtx)
+	m.yieldStandby() // A standby VM gives up its slot for VMs it can't be adopted as
+	// Re-check space right before cloning: other provisions may have used it up
+	// since the request was accepted.
+	var size int64
+	sized := false
+	for _, imageName := range needed {
+		if imageSize, err := m.imageManager.ImageSize(op.Trace(ctx), imageName); err == nil {
+			size += imageSize
+			sized = true
+		}
+	}
+	if sized {
+		if err := m.imageManager.EnsureFreeSpace(m.paths.Root(), size, cmd.ImageName); err != nil {
+			return fmt.Errorf("cannot clone image %s for VM %s: %w", cmd.ImageName, cmd.VMID, err)
+		}
+	}
+	if err := m.paths.Create(cmd.VMID); err != nil {
+		return err
+	}
+
+	// Copy the base images to the VM's directory alongside writing its config
+	if err := m.cloneVM(op.Trace(createCtx), op, cmd, imagePath); err != nil {
+		return m.stageError(ctx, createCtx, stageCreate, err)
+	}
+	vmDiskPath := m.paths.DiskPath(cmd.VMID)
+	if cmd.DiskSizeGB > 0 {
+		if err := timeStep(op, "grow disk", func() error { return growDisk(vmDiskPath, cmd.DiskSizeGB) }); err != nil {
+			m.teardownVM(cmd.VMID)
+			return fmt.Errorf("cannot provision VM %s: %w", cmd.VMID, err)
+		}
+	}
+
+	// Boot the VM detached with its launch: network mode, data disks, CPU
+	// policy, log and PID file, as the warm pool and resumes do.
+	op.SetPhase("booting")
+	showStageDeadline(op, createCtx)
+	if err := m.applyTartConfig(cmd.VMID); err != nil {
+		m.teardownVM(cmd.VMID)
+		return fmt.Errorf("cannot provision VM %s: %w", cmd.VMID, err)
+	}
+	if err := m.commands.StartVM(cmd.VMID, m.Launch(cmd.VMID)); err != nil {
+		m.teardownVM(cmd.VMID)
+		return fmt.Errorf("cannot provision VM %s: %w", cmd.VMID, err)
+	}
+
+	// Record the VM's SSH host key out-of-band before the first connection.
+	// If the guest agent isn't available the key is trusted on first use instead.
+	op.SetPhase("capturing host key")
+	showStageDeadline(op, createCtx)
+	if err := m.hostKeys.Capture(op.Trace(createCtx), cmd.VMID); err != nil {
+		log.Printf("Warning: %v; falling back to trust-on-first-use", err)
+	}
+
+	// Wait for the guest to come up, so the provision report tells booting
+	// apart from the provisioning done over SSH.
+	cancelCreate()
+	op.SetPhase("waiting for IP")
+	ipCtx, cancelIP := m.stageContext(ctx, stageIP)
+	defer cancelIP()
+	showStageDeadline(op, ipCtx)
+	if err := m.waitForIP(ipCtx, cmd.VMID); err != nil {
+		m.teardownVM(cmd.VMID)
+		return m.stageError(ctx, ipCtx, stageIP, fmt.Errorf("VM %s did not get an IP address: %w", cmd.VMID, err))
+	}
+	op.SetPhase("waiting for SSH")
+	sshCtx, cancelSSH := m.stageContext(ctx, stageSSH)
+	defer cancelSSH()
+	showStageDeadline(op, sshCtx)
+	if err := m.waitForSSH(op.Trace(sshCtx), cmd.VMID); err != nil {
+		m.teardownVM(cmd.VMID)
+		return m.stageError(ctx, sshCtx, stageSSH, fmt.Errorf("VM %s did not become reachable over SSH: %w", cmd.VMID, err))
+	}
+	m.markBooted(cmd.VMID)
 
-	// 1. Check if image is cached and ready
-	imagePath, ok := m.imageManager.GetCachedImagePath(cmd.ImageName)
+	if cmd.DiskSizeGB > 0 {
+		op.SetPhase("resizing guest volume")
+		if err := m.resizeGuestVolume(op.Trace(ctx), cmd.VMID); err != nil {
+			log.Printf("Guest volume resize failed on VM %s, tearing it down: %v", cmd.VMID, err)
+			m.teardownVM(cmd.VMID)
+			return fmt.Errorf("failed to provision VM %s: %w", cmd.VMID, err)
+		}
+	}
+	return nil
+}
+
+// waitForImage returns the path of a cached image the VM is created from,
+// requesting its download and waiting for it first if it isn't cached yet.
+func (m *Manager) waitForImage(ctx context.Context, op *operations.Operation, vmID, imageName string) (string, error) {
+	// Check if image is cached and ready. A corrupt cached copy is evicted.
+	// One that failed its smoke test is rejected, or evicted if a new version
+	// has been uploaded.
+	op.SetPhase("verifying image")
+	if err := m.imageManager.CheckUsable(op.Trace(ctx), imageName); err != nil {
+		return "", fmt.Errorf("cannot provision VM %s: %w", vmID, err)
+	}
+	imagePath, ok := m.imageManager.UseCachedImage(imageName)
 	if !ok {
 		// Image not cached, request download
-		log.Printf("Image %s not cached. Requesting download.", cmd.ImageName)
-		m.imageManager.RequestImageDownload(cmd.ImageName)
-
+		log.Printf("Image %s not cached. Requesting download.", imageName)
 		// Wait for download to complete (non-blocking for agent, but blocking for this VM provisioning call)
 		// This is where the "queue/wait the current GitHub job" logic comes in.
 		// The orchestrator would have already decided this node is suitable for download.
 		// Here, we block THIS VM provisioning request until download is done.
-		timeout := time.After(30 * time.Minute) // Max wait time for download
+		// Giving up cancels the download unless another provision still waits for it.
+		waitCtx, cancelWait := m.stageContext(ctx, stageDownload)
+		defer cancelWait()
+		m.imageManager.RequestImageDownload(op.Trace(waitCtx), imageName)
+		op.SetPhase("waiting for image download")
+		showStageDeadline(op, waitCtx)
 		ticker := time.NewTicker(10 * time.Second)
 		defer ticker.Stop()
 
 		for {
 			select {
 			case <-ticker.C:
-				imagePath, ok = m.imageManager.GetCachedImagePath(cmd.ImageName)
-				if ok && !m.imageManager.IsImageDownloading(cmd.ImageName) {
-					log.Printf("Image %s downloaded. Proceeding with VM provisioning.", cmd.ImageName)
+				imagePath, ok = m.imageManager.GetCachedImagePath(imageName)
+				if ok && !m.imageManager.IsImageDownloading(imageName) {
+					log.Printf("Image %s downloaded. Proceeding with VM provisioning.", imageName)
 					goto ImageReady // Break out of loop and continue
 				}
-				log.Printf("Waiting for image %s to finish downloading...", cmd.ImageName)
-			case <-timeout:
-				return fmt.Errorf("timeout waiting for image %s to download for VM %s", cmd.ImageName, cmd.VMID)
+				log.Printf("Waiting for image %s to finish downloading...", imageName)
+			case <-waitCtx.Done():
+				if ctx.Err() != nil {
+					return "", fmt.Errorf("provisioning of VM %s canceled while waiting for image %s: %w", vmID, imageName, ctx.Err())
+				}
+				return "", m.stageError(ctx, waitCtx, stageDownload, fmt.Errorf("image %s didn't finish downloading for VM %s", imageName, vmID))
 			}
 		}
 	ImageReady: // Label to jump to after successful download
+		cancelWait()
 		if imagePath == "" {
-			return fmt.Errorf("image %s path is empty after download, cannot provision VM %s", cmd.ImageName, cmd.VMID)
+			return "", fmt.Errorf("image %s path is empty after download, cannot provision VM %s", imageName, vmID)
+		}
+		if err := m.imageManager.CheckUsable(op.Trace(ctx), imageName); err != nil {
+			return "", fmt.Errorf("cannot provision VM %s: %w", vmID, err)
 		}
 	}
+	return imagePath, nil
+}
 
-	// 2. Create and Start the VM
-	// This is where you call macOS `vm` commands or interact with Hypervisor.framework.
-	// For ephemeral runners, you'd want to clone the base image to a new location for the VM.
-	vmBasePath := fmt.Sprintf("/var/macvmorx/vms/%s", cmd.VMID)
-	if err := os.MkdirAll(vmBasePath, 0755); err != nil {
-		return fmt.Errorf("failed to create VM base directory %s: %w", vmBasePath, err)
+// formatSteps renders step timings for logging, e.g. "creating VM=12.3s, clone disk=8.1s".
+func formatSteps(steps []models.OperationStep) string {
+	parts := make([]string, 0, len(steps))
+	for _, step := range steps {
+		parts = append(parts, fmt.Sprintf("%s=%s", step.Name, time.Duration(step.DurationMs)*time.Millisecond))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// installRunner runs the runner install script inside the VM, retrying up to
+// RunnerInstallAttempts times, and verifies the runner service afterwards.
+// With RunnerConfirmation, an attempt only succeeds once the runner is
+// confirmed registered, too.
+func (m *Manager) installRunner(ctx context.Context, cmd models.VMProvisionCommand, name string) error {
+	vmID := cmd.VMID
+	if usesRunnerPackage(m.cfg, cmd) {
+		m.uploadRunnerPackage(ctx, vmID)
 	}
 
-	// Example: Copy the base image to the VM's directory
-	vmDiskPath := filepath.Join(vmBasePath, fmt.Sprintf("%s.sparseimage", cmd.VMID))
-	log.Printf("Cloning image %s to %s for VM %s...", imagePath, vmDiskPath, cmd.VMID)
-	_, err := utils.ExecuteCommand("cp", imagePath, vmDiskPath) // Simple copy, consider `hdiutil compact` for sparse images
+	attempts := m.cfg.RunnerInstallAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		log.Printf("Installing GitHub runner '%s' on VM %s (attempt %d/%d)...", name, vmID, attempt, attempts)
+		attemptCtx, span := tracing.Start(ctx, "runner install attempt", attribute.Int("macvmagt.attempt", attempt))
+		lastErr = m.installAttempt(attemptCtx, cmd, name, attempt)
+		tracing.End(span, lastErr)
+		if lastErr == nil {
+			log.Printf("GitHub runner '%s' installed and verified on VM %s.", name, vmID)
+			return nil
+		}
+		log.Printf("Runner install attempt %d/%d on VM %s failed: %v", attempt, attempts, vmID, lastErr)
+		if attempt < attempts {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("giving up after %d attempts: %w", attempt, ctx.Err())
+			case <-time.After(m.cfg.RunnerInstallRetryDelay):
+			}
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", attempts, lastErr)
+}
+
+// installAttempt renders the install script and runs it, then confirms the
+// runner. Each attempt renders the script anew, as a JIT config is
+// single-use: the runner a failed attempt registered is removed, and
+// registered again with a new config.
+func (m *Manager) installAttempt(ctx context.Context, cmd models.VMProvisionCommand, name string, attempt int) error {
+	if attempt > 1 && profileFor(cmd.Workload).name == workloadGitHub && usesJIT(m.cfg) {
+		if err := m.github.DeleteRunner(ctx, cmd.InstallationToken, cmd.GitHubOrg, cmd.GitHubRepo, name); err != nil {
+			return fmt.Errorf("failed to remove JIT runner of the failed attempt: %w", err)
+		}
+	}
+	script, env, err := m.renderRunnerScript(ctx, cmd, name)
 	if err != nil {
-		return fmt.Errorf("failed to clone VM disk image: %w", err)
-	}
-	log.Printf("Image cloned for VM %s.", cmd.VMID)
-
-	// Actual VM creation using `vm` command (highly simplified example)
-	// This assumes `vm` can create a VM from a disk image directly.
-	// For a more robust solution, consider `tart` (https://github.com/cirruslabs/tart)
-	// or direct Hypervisor.framework interaction in Swift.
-	// Example `vm` command for creating a VM:
-	// `vm create --name <VMID> --disk <vmDiskPath> --memory 4G --cpu 2`
-	// You'd need to configure networking (e.g., bridged, NAT) and other VM parameters.
-	// For simplicity, we'll just simulate the creation.
-	log.Printf("Placeholder: Executing VM creation command for %s using disk %s...", cmd.VMID, vmDiskPath)
-	// Simulate VM creation time
-	time.Sleep(10 * time.Second) // Simulate actual VM creation/boot time
-
-	// Start the VM
-	// `vm start <VMID>`
-	log.Printf("Placeholder: VM %s started.", cmd.VMID)
-
-	// 3. Run Post-Script to Install GitHub Runner
-	// This script should be located on the Mac Mini agent.
-	// It needs to be executed *inside* the newly created VM. This is complex
-	// and typically involves SSH or a shared folder mechanism.
-	// For now, we'll simulate it.
-	// runnerScriptPath := "github.com/changty97/macvmagt/scripts/install_github_runner.sh.template" // Adjust path
-	uniqueRunnerName := fmt.Sprintf("macvmorx-runner-%s-%s", m.cfg.NodeID, cmd.VMID)
-
-	log.Printf("Placeholder: Running post-script to install GitHub runner '%s' on VM %s...", uniqueRunnerName, cmd.VMID)
-	// Example: Execute a script via SSH into the VM (requires SSH server in VM and credentials)
-	// `ssh user@<VM_IP_ADDRESS> "bash -s" < ${runnerScriptPath} ${uniqueRunnerName}`
-	// Or use a shared folder and execute locally within the VM.
-	time.Sleep(5 * time.Second) // Simulate runner installation
-	log.Printf("Placeholder: GitHub runner '%s' installed on VM %s.", uniqueRunnerName, cmd.VMID)
-
-	log.Printf("VM %s provisioned and ready for GitHub job.", cmd.VMID)
+		return err
+	}
+	if err := m.runRunnerScript(ctx, cmd.VMID, script, env); err != nil {
+		return err
+	}
+	return m.confirmRunner(ctx, cmd, name)
+}
+
+// runRunnerScript performs a single install attempt followed by verification.
+// The script is uploaded and run with its secrets in env. With guest events,
+// the runner is verified by the guest helper reporting its registration
+// rather than over SSH. The attempt is aborted if it takes longer than
+// RunnerInstallTimeout.
+func (m *Manager) runRunnerScript(ctx context.Context, vmID string, script []byte, env map[string]string) (err error) {
+	parent := ctx
+	ctx, cancel := m.stageContext(ctx, stageRunnerInstall)
+	defer cancel()
+	defer func() { err = m.stageError(parent, ctx, stageRunnerInstall, err) }()
+	if m.cfg.GuestEvents {
+		m.clearGuestStatus(vmID) // Don't mistake an earlier attempt's registration for this one's
+	}
+
+	client := m.ssh.Client(vmID)
+	if _, err := runScriptFile(ctx, client, m.cfg.RunnerScriptInterpreter, script, env); err != nil {
+		return fmt.Errorf("runner install script failed: %w", err)
+	}
+
+	if m.cfg.GuestEvents {
+		return m.waitForRunnerRegistered(ctx, vmID)
+	}
+	return m.verifyRunner(ctx, client)
+}
+
+// sshTarget resolves the VM's address and host key verification settings.
+func (m *Manager) sshTarget(vmID string) (sshclient.Target, error) {
+	ip, err := m.IPAddress(vmID)
+	if err != nil {
+		return sshclient.Target{}, err
+	}
+	return sshclient.Target{
+		Host:              ip,
+		User:              m.cfg.VMSSHUser,
+		KeyPath:           m.cfg.VMSSHKeyPath,
+		HostKeyCallback:   m.hostKeys.Callback(vmID),
+		HostKeyAlgorithms: m.hostKeys.HostKeyAlgorithms(vmID),
+	}, nil
+}
+
+// verifyRunner checks that the runner is up inside the VM: for GitHub
+// runners registered with a token the launchd service, otherwise the process
+// of the workload's CI agent.
+func (m *Manager) verifyRunner(ctx context.Context, client *sshclient.Client) error {
+	profile := m.workloadOf(client.VMID())
+	if profile.name != workloadGitHub || usesJIT(m.cfg) {
+		if _, err := client.Run(ctx, "pgrep -f "+shellQuote(profile.process), nil); err != nil {
+			return fmt.Errorf("%s agent process is not running: %w", profile.name, err)
+		}
+		return nil
+	}
+
+	command := fmt.Sprintf("cd %s && ./svc.sh status", runnerHome)
+	output, err := client.Run(ctx, command, nil)
+	if err != nil {
+		return fmt.Errorf("failed to query runner service status: %w", err)
+	}
+	if !strings.Contains(output, "Started") {
+		return fmt.Errorf("runner service is not running (svc.sh status: %s)", strings.TrimSpace(output))
+	}
 	return nil
 }
 
-// DeleteVM handles the request to delete a VM.
-func (m *Manager) DeleteVM(cmd models.VMDeleteCommand) error {
-	log.Printf("Received request to delete VM %s", cmd.VMID)
+// teardownVM removes a VM that failed provisioning so it doesn't hold a slot.
+func (m *Manager) teardownVM(vmID string) {
+	if !IsStandby(vmID) {
+		m.collectLogs(vmID, "failed")
+	}
+	if err := m.commands.DeleteVM(vmID); err != nil {
+		log.Printf("Warning: Failed to delete VM %s during teardown: %v", vmID, err)
+	}
+	if err := m.paths.Remove(vmID); err != nil {
+		log.Printf("Warning: Failed to remove VM directory %s during teardown: %v", m.paths.VMDir(vmID), err)
+	}
+	m.ssh.Close(vmID)
+	m.hostKeys.Forget(vmID)
+	m.imageManager.RemoveClone(vmID)
+	m.setReachability(vmID, nil)
+	m.unregisterMDNS(vmID)
+	m.clearGuestStatus(vmID)
+	m.forgetClock(vmID)
+	m.forgetIPMethod(vmID)
+}
+
+// cancelProvision stops the in-flight provision of a VM, if there is one.
+func (m *Manager) cancelProvision(vmID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if provision, ok := m.provisions[vmID]; ok {
+		log.Printf("Canceling in-flight provision of VM %s", vmID)
+		provision.cancel()
+	}
+}
+
+// DeleteVM handles the request to delete a VM. It is traced as part of the
+// trace in ctx.
+func (m *Manager) DeleteVM(ctx context.Context, cmd models.VMDeleteCommand) (err error) {
+	log.Printf("Received request to delete VM %s%s", cmd.VMID, requestid.LogSuffix(ctx))
+	op := m.ops.StartContext(ctx, "delete", cmd.VMID)
+	defer func() {
+		op.Fail(err)
+		op.Done()
+	}()
+	// Wait for the canceled provision, or any other command on the VM, to
+	// stop before deleting the VM from under it.
+	m.cancelProvision(cmd.VMID)
+	unlock, err := m.lockVM(ctx, cmd.VMID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	hookEnv := m.vmHookEnv(cmd.VMID) // Read before the VM's config is deleted
+	config, _ := m.readVMConfig(cmd.VMID)
+	if err := m.runHook(op.Trace(ctx), hookPreDelete, cmd.VMID, hookEnv); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if m.cfg.VMLogCollection {
+		op.SetPhase("collecting logs")
+		m.collectLogs(cmd.VMID, "deleted")
+	}
+	op.SetPhase("deleting VM")
 
 	// 1. Stop and Delete the VM
 	// This calls the vmutils.DeleteVM which uses the `vm` command.
-	err := utils.DeleteVM(cmd.VMID)
+	err = m.commands.DeleteVM(cmd.VMID)
 	if err != nil {
 		return fmt.Errorf("failed to delete VM %s: %w", cmd.VMID, err)
 	}
+	if m.cfg.DeregisterRunners && config != nil && config.Runner != nil {
+		op.SetPhase("deregistering runner")
+		if err := m.deregisterRunner(op.Trace(ctx), config.Runner); err != nil {
+			log.Printf("Warning: Could not deregister runner of VM %s: %v", cmd.VMID, err)
+		}
+	}
 
 	// 2. Clean up VM's disk image and directory
-	vmBasePath := fmt.Sprintf("/var/macvmorx/vms/%s", cmd.VMID)
+	op.SetPhase("cleaning up")
+	vmBasePath := m.paths.VMDir(cmd.VMID)
 	log.Printf("Cleaning up VM directory: %s", vmBasePath)
-	if err := os.RemoveAll(vmBasePath); err != nil {
+	if err := m.paths.Remove(cmd.VMID); err != nil {
 		log.Printf("Warning: Failed to remove VM directory %s: %v", vmBasePath, err)
 	}
+	m.ssh.Close(cmd.VMID)
+	m.hostKeys.Forget(cmd.VMID)
+	m.imageManager.RemoveClone(cmd.VMID)
+	m.setReachability(cmd.VMID, nil)
+	m.unregisterMDNS(cmd.VMID)
+	m.clearGuestStatus(cmd.VMID)
+	m.forgetClock(cmd.VMID)
+	m.forgetIPMethod(cmd.VMID)
+	if err := m.runHook(op.Trace(ctx), hookPostDelete, cmd.VMID, hookEnv); err != nil {
+		log.Printf("Warning: %v", err)
+	}
 
 	log.Printf("VM %s deleted and cleaned up.", cmd.VMID)
 	return nil
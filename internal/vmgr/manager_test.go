@@ -0,0 +1,202 @@
+package vmgr
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/fakedriver"
+	"github.com/changty97/macvmagt/internal/hostkeys"
+	"github.com/changty97/macvmagt/internal/imagemgr"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/operations"
+	"github.com/changty97/macvmagt/internal/paths"
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// newCreateManager returns a Manager with image macos-15 cached, in a new
+// working directory, whose commands are replayed from the fixture file
+// testdata/<fixture>.jsonl and recorded to commands.jsonl. Its VMs and image
+// cache are in the relative directories vms/ and images/, so the fixtures
+// name them the same on every run.
+func newCreateManager(t *testing.T, fixture string) *Manager {
+	t.Helper()
+	replayer, err := utils.NewReplayRunner(filepath.Join("testdata", fixture+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(t.TempDir())
+	t.Setenv("TART_HOME", "tart")
+	recorder, err := utils.NewRecordingRunner(replayer, "commands.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		NodeID:          "node-1",
+		Driver:          fakedriver.Name,
+		MaxVMs:          1,
+		DiskCloneMode:   cloneModeClone,
+		ImageCacheDir:   "images",
+		MaxCachedImages: 2,
+		StateDir:        "state",
+		IPDiscovery:     []string{"tart"},
+	}
+	if err := os.MkdirAll("images", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("images", "macos-15"), []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ops := operations.NewTracker()
+	im, err := imagemgr.NewManager(cfg, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(im.Close)
+	im.SetCommandRunner(recorder)
+	hk, err := hostkeys.NewStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(cfg, im, nil, nil, hk, ops, paths.New("vms"))
+	m.SetCommandRunner(recorder)
+	return m
+}
+
+// recordedCommands returns the command lines a Manager from newCreateManager
+// ran so far, oldest first.
+func recordedCommands(t *testing.T) []string {
+	t.Helper()
+	file, err := os.Open("commands.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var commands []string
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		var run struct {
+			Command string `json:"command"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &run); err != nil {
+			t.Fatal(err)
+		}
+		commands = append(commands, run.Command)
+	}
+	return commands
+}
+
+// writeTartConfig writes the config tart keeps for a cloned VM.
+func writeTartConfig(t *testing.T, vmID string) {
+	t.Helper()
+	dir, err := utils.TartVMDir(vmID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"cpuCount":4}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateVMCloneFailed(t *testing.T) {
+	m := newCreateManager(t, "create-clone-failed")
+	op := m.ops.Start("provision", "vm-1")
+	defer op.Done()
+
+	err := m.createVM(context.Background(), op, models.VMProvisionCommand{VMID: "vm-1", ImageName: "macos-15"})
+	if err == nil {
+		t.Fatal("createVM succeeded without a clone")
+	}
+	if _, err := os.Stat(m.paths.VMDir("vm-1")); !os.IsNotExist(err) {
+		t.Errorf("partial clone left behind: %v", err)
+	}
+	want := []string{
+		"tart list --format json",
+		"df -P -k vms",
+		"cp -c images/macos-15 vms/vm-1/disk/vm-1.sparseimage",
+	}
+	if got := recordedCommands(t); !slices.Equal(got, want) {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+}
+
+func TestCreateVMBootFailed(t *testing.T) {
+	m := newCreateManager(t, "create-boot-failed")
+	writeTartConfig(t, "vm-1")
+	// The replayed `cp -c` clones nothing, so the clone is made up front.
+	disk := m.paths.DiskPath("vm-1")
+	if err := os.MkdirAll(filepath.Dir(disk), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(disk, []byte("image"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	op := m.ops.Start("provision", "vm-1")
+	defer op.Done()
+
+	err := m.createVM(context.Background(), op, models.VMProvisionCommand{VMID: "vm-1", ImageName: "macos-15"})
+	if err == nil {
+		t.Fatal("createVM succeeded without booting the VM")
+	}
+	if _, err := os.Stat(m.paths.VMDir("vm-1")); !os.IsNotExist(err) {
+		t.Errorf("VM directory left behind: %v", err)
+	}
+	want := []string{
+		"tart list --format json",
+		"df -P -k vms",
+		"cp -c images/macos-15 vms/vm-1/disk/vm-1.sparseimage",
+		"tart run --no-graphics vm-1",
+		"tart stop vm-1",
+		"tart delete vm-1",
+	}
+	if got := recordedCommands(t); !slices.Equal(got, want) {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+}
+
+func TestDeleteVM(t *testing.T) {
+	m := newCreateManager(t, "delete")
+	if err := m.paths.Create("vm-1"); err != nil {
+		t.Fatal(err)
+	}
+	m.imageManager.AddClone("macos-15", "vm-1")
+
+	if err := m.DeleteVM(context.Background(), models.VMDeleteCommand{VMID: "vm-1"}); err != nil {
+		t.Fatalf("DeleteVM: %v", err)
+	}
+	if _, err := os.Stat(m.paths.VMDir("vm-1")); !os.IsNotExist(err) {
+		t.Errorf("VM directory left behind: %v", err)
+	}
+	for _, manifest := range m.imageManager.Manifests() {
+		if slices.Contains(manifest.Clones, "vm-1") {
+			t.Errorf("image %s still lists the deleted VM as a clone", manifest.Name)
+		}
+	}
+	want := []string{"tart stop vm-1", "tart delete vm-1"}
+	if got := recordedCommands(t); !slices.Equal(got, want) {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+}
+
+func TestDeleteVMFailed(t *testing.T) {
+	m := newCreateManager(t, "delete-failed")
+	if err := m.paths.Create("vm-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.DeleteVM(context.Background(), models.VMDeleteCommand{VMID: "vm-1"}); err == nil {
+		t.Fatal("DeleteVM succeeded though tart delete failed")
+	}
+	// The VM still exists, so its directory is kept for the next attempt.
+	if _, err := os.Stat(m.paths.VMDir("vm-1")); err != nil {
+		t.Errorf("VM directory of a VM that wasn't deleted: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package vmgr
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"syscall"
+
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// mdnsProcess is a dns-sd process advertising a VM.
+type mdnsProcess struct {
+	pid    int           // 0 if no process runs it, e.g. when replayed
+	exited chan struct{} // Closed once the process exits
+}
+
+// stop kills the process, unless it already exited and its PID may have
+// been reused.
+func (p mdnsProcess) stop() {
+	if p.pid <= 0 {
+		return
+	}
+	select {
+	case <-p.exited:
+	default:
+		syscall.Kill(p.pid, syscall.SIGKILL)
+	}
+}
+
+// mdnsHostname returns the hostname a VM is advertised under in the .local
+// domain: its ID lowercased, with characters invalid in a DNS label replaced.
+func mdnsHostname(vmID string) string {
+	host := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(vmID))
+	if len(host) > 63 {
+		host = host[:63]
+	}
+	return strings.Trim(host, "-")
+}
+
+// registerMDNS advertises a VM's IP as <host>.local, along with its SSH
+// service, through the host's Bonjour responder. dns-sd keeps the records
+// registered for as long as it runs, so it runs until the VM is removed.
+func (m *Manager) registerMDNS(vmID string) error {
+	ip, err := m.IPAddress(vmID)
+	if err != nil {
+		return err
+	}
+	host := mdnsHostname(vmID) + ".local"
+	exited := make(chan struct{})
+	opts := utils.StartOptions{Exited: func(error) { close(exited) }}
+	pid, err := m.commands.Runner().Start(opts, "dns-sd", "-P", vmID, "_ssh._tcp", "local", "22", host, ip)
+	if err != nil {
+		return fmt.Errorf("failed to register %s in mDNS: %w", host, err)
+	}
+
+	m.mu.Lock()
+	previous, ok := m.mdns[vmID]
+	m.mdns[vmID] = mdnsProcess{pid: pid, exited: exited}
+	m.mu.Unlock()
+	if ok {
+		previous.stop()
+	}
+	log.Printf("Registered VM %s in mDNS as %s (%s)", vmID, host, ip)
+	return nil
+}
+
+// unregisterMDNS withdraws a VM's mDNS records, if it was registered.
+func (m *Manager) unregisterMDNS(vmID string) {
+	m.mu.Lock()
+	process, ok := m.mdns[vmID]
+	delete(m.mdns, vmID)
+	m.mu.Unlock()
+	if ok {
+		process.stop()
+	}
+}
+
+// Hostname returns the .local hostname a VM is registered under in mDNS, or
+// "" if it isn't.
+func (m *Manager) Hostname(vmID string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.mdns[vmID]; !ok {
+		return ""
+	}
+	return mdnsHostname(vmID) + ".local"
+}
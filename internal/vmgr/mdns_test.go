@@ -0,0 +1,54 @@
+package vmgr
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/paths"
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// newReplayManager returns a Manager whose commands are replayed from the
+// fixture file testdata/<fixture>.jsonl.
+func newReplayManager(t *testing.T, fixture string) *Manager {
+	t.Helper()
+	replayer, err := utils.NewReplayRunner(filepath.Join("testdata", fixture+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{MaxVMs: 1, IPDiscovery: []string{"tart"}}
+	m := NewManager(cfg, nil, nil, nil, nil, nil, paths.New(t.TempDir()))
+	m.SetCommandRunner(replayer)
+	return m
+}
+
+func TestRegisterMDNS(t *testing.T) {
+	t.Parallel()
+	m := newReplayManager(t, "mdns")
+
+	if err := m.registerMDNS("vm-1"); err != nil {
+		t.Fatalf("registerMDNS: %v", err)
+	}
+	if got, want := m.Hostname("vm-1"), "vm-1.local"; got != want {
+		t.Errorf("Hostname = %q, want %q", got, want)
+	}
+	m.unregisterMDNS("vm-1")
+	if got := m.Hostname("vm-1"); got != "" {
+		t.Errorf("Hostname after unregisterMDNS = %q, want none", got)
+	}
+}
+
+func TestSuspendedVMs(t *testing.T) {
+	t.Parallel()
+	m := newReplayManager(t, "suspended")
+
+	got, err := m.SuspendedVMs()
+	if err != nil {
+		t.Fatalf("SuspendedVMs: %v", err)
+	}
+	if want := []string{"vm-0", "vm-2"}; !slices.Equal(got, want) {
+		t.Errorf("SuspendedVMs = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,293 @@
+package vmgr
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/logrotate"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// defaultNetworkMode applies to provision requests without a network mode.
+const defaultNetworkMode = "nat"
+
+// vmNetwork is the network section of a VM's config.
+type vmNetwork struct {
+	Type       string `json:"type"`                // "nat", "bridged", "softnet" or "host-only"
+	Interface  string `json:"interface,omitempty"` // Host interface bridged onto
+	MACAddress string `json:"macAddress"`
+}
+
+// newVMNetwork returns the network config of a new VM. Its MAC address is the
+// one requested, or else derived from the node and VM IDs.
+func newVMNetwork(nodeID string, cmd models.VMProvisionCommand) (vmNetwork, error) {
+	mac := deterministicMAC(nodeID, cmd.VMID)
+	if cmd.MACAddress != "" {
+		requested, err := net.ParseMAC(cmd.MACAddress)
+		if err != nil {
+			return vmNetwork{}, fmt.Errorf("invalid MAC address %q: %w", cmd.MACAddress, err)
+		}
+		mac = requested
+	}
+	mode := cmd.NetworkMode
+	if mode == "" {
+		mode = defaultNetworkMode
+	}
+	return vmNetwork{Type: mode, Interface: cmd.NetworkInterface, MACAddress: mac.String()}, nil
+}
+
+// deterministicMAC derives a locally administered, unicast MAC address from
+// the node and VM IDs. A VM provisioned again under the same ID gets the same
+// MAC, and so usually the same DHCP lease, while VMs on other nodes sharing a
+// bridged network don't collide.
+func deterministicMAC(nodeID, vmID string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(nodeID + "/" + vmID))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = mac[0]&^0x01 | 0x02
+	return mac
+}
+
+// readVMConfig reads the config written for a VM when it was provisioned.
+func (m *Manager) readVMConfig(vmID string) (*vmConfig, error) {
+	data, err := os.ReadFile(filepath.Join(m.paths.ConfigDir(vmID), "config.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config of VM %s: %w", vmID, err)
+	}
+	var config vmConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config of VM %s: %w", vmID, err)
+	}
+	return &config, nil
+}
+
+// Network returns a VM's network mode and MAC address, or empty strings for
+// VMs the agent has no config for.
+func (m *Manager) Network(vmID string) (mode, mac string) {
+	config, err := m.readVMConfig(vmID)
+	if err != nil {
+		return "", ""
+	}
+	return config.Network.Type, config.Network.MACAddress
+}
+
+// IP discovery strategies, tried in IPDiscovery order.
+const (
+	ipDiscoveryTart = "tart" // `tart ip`, waiting for the VM to get an IP address
+	ipDiscoveryDHCP = "dhcp" // The host's DHCP lease for the VM's MAC address
+	ipDiscoveryARP  = "arp"  // The host's ARP table, after sweeping the vmnet subnets
+)
+
+// ipWaitStep is how long a strategy may wait for a booting VM's IP address
+// before the next strategy is tried.
+const ipWaitStep = 10 * time.Second
+
+// ipStrategy finds a VM's IP address one way, waiting up to wait for it to
+// appear. config is nil for VMs the agent has no config for.
+type ipStrategy func(m *Manager, ctx context.Context, vmID string, config *vmConfig, wait time.Duration) (string, error)
+
+// ipStrategies are the IP discovery strategies by name.
+var ipStrategies = map[string]ipStrategy{
+	ipDiscoveryTart: (*Manager).ipFromTart,
+	ipDiscoveryDHCP: (*Manager).ipFromDHCP,
+	ipDiscoveryARP:  (*Manager).ipFromARP,
+}
+
+// ValidateIPDiscovery checks that IP discovery has strategies and knows them all.
+func ValidateIPDiscovery(names []string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("--ip-discovery needs at least one strategy: tart, dhcp or arp")
+	}
+	for _, name := range names {
+		if _, ok := ipStrategies[name]; !ok {
+			return fmt.Errorf("unknown IP discovery strategy '%s', expected tart, dhcp or arp", name)
+		}
+	}
+	return nil
+}
+
+// IPAddress returns a VM's IP address, trying the IPDiscovery strategies in
+// order without waiting.
+func (m *Manager) IPAddress(vmID string) (string, error) {
+	ip, _, err := m.discoverIP(context.Background(), vmID, 0)
+	return ip, err
+}
+
+// discoverIP tries the IPDiscovery strategies in order, each waiting up to
+// wait, and returns the first IP address found and the strategy that found it.
+func (m *Manager) discoverIP(ctx context.Context, vmID string, wait time.Duration) (ip, method string, err error) {
+	config, _ := m.readVMConfig(vmID)
+	var errs []error
+	for _, name := range m.cfg.IPDiscovery {
+		strategy, ok := ipStrategies[name]
+		if !ok {
+			continue
+		}
+		ip, err := strategy(m, ctx, vmID, config, wait)
+		if err == nil {
+			return ip, name, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return "", "", fmt.Errorf("no IP address found for VM %s: %w", vmID, errors.Join(errs...))
+}
+
+// ipFromTart asks tart for a VM's IP address.
+func (m *Manager) ipFromTart(ctx context.Context, vmID string, config *vmConfig, wait time.Duration) (string, error) {
+	return m.commands.GetVMIPAddress(ctx, vmID, wait)
+}
+
+// ipFromDHCP looks a VM's IP address up in the host's DHCP leases. Bridged
+// VMs lease from the LAN's DHCP server, so they aren't found there.
+func (m *Manager) ipFromDHCP(ctx context.Context, vmID string, config *vmConfig, wait time.Duration) (string, error) {
+	mac, err := configMAC(config)
+	if err != nil {
+		return "", err
+	}
+	if config.Network.Type == "bridged" {
+		return "", fmt.Errorf("bridged VMs don't lease from the host")
+	}
+	return utils.LookupDHCPLease(m.cfg.DHCPLeasesPath, mac)
+}
+
+// ipFromARP looks a VM's IP address up in the host's ARP table. While
+// waiting for a booting VM, the vmnet subnets are swept first, so a guest
+// that hasn't talked to the host yet gets an entry.
+func (m *Manager) ipFromARP(ctx context.Context, vmID string, config *vmConfig, wait time.Duration) (string, error) {
+	mac, err := configMAC(config)
+	if err != nil {
+		return "", err
+	}
+	if wait > 0 {
+		if err := utils.SweepVMNetworks(ctx); err != nil {
+			log.Printf("Warning: Could not sweep the VM networks for VM %s: %v", vmID, err)
+		}
+	}
+	return m.commands.LookupARP(ctx, mac)
+}
+
+// configMAC returns the MAC address from a VM's config.
+func configMAC(config *vmConfig) (net.HardwareAddr, error) {
+	if config == nil {
+		return nil, fmt.Errorf("VM has no config to take its MAC address from")
+	}
+	return net.ParseMAC(config.Network.MACAddress)
+}
+
+// waitForIP polls for a booting VM's IP address until it has one or ctx is
+// done, and records which strategy found it.
+func (m *Manager) waitForIP(ctx context.Context, vmID string) error {
+	for {
+		ip, method, err := m.discoverIP(ctx, vmID, ipWaitStep)
+		if err == nil {
+			log.Printf("VM %s has IP address %s, found via %s", vmID, ip, method)
+			m.recordIPDiscovery(vmID, method)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-time.After(sshPollInterval):
+		}
+	}
+}
+
+// recordIPDiscovery records the strategy that found a VM's IP address, for
+// its provision report and the discovery counts.
+func (m *Manager) recordIPDiscovery(vmID, method string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ipMethods[vmID] = method
+	m.ipCounts[method]++
+}
+
+// ipMethod returns the strategy that found a VM's IP address while it booted.
+func (m *Manager) ipMethod(vmID string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ipMethods[vmID]
+}
+
+// forgetIPMethod drops the IP discovery strategy of a VM that is gone.
+func (m *Manager) forgetIPMethod(vmID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.ipMethods, vmID)
+}
+
+// IPDiscoveries returns how many booting VMs each IP discovery strategy
+// found the address of since the agent started.
+func (m *Manager) IPDiscoveries() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[string]int64, len(ipStrategies))
+	for name := range ipStrategies {
+		counts[name] = m.ipCounts[name]
+	}
+	return counts
+}
+
+// applyTartConfig sets the MAC address, CPUs, memory, display size, machine
+// identifier and hardware model from a VM's config on its tart VM before it
+// boots. Tart keeps the last two base64-encoded as ecid and hardwareModel, the
+// form the VM's config holds them in. Without a hardware model, the one the
+// tart VM was cloned with is kept.
+func (m *Manager) applyTartConfig(vmID string) error {
+	config, err := m.readVMConfig(vmID)
+	if err != nil {
+		return err
+	}
+	fields, err := tartHardware(config)
+	if err != nil {
+		return err
+	}
+	fields["macAddress"] = config.Network.MACAddress
+	if config.MachineIdentifier != "" {
+		fields["ecid"] = config.MachineIdentifier
+	}
+	if config.HardwareModel != "" {
+		fields["hardwareModel"] = config.HardwareModel
+	}
+	return utils.SetTartConfig(vmID, fields)
+}
+
+// RunArgs returns the `tart run` arguments that apply a VM's network config
+// and attach its data disks, so it keeps them whenever it is started or resumed.
+func (m *Manager) RunArgs(vmID string) []string {
+	config, err := m.readVMConfig(vmID)
+	if err != nil {
+		return nil
+	}
+	args := utils.TartNetworkArgs(config.Network.Type, config.Network.Interface)
+	for _, disk := range config.Disks {
+		args = append(args, "--disk="+m.paths.DataDiskPath(vmID, disk.Name))
+	}
+	return args
+}
+
+// Launch returns how a VM is started or resumed: with its RunArgs, at the
+// scheduling priority of its CPU policy, with its output going to vm.log in
+// its logs directory and its PID to its PID file.
+func (m *Manager) Launch(vmID string) utils.VMLaunch {
+	launch := utils.VMLaunch{
+		Args:      m.RunArgs(vmID),
+		Log:       filepath.Join(m.paths.LogsDir(vmID), vmLogName),
+		LogPolicy: logrotate.FromConfig(m.cfg),
+		PIDFile:   m.paths.PIDPath(vmID),
+	}
+	if config, err := m.readVMConfig(vmID); err == nil {
+		launch.CPU = config.CPUPolicy
+	}
+	return launch
+}
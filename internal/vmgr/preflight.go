@@ -0,0 +1,57 @@
+package vmgr
+
+import (
+	"context"
+	"log"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// Preflight checks that the image download (if the image isn't cached) and the
+// VM clone will fit on disk, evicting cached images if needed. It returns an
+// error wrapping imagemgr.ErrInsufficientStorage if space can't be freed, or
+// imagemgr.ErrSmokeTestFailed if the cached image failed its smoke test, or
+// imagemgr.ErrArchMismatch if the image is built for another architecture.
+func (m *Manager) Preflight(ctx context.Context, cmd models.VMProvisionCommand) error {
+	if err := m.imageManager.CheckUsable(ctx, cmd.ImageName); err != nil {
+		return err
+	}
+	if err := m.imageManager.CheckRequirements(cmd.ImageName, cmd.ImageRequirements); err != nil {
+		return err
+	}
+	if err := m.imageManager.CheckArch(ctx, cmd.ImageName); err != nil {
+		return err
+	}
+
+	size, err := m.imageManager.ImageSize(ctx, cmd.ImageName)
+	if err != nil {
+		// Don't block provisioning on a metadata lookup; the download reports real errors.
+		log.Printf("Warning: Skipping disk preflight for VM %s: %v", cmd.VMID, err)
+		return nil
+	}
+
+	// The clone is expected to be as large as the image itself.
+	cloneBytes := size
+	downloadBytes := int64(0)
+	if _, cached := m.imageManager.GetCachedImagePath(cmd.ImageName); !cached {
+		downloadBytes = size
+	}
+
+	if downloadBytes > 0 {
+		_, cacheVolume, err := m.commands.GetFreeDiskSpace(m.cfg.ImageCacheDir)
+		if err != nil {
+			return err
+		}
+		_, vmsVolume, err := m.commands.GetFreeDiskSpace(m.paths.Root())
+		if err != nil {
+			return err
+		}
+		if cacheVolume == vmsVolume {
+			// Both land on the same volume, so it needs room for both at once.
+			cloneBytes += downloadBytes
+		} else if err := m.imageManager.EnsureFreeSpace(m.cfg.ImageCacheDir, downloadBytes, cmd.ImageName); err != nil {
+			return err
+		}
+	}
+	return m.imageManager.EnsureFreeSpace(m.paths.Root(), cloneBytes, cmd.ImageName)
+}
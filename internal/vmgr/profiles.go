@@ -0,0 +1,69 @@
+package vmgr
+
+import (
+	"github.com/changty97/macvmagt/internal/config"
+)
+
+// Workloads, the CI agents a VM can be provisioned for.
+const (
+	workloadGitHub    = "github"
+	workloadBuildkite = "buildkite"
+	workloadGitLab    = "gitlab"
+)
+
+// workloadProfile is how the CI agent of a workload is installed, registered
+// and checked on.
+type workloadProfile struct {
+	name        string
+	scriptPath  func(cfg *config.Config) string // Install script template streamed into the VM
+	tokenSecret func(cfg *config.Config) string // Secret the script's registration token is fetched from
+	// process matches the agent's process for pgrep -f. An ephemeral agent's
+	// is gone once it finished its job.
+	process string
+	logs    []string // Files and directories in the guest with the agent's logs
+}
+
+// workloadProfiles are the known workloads, by name.
+var workloadProfiles = map[string]workloadProfile{
+	workloadGitHub: {
+		name:        workloadGitHub,
+		scriptPath:  func(cfg *config.Config) string { return cfg.RunnerScriptPath },
+		tokenSecret: func(cfg *config.Config) string { return cfg.RunnerTokenSecret },
+		process:     "Runner.Listener",
+		logs:        []string{runnerHome + "/_diag", runnerHome + "/runner.log"},
+	},
+	workloadBuildkite: {
+		name:        workloadBuildkite,
+		scriptPath:  func(cfg *config.Config) string { return cfg.BuildkiteScriptPath },
+		tokenSecret: func(cfg *config.Config) string { return cfg.BuildkiteTokenSecret },
+		process:     "buildkite-agent start",
+		logs:        []string{"/Users/runner/buildkite-agent/agent.log"},
+	},
+	workloadGitLab: {
+		name:        workloadGitLab,
+		scriptPath:  func(cfg *config.Config) string { return cfg.GitLabScriptPath },
+		tokenSecret: func(cfg *config.Config) string { return cfg.GitLabTokenSecret },
+		process:     "gitlab-runner run", // Also matches run-single, which ephemeral runners use
+		logs:        []string{"/Users/runner/gitlab-runner/runner.log"},
+	},
+}
+
+// profileFor returns the profile of a workload requested in a provision
+// request, GitHub Actions if it requested none. Requests are validated, so
+// the workload is known.
+func profileFor(workload string) workloadProfile {
+	if profile, ok := workloadProfiles[workload]; ok {
+		return profile
+	}
+	return workloadProfiles[workloadGitHub]
+}
+
+// workloadOf returns the profile of the CI agent installed in a VM, GitHub
+// Actions for VMs provisioned before workloads were recorded.
+func (m *Manager) workloadOf(vmID string) workloadProfile {
+	config, err := m.readVMConfig(vmID)
+	if err != nil || config.Runner == nil {
+		return profileFor("")
+	}
+	return profileFor(config.Runner.Workload)
+}
@@ -0,0 +1,95 @@
+package vmgr
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// dialGrace is added to ReachabilityTimeout to cover connecting to the VM.
+const dialGrace = 20 * time.Second
+
+// checkReachability curls every configured endpoint from inside the VM, so
+// guest networking problems (DNS, proxy, firewall) show up at provision time
+// instead of as failing clones in the first job. Any HTTP response counts as
+// reachable; only connection-level failures don't.
+func (m *Manager) checkReachability(ctx context.Context, vmID string) []models.ReachabilityResult {
+	client := m.ssh.Client(vmID)
+	timeoutSeconds := int(math.Ceil(m.cfg.ReachabilityTimeout.Seconds()))
+	if timeoutSeconds < 1 {
+		timeoutSeconds = 1
+	}
+
+	results := make([]models.ReachabilityResult, 0, len(m.cfg.ReachabilityEndpoints))
+	for _, endpoint := range m.cfg.ReachabilityEndpoints {
+		url := endpoint
+		if !strings.Contains(url, "://") {
+			url = "https://" + url
+		}
+		command := fmt.Sprintf("curl -sS -o /dev/null --max-time %d -w '%%{http_code} %%{time_total}' %s",
+			timeoutSeconds, shellQuote(url))
+
+		result := models.ReachabilityResult{Endpoint: endpoint}
+		// Leave curl time to report its own timeout before the session is killed.
+		curlCtx, cancel := context.WithTimeout(ctx, m.cfg.ReachabilityTimeout+dialGrace)
+		output, err := client.Run(curlCtx, command, nil)
+		cancel()
+		if err != nil {
+			result.Error = strings.TrimSpace(output)
+			if result.Error == "" {
+				result.Error = err.Error()
+			}
+		} else {
+			fields := strings.Fields(output)
+			if len(fields) == 2 {
+				result.HTTPStatus, _ = strconv.Atoi(fields[0])
+				if seconds, err := strconv.ParseFloat(fields[1], 64); err == nil {
+					result.LatencyMs = int64(seconds * 1000)
+				}
+			}
+			result.Reachable = result.HTTPStatus != 0
+			if !result.Reachable {
+				result.Error = fmt.Sprintf("no HTTP response (curl: %s)", strings.TrimSpace(output))
+			}
+		}
+		if !result.Reachable {
+			log.Printf("Warning: VM %s cannot reach %s: %s", vmID, endpoint, result.Error)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Reachability returns the network self-test results recorded for a VM, if any.
+func (m *Manager) Reachability(vmID string) []models.ReachabilityResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reachability[vmID]
+}
+
+func (m *Manager) setReachability(vmID string, results []models.ReachabilityResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if results == nil {
+		delete(m.reachability, vmID)
+		return
+	}
+	m.reachability[vmID] = results
+}
+
+// unreachableEndpoints lists the endpoints that failed the self-test.
+func unreachableEndpoints(results []models.ReachabilityResult) []string {
+	var failed []string
+	for _, result := range results {
+		if !result.Reachable {
+			failed = append(failed, result.Endpoint)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,114 @@
+package vmgr
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// provisioningDir holds a marker per in-flight provision, under the state
+// directory. A marker left at startup belongs to a provision the agent
+// crashed or was killed during.
+const provisioningDir = "provisioning"
+
+// InterruptedProvision is a provision found unfinished at startup.
+type InterruptedProvision struct {
+	VMID      string    `json:"vmId"`
+	ImageName string    `json:"imageName,omitempty"`
+	RequestID string    `json:"requestId,omitempty"` // Of the provision's command
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// markerPath returns the path of the marker of a VM's in-flight provision.
+func (m *Manager) markerPath(vmID string) string {
+	return filepath.Join(m.cfg.StateDir, provisioningDir, vmID+".json")
+}
+
+// markProvisioning records that a VM is being provisioned until
+// unmarkProvisioning is called, so a crash in between is noticed at startup.
+func (m *Manager) markProvisioning(vmID, imageName, requestID string) {
+	path := m.markerPath(vmID)
+	data, err := json.Marshal(InterruptedProvision{VMID: vmID, ImageName: imageName, RequestID: requestID, StartedAt: time.Now().UTC()})
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		log.Printf("Warning: Could not mark VM %s as provisioning: %v", vmID, err)
+	}
+}
+
+// unmarkProvisioning removes the marker of a VM's finished provision.
+func (m *Manager) unmarkProvisioning(vmID string) {
+	if err := os.Remove(m.markerPath(vmID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: Could not remove provisioning marker of VM %s: %v", vmID, err)
+	}
+}
+
+// RecoverInterrupted cleans up after an agent that crashed or was killed:
+// VMs whose provision was in flight are torn down, since their request,
+// including its runner registration, isn't kept and the provision can't be
+// resumed, and so are VM directories without a config, which only an
+// interrupted clone leaves. VMs that finished provisioning are kept as they
+// are. It returns
+// the interrupted provisions, so the orchestrator can reschedule them, and
+// must run before the agent accepts commands.
+func (m *Manager) RecoverInterrupted() []InterruptedProvision {
+	interrupted := m.interruptedProvisions()
+	torndown := make(map[string]bool)
+	for _, provision := range interrupted {
+		log.Printf("Provision of VM %s started at %s was interrupted, tearing the VM down", provision.VMID, provision.StartedAt.Format(time.RFC3339))
+		m.teardownVM(provision.VMID)
+		m.unmarkProvisioning(provision.VMID)
+		torndown[provision.VMID] = true
+	}
+
+	if vmIDs, err := m.paths.List(); err == nil {
+		for _, vmID := range vmIDs {
+			if torndown[vmID] || IsStandby(vmID) { // Stale standbys are removed by the warm pool
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(m.paths.ConfigDir(vmID), "config.json")); !os.IsNotExist(err) {
+				continue
+			}
+			log.Printf("VM directory %s has no config, removing the half-created VM", m.paths.VMDir(vmID))
+			m.teardownVM(vmID)
+			interrupted = append(interrupted, InterruptedProvision{VMID: vmID})
+		}
+	} else {
+		log.Printf("Warning: Could not list VM directories for interrupted provisions: %v", err)
+	}
+
+	return interrupted
+}
+
+// interruptedProvisions reads the markers of provisions left in flight.
+func (m *Manager) interruptedProvisions() []InterruptedProvision {
+	dir := filepath.Join(m.cfg.StateDir, provisioningDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: Could not read provisioning markers in %s: %v", dir, err)
+		}
+		return nil
+	}
+	var interrupted []InterruptedProvision
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		provision := InterruptedProvision{VMID: strings.TrimSuffix(entry.Name(), ".json")}
+		if data, err := os.ReadFile(filepath.Join(dir, entry.Name())); err == nil {
+			if err := json.Unmarshal(data, &provision); err != nil {
+				log.Printf("Warning: Could not parse provisioning marker of VM %s: %v", provision.VMID, err)
+			}
+		}
+		interrupted = append(interrupted, provision)
+	}
+	return interrupted
+}
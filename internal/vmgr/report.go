@@ -0,0 +1,79 @@
+package vmgr
+
+import (
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/operations"
+)
+
+// maxProvisionReports is how many reports of finished provisions are kept.
+const maxProvisionReports = 100
+
+// reportStages maps the provision phases and sub-steps to the stage of the
+// provision report they count towards.
+var reportStages = map[string]func(r *models.ProvisionReport) *int64{
+	"waiting for image download": func(r *models.ProvisionReport) *int64 { return &r.DownloadMs },
+	"clone disk":                 func(r *models.ProvisionReport) *int64 { return &r.CloneMs },
+	"adopt standby":              func(r *models.ProvisionReport) *int64 { return &r.CloneMs },
+	"booting":                    func(r *models.ProvisionReport) *int64 { return &r.BootToIPMs },
+	"capturing host key":         func(r *models.ProvisionReport) *int64 { return &r.BootToIPMs },
+	"waiting for IP":             func(r *models.ProvisionReport) *int64 { return &r.BootToIPMs },
+	"waiting for SSH":            func(r *models.ProvisionReport) *int64 { return &r.SSHReadyMs },
+	"installing runner":          func(r *models.ProvisionReport) *int64 { return &r.RunnerInstallMs },
+}
+
+// recordProvisionReport builds the report of a finished provision from the
+// timings of its operation and keeps it, dropping the oldest beyond
+// maxProvisionReports.
+func (m *Manager) recordProvisionReport(op *operations.Operation, cmd models.VMProvisionCommand, started time.Time, adopted bool, err error) {
+	report := models.ProvisionReport{
+		VMID:         cmd.VMID,
+		ImageName:    cmd.ImageName,
+		Succeeded:    err == nil,
+		FromWarmPool: adopted,
+		StartedAt:    started.UTC(),
+		TotalMs:      time.Since(started).Milliseconds(),
+		Steps:        op.Timings(),
+		IPDiscovery:  m.ipMethod(cmd.VMID),
+	}
+	if err != nil {
+		report.FailedPhase = op.Phase()
+		report.TimedOutStage = TimedOutStage(err)
+	}
+	for _, step := range report.Steps {
+		if stage, ok := reportStages[step.Name]; ok {
+			*stage(&report) += step.DurationMs
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reports = append(m.reports, report)
+	if len(m.reports) > maxProvisionReports {
+		m.reports = m.reports[len(m.reports)-maxProvisionReports:]
+	}
+}
+
+// ProvisionReports returns the reports of recent provisions, newest first,
+// only those of vmID if it isn't empty.
+func (m *Manager) ProvisionReports(vmID string) []models.ProvisionReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reports := []models.ProvisionReport{}
+	for i := len(m.reports) - 1; i >= 0; i-- {
+		if vmID == "" || m.reports[i].VMID == vmID {
+			reports = append(reports, m.reports[i])
+		}
+	}
+	return reports
+}
+
+// ProvisionReport returns the report of the latest provision of a VM.
+func (m *Manager) ProvisionReport(vmID string) (models.ProvisionReport, bool) {
+	reports := m.ProvisionReports(vmID)
+	if len(reports) == 0 {
+		return models.ProvisionReport{}, false
+	}
+	return reports[0], true
+}
@@ -0,0 +1,46 @@
+package vmgr
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// guestRunnerPackage is where the cached GitHub runner package is uploaded in VMs.
+const guestRunnerPackage = "/tmp/actions-runner.tar.gz"
+
+// usesRunnerPackage reports whether the runner of a request is installed
+// from the agent's cached runner package.
+func usesRunnerPackage(cfg *config.Config, cmd models.VMProvisionCommand) bool {
+	return cfg.RunnerPackageCache && profileFor(cmd.Workload).name == workloadGitHub
+}
+
+// PrefetchRunnerPackage caches the GitHub runner package, so the first
+// provision doesn't wait for its download.
+func (m *Manager) PrefetchRunnerPackage() {
+	if _, err := m.runnerPkgs.Get(context.Background()); err != nil {
+		log.Printf("Warning: Could not cache the GitHub runner package: %v", err)
+	}
+}
+
+// uploadRunnerPackage uploads the cached GitHub runner package into a VM over
+// SFTP. Failing is only logged, since the install script then downloads the
+// runner itself.
+func (m *Manager) uploadRunnerPackage(ctx context.Context, vmID string) {
+	pkg, err := m.runnerPkgs.Get(ctx)
+	if err == nil {
+		var file *os.File
+		if file, err = os.Open(pkg.Path); err == nil {
+			err = m.ssh.Client(vmID).Upload(ctx, file, guestRunnerPackage, 0644)
+			file.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: Could not upload the cached runner package into VM %s, it downloads the runner itself: %v", vmID, err)
+		return
+	}
+	log.Printf("Uploaded GitHub runner %s into VM %s.", pkg.Version, vmID)
+}
@@ -0,0 +1,227 @@
+package vmgr
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/github"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/sshclient"
+)
+
+// defaultRunnerLabels are applied when a provision request specifies no labels.
+var defaultRunnerLabels = []string{"macos"}
+
+// guestScriptDir is where the runner install script is uploaded in VMs to
+// run. It is removed once it ran.
+const guestScriptDir = "/tmp"
+
+// Environment variables the runner install script gets its secrets from, so
+// they are neither written into the uploaded script nor passed as arguments.
+const (
+	envRunnerToken = "MACVMAGT_RUNNER_TOKEN" // RunnerScriptData.Token
+	envJITConfig   = "MACVMAGT_JIT_CONFIG"   // RunnerScriptData.JITConfig
+	envGuestToken  = "MACVMAGT_GUEST_TOKEN"  // RunnerScriptData.GuestToken
+)
+
+// RunnerScriptData holds the values the runner install script template is rendered with.
+type RunnerScriptData struct {
+	RunnerName  string
+	Org         string
+	Repo        string
+	RunnerGroup string
+	Labels      string // Comma-separated, as expected by config.sh --labels and buildkite-agent --tags
+	Ephemeral   bool
+	// Secrets, also passed in the script's environment as MACVMAGT_RUNNER_TOKEN,
+	// MACVMAGT_JIT_CONFIG and MACVMAGT_GUEST_TOKEN. Scripts should read them
+	// from there, so they don't end up in the script file.
+	Token     string // Registration token of the workload's CI agent; empty in JIT mode
+	JITConfig string // Encoded just-in-time runner config; empty in token mode
+	ServerURL string // GitLab instance GitLab runners register with; empty for other workloads
+	// RunnerPackage is where the agent uploads its cached GitHub runner
+	// package in the VM; empty if the VM downloads the runner itself. The
+	// script downloads it too if the upload failed.
+	RunnerPackage string
+	// Guest helper settings; all empty unless guest events are enabled.
+	GuestEventsURL string // Where the guest helper posts the VM's events
+	GuestToken     string // Authenticates the guest helper's events
+	GuestAgentPin  string // Public key pin of the agent's HTTPS certificate; empty verifies it against the guest's CAs
+}
+
+// scriptFuncs are the helpers available to the runner script template.
+var scriptFuncs = template.FuncMap{
+	"shellquote": shellQuote,
+}
+
+// shellQuote wraps s in single quotes so it is passed to bash verbatim.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runnerName returns the unique GitHub runner name for a VM on this node.
+func runnerName(cfg *config.Config, vmID string) string {
+	return fmt.Sprintf("macvmorx-runner-%s-%s", cfg.NodeID, vmID)
+}
+
+// newRunnerScriptData builds the template data for a request, without secrets.
+func newRunnerScriptData(cfg *config.Config, cmd models.VMProvisionCommand, name string) (RunnerScriptData, []string, error) {
+	profile := profileFor(cmd.Workload)
+	if profile.name == workloadGitHub && cmd.GitHubOrg == "" {
+		return RunnerScriptData{}, nil, fmt.Errorf("githubOrg is required to register a runner")
+	}
+
+	labels := cmd.Labels
+	if len(labels) == 0 {
+		labels = defaultRunnerLabels
+	}
+
+	data := RunnerScriptData{
+		RunnerName:  name,
+		Org:         cmd.GitHubOrg,
+		Repo:        cmd.GitHubRepo,
+		RunnerGroup: cmd.RunnerGroup,
+		Labels:      strings.Join(labels, ","),
+		Ephemeral:   cmd.Ephemeral,
+	}
+	if profile.name == workloadGitLab {
+		data.ServerURL = cfg.GitLabURL
+	}
+	if usesRunnerPackage(cfg, cmd) {
+		data.RunnerPackage = guestRunnerPackage
+	}
+	return data, labels, nil
+}
+
+// executeRunnerScript parses the script template at path, the install script
+// of a workload, and renders it with data.
+func executeRunnerScript(path string, data RunnerScriptData) ([]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read runner script %s: %w", path, err)
+	}
+	tmpl, err := template.New("runner").Funcs(scriptFuncs).Option("missingkey=error").Parse(string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse runner script template %s: %w", path, err)
+	}
+
+	var script bytes.Buffer
+	if err := tmpl.Execute(&script, data); err != nil {
+		return nil, fmt.Errorf("failed to render runner script: %w", err)
+	}
+	return script.Bytes(), nil
+}
+
+// runnerScriptEnv returns the secrets in data as the environment the runner
+// install script runs with.
+func runnerScriptEnv(data RunnerScriptData) map[string]string {
+	return map[string]string{
+		envRunnerToken: data.Token,
+		envJITConfig:   data.JITConfig,
+		envGuestToken:  data.GuestToken,
+	}
+}
+
+// renderRunnerScript renders the install script of the request's workload,
+// fetching the registration token from the secrets provider, and returns it
+// with the environment holding its secrets.
+func (m *Manager) renderRunnerScript(ctx context.Context, cmd models.VMProvisionCommand, name string) ([]byte, map[string]string, error) {
+	data, labels, err := newRunnerScriptData(m.cfg, cmd, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	profile := profileFor(cmd.Workload)
+	if profile.name == workloadGitHub && usesJIT(m.cfg) {
+		// The agent registers the runner itself; the VM only receives the encoded config.
+		data.JITConfig, err = m.github.GenerateJITConfig(ctx, cmd.InstallationToken, github.JITConfigRequest{
+			Org:         cmd.GitHubOrg,
+			Repo:        cmd.GitHubRepo,
+			RunnerName:  name,
+			RunnerGroup: cmd.RunnerGroup,
+			Labels:      labels,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to register JIT runner: %w", err)
+		}
+	} else {
+		data.Token, err = m.secrets.GetSecret(ctx, profile.tokenSecret(m.cfg))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch %s registration token: %w", profile.name, err)
+		}
+	}
+
+	if m.cfg.GuestEvents {
+		config, err := m.readVMConfig(cmd.VMID)
+		if err != nil {
+			return nil, nil, err
+		}
+		data.GuestEventsURL = guestEventsURL(m.cfg.GuestAgentURL, cmd.VMID)
+		data.GuestToken = config.GuestToken
+		if strings.HasPrefix(data.GuestEventsURL, "https://") {
+			data.GuestAgentPin = m.agentPin
+		}
+	}
+
+	script, err := executeRunnerScript(runnerScriptPath(m.cfg, m.profiles, cmd), data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return script, runnerScriptEnv(data), nil
+}
+
+// runScriptFile uploads script into the VM over SFTP and runs it from there
+// with interpreter, in the environment env, removing it afterwards. The
+// environment is sourced from stdin rather than set on the command line, so
+// the secrets in it don't show in the guest's process list, and the script
+// runs as written however it quotes, unlike one fed to the interpreter inline.
+func runScriptFile(ctx context.Context, client *sshclient.Client, interpreter string, script []byte, env map[string]string) (string, error) {
+	interpreter, _, err := parseInterpreter(interpreter)
+	if err != nil {
+		return "", err
+	}
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to name script file: %w", err)
+	}
+	remotePath := path.Join(guestScriptDir, "macvmagt-script-"+hex.EncodeToString(suffix))
+
+	if err := client.Upload(ctx, bytes.NewReader(script), remotePath, 0700); err != nil {
+		return "", err
+	}
+	defer func() {
+		// Removed even if ctx is done, e.g. when the attempt timed out.
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		if err := client.Remove(cleanupCtx, remotePath); err != nil {
+			log.Printf("Warning: Failed to remove script file from VM %s: %v", client.VMID(), err)
+		}
+	}()
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var environment strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&environment, "%s=%s\n", name, shellQuote(env[name]))
+	}
+	command := fmt.Sprintf("set -a && . /dev/stdin && set +a && %s %s", interpreter, remotePath)
+	return client.Run(ctx, command, strings.NewReader(environment.String()))
+}
+
+// usesJIT reports whether runners are registered with just-in-time configs.
+func usesJIT(cfg *config.Config) bool {
+	return cfg.RunnerRegistration == "jit"
+}
@@ -0,0 +1,108 @@
+package vmgr
+
+import (
+	"log"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// vmClock holds when a VM was confirmed booted and became ready. Times taken
+// with time.Now carry a monotonic reading, so durations measured from them
+// are immune to the host clock being stepped, e.g. by NTP after sleep.
+type vmClock struct {
+	created time.Time // Wall-clock creation time from the VM's config, for its age
+	booted  time.Time
+	ready   time.Time // Zero until the provision succeeded
+}
+
+// markBooted records that a VM answered over SSH, or was adopted from the
+// warm pool, from when its runtime is counted.
+func (m *Manager) markBooted(vmID string) {
+	m.setClock(vmID, func(clock *vmClock, config *vmConfig, now time.Time) {
+		clock.booted = now
+		config.BootedAt = now
+	})
+}
+
+// markReady records that a VM's provision succeeded.
+func (m *Manager) markReady(vmID string) {
+	m.setClock(vmID, func(clock *vmClock, config *vmConfig, now time.Time) {
+		clock.ready = now
+		config.ReadyAt = now
+	})
+}
+
+// setClock updates a VM's clock and persists the wall-clock time in its
+// config, so it survives agent restarts.
+func (m *Manager) setClock(vmID string, fn func(clock *vmClock, config *vmConfig, now time.Time)) {
+	now := time.Now()
+	config, err := m.readVMConfig(vmID)
+	if err != nil {
+		config = &vmConfig{VMID: vmID} // Still tracked in memory
+	}
+	m.mu.Lock()
+	clock := m.clocks[vmID]
+	clock.created = config.CreatedAt
+	fn(&clock, config, now)
+	m.clocks[vmID] = clock
+	m.mu.Unlock()
+	if err == nil {
+		err = m.saveVMConfig(config)
+	}
+	if err != nil {
+		log.Printf("Warning: Could not persist boot and ready times of VM %s, they are lost on restart: %v", vmID, err)
+	}
+}
+
+// forgetClock drops the clock of a VM that is gone.
+func (m *Manager) forgetClock(vmID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.clocks, vmID)
+}
+
+// Runtime returns how long a VM has run since it booted, how long it has been
+// ready and its wall-clock age since it was created, in seconds. After an
+// agent restart the clock is restored from the times persisted in the VM's
+// config, and only the restart gap is measured with the wall clock; a clock
+// stepped back across it counts as no time having passed.
+func (m *Manager) Runtime(vmID string) models.VMRuntime {
+	m.mu.Lock()
+	clock, ok := m.clocks[vmID]
+	m.mu.Unlock()
+	if !ok {
+		config, err := m.readVMConfig(vmID)
+		if err != nil {
+			return models.VMRuntime{}
+		}
+		now := time.Now()
+		clock = vmClock{created: config.CreatedAt, booted: restoreTime(now, config.BootedAt), ready: restoreTime(now, config.ReadyAt)}
+		m.mu.Lock()
+		if _, raced := m.clocks[vmID]; !raced {
+			m.clocks[vmID] = clock
+		}
+		m.mu.Unlock()
+	}
+
+	var lifetime models.VMRuntime
+	if !clock.booted.IsZero() {
+		lifetime.RuntimeSeconds = int64(time.Since(clock.booted).Seconds())
+	}
+	if !clock.ready.IsZero() {
+		lifetime.ReadySeconds = int64(time.Since(clock.ready).Seconds())
+	}
+	if !clock.created.IsZero() {
+		lifetime.AgeSeconds = max(int64(time.Since(clock.created).Seconds()), 0)
+	}
+	return lifetime
+}
+
+// restoreTime turns a wall-clock time read from disk into one with a
+// monotonic reading relative to now, not later than now.
+func restoreTime(now, wall time.Time) time.Time {
+	if wall.IsZero() {
+		return time.Time{}
+	}
+	return now.Add(-max(now.Sub(wall), 0))
+}
@@ -0,0 +1,68 @@
+package vmgr
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// shutdownCommand powers the guest off from inside, letting macOS flush its disks.
+const shutdownCommand = "sudo shutdown -h now"
+
+// shutdownPollInterval is how often the VM state is checked while waiting for the guest to power off.
+const shutdownPollInterval = 2 * time.Second
+
+// ShutdownVM powers a VM off while keeping it and its disk. The guest is asked
+// to shut down over SSH first; if it is still running after
+// GuestShutdownTimeout, the VM is stopped through the hypervisor instead.
+func (m *Manager) ShutdownVM(vmID string) error {
+	log.Printf("Received request to shut down VM %s", vmID)
+	op := m.ops.Start("shutdown", vmID)
+	defer op.Done()
+
+	unlock, err := m.lockVM(context.Background(), vmID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	op.SetPhase("requesting guest shutdown")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// The connection drops as the guest goes down, so an error here is expected
+	// and only matters if the VM then fails to stop.
+	if _, err := m.ssh.Client(vmID).Run(ctx, shutdownCommand, nil); err != nil {
+		log.Printf("Guest shutdown command on VM %s returned: %v", vmID, err)
+	}
+	cancel()
+	m.ssh.Close(vmID)
+
+	op.SetPhase("waiting for guest to power off")
+	op.SetDeadline(time.Now().Add(m.cfg.GuestShutdownTimeout))
+	if m.waitForStop(vmID, m.cfg.GuestShutdownTimeout) {
+		log.Printf("VM %s shut down by the guest.", vmID)
+	} else {
+		log.Printf("VM %s did not power off within %s, stopping it through the hypervisor", vmID, m.cfg.GuestShutdownTimeout)
+		op.SetPhase("forcing stop")
+		if err := m.commands.StopVM(vmID); err != nil {
+			return fmt.Errorf("failed to shut down VM %s: %w", vmID, err)
+		}
+	}
+
+	m.setReachability(vmID, nil)
+	return nil
+}
+
+// waitForStop polls the VM state until it is no longer running or timeout elapses.
+func (m *Manager) waitForStop(vmID string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		state, err := m.commands.GetVMState(vmID)
+		if err != nil {
+			log.Printf("Warning: Could not get state of VM %s: %v", vmID, err)
+		} else if state != "running" {
+			return true
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package vmgr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// smokeTestVMPrefix names the throwaway VMs booted to smoke test images.
+const smokeTestVMPrefix = "smoke-test-"
+
+// sshPollInterval is how often a booting VM is probed until it answers over SSH.
+const sshPollInterval = 5 * time.Second
+
+// SmokeTestImage boots a throwaway VM from a newly downloaded image, waits for
+// it to answer over SSH and runs ImageSmokeTestScript in it, if one is
+// configured. The VM is torn down afterwards whatever the outcome. It returns
+// the script's output on success, and the tools found in the image.
+func (m *Manager) SmokeTestImage(ctx context.Context, imageName, imagePath string) (_ string, tools *models.ImageTools, err error) {
+	vmID := fmt.Sprintf("%s%d", smokeTestVMPrefix, time.Now().UnixNano())
+	log.Printf("Smoke testing image %s in VM %s", imageName, vmID)
+	op := m.ops.StartContext(ctx, "image-smoke-test", vmID)
+	defer func() {
+		op.Fail(err)
+		op.Done()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		op.SetDeadline(deadline)
+	}
+
+	op.SetPhase("creating VM")
+	if err := m.paths.Create(vmID); err != nil {
+		return "", nil, err
+	}
+	defer m.teardownVM(vmID)
+	if err := m.cloneVM(op.Trace(ctx), op, models.VMProvisionCommand{VMID: vmID, ImageName: imageName}, imagePath); err != nil {
+		return "", nil, err
+	}
+
+	op.SetPhase("booting")
+	if err := m.applyTartConfig(vmID); err != nil {
+		return "", nil, err
+	}
+	if err := m.commands.StartVM(vmID, m.Launch(vmID)); err != nil {
+		return "", nil, err
+	}
+	if err := m.hostKeys.Capture(op.Trace(ctx), vmID); err != nil {
+		log.Printf("Warning: %v; falling back to trust-on-first-use", err)
+	}
+
+	op.SetPhase("waiting for SSH")
+	if err := m.waitForSSH(op.Trace(ctx), vmID); err != nil {
+		return "", nil, fmt.Errorf("VM did not become reachable over SSH: %w", err)
+	}
+
+	op.SetPhase("inspecting tools")
+	if tools, err = m.inspectTools(op.Trace(ctx), vmID); err != nil {
+		log.Printf("Warning: Could not inspect the tools of image %s: %v", imageName, err)
+	}
+	if m.cfg.ImageSmokeTestScript == "" {
+		return "booted and reachable over SSH", tools, nil
+	}
+
+	op.SetPhase("running validation script")
+	script, err := os.ReadFile(m.cfg.ImageSmokeTestScript)
+	if err != nil {
+		return "", tools, fmt.Errorf("failed to read smoke test script %s: %w", m.cfg.ImageSmokeTestScript, err)
+	}
+	command, err := interpreterCommand("")
+	if err != nil {
+		return "", tools, err
+	}
+	output, err := m.ssh.Client(vmID).Run(op.Trace(ctx), command, bytes.NewReader(script))
+	if err != nil {
+		return "", tools, fmt.Errorf("validation script failed: %w", err)
+	}
+	return strings.TrimSpace(output), tools, nil
+}
+
+// waitForSSH probes a booting VM until a command round-trips over SSH or ctx is done.
+func (m *Manager) waitForSSH(ctx context.Context, vmID string) error {
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		_, err := m.checkSSH(probeCtx, m.ssh.Client(vmID))
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-time.After(sshPollInterval):
+		}
+	}
+}
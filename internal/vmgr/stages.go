@@ -0,0 +1,91 @@
+package vmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/operations"
+)
+
+// Provisioning stages with their own timeout.
+const (
+	stageDownload      = "download"       // Waiting for the image to download
+	stageCreate        = "create"         // Cloning the image and starting the VM
+	stageIP            = "ip"             // Waiting for the booted VM's IP address
+	stageSSH           = "ssh"            // Waiting for SSH to answer
+	stageRunnerInstall = "runner-install" // A single runner install attempt
+)
+
+// StageTimeoutError is returned by a provision that a stage's timeout ended.
+type StageTimeoutError struct {
+	Stage   string
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *StageTimeoutError) Error() string {
+	return fmt.Sprintf("stage %s timed out after %s: %v", e.Stage, e.Timeout, e.Err)
+}
+
+func (e *StageTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// TimedOutStage returns the stage whose timeout ended a failed provision, or
+// "" if none did.
+func TimedOutStage(err error) string {
+	var timeout *StageTimeoutError
+	if errors.As(err, &timeout) {
+		return timeout.Stage
+	}
+	return ""
+}
+
+// stageTimeout returns the configured timeout of a stage.
+func (m *Manager) stageTimeout(stage string) time.Duration {
+	switch stage {
+	case stageDownload:
+		return m.cfg.ImageDownloadTimeout
+	case stageCreate:
+		return m.cfg.VMCreateTimeout
+	case stageIP:
+		return m.cfg.IPTimeout
+	case stageSSH:
+		return m.cfg.SSHReadyTimeout
+	case stageRunnerInstall:
+		return m.cfg.RunnerInstallTimeout
+	}
+	return 0
+}
+
+// stageContext bounds a stage of a provision by its timeout, nested in the
+// provision's ctx. A timeout of zero or less means the stage has no limit of
+// its own, only the provision's.
+func (m *Manager) stageContext(ctx context.Context, stage string) (context.Context, context.CancelFunc) {
+	timeout := m.stageTimeout(stage)
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// showStageDeadline shows the deadline of the stage run with stageCtx on
+// op's current phase. Phases reset their deadline, so a stage spanning
+// several phases shows it on each.
+func showStageDeadline(op *operations.Operation, stageCtx context.Context) {
+	if deadline, ok := stageCtx.Deadline(); ok {
+		op.SetDeadline(deadline)
+	}
+}
+
+// stageError wraps the error of a stage run with stageCtx in a
+// StageTimeoutError if the stage's timeout ended it, rather than the
+// provision's ctx being canceled.
+func (m *Manager) stageError(ctx, stageCtx context.Context, stage string, err error) error {
+	if err == nil || ctx.Err() != nil || !errors.Is(stageCtx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	return &StageTimeoutError{Stage: stage, Timeout: m.stageTimeout(stage), Err: err}
+}
@@ -0,0 +1,31 @@
+package vmgr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+)
+
+func TestStageContext(t *testing.T) {
+	m := &Manager{cfg: &config.Config{IPTimeout: time.Minute, SSHReadyTimeout: 0}}
+
+	ctx, cancel := m.stageContext(context.Background(), stageIP)
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Minute {
+		t.Errorf("ip stage deadline = %v, %v, want within a minute", deadline, ok)
+	}
+
+	// A stage without a timeout is only bounded by the provision.
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel = m.stageContext(parent, stageSSH)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok || ctx.Err() != nil {
+		t.Fatalf("ssh stage with no timeout has a deadline or ended: %v", ctx.Err())
+	}
+	cancelParent()
+	if ctx.Err() == nil {
+		t.Errorf("ssh stage outlived the provision")
+	}
+}
@@ -0,0 +1,94 @@
+package vmgr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// defaultStepInterpreter runs provisioning steps that don't declare one.
+const defaultStepInterpreter = "bash"
+
+// shellInterpreters read a script from stdin with -s; everything else
+// (python3, ruby, perl, node, ...) is given "-".
+var shellInterpreters = map[string]bool{
+	"sh":   true,
+	"bash": true,
+	"zsh":  true,
+	"ksh":  true,
+	"dash": true,
+}
+
+// interpreterCommand builds the command that runs a script fed on stdin with
+// the given interpreter, e.g. "bash -s", "zsh -s" or "/usr/bin/env python3 -".
+func interpreterCommand(interpreter string) (string, error) {
+	interpreter, fields, err := parseInterpreter(interpreter)
+	if err != nil {
+		return "", err
+	}
+	if shellInterpreters[path.Base(fields[len(fields)-1])] {
+		return interpreter + " -s", nil
+	}
+	return interpreter + " -", nil
+}
+
+// parseInterpreter splits an interpreter into its fields, defaulting to
+// defaultStepInterpreter, and rejects ones that would be more than a command
+// line to the guest's shell.
+func parseInterpreter(interpreter string) (string, []string, error) {
+	interpreter = strings.TrimSpace(interpreter)
+	if interpreter == "" {
+		interpreter = defaultStepInterpreter
+	}
+	fields := strings.Fields(interpreter)
+	for _, field := range fields {
+		if strings.ContainsAny(field, ";&|`$<>()'\"\\") {
+			return "", nil, fmt.Errorf("invalid interpreter %q", interpreter)
+		}
+	}
+	return interpreter, fields, nil
+}
+
+// runSteps runs the request's custom provisioning steps in order, stopping at
+// the first failure.
+func (m *Manager) runSteps(ctx context.Context, vmID string, steps []models.ProvisionStep) error {
+	for i, step := range steps {
+		name := stepName(i, step)
+		command, err := interpreterCommand(step.Interpreter)
+		if err != nil {
+			return fmt.Errorf("step %s: %w", name, err)
+		}
+
+		timeout := m.cfg.ProvisionStepTimeout
+		if step.TimeoutSeconds > 0 {
+			timeout = time.Duration(step.TimeoutSeconds) * time.Second
+		}
+		stepCtx, span := tracing.Start(ctx, "provisioning step", attribute.String("macvmagt.step", name))
+		stepCtx, cancel := context.WithTimeout(stepCtx, timeout)
+
+		log.Printf("Running provisioning step %s on VM %s with %s...", name, vmID, command)
+		_, err = m.ssh.Client(vmID).Run(stepCtx, command, bytes.NewReader([]byte(step.Script)))
+		cancel()
+		tracing.End(span, err)
+		if err != nil {
+			return fmt.Errorf("step %s failed: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// stepName identifies a step in logs and dry-run output.
+func stepName(index int, step models.ProvisionStep) string {
+	if step.Name != "" {
+		return fmt.Sprintf("%d-%s", index+1, step.Name)
+	}
+	return fmt.Sprintf("%d", index+1)
+}
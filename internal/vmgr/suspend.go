@@ -0,0 +1,90 @@
+package vmgr
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// resumeTimeout bounds how long a resumed VM may take to show up as running.
+const resumeTimeout = time.Minute
+
+// SuspendVM saves a running VM's memory state to disk and stops it, freeing
+// its host RAM and VM slot until it is resumed.
+func (m *Manager) SuspendVM(vmID string) error {
+	log.Printf("Received request to suspend VM %s", vmID)
+	op := m.ops.Start("suspend", vmID)
+	defer op.Done()
+
+	unlock, err := m.lockVM(context.Background(), vmID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	op.SetPhase("suspending")
+	if err := m.commands.SuspendVM(vmID); err != nil {
+		op.Fail(err)
+		return err
+	}
+	m.ssh.Close(vmID) // The guest's connections don't survive the suspension
+	return nil
+}
+
+// ResumeVM restores a suspended VM from its saved state, with the same
+// network settings it was provisioned with, and waits for it to run. A warm
+// pool standby VM gives up its slot if it holds the last one.
+func (m *Manager) ResumeVM(vmID string) error {
+	log.Printf("Received request to resume VM %s", vmID)
+	op := m.ops.Start("resume", vmID)
+	defer op.Done()
+
+	unlock, err := m.lockVM(context.Background(), vmID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	op.SetPhase("waiting for a VM slot")
+	freeSlot, err := m.acquireSlot(context.Background())
+	if err != nil {
+		return err
+	}
+	defer freeSlot()
+
+	op.SetPhase("resuming")
+	m.yieldStandby()
+	if err := m.commands.ResumeVM(vmID, m.Launch(vmID)); err != nil {
+		op.Fail(err)
+		return err
+	}
+
+	op.SetPhase("waiting for VM to run")
+	op.SetDeadline(time.Now().Add(resumeTimeout))
+	deadline := time.Now().Add(resumeTimeout)
+	for time.Now().Before(deadline) {
+		if state, err := m.commands.GetVMState(vmID); err == nil && state == "running" {
+			return nil
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+	err = fmt.Errorf("VM %s is not running %s after resuming", vmID, resumeTimeout)
+	op.Fail(err)
+	return err
+}
+
+// SuspendedVMs returns the IDs of the VMs that are suspended to disk.
+func (m *Manager) SuspendedVMs() ([]string, error) {
+	states, err := m.commands.ListVMs()
+	if err != nil {
+		return nil, err
+	}
+	var suspended []string
+	for vmID, state := range states {
+		if state == "suspended" {
+			suspended = append(suspended, vmID)
+		}
+	}
+	sort.Strings(suspended)
+	return suspended, nil
+}
@@ -0,0 +1,66 @@
+package vmgr
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// CaptureTemplate caches the current disk of a VM as the image name, so new
+// VMs can be cloned from it, e.g. after it has warmed up simulator caches,
+// without uploading it to GCS and downloading it again. A running VM is
+// suspended first, so its disk doesn't change while it is copied; it stays
+// suspended and can be resumed afterwards.
+func (m *Manager) CaptureTemplate(ctx context.Context, vmID, name string) (_ models.ImageManifest, err error) {
+	log.Printf("Received request to capture VM %s as template %s", vmID, name)
+	op := m.ops.StartContext(ctx, "template-capture", vmID)
+	defer func() {
+		op.Fail(err)
+		op.Done()
+	}()
+
+	unlock, err := m.lockVM(ctx, vmID)
+	if err != nil {
+		return models.ImageManifest{}, err
+	}
+	defer unlock()
+	config, err := m.readVMConfig(vmID)
+	if err != nil {
+		return models.ImageManifest{}, err
+	}
+	state, err := m.commands.GetVMState(vmID)
+	if err != nil {
+		return models.ImageManifest{}, err
+	}
+	if state == "running" {
+		op.SetPhase("suspending")
+		if err := m.commands.SuspendVM(vmID); err != nil {
+			return models.ImageManifest{}, err
+		}
+		m.ssh.Close(vmID) // The guest's connections don't survive the suspension
+	}
+
+	op.SetPhase("copying disk")
+	return m.imageManager.AddTemplate(op.Context(), name, vmID, config.HardwareModel, func(ctx context.Context, diskPath, auxPath string) error {
+		if err := timeStep(op, "copy disk", func() error {
+			_, err := m.copyImage(ctx, m.paths.DiskPath(vmID), diskPath)
+			return err
+		}); err != nil {
+			return err
+		}
+		vmAux := filepath.Join(m.paths.AuxDir(vmID), "aux.img")
+		if _, err := os.Stat(vmAux); err != nil {
+			return nil // The backend keeps no aux image for the VM
+		}
+		return timeStep(op, "copy aux", func() error {
+			if _, err := m.copyImage(ctx, vmAux, auxPath); err != nil {
+				return fmt.Errorf("failed to copy aux image: %w", err)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,115 @@
+package vmgr
+
+import (
+	"net"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/utils"
+)
+
+// usageSample is the last resource usage sampled for a VM, with the CPU time
+// it was computed from.
+type usageSample struct {
+	cpuSeconds float64
+	at         time.Time
+	usage      models.VMResourceUsage
+}
+
+// DiskBytesFunc returns the disk space allocated to a VM as last sampled,
+// and whether it was.
+type DiskBytesFunc func(vmID string) (uint64, bool)
+
+// SetDiskBytes makes resource usage samples take VMs' disk usage from fn
+// rather than walking their directories each time. The disk usage sampler
+// measures it in the background, so it provides fn.
+func (m *Manager) SetDiskBytes(fn DiskBytesFunc) {
+	m.diskBytes = fn
+}
+
+// ProcessID returns the PID of the process running a VM: the one in its PID
+// file, or else, e.g. for VMs started by older agents, the one found in the
+// process table.
+func (m *Manager) ProcessID(vmID string) (int, error) {
+	if pid, err := utils.ReadPIDFile(m.paths.PIDPath(vmID)); err == nil {
+		return pid, nil
+	}
+	return m.commands.GetVMProcessID(vmID)
+}
+
+// ResourceUsage samples the resources a running VM uses. CPU usage is
+// averaged over the time since the VM's previous sample, so the first sample
+// of a VM reports 0. Network counters are only available for VMs attached to
+// a vmnet bridge, i.e. not bridged ones.
+func (m *Manager) ResourceUsage(vmID string) (*models.VMResourceUsage, error) {
+	pid, err := m.ProcessID(vmID)
+	if err != nil {
+		return nil, err
+	}
+	cpuSeconds, rss, err := utils.ProcessTreeUsage(pid)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	usage := models.VMResourceUsage{MemoryRSSBytes: rss}
+	if disk, ok := m.sampledDiskBytes(vmID); ok {
+		usage.DiskBytes = disk
+	} else if disk, err := utils.DirAllocatedBytes(m.paths.VMDir(vmID)); err == nil {
+		usage.DiskBytes = disk
+	}
+	if config, err := m.readVMConfig(vmID); err == nil && config.Network.Type != "bridged" {
+		if mac, err := net.ParseMAC(config.Network.MACAddress); err == nil {
+			if iface, err := m.commands.BridgeMemberForMAC(mac); err == nil {
+				// The host end of the interface sends what the guest receives.
+				if sent, received, err := utils.InterfaceCounters(iface); err == nil {
+					usage.NetworkInterface, usage.NetRxBytes, usage.NetTxBytes = iface, sent, received
+				}
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if previous, ok := m.usage[vmID]; ok {
+		if elapsed := now.Sub(previous.at).Seconds(); elapsed > 0 && cpuSeconds >= previous.cpuSeconds {
+			usage.CPUPercent = (cpuSeconds - previous.cpuSeconds) / elapsed * 100
+		}
+	}
+	m.usage[vmID] = usageSample{cpuSeconds: cpuSeconds, at: now, usage: usage}
+	return &usage, nil
+}
+
+// sampledDiskBytes returns a VM's disk usage as last sampled, if it was.
+func (m *Manager) sampledDiskBytes(vmID string) (uint64, bool) {
+	if m.diskBytes == nil {
+		return 0, false
+	}
+	return m.diskBytes(vmID)
+}
+
+// ResourceUsages returns the last resource usage sampled for each VM.
+func (m *Manager) ResourceUsages() map[string]models.VMResourceUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usages := make(map[string]models.VMResourceUsage, len(m.usage))
+	for vmID, sample := range m.usage {
+		usages[vmID] = sample.usage
+	}
+	return usages
+}
+
+// ForgetResourceUsage drops the usage samples of VMs not in running, so
+// stopped VMs disappear from /metrics.
+func (m *Manager) ForgetResourceUsage(running []models.VMInfo) {
+	keep := make(map[string]bool, len(running))
+	for _, vm := range running {
+		keep[vm.VMID] = true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for vmID := range m.usage {
+		if !keep[vmID] {
+			delete(m.usage, vmID)
+		}
+	}
+}
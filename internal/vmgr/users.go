@@ -0,0 +1,178 @@
+package vmgr
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// validUsername matches the short names sysadminctl accepts.
+var validUsername = regexp.MustCompile(`^[a-z_][a-z0-9_.-]{0,30}$`)
+
+// dryRunPassword stands in for guest user passwords in dry-run output.
+const dryRunPassword = "DRY-RUN-PASSWORD"
+
+// validateGuestUsers checks the requested accounts before anything runs in the VM.
+func validateGuestUsers(users []models.GuestUser) error {
+	autoLogin := 0
+	for _, user := range users {
+		if !validUsername.MatchString(user.Username) {
+			return fmt.Errorf("invalid guest username %q", user.Username)
+		}
+		if user.Password != "" && user.PasswordSecret != "" {
+			return fmt.Errorf("guest user %s: set either password or passwordSecret, not both", user.Username)
+		}
+		if user.AutoLogin {
+			autoLogin++
+			if user.Password == "" && user.PasswordSecret == "" {
+				return fmt.Errorf("guest user %s: auto-login requires a password", user.Username)
+			}
+		}
+	}
+	if autoLogin > 1 {
+		return fmt.Errorf("only one guest user can log in automatically")
+	}
+	return nil
+}
+
+// resolveGuestPasswords returns each user's password, fetching passwordSecret
+// from the secrets provider. Key-only accounts get a random password since
+// sysadminctl requires one.
+func (m *Manager) resolveGuestPasswords(ctx context.Context, users []models.GuestUser) (map[string]string, error) {
+	passwords := make(map[string]string, len(users))
+	for _, user := range users {
+		switch {
+		case user.Password != "":
+			passwords[user.Username] = user.Password
+		case user.PasswordSecret != "":
+			password, err := m.secrets.GetSecret(ctx, user.PasswordSecret)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch password of guest user %s: %w", user.Username, err)
+			}
+			passwords[user.Username] = password
+		default:
+			random := make([]byte, 24)
+			if _, err := rand.Read(random); err != nil {
+				return nil, fmt.Errorf("failed to generate password for guest user %s: %w", user.Username, err)
+			}
+			passwords[user.Username] = hex.EncodeToString(random)
+		}
+	}
+	return passwords, nil
+}
+
+// kcpasswordKey is the key macOS XORs the auto-login password in
+// /etc/kcpassword with.
+var kcpasswordKey = []byte{0x7d, 0x89, 0x52, 0x23, 0xd2, 0xbc, 0xdd, 0xea, 0xa3, 0xb9, 0x1f}
+
+// kcpassword encodes password for /etc/kcpassword, as sysadminctl -autologin
+// does: XORed with kcpasswordKey and padded to a multiple of 12 bytes.
+func kcpassword(password string) []byte {
+	data := make([]byte, (len(password)/12+1)*12)
+	copy(data, password)
+	for i := range data {
+		data[i] ^= kcpasswordKey[i%len(kcpasswordKey)]
+	}
+	return data
+}
+
+// printfBytes returns a bash printf builtin printing data. Builtins don't
+// exec, so data doesn't show up in any process's arguments.
+func printfBytes(data []byte) string {
+	var b strings.Builder
+	b.WriteString("printf '")
+	for _, c := range data {
+		fmt.Fprintf(&b, "\\x%02x", c)
+	}
+	b.WriteString("'")
+	return b.String()
+}
+
+// dsclQuote quotes s as one argument of a command read by dscl.
+func dsclQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// guestUsersScript renders the bash script that creates or updates the
+// accounts with sysadminctl. Existing accounts are kept; only admin
+// membership, SSH keys and auto-login are applied to them. Passwords are
+// only ever passed to printf, which bash runs itself, and piped on, so `ps`
+// in the guest doesn't show them.
+func guestUsersScript(users []models.GuestUser, passwords map[string]string) string {
+	var b strings.Builder
+	b.WriteString("set -euo pipefail\n")
+	for _, user := range users {
+		name := shellQuote(user.Username)
+		home := shellQuote("/Users/" + user.Username)
+		fullName := user.FullName
+		if fullName == "" {
+			fullName = user.Username
+		}
+
+		fmt.Fprintf(&b, "\n# Guest user %s\n", user.Username)
+		fmt.Fprintf(&b, "if ! id -u %s >/dev/null 2>&1; then\n", name)
+		fmt.Fprintf(&b, "    sudo sysadminctl -addUser %s -fullName %s -home %s", name, shellQuote(fullName), home)
+		if user.Admin {
+			b.WriteString(" -admin")
+		}
+		b.WriteString("\n")
+		// dscl reads its commands from stdin when it isn't given one.
+		fmt.Fprintf(&b, "    %s | sudo dscl . >/dev/null\n", printfBytes([]byte("passwd /Users/"+user.Username+" "+dsclQuote(passwords[user.Username])+"\n")))
+		fmt.Fprintf(&b, "    sudo createhomedir -c -u %s >/dev/null\n", name)
+		b.WriteString("fi\n")
+		if user.Admin {
+			fmt.Fprintf(&b, "sudo dseditgroup -o edit -a %s -t user admin\n", name)
+		}
+
+		if len(user.SSHAuthorizedKeys) > 0 {
+			sshDir := shellQuote("/Users/" + user.Username + "/.ssh")
+			keysFile := shellQuote("/Users/" + user.Username + "/.ssh/authorized_keys")
+			fmt.Fprintf(&b, "sudo mkdir -p %s\n", sshDir)
+			b.WriteString("printf '%s\\n'")
+			for _, key := range user.SSHAuthorizedKeys {
+				b.WriteString(" " + shellQuote(strings.TrimSpace(key)))
+			}
+			fmt.Fprintf(&b, " | sudo tee %s >/dev/null\n", keysFile)
+			fmt.Fprintf(&b, "sudo chown -R %s:staff %s\n", name, sshDir)
+			fmt.Fprintf(&b, "sudo chmod 700 %s\n", sshDir)
+			fmt.Fprintf(&b, "sudo chmod 600 %s\n", keysFile)
+		}
+
+		if user.AutoLogin {
+			fmt.Fprintf(&b, "%s | sudo tee /etc/kcpassword >/dev/null\n", printfBytes(kcpassword(passwords[user.Username])))
+			b.WriteString("sudo chmod 600 /etc/kcpassword\n")
+			fmt.Fprintf(&b, "sudo defaults write /Library/Preferences/com.apple.loginwindow autoLoginUser %s\n", name)
+		}
+	}
+	return b.String()
+}
+
+// configureGuestUsers creates the request's guest accounts inside the VM. The
+// script is streamed on stdin and only pipes passwords between processes, so
+// they never appear in command lines or logs.
+func (m *Manager) configureGuestUsers(ctx context.Context, vmID string, users []models.GuestUser) error {
+	if err := validateGuestUsers(users); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.cfg.ProvisionStepTimeout)
+	defer cancel()
+
+	passwords, err := m.resolveGuestPasswords(ctx, users)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Configuring %d guest user account(s) on VM %s...", len(users), vmID)
+	script := guestUsersScript(users, passwords)
+	if _, err := m.ssh.Client(vmID).Run(ctx, "bash -s", strings.NewReader(script)); err != nil {
+		return fmt.Errorf("failed to configure guest users: %w", err)
+	}
+	return nil
+}
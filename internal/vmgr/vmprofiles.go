@@ -0,0 +1,63 @@
+package vmgr
+
+import (
+	"cmp"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/vmprofiles"
+)
+
+// SetProfiles makes provision requests take the settings they leave out
+// from the node's VM profiles. The agent loads them, so it provides them.
+func (m *Manager) SetProfiles(profiles *vmprofiles.Set) {
+	m.profiles = profiles
+}
+
+// ApplyProfile fills in the settings a provision request leaves out from the
+// VM profile it names or matches, if any. It fails with
+// vmprofiles.ErrUnknownProfile if the request names a profile the node
+// doesn't define.
+func (m *Manager) ApplyProfile(cmd *models.VMProvisionCommand) error {
+	return m.profiles.Apply(cmd)
+}
+
+// Profile returns the VM profile a VM was provisioned with, or "" if none.
+func (m *Manager) Profile(vmID string) string {
+	config, err := m.readVMConfig(vmID)
+	if err != nil {
+		return ""
+	}
+	return config.Profile
+}
+
+// runnerScriptPath returns the install script of a provision request: its
+// VM profile's, or else its workload's.
+func runnerScriptPath(cfg *config.Config, profiles *vmprofiles.Set, cmd models.VMProvisionCommand) string {
+	return cmp.Or(profiles.RunnerScriptPath(cmd.Profile), profileFor(cmd.Workload).scriptPath(cfg))
+}
+
+// tartHardware returns the fields of tart's config.json that size a VM as
+// its config says. Sizes left at 0 keep the image's.
+func tartHardware(config *vmConfig) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	if config.CPUs > 0 {
+		fields["cpuCount"] = config.CPUs
+	}
+	if config.MemoryMB > 0 {
+		fields["memorySize"] = uint64(config.MemoryMB) << 20
+	}
+	if config.Display != "" {
+		width, height, _ := strings.Cut(config.Display, "x")
+		w, errW := strconv.Atoi(width)
+		h, errH := strconv.Atoi(height)
+		if errW != nil || errH != nil {
+			return nil, fmt.Errorf("invalid display %q of VM %s", config.Display, config.VMID)
+		}
+		fields["display"] = map[string]int{"width": w, "height": h}
+	}
+	return fields, nil
+}
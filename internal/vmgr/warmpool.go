@@ -0,0 +1,337 @@
+package vmgr
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/operations"
+)
+
+// warmVMPrefix names the standby VMs of the warm pool.
+const warmVMPrefix = "warm-"
+
+// warmPoolInterval is how often the warm pool is checked for missing standby
+// VMs, e.g. once a slot frees up or the pool's image is downloaded.
+const warmPoolInterval = 30 * time.Second
+
+// standbyBootTimeout bounds how long a standby VM may take to answer over SSH.
+const standbyBootTimeout = 10 * time.Minute
+
+// IsStandby reports whether vmID names a standby VM of the warm pool rather
+// than a VM provisioned by the orchestrator.
+func IsStandby(vmID string) bool {
+	return strings.HasPrefix(vmID, warmVMPrefix)
+}
+
+// ValidateWarmPool checks that an enabled warm pool has an image to create
+// its standby VMs from.
+func ValidateWarmPool(size int, imageName string) error {
+	if size > 0 && imageName == "" {
+		return fmt.Errorf("a warm pool of %d VMs needs an image", size)
+	}
+	return nil
+}
+
+// WarmPool returns the warm pool's status, or nil if it is disabled.
+func (m *Manager) WarmPool() *models.WarmPoolStatus {
+	if m.cfg.WarmPoolSize <= 0 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &models.WarmPoolStatus{
+		Image:     m.cfg.WarmPoolImage,
+		Size:      m.cfg.WarmPoolSize,
+		Ready:     len(m.standbys),
+		Preparing: m.prepStandby != nil,
+	}
+}
+
+// StartWarmPool removes standby VMs left behind by an earlier run of the
+// agent, then keeps WarmPoolSize standby VMs of WarmPoolImage cloned, booted
+// and reachable over SSH, as far as VM slots allow. It runs until the agent exits.
+func (m *Manager) StartWarmPool() {
+	m.removeStaleStandbys()
+	if m.cfg.WarmPoolSize <= 0 {
+		return
+	}
+	log.Printf("Keeping %d standby VMs of image %s in the warm pool", m.cfg.WarmPoolSize, m.cfg.WarmPoolImage)
+
+	ticker := time.NewTicker(warmPoolInterval)
+	defer ticker.Stop()
+	for {
+		m.fillWarmPool()
+		select {
+		case <-ticker.C:
+		case <-m.refillPool:
+		}
+	}
+}
+
+// removeStaleStandbys tears down standby VMs the agent doesn't track, which
+// are left over from before it restarted.
+func (m *Manager) removeStaleStandbys() {
+	stale := make(map[string]bool)
+	if states, err := m.commands.ListVMs(); err == nil {
+		for vmID := range states {
+			stale[vmID] = IsStandby(vmID)
+		}
+	} else {
+		log.Printf("Warning: Failed to list VMs for stale standby VMs: %v", err)
+	}
+	if vmIDs, err := m.paths.List(); err == nil {
+		for _, vmID := range vmIDs {
+			stale[vmID] = IsStandby(vmID)
+		}
+	}
+	for vmID, isStandby := range stale {
+		if isStandby {
+			log.Printf("Removing stale standby VM %s", vmID)
+			m.teardownVM(vmID)
+		}
+	}
+}
+
+// fillWarmPool prepares standby VMs one at a time until the pool is full or
+// has no slot left, downloading the pool's image first if needed.
+func (m *Manager) fillWarmPool() {
+	imageName := m.cfg.WarmPoolImage
+	for m.needsStandby() {
+		if m.imageManager.IsImageDownloading(imageName) {
+			return
+		}
+		// Checked first, as a corrupt image is evicted to be downloaded again.
+		if err := m.imageManager.CheckUsable(context.Background(), imageName); err != nil {
+			log.Printf("Warning: Cannot prepare standby VMs: %v", err)
+			return
+		}
+		imagePath, ok := m.imageManager.GetCachedImagePath(imageName)
+		if !ok {
+			// The pool keeps waiting for the image, so the download is never
+			// canceled for lack of waiters.
+			log.Printf("Warm pool image %s not cached. Requesting download.", imageName)
+			m.imageManager.RequestImageDownload(context.Background(), imageName)
+			return
+		}
+		if err := m.prepareStandby(imageName, imagePath); err != nil {
+			log.Printf("Warning: Failed to prepare standby VM: %v", err)
+			return
+		}
+	}
+}
+
+// needsStandby reports whether the warm pool is short of standby VMs and a VM
+// slot is free for another one. In-flight provisions count as using a slot,
+// so the pool doesn't take the slot a VM is being created for.
+func (m *Manager) needsStandby() bool {
+	running, err := m.commands.GetRunningVMs()
+	if err != nil {
+		log.Printf("Warning: Failed to list running VMs for the warm pool: %v", err)
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.standbys) < m.cfg.WarmPoolSize && len(running)+len(m.provisions) < m.cfg.MaxVMs
+}
+
+// prepareStandby clones a standby VM from the pool's image, boots it and waits
+// for it to answer over SSH, then adds it to the pool. It is torn down if that
+// fails or yieldStandby stops it to free its slot.
+func (m *Manager) prepareStandby(imageName, imagePath string) (err error) {
+	vmID := fmt.Sprintf("%s%d", warmVMPrefix, time.Now().UnixNano())
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	m.prepStandby = cancel
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.prepStandby = nil
+		m.mu.Unlock()
+		cancel()
+	}()
+
+	log.Printf("Preparing standby VM %s of image %s", vmID, imageName)
+	op := m.ops.Start("warm-standby", vmID)
+	defer func() {
+		op.Fail(err)
+		op.Done()
+	}()
+
+	op.SetPhase("creating VM")
+	if size, err := m.imageManager.ImageSize(op.Trace(ctx), imageName); err == nil {
+		if err := m.imageManager.EnsureFreeSpace(m.paths.Root(), size, imageName); err != nil {
+			return fmt.Errorf("cannot clone image %s for standby VM %s: %w", imageName, vmID, err)
+		}
+	}
+	if err := m.paths.Create(vmID); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			m.teardownVM(vmID)
+		}
+	}()
+	if err := m.cloneVM(op.Trace(ctx), op, models.VMProvisionCommand{VMID: vmID, ImageName: imageName}, imagePath); err != nil {
+		return err
+	}
+
+	op.SetPhase("booting")
+	if err := m.applyTartConfig(vmID); err != nil {
+		return err
+	}
+	if err := m.commands.StartVM(vmID, m.Launch(vmID)); err != nil {
+		return err
+	}
+	if err := m.hostKeys.Capture(op.Trace(ctx), vmID); err != nil {
+		log.Printf("Warning: %v; falling back to trust-on-first-use", err)
+	}
+
+	op.SetPhase("waiting for SSH")
+	op.SetDeadline(time.Now().Add(standbyBootTimeout))
+	bootCtx, cancelBoot := context.WithTimeout(ctx, standbyBootTimeout)
+	defer cancelBoot()
+	if err := m.waitForSSH(op.Trace(bootCtx), vmID); err != nil {
+		return fmt.Errorf("standby VM %s did not become reachable over SSH: %w", vmID, err)
+	}
+
+	m.mu.Lock()
+	m.standbys = append(m.standbys, vmID)
+	m.mu.Unlock()
+	log.Printf("Standby VM %s of image %s is ready", vmID, imageName)
+	return nil
+}
+
+// fitsStandby reports whether a provision request can be served by a standby
+// VM: it is for the pool's image and doesn't ask for anything fixed when a VM
+// is cloned or booted. Guest users and provisioning steps run over SSH, so
+// they still apply.
+func (m *Manager) fitsStandby(cmd models.VMProvisionCommand) bool {
+	return m.cfg.WarmPoolSize > 0 &&
+		cmd.ImageName == m.cfg.WarmPoolImage &&
+		cmd.HardwareModel == "" &&
+		cmd.MACAddress == "" &&
+		(cmd.NetworkMode == "" || cmd.NetworkMode == defaultNetworkMode) &&
+		cmd.NetworkInterface == "" &&
+		cmd.DiskSizeGB == 0 &&
+		len(cmd.Disks) == 0 &&
+		cmd.CPUPolicy == nil &&
+		cmd.CPUs == 0 &&
+		cmd.MemoryMB == 0 &&
+		cmd.Display == ""
+}
+
+// adoptStandby turns a standby VM from the warm pool into the requested VM by
+// renaming it, so only the runner is left to install. It returns false if no
+// standby fits the request; standby VMs that can't be adopted are torn down.
+func (m *Manager) adoptStandby(ctx context.Context, op *operations.Operation, cmd models.VMProvisionCommand) bool {
+	if !m.fitsStandby(cmd) {
+		return false
+	}
+	for {
+		m.mu.Lock()
+		if len(m.standbys) == 0 {
+			m.mu.Unlock()
+			return false
+		}
+		standbyID := m.standbys[0]
+		m.standbys = m.standbys[1:]
+		m.mu.Unlock()
+
+		op.SetPhase("adopting standby VM")
+		err := timeStep(op, "adopt standby", func() error {
+			return m.renameStandby(standbyID, cmd.VMID)
+		})
+		m.signalRefill()
+		if err == nil {
+			log.Printf("VM %s adopted standby VM %s from the warm pool", cmd.VMID, standbyID)
+			return true
+		}
+		log.Printf("Warning: Failed to adopt standby VM %s for VM %s, tearing it down: %v", standbyID, cmd.VMID, err)
+		m.teardownVM(standbyID)
+		if ctx.Err() != nil {
+			return false
+		}
+	}
+}
+
+// renameStandby renames a running standby VM, its directory and its host key
+// to vmID, and gives it a fresh guest token. Its MAC address and machine
+// identifier stay those it was booted with. If it fails once the VM is
+// renamed, the VM is torn down under its new name.
+func (m *Manager) renameStandby(standbyID, vmID string) error {
+	state, err := m.commands.GetVMState(standbyID)
+	if err != nil {
+		return err
+	}
+	if state != "running" {
+		return fmt.Errorf("standby VM %s is %s", standbyID, state)
+	}
+	if err := m.commands.RenameVM(standbyID, vmID); err != nil {
+		return err
+	}
+	if err := m.moveStandbyState(standbyID, vmID); err != nil {
+		m.teardownVM(vmID)
+		return err
+	}
+	return nil
+}
+
+// moveStandbyState moves the agent's state of a renamed standby VM to vmID.
+func (m *Manager) moveStandbyState(standbyID, vmID string) error {
+	if err := m.paths.Rename(standbyID, vmID); err != nil {
+		return err
+	}
+	if err := m.hostKeys.Rename(standbyID, vmID); err != nil {
+		return err
+	}
+	m.imageManager.RenameClone(standbyID, vmID)
+	m.ssh.Close(standbyID)
+	m.clearGuestStatus(standbyID)
+
+	config, err := m.readVMConfig(vmID)
+	if err != nil {
+		return err
+	}
+	config.VMID = vmID
+	if m.cfg.GuestEvents {
+		if config.GuestToken, err = newGuestToken(); err != nil {
+			return err
+		}
+	}
+	return m.saveVMConfig(config)
+}
+
+// yieldStandby frees a VM slot held by the warm pool when all slots are in
+// use: it tears down a ready standby VM, or else stops preparing one.
+func (m *Manager) yieldStandby() {
+	running, err := m.commands.GetRunningVMs()
+	if err != nil || len(running) < m.cfg.MaxVMs {
+		return
+	}
+	m.mu.Lock()
+	if len(m.standbys) == 0 {
+		if m.prepStandby != nil {
+			log.Printf("Stopping the standby VM being prepared to free its slot")
+			m.prepStandby()
+		}
+		m.mu.Unlock()
+		return
+	}
+	standbyID := m.standbys[len(m.standbys)-1]
+	m.standbys = m.standbys[:len(m.standbys)-1]
+	m.mu.Unlock()
+	log.Printf("Tearing down standby VM %s to free its slot", standbyID)
+	m.teardownVM(standbyID)
+}
+
+// signalRefill wakes the warm pool to replace an adopted standby VM.
+func (m *Manager) signalRefill() {
+	select {
+	case m.refillPool <- struct{}{}:
+	default:
+	}
+}
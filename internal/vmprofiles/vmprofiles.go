@@ -0,0 +1,173 @@
+// Package vmprofiles holds the VM profiles an operator defines for a node:
+// named sets of provisioning settings, such as the CPUs, memory, network and
+// runner script of VMs for an image, so provision requests don't have to
+// spell them out.
+package vmprofiles
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/validate"
+)
+
+// ErrUnknownProfile is returned when a provision request names a profile the
+// node doesn't define.
+var ErrUnknownProfile = errors.New("unknown VM profile")
+
+// Profile is a named set of provisioning settings. It applies to provision
+// requests that name it, or else to requests for one of its Images, or else
+// with one of its Labels.
+type Profile struct {
+	Name             string          `json:"name"`
+	Images           []string        `json:"images,omitempty"` // Images the profile applies to
+	Labels           []string        `json:"labels,omitempty"` // Runner labels the profile applies to
+	CPUs             int             `json:"cpus,omitempty"`
+	MemoryMB         int             `json:"memoryMb,omitempty"`
+	Display          string          `json:"display,omitempty"`          // Width x height in pixels, e.g. "1920x1080"
+	NetworkMode      string          `json:"networkMode,omitempty"`      // "nat", "bridged", "softnet" or "host-only"
+	NetworkInterface string          `json:"networkInterface,omitempty"` // Host interface to bridge onto
+	Disks            []models.VMDisk `json:"disks,omitempty"`            // Data disks attached to the VM
+	RunnerScriptPath string          `json:"runnerScriptPath,omitempty"` // Install script used instead of the workload's
+}
+
+// Set is the profiles of a node, in the order they are matched in.
+type Set struct {
+	profiles []Profile
+}
+
+// Load reads the profiles from a JSON file holding an array of profiles. An
+// empty path defines none.
+func Load(path string) (*Set, error) {
+	if path == "" {
+		return &Set{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM profiles: %w", err)
+	}
+	var profiles []Profile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("failed to parse VM profiles %s: %w", path, err)
+	}
+	names := make(map[string]bool, len(profiles))
+	for _, profile := range profiles {
+		if err := check(profile); err != nil {
+			return nil, fmt.Errorf("invalid VM profile %q in %s: %w", profile.Name, path, err)
+		}
+		if names[profile.Name] {
+			return nil, fmt.Errorf("duplicate VM profile %q in %s", profile.Name, path)
+		}
+		names[profile.Name] = true
+	}
+	return &Set{profiles: profiles}, nil
+}
+
+// check validates a profile's settings like those of a provision request.
+func check(profile Profile) error {
+	if err := validate.ProfileName(profile.Name); err != nil {
+		return err
+	}
+	for _, image := range profile.Images {
+		if err := validate.ImageName(image); err != nil {
+			return err
+		}
+	}
+	if err := validate.Labels(profile.Labels); err != nil {
+		return err
+	}
+	if err := validate.Hardware(profile.CPUs, profile.MemoryMB, profile.Display); err != nil {
+		return err
+	}
+	if err := validate.Network(profile.NetworkMode, profile.NetworkInterface); err != nil {
+		return err
+	}
+	if err := validate.Disks(profile.Disks); err != nil {
+		return err
+	}
+	if profile.RunnerScriptPath != "" {
+		if _, err := os.Stat(profile.RunnerScriptPath); err != nil {
+			return fmt.Errorf("runner script: %w", err)
+		}
+	}
+	return nil
+}
+
+// List returns the profiles in the order they are matched in.
+func (s *Set) List() []Profile {
+	return slices.Clone(s.profiles)
+}
+
+// Get returns the profile called name.
+func (s *Set) Get(name string) (Profile, bool) {
+	for _, profile := range s.profiles {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+	return Profile{}, false
+}
+
+// match returns the profile for a provision request: the one it names, or
+// else the first for its image, or else the first for one of its labels.
+func (s *Set) match(cmd models.VMProvisionCommand) (Profile, bool, error) {
+	if cmd.Profile != "" {
+		profile, ok := s.Get(cmd.Profile)
+		if !ok {
+			return Profile{}, false, fmt.Errorf("%w %q", ErrUnknownProfile, cmd.Profile)
+		}
+		return profile, true, nil
+	}
+	for _, profile := range s.profiles {
+		if slices.Contains(profile.Images, cmd.ImageName) {
+			return profile, true, nil
+		}
+	}
+	for _, profile := range s.profiles {
+		for _, label := range profile.Labels {
+			if slices.Contains(cmd.Labels, label) {
+				return profile, true, nil
+			}
+		}
+	}
+	return Profile{}, false, nil
+}
+
+// Apply fills in the settings a provision request leaves out from its
+// profile, and records the profile's name on it. Settings the request has
+// win; the network mode and interface are taken together, and so are the
+// disks.
+func (s *Set) Apply(cmd *models.VMProvisionCommand) error {
+	profile, ok, err := s.match(*cmd)
+	if err != nil || !ok {
+		return err
+	}
+	cmd.Profile = profile.Name
+	if cmd.CPUs == 0 {
+		cmd.CPUs = profile.CPUs
+	}
+	if cmd.MemoryMB == 0 {
+		cmd.MemoryMB = profile.MemoryMB
+	}
+	if cmd.Display == "" {
+		cmd.Display = profile.Display
+	}
+	if cmd.NetworkMode == "" && cmd.NetworkInterface == "" {
+		cmd.NetworkMode, cmd.NetworkInterface = profile.NetworkMode, profile.NetworkInterface
+	}
+	if len(cmd.Disks) == 0 {
+		cmd.Disks = slices.Clone(profile.Disks)
+	}
+	return nil
+}
+
+// RunnerScriptPath returns the install script of a profile, or "" if the
+// profile doesn't set one or no longer exists.
+func (s *Set) RunnerScriptPath(name string) string {
+	profile, _ := s.Get(name)
+	return profile.RunnerScriptPath
+}
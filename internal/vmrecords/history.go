@@ -0,0 +1,175 @@
+package vmrecords
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/models"
+)
+
+// History keeps an accounting record of the last VMHistorySize VMs
+// provisioned on the node: when they started and became ready, from which
+// image, how long they lived and why they ended. Unlike Store it doesn't wait
+// for the orchestrator, so usage can be accounted per node even if the
+// orchestrator loses data. Entries are persisted in vm_history.json in the
+// state directory.
+type History struct {
+	path       string
+	maxEntries int
+	mu         sync.Mutex              // Protects entries
+	entries    []models.VMHistoryEntry // Oldest first
+}
+
+// HistoryFilter selects history entries. Zero fields match every entry.
+type HistoryFilter struct {
+	VMID       string
+	ImageName  string
+	Tenant     string
+	ExitReason string    // "running" matches VMs that haven't ended
+	Since      time.Time // Entries of VMs that ended at or after Since, or haven't ended
+	Until      time.Time // Entries of VMs that started before Until
+	Limit      int       // Newest entries returned at most; 0 returns all
+}
+
+// NewHistory creates a History backed by vm_history.json in the state
+// directory. It keeps nothing if VMHistorySize is 0.
+func NewHistory(cfg *config.Config) *History {
+	h := &History{
+		path:       filepath.Join(cfg.StateDir, "vm_history.json"),
+		maxEntries: cfg.VMHistorySize,
+	}
+	if h.maxEntries > 0 {
+		h.load()
+	}
+	return h
+}
+
+// load reads previously persisted entries, ignoring a missing or corrupt file.
+func (h *History) load() {
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: Could not read VM history %s: %v", h.path, err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &h.entries); err != nil {
+		log.Printf("Warning: Could not parse VM history %s: %v", h.path, err)
+	}
+}
+
+// Started records the start of a provision.
+func (h *History) Started(cmd models.VMProvisionCommand, tenant string) {
+	if h.maxEntries <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, models.VMHistoryEntry{
+		VMID:      cmd.VMID,
+		ImageName: cmd.ImageName,
+		Tenant:    tenant,
+		Workload:  cmd.Workload,
+		StartedAt: time.Now().UTC(),
+	})
+	if len(h.entries) > h.maxEntries {
+		h.entries = append([]models.VMHistoryEntry(nil), h.entries[len(h.entries)-h.maxEntries:]...)
+	}
+	h.persist()
+}
+
+// Ready records that a VM's provision succeeded.
+func (h *History) Ready(vmID string) {
+	h.update(vmID, func(entry *models.VMHistoryEntry, now time.Time) {
+		entry.ReadyAt = &now
+	})
+}
+
+// Ended records that a VM is gone, for reason ("deleted", "job-finished",
+// "failed" or "interrupted"). VMs provisioned before the history was kept
+// have no entry and are skipped.
+func (h *History) Ended(vmID, reason, message string) {
+	h.update(vmID, func(entry *models.VMHistoryEntry, now time.Time) {
+		entry.EndedAt = &now
+		entry.ExitReason = reason
+		entry.Message = message
+	})
+}
+
+// update applies fn to the entry of a VM that hasn't ended and persists it.
+func (h *History) update(vmID string, fn func(entry *models.VMHistoryEntry, now time.Time)) {
+	if h.maxEntries <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if h.entries[i].VMID == vmID && h.entries[i].EndedAt == nil {
+			fn(&h.entries[i], time.Now().UTC())
+			h.persist()
+			return
+		}
+	}
+}
+
+// List returns the entries filter selects, newest first, with their
+// durations filled in.
+func (h *History) List(filter HistoryFilter) []models.VMHistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now().UTC()
+	entries := []models.VMHistoryEntry{}
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(entries) >= filter.Limit {
+			break
+		}
+		entry := h.entries[i]
+		if !filter.matches(entry) {
+			continue
+		}
+		end := now
+		if entry.EndedAt != nil {
+			end = *entry.EndedAt
+		}
+		entry.DurationSeconds = int64(end.Sub(entry.StartedAt).Seconds())
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// matches reports whether filter selects an entry.
+func (f HistoryFilter) matches(entry models.VMHistoryEntry) bool {
+	switch {
+	case f.VMID != "" && entry.VMID != f.VMID,
+		f.ImageName != "" && entry.ImageName != f.ImageName,
+		f.Tenant != "" && entry.Tenant != f.Tenant,
+		f.ExitReason == "running" && entry.EndedAt != nil,
+		f.ExitReason != "" && f.ExitReason != "running" && entry.ExitReason != f.ExitReason,
+		!f.Since.IsZero() && entry.EndedAt != nil && entry.EndedAt.Before(f.Since),
+		!f.Until.IsZero() && !entry.StartedAt.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// persist writes all entries to disk atomically. Callers must hold h.mu.
+func (h *History) persist() {
+	data, err := json.Marshal(h.entries)
+	if err != nil {
+		log.Printf("Warning: Could not marshal VM history: %v", err)
+		return
+	}
+	tmpPath := h.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		log.Printf("Warning: Could not write %s: %v", tmpPath, err)
+		return
+	}
+	if err := os.Rename(tmpPath, h.path); err != nil {
+		log.Printf("Warning: Could not persist VM history: %v", err)
+	}
+}
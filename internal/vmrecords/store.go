@@ -0,0 +1,138 @@
+package vmrecords
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/changty97/macvmagt/internal/config"
+	"github.com/changty97/macvmagt/internal/models"
+	"github.com/changty97/macvmagt/internal/requestid"
+)
+
+// Store retains records of VMs that are gone (tombstones of deleted VMs and
+// failed provisions) and reports them in every heartbeat until the
+// orchestrator acknowledges them. Records are persisted in vm_records.json in
+// the state directory so they survive agent restarts.
+type Store struct {
+	path       string
+	maxRecords int
+	mu         sync.Mutex // Protects records
+	records    []models.VMRecord
+}
+
+// NewStore creates a Store backed by vm_records.json in the state directory.
+func NewStore(cfg *config.Config) (*Store, error) {
+	if err := os.MkdirAll(cfg.StateDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory %s: %w", cfg.StateDir, err)
+	}
+
+	s := &Store{
+		path:       filepath.Join(cfg.StateDir, "vm_records.json"),
+		maxRecords: cfg.MaxRetainedVMRecords,
+	}
+	s.load()
+	return s, nil
+}
+
+// load reads previously persisted records, ignoring a missing or corrupt file.
+func (s *Store) load() {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: Could not read VM records %s: %v", s.path, err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &s.records); err != nil {
+		log.Printf("Warning: Could not parse VM records %s: %v", s.path, err)
+		return
+	}
+	log.Printf("Loaded %d unacknowledged VM records from %s", len(s.records), s.path)
+}
+
+// Add retains a record for a VM that reached a final state (e.g., "deleted" or "failed").
+func (s *Store) Add(vmID, state, message string) {
+	s.AddContext(context.Background(), vmID, state, message)
+}
+
+// AddContext is like Add, for a state reached by the command whose request
+// ID ctx carries.
+func (s *Store) AddContext(ctx context.Context, vmID, state, message string) {
+	now := time.Now().UTC()
+	record := models.VMRecord{
+		ID:        fmt.Sprintf("%s-%s-%d", vmID, state, now.UnixNano()),
+		VMID:      vmID,
+		State:     state,
+		Message:   message,
+		RequestID: requestid.FromContext(ctx),
+		Timestamp: now,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = append(s.records, record)
+	// If the orchestrator never acks, drop the oldest records rather than grow without bound.
+	if s.maxRecords > 0 && len(s.records) > s.maxRecords {
+		dropped := len(s.records) - s.maxRecords
+		log.Printf("Warning: Dropping %d unacknowledged VM records (limit %d)", dropped, s.maxRecords)
+		s.records = append([]models.VMRecord(nil), s.records[dropped:]...)
+	}
+	s.persist()
+}
+
+// Pending returns all records not yet acknowledged by the orchestrator.
+func (s *Store) Pending() []models.VMRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]models.VMRecord(nil), s.records...)
+}
+
+// Ack prunes the records the orchestrator acknowledged.
+func (s *Store) Ack(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	acked := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		acked[id] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.records[:0]
+	for _, record := range s.records {
+		if !acked[record.ID] {
+			kept = append(kept, record)
+		}
+	}
+	if len(kept) == len(s.records) {
+		return
+	}
+	s.records = kept
+	s.persist()
+}
+
+// persist writes all records to disk atomically. Callers must hold s.mu.
+func (s *Store) persist() {
+	data, err := json.Marshal(s.records)
+	if err != nil {
+		log.Printf("Warning: Could not marshal VM records: %v", err)
+		return
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		log.Printf("Warning: Could not write %s: %v", tmpPath, err)
+		return
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		log.Printf("Warning: Could not persist VM records: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+#!/bin/bash
+# scripts/install_buildkite_agent.sh
+
+# This script is meant to be run inside the newly provisioned macOS VM.
+# It will download and start the Buildkite agent.
+
+# It is a Go text/template: the agent renders it for provision requests with
+# "workload": "buildkite", with the request's labels (the agent's tags, e.g.
+# queue=macos) and ephemeral flag and the agent token from its secrets
+# provider, then uploads it into the VM over SFTP and runs it. Secrets come in
+# the environment, MACVMAGT_RUNNER_TOKEN and MACVMAGT_GUEST_TOKEN, rather than
+# being rendered into the script. Do not run it directly.
+
+AGENT_NAME={{ shellquote .RunnerName }}
+AGENT_HOME="/Users/runner/buildkite-agent"
+
+echo "Installing Buildkite agent with name: ${AGENT_NAME}"
+
+# 1. Download and install the agent into AGENT_HOME
+mkdir -p "${AGENT_HOME}"
+curl -fsSL https://raw.githubusercontent.com/buildkite/agent/main/install.sh | \
+    DESTINATION="${AGENT_HOME}" TOKEN="${MACVMAGT_RUNNER_TOKEN}" bash
+mkdir -p "${AGENT_HOME}/hooks" "${AGENT_HOME}/builds"
+
+{{ if .GuestEventsURL -}}
+# 1b. Install the guest helper, which reports this VM's phases to the agent:
+# boot-complete at every boot, runner-registered once the agent is up, and
+# job-started/job-finished from the agent's job hooks. It never fails, so an
+# unreachable agent can't fail a job.
+echo "Installing guest helper..."
+sudo mkdir -p /usr/local/bin
+printf 'AGENT_URL=%s\nGUEST_TOKEN=%s\nAGENT_PIN=%s\n' {{ shellquote .GuestEventsURL }} "${MACVMAGT_GUEST_TOKEN}" {{ shellquote .GuestAgentPin }} | sudo tee /etc/macvmagt-guest.conf > /dev/null
+sudo tee /usr/local/bin/macvmagt-guest > /dev/null <<'GUEST'
+#!/bin/bash
+# Usage: macvmagt-guest <event> [build/job]
+. /etc/macvmagt-guest.conf
+JOB=$(printf '%s' "${2:-}" | tr -cd 'A-Za-z0-9._/-')
+# With AGENT_PIN, the agent's self-signed certificate is trusted by its key alone.
+curl -sf -m 5 --retry 3 --retry-connrefused -o /dev/null -X POST ${AGENT_PIN:+--insecure --pinnedpubkey "$AGENT_PIN"} \
+     -H "Authorization: Bearer ${GUEST_TOKEN}" -H 'Content-Type: application/json' \
+     --data "{\"event\":\"$1\",\"job\":\"${JOB}\"}" "${AGENT_URL}" || true
+exit 0
+GUEST
+sudo chmod 0755 /usr/local/bin/macvmagt-guest
+sudo tee /Library/LaunchDaemons/com.macvmagt.guest.plist > /dev/null <<'GUEST'
+<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>Label</key><string>com.macvmagt.guest</string>
+    <key>ProgramArguments</key>
+    <array><string>/usr/local/bin/macvmagt-guest</string><string>boot-complete</string></array>
+    <key>RunAtLoad</key><true/>
+</dict>
+</plist>
+GUEST
+sudo launchctl load -w /Library/LaunchDaemons/com.macvmagt.guest.plist # Reports boot-complete now, too
+
+# The agent runs its environment hook before and its pre-exit hook after every job.
+cat > "${AGENT_HOME}/hooks/environment" <<'GUEST'
+/usr/local/bin/macvmagt-guest job-started "${BUILDKITE_BUILD_ID}/${BUILDKITE_JOB_ID}"
+GUEST
+cat > "${AGENT_HOME}/hooks/pre-exit" <<'GUEST'
+/usr/local/bin/macvmagt-guest job-finished "${BUILDKITE_BUILD_ID}/${BUILDKITE_JOB_ID}"
+GUEST
+chmod 0755 "${AGENT_HOME}/hooks/environment" "${AGENT_HOME}/hooks/pre-exit"
+
+{{ end -}}
+# 2. Start the agent. An ephemeral agent disconnects after a single job.
+cd "${AGENT_HOME}"
+echo "Starting Buildkite agent..."
+nohup ./bin/buildkite-agent start \
+    --config "${AGENT_HOME}/buildkite-agent.cfg" \
+    --name "${AGENT_NAME}" \
+    --tags {{ shellquote .Labels }} \
+    --build-path "${AGENT_HOME}/builds" \
+    --hooks-path "${AGENT_HOME}/hooks" \
+{{- if .Ephemeral }}
+    --disconnect-after-job \
+{{- end }}
+    > "${AGENT_HOME}/agent.log" 2>&1 &
+
+echo "Buildkite agent '${AGENT_NAME}' started."
+{{- if .GuestEventsURL }}
+/usr/local/bin/macvmagt-guest runner-registered
+{{- end }}
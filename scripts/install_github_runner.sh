@@ -1,23 +1,40 @@
 #!/bin/bash
-# scripts/install_github_runner.sh.template
+# scripts/install_github_runner.sh
 
 # This script is meant to be run inside the newly provisioned macOS VM.
 # It will download and configure the GitHub Actions self-hosted runner.
 
-# Usage: ./install_github_runner.sh.template <unique_runner_name>
+# It is a Go text/template: the agent renders it with values from the
+# provision request (org, repo, runner group, labels, ephemeral flag) and the
+# registration token from its secrets provider, then uploads it into the VM
+# over SFTP and runs it. Secrets come in the environment, MACVMAGT_RUNNER_TOKEN
+# or MACVMAGT_JIT_CONFIG and MACVMAGT_GUEST_TOKEN, rather than being rendered
+# into the script. Do not run it directly.
 
-RUNNER_NAME="$1"
-if [ -z "$RUNNER_NAME" ]; then
-    echo "Usage: $0 <unique_runner_name>"
-    exit 1
-fi
-
-GITHUB_OWNER="your-github-org-or-user" # e.g., my-company
-GITHUB_REPO="your-github-repo"         # e.g., my-project
+RUNNER_NAME={{ shellquote .RunnerName }}
+GITHUB_OWNER={{ shellquote .Org }}
+GITHUB_REPO={{ shellquote .Repo }}
 RUNNER_HOME="/Users/runner/actions-runner" # Or /opt/actions-runner
 
+if [ -n "${GITHUB_REPO}" ]; then
+    GITHUB_URL="https://github.com/${GITHUB_OWNER}/${GITHUB_REPO}"
+else
+    GITHUB_URL="https://github.com/${GITHUB_OWNER}" # Organization-level runner
+fi
+
 echo "Installing GitHub Actions runner with name: ${RUNNER_NAME}"
+mkdir -p "${RUNNER_HOME}"
 
+{{ if .RunnerPackage -}}
+# 1. Use the runner package the agent cached and uploaded, if it got here.
+RUNNER_PACKAGE={{ shellquote .RunnerPackage }}
+if [ -f "${RUNNER_PACKAGE}" ]; then
+    echo "Extracting runner from the agent's cached package ${RUNNER_PACKAGE}"
+    tar xzf "${RUNNER_PACKAGE}" -C "${RUNNER_HOME}"
+    rm -f "${RUNNER_PACKAGE}"
+fi
+{{ end -}}
+if [ ! -x "${RUNNER_HOME}/config.sh" ]; then
 # 1. Download the latest runner package
 # Get the latest runner version URL from GitHub API
 RUNNER_VERSION=$(curl -s https://api.github.com/repos/actions/runner/releases/latest | grep -oP '"tag_name": "\Kv\d+\.\d+\.\d+' | head -n 1)
@@ -29,27 +46,83 @@ RUNNER_TARBALL="actions-runner-osx-${RUNNER_ARCH}-${RUNNER_VERSION}.tar.gz"
 RUNNER_DOWNLOAD_URL="https://github.com/actions/runner/releases/download/${RUNNER_VERSION}/${RUNNER_TARBALL}"
 
 echo "Downloading runner from: ${RUNNER_DOWNLOAD_URL}"
-mkdir -p "${RUNNER_HOME}"
 curl -o "${RUNNER_HOME}/${RUNNER_TARBALL}" -L "${RUNNER_DOWNLOAD_URL}"
 
 # 2. Extract the runner
 tar xzf "${RUNNER_HOME}/${RUNNER_TARBALL}" -C "${RUNNER_HOME}"
 rm "${RUNNER_HOME}/${RUNNER_TARBALL}"
+fi
 
-# 3. Configure the runner
-cd "${RUNNER_HOME}"
+{{ if .GuestEventsURL -}}
+# 2b. Install the guest helper, which reports this VM's phases to the agent:
+# boot-complete at every boot, runner-registered once the runner is up, and
+# job-started/job-finished from the runner's job hooks. It never fails, so an
+# unreachable agent can't fail a job.
+echo "Installing guest helper..."
+sudo mkdir -p /usr/local/bin /usr/local/libexec/macvmagt
+printf 'AGENT_URL=%s\nGUEST_TOKEN=%s\nAGENT_PIN=%s\n' {{ shellquote .GuestEventsURL }} "${MACVMAGT_GUEST_TOKEN}" {{ shellquote .GuestAgentPin }} | sudo tee /etc/macvmagt-guest.conf > /dev/null
+sudo tee /usr/local/bin/macvmagt-guest > /dev/null <<'GUEST'
+#!/bin/bash
+# Usage: macvmagt-guest <event> [run-id/job]
+. /etc/macvmagt-guest.conf
+JOB=$(printf '%s' "${2:-}" | tr -cd 'A-Za-z0-9._/-')
+# With AGENT_PIN, the agent's self-signed certificate is trusted by its key alone.
+curl -sf -m 5 --retry 3 --retry-connrefused -o /dev/null -X POST ${AGENT_PIN:+--insecure --pinnedpubkey "$AGENT_PIN"} \
+     -H "Authorization: Bearer ${GUEST_TOKEN}" -H 'Content-Type: application/json' \
+     --data "{\"event\":\"$1\",\"job\":\"${JOB}\"}" "${AGENT_URL}" || true
+exit 0
+GUEST
+sudo tee /usr/local/libexec/macvmagt/job-started.sh > /dev/null <<'GUEST'
+#!/bin/bash
+exec /usr/local/bin/macvmagt-guest job-started "${GITHUB_RUN_ID}/${GITHUB_JOB}"
+GUEST
+sudo tee /usr/local/libexec/macvmagt/job-finished.sh > /dev/null <<'GUEST'
+#!/bin/bash
+exec /usr/local/bin/macvmagt-guest job-finished "${GITHUB_RUN_ID}/${GITHUB_JOB}"
+GUEST
+sudo chmod 0755 /usr/local/bin/macvmagt-guest /usr/local/libexec/macvmagt/*.sh
+sudo tee /Library/LaunchDaemons/com.macvmagt.guest.plist > /dev/null <<'GUEST'
+<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>Label</key><string>com.macvmagt.guest</string>
+    <key>ProgramArguments</key>
+    <array><string>/usr/local/bin/macvmagt-guest</string><string>boot-complete</string></array>
+    <key>RunAtLoad</key><true/>
+</dict>
+</plist>
+GUEST
+sudo launchctl load -w /Library/LaunchDaemons/com.macvmagt.guest.plist # Reports boot-complete now, too
 
-# Get a registration token (requires GitHub PAT with 'repo' scope)
-# This token should ideally be passed securely or fetched from a secrets manager.
-# For simplicity, you might hardcode it here for testing, but NOT for production.
-# Or, the orchestrator could fetch it and pass it to the agent, which then passes to VM.
-GITHUB_RUNNER_TOKEN="YOUR_GITHUB_RUNNER_REGISTRATION_TOKEN" # REPLACE THIS!
+# The runner reads its .env when it starts, so the hooks apply to every job.
+cat >> "${RUNNER_HOME}/.env" <<'GUEST'
+ACTIONS_RUNNER_HOOK_JOB_STARTED=/usr/local/libexec/macvmagt/job-started.sh
+ACTIONS_RUNNER_HOOK_JOB_COMPLETED=/usr/local/libexec/macvmagt/job-finished.sh
+GUEST
 
+{{ end -}}
+# 3. Configure the runner
+cd "${RUNNER_HOME}"
+{{ if .JITConfig }}
+# Just-in-time runner: the agent has already registered it with GitHub, so the
+# encoded config replaces config.sh. The runner exits after a single job.
+echo "Starting just-in-time runner..."
+# The runner reads its arguments from ACTIONS_RUNNER_INPUT_* variables too,
+# which keeps the config out of its process arguments.
+ACTIONS_RUNNER_INPUT_JITCONFIG="${MACVMAGT_JIT_CONFIG}" nohup ./run.sh > "${RUNNER_HOME}/runner.log" 2>&1 &
+{{ else }}
 echo "Configuring runner..."
-./config.sh --url "https://github.com/${GITHUB_OWNER}/${GITHUB_REPO}" \
-            --token "${GITHUB_RUNNER_TOKEN}" \
+ACTIONS_RUNNER_INPUT_TOKEN="${MACVMAGT_RUNNER_TOKEN}" \
+./config.sh --url "${GITHUB_URL}" \
             --name "${RUNNER_NAME}" \
-            --labels "macos,${RUNNER_ARCH},ephemeral" \
+            --labels {{ shellquote .Labels }} \
+{{- if .RunnerGroup }}
+            --runnergroup {{ shellquote .RunnerGroup }} \
+{{- end }}
+{{- if .Ephemeral }}
+            --ephemeral \
+{{- end }}
             --unattended \
             --replace # Important for ephemeral runners to replace existing with same name
 
@@ -58,10 +131,14 @@ echo "Configuring runner..."
 echo "Installing runner as a service..."
 sudo ./svc.sh install
 sudo ./svc.sh start
-
+{{ end }}
 echo "GitHub Actions runner '${RUNNER_NAME}' configured and started."
+{{- if .GuestEventsURL }}
+/usr/local/bin/macvmagt-guest runner-registered
+{{- end }}
 
 # Important: The agent needs to know when the GitHub job is truly "done"
-# so it can signal the orchestrator to delete the VM. This typically involves
-# the GitHub workflow itself signaling back to the orchestrator's API
-# or the agent monitoring the runner's status.
\ No newline at end of file
+# so it can signal the orchestrator to delete the VM. With guest events
+# enabled, the guest helper reports job-finished to the agent, which surfaces
+# it in heartbeats; otherwise the GitHub workflow itself must signal back to
+# the orchestrator's API.
\ No newline at end of file
@@ -0,0 +1,106 @@
+#!/bin/bash
+# scripts/install_gitlab_runner.sh
+
+# This script is meant to be run inside the newly provisioned macOS VM.
+# It will download, register and start a GitLab runner with the shell executor.
+
+# It is a Go text/template: the agent renders it for provision requests with
+# "workload": "gitlab", with the request's ephemeral flag, the GitLab URL and
+# the runner authentication token (glrt-...) from its secrets provider, then
+# uploads it into the VM over SFTP and runs it. Secrets come in the
+# environment, MACVMAGT_RUNNER_TOKEN and MACVMAGT_GUEST_TOKEN, rather than
+# being rendered into the script. The runner's tags are set where the token
+# was created in GitLab. Do not run it directly.
+
+RUNNER_NAME={{ shellquote .RunnerName }}
+GITLAB_URL={{ shellquote .ServerURL }}
+# gitlab-runner reads --token from CI_SERVER_TOKEN too, which keeps it out of
+# its process arguments.
+export CI_SERVER_TOKEN="${MACVMAGT_RUNNER_TOKEN}"
+RUNNER_HOME="/Users/runner/gitlab-runner"
+
+echo "Installing GitLab runner with name: ${RUNNER_NAME}"
+
+# 1. Download the runner binary
+RUNNER_ARCH="arm64" # For Apple Silicon Mac Minis
+if [[ $(uname -m) == "x86_64" ]]; then
+    RUNNER_ARCH="amd64" # For Intel Mac Minis
+fi
+mkdir -p "${RUNNER_HOME}/builds"
+sudo curl -fsSL -o /usr/local/bin/gitlab-runner \
+    "https://gitlab-runner-downloads.s3.amazonaws.com/latest/binaries/gitlab-runner-darwin-${RUNNER_ARCH}"
+sudo chmod 0755 /usr/local/bin/gitlab-runner
+
+{{ if .GuestEventsURL -}}
+# 1b. Install the guest helper, which reports this VM's phases to the agent:
+# boot-complete at every boot, runner-registered once the runner is up, and
+# job-started/job-finished from the runner's pre- and post-build scripts. It
+# never fails, so an unreachable agent can't fail a job.
+echo "Installing guest helper..."
+sudo mkdir -p /usr/local/bin
+printf 'AGENT_URL=%s\nGUEST_TOKEN=%s\nAGENT_PIN=%s\n' {{ shellquote .GuestEventsURL }} "${MACVMAGT_GUEST_TOKEN}" {{ shellquote .GuestAgentPin }} | sudo tee /etc/macvmagt-guest.conf > /dev/null
+sudo tee /usr/local/bin/macvmagt-guest > /dev/null <<'GUEST'
+#!/bin/bash
+# Usage: macvmagt-guest <event> [pipeline/job]
+. /etc/macvmagt-guest.conf
+JOB=$(printf '%s' "${2:-}" | tr -cd 'A-Za-z0-9._/-')
+# With AGENT_PIN, the agent's self-signed certificate is trusted by its key alone.
+curl -sf -m 5 --retry 3 --retry-connrefused -o /dev/null -X POST ${AGENT_PIN:+--insecure --pinnedpubkey "$AGENT_PIN"} \
+     -H "Authorization: Bearer ${GUEST_TOKEN}" -H 'Content-Type: application/json' \
+     --data "{\"event\":\"$1\",\"job\":\"${JOB}\"}" "${AGENT_URL}" || true
+exit 0
+GUEST
+sudo chmod 0755 /usr/local/bin/macvmagt-guest
+sudo tee /Library/LaunchDaemons/com.macvmagt.guest.plist > /dev/null <<'GUEST'
+<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>Label</key><string>com.macvmagt.guest</string>
+    <key>ProgramArguments</key>
+    <array><string>/usr/local/bin/macvmagt-guest</string><string>boot-complete</string></array>
+    <key>RunAtLoad</key><true/>
+</dict>
+</plist>
+GUEST
+sudo launchctl load -w /Library/LaunchDaemons/com.macvmagt.guest.plist # Reports boot-complete now, too
+
+{{ end -}}
+# 2. Register and start the runner. An ephemeral runner takes a single job
+# with run-single instead of being registered as a service.
+cd "${RUNNER_HOME}"
+{{ if .Ephemeral }}
+echo "Starting single-job GitLab runner..."
+nohup gitlab-runner run-single \
+    --url "${GITLAB_URL}" \
+    --name "${RUNNER_NAME}" \
+    --executor shell \
+    --builds-dir "${RUNNER_HOME}/builds" \
+{{- if .GuestEventsURL }}
+    --pre-build-script '/usr/local/bin/macvmagt-guest job-started "${CI_PIPELINE_ID}/${CI_JOB_ID}"' \
+    --post-build-script '/usr/local/bin/macvmagt-guest job-finished "${CI_PIPELINE_ID}/${CI_JOB_ID}"' \
+{{- end }}
+    --max-builds 1 \
+    > "${RUNNER_HOME}/runner.log" 2>&1 &
+{{ else }}
+echo "Registering runner..."
+gitlab-runner register --non-interactive \
+    --url "${GITLAB_URL}" \
+    --name "${RUNNER_NAME}" \
+    --executor shell \
+    --builds-dir "${RUNNER_HOME}/builds" \
+{{- if .GuestEventsURL }}
+    --pre-build-script '/usr/local/bin/macvmagt-guest job-started "${CI_PIPELINE_ID}/${CI_JOB_ID}"' \
+    --post-build-script '/usr/local/bin/macvmagt-guest job-finished "${CI_PIPELINE_ID}/${CI_JOB_ID}"' \
+{{- end }}
+    --config "${RUNNER_HOME}/config.toml"
+
+# Run it in the background like the other workloads, so it survives the SSH session.
+echo "Starting runner..."
+nohup gitlab-runner run --config "${RUNNER_HOME}/config.toml" --working-directory "${RUNNER_HOME}" \
+    > "${RUNNER_HOME}/runner.log" 2>&1 &
+{{ end }}
+echo "GitLab runner '${RUNNER_NAME}' started."
+{{- if .GuestEventsURL }}
+/usr/local/bin/macvmagt-guest runner-registered
+{{- end }}
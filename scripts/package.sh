@@ -0,0 +1,41 @@
+#!/bin/bash
+# Builds macvmagt for both Apple Silicon and Intel Macs and, when lipo is
+# available, merges them into a single universal binary. The agent detects
+# which VM backends are usable at startup, so the same artifact can be
+# deployed to every node.
+set -e
+
+VERSION=${VERSION:-$(git describe --tags --always --dirty 2>/dev/null || echo dev)}
+LDFLAGS="-X github.com/changty97/macvmagt/internal/version.Version=${VERSION}"
+
+mkdir -p dist
+GOOS=darwin GOARCH=arm64 go build -ldflags "$LDFLAGS" -o dist/macvmagt-darwin-arm64 ./cmd/macvmagt
+GOOS=darwin GOARCH=amd64 go build -ldflags "$LDFLAGS" -o dist/macvmagt-darwin-amd64 ./cmd/macvmagt
+
+if command -v lipo >/dev/null 2>&1; then
+    lipo -create -output dist/macvmagt dist/macvmagt-darwin-arm64 dist/macvmagt-darwin-amd64
+    echo "Built universal binary dist/macvmagt"
+else
+    echo "lipo not found, skipping universal binary (per-arch binaries are in dist/)"
+fi
+
+# With UPDATE_SIGNING_KEY (an Ed25519 private key PEM, e.g. from
+# `openssl genpkey -algorithm ed25519`), also write the latest.json release
+# manifest that `macvmagt update` installs from. Upload it next to the binary.
+# Nodes only install releases newer than theirs; with ROLLBACK=1 the manifest
+# is signed as a rollback, which nodes on newer versions install too.
+if [ -n "$UPDATE_SIGNING_KEY" ] && [ -f dist/macvmagt ]; then
+    SHA256=$(shasum -a 256 dist/macvmagt | cut -d' ' -f1)
+    # pkeyutl needs Ed25519 input as a file (-rawin can't sign from a pipe).
+    if [ "$ROLLBACK" = "1" ]; then
+        printf 'macvmagt %s %s rollback' "$VERSION" "$SHA256" > dist/release.msg
+        ROLLBACK_FIELD=', "rollback": true'
+    else
+        printf 'macvmagt %s %s' "$VERSION" "$SHA256" > dist/release.msg
+        ROLLBACK_FIELD=''
+    fi
+    SIGNATURE=$(openssl pkeyutl -sign -inkey "$UPDATE_SIGNING_KEY" -rawin -in dist/release.msg | base64 | tr -d '\n')
+    rm dist/release.msg
+    printf '{"version": "%s", "url": "macvmagt", "sha256": "%s"%s, "signature": "%s"}\n' "$VERSION" "$SHA256" "$ROLLBACK_FIELD" "$SIGNATURE" > dist/latest.json
+    echo "Wrote signed release manifest dist/latest.json"
+fi